@@ -35,6 +35,9 @@ def create_app():
 
     from webserver.views import auth
     app.register_blueprint(auth.auth_bp)
+
+    from webserver.views import health
+    app.register_blueprint(health.health_bp)
     app.add_url_rule("/", endpoint="index")
 
     jwt = JWTManager(app)
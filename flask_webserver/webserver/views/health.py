@@ -0,0 +1,22 @@
+from flask import Blueprint, jsonify
+from sqlalchemy import text
+
+from webserver import db
+
+health_bp = Blueprint("health", __name__)
+
+
+@health_bp.get("/livez")
+def livez():
+    return "ok\n", 200, {"Content-Type": "text/plain; charset=utf-8"}
+
+
+@health_bp.get("/readyz")
+def readyz():
+    try:
+        with db.engine.connect() as conn:
+            conn.execute(text("SELECT 1"))
+    except Exception as err:
+        return jsonify({"status": "unavailable", "checks": {"database": str(err)}}), 503
+
+    return jsonify({"status": "ok", "checks": {"database": "ok"}})
@@ -0,0 +1,110 @@
+// debug.go - Admin-only profiling and runtime debug endpoints for the gateway
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// ADMIN_TOKEN guards /debug/*; the endpoints are disabled when it is empty.
+var ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+
+type ConnInfo struct {
+	ClientAddr  string `json:"client_addr"`
+	BackendAddr string `json:"backend_local_addr"`
+}
+
+// newDebugHandler serves pprof, a goroutine dump and the binary gateway's
+// connection table. Paths are only reachable with the admin bearer token.
+func newDebugHandler(bg *BinaryGateway) http.Handler {
+	if rate := envInt("PPROF_BLOCK_RATE", 0); rate > 0 {
+		runtime.SetBlockProfileRate(rate)
+	}
+	if fraction := envInt("PPROF_MUTEX_FRACTION", 0); fraction > 0 {
+		runtime.SetMutexProfileFraction(fraction)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/goroutines", handleGoroutineDump)
+	mux.HandleFunc("GET /debug/log-level", handleLogLevel)
+	mux.HandleFunc("PUT /debug/log-level", handleLogLevel)
+	mux.HandleFunc("GET /debug/connections", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		conns := bg.Connections()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"goroutines":       runtime.NumGoroutine(),
+			"heap_alloc":       mem.HeapAlloc,
+			"heap_inuse":       mem.HeapInuse,
+			"num_gc":           mem.NumGC,
+			"connection_count": len(conns),
+			"connections":      conns,
+		})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ADMIN_TOKEN == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) != 1 {
+			http.Error(w, "Admin authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func handleGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+// GET /debug/log-level
+// PUT /debug/log-level  {"component": "forward", "level": "debug"}
+// An empty component applies the level to every component.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			Component string `json:"component"`
+			Level     string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := setLogLevel(req.Component, req.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gatewayLog.InfoContext(r.Context(), "log level changed", "target", req.Component, "level", req.Level)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelSnapshot())
+}
@@ -0,0 +1,203 @@
+// forward.go - Backend-to-client forwarding for binary connections
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Downstream Forwarding
+// ============================================
+
+// readFromBackend reads the backend into buffers sized from the reads before
+// them: a read that fills its buffer doubles the next one, up to
+// GATEWAY_FORWARD_BUFFER_MAX; one that uses under a quarter halves it, down
+// to GATEWAY_FORWARD_BUFFER_MIN, so a connection carrying only ACKs stays
+// small. Each read is handed to the event loop as is. While a write is
+// queued on the loop, further reads collect behind it and go out together
+// with one writev once it is done, so the faster the backend sends, the
+// larger the batches. Past GATEWAY_FORWARD_MAX_PENDING bytes waiting for the
+// loop, the reader stops reading the backend until the loop catches up.
+
+var (
+	GATEWAY_FORWARD_BUFFER_MIN  = envInt("GATEWAY_FORWARD_BUFFER_MIN", 4*1024)
+	GATEWAY_FORWARD_BUFFER_MAX  = envInt("GATEWAY_FORWARD_BUFFER_MAX", 1024*1024)
+	GATEWAY_FORWARD_MAX_PENDING = envInt("GATEWAY_FORWARD_MAX_PENDING", 8*1024*1024)
+)
+
+// logForwardOptions records the effective settings at startup.
+func logForwardOptions() {
+	binaryLog.Info("forward options",
+		"buffer_min", GATEWAY_FORWARD_BUFFER_MIN,
+		"buffer_max", GATEWAY_FORWARD_BUFFER_MAX,
+		"max_pending", GATEWAY_FORWARD_MAX_PENDING)
+}
+
+func (bg *BinaryGateway) readFromBackend(connCtx context.Context, clientConn gnet.Conn, remote string, backendConn net.Conn) {
+	ds := newDownstream(clientConn)
+	size := GATEWAY_FORWARD_BUFFER_MIN
+
+	for {
+		buffer := getForwardBuffer(size)
+		n, err := backendConn.Read(buffer)
+		if err != nil {
+			putForwardBuffer(buffer)
+			// net.ErrClosed: OnClose closed it after the client went away
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				binaryLog.ErrorContext(connCtx, "error reading from backend", "remote", remote, "err", err)
+			}
+			clientConn.Close()
+			return
+		}
+
+		switch {
+		case n == len(buffer):
+			size = min(size*2, GATEWAY_FORWARD_BUFFER_MAX)
+		case n < len(buffer)/4:
+			size = max(size/2, GATEWAY_FORWARD_BUFFER_MIN)
+		}
+		if n == 0 {
+			putForwardBuffer(buffer)
+			continue
+		}
+
+		// Forward response to client
+		if err := ds.send(buffer[:n]); err != nil {
+			binaryLog.ErrorContext(connCtx, "error writing to client", "remote", remote, "err", err)
+			return
+		}
+		binaryBytes.WithLabelValues(DIRECTION_DOWNSTREAM).Add(float64(n))
+		forwardLog.DebugContext(connCtx, "forwarded to client", "bytes", n)
+	}
+}
+
+// downstream queues a client connection's writes for its event loop, one
+// batch at a time.
+type downstream struct {
+	conn gnet.Conn
+
+	mu      sync.Mutex
+	room    *sync.Cond // Signalled when queued bytes are written
+	pending [][]byte   // Reads waiting for the batch in flight
+	queued  int        // Bytes pending or in flight
+	writing bool       // A batch is queued on the event loop
+	err     error      // Set once a write fails; every later send fails
+}
+
+func newDownstream(conn gnet.Conn) *downstream {
+	ds := &downstream{conn: conn}
+	ds.room = sync.NewCond(&ds.mu)
+	return ds
+}
+
+// send queues buf, which belongs to the downstream from then on, waiting
+// while too much is queued already.
+func (ds *downstream) send(buf []byte) error {
+	ds.mu.Lock()
+	for ds.err == nil && ds.queued >= GATEWAY_FORWARD_MAX_PENDING {
+		ds.room.Wait()
+	}
+	if ds.err != nil {
+		ds.mu.Unlock()
+		putForwardBuffer(buf)
+		return ds.err
+	}
+	ds.pending = append(ds.pending, buf)
+	ds.queued += len(buf)
+	if ds.writing {
+		ds.mu.Unlock()
+		return nil // Goes with the next batch
+	}
+	ds.writing = true
+	batch := ds.pending
+	ds.pending = nil
+	ds.mu.Unlock()
+
+	return ds.write(batch)
+}
+
+// write queues batch on the event loop. Its callback recycles the buffers
+// and sends whatever collected meanwhile.
+func (ds *downstream) write(batch [][]byte) error {
+	err := ds.conn.AsyncWritev(batch, func(_ gnet.Conn, err error) error {
+		forwardBatchReads.Observe(float64(len(batch)))
+		written := 0
+		for _, buf := range batch {
+			written += len(buf)
+			putForwardBuffer(buf)
+		}
+
+		ds.mu.Lock()
+		ds.queued -= written
+		if err != nil {
+			ds.fail(err)
+			ds.mu.Unlock()
+			return nil
+		}
+		next := ds.pending
+		ds.pending = nil
+		ds.writing = len(next) > 0
+		ds.room.Broadcast()
+		ds.mu.Unlock()
+
+		if len(next) > 0 {
+			return ds.write(next)
+		}
+		return nil
+	})
+	if err != nil {
+		// The event loop is gone, so the callback never runs
+		for _, buf := range batch {
+			putForwardBuffer(buf)
+		}
+		ds.mu.Lock()
+		ds.fail(err)
+		ds.mu.Unlock()
+	}
+	return err
+}
+
+// fail drops everything queued. Caller holds ds.mu.
+func (ds *downstream) fail(err error) {
+	if ds.err == nil {
+		ds.err = err
+	}
+	for _, buf := range ds.pending {
+		putForwardBuffer(buf)
+	}
+	ds.pending = nil
+	ds.queued = 0
+	ds.writing = false
+	ds.room.Broadcast()
+}
+
+// ============================================
+// Forward Buffers
+// ============================================
+
+// One pool per buffer size, GATEWAY_FORWARD_BUFFER_MIN and its doublings.
+
+var forwardBuffers [32]sync.Pool
+
+func forwardBufferClass(size int) int {
+	return bits.Len(uint(size/GATEWAY_FORWARD_BUFFER_MIN)) - 1
+}
+
+func getForwardBuffer(size int) []byte {
+	if buf, ok := forwardBuffers[forwardBufferClass(size)].Get().(*[]byte); ok && cap(*buf) >= size {
+		return (*buf)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putForwardBuffer(buf []byte) {
+	buf = buf[:cap(buf)]
+	forwardBuffers[forwardBufferClass(len(buf))].Put(&buf)
+}
@@ -0,0 +1,192 @@
+// frames.go - Frame-aware forwarding of the client's binary stream
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Upstream Framing
+// ============================================
+
+// The gateway reads the client's frames out of the connection's inbound
+// buffer, as the file server does, and forwards them frame by frame:
+//
+//	auth_token_size(4) | auth_token | payload_size(4) | command(1) | ...
+//
+// Nothing of a frame is forwarded before its header is complete and checked
+// by admitFrame, the one place for per-command decisions: it names the
+// command for the debug log and counts it. A frame of up to
+// GATEWAY_FRAME_BUFFER_MAX bytes is held until it is complete and goes to the
+// backend with one write. A larger one, in practice a chunk, is streamed as
+// it arrives after its header, so the gateway never holds a whole chunk.
+//
+// A frame that cannot be followed - an auth token over MAX_TOKEN_SIZE or a
+// payload over GATEWAY_MAX_FRAME_SIZE - is answered with RESP_ERROR and the
+// connection closed, as the file server would, without reaching it. Unknown
+// commands and empty payloads are forwarded: the file server answers them in
+// order with the rest of the connection's replies.
+
+var (
+	GATEWAY_FRAME_BUFFER_MAX = envInt("GATEWAY_FRAME_BUFFER_MAX", 64*1024)
+	// The file server's MAX_CHUNK_SIZE and room for the chunk's fields
+	GATEWAY_MAX_FRAME_SIZE = envInt("GATEWAY_MAX_FRAME_SIZE", 1024*1024*1024+64*1024)
+)
+
+const (
+	REJECT_TOKEN_SIZE = "token_size"
+	REJECT_FRAME_SIZE = "frame_size"
+)
+
+var errIncompleteFrame = errors.New("Incomplete frame header")
+
+// frameError is a frame the gateway refuses to forward.
+type frameError struct {
+	reason  string // REJECT_*, for the metric
+	message string // Sent to the client
+	size    int
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("%s (%d bytes)", e.message, e.size)
+}
+
+type frameHeader struct {
+	cmd     byte // 0 for an empty payload
+	token   int  // Auth token size
+	payload int
+}
+
+func (fh frameHeader) size() int {
+	return 4 + fh.token + 4 + fh.payload
+}
+
+// peekFrame reads the header of the next frame in c's inbound buffer without
+// consuming it.
+func peekFrame(c gnet.Conn) (frameHeader, error) {
+	prefix, err := c.Peek(4)
+	if err != nil {
+		return frameHeader{}, errIncompleteFrame
+	}
+	fh := frameHeader{token: int(binary.BigEndian.Uint32(prefix))}
+	if fh.token > MAX_TOKEN_SIZE {
+		return fh, &frameError{reason: REJECT_TOKEN_SIZE, message: "Invalid auth token size", size: fh.token}
+	}
+
+	headerSize := 4 + fh.token + 4
+	header, err := c.Peek(headerSize)
+	if err != nil {
+		return fh, errIncompleteFrame
+	}
+	fh.payload = int(binary.BigEndian.Uint32(header[headerSize-4:]))
+	if fh.payload > GATEWAY_MAX_FRAME_SIZE {
+		return fh, &frameError{reason: REJECT_FRAME_SIZE, message: "Frame too large", size: fh.payload}
+	}
+	if fh.payload > 0 {
+		header, err = c.Peek(headerSize + 1)
+		if err != nil {
+			return fh, errIncompleteFrame
+		}
+		fh.cmd = header[headerSize]
+	}
+	return fh, nil
+}
+
+// forwardFrames forwards every frame, or the part of a streamed one, that is
+// in c's inbound buffer. It returns gnet.Close once the connection cannot go
+// on.
+func (bg *BinaryGateway) forwardFrames(c gnet.Conn, ctx *ClientContext) gnet.Action {
+	for c.InboundBuffered() > 0 {
+		if ctx.streaming > 0 {
+			data, _ := c.Next(min(ctx.streaming, c.InboundBuffered()))
+			if !bg.forward(c, ctx, data) {
+				return gnet.Close
+			}
+			ctx.streaming -= len(data)
+			continue
+		}
+
+		fh, err := peekFrame(c)
+		var frameErr *frameError
+		switch {
+		case errors.As(err, &frameErr):
+			bg.rejectFrame(c, ctx, frameErr)
+			return gnet.Close
+		case err != nil:
+			return gnet.None // Need the rest of the header
+		}
+
+		if fh.size() <= GATEWAY_FRAME_BUFFER_MAX {
+			frame, err := c.Peek(fh.size())
+			if err != nil {
+				return gnet.None // Need the rest of the frame
+			}
+			bg.admitFrame(ctx, fh)
+			ok := bg.forward(c, ctx, frame)
+			c.Discard(fh.size())
+			if !ok {
+				return gnet.Close
+			}
+			continue
+		}
+
+		bg.admitFrame(ctx, fh)
+		ctx.streaming = fh.size()
+	}
+	return gnet.None
+}
+
+// admitFrame is called once per frame, before any of it is forwarded.
+func (bg *BinaryGateway) admitFrame(ctx *ClientContext, fh frameHeader) {
+	binaryFrames.WithLabelValues(commandLabel(fh.cmd)).Inc()
+	forwardLog.DebugContext(ctx.connCtx, "forwarding to backend", "command", commandName(fh.cmd), "frame_bytes", fh.size())
+}
+
+// forward writes data to the backend, reporting whether it could.
+func (bg *BinaryGateway) forward(c gnet.Conn, ctx *ClientContext, data []byte) bool {
+	ctx.mu.Lock()
+	_, err := ctx.backendConn.Write(data)
+	ctx.forwarded += int64(len(data))
+	ctx.mu.Unlock()
+
+	if err != nil {
+		binaryLog.ErrorContext(ctx.connCtx, "error writing to backend", "remote", ctx.remoteAddr, "err", err)
+		return false
+	}
+	binaryBytes.WithLabelValues(DIRECTION_UPSTREAM).Add(float64(len(data)))
+	return true
+}
+
+// rejectFrame answers a frame the gateway cannot follow. The connection is
+// closed after it; replies the backend still owed the client are lost, as
+// when the file server closes a connection over such a frame.
+func (bg *BinaryGateway) rejectFrame(c gnet.Conn, ctx *ClientContext, frameErr *frameError) {
+	binaryFramesRejected.WithLabelValues(frameErr.reason).Inc()
+	binaryLog.WarnContext(ctx.connCtx, "rejected frame", "remote", ctx.remoteAddr, "err", frameErr)
+	c.Write(errorResponse(frameErr.message))
+}
+
+// errorResponse encodes a RESP_ERROR.
+func errorResponse(message string) []byte {
+	message = message[:min(len(message), 0xFF)]
+	return append([]byte{RESP_ERROR, byte(len(message))}, message...)
+}
+
+func commandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+// commandLabel is commandName for metrics, which take only known commands.
+func commandLabel(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "unknown"
+}
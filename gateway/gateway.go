@@ -3,35 +3,38 @@ package main
 
 import (
 	"bytes"
-
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/panjf2000/gnet/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ============================================
 // Configuration
 // ============================================
 
-const (
-	GATEWAY_HTTP_PORT   = ":5000"      // Gateway listens here
-	GATEWAY_BINARY_PORT = ":9090"      // Gateway binary protocol port
-	FLASK_BACKEND       = "http://flask_webserver:5001"  // Flask backend
-	GNET_HTTP_BACKEND   = "http://file_server:8081"  // gnet HTTP APIs
-	GNET_BINARY_BACKEND = "file_server:8081"         // gnet binary protocol
-
-	// Binary protocol commands (must match gnet server)
-	CMD_UPLOAD_CHUNK = 0x01
-	CMD_STREAM_RANGE = 0x02
-	CMD_PING         = 0x03
+// Addresses default to the docker-compose network and can be overridden to
+// run the gateway elsewhere.
+var (
+	GATEWAY_HTTP_PORT   = envString("GATEWAY_HTTP_ADDR", ":5000")                   // Gateway listens here
+	GATEWAY_BINARY_PORT = envString("GATEWAY_BINARY_ADDR", ":9090")                 // Gateway binary protocol port
+	FLASK_BACKEND       = envString("FLASK_BACKEND", "http://flask_webserver:5001") // Flask backend
+	GNET_HTTP_BACKEND   = envString("GNET_HTTP_BACKEND", "http://file_server:8085") // gnet HTTP APIs
+	GNET_BINARY_BACKEND = envString("GNET_BINARY_BACKEND", "file_server:8081")      // gnet binary protocol
 )
 
 // ============================================
@@ -41,34 +44,81 @@ const (
 type HTTPGateway struct {
 	flaskProxy *httputil.ReverseProxy
 	gnetProxy  *httputil.ReverseProxy
+	debug      http.Handler
+	metrics    http.Handler
 }
 
-func NewHTTPGateway() *HTTPGateway {
+func NewHTTPGateway(binaryGateway *BinaryGateway) *HTTPGateway {
 	flaskURL, _ := url.Parse(FLASK_BACKEND)
 	gnetURL, _ := url.Parse(GNET_HTTP_BACKEND)
 
+	flaskProxy := httputil.NewSingleHostReverseProxy(flaskURL)
+	gnetProxy := httputil.NewSingleHostReverseProxy(gnetURL)
+
+	// Inject traceparent headers so backends join the gateway's trace
+	flaskProxy.Transport = otelhttp.NewTransport(http.DefaultTransport)
+	gnetProxy.Transport = otelhttp.NewTransport(http.DefaultTransport)
+
 	return &HTTPGateway{
-		flaskProxy: httputil.NewSingleHostReverseProxy(flaskURL),
-		gnetProxy:  httputil.NewSingleHostReverseProxy(gnetURL),
+		flaskProxy: flaskProxy,
+		gnetProxy:  gnetProxy,
+		debug:      newDebugHandler(binaryGateway),
+		metrics:    promhttp.Handler(),
 	}
 }
 
 func (gw *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Assign a request ID and forward it so backend logs can be correlated
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newCorrelationID()
+		r.Header.Set("X-Request-ID", requestID)
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+	r = r.WithContext(withCorrelationID(r.Context(), "request_id", requestID))
+
 	// Log request
-	log.Printf("📥 HTTP %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	httpLog.InfoContext(r.Context(), "request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
 
 	// Route based on path
+	backend := BACKEND_LOCAL
 	switch {
+	case r.URL.Path == "/livez":
+		handleLivez(w, r)
+
+	case r.URL.Path == "/readyz":
+		handleReadyz(w, r)
+
+	case r.URL.Path == "/metrics":
+		gw.metrics.ServeHTTP(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/debug/"):
+		// Gateway's own admin debug endpoints
+		gw.debug.ServeHTTP(w, r)
+
 	case isGnetHTTPRoute(r.URL.Path):
 		// Route to gnet HTTP server (streaming, internal APIs)
-		log.Printf("→ Routing to gnet HTTP: %s", r.URL.Path)
+		backend = BACKEND_GNET
+		httpLog.DebugContext(r.Context(), "routing request", "path", r.URL.Path, "backend", backend)
 		gw.gnetProxy.ServeHTTP(w, r)
 
 	default:
 		// Route to Flask (auth, metadata, control)
-		log.Printf("→ Routing to Flask: %s", r.URL.Path)
+		backend = BACKEND_FLASK
+		httpLog.DebugContext(r.Context(), "routing request", "path", r.URL.Path, "backend", backend)
 		gw.flaskProxy.ServeHTTP(w, r)
 	}
+
+	observeHTTP(backend, rec.status, start)
 }
 
 func isGnetHTTPRoute(path string) bool {
@@ -77,6 +127,14 @@ func isGnetHTTPRoute(path string) bool {
 		"/stream/",           // Streaming endpoint
 		"/internal/",         // Internal gnet APIs
 		"/health",            // Health check (gnet)
+		"/admin/",            // Admin stats (gnet)
+		"/usage",             // Usage reporting (gnet)
+		"/files",             // User file listing and download (gnet)
+		"/upload/",           // HTTP chunk upload API (gnet)
+		"/exports",           // Bulk export jobs (gnet)
+		"/activity",          // Per-user activity feed (gnet)
+		"/notifications",     // Notification preferences (gnet)
+		"/drop/",             // Anonymous uploads through drop links (gnet)
 	}
 
 	for _, route := range gnetRoutes {
@@ -95,41 +153,78 @@ func isGnetHTTPRoute(path string) bool {
 type BinaryGateway struct {
 	gnet.BuiltinEventEngine
 
+	eng          gnet.Engine
 	gnetBackend  string
 	connPool     map[gnet.Conn]net.Conn // Client conn -> Backend conn
 	connPoolMu   sync.RWMutex
+	tlsConfig    *tls.Config // nil without GATEWAY_BINARY_TLS_ADDR
 }
 
 type ClientContext struct {
 	backendConn net.Conn
 	buffer      []byte
+	remoteAddr  string          // Taken at open; gnet clears c.RemoteAddr() once the client disconnects
+	connCtx     context.Context // Carries the connection's conn_id for logging
+	span        trace.Span      // Spans the lifetime of the proxied connection
+	forwarded   int64
+	streaming   int // Bytes of a frame too large to hold still to forward
 	mu          sync.Mutex
 }
 
 func (bg *BinaryGateway) OnBoot(eng gnet.Engine) (action gnet.Action) {
-	log.Printf("🚀 Binary gateway started on port 9090")
-	log.Printf("🔗 Backend: %s", bg.gnetBackend)
+	bg.eng = eng
+	binaryLog.Info("binary gateway started", "addr", GATEWAY_BINARY_PORT, "backend", bg.gnetBackend)
+	if bg.tlsConfig != nil {
+		go bg.serveTLS(bg.tlsConfig)
+	}
 	return gnet.None
 }
 
 func (bg *BinaryGateway) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	log.Printf("✅ Binary client connected: %s", c.RemoteAddr())
+	connID := newCorrelationID()
+	connCtx := withCorrelationID(context.Background(), "conn_id", connID)
+	remote := c.RemoteAddr().String()
+	if peer, ok := c.Context().(*tlsPeer); ok {
+		remote = peer.remoteAddr // From the TLS port (tls.go)
+	}
+	binaryLog.InfoContext(connCtx, "client connected", "remote", remote)
 
 	// Establish connection to gnet backend
-	backendConn, err := net.DialTimeout("tcp", bg.gnetBackend, 5*time.Second)
+	backendConn, err := dialBackend(bg.gnetBackend)
 	if err != nil {
-		log.Printf("❌ Failed to connect to gnet backend: %v", err)
+		backendDialErrors.Inc()
+		binaryLog.ErrorContext(connCtx, "failed to connect to gnet backend", "backend", bg.gnetBackend, "err", err)
 		return nil, gnet.Close
 	}
 
+	// The binary frame has no room for our ID, but the backend logs our local
+	// address as "remote", which ties the two connections together
+	binaryLog.InfoContext(connCtx, "backend connected", "backend", bg.gnetBackend, "local", backendConn.LocalAddr().String())
+
+	_, span := tracer.Start(connCtx, "binary.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("conn.id", connID),
+			attribute.String("net.peer.addr", remote),
+			attribute.String("backend.addr", bg.gnetBackend),
+		))
+
 	ctx := &ClientContext{
 		backendConn: backendConn,
 		buffer:      make([]byte, 0, 4096),
+		remoteAddr:  remote,
+		connCtx:     connCtx,
+		span:        span,
 	}
 	c.SetContext(ctx)
 
+	bg.connPoolMu.Lock()
+	bg.connPool[c] = backendConn
+	bg.connPoolMu.Unlock()
+	binaryConnections.Inc()
+
 	// Start reading responses from backend
-	go bg.readFromBackend(c, backendConn)
+	go bg.readFromBackend(connCtx, c, remote, backendConn)
 
 	return nil, gnet.None
 }
@@ -137,73 +232,53 @@ func (bg *BinaryGateway) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
 func (bg *BinaryGateway) OnClose(c gnet.Conn, err error) (action gnet.Action) {
 	ctx := c.Context().(*ClientContext)
 
+	bg.connPoolMu.Lock()
+	delete(bg.connPool, c)
+	bg.connPoolMu.Unlock()
+
 	if ctx.backendConn != nil {
 		ctx.backendConn.Close()
-		log.Printf("👋 Closed backend connection for %s", c.RemoteAddr())
+		binaryConnections.Dec()
+		binaryLog.DebugContext(ctx.connCtx, "closed backend connection", "remote", ctx.remoteAddr)
+	}
+
+	if ctx.span != nil {
+		ctx.span.SetAttributes(attribute.Int64("bytes.forwarded", ctx.forwarded))
+		if err != nil {
+			ctx.span.RecordError(err)
+		}
+		ctx.span.End()
 	}
 
 	if err != nil {
-		log.Printf("❌ Client disconnected with error: %v", err)
+		binaryLog.WarnContext(ctx.connCtx, "client disconnected with error", "remote", ctx.remoteAddr, "err", err)
 	} else {
-		log.Printf("👋 Client disconnected: %s", c.RemoteAddr())
+		binaryLog.InfoContext(ctx.connCtx, "client disconnected", "remote", ctx.remoteAddr)
 	}
 
 	return gnet.None
 }
 
-func (bg *BinaryGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	ctx := c.Context().(*ClientContext)
-
-	// Read data from client
-	data, err := c.Next(-1)
-	if err != nil {
-		log.Printf("❌ Error reading from client: %v", err)
-		return gnet.Close
-	}
-
-	// Peek at command to log
-	if len(data) > 0 {
-		cmd := data[0]
-		log.Printf("⚡ Forwarding command 0x%02x (%d bytes) to gnet backend", cmd, len(data))
-	}
-
-	// Forward to gnet backend
-	ctx.mu.Lock()
-	_, err = ctx.backendConn.Write(data)
-	ctx.mu.Unlock()
-
-	if err != nil {
-		log.Printf("❌ Error writing to backend: %v", err)
-		return gnet.Close
+// Connections lists the proxied client/backend connection pairs.
+func (bg *BinaryGateway) Connections() []ConnInfo {
+	bg.connPoolMu.RLock()
+	defer bg.connPoolMu.RUnlock()
+
+	conns := make([]ConnInfo, 0, len(bg.connPool))
+	for client, backend := range bg.connPool {
+		conns = append(conns, ConnInfo{
+			ClientAddr:  client.Context().(*ClientContext).remoteAddr,
+			BackendAddr: backend.LocalAddr().String(),
+		})
 	}
-
-	return gnet.None
+	return conns
 }
 
-func (bg *BinaryGateway) readFromBackend(clientConn gnet.Conn, backendConn net.Conn) {
-	buffer := make([]byte, 64*1024) // 64KB buffer
-
-	for {
-		n, err := backendConn.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("❌ Error reading from backend: %v", err)
-			}
-			clientConn.Close()
-			return
-		}
-
-		if n > 0 {
-			// Forward response to client
-			err = clientConn.AsyncWrite(buffer[:n], nil)
-			if err != nil {
-				log.Printf("❌ Error writing to client: %v", err)
-				return
-			}
+func (bg *BinaryGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
+	ctx := c.Context().(*ClientContext)
 
-			log.Printf("⬅️  Forwarded %d bytes from backend to client", n)
-		}
-	}
+	// Forward complete frames to gnet backend; see frames.go
+	return bg.forwardFrames(c, ctx)
 }
 
 // ============================================
@@ -217,12 +292,12 @@ type SmartBinaryGateway struct {
 }
 
 func (sbg *SmartBinaryGateway) OnBoot(eng gnet.Engine) (action gnet.Action) {
-	log.Printf("🚀 Smart binary gateway started")
+	binaryLog.Info("smart binary gateway started", "backend", sbg.gnetBackend)
 	return gnet.None
 }
 
 func (sbg *SmartBinaryGateway) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	log.Printf("✅ Client connected: %s", c.RemoteAddr())
+	binaryLog.Info("client connected", "remote", c.RemoteAddr().String())
 
 	ctx := &ClientContext{
 		buffer: make([]byte, 0, 4096),
@@ -245,9 +320,9 @@ func (sbg *SmartBinaryGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
 
 	// Lazy connection to backend
 	if ctx.backendConn == nil {
-		backendConn, err := net.DialTimeout("tcp", sbg.gnetBackend, 5*time.Second)
+		backendConn, err := dialBackend(sbg.gnetBackend)
 		if err != nil {
-			log.Printf("❌ Failed to connect to backend: %v", err)
+			binaryLog.Error("failed to connect to backend", "backend", sbg.gnetBackend, "err", err)
 			return gnet.Close
 		}
 
@@ -264,15 +339,10 @@ func (sbg *SmartBinaryGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
 		ctx.mu.Unlock()
 
 		if err != nil {
-			log.Printf("❌ Error forwarding to backend: %v", err)
+			binaryLog.Error("error forwarding to backend", "remote", c.RemoteAddr().String(), "err", err)
 			return gnet.Close
 		}
 
-		// Log command
-		if ctx.buffer[0] == CMD_UPLOAD_CHUNK {
-			log.Printf("⚡ Upload chunk forwarded (%d bytes)", len(ctx.buffer))
-		}
-
 		ctx.buffer = ctx.buffer[:0]
 	}
 
@@ -296,7 +366,7 @@ func (sbg *SmartBinaryGateway) readFromBackend(clientConn gnet.Conn, backendConn
 		n, err := backendConn.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("❌ Backend read error: %v", err)
+				binaryLog.Error("backend read error", "remote", clientConn.RemoteAddr().String(), "err", err)
 			}
 			clientConn.Close()
 			return
@@ -320,7 +390,7 @@ type UnifiedGateway struct {
 }
 
 func (ug *UnifiedGateway) OnBoot(eng gnet.Engine) (action gnet.Action) {
-	log.Printf("🚀 Unified gateway started (auto-detect protocol)")
+	gatewayLog.Info("unified gateway started", "mode", "auto-detect")
 	return gnet.None
 }
 
@@ -350,16 +420,16 @@ func (ug *UnifiedGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
 		var backend string
 		if isHTTP {
 			backend = ug.flaskBackend
-			log.Printf("🔍 Detected HTTP protocol → Flask")
+			gatewayLog.Debug("detected protocol", "protocol", "http", "backend", ug.flaskBackend)
 		} else {
 			backend = ug.gnetBackend
-			log.Printf("🔍 Detected binary protocol → gnet")
+			gatewayLog.Debug("detected protocol", "protocol", "binary", "backend", ug.gnetBackend)
 		}
 
 		// Connect to appropriate backend
-		backendConn, err := net.DialTimeout("tcp", backend, 5*time.Second)
+		backendConn, err := dialBackend(backend)
 		if err != nil {
-			log.Printf("❌ Backend connection failed: %v", err)
+			gatewayLog.Error("backend connection failed", "backend", backend, "err", err)
 			return gnet.Close
 		}
 
@@ -376,7 +446,7 @@ func (ug *UnifiedGateway) OnTraffic(c gnet.Conn) (action gnet.Action) {
 		ctx.mu.Unlock()
 
 		if err != nil {
-			log.Printf("❌ Forward error: %v", err)
+			gatewayLog.Error("forward error", "remote", c.RemoteAddr().String(), "err", err)
 			return gnet.Close
 		}
 
@@ -404,14 +474,7 @@ func (ug *UnifiedGateway) detectHTTP(data []byte) bool {
 		}
 	}
 
-	// Check for binary protocol commands
-	if len(data) > 0 {
-		cmd := data[0]
-		if cmd == CMD_UPLOAD_CHUNK || cmd == CMD_STREAM_RANGE || cmd == CMD_PING {
-			return false
-		}
-	}
-
+	// Anything else is a binary frame, which starts with its token size
 	return false
 }
 
@@ -446,6 +509,11 @@ func (ug *UnifiedGateway) readFromBackend(clientConn gnet.Conn, backendConn net.
 // ============================================
 
 func main() {
+	// Route the standard library logger through the structured handler
+	slog.SetDefault(gatewayLog)
+	logSocketOptions()
+	logForwardOptions()
+
 	// Mode 1: Separate HTTP and Binary gateways
 	mode := "separate" // Options: "separate", "unified"
 
@@ -455,7 +523,7 @@ func main() {
 	case "unified":
 		runUnifiedGateway()
 	default:
-		log.Fatal("Invalid mode")
+		logFatal(gatewayLog, "invalid mode", "mode", mode)
 	}
 }
 
@@ -464,29 +532,59 @@ func main() {
 // ============================================
 
 func runSeparateGateways() {
-	log.Printf("🚀 Starting SEPARATE gateways mode")
-	log.Printf("📡 HTTP Gateway: %s → Flask(%s) / gnet(%s)",
-		GATEWAY_HTTP_PORT, FLASK_BACKEND, GNET_HTTP_BACKEND)
-	log.Printf("⚡ Binary Gateway: %s → gnet(%s)",
-		GATEWAY_BINARY_PORT, GNET_BINARY_BACKEND)
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logFatal(gatewayLog, "failed to initialize tracing", "err", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	// Start HTTP gateway
-	go func() {
-		httpGateway := NewHTTPGateway()
-		log.Printf("🌐 HTTP Gateway listening on %s", GATEWAY_HTTP_PORT)
-		log.Fatal(http.ListenAndServe(GATEWAY_HTTP_PORT, httpGateway))
-	}()
+	gatewayLog.Info("starting separate gateways mode",
+		"http_addr", GATEWAY_HTTP_PORT,
+		"flask_backend", FLASK_BACKEND,
+		"gnet_http_backend", GNET_HTTP_BACKEND,
+		"binary_addr", GATEWAY_BINARY_PORT,
+		"gnet_binary_backend", GNET_BINARY_BACKEND)
+
+	certs, err := newCertSource()
+	if err != nil {
+		logFatal(gatewayLog, "failed to load TLS certificates", "err", err)
+	}
+	if GATEWAY_HTTPS_PORT != "" && certs == nil {
+		logFatal(httpLog, "GATEWAY_HTTPS_ADDR needs GATEWAY_TLS_CERT and GATEWAY_TLS_KEY, or GATEWAY_ACME_DOMAINS")
+	}
+	tlsConfig, err := loadBinaryTLSConfig(certs)
+	if err != nil {
+		logFatal(binaryLog, "failed to configure binary TLS", "err", err)
+	}
 
-	// Start Binary gateway
 	binaryGateway := &BinaryGateway{
 		gnetBackend: GNET_BINARY_BACKEND,
 		connPool:    make(map[gnet.Conn]net.Conn),
+		tlsConfig:   tlsConfig,
+	}
+
+	// Start HTTP gateway, and HTTPS if configured (https.go)
+	httpHandler := otelhttp.NewHandler(NewHTTPGateway(binaryGateway), "gateway-http")
+	go func() {
+		httpLog.Info("HTTP gateway listening", "addr", GATEWAY_HTTP_PORT)
+		err := http.ListenAndServe(GATEWAY_HTTP_PORT, certs.httpHandler(httpHandler))
+		logFatal(httpLog, "HTTP gateway stopped", "err", err)
+	}()
+	if GATEWAY_HTTPS_PORT != "" {
+		go func() {
+			err := serveHTTPS(httpHandler, certs)
+			logFatal(httpLog, "HTTPS gateway stopped", "err", err)
+		}()
 	}
 
-	log.Fatal(gnet.Run(binaryGateway, fmt.Sprintf("tcp://%s", GATEWAY_BINARY_PORT),
-		gnet.WithMulticore(true),
-		gnet.WithEdgeTriggeredIO(true),
-		gnet.WithReusePort(true)))
+	go binaryGateway.drainOnSignal()
+
+	// Start Binary gateway
+	err = gnet.Run(binaryGateway, fmt.Sprintf("tcp://%s", GATEWAY_BINARY_PORT), gnetOptions()...)
+	if err != nil {
+		logFatal(binaryLog, "binary gateway stopped", "err", err)
+	}
+	gatewayLog.Info("gateway stopped")
 }
 
 // ============================================
@@ -494,8 +592,7 @@ func runSeparateGateways() {
 // ============================================
 
 func runUnifiedGateway() {
-	log.Printf("🚀 Starting UNIFIED gateway mode (auto-detect)")
-	log.Printf("📡 Listening on %s", GATEWAY_HTTP_PORT)
+	gatewayLog.Info("starting unified gateway mode", "addr", GATEWAY_HTTP_PORT)
 
 	// This gateway auto-detects HTTP vs Binary protocol
 	unifiedGateway := &UnifiedGateway{
@@ -503,8 +600,6 @@ func runUnifiedGateway() {
 		gnetBackend:  GNET_BINARY_BACKEND,
 	}
 
-	log.Fatal(gnet.Run(unifiedGateway, fmt.Sprintf("tcp://%s", GATEWAY_HTTP_PORT),
-		gnet.WithMulticore(true),
-		gnet.WithEdgeTriggeredIO(true),
-		gnet.WithReusePort(true)))
+	err := gnet.Run(unifiedGateway, fmt.Sprintf("tcp://%s", GATEWAY_HTTP_PORT), gnetOptions()...)
+	logFatal(gatewayLog, "unified gateway stopped", "err", err)
 }
@@ -0,0 +1,121 @@
+// health.go - Liveness/readiness probes and graceful draining for the gateway
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ============================================
+// Probes
+// ============================================
+
+const (
+	PROBE_TIMEOUT = 2 * time.Second
+	DRAIN_TIMEOUT = 5 * time.Minute // Max wait for proxied uploads on SIGTERM
+)
+
+// draining is set on SIGTERM so /readyz fails while open connections finish.
+var draining atomic.Bool
+
+var probeClient = &http.Client{Timeout: PROBE_TIMEOUT}
+
+// GET /livez
+// The gateway process is up. Backends are deliberately not consulted.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz
+// Ready when not draining, the file server reports ready (S3 and session
+// store reachable) and its binary port accepts connections.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if draining.Load() {
+		checks["draining"] = "gateway is draining"
+		ready = false
+	} else {
+		checks["draining"] = "ok"
+	}
+
+	if err := probeFileServer(r.Context()); err != nil {
+		checks["file_server"] = err.Error()
+		ready = false
+	} else {
+		checks["file_server"] = "ok"
+	}
+
+	if conn, err := net.DialTimeout("tcp", GNET_BINARY_BACKEND, PROBE_TIMEOUT); err != nil {
+		checks["file_server_binary"] = err.Error()
+		ready = false
+	} else {
+		conn.Close()
+		checks["file_server_binary"] = "ok"
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+		httpLog.WarnContext(r.Context(), "readiness check failing", "checks", checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func probeFileServer(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, GNET_HTTP_BACKEND+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("file server not ready: %s", resp.Status)
+	}
+	return nil
+}
+
+// drainOnSignal marks the gateway as draining on SIGTERM/SIGINT, waits for
+// proxied binary connections to close (at most DRAIN_TIMEOUT), then stops
+// the binary event loop.
+func (bg *BinaryGateway) drainOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+
+	draining.Store(true)
+	gatewayLog.Info("draining", "signal", sig.String(), "connections", len(bg.Connections()), "timeout", DRAIN_TIMEOUT)
+
+	deadline := time.Now().Add(DRAIN_TIMEOUT)
+	for len(bg.Connections()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := bg.eng.Stop(ctx); err != nil {
+		logFatal(binaryLog, "failed to stop binary gateway", "err", err)
+	}
+}
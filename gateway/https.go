@@ -0,0 +1,208 @@
+// https.go - HTTPS for the HTTP gateway, with certificate reload and ACME
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ============================================
+// HTTPS
+// ============================================
+
+// With GATEWAY_HTTPS_ADDR set the HTTP gateway also serves HTTPS there, so it
+// can face the internet without a TLS proxy in front; the plaintext
+// GATEWAY_HTTP_ADDR stays up. Requests keep their routing and gain
+// X-Forwarded-Proto on the way to the backends.
+//
+// Certificates come from one of two places, shared with the binary TLS port
+// (tls.go):
+//
+//   - GATEWAY_TLS_CERT and GATEWAY_TLS_KEY, PEM files. They are read again on
+//     SIGHUP, and when either file's modification time changes (checked every
+//     GATEWAY_TLS_RELOAD_SECONDS), so a renewed certificate is picked up
+//     without a restart. A pair that fails to load is logged and the previous
+//     one kept; handshakes in progress finish with the certificate they
+//     started with.
+//   - ACME (Let's Encrypt) for the comma-separated GATEWAY_ACME_DOMAINS, which
+//     takes precedence. Certificates are obtained on the first handshake for a
+//     domain, renewed before they expire and kept in GATEWAY_ACME_CACHE_DIR.
+//     The TLS-ALPN-01 challenge is answered on the HTTPS port and HTTP-01 on
+//     GATEWAY_HTTP_ADDR, so one of them must be reachable on 443 or 80.
+//     GATEWAY_ACME_EMAIL is the account's contact and GATEWAY_ACME_DIRECTORY
+//     replaces Let's Encrypt's production directory, e.g. with staging.
+//     Using it accepts the CA's terms of service.
+
+var (
+	GATEWAY_HTTPS_PORT     = envString("GATEWAY_HTTPS_ADDR", "")
+	GATEWAY_TLS_CERT       = envString("GATEWAY_TLS_CERT", "")
+	GATEWAY_TLS_KEY        = envString("GATEWAY_TLS_KEY", "")
+	GATEWAY_TLS_RELOAD     = time.Duration(envInt("GATEWAY_TLS_RELOAD_SECONDS", 10)) * time.Second
+	GATEWAY_ACME_DOMAINS   = envString("GATEWAY_ACME_DOMAINS", "")
+	GATEWAY_ACME_EMAIL     = envString("GATEWAY_ACME_EMAIL", "")
+	GATEWAY_ACME_CACHE_DIR = envString("GATEWAY_ACME_CACHE_DIR", "/data/acme")
+	GATEWAY_ACME_DIRECTORY = envString("GATEWAY_ACME_DIRECTORY", autocert.DefaultACMEDirectory)
+)
+
+// certSource supplies the gateway's TLS certificates.
+type certSource struct {
+	files *certFiles
+	acme  *autocert.Manager
+}
+
+// newCertSource returns nil when neither ACME nor certificate files are
+// configured.
+func newCertSource() (*certSource, error) {
+	if GATEWAY_ACME_DOMAINS != "" {
+		var domains []string
+		for _, domain := range strings.Split(GATEWAY_ACME_DOMAINS, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(GATEWAY_ACME_CACHE_DIR),
+			Email:      GATEWAY_ACME_EMAIL,
+			Client:     &acme.Client{DirectoryURL: GATEWAY_ACME_DIRECTORY},
+		}
+		gatewayLog.Info("TLS certificates from ACME", "domains", domains, "directory", GATEWAY_ACME_DIRECTORY, "cache", GATEWAY_ACME_CACHE_DIR)
+		return &certSource{acme: manager}, nil
+	}
+
+	if GATEWAY_TLS_CERT == "" && GATEWAY_TLS_KEY == "" {
+		return nil, nil
+	}
+	if GATEWAY_TLS_CERT == "" || GATEWAY_TLS_KEY == "" {
+		return nil, errors.New("GATEWAY_TLS_CERT and GATEWAY_TLS_KEY must be set together")
+	}
+	files, err := newCertFiles(GATEWAY_TLS_CERT, GATEWAY_TLS_KEY)
+	if err != nil {
+		return nil, err
+	}
+	go files.reloadLoop()
+	return &certSource{files: files}, nil
+}
+
+// tlsConfig is a server config that picks certificates from cs.
+func (cs *certSource) tlsConfig() *tls.Config {
+	if cs.acme != nil {
+		return cs.acme.TLSConfig() // Adds the acme-tls/1 protocol for TLS-ALPN-01
+	}
+	return &tls.Config{GetCertificate: cs.files.GetCertificate, MinVersion: tls.VersionTLS12}
+}
+
+// httpHandler answers ACME HTTP-01 challenges in front of h.
+func (cs *certSource) httpHandler(h http.Handler) http.Handler {
+	if cs == nil || cs.acme == nil {
+		return h
+	}
+	return cs.acme.HTTPHandler(h)
+}
+
+// serveHTTPS serves h on GATEWAY_HTTPS_ADDR until the listener fails.
+func serveHTTPS(h http.Handler, certs *certSource) error {
+	cfg := certs.tlsConfig()
+	cfg.NextProtos = append(cfg.NextProtos, "h2", "http/1.1")
+	server := &http.Server{Addr: GATEWAY_HTTPS_PORT, Handler: h, TLSConfig: cfg}
+	httpLog.Info("HTTPS gateway listening", "addr", GATEWAY_HTTPS_PORT)
+	return server.ListenAndServeTLS("", "")
+}
+
+// ============================================
+// Certificate Files
+// ============================================
+
+// certFiles is a certificate and key loaded from PEM files and loaded again
+// when they change.
+type certFiles struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest of the two files' when last loaded
+}
+
+func newCertFiles(certPath, keyPath string) (*certFiles, error) {
+	cf := &certFiles{certPath: certPath, keyPath: keyPath}
+	if err := cf.load(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (cf *certFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.cert, nil
+}
+
+func (cf *certFiles) load() error {
+	modTime, err := cf.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cf.certPath, cf.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	cf.mu.Lock()
+	cf.cert = &cert
+	cf.modTime = modTime
+	cf.mu.Unlock()
+	gatewayLog.Info("loaded TLS certificate", "cert", cf.certPath, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (cf *certFiles) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cf.certPath, cf.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reloadLoop loads the files again on SIGHUP or once they change.
+func (cf *certFiles) reloadLoop() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(GATEWAY_TLS_RELOAD)
+	defer ticker.Stop()
+
+	tried := cf.modTime // A pair that failed is not tried again until it changes
+	for {
+		select {
+		case <-hup:
+			gatewayLog.Info("reloading TLS certificate", "signal", "SIGHUP")
+		case <-ticker.C:
+			modTime, err := cf.latestModTime()
+			if err != nil || modTime.Equal(tried) {
+				continue
+			}
+			tried = modTime
+		}
+		if err := cf.load(); err != nil {
+			gatewayLog.Error("failed to reload TLS certificate, keeping the previous one", "cert", cf.certPath, "err", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// metrics.go - Prometheus metrics for the gateway
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ============================================
+// Metrics
+// ============================================
+
+// Names, help text and labels mirror the gateway entries in the file server's
+// metric catalog (gnet-backend/metrics/catalog.go), which the Grafana
+// dashboards are generated from. Change both together.
+
+const (
+	BACKEND_FLASK = "flask"
+	BACKEND_GNET  = "gnet"
+	BACKEND_LOCAL = "local" // Served by the gateway itself
+
+	DIRECTION_UPSTREAM   = "upstream"
+	DIRECTION_DOWNSTREAM = "downstream"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_http_requests_total",
+		Help: "HTTP requests handled, by backend (flask, gnet, local) and status code.",
+	}, []string{"backend", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_http_request_seconds",
+		Help:    "HTTP request latency including the backend round trip, by backend.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	binaryConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_binary_connections_active",
+		Help: "Proxied binary protocol connections currently open.",
+	})
+
+	binaryBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_binary_bytes_forwarded_total",
+		Help: "Bytes forwarded on binary connections, by direction (upstream, downstream).",
+	}, []string{"direction"})
+
+	binaryFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_binary_frames_total",
+		Help: "Binary protocol frames forwarded to the file server, by command.",
+	}, []string{"command"})
+
+	binaryFramesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_binary_frames_rejected_total",
+		Help: "Binary protocol frames refused by the gateway, by reason (token_size, frame_size).",
+	}, []string{"reason"})
+
+	tlsHandshakeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_tls_handshake_failures_total",
+		Help: "Connections to the binary TLS port closed because the TLS handshake failed.",
+	})
+
+	backendDialErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_backend_dial_errors_total",
+		Help: "Failed connection attempts to the file server's binary port.",
+	})
+
+	forwardBatchReads = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gateway_binary_forward_batch_reads",
+		Help:    "Backend reads written to a client with one writev.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10), // 1 .. 512
+	})
+)
+
+// statusRecorder captures the status code written by a handler or proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets the proxy hijack the connection for WebSocket upgrades.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Flush keeps streamed responses from the file server unbuffered.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func observeHTTP(backend string, status int, start time.Time) {
+	httpRequests.WithLabelValues(backend, strconv.Itoa(status)).Inc()
+	httpDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+}
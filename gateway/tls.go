@@ -0,0 +1,157 @@
+// tls.go - TLS listener for the binary gateway
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Binary TLS
+// ============================================
+
+// Like the file server's binary port (gnet-backend/tls.go), the gateway's
+// GATEWAY_BINARY_ADDR is plaintext. With GATEWAY_BINARY_TLS_ADDR set it also
+// accepts TLS there, with the HTTPS port's certificates (https.go); with
+// GATEWAY_TLS_CLIENT_CA set, only from clients with a certificate signed by
+// one of its CAs. The decrypted stream reaches the event loops through a
+// socketpair and is forwarded like any other client's, frame by frame. Bind
+// GATEWAY_BINARY_ADDR to loopback to accept only TLS. The gateway's own
+// connections to the file server stay plaintext.
+
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var (
+	GATEWAY_BINARY_TLS_PORT = envString("GATEWAY_BINARY_TLS_ADDR", "")
+	GATEWAY_TLS_CLIENT_CA   = envString("GATEWAY_TLS_CLIENT_CA", "")
+)
+
+// tlsPeer is the gnet context a TLS connection's socket is registered with,
+// until OnOpen replaces it.
+type tlsPeer struct {
+	remoteAddr string
+}
+
+// loadBinaryTLSConfig builds the binary TLS listener's config, or returns
+// nil when GATEWAY_BINARY_TLS_ADDR is not set.
+func loadBinaryTLSConfig(certs *certSource) (*tls.Config, error) {
+	if GATEWAY_BINARY_TLS_PORT == "" {
+		return nil, nil
+	}
+	if certs == nil {
+		return nil, errors.New("GATEWAY_BINARY_TLS_ADDR needs GATEWAY_TLS_CERT and GATEWAY_TLS_KEY, or GATEWAY_ACME_DOMAINS")
+	}
+	cfg := certs.tlsConfig()
+
+	if GATEWAY_TLS_CLIENT_CA != "" {
+		pem, err := os.ReadFile(GATEWAY_TLS_CLIENT_CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", GATEWAY_TLS_CLIENT_CA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serveTLS accepts TLS connections on GATEWAY_BINARY_TLS_ADDR until the
+// listener fails.
+func (bg *BinaryGateway) serveTLS(cfg *tls.Config) {
+	ln, err := net.Listen("tcp", GATEWAY_BINARY_TLS_PORT)
+	if err != nil {
+		logFatal(binaryLog, "failed to listen for TLS", "addr", GATEWAY_BINARY_TLS_PORT, "err", err)
+	}
+	binaryLog.Info("binary TLS gateway listening", "addr", GATEWAY_BINARY_TLS_PORT, "client_certs", cfg.ClientAuth == tls.RequireAndVerifyClientCert)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logFatal(binaryLog, "binary TLS listener stopped", "addr", GATEWAY_BINARY_TLS_PORT, "err", err)
+		}
+		go bg.handleTLS(tls.Server(conn, cfg))
+	}
+}
+
+func (bg *BinaryGateway) handleTLS(conn *tls.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		binaryLog.Debug("TLS handshake failed", "remote", remote, "err", err)
+		tlsHandshakeFailures.Inc()
+		return
+	}
+
+	local, err := bg.registerSocket(remote)
+	if err != nil {
+		binaryLog.Error("failed to register TLS connection", "remote", remote, "err", err)
+		return
+	}
+	defer local.Close()
+
+	// Either side closing ends both
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// registerSocket hands one end of a new socketpair to the event loops, as a
+// connection from remote, and returns the other.
+func (bg *BinaryGateway) registerSocket(remote string) (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local, err := fileConn(fds[0])
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+	loop, err := fileConn(fds[1])
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	// gnet duplicates the socket, so this one is closed either way
+	defer loop.Close()
+
+	ctx := gnet.NewNetConnContext(gnet.NewContext(context.Background(), &tlsPeer{remoteAddr: remote}), loop)
+	registered, err := bg.eng.Register(ctx)
+	if err == nil {
+		err = (<-registered).Err
+	}
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	return local, nil
+}
+
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "socketpair")
+	defer f.Close()
+	return net.FileConn(f)
+}
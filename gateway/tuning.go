@@ -0,0 +1,126 @@
+// tuning.go - Socket options for client and backend connections
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Socket Tuning
+// ============================================
+
+// The same options as the file server's binary port (gnet-backend/tuning.go),
+// applied to the gateway's listener and to its connections to the backends.
+// Chunks pass through twice, client to gateway and gateway to backend, so a
+// setting that helps one leg usually belongs on both.
+
+var (
+	// SO_RCVBUF / SO_SNDBUF; 0 keeps the kernel's autotuning. Raise them
+	// for links with a large bandwidth-delay product.
+	GATEWAY_SOCKET_RECV_BUFFER = envInt("GATEWAY_SOCKET_RECV_BUFFER", 0)
+	GATEWAY_SOCKET_SEND_BUFFER = envInt("GATEWAY_SOCKET_SEND_BUFFER", 0)
+
+	// TCP_NODELAY: replies and small commands are not held back waiting for
+	// the peer's delayed ACK.
+	GATEWAY_TCP_NODELAY = envBool("GATEWAY_TCP_NODELAY", true)
+
+	// TCP keep-alive, in seconds; 0 turns it off. Without it a client that
+	// vanished without a FIN kept its connection, and the backend connection
+	// paired with it, open indefinitely. GATEWAY_TCP_KEEPINTVL 0 is a fifth
+	// of GATEWAY_TCP_KEEPALIVE.
+	GATEWAY_TCP_KEEPALIVE = envInt("GATEWAY_TCP_KEEPALIVE", 60)
+	GATEWAY_TCP_KEEPINTVL = envInt("GATEWAY_TCP_KEEPINTVL", 0)
+	GATEWAY_TCP_KEEPCNT   = envInt("GATEWAY_TCP_KEEPCNT", 5)
+)
+
+func envBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func keepAliveInterval() time.Duration {
+	if GATEWAY_TCP_KEEPINTVL > 0 {
+		return time.Duration(GATEWAY_TCP_KEEPINTVL) * time.Second
+	}
+	return time.Duration(GATEWAY_TCP_KEEPALIVE) * time.Second / 5
+}
+
+// gnetOptions is the option set for the gateway's listener.
+func gnetOptions() []gnet.Option {
+	opts := []gnet.Option{
+		gnet.WithMulticore(true),
+		gnet.WithEdgeTriggeredIO(true),
+		gnet.WithReusePort(true),
+	}
+	if GATEWAY_SOCKET_RECV_BUFFER > 0 {
+		opts = append(opts, gnet.WithSocketRecvBuffer(GATEWAY_SOCKET_RECV_BUFFER))
+	}
+	if GATEWAY_SOCKET_SEND_BUFFER > 0 {
+		opts = append(opts, gnet.WithSocketSendBuffer(GATEWAY_SOCKET_SEND_BUFFER))
+	}
+	if GATEWAY_TCP_NODELAY {
+		opts = append(opts, gnet.WithTCPNoDelay(gnet.TCPNoDelay))
+	} else {
+		opts = append(opts, gnet.WithTCPNoDelay(gnet.TCPDelay))
+	}
+	if GATEWAY_TCP_KEEPALIVE > 0 {
+		opts = append(opts,
+			gnet.WithTCPKeepAlive(time.Duration(GATEWAY_TCP_KEEPALIVE)*time.Second),
+			gnet.WithTCPKeepInterval(keepAliveInterval()),
+			gnet.WithTCPKeepCount(GATEWAY_TCP_KEEPCNT))
+	}
+	if GATEWAY_BINARY_TLS_PORT != "" {
+		// Round robin races with connections registered from outside the
+		// event loops (tls.go)
+		opts = append(opts, gnet.WithLoadBalancing(gnet.LeastConnections))
+	}
+	return opts
+}
+
+// dialBackend connects to a backend with the gateway's socket options.
+func dialBackend(addr string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: 5 * time.Second,
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   GATEWAY_TCP_KEEPALIVE > 0,
+			Idle:     time.Duration(GATEWAY_TCP_KEEPALIVE) * time.Second,
+			Interval: keepAliveInterval(),
+			Count:    GATEWAY_TCP_KEEPCNT,
+		},
+	}
+	if GATEWAY_TCP_KEEPALIVE <= 0 {
+		dialer.KeepAlive = -1
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := conn.(*net.TCPConn)
+	tcp.SetNoDelay(GATEWAY_TCP_NODELAY)
+	if GATEWAY_SOCKET_RECV_BUFFER > 0 {
+		tcp.SetReadBuffer(GATEWAY_SOCKET_RECV_BUFFER)
+	}
+	if GATEWAY_SOCKET_SEND_BUFFER > 0 {
+		tcp.SetWriteBuffer(GATEWAY_SOCKET_SEND_BUFFER)
+	}
+	return conn, nil
+}
+
+// logSocketOptions records the effective settings at startup.
+func logSocketOptions() {
+	gatewayLog.Info("socket options",
+		"socket_recv_buffer", GATEWAY_SOCKET_RECV_BUFFER,
+		"socket_send_buffer", GATEWAY_SOCKET_SEND_BUFFER,
+		"tcp_nodelay", GATEWAY_TCP_NODELAY,
+		"tcp_keepalive", GATEWAY_TCP_KEEPALIVE,
+		"tcp_keepintvl", keepAliveInterval().Seconds(),
+		"tcp_keepcnt", GATEWAY_TCP_KEEPCNT)
+}
@@ -0,0 +1,299 @@
+// acl.go - Access to a user's files granted to other users
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Access Grants
+// ============================================
+
+// A user's files live under their own prefix and only they can reach them;
+// a share (shares.go) hands one file to anyone with the link. A grant gives
+// another user of the same tenant access to a file or a folder, with their
+// own token, until the owner revokes it:
+//
+//	POST   /files/grants                       {"path", "user_id", "access"}
+//	GET    /files/grants                       {"granted": [...], "received": [...]}
+//	DELETE /files/grants?path=...&user_id=...  revoke
+//	GET    /files?prefix=...                   list what the caller can read under prefix
+//
+// The path is a key, or a prefix ending in "/" that covers every key under
+// it, including ones uploaded later. "read" access lets the grantee list the
+// files, read their metadata, download them and get streaming tokens for
+// them; "write" also lets them tag files and move them to the owner's trash.
+// Granting the same path to the same user again changes the access.
+//
+// Files stay their owner's: uploads still go under the uploader's own
+// prefix, deletions free the owner's storage, and a grantee's downloads count
+// towards the grantee's streamed bytes in /usage.
+//
+// Grants are kept in the metadata store (metadata.go) and need METADATA_DB.
+
+const (
+	ACCESS_READ  = "read"
+	ACCESS_WRITE = "write"
+)
+
+var errGrantNotFound = errors.New("Grant not found")
+
+type Grant struct {
+	Path      string    `json:"path"`
+	Owner     string    `json:"owner"`
+	UserID    string    `json:"user_id"`
+	Access    string    `json:"access"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// covers reports whether the grant reaches key.
+func (g *Grant) covers(key string) bool {
+	if strings.HasSuffix(g.Path, "/") {
+		return strings.HasPrefix(key, g.Path)
+	}
+	return key == g.Path
+}
+
+// allows reports whether the grant gives access, read or write.
+func (g *Grant) allows(access string) bool {
+	return g.Access == ACCESS_WRITE || access == ACCESS_READ
+}
+
+func (hs *HTTPServer) registerGrantRoutes() {
+	hs.mux.HandleFunc("POST /files/grants", hs.handleGrantAccess)
+	hs.mux.HandleFunc("GET /files/grants", hs.handleListGrants)
+	hs.mux.HandleFunc("DELETE /files/grants", hs.handleRevokeAccess)
+}
+
+// POST /files/grants
+func (hs *HTTPServer) handleGrantAccess(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var grant Grant
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&grant); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if !strings.HasPrefix(grant.Path, tokenInfo.UserID+"/") {
+		writeJSONError(w, http.StatusForbidden, "File does not belong to user")
+		return
+	}
+	if grant.Access != ACCESS_READ && grant.Access != ACCESS_WRITE {
+		writeJSONError(w, http.StatusBadRequest, `access must be "read" or "write"`)
+		return
+	}
+	// A user ID is exactly what a key of theirs starts with
+	if grant.UserID == "" || keyOwner(grant.UserID+"/") != grant.UserID {
+		writeJSONError(w, http.StatusBadRequest, "Invalid user_id")
+		return
+	}
+	if grant.UserID == tokenInfo.UserID {
+		writeJSONError(w, http.StatusBadRequest, "Cannot grant access to yourself")
+		return
+	}
+	if hs.uploads.tenantOf(grant.UserID) != tokenInfo.Tenant || (tokenInfo.Tenant == nil && strings.HasPrefix(grant.UserID, TENANT_KEY_ROOT)) {
+		writeJSONError(w, http.StatusBadRequest, "Access can only be granted within a tenant")
+		return
+	}
+
+	grant.Owner = tokenInfo.UserID
+	grant.CreatedAt = time.Now().UTC()
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.PutGrant(r.Context(), &grant)) {
+		return
+	}
+	auditLog.Record(AUDIT_ACCESS_GRANTED, tokenInfo.UserID, "", r.RemoteAddr, grant.Access+" "+grant.Path+" -> "+grant.UserID)
+	httpLog.InfoContext(r.Context(), "granted access", "path", grant.Path, "grantee", grant.UserID, "access", grant.Access)
+
+	writeJSON(w, http.StatusCreated, grant)
+}
+
+// GET /files/grants
+func (hs *HTTPServer) handleListGrants(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	granted, err := hs.uploads.metadata.ListGrants(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	received, err := hs.uploads.metadata.GrantsTo(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"granted": granted, "received": received})
+}
+
+// DELETE /files/grants?path=...&user_id=...
+func (hs *HTTPServer) handleRevokeAccess(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	path, grantee := r.URL.Query().Get("path"), r.URL.Query().Get("user_id")
+	err := hs.uploads.metadata.DeleteGrant(r.Context(), tokenInfo.UserID, path, grantee)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	auditLog.Record(AUDIT_ACCESS_REVOKED, tokenInfo.UserID, "", r.RemoteAddr, path+" -> "+grantee)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize reports whether userID may access key, their own or granted to
+// them, answering the request itself if not.
+func (hs *HTTPServer) authorize(w http.ResponseWriter, r *http.Request, userID, key, access string) bool {
+	if strings.HasPrefix(key, userID+"/") {
+		return true
+	}
+	grants, err := hs.uploads.metadata.GrantsTo(r.Context(), userID)
+	if err != nil && !errors.Is(err, errMetadataDisabled) {
+		httpLog.ErrorContext(r.Context(), "failed to read grants", "user_id", userID, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check access")
+		return false
+	}
+	for _, grant := range grants {
+		if grant.covers(key) && grant.allows(access) {
+			return true
+		}
+	}
+	writeJSONError(w, http.StatusForbidden, "File does not belong to user")
+	return false
+}
+
+// listGrantedFiles answers GET /files?prefix= for a prefix outside the
+// caller's own, with the files under it that grants let them read.
+func (hs *HTTPServer) listGrantedFiles(w http.ResponseWriter, r *http.Request, userID, prefix string) {
+	grants, err := hs.uploads.metadata.GrantsTo(r.Context(), userID)
+	if err != nil && !errors.Is(err, errMetadataDisabled) {
+		httpLog.ErrorContext(r.Context(), "failed to read grants", "user_id", userID, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check access")
+		return
+	}
+
+	// A grant covering the whole prefix lists it once; narrower ones list
+	// only their own paths
+	var paths []string
+	for _, grant := range grants {
+		if grant.covers(prefix) {
+			paths = []string{prefix}
+			break
+		}
+		if strings.HasPrefix(grant.Path, prefix) {
+			paths = append(paths, grant.Path)
+		}
+	}
+	if len(paths) == 0 {
+		writeJSONError(w, http.StatusForbidden, "Prefix does not belong to user")
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+	files := make([]FileSummary, 0)
+	seen := make(map[string]bool)
+	truncated := false
+	for _, path := range paths {
+		listed, more, cached := s3Client.listings.Get(path)
+		if fresh || !cached {
+			generation := s3Client.listings.Generation()
+			if listed, more, err = listFiles(r.Context(), s3Client, path); err != nil {
+				s3Log.ErrorContext(r.Context(), "failed to list granted files", "user_id", userID, "prefix", path, "err", err)
+				writeJSONError(w, http.StatusBadGateway, "Failed to list files")
+				return
+			}
+			s3Client.listings.Put(path, generation, listed, more)
+		}
+		truncated = truncated || more
+		for _, file := range listed {
+			if seen[file.Key] || !slices.ContainsFunc(grants, func(g Grant) bool { return g.covers(file.Key) }) {
+				continue
+			}
+			seen[file.Key] = true
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].LastModified.After(files[j].LastModified) })
+	if len(files) > FILES_LIST_MAX {
+		files, truncated = files[:FILES_LIST_MAX], true
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files":     files,
+		"truncated": truncated,
+		"sessions":  []SessionSummary{},
+	})
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) PutGrant(ctx context.Context, grant *Grant) error {
+	return ms.db.QueryRowContext(ctx, `
+		INSERT INTO grants (path, grantee, owner, access, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (path, grantee) DO UPDATE SET access = excluded.access
+		RETURNING created_at`,
+		grant.Path, grant.UserID, grant.Owner, grant.Access, grant.CreatedAt).Scan(&grant.CreatedAt)
+}
+
+func (ms *sqlMetadataStore) ListGrants(ctx context.Context, owner string) ([]Grant, error) {
+	return ms.queryGrants(ctx, `WHERE owner = $1`, owner)
+}
+
+func (ms *sqlMetadataStore) GrantsTo(ctx context.Context, userID string) ([]Grant, error) {
+	return ms.queryGrants(ctx, `WHERE grantee = $1`, userID)
+}
+
+func (ms *sqlMetadataStore) queryGrants(ctx context.Context, where, arg string) ([]Grant, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT path, grantee, owner, access, created_at FROM grants `+where+`
+		ORDER BY created_at DESC`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := make([]Grant, 0)
+	for rows.Next() {
+		var grant Grant
+		if err := rows.Scan(&grant.Path, &grant.UserID, &grant.Owner, &grant.Access, &grant.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func (ms *sqlMetadataStore) DeleteGrant(ctx context.Context, owner, path, userID string) error {
+	result, err := ms.db.ExecContext(ctx, `DELETE FROM grants WHERE path = $1 AND grantee = $2 AND owner = $3`, path, userID, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errGrantNotFound
+	}
+	return nil
+}
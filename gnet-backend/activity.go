@@ -0,0 +1,288 @@
+// activity.go - What happened to each user's files, for the user to see
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Activity Feed
+// ============================================
+
+// The audit log (audit.go) is for operators, exported in bulk. Users get
+// their own record of what happened to their files, newest first:
+//
+//	GET /activity   ?limit= (default 50, at most 500), ?before=<id> for the
+//	                next page, ?event= to filter; the admin gives ?user_id=
+//
+// Each entry is one of the events below, in the feed of the file's owner.
+// Its actor is who did it: the owner, a user they granted access to
+// (acl.go), "retention" for retention rules (retention.go), "admin" for an
+// admin's transfers (transfer.go), or empty for someone with a share link.
+// Downloads and streams are recorded once per read from the start of the
+// file, so a player's range requests count as one.
+//
+// Entries are written to the metadata store in batches by a background
+// writer, which never blocks a request: with ACTIVITY_QUEUE entries waiting,
+// new ones are dropped and counted in upload_activity_entries_total. The
+// feed needs METADATA_DB, and ACTIVITY_FEED=0 turns it off. Entries older
+// than ACTIVITY_RETENTION_DAYS (0 keeps them) are pruned hourly.
+
+const (
+	ACTIVITY_UPLOAD_COMPLETED = "upload.completed"
+	ACTIVITY_FILE_DOWNLOADED  = "file.downloaded"
+	ACTIVITY_FILE_STREAMED    = "file.streamed"
+	ACTIVITY_SHARE_CREATED    = "share.created"
+	ACTIVITY_SHARE_DOWNLOADED = "share.downloaded"
+	ACTIVITY_FILE_DELETED     = "file.deleted"
+	ACTIVITY_FILE_ARCHIVED    = "file.archived"
+	ACTIVITY_COMMENT_ADDED    = "comment.added"
+	ACTIVITY_FILE_TRANSFERRED = "file.transferred" // To another user; see transfer.go
+	ACTIVITY_FILE_RECEIVED    = "file.received"    // Copied or transferred from another user
+
+	ACTIVITY_QUEUE          = 10000
+	ACTIVITY_BATCH          = 100 // Entries written per transaction
+	ACTIVITY_PRUNE_INTERVAL = time.Hour
+	ACTIVITY_PAGE_DEFAULT   = 50
+	ACTIVITY_PAGE_MAX       = 500
+)
+
+var (
+	ACTIVITY_ENABLED        = os.Getenv("ACTIVITY_FEED") != "0"
+	ACTIVITY_RETENTION_DAYS = envInt("ACTIVITY_RETENTION_DAYS", 90)
+)
+
+type ActivityEntry struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Event     string    `json:"event"`
+	Key       string    `json:"key"`
+	Actor     string    `json:"actor,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ActivityPage struct {
+	Activity   []ActivityEntry `json:"activity"`
+	NextBefore int64           `json:"next_before,omitempty"` // The ?before= of the next page, if any
+}
+
+type ActivityFeed struct {
+	metadata MetadataStore
+	queue    chan ActivityEntry
+}
+
+// NewActivityFeed starts the feed's writer, or returns nil if the feed is
+// off; a nil feed records nothing.
+func NewActivityFeed(metadata MetadataStore) *ActivityFeed {
+	if !ACTIVITY_ENABLED || METADATA_DB == "" {
+		return nil
+	}
+	af := &ActivityFeed{
+		metadata: metadata,
+		queue:    make(chan ActivityEntry, ACTIVITY_QUEUE),
+	}
+	go af.run()
+	return af
+}
+
+// Record queues event on key, by actor, for the feed of key's owner.
+func (af *ActivityFeed) Record(event, key, actor, detail string) {
+	if af == nil {
+		return
+	}
+	entry := ActivityEntry{
+		UserID:    keyOwner(key),
+		Event:     event,
+		Key:       key,
+		Actor:     actor,
+		Detail:    detail,
+		CreatedAt: time.Now().UTC(),
+	}
+	select {
+	case af.queue <- entry:
+	default:
+		activityEntries.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (af *ActivityFeed) run() {
+	prune := time.NewTicker(ACTIVITY_PRUNE_INTERVAL)
+	defer prune.Stop()
+
+	for {
+		select {
+		case entry := <-af.queue:
+			af.write(af.batch(entry))
+		case <-prune.C:
+			af.prune()
+		}
+	}
+}
+
+// batch returns first and the entries queued behind it, up to
+// ACTIVITY_BATCH.
+func (af *ActivityFeed) batch(first ActivityEntry) []ActivityEntry {
+	entries := []ActivityEntry{first}
+	for len(entries) < ACTIVITY_BATCH {
+		select {
+		case entry := <-af.queue:
+			entries = append(entries, entry)
+		default:
+			return entries
+		}
+	}
+	return entries
+}
+
+func (af *ActivityFeed) write(entries []ActivityEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), METADATA_TIMEOUT)
+	defer cancel()
+	if err := af.metadata.PutActivity(ctx, entries); err != nil {
+		activityEntries.WithLabelValues("error").Add(float64(len(entries)))
+		serverLog.Error("failed to record activity", "entries", len(entries), "err", err)
+		return
+	}
+	activityEntries.WithLabelValues("ok").Add(float64(len(entries)))
+}
+
+func (af *ActivityFeed) prune() {
+	if ACTIVITY_RETENTION_DAYS <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), METADATA_TIMEOUT)
+	defer cancel()
+	n, err := af.metadata.PruneActivity(ctx, time.Now().UTC().AddDate(0, 0, -ACTIVITY_RETENTION_DAYS))
+	if err != nil {
+		serverLog.Warn("failed to prune activity", "err", err)
+		return
+	}
+	if n > 0 {
+		serverLog.Info("pruned activity", "entries", n, "retention_days", ACTIVITY_RETENTION_DAYS)
+	}
+}
+
+// readActivity reports whether a read of r records a download or stream:
+// one from the start of the file, not a later range of it.
+func readActivity(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+func (hs *HTTPServer) registerActivityRoutes() {
+	hs.mux.HandleFunc("GET /activity", hs.handleListActivity)
+}
+
+// GET /activity
+func (hs *HTTPServer) handleListActivity(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, _, ok := hs.adminOrCaller(w, r, query.Get("user_id"))
+	if !ok {
+		return
+	}
+
+	limit := ACTIVITY_PAGE_DEFAULT
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > ACTIVITY_PAGE_MAX {
+			writeJSONError(w, http.StatusBadRequest, "limit must be 1 to 500")
+			return
+		}
+		limit = n
+	}
+	var before int64
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid before")
+			return
+		}
+		before = n
+	}
+	if hs.uploads.activity == nil {
+		writeJSONError(w, http.StatusNotImplemented, "Activity feed is not enabled")
+		return
+	}
+
+	// One more than the page tells whether there is another
+	entries, err := hs.uploads.metadata.ListActivity(r.Context(), userID, query.Get("event"), before, limit+1)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	page := ActivityPage{Activity: entries}
+	if len(entries) > limit {
+		page.Activity = entries[:limit]
+		page.NextBefore = entries[limit-1].ID
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, page)
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) PutActivity(ctx context.Context, entries []ActivityEntry) error {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO activity (user_id, event, s3_key, actor, detail, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			entry.UserID, entry.Event, entry.Key, entry.Actor, entry.Detail, entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ms *sqlMetadataStore) ListActivity(ctx context.Context, userID, event string, before int64, limit int) ([]ActivityEntry, error) {
+	where, args := `user_id = $1`, []interface{}{userID}
+	if event != "" {
+		args = append(args, event)
+		where += ` AND event = $` + strconv.Itoa(len(args))
+	}
+	if before > 0 {
+		args = append(args, before)
+		where += ` AND id < $` + strconv.Itoa(len(args))
+	}
+	args = append(args, limit)
+
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT id, user_id, event, s3_key, actor, detail, created_at
+		FROM activity WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]ActivityEntry, 0)
+	for rows.Next() {
+		var entry ActivityEntry
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Event, &entry.Key, &entry.Actor, &entry.Detail, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (ms *sqlMetadataStore) PruneActivity(ctx context.Context, before time.Time) (int64, error) {
+	res, err := ms.db.ExecContext(ctx, `DELETE FROM activity WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
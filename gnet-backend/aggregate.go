@@ -0,0 +1,224 @@
+// aggregate.go - Chunks below the S3 part minimum, combined into parts
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ============================================
+// Part Aggregation
+// ============================================
+
+// S3 rejects multipart parts under MIN_CHUNK_SIZE except the last, but a
+// browser short on memory may only manage chunks of a few hundred KB. Such a
+// session is accepted down to MIN_SMALL_CHUNK_SIZE and each S3 part covers
+// ChunksPerPart consecutive chunks. A chunk is written at its offset in the
+// part's staging file and acknowledged as soon as it is on disk, so progress,
+// resume and retries still work chunk by chunk. The chunk that fills a part
+// uploads it; if that fails the chunk is refused and its retry tries again.
+// The session completes once every part is in S3, not merely every chunk.
+
+const MIN_SMALL_CHUNK_SIZE = 256 * 1024
+
+var PART_STAGING_DIR = envString("PART_STAGING_DIR", "/tmp/gnet_part_staging")
+
+// chunksPerPart is how many chunks of chunkSize make a part of at least
+// MIN_CHUNK_SIZE.
+func chunksPerPart(chunkSize uint32) uint32 {
+	return max(1, (MIN_CHUNK_SIZE+chunkSize-1)/chunkSize)
+}
+
+// PartNumber is the S3 part that holds a chunk.
+func (us *UploadSession) PartNumber(index uint32) int32 {
+	return int32(index/us.ChunksPerPart) + 1
+}
+
+// PartCount is the number of S3 parts the finished upload has.
+func (us *UploadSession) PartCount() uint32 {
+	return (us.TotalChunks + us.ChunksPerPart - 1) / us.ChunksPerPart
+}
+
+// partChunks is the number of chunks in part; only the last part is short.
+func (us *UploadSession) partChunks(part int32) uint32 {
+	first := uint32(part-1) * us.ChunksPerPart
+	return min(us.ChunksPerPart, us.TotalChunks-first)
+}
+
+// stageChunk records that chunk index is in its part's staging file and
+// reports whether that completes the part. A chunk counts once however often
+// it is staged, so exactly one caller sees each part complete.
+func (us *UploadSession) stageChunk(index uint32) (partComplete bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.staged == nil {
+		us.staged = make(map[uint32]bool)
+		us.stagedParts = make(map[int32]uint32)
+	}
+	if us.staged[index] {
+		return false
+	}
+	part := us.PartNumber(index)
+	us.staged[index] = true
+	us.stagedParts[part]++
+	return us.stagedParts[part] == us.partChunks(part)
+}
+
+// unstageChunk takes back the chunk that completed a part whose upload
+// failed, so that its retry completes the part again.
+func (us *UploadSession) unstageChunk(index uint32) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.staged[index] {
+		delete(us.staged, index)
+		us.stagedParts[us.PartNumber(index)]--
+	}
+}
+
+func (us *UploadSession) hasChunk(index uint32) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	_, ok := us.ReceivedChunks[index]
+	return ok
+}
+
+// aggregateChunk stages a chunk of a small-chunk session and uploads its part
+// if the chunk completes it. etag is empty while the part is still missing
+// chunks.
+func (fus *FileUploadServer) aggregateChunk(reqCtx context.Context, session *UploadSession, chunkIndex uint32, body chunkBody) (etag string, err error) {
+	if chunkIndex >= session.TotalChunks {
+		return "", fmt.Errorf("chunk_index %d out of range (total %d)", chunkIndex, session.TotalChunks)
+	}
+	// Offsets in the staging file assume full chunks before the last
+	if size := body.size(); size > session.ChunkSize || (size < session.ChunkSize && chunkIndex != session.TotalChunks-1) {
+		return "", fmt.Errorf("chunk %d is %d bytes, expected %d", chunkIndex, size, session.ChunkSize)
+	}
+
+	part := session.PartNumber(chunkIndex)
+	offset := int64(chunkIndex%session.ChunksPerPart) * int64(session.ChunkSize)
+	if err := fus.staging.Write(session.SessionID, part, offset, body); err != nil {
+		if _, bodyErr := body.digest(); bodyErr != nil {
+			return "", bodyErr // The request failed, not staging
+		}
+		chunkLog.ErrorContext(reqCtx, "failed to stage chunk", "session_id", session.SessionID, "chunk_index", chunkIndex, "err", err)
+		return "", fmt.Errorf("failed to stage chunk: %v", err)
+	}
+	// Only a chunk that arrived intact may count towards its part
+	if _, err := body.digest(); err != nil {
+		return "", err
+	}
+	if !session.stageChunk(chunkIndex) {
+		return "", nil
+	}
+
+	file, err := fus.staging.Open(session.SessionID, part)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			etag, err = fus.uploadPart(reqCtx, session, part, file, info.Size())
+		}
+		file.Close()
+	}
+	if err != nil {
+		session.unstageChunk(chunkIndex)
+		return "", err
+	}
+	fus.staging.RemovePart(session.SessionID, part)
+	s3Log.InfoContext(reqCtx, "part assembled", "session_id", session.SessionID, "part_number", part, "chunks", session.partChunks(part))
+	return etag, nil
+}
+
+// uploadPart stores one S3 part of a session from size bytes of body.
+func (fus *FileUploadServer) uploadPart(reqCtx context.Context, session *UploadSession, partNumber int32, body io.Reader, size int64) (string, error) {
+	// The client hashes a payload to sign it and rewinds it to send it. A
+	// body that cannot be seeked, a chunk streaming in over HTTP, is sent
+	// unsigned instead and cannot be retried; the client of the chunk
+	// retries it.
+	var optFns []func(*s3.Options)
+	if _, ok := body.(io.Seeker); !ok {
+		optFns = append(optFns, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+	}
+
+	partStart := time.Now()
+	result, err := fus.s3Client.client.UploadPart(
+		reqCtx,
+		&s3.UploadPartInput{
+			Bucket:        aws.String(fus.s3Client.bucket),
+			Key:           aws.String(session.S3Key),
+			UploadId:      aws.String(session.UploadID),
+			PartNumber:    aws.Int32(partNumber),
+			Body:          body,
+			ContentLength: aws.Int64(size),
+		},
+		optFns...,
+	)
+	if err != nil {
+		s3Log.ErrorContext(reqCtx, "failed to upload part", "session_id", session.SessionID, "part_number", partNumber, "err", err)
+		return "", fmt.Errorf("S3 upload failed: %v", err)
+	}
+	uploadPartDuration.Observe(time.Since(partStart).Seconds())
+	return *result.ETag, nil
+}
+
+// ============================================
+// Part Staging
+// ============================================
+
+// One file per unfinished part, under a directory per session. Like the
+// preview spool it lives only as long as the session.
+
+type PartStaging struct {
+	dir string
+}
+
+func NewPartStaging(dir string) (*PartStaging, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create part staging: %w", err)
+	}
+	return &PartStaging{dir: dir}, nil
+}
+
+func (ps *PartStaging) partPath(sessionID string, part int32) string {
+	return filepath.Join(ps.dir, sessionID, fmt.Sprintf("%05d.part", part))
+}
+
+// Write copies r to offset in a part's staging file.
+func (ps *PartStaging) Write(sessionID string, part int32, offset int64, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Join(ps.dir, sessionID), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ps.partPath(sessionID, part), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(f, offset), r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (ps *PartStaging) Open(sessionID string, part int32) (*os.File, error) {
+	return os.Open(ps.partPath(sessionID, part))
+}
+
+func (ps *PartStaging) RemovePart(sessionID string, part int32) {
+	if err := os.Remove(ps.partPath(sessionID, part)); err != nil && !os.IsNotExist(err) {
+		sessionLog.Warn("failed to remove staged part", "session_id", sessionID, "part_number", part, "err", err)
+	}
+}
+
+// Remove drops every staged part of a session.
+func (ps *PartStaging) Remove(sessionID string) {
+	if err := os.RemoveAll(filepath.Join(ps.dir, sessionID)); err != nil {
+		sessionLog.Warn("failed to remove part staging", "session_id", sessionID, "err", err)
+	}
+}
@@ -0,0 +1,136 @@
+// alerts.go - Error-rate alerting via webhook and Slack
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ============================================
+// Alerting
+// ============================================
+
+// Every rule counts errors over ALERT_WINDOW. Reaching the threshold fires an
+// "alert.firing" notification, repeated at most once per ALERT_COOLDOWN while
+// the condition holds. An "alert.resolved" notification follows once the
+// count drops below the threshold again. A threshold of 0 disables a rule.
+
+const (
+	ALERT_CHECK_INTERVAL = 30 * time.Second
+	ALERT_WINDOW         = 5 * time.Minute
+	ALERT_COOLDOWN       = 15 * time.Minute
+)
+
+var (
+	ALERT_WEBHOOK_URL       = os.Getenv("ALERT_WEBHOOK_URL")
+	ALERT_SLACK_WEBHOOK_URL = os.Getenv("ALERT_SLACK_WEBHOOK_URL")
+)
+
+type AlertRule struct {
+	Name        string
+	Description string
+	Threshold   int64
+	Count       func(window time.Duration) int64
+}
+
+type AlertNotification struct {
+	Rule      string `json:"rule"`
+	Count     int64  `json:"count"`
+	Threshold int64  `json:"threshold"`
+	Window    string `json:"window"`
+}
+
+func defaultAlertRules(stats *UploadStats) []AlertRule {
+	return []AlertRule{
+		{
+			Name:        "s3_errors",
+			Description: "S3 requests failing",
+			Threshold:   int64(envInt("ALERT_S3_ERRORS", 20)),
+			Count:       stats.s3Failures.Sum,
+		},
+		{
+			Name:        "finalize_failures",
+			Description: "Uploads failing to finalize",
+			Threshold:   int64(envInt("ALERT_FINALIZE_FAILURES", 3)),
+			Count: func(window time.Duration) int64 {
+				return stats.FailureCount(FAILURE_FINALIZE, window)
+			},
+		},
+		{
+			Name:        "auth_failures",
+			Description: "Authentication failures",
+			Threshold:   int64(envInt("ALERT_AUTH_FAILURES", 100)),
+			Count: func(window time.Duration) int64 {
+				return stats.FailureCount(FAILURE_AUTH, window)
+			},
+		},
+	}
+}
+
+type Alerter struct {
+	rules     []AlertRule
+	firing    map[string]bool
+	lastFired map[string]time.Time
+}
+
+func NewAlerter(rules []AlertRule) *Alerter {
+	return &Alerter{
+		rules:     rules,
+		firing:    make(map[string]bool),
+		lastFired: make(map[string]time.Time),
+	}
+}
+
+// Enabled reports whether there is anywhere to send alerts.
+func (a *Alerter) Enabled() bool {
+	return ALERT_WEBHOOK_URL != "" || ALERT_SLACK_WEBHOOK_URL != ""
+}
+
+func (a *Alerter) Run() {
+	ticker := time.NewTicker(ALERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.evaluate(time.Now())
+	}
+}
+
+func (a *Alerter) evaluate(now time.Time) {
+	for _, rule := range a.rules {
+		if rule.Threshold <= 0 {
+			continue
+		}
+
+		count := rule.Count(ALERT_WINDOW)
+		switch {
+		case count >= rule.Threshold:
+			if a.firing[rule.Name] && now.Sub(a.lastFired[rule.Name]) < ALERT_COOLDOWN {
+				continue
+			}
+			a.firing[rule.Name] = true
+			a.lastFired[rule.Name] = now
+			a.notify("alert.firing", rule, count,
+				fmt.Sprintf(":rotating_light: %s: %d in the last %s (threshold %d)", rule.Description, count, ALERT_WINDOW, rule.Threshold))
+
+		case a.firing[rule.Name]:
+			a.firing[rule.Name] = false
+			a.notify("alert.resolved", rule, count,
+				fmt.Sprintf(":white_check_mark: %s back below threshold: %d in the last %s", rule.Description, count, ALERT_WINDOW))
+		}
+	}
+}
+
+func (a *Alerter) notify(event string, rule AlertRule, count int64, text string) {
+	serverLog.Warn(event, "rule", rule.Name, "count", count, "threshold", rule.Threshold, "window", ALERT_WINDOW)
+
+	ctx := context.Background()
+	sendWebhook(ctx, ALERT_WEBHOOK_URL, event, AlertNotification{
+		Rule:      rule.Name,
+		Count:     count,
+		Threshold: rule.Threshold,
+		Window:    ALERT_WINDOW.String(),
+	})
+	sendSlack(ctx, ALERT_SLACK_WEBHOOK_URL, event, text)
+}
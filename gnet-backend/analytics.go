@@ -0,0 +1,345 @@
+// analytics.go - Storage analytics for capacity planning
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Storage Analytics
+// ============================================
+
+// /usage (usage.go) answers for one user and /admin/stats for the last
+// minutes; capacity planning wants the whole store over months:
+//
+//	GET /admin/analytics   ?granularity=daily|monthly (default daily),
+//	                       ?from=, ?to= (YYYY-MM-DD, default the 30 days up to today),
+//	                       ?tenant= (one tenant's users only), ?top= (default 10)
+//
+// The response has the files stored and their bytes (those in the trash
+// included, as they take storage until purged, and also counted apart), by
+// content type, by size bucket, the top uploaders by bytes, and "growth":
+// per period, the files completed in it and the running total at its end,
+// ready for a time-series panel. Periods are UTC days or months.
+//
+// Everything is counted from the metadata store, so it needs METADATA_DB
+// and covers the files recorded there. Growth counts the files still
+// stored: a file purged since no longer counts in the period it was
+// uploaded in.
+
+const (
+	ANALYTICS_TOP_DEFAULT   = 10
+	ANALYTICS_TOP_MAX       = 100
+	ANALYTICS_CONTENT_TYPES = 50 // Largest content types listed
+	ANALYTICS_MAX_PERIODS   = 400
+)
+
+// Lower bounds of the size buckets after the first, which starts at 0
+var ANALYTICS_SIZE_BUCKETS = []int64{1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30, 100 << 30}
+
+// AnalyticsQuery is what StorageAnalytics counts.
+type AnalyticsQuery struct {
+	OwnerPrefix string      // Only owners starting with it; empty for every one
+	Periods     []time.Time // Bounds of the growth periods, in order: one more than the periods
+	Top         int
+}
+
+type StorageAnalytics struct {
+	Files        int64            `json:"files"`
+	Bytes        int64            `json:"bytes"`
+	TrashFiles   int64            `json:"trash_files"`
+	TrashBytes   int64            `json:"trash_bytes"`
+	ContentTypes []ContentTypeUse `json:"content_types"`
+	SizeBuckets  []SizeBucketUse  `json:"size_buckets"`
+	TopUploaders []UploaderUse    `json:"top_uploaders"`
+	Growth       []StorageGrowth  `json:"growth"`
+}
+
+type ContentTypeUse struct {
+	ContentType string `json:"content_type"`
+	Files       int64  `json:"files"`
+	Bytes       int64  `json:"bytes"`
+}
+
+type SizeBucketUse struct {
+	MinBytes int64 `json:"min_bytes"`
+	MaxBytes int64 `json:"max_bytes,omitempty"` // Exclusive; absent for the last bucket
+	Files    int64 `json:"files"`
+	Bytes    int64 `json:"bytes"`
+}
+
+type UploaderUse struct {
+	UserID string `json:"user_id"`
+	Files  int64  `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type StorageGrowth struct {
+	Period     string    `json:"period"`
+	Start      time.Time `json:"start"`
+	FilesAdded int64     `json:"files_added"`
+	BytesAdded int64     `json:"bytes_added"`
+	FilesTotal int64     `json:"files_total"` // Up to the end of the period
+	BytesTotal int64     `json:"bytes_total"`
+}
+
+func (hs *HTTPServer) registerAnalyticsRoutes() {
+	hs.mux.Handle("GET /admin/analytics", requireAdmin(http.HandlerFunc(hs.handleAnalytics)))
+}
+
+// GET /admin/analytics
+func (hs *HTTPServer) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = "daily"
+	}
+	if granularity != "daily" && granularity != "monthly" {
+		writeJSONError(w, http.StatusBadRequest, "granularity must be daily or monthly")
+		return
+	}
+
+	now := time.Now().UTC()
+	var from, to time.Time
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(USAGE_DAY_FORMAT, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s date, expected YYYY-MM-DD", name))
+			return
+		}
+		*dst = t
+	}
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -30)
+	}
+	if to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, "to is before from")
+		return
+	}
+
+	top := ANALYTICS_TOP_DEFAULT
+	if v := query.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > ANALYTICS_TOP_MAX {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("top must be 1 to %d", ANALYTICS_TOP_MAX))
+			return
+		}
+		top = n
+	}
+
+	q := AnalyticsQuery{Top: top}
+	if id := query.Get("tenant"); id != "" {
+		tenant, ok := hs.uploads.tenants[id]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Tenant not found")
+			return
+		}
+		q.OwnerPrefix = tenant.userPrefix()
+	}
+
+	format := USAGE_DAY_FORMAT
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	next := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if granularity == "monthly" {
+		format = USAGE_MONTH_FORMAT
+		start = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	}
+	for t := start; !t.After(to); t = next(t) {
+		q.Periods = append(q.Periods, t)
+		if len(q.Periods) > ANALYTICS_MAX_PERIODS {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("At most %d periods; use a shorter range or monthly", ANALYTICS_MAX_PERIODS))
+			return
+		}
+	}
+	q.Periods = append(q.Periods, next(q.Periods[len(q.Periods)-1]))
+
+	analytics, err := hs.uploads.metadata.StorageAnalytics(r.Context(), q)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range analytics.Growth {
+		analytics.Growth[i].Period = analytics.Growth[i].Start.Format(format)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"generated_at": now,
+		"tenant":       query.Get("tenant"),
+		"granularity":  granularity,
+		"from":         from.Format(USAGE_DAY_FORMAT),
+		"to":           to.Format(USAGE_DAY_FORMAT),
+		"storage":      analytics,
+	})
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+// bucketCase is a CASE numbering the bucket of column among the bounds
+// $first, $first+1, ... ($first+n-1): 0 below the first, n from the last.
+func bucketCase(column string, first, n int) string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, " WHEN %s < $%d THEN %d", column, first+i, i)
+	}
+	fmt.Fprintf(&b, " ELSE %d END", n)
+	return b.String()
+}
+
+func (ms *sqlMetadataStore) StorageAnalytics(ctx context.Context, q AnalyticsQuery) (*StorageAnalytics, error) {
+	// Scoped as ExpiredFiles (retention.go) scopes, with the bounds first
+	scope := func(args []interface{}) (string, []interface{}) {
+		if q.OwnerPrefix == "" {
+			return "", args
+		}
+		n := len(args)
+		return fmt.Sprintf(" WHERE $%d = substr(owner, 1, $%d)", n+1, n+2), append(args, q.OwnerPrefix, len(q.OwnerPrefix))
+	}
+	const sum = `CAST(COALESCE(SUM(size), 0) AS BIGINT)`
+
+	analytics := &StorageAnalytics{
+		ContentTypes: make([]ContentTypeUse, 0),
+		SizeBuckets:  make([]SizeBucketUse, 0, len(ANALYTICS_SIZE_BUCKETS)+1),
+		TopUploaders: make([]UploaderUse, 0),
+		Growth:       make([]StorageGrowth, 0, len(q.Periods)-1),
+	}
+
+	where, args := scope(nil)
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), `+sum+`, COUNT(deleted_at), CAST(COALESCE(SUM(CASE WHEN deleted_at IS NOT NULL THEN size ELSE 0 END), 0) AS BIGINT)
+		FROM files`+where, args...).
+		Scan(&analytics.Files, &analytics.Bytes, &analytics.TrashFiles, &analytics.TrashBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args = scope(nil)
+	args = append(args, ANALYTICS_CONTENT_TYPES)
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT content_type, COUNT(*), `+sum+` FROM files`+where+`
+		GROUP BY content_type ORDER BY 3 DESC, content_type
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var use ContentTypeUse
+		if err := rows.Scan(&use.ContentType, &use.Files, &use.Bytes); err != nil {
+			return nil, err
+		}
+		analytics.ContentTypes = append(analytics.ContentTypes, use)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	where, args = scope(nil)
+	args = append(args, q.Top)
+	rows, err = ms.db.QueryContext(ctx, `
+		SELECT owner, COUNT(*), `+sum+` FROM files`+where+`
+		GROUP BY owner ORDER BY 3 DESC, owner
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var use UploaderUse
+		if err := rows.Scan(&use.UserID, &use.Files, &use.Bytes); err != nil {
+			return nil, err
+		}
+		analytics.TopUploaders = append(analytics.TopUploaders, use)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Both bucketings are one pass over the files each
+	bounds := ANALYTICS_SIZE_BUCKETS
+	for i := 0; i <= len(bounds); i++ {
+		bucket := SizeBucketUse{}
+		if i > 0 {
+			bucket.MinBytes = bounds[i-1]
+		}
+		if i < len(bounds) {
+			bucket.MaxBytes = bounds[i]
+		}
+		analytics.SizeBuckets = append(analytics.SizeBuckets, bucket)
+	}
+	args = make([]interface{}, 0, len(bounds))
+	for _, bound := range bounds {
+		args = append(args, bound)
+	}
+	where, args = scope(args)
+	err = ms.groupBuckets(ctx, `SELECT `+bucketCase("size", 1, len(bounds))+` AS bucket, COUNT(*), `+sum+` FROM files`+where+` GROUP BY 1`,
+		args, func(bucket int, files, bytes int64) {
+			analytics.SizeBuckets[bucket].Files, analytics.SizeBuckets[bucket].Bytes = files, bytes
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Bucket 0 is before the first period, and the last after the last
+	for _, start := range q.Periods[:len(q.Periods)-1] {
+		analytics.Growth = append(analytics.Growth, StorageGrowth{Start: start})
+	}
+	args = make([]interface{}, 0, len(q.Periods))
+	for _, bound := range q.Periods {
+		args = append(args, bound)
+	}
+	where, args = scope(args)
+	var beforeFiles, beforeBytes int64
+	err = ms.groupBuckets(ctx, `SELECT `+bucketCase("completed_at", 1, len(q.Periods))+` AS bucket, COUNT(*), `+sum+` FROM files`+where+` GROUP BY 1`,
+		args, func(bucket int, files, bytes int64) {
+			switch {
+			case bucket == 0:
+				beforeFiles, beforeBytes = files, bytes
+			case bucket <= len(analytics.Growth):
+				analytics.Growth[bucket-1].FilesAdded, analytics.Growth[bucket-1].BytesAdded = files, bytes
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i := range analytics.Growth {
+		beforeFiles += analytics.Growth[i].FilesAdded
+		beforeBytes += analytics.Growth[i].BytesAdded
+		analytics.Growth[i].FilesTotal, analytics.Growth[i].BytesTotal = beforeFiles, beforeBytes
+	}
+	return analytics, nil
+}
+
+// groupBuckets runs a query of (bucket, files, bytes) rows.
+func (ms *sqlMetadataStore) groupBuckets(ctx context.Context, query string, args []interface{}, add func(bucket int, files, bytes int64)) error {
+	rows, err := ms.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket int
+		var files, bytes int64
+		if err := rows.Scan(&bucket, &files, &bytes); err != nil {
+			return err
+		}
+		add(bucket, files, bytes)
+	}
+	return rows.Err()
+}
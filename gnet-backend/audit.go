@@ -0,0 +1,257 @@
+// audit.go - Audit trail and periodic export to S3
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Audit Trail
+// ============================================
+
+// Security-relevant and session lifecycle events are buffered in memory and
+// periodically written as gzipped CSV objects under AUDIT_PREFIX in the upload
+// bucket:
+//
+//	<AUDIT_PREFIX>/2006/01/02/audit-20060102T150405Z.csv.gz
+//
+// Objects older than AUDIT_RETENTION_DAYS are deleted by the same job.
+
+const (
+	AUDIT_BUFFER_MAX = 100000 // Oldest events are dropped beyond this
+
+	AUDIT_SESSION_CREATED   = "session.created"
+	AUDIT_SESSION_PAUSED    = "session.paused"
+	AUDIT_SESSION_RESUMED   = "session.resumed"
+	AUDIT_SESSION_CANCELLED = "session.cancelled"
+	AUDIT_SESSION_COMPLETED = "session.completed"
+	AUDIT_SESSION_FAILED    = "session.failed"
+	AUDIT_SESSION_EXPIRED   = "session.expired"
+	AUDIT_AUTH_FAILED       = "auth.failed"
+	AUDIT_SHARE_CREATED     = "share.created"
+	AUDIT_SHARE_REVOKED     = "share.revoked"
+	AUDIT_FILE_DELETED      = "file.deleted"
+	AUDIT_FILE_RESTORED     = "file.restored"
+	AUDIT_FILE_ROLLED_BACK  = "file.rolled_back"
+	AUDIT_FILE_EXPIRED      = "file.expired"
+	AUDIT_FILE_CORRUPT      = "file.corrupt"
+	AUDIT_FILE_COPIED       = "file.copied"
+	AUDIT_FILE_TRANSFERRED  = "file.transferred"
+	AUDIT_ACCESS_GRANTED    = "access.granted"
+	AUDIT_ACCESS_REVOKED    = "access.revoked"
+	AUDIT_EXPORT_STARTED    = "export.started"
+	AUDIT_EXPORT_FINISHED   = "export.finished"
+	AUDIT_HOLD_PLACED       = "hold.placed"
+	AUDIT_HOLD_RELEASED     = "hold.released"
+	AUDIT_DROP_CREATED      = "drop.created"
+	AUDIT_DROP_REVOKED      = "drop.revoked"
+	AUDIT_QUOTA_SET         = "quota.set"
+
+	AUDIT_IMPERSONATION_STARTED = "impersonation.started"
+	AUDIT_IMPERSONATION_ENDED   = "impersonation.ended"
+	AUDIT_IMPERSONATED_REQUEST  = "impersonation.request"
+	AUDIT_ERASURE_STARTED       = "erasure.started"
+	AUDIT_ERASURE_FINISHED      = "erasure.finished"
+)
+
+var (
+	AUDIT_PREFIX          = envString("AUDIT_PREFIX", "_audit")
+	AUDIT_EXPORT_INTERVAL = time.Duration(envInt("AUDIT_EXPORT_MINUTES", 60)) * time.Minute
+	AUDIT_RETENTION_DAYS  = envInt("AUDIT_RETENTION_DAYS", 90)
+)
+
+var AUDIT_CSV_HEADER = []string{"time", "event", "user_id", "session_id", "remote_addr", "detail"}
+
+type AuditEvent struct {
+	Time       time.Time
+	Event      string
+	UserID     string
+	SessionID  string
+	RemoteAddr string
+	Detail     string
+}
+
+func (ae AuditEvent) record() []string {
+	return []string{ae.Time.UTC().Format(time.RFC3339Nano), ae.Event, ae.UserID, ae.SessionID, ae.RemoteAddr, ae.Detail}
+}
+
+type AuditLog struct {
+	events  []AuditEvent
+	dropped int
+	mu      sync.Mutex
+}
+
+var auditLog = &AuditLog{}
+
+func (al *AuditLog) Record(event, userID, sessionID, remoteAddr, detail string) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if len(al.events) >= AUDIT_BUFFER_MAX {
+		al.events = al.events[1:]
+		al.dropped++
+	}
+	al.events = append(al.events, AuditEvent{
+		Time:       time.Now(),
+		Event:      event,
+		UserID:     userID,
+		SessionID:  sessionID,
+		RemoteAddr: remoteAddr,
+		Detail:     detail,
+	})
+}
+
+// drain takes every buffered event.
+func (al *AuditLog) drain() ([]AuditEvent, int) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	events, dropped := al.events, al.dropped
+	al.events = nil
+	al.dropped = 0
+	return events, dropped
+}
+
+// requeue puts events back after a failed export, ahead of newer ones.
+func (al *AuditLog) requeue(events []AuditEvent) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.events = append(events, al.events...)
+	if over := len(al.events) - AUDIT_BUFFER_MAX; over > 0 {
+		al.events = al.events[over:]
+		al.dropped += over
+	}
+}
+
+// ============================================
+// Export Job
+// ============================================
+
+type AuditExporter struct {
+	s3Client *S3Client
+	log      *AuditLog
+}
+
+func NewAuditExporter(s3Client *S3Client, log *AuditLog) *AuditExporter {
+	return &AuditExporter{
+		s3Client: s3Client,
+		log:      log,
+	}
+}
+
+func (ae *AuditExporter) Run() {
+	ticker := time.NewTicker(AUDIT_EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		if err := ae.Export(ctx); err != nil {
+			s3Log.Error("audit export failed", "err", err)
+		}
+		if err := ae.prune(ctx); err != nil {
+			s3Log.Warn("audit retention cleanup failed", "err", err)
+		}
+	}
+}
+
+// Export writes all buffered events to one gzipped CSV object.
+func (ae *AuditExporter) Export(ctx context.Context) error {
+	events, dropped := ae.log.drain()
+	if dropped > 0 {
+		s3Log.Warn("audit buffer overflowed, events dropped", "dropped", dropped)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := csv.NewWriter(gz)
+	w.Write(AUDIT_CSV_HEADER)
+	for _, event := range events {
+		w.Write(event.record())
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		ae.log.requeue(events)
+		return fmt.Errorf("failed to encode audit CSV: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		ae.log.requeue(events)
+		return fmt.Errorf("failed to compress audit CSV: %w", err)
+	}
+
+	now := time.Now().UTC()
+	key := path.Join(AUDIT_PREFIX, now.Format("2006/01/02"), "audit-"+now.Format("20060102T150405Z")+".csv.gz")
+	_, err := ae.s3Client.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(ae.s3Client.bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(buf.Bytes()),
+		ContentType:     aws.String("text/csv"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		ae.log.requeue(events)
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	ae.s3Client.listings.Invalidate(key)
+
+	s3Log.Info("audit events exported", "key", key, "events", len(events), "bytes", buf.Len())
+	return nil
+}
+
+// prune deletes exported objects older than the retention period.
+func (ae *AuditExporter) prune(ctx context.Context) error {
+	if AUDIT_RETENTION_DAYS <= 0 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -AUDIT_RETENTION_DAYS)
+
+	paginator := s3.NewListObjectsV2Paginator(ae.s3Client.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(ae.s3Client.bucket),
+		Prefix: aws.String(AUDIT_PREFIX + "/"),
+	})
+
+	var expired []types.ObjectIdentifier
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified != nil && obj.LastModified.Before(cutoff) {
+				expired = append(expired, types.ObjectIdentifier{Key: obj.Key})
+			}
+		}
+	}
+
+	// DeleteObjects takes at most 1000 keys per call
+	for start := 0; start < len(expired); start += 1000 {
+		batch := expired[start:min(start+1000, len(expired))]
+		_, err := ae.s3Client.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(ae.s3Client.bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		ae.s3Client.listings.Invalidate(AUDIT_PREFIX + "/")
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(expired) > 0 {
+		s3Log.Info("expired audit exports deleted", "objects", len(expired), "retention_days", AUDIT_RETENTION_DAYS)
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+// chunkpool.go - S3 part uploads off the gnet event loop
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"backend/protocol"
+)
+
+// ============================================
+// Chunk Workers
+// ============================================
+
+// The event loop moves each received UPLOAD_CHUNK out of the connection's
+// buffer and hands it to one of UPLOAD_WORKERS goroutines, which stores it
+// and queues the ACK for the event loop to write, so an S3 PUT never stalls
+// the loop. A client that sends chunks without waiting for their ACKs gets up
+// to MAX_SESSION_INFLIGHT of them uploaded to S3 at once over its one
+// connection; past that, and for any other command, OnTraffic leaves the
+// frames buffered until the chunks are answered. When UPLOAD_QUEUE chunks are
+// already waiting the command is refused with errServerBusy, which the SDK
+// treats like errSessionBusy.
+//
+// Workers spend their time waiting on S3, so their number is about the
+// network more than the CPUs; it still defaults to 8 per CPU, since bigger
+// boxes tend to have bigger pipes, kept between 16 for a one-core edge box
+// and 256 so that a 64-core node does not open thousands of S3 requests.
+
+var (
+	UPLOAD_WORKERS = envInt("UPLOAD_WORKERS", min(max(8*runtime.NumCPU(), 16), 256))
+	UPLOAD_QUEUE   = envInt("UPLOAD_QUEUE", 2*UPLOAD_WORKERS)
+)
+
+// The SDK matches on the prefix of this text (client.BUSY_MESSAGE)
+var errServerBusy = errors.New("Too many chunks in flight on this server, retry later")
+
+type chunkJob struct {
+	run      func()
+	queuedAt time.Time
+}
+
+type ChunkPool struct {
+	jobs chan chunkJob
+	wg   sync.WaitGroup
+}
+
+func NewChunkPool(workers, queue int) *ChunkPool {
+	cp := &ChunkPool{jobs: make(chan chunkJob, max(queue, 0))}
+	for i := 0; i < max(workers, 1); i++ {
+		cp.wg.Add(1)
+		go cp.work()
+	}
+	return cp
+}
+
+func (cp *ChunkPool) work() {
+	defer cp.wg.Done()
+	for job := range cp.jobs {
+		chunkQueueDepth.Dec()
+		chunkQueueWait.Observe(time.Since(job.queuedAt).Seconds())
+		job.run()
+	}
+}
+
+// Submit queues run for a worker without blocking. It returns errServerBusy
+// if the queue is full.
+func (cp *ChunkPool) Submit(run func()) error {
+	chunkQueueDepth.Inc()
+	select {
+	case cp.jobs <- chunkJob{run: run, queuedAt: time.Now()}:
+		return nil
+	default:
+		chunkQueueDepth.Dec()
+		return errServerBusy
+	}
+}
+
+// Close waits for every queued chunk to be stored. Nothing may be submitted
+// afterwards.
+func (cp *ChunkPool) Close() {
+	close(cp.jobs)
+	cp.wg.Wait()
+}
+
+// ============================================
+// Response Order
+// ============================================
+
+// Pipelined chunks finish in any order, but a client matches responses to
+// commands by position. Every frame takes a reply slot when it is read, and
+// responses are released only once all earlier slots are filled.
+//
+// Released responses collect in the connection's outbox rather than going
+// out with an AsyncWrite each. The event loop writes the whole outbox with
+// one writev when OnTraffic returns; chunk workers wake the loop after
+// answering, so ACKs for chunks that finish close together share a syscall,
+// as do the replies to a burst of pipelined frames.
+
+type reply struct {
+	data  []byte
+	ready bool
+}
+
+// reserveReply appends a slot for the frame being handled.
+func (ctx *ClientContext) reserveReply() *reply {
+	r := &reply{}
+	ctx.mu.Lock()
+	ctx.replies = append(ctx.replies, r)
+	ctx.mu.Unlock()
+	return r
+}
+
+// sendReply fills r and moves every ready response at the head of the queue
+// to the outbox. Off the event loop, the caller must wake c to have them
+// written.
+func (ctx *ClientContext) sendReply(r *reply, data []byte) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	r.data, r.ready = data, true
+	for len(ctx.replies) > 0 && ctx.replies[0].ready {
+		ctx.outbox = append(ctx.outbox, ctx.replies[0].data)
+		ctx.replies[0] = nil
+		ctx.replies = ctx.replies[1:]
+	}
+}
+
+// flushReplies writes the outbox. Event loop only.
+func (ctx *ClientContext) flushReplies(c gnet.Conn) {
+	ctx.mu.Lock()
+	outbox := ctx.outbox
+	ctx.outbox = nil
+	ctx.mu.Unlock()
+
+	if len(outbox) > 0 {
+		c.Writev(outbox)
+	}
+}
+
+// ============================================
+// Memory Budget
+// ============================================
+
+// Every chunk being received or stored holds its whole data in memory, so
+// 200 clients sending 100 MB chunks at once would need 20 GB; larger chunks
+// go to a file instead (largechunk.go). MAX_CHUNK_MEMORY caps the chunk
+// bytes held across the server. A binary connection whose next chunk does
+// not fit is held back: the chunk stays in the connection's inbound buffer
+// and no ACK goes back, until a release wakes the connection to try again.
+//
+// gnet cannot stop reading a connection, though, so the rest of the frame,
+// and whatever the client pipelines behind it, keeps piling up in that
+// buffer. What a held connection has buffered counts against
+// MAX_CHUNK_MEMORY, and MAX_CONN_BUFFER caps it per connection: past it the
+// chunk is refused with errServerBusy's text, which the SDKs back off from
+// like a 429, and its data is discarded as it arrives. Any other frame is
+// handled whole and must fit in MAX_CONN_BUFFER, or the connection is
+// closed. The HTTP API cannot hold a request back, so it answers 503 with
+// Retry-After and errServerBusy's text straight away.
+
+var (
+	MAX_CHUNK_MEMORY = envInt("MAX_CHUNK_MEMORY", 2*1024*1024*1024)
+	MAX_CONN_BUFFER  = envInt("MAX_CONN_BUFFER", 8*1024*1024)
+)
+
+type MemoryBudget struct {
+	mu      sync.Mutex
+	limit   int
+	used    int              // Reserved
+	held    int              // In the inbound buffers of held connections
+	gauge   prometheus.Gauge // Reports used and held
+	waiting map[gnet.Conn]struct{}
+}
+
+func NewMemoryBudget(limit int, gauge prometheus.Gauge) *MemoryBudget {
+	return &MemoryBudget{limit: limit, gauge: gauge, waiting: make(map[gnet.Conn]struct{})}
+}
+
+// Reserve takes n bytes of the budget if they fit. While nothing is
+// reserved any size fits, so a chunk larger than the whole budget still goes
+// through on its own, and held connections cannot lock each other out.
+func (mb *MemoryBudget) Reserve(n int) bool {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.reserve(n)
+}
+
+// ReserveOrWake is Reserve for an event loop: if n bytes do not fit, c is
+// woken once some are released.
+func (mb *MemoryBudget) ReserveOrWake(c gnet.Conn, n int) bool {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.reserve(n) {
+		return true
+	}
+	if _, ok := mb.waiting[c]; !ok {
+		mb.waiting[c] = struct{}{}
+		backpressure.WithLabelValues("binary").Inc()
+	}
+	return false
+}
+
+func (mb *MemoryBudget) reserve(n int) bool {
+	if mb.used > 0 && mb.used+mb.held+n > mb.limit {
+		return false
+	}
+	mb.used += n
+	mb.gauge.Set(float64(mb.used + mb.held))
+	return true
+}
+
+// Hold adds n bytes, negative to give them back, to what held connections
+// have buffered. It wakes no one; a held connection waits for a Release.
+func (mb *MemoryBudget) Hold(n int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.held += n
+	mb.gauge.Set(float64(mb.used + mb.held))
+}
+
+// Release returns n reserved bytes and wakes every waiting connection.
+func (mb *MemoryBudget) Release(n int) {
+	mb.mu.Lock()
+	mb.used -= n
+	mb.gauge.Set(float64(mb.used + mb.held))
+	waiting := mb.waiting
+	if len(waiting) > 0 {
+		mb.waiting = make(map[gnet.Conn]struct{})
+	}
+	mb.mu.Unlock()
+
+	for c := range waiting {
+		c.Wake(nil) // Fails harmlessly if c has closed
+	}
+}
+
+// ============================================
+// Chunk Buffers
+// ============================================
+
+// A queued chunk outlives the frame it arrived in, so its data is moved into
+// a buffer of its own. Buffers are recycled: chunks are megabytes each.
+
+var chunkBuffers sync.Pool
+
+func getChunkBuffer(size int) []byte {
+	if buf, ok := chunkBuffers.Get().(*[]byte); ok && cap(*buf) >= size {
+		return (*buf)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putChunkBuffer(buf []byte) {
+	chunkBuffers.Put(&buf)
+}
+
+// chunkBudget is what a chunk of size bytes is received into: chunk memory,
+// or chunk file space for one too large for memory.
+func (fus *FileUploadServer) chunkBudget(size int) *MemoryBudget {
+	if size > MAX_MEMORY_CHUNK_SIZE {
+		return fus.chunkSpace
+	}
+	return fus.chunkMemory
+}
+
+// admitChunk reserves size bytes for a chunk whose frame head has arrived
+// and checks it against the rate limits, before any of it is received. If
+// either refuses, the chunk is to be held back, and c is woken once some
+// budget is released or when the rate limits would pass; that wait is
+// returned for a rate limit. Event loop only.
+func (fus *FileUploadServer) admitChunk(c gnet.Conn, ctx *ClientContext, userID string, size int) (time.Duration, bool) {
+	if wait := time.Until(ctx.rateUntil); wait > 0 {
+		return wait, false // Already woken then
+	}
+	budget := fus.chunkBudget(size)
+	if !budget.ReserveOrWake(c, size) {
+		return 0, false
+	}
+	wait, ok := fus.limiter.Allow(RATE_CHUNK, userID, peerIP(ctx.remoteAddr), size)
+	if !ok {
+		budget.Release(size)
+		ctx.rateUntil = time.Now().Add(wait)
+		time.AfterFunc(wait, func() { c.Wake(nil) }) // Fails harmlessly if c has closed
+	}
+	return wait, ok
+}
+
+// refuseChunk is the response to a chunk admitChunk held back until its
+// connection buffered MAX_CONN_BUFFER: rate limited after a rate limit's
+// wait, busy otherwise.
+func (fus *FileUploadServer) refuseChunk(wait time.Duration) []byte {
+	if wait > 0 {
+		return rateLimitedResponse(wait)
+	}
+	chunksReceived.WithLabelValues("busy").Inc()
+	return fus.errorResponse(errServerBusy.Error())
+}
+
+// releaseChunk recycles the buffer of a received chunk and returns its bytes
+// to the memory budget, or drops its file and returns its space.
+func (fus *FileUploadServer) releaseChunk(chunk *chunkStream) {
+	switch {
+	case chunk.discarded():
+		// Nothing was reserved
+	case chunk.file != nil:
+		chunk.file.Close()
+		fus.chunkSpace.Release(chunk.size)
+	default:
+		putChunkBuffer(chunk.cmd.ChunkData)
+		fus.chunkMemory.Release(chunk.size)
+	}
+}
+
+// ============================================
+// Chunk Streams
+// ============================================
+
+// Rather than waiting for a whole UPLOAD_CHUNK frame and then copying and
+// hashing it in two more passes, OnTraffic decodes the command up to the
+// chunk data and moves the data into its chunk buffer as it arrives,
+// feeding each piece to SHA-256 on the way. The connection's inbound buffer
+// never holds more than one read of a chunk, and the digest is ready when
+// the last byte is.
+
+// Session ID, chunk index and data size
+const MAX_CHUNK_HEAD = 2 + 0xFFFF + 4 + 4
+
+type chunkStream struct {
+	token     []byte
+	tokenInfo *TokenInfo // nil if token is not valid: the data is discarded
+	refused   []byte     // The response to a chunk that is discarded instead
+	head      []byte     // The payload up to the chunk data
+	cmd       *protocol.UploadChunk
+	size      int
+	filled    int
+	file      *os.File // Instead of cmd.ChunkData past MAX_MEMORY_CHUNK_SIZE
+	hash      hash.Hash
+}
+
+// peekChunk decodes the head of the UPLOAD_CHUNK frame at the start of the
+// inbound buffer. It returns false if the frame is malformed or its head has
+// not arrived; the caller then handles the frame whole.
+func peekChunk(c gnet.Conn, headerSize, totalSize int) (head []byte, size int, ok bool) {
+	frame, err := c.Peek(min(c.InboundBuffered(), totalSize, headerSize+1+MAX_CHUNK_HEAD))
+	if err != nil {
+		return nil, 0, false
+	}
+	offset, size, err := protocol.DecodeHead(&protocol.UploadChunk{}, frame[headerSize+1:])
+	if err != nil || headerSize+1+offset+size != totalSize {
+		return nil, 0, false
+	}
+	return frame[:headerSize+1+offset], size, true
+}
+
+// startChunk begins receiving the chunk whose frame head peekChunk returned,
+// into size bytes admitChunk has reserved: a buffer, or a
+// file if the chunk is too large for memory. Without tokenInfo, for a token
+// that is not valid, or with a refused response, nothing is reserved and the
+// data is discarded as it arrives; the frame is then answered AUTH_FAILED or
+// refused.
+func (fus *FileUploadServer) startChunk(c gnet.Conn, ctx *ClientContext, head []byte, headerSize, size int, tokenInfo *TokenInfo, refused []byte) gnet.Action {
+	chunk := &chunkStream{
+		token:     bytes.Clone(head[4 : headerSize-4]),
+		tokenInfo: tokenInfo,
+		refused:   refused,
+		head:      bytes.Clone(head[headerSize:]),
+		cmd:       &protocol.UploadChunk{},
+		size:      size,
+		hash:      sha256.New(),
+	}
+	protocol.DecodeHead(chunk.cmd, head[headerSize+1:])
+	if !chunk.discarded() {
+		ctx.mu.Lock()
+		depth := ctx.inflight + 1
+		ctx.mu.Unlock()
+		sizeRecvBuffer(c, ctx, size, depth)
+	}
+	switch {
+	case chunk.discarded():
+		// Nothing to receive into
+	case size > MAX_MEMORY_CHUNK_SIZE:
+		file, err := fus.chunkFiles.Create()
+		if err != nil {
+			fus.chunkSpace.Release(size)
+			chunkLog.ErrorContext(ctx.connCtx, "failed to create chunk file", "remote", ctx.remoteAddr, "size", size, "err", err)
+			ctx.sendReply(ctx.reserveReply(), tagErrorResponse(fus.errorResponse("Failed to receive chunk"), ctx.connID))
+			return gnet.Close
+		}
+		chunk.file = file
+	default:
+		chunk.cmd.ChunkData = getChunkBuffer(size)
+	}
+	ctx.chunk = chunk
+	c.Discard(len(head))
+	return fus.receiveChunk(c, ctx)
+}
+
+// receiveChunk moves what has arrived of the chunk being received into its
+// buffer or file, and handles the frame once it is complete.
+func (fus *FileUploadServer) receiveChunk(c gnet.Conn, ctx *ClientContext) gnet.Action {
+	chunk := ctx.chunk
+	if chunk.discarded() {
+		if n := min(c.InboundBuffered(), chunk.size-chunk.filled); n > 0 {
+			n, _ = c.Discard(n)
+			chunk.filled += n
+		}
+	} else if chunk.file != nil {
+		if n := min(c.InboundBuffered(), chunk.size-chunk.filled); n > 0 {
+			data, _ := c.Peek(n)
+			if _, err := chunk.file.Write(data); err != nil {
+				chunkLog.ErrorContext(ctx.connCtx, "failed to write chunk file", "remote", ctx.remoteAddr, "err", err)
+				ctx.sendReply(ctx.reserveReply(), tagErrorResponse(fus.errorResponse("Failed to receive chunk"), ctx.connID))
+				return gnet.Close // OnClose releases the chunk
+			}
+			chunk.hash.Write(data)
+			c.Discard(n)
+			chunk.filled += n
+		}
+	} else {
+		data := chunk.cmd.ChunkData
+		n, _ := c.Read(data[chunk.filled:])
+		chunk.hash.Write(data[chunk.filled : chunk.filled+n])
+		chunk.filled += n
+	}
+	if chunk.filled < chunk.size {
+		return gnet.None // Need more chunk data
+	}
+
+	ctx.chunk = nil
+	action := fus.handleFrame(c, ctx, chunk.token, nil, chunk)
+	if c.InboundBuffered() > 0 {
+		// The next message started arriving in this read
+		ctx.mu.Lock()
+		ctx.frameStart = time.Now()
+		ctx.mu.Unlock()
+	}
+	return action
+}
+
+// discarded reports whether the chunk's data is dropped rather than stored.
+func (chunk *chunkStream) discarded() bool {
+	return chunk.tokenInfo == nil || chunk.refused != nil
+}
+
+// body is the received chunk for storeChunk.
+func (chunk *chunkStream) body(receive time.Duration) chunkBody {
+	var digest [sha256.Size]byte
+	chunk.hash.Sum(digest[:0])
+	if chunk.file != nil {
+		return newFileChunk(chunk.file, chunk.size, digest, receive)
+	}
+	return newMemoryChunk(chunk.cmd.ChunkData, digest, receive)
+}
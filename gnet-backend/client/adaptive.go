@@ -0,0 +1,91 @@
+// adaptive.go - Chunk size and parallelism picked from measured throughput
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// ============================================
+// Link Estimate
+// ============================================
+
+// A session's chunk size is fixed when it is opened, so adaptive sizing works
+// across uploads: every acknowledged chunk feeds a per-connection throughput
+// estimate and every network failure a failure rate, and the next session
+// gets chunks that take about ADAPTIVE_CHUNK_TIME to send. On a flaky link the
+// target drops to FLAKY_CHUNK_TIME, so a resume repeats less work. Within an
+// upload, the number of connections is adapted instead (see window).
+
+const (
+	ADAPTIVE_CHUNK_TIME   = 4 * time.Second
+	FLAKY_CHUNK_TIME      = 1 * time.Second
+	FLAKY_FAILURE_RATE    = 0.1 // Share of chunk attempts failing that counts as flaky
+	ADAPTIVE_MIN_SAMPLES  = 2   // Chunks measured before the estimate is used
+	ADAPTIVE_EWMA_WEIGHT  = 0.3 // Weight of the newest sample
+	ADAPTIVE_ROUNDING     = 1024 * 1024
+	ADAPTIVE_GAIN         = 0.1 // Throughput gain that justifies one more connection
+	ADAPTIVE_LEVEL_CHUNKS = 2   // Chunks per connection measured before deciding
+
+	// Every connection holds its chunk in memory, so chunks past the old
+	// 100 MB limit are only sent when UploadOptions.ChunkSize asks for them.
+	ADAPTIVE_MAX_CHUNK = 100 * 1024 * 1024
+)
+
+type linkStats struct {
+	mu          sync.Mutex
+	bytesPerSec float64 // One connection's throughput
+	failureRate float64
+	samples     int
+}
+
+// chunk records one acknowledged chunk of n bytes that took d on the wire.
+func (l *linkStats) chunk(n int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(n) / d.Seconds()
+	if l.samples == 0 {
+		l.bytesPerSec = rate
+	} else {
+		l.bytesPerSec += ADAPTIVE_EWMA_WEIGHT * (rate - l.bytesPerSec)
+	}
+	l.samples++
+}
+
+// attempt records whether one chunk attempt failed on the network.
+func (l *linkStats) attempt(failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sample := 0.0
+	if failed {
+		sample = 1
+	}
+	l.failureRate += ADAPTIVE_EWMA_WEIGHT * (sample - l.failureRate)
+}
+
+// chunkSize is the chunk size to open the next session with.
+func (l *linkStats) chunkSize() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.samples < ADAPTIVE_MIN_SAMPLES {
+		return DEFAULT_CHUNK_SIZE
+	}
+	target := ADAPTIVE_CHUNK_TIME
+	if l.failureRate >= FLAKY_FAILURE_RATE {
+		target = FLAKY_CHUNK_TIME
+	}
+	size := int64(l.bytesPerSec*target.Seconds()) / ADAPTIVE_ROUNDING * ADAPTIVE_ROUNDING
+	return uint32(max(MIN_CHUNK_SIZE, min(size, ADAPTIVE_MAX_CHUNK)))
+}
+
+// SuggestedChunkSize is the chunk size an Adaptive upload would open its
+// session with now: DEFAULT_CHUNK_SIZE until a few chunks have been measured.
+func (c *Client) SuggestedChunkSize() uint32 {
+	return c.opts.link.chunkSize()
+}
@@ -0,0 +1,509 @@
+// Package client is the Go SDK for the file server's binary upload protocol.
+// NewHTTP speaks the HTTP chunk API instead, for where the binary port is out
+// of reach (cmd/wasm runs it in the browser).
+//
+//	c := client.New("localhost:9090", token)
+//	defer c.Close()
+//	result, err := c.UploadFile(ctx, "video.mp4", client.UploadOptions{})
+//
+// A Client holds one connection and sends one command at a time. Network
+// failures close the connection; the command is retried on a fresh one with
+// exponential backoff. Server-side rejections (ServerError, ErrAuthFailed,
+// HashMismatchError, RateLimitedError) are returned as-is and never retried;
+// UploadFile sends a busy or rate-limited chunk again.
+//
+// Uploaded files are read back over the HTTP API with OpenRemote.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"backend/protocol"
+)
+
+// ============================================
+// Client
+// ============================================
+
+const (
+	DEFAULT_DIAL_TIMEOUT    = 10 * time.Second
+	DEFAULT_REQUEST_TIMEOUT = 5 * time.Minute // Covers the server's S3 part upload
+	DEFAULT_MAX_RETRIES     = 5
+	DEFAULT_RETRY_BACKOFF   = 500 * time.Millisecond
+	MAX_RETRY_BACKOFF       = 30 * time.Second
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// BUSY_MESSAGE starts the server's error when a session already has its
+// maximum number of chunks in flight (MAX_SESSION_INFLIGHT on the server), or
+// the server as a whole is out of chunk workers or chunk memory.
+const BUSY_MESSAGE = "Too many chunks in flight"
+
+// ServerError is a RESP_ERROR sent by the server. Message includes the
+// server's conn_id tag, which locates the failure in its logs.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// HashMismatchError is sent instead of the completion of an upload started
+// with InitUploadVerified whose assembled file did not have the declared
+// SHA-256. The server has failed the session and deleted the file.
+type HashMismatchError struct {
+	Declared string
+	SHA256   string // The assembled file's
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("uploaded file has SHA-256 %s, not the declared %s", e.SHA256, e.Declared)
+}
+
+// RateLimitedError is sent instead of the answer to an init or chunk over
+// one of the server's rate limits. Nothing was done; the same command passes
+// after RetryAfter.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// IsBusy reports whether err is the server's backpressure signal, or a rate
+// limit. The chunk was not stored and can be sent again after a short wait.
+func IsBusy(err error) bool {
+	var serverErr *ServerError
+	var limited *RateLimitedError
+	return errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, BUSY_MESSAGE) ||
+		errors.As(err, &limited)
+}
+
+type Client struct {
+	addr  string
+	token string
+	opts  options
+
+	conn   net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex // One command in flight per connection
+
+	http *httpTransport // Set by NewHTTP instead of the binary connection
+}
+
+type options struct {
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	maxRetries     int
+	retryBackoff   time.Duration
+	dialer         func(ctx context.Context, addr string) (net.Conn, error)
+	tls            *tls.Config
+	limiter        *rate.Limiter // Shared by clones, so parallel uploads split it
+	link           *linkStats    // Shared by clones, so every connection feeds one estimate
+	sendWindow     *DailyWindow
+	httpClient     *http.Client
+	compression    uint8          // Codecs offered to the server
+	codecs         *sessionCodecs // Shared by clones, which send chunks of the same sessions
+}
+
+type Option func(*options)
+
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) { o.dialTimeout = d }
+}
+
+// WithRequestTimeout bounds one command round trip when ctx has no deadline.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) { o.requestTimeout = d }
+}
+
+// WithRetries sets how many times a command is retried after a network error,
+// starting at backoff and doubling up to MAX_RETRY_BACKOFF. Zero disables
+// retries.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = n
+		o.retryBackoff = backoff
+	}
+}
+
+// WithDialer replaces the TCP dialer, e.g. for TLS.
+func WithDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(o *options) { o.dialer = dial }
+}
+
+// WithTLS connects to the server's TLS port (GNET_TLS_ADDR) instead. A nil
+// cfg checks the server's certificate against the system roots; set
+// Certificates in cfg for a server that asks for client certificates.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+		if o.tls == nil {
+			o.tls = &tls.Config{}
+		}
+	}
+}
+
+// New returns a client for the binary port at addr (host:port), usually the
+// gateway's. The connection is opened lazily on the first command.
+func New(addr, token string, opts ...Option) *Client {
+	o := options{
+		dialTimeout:    DEFAULT_DIAL_TIMEOUT,
+		requestTimeout: DEFAULT_REQUEST_TIMEOUT,
+		maxRetries:     DEFAULT_MAX_RETRIES,
+		retryBackoff:   DEFAULT_RETRY_BACKOFF,
+		link:           &linkStats{},
+		codecs:         &sessionCodecs{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.dialer == nil {
+		d := &net.Dialer{Timeout: o.dialTimeout, KeepAlive: 30 * time.Second}
+		o.dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+		if o.tls != nil {
+			td := &tls.Dialer{NetDialer: d, Config: o.tls}
+			o.dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+				return td.DialContext(ctx, "tcp", addr)
+			}
+		}
+	}
+	if o.limiter != nil {
+		o.dialer = throttledDialer(o.dialer, o.limiter)
+	}
+
+	return &Client{addr: addr, token: token, opts: o}
+}
+
+// SetToken replaces the auth token for subsequent commands, e.g. after a
+// refresh.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// clone returns an unconnected client with the same address, token and
+// options, for sending on a second connection.
+func (c *Client) clone() *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &Client{addr: c.addr, token: c.token, opts: c.opts, http: c.http}
+}
+
+// Clone returns an unconnected client with the same address, token and
+// options, sharing the bandwidth limit and throughput estimate. A Client
+// sends one command at a time, so upload several files at once with a clone
+// per goroutine.
+func (c *Client) Clone() *Client {
+	return c.clone()
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeConn()
+}
+
+func (c *Client) closeConn() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.reader = nil
+	return err
+}
+
+// do sends one command and returns the decoded response, reconnecting and
+// retrying on network errors.
+func (c *Client) do(ctx context.Context, cmd protocol.Message) (protocol.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.token) > protocol.MAX_TOKEN_SIZE {
+		return nil, fmt.Errorf("auth token too long: %d bytes (max %d)", len(c.token), protocol.MAX_TOKEN_SIZE)
+	}
+
+	backoff := c.opts.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var resp protocol.Message
+		var err error
+		if c.http != nil {
+			resp, err = c.http.roundTrip(ctx, c.token, cmd)
+		} else {
+			resp, err = c.roundTrip(ctx, cmd)
+		}
+		if cmd.Code() == protocol.CMD_UPLOAD_CHUNK {
+			c.opts.link.attempt(err != nil)
+		}
+		if err == nil {
+			return c.checkResponse(resp)
+		}
+
+		c.closeConn()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.opts.maxRetries {
+			return nil, fmt.Errorf("%s failed after %d attempts: %w", commandName(cmd), attempt+1, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, MAX_RETRY_BACKOFF)
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, cmd protocol.Message) (protocol.Message, error) {
+	if c.conn == nil {
+		dialCtx, cancel := context.WithTimeout(ctx, c.opts.dialTimeout)
+		conn, err := c.opts.dialer(dialCtx, c.addr)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.reader = bufio.NewReaderSize(conn, 64*1024)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.opts.requestTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+
+	// Unblock the read when ctx is cancelled before the deadline
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := c.conn.Write(protocol.AppendFrame(nil, c.token, cmd)); err != nil {
+		return nil, err
+	}
+	return protocol.ReadResponse(c.reader)
+}
+
+func (c *Client) checkResponse(resp protocol.Message) (protocol.Message, error) {
+	switch resp := resp.(type) {
+	case *protocol.ErrorResp:
+		return nil, &ServerError{Message: resp.Message}
+	case *protocol.AuthFailedResp:
+		return nil, ErrAuthFailed
+	case *protocol.HashMismatchResp:
+		return nil, &HashMismatchError{Declared: resp.Declared, SHA256: resp.SHA256}
+	case *protocol.RateLimitedResp:
+		return nil, &RateLimitedError{RetryAfter: time.Duration(resp.RetryAfterMS) * time.Millisecond}
+	}
+	return resp, nil
+}
+
+func commandName(cmd protocol.Message) string {
+	if name, ok := protocol.CommandNames[cmd.Code()]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", cmd.Code())
+}
+
+func unexpected(cmd, resp protocol.Message) error {
+	return fmt.Errorf("unexpected response 0x%02x to %s", resp.Code(), commandName(cmd))
+}
+
+// ============================================
+// Commands
+// ============================================
+
+type Session struct {
+	ID          string
+	S3Key       string
+	ChunkSize   uint32 // Needed to resume the session
+	Compression uint8  // COMPRESSION_* the server chose for its chunks, 0 for none
+
+	// Set by InitUploadVerified when the server already stored the file and
+	// completed the session by copying it; there are no chunks to send.
+	Complete *Completed
+}
+
+type Progress struct {
+	Received uint32
+	Total    uint32
+}
+
+// ChunkResult is the outcome of one UploadChunk. Complete is set when the
+// chunk was the last one and the server assembled the file.
+type ChunkResult struct {
+	Index       uint32
+	Progress    Progress
+	Duplicate   bool          // Already received; nothing was stored
+	BytesPerSec uint64        // Server-measured rate, 0 until known
+	ETA         time.Duration // -1 until known
+	Complete    *Completed
+
+	// Set by Upload and ResumeUpload: every chunk below Contiguous has been
+	// acknowledged, and SHA256 is the chunk's digest if HashChunks was set.
+	Contiguous uint32
+	SHA256     []byte
+}
+
+type Completed struct {
+	S3Key string
+	Size  uint64
+}
+
+type Status struct {
+	State string
+	Progress
+}
+
+// InitUpload opens a session for fileName split into totalChunks chunks of
+// chunkSize bytes (the last may be shorter). If the connection drops after the
+// server accepted the command, the retry opens a second session; the first is
+// reaped by the server's session timeout.
+func (c *Client) InitUpload(ctx context.Context, fileName string, totalChunks, chunkSize uint32) (*Session, error) {
+	cmd := &protocol.InitUpload{FileName: fileName, TotalChunks: totalChunks, ChunkSize: chunkSize, Compression: c.opts.compression}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *protocol.ReadyResp:
+		return &Session{ID: resp.SessionID, S3Key: resp.S3Key, ChunkSize: chunkSize}, nil
+	case *protocol.ReadyCompressedResp:
+		c.opts.codecs.set(resp.SessionID, resp.Compression)
+		return &Session{ID: resp.SessionID, S3Key: resp.S3Key, ChunkSize: chunkSize, Compression: resp.Compression}, nil
+	}
+	return nil, unexpected(cmd, resp)
+}
+
+// InitUploadVerified is InitUpload for a file whose SHA-256 (hex) is known:
+// the server checks the assembled file against it, and the last chunk is
+// answered with a *HashMismatchError if it does not match. If the server
+// already stores the file, the session is completed at once (Session.Complete).
+func (c *Client) InitUploadVerified(ctx context.Context, fileName string, totalChunks, chunkSize uint32, sha256 string) (*Session, error) {
+	cmd := &protocol.InitUploadVerified{FileName: fileName, TotalChunks: totalChunks, ChunkSize: chunkSize, SHA256: sha256, Compression: c.opts.compression}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *protocol.ReadyResp:
+		return &Session{ID: resp.SessionID, S3Key: resp.S3Key, ChunkSize: chunkSize}, nil
+	case *protocol.ReadyCompressedResp:
+		c.opts.codecs.set(resp.SessionID, resp.Compression)
+		return &Session{ID: resp.SessionID, S3Key: resp.S3Key, ChunkSize: chunkSize, Compression: resp.Compression}, nil
+	case *protocol.CompleteResp:
+		return &Session{S3Key: resp.S3Key, ChunkSize: chunkSize, Complete: &Completed{S3Key: resp.S3Key, Size: resp.FileSize}}, nil
+	}
+	return nil, unexpected(cmd, resp)
+}
+
+// UploadChunk sends chunk index of the session, compressed if the session
+// was opened or resumed with compression. Chunks are idempotent, so a
+// retried chunk comes back as Duplicate rather than an error.
+func (c *Client) UploadChunk(ctx context.Context, sessionID string, index uint32, chunk []byte) (*ChunkResult, error) {
+	data, err := c.compressChunk(sessionID, chunk)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &protocol.UploadChunk{SessionID: sessionID, ChunkIndex: index, ChunkData: data}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ChunkResult{Index: index, ETA: -1}
+	switch resp := resp.(type) {
+	case *protocol.ChunkAckResp:
+		result.Progress = Progress{Received: resp.Received, Total: resp.Total}
+		result.BytesPerSec = resp.BytesPerSec
+		if resp.ETASeconds != protocol.ETA_UNKNOWN {
+			result.ETA = time.Duration(resp.ETASeconds) * time.Second
+		}
+	case *protocol.DuplicateResp:
+		result.Duplicate = true
+		result.Progress = Progress{Received: resp.Received}
+	case *protocol.CompleteResp:
+		result.Complete = &Completed{S3Key: resp.S3Key, Size: resp.FileSize}
+		result.ETA = 0
+		c.opts.codecs.set(sessionID, 0)
+	default:
+		return nil, unexpected(cmd, resp)
+	}
+	return result, nil
+}
+
+func (c *Client) Pause(ctx context.Context, sessionID string) (*Progress, error) {
+	cmd := &protocol.PauseUpload{SessionID: sessionID}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	paused, ok := resp.(*protocol.PausedResp)
+	if !ok {
+		return nil, unexpected(cmd, resp)
+	}
+	return &Progress{Received: paused.Received, Total: paused.Total}, nil
+}
+
+// Resume continues a paused session and returns the chunk indexes the server
+// has not received yet. Compression is negotiated again, as at InitUpload.
+func (c *Client) Resume(ctx context.Context, sessionID string) (*Progress, []uint32, error) {
+	cmd := &protocol.ResumeUpload{SessionID: sessionID, Compression: c.opts.compression}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch resp := resp.(type) {
+	case *protocol.ResumedResp:
+		c.opts.codecs.set(sessionID, 0)
+		return &Progress{Received: resp.Received, Total: resp.Total}, resp.Missing, nil
+	case *protocol.ResumedCompressedResp:
+		c.opts.codecs.set(sessionID, resp.Compression)
+		return &Progress{Received: resp.Received, Total: resp.Total}, resp.Missing, nil
+	}
+	return nil, nil, unexpected(cmd, resp)
+}
+
+func (c *Client) Cancel(ctx context.Context, sessionID string) error {
+	cmd := &protocol.CancelUpload{SessionID: sessionID}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*protocol.CancelledResp); !ok {
+		return unexpected(cmd, resp)
+	}
+	c.opts.codecs.set(sessionID, 0)
+	return nil
+}
+
+func (c *Client) Status(ctx context.Context, sessionID string) (*Status, error) {
+	cmd := &protocol.GetStatus{SessionID: sessionID}
+	resp, err := c.do(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	status, ok := resp.(*protocol.StatusResp)
+	if !ok {
+		return nil, unexpected(cmd, resp)
+	}
+	return &Status{State: status.State, Progress: Progress{Received: status.Received, Total: status.Total}}, nil
+}
@@ -0,0 +1,65 @@
+// compress.go - Chunk compression negotiated with the server
+package client
+
+import (
+	"sync"
+
+	"backend/compression"
+)
+
+// ============================================
+// Compression
+// ============================================
+
+// With WithCompression, InitUpload, InitUploadVerified and Resume offer the
+// server the given codecs, and it picks the one the session's chunks are
+// sent with (Session.Compression), or none. UploadChunk then compresses
+// every chunk of the session on the calling goroutine, so with Parallelism
+// the work is spread over the sending workers. The choice is remembered per
+// session and shared by clones, whichever connection sends the chunk.
+// Servers that predate compression, and NewHTTP, just answer without it.
+//
+// Compression pays off for text, documents and uncompressed images on links
+// slower than the codec: zstd manages a few hundred MB/s per core, LZ4 a
+// few GB/s. Video, photos and archives are already compressed and only cost
+// CPU.
+
+// WithCompression offers the COMPRESSION_* codecs in codecs, e.g.
+// compression.Supported for all of them.
+func WithCompression(codecs uint8) Option {
+	return func(o *options) { o.compression = codecs & compression.Supported }
+}
+
+// sessionCodecs is the codec each session's chunks are compressed with.
+type sessionCodecs struct {
+	mu     sync.Mutex
+	codecs map[string]uint8
+}
+
+func (sc *sessionCodecs) set(sessionID string, codec uint8) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if codec == 0 {
+		delete(sc.codecs, sessionID)
+		return
+	}
+	if sc.codecs == nil {
+		sc.codecs = make(map[string]uint8)
+	}
+	sc.codecs[sessionID] = codec
+}
+
+func (sc *sessionCodecs) get(sessionID string) uint8 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.codecs[sessionID]
+}
+
+// compressChunk returns chunk as the session's chunks are sent.
+func (c *Client) compressChunk(sessionID string, chunk []byte) ([]byte, error) {
+	codec := c.opts.codecs.get(sessionID)
+	if codec == 0 {
+		return chunk, nil
+	}
+	return compression.Compress(codec, nil, chunk)
+}
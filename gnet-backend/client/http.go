@@ -0,0 +1,250 @@
+// http.go - The chunk commands over the HTTP chunk API
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"backend/protocol"
+)
+
+// ============================================
+// HTTP Transport
+// ============================================
+
+// A browser cannot open the binary port, so NewHTTP runs the same Client -
+// windowing, retries, adaptive sizing, resume - over the /upload/* endpoints
+// instead. Each command maps to one request and the JSON answer is turned
+// back into the binary protocol's response, so everything above do() behaves
+// the same on both transports. Error statuses become RESP_ERROR (429 and the
+// 503 of a server out of chunk memory carry BUSY_MESSAGE, so IsBusy still
+// works), RESP_RATE_LIMITED (a 429 with retry_after_ms) or RESP_AUTH_FAILED
+// and are not retried; only failed requests are. Chunks carry their SHA-256
+// so the server rejects corrupted ones.
+//
+// This is what cmd/wasm exports to the web client.
+
+type httpTransport struct {
+	client   *http.Client
+	endpoint string
+}
+
+// WithHTTPClient replaces http.DefaultClient for a client made by NewHTTP.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(o *options) { o.httpClient = hc }
+}
+
+// NewHTTP returns a client for the HTTP chunk API at endpoint, e.g.
+// "http://localhost:8080". WithDialer and WithBandwidthLimit do not apply.
+func NewHTTP(endpoint, token string, opts ...Option) *Client {
+	c := New("", token, opts...)
+	hc := c.opts.httpClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c.http = &httpTransport{client: hc, endpoint: strings.TrimSuffix(endpoint, "/")}
+	return c
+}
+
+type httpStatus struct {
+	State    string   `json:"state"`
+	Received uint32   `json:"received"`
+	Total    uint32   `json:"total"`
+	Missing  []uint32 `json:"missing"`
+}
+
+// rejection is an error status, carrying the protocol response the binary
+// port would have sent.
+type rejection struct {
+	resp protocol.Message
+}
+
+func (r *rejection) Error() string {
+	return fmt.Sprintf("rejected with 0x%02x", r.resp.Code())
+}
+
+func (t *httpTransport) roundTrip(ctx context.Context, token string, cmd protocol.Message) (protocol.Message, error) {
+	resp, err := t.send(ctx, token, cmd)
+	var rejected *rejection
+	if errors.As(err, &rejected) {
+		return rejected.resp, nil
+	}
+	return resp, err
+}
+
+func (t *httpTransport) send(ctx context.Context, token string, cmd protocol.Message) (protocol.Message, error) {
+	switch cmd := cmd.(type) {
+	case *protocol.InitUpload:
+		body, _ := json.Marshal(map[string]any{
+			"file_name":    cmd.FileName,
+			"total_chunks": cmd.TotalChunks,
+			"chunk_size":   cmd.ChunkSize,
+		})
+		var ready struct {
+			SessionID string `json:"session_id"`
+			S3Key     string `json:"s3_key"`
+		}
+		if err := t.request(ctx, token, "POST", "/upload/init", "application/json", body, &ready); err != nil {
+			return nil, err
+		}
+		return &protocol.ReadyResp{SessionID: ready.SessionID, S3Key: ready.S3Key}, nil
+
+	case *protocol.InitUploadVerified:
+		body, _ := json.Marshal(map[string]any{
+			"file_name":    cmd.FileName,
+			"total_chunks": cmd.TotalChunks,
+			"chunk_size":   cmd.ChunkSize,
+			"sha256":       cmd.SHA256,
+		})
+		var ready struct {
+			SessionID string `json:"session_id"`
+			S3Key     string `json:"s3_key"`
+			Complete  bool   `json:"complete"`
+			Size      uint64 `json:"size"`
+		}
+		if err := t.request(ctx, token, "POST", "/upload/init", "application/json", body, &ready); err != nil {
+			return nil, err
+		}
+		if ready.Complete {
+			return &protocol.CompleteResp{S3Key: ready.S3Key, FileSize: ready.Size}, nil
+		}
+		return &protocol.ReadyResp{SessionID: ready.SessionID, S3Key: ready.S3Key}, nil
+
+	case *protocol.UploadChunk:
+		return t.uploadChunk(ctx, token, cmd)
+
+	case *protocol.PauseUpload:
+		var status httpStatus
+		if err := t.request(ctx, token, "POST", "/upload/pause/"+url.PathEscape(cmd.SessionID), "", nil, &status); err != nil {
+			return nil, err
+		}
+		return &protocol.PausedResp{Received: status.Received, Total: status.Total}, nil
+
+	case *protocol.ResumeUpload:
+		var status httpStatus
+		if err := t.request(ctx, token, "POST", "/upload/resume/"+url.PathEscape(cmd.SessionID), "", nil, &status); err != nil {
+			return nil, err
+		}
+		return &protocol.ResumedResp{Received: status.Received, Total: status.Total, Missing: status.Missing}, nil
+
+	case *protocol.CancelUpload:
+		if err := t.request(ctx, token, "POST", "/upload/cancel/"+url.PathEscape(cmd.SessionID), "", nil, nil); err != nil {
+			return nil, err
+		}
+		return &protocol.CancelledResp{}, nil
+
+	case *protocol.GetStatus:
+		var status httpStatus
+		if err := t.request(ctx, token, "GET", "/upload/status/"+url.PathEscape(cmd.SessionID), "", nil, &status); err != nil {
+			return nil, err
+		}
+		return &protocol.StatusResp{State: status.State, Received: status.Received, Total: status.Total}, nil
+	}
+	return nil, fmt.Errorf("%s has no HTTP endpoint", commandName(cmd))
+}
+
+func (t *httpTransport) uploadChunk(ctx context.Context, token string, cmd *protocol.UploadChunk) (protocol.Message, error) {
+	// The server reads the fields before the chunk part, so order matters
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	sum := sha256.Sum256(cmd.ChunkData)
+	form.WriteField("session_id", cmd.SessionID)
+	form.WriteField("chunk_index", strconv.FormatUint(uint64(cmd.ChunkIndex), 10))
+	form.WriteField("sha256", hex.EncodeToString(sum[:]))
+	form.WriteField("size", strconv.Itoa(len(cmd.ChunkData)))
+	part, _ := form.CreateFormFile("chunk", fmt.Sprintf("chunk-%d", cmd.ChunkIndex))
+	part.Write(cmd.ChunkData)
+	form.Close()
+
+	var ack struct {
+		Duplicate      bool    `json:"duplicate"`
+		Received       uint32  `json:"received"`
+		Total          uint32  `json:"total"`
+		BytesPerSecond uint64  `json:"bytes_per_second"`
+		ETASeconds     *uint32 `json:"eta_seconds"`
+		Complete       bool    `json:"complete"`
+		S3Key          string  `json:"s3_key"`
+		Size           uint64  `json:"size"`
+	}
+	if err := t.request(ctx, token, "POST", "/upload/chunk", form.FormDataContentType(), body.Bytes(), &ack); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ack.Complete:
+		return &protocol.CompleteResp{S3Key: ack.S3Key, FileSize: ack.Size}, nil
+	case ack.Duplicate:
+		return &protocol.DuplicateResp{ChunkIndex: cmd.ChunkIndex, Received: ack.Received}, nil
+	}
+	eta := uint32(protocol.ETA_UNKNOWN)
+	if ack.ETASeconds != nil {
+		eta = *ack.ETASeconds
+	}
+	return &protocol.ChunkAckResp{
+		ChunkIndex:  cmd.ChunkIndex,
+		Received:    ack.Received,
+		Total:       ack.Total,
+		BytesPerSec: ack.BytesPerSecond,
+		ETASeconds:  eta,
+	}, nil
+}
+
+// request sends one API call and decodes a successful answer into out.
+func (t *httpTransport) request(ctx context.Context, token, method, path, contentType string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, t.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &rejection{&protocol.AuthFailedResp{}}
+	}
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error        string `json:"error"`
+			Declared     string `json:"declared"`
+			SHA256       string `json:"sha256"`
+			RetryAfterMS uint32 `json:"retry_after_ms"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		switch {
+		case body.Declared != "":
+			// The server's answer to a file that failed its hash check
+			return &rejection{&protocol.HashMismatchResp{Declared: body.Declared, SHA256: body.SHA256}}
+		case resp.StatusCode == http.StatusTooManyRequests && body.RetryAfterMS > 0:
+			return &rejection{&protocol.RateLimitedResp{RetryAfterMS: body.RetryAfterMS}}
+		case body.Error == "":
+			body.Error = resp.Status
+		}
+		return &rejection{&protocol.ErrorResp{Message: body.Error}}
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+// parallel.go - Concurrent chunk sending with server-driven backoff
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Chunk Sending
+// ============================================
+
+// Each of UploadOptions.Parallelism workers owns one connection and its own
+// chunk buffer. A shared window caps how many chunks are in flight: it
+// shrinks by half whenever the server answers BUSY_MESSAGE and grows by one
+// after a full window of acknowledged chunks, so parallel uploads settle at
+// what the server is willing to take (AIMD, as in TCP congestion control).
+// An Adaptive upload starts the window at one and grows it only while the
+// measured throughput keeps rising by ADAPTIVE_GAIN, since on a saturated
+// link more connections just split the same bandwidth.
+
+const (
+	BUSY_BACKOFF     = 250 * time.Millisecond
+	MAX_BUSY_BACKOFF = 5 * time.Second
+)
+
+func (c *Client) sendChunks(ctx context.Context, sessionID string, r io.ReaderAt, size int64, chunkSize, totalChunks uint32, chunks []uint32, opts UploadOptions) (*Completed, error) {
+	workers := max(1, min(opts.Parallelism, len(chunks)))
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan uint32, len(chunks))
+	for _, index := range chunks {
+		queue <- index
+	}
+
+	var (
+		win       = newWindow(workers, opts.Adaptive)
+		order     = newCompletionTracker(totalChunks, chunks)
+		mu        sync.Mutex // Guards order, completed, remaining and OnChunk calls
+		completed *Completed
+		remaining = len(chunks)
+		wg        sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		conn := c
+		if i > 0 {
+			conn = c.clone()
+			defer conn.Close()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunkSize)
+			for {
+				var index uint32
+				select {
+				case next, ok := <-queue:
+					if !ok {
+						return
+					}
+					index = next
+				case <-ctx.Done():
+					return
+				}
+
+				result, err := conn.sendChunk(ctx, win, sessionID, r, size, chunkSize, index, buf, opts.HashChunks)
+				if err != nil {
+					cancel(fmt.Errorf("chunk %d: %w", index, err))
+					return
+				}
+
+				mu.Lock()
+				result.Contiguous = order.ack(index)
+				if opts.OnChunk != nil {
+					opts.OnChunk(result)
+				}
+				if result.Complete != nil {
+					completed = result.Complete
+				}
+				remaining--
+				if remaining == 0 {
+					close(queue)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if completed != nil {
+		return completed, nil
+	}
+	if err := context.Cause(ctx); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("all chunks sent but the server did not complete the upload")
+}
+
+// sendChunk reads, optionally hashes, and uploads one chunk, waiting out
+// BUSY responses.
+func (c *Client) sendChunk(ctx context.Context, win *window, sessionID string, r io.ReaderAt, size int64, chunkSize, index uint32, buf []byte, hash bool) (*ChunkResult, error) {
+	offset := int64(index) * int64(chunkSize)
+	n := min(int64(chunkSize), size-offset)
+	if _, err := r.ReadAt(buf[:n], offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+
+	var digest []byte
+	if hash {
+		sum := sha256.Sum256(buf[:n])
+		digest = sum[:]
+	}
+
+	backoff := BUSY_BACKOFF
+	for {
+		if c.opts.sendWindow != nil {
+			if err := c.opts.sendWindow.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if err := win.acquire(ctx); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		result, err := c.UploadChunk(ctx, sessionID, index, buf[:n])
+		busy := IsBusy(err)
+		if err == nil && !result.Duplicate {
+			c.opts.link.chunk(int(n), time.Since(start))
+			win.release(false, n)
+		} else {
+			win.release(busy, 0)
+		}
+
+		if !busy {
+			if err != nil {
+				return nil, err
+			}
+			result.SHA256 = digest
+			return result, nil
+		}
+
+		wait := backoff
+		var limited *RateLimitedError
+		if errors.As(err, &limited) {
+			wait = max(wait, limited.RetryAfter)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, MAX_BUSY_BACKOFF)
+	}
+}
+
+// ============================================
+// Window
+// ============================================
+
+type window struct {
+	mu       sync.Mutex
+	limit    int
+	max      int
+	inflight int
+	acked    int           // Acknowledged chunks since the limit last changed
+	wake     chan struct{} // Closed and replaced whenever a slot frees up
+
+	adaptive   bool
+	settled    bool      // More connections stopped paying off
+	levelStart time.Time // When the limit last changed
+	levelBytes int64     // Bytes acknowledged since then
+	levelRate  float64   // Throughput at the previous limit
+}
+
+func newWindow(max int, adaptive bool) *window {
+	w := &window{limit: max, max: max, wake: make(chan struct{}), adaptive: adaptive, levelStart: time.Now()}
+	if adaptive {
+		w.limit = 1
+	}
+	return w
+}
+
+func (w *window) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.inflight < w.limit {
+			w.inflight++
+			w.mu.Unlock()
+			return nil
+		}
+		wake := w.wake
+		w.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot; n is the size of the chunk it acknowledged, if any.
+func (w *window) release(busy bool, n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.inflight--
+	switch {
+	case busy:
+		w.limit = max(1, w.limit/2)
+		w.acked = 0
+		w.settled = false
+		w.newLevel(0)
+	case w.adaptive:
+		if n > 0 {
+			w.adapt(n)
+		}
+	case w.limit < w.max:
+		w.acked++
+		if w.acked >= w.limit {
+			w.limit++
+			w.acked = 0
+		}
+	}
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
+
+// adapt adds a connection after each full measurement at the current limit
+// that beat the previous one, and settles (dropping the last addition if it
+// made things worse) once one does not.
+func (w *window) adapt(n int64) {
+	if w.settled || w.limit >= w.max {
+		return
+	}
+	w.acked++
+	w.levelBytes += n
+	if w.acked < w.limit*ADAPTIVE_LEVEL_CHUNKS {
+		return
+	}
+
+	rate := float64(w.levelBytes) / time.Since(w.levelStart).Seconds()
+	switch {
+	case w.levelRate == 0 || rate > w.levelRate*(1+ADAPTIVE_GAIN):
+		w.limit++
+	case rate < w.levelRate:
+		w.limit = max(1, w.limit-1)
+		w.settled = true
+	default:
+		w.settled = true
+	}
+	w.acked = 0
+	w.newLevel(rate)
+}
+
+func (w *window) newLevel(rate float64) {
+	w.levelRate = rate
+	w.levelStart = time.Now()
+	w.levelBytes = 0
+}
+
+// ============================================
+// Completion Order
+// ============================================
+
+// completionTracker follows which chunks are acknowledged so callers can
+// checkpoint the contiguous prefix even though chunks finish out of order.
+type completionTracker struct {
+	done []bool
+	next uint32 // First chunk not yet acknowledged
+}
+
+// newCompletionTracker treats every chunk not in pending as already done,
+// which is the case for a resumed session.
+func newCompletionTracker(totalChunks uint32, pending []uint32) *completionTracker {
+	t := &completionTracker{done: make([]bool, totalChunks)}
+	for i := range t.done {
+		t.done[i] = true
+	}
+	for _, index := range pending {
+		if index < totalChunks {
+			t.done[index] = false
+		}
+	}
+	t.advance()
+	return t
+}
+
+func (t *completionTracker) ack(index uint32) uint32 {
+	if index < uint32(len(t.done)) {
+		t.done[index] = true
+	}
+	t.advance()
+	return t.next
+}
+
+func (t *completionTracker) advance() {
+	for t.next < uint32(len(t.done)) && t.done[t.next] {
+		t.next++
+	}
+}
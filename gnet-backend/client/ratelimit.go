@@ -0,0 +1,207 @@
+// ratelimit.go - Client-side bandwidth limiting and send windows
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ============================================
+// Bandwidth Limit
+// ============================================
+
+// RATE_LIMIT_SLICE is the largest write released at once, so a limited
+// upload shares the link smoothly instead of in chunk-sized bursts.
+const RATE_LIMIT_SLICE = 32 * 1024
+
+// WithBandwidthLimit caps the bytes per second written by the client,
+// including every extra connection of a parallel upload. Time spent waiting
+// for bandwidth does not count against the request timeout.
+func WithBandwidthLimit(bytesPerSec int64) Option {
+	return func(o *options) {
+		o.limiter = nil
+		if bytesPerSec > 0 {
+			o.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), RATE_LIMIT_SLICE)
+		}
+	}
+}
+
+func throttledDialer(dial func(ctx context.Context, addr string) (net.Conn, error), limiter *rate.Limiter) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{Conn: conn, limiter: limiter, kick: make(chan struct{})}, nil
+	}
+}
+
+type throttledConn struct {
+	net.Conn
+	limiter *rate.Limiter
+
+	mu       sync.Mutex
+	deadline time.Time
+	kick     chan struct{} // Closed and replaced whenever the deadline changes
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.kick)
+	c.kick = make(chan struct{})
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, RATE_LIMIT_SLICE)
+		if err := c.wait(n); err != nil {
+			return written, err
+		}
+		m, err := c.Conn.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// wait blocks until n bytes may be sent, then pushes the deadline back by
+// the time spent waiting.
+func (c *throttledConn) wait(n int) error {
+	delay := c.limiter.ReserveN(time.Now(), n).Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		deadline, kick := c.deadline, c.kick
+		c.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			// Also how a cancelled request interrupts the wait
+			return os.ErrDeadlineExceeded
+		}
+
+		select {
+		case <-timer.C:
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.deadline.IsZero() {
+				return nil
+			}
+			c.deadline = c.deadline.Add(delay)
+			return c.Conn.SetDeadline(c.deadline)
+		case <-kick:
+		}
+	}
+}
+
+// ============================================
+// Send Window
+// ============================================
+
+// DailyWindow is a time of day range, in the local time zone, during which
+// chunks may be sent, e.g. 22:00-06:00 for off-peak uploads. An End before
+// Start wraps past midnight; equal bounds allow the whole day.
+type DailyWindow struct {
+	Start time.Duration // Since midnight
+	End   time.Duration
+}
+
+// WithSendWindow holds chunks of Upload and ResumeUpload until the window is
+// open. A chunk already being sent when it closes is finished.
+func WithSendWindow(w DailyWindow) Option {
+	return func(o *options) { o.sendWindow = &w }
+}
+
+// ParseDailyWindow parses "HH:MM-HH:MM".
+func ParseDailyWindow(s string) (DailyWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return DailyWindow{}, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return DailyWindow{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return DailyWindow{}, err
+	}
+	return DailyWindow{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w DailyWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+func (w DailyWindow) Contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	switch {
+	case w.Start == w.End:
+		return true
+	case w.Start < w.End:
+		return offset >= w.Start && offset < w.End
+	default:
+		return offset >= w.Start || offset < w.End
+	}
+}
+
+// Next returns t if the window is open, otherwise when it next opens.
+func (w DailyWindow) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	open := midnight(t).Add(w.Start)
+	if open.Before(t) {
+		open = midnight(t.AddDate(0, 0, 1)).Add(w.Start)
+	}
+	return open
+}
+
+func (w DailyWindow) wait(ctx context.Context) error {
+	now := time.Now()
+	open := w.Next(now)
+	if !open.After(now) {
+		return nil
+	}
+
+	timer := time.NewTimer(open.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,290 @@
+// stream.go - Seekable reads of uploaded files over the HTTP API
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Remote Files
+// ============================================
+
+// A RemoteFile reads an uploaded file with ranged GETs, so media can be
+// consumed without downloading it first. Reads use a streaming token scoped
+// to the one file, not the account token; it is renewed STREAM_RENEW_BEFORE
+// its expiry, and once more if the server rejects it anyway (e.g. after a
+// restart). Every read carries If-Match, so a file replaced while it is being
+// read fails with ErrRemoteChanged instead of mixing two versions.
+
+const (
+	DEFAULT_READ_AHEAD  = 4 * 1024 * 1024 // Smallest range fetched by Read
+	STREAM_RENEW_BEFORE = 30 * time.Second
+)
+
+var ErrRemoteChanged = errors.New("remote file changed while reading")
+
+// HTTPError is an error status returned by the HTTP API.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+type RemoteOptions struct {
+	HTTPClient *http.Client // Defaults to http.DefaultClient
+	ReadAhead  int          // Defaults to DEFAULT_READ_AHEAD; Read only, ReadAt fetches exactly
+}
+
+type streamToken struct {
+	Token       string    `json:"token"`
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	ContentType string    `json:"content_type"`
+}
+
+// RemoteFile is an io.ReadSeeker and io.ReaderAt over an uploaded file.
+// ReadAt may be called concurrently; Read and Seek share one offset.
+type RemoteFile struct {
+	ctx       context.Context
+	http      *http.Client
+	endpoint  string
+	token     string
+	key       string
+	readAhead int
+
+	size        int64
+	etag        string
+	contentType string
+
+	mu        sync.Mutex // Guards the streaming token; held while renewing
+	streamURL string
+	expiresAt time.Time
+
+	readMu   sync.Mutex
+	offset   int64
+	buf      []byte
+	bufStart int64
+}
+
+// OpenRemote opens key (as listed by GET /files) through the HTTP API at
+// endpoint, e.g. "http://localhost:8080". ctx bounds every request made by
+// the returned file.
+func OpenRemote(ctx context.Context, endpoint, token, key string, opts RemoteOptions) (*RemoteFile, error) {
+	f := &RemoteFile{
+		ctx:       ctx,
+		http:      opts.HTTPClient,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		token:     token,
+		key:       key,
+		readAhead: opts.ReadAhead,
+	}
+	if f.http == nil {
+		f.http = http.DefaultClient
+	}
+	if f.readAhead <= 0 {
+		f.readAhead = DEFAULT_READ_AHEAD
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.renew(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RemoteFile) Size() int64         { return f.size }
+func (f *RemoteFile) ETag() string        { return f.etag }
+func (f *RemoteFile) ContentType() string { return f.contentType }
+
+// renew requests a new streaming token. Called with f.mu held.
+func (f *RemoteFile) renew() error {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodPost, f.endpoint+"/stream/token/"+escapeKey(f.key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token)
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+
+	var st streamToken
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return fmt.Errorf("invalid streaming token response: %w", err)
+	}
+	if f.etag == "" {
+		f.size = st.Size
+		f.etag = st.ETag
+		f.contentType = st.ContentType
+	} else if st.ETag != f.etag {
+		return ErrRemoteChanged
+	}
+	f.streamURL = f.endpoint + st.URL
+	f.expiresAt = st.ExpiresAt
+	return nil
+}
+
+// currentURL returns the streaming URL, renewing the token when it is about
+// to expire or when force is set.
+func (f *RemoteFile) currentURL(force bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if force || time.Until(f.expiresAt) < STREAM_RENEW_BEFORE {
+		if err := f.renew(); err != nil {
+			return "", err
+		}
+	}
+	return f.streamURL, nil
+}
+
+// fetch fills p from offset off, which the caller has clipped to the file.
+func (f *RemoteFile) fetch(p []byte, off int64) (int, error) {
+	for attempt := 0; ; attempt++ {
+		u, err := f.currentURL(attempt > 0)
+		if err != nil {
+			return 0, err
+		}
+		req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+		req.Header.Set("If-Match", f.etag)
+
+		resp, err := f.http.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			n, err := io.ReadFull(resp.Body, p)
+			resp.Body.Close()
+			return n, err
+		case http.StatusUnauthorized:
+			resp.Body.Close()
+			if attempt == 0 {
+				continue // Token expired or unknown to the server: renew once
+			}
+		case http.StatusPreconditionFailed:
+			resp.Body.Close()
+			return 0, ErrRemoteChanged
+		}
+		err = httpError(resp)
+		resp.Body.Close()
+		return 0, err
+	}
+}
+
+// ReadAt reads len(p) bytes at off with one ranged GET.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	p = p[:min(int64(want), f.size-off)]
+	n, err := f.fetch(p, off)
+	if err == nil && n < want {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Read reads from the current offset, fetching at least ReadAhead bytes per
+// request so small reads do not each cost a round trip.
+func (f *RemoteFile) Read(p []byte) (int, error) {
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
+
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.offset < f.bufStart || f.offset >= f.bufStart+int64(len(f.buf)) {
+		n := min(int64(max(len(p), f.readAhead)), f.size-f.offset)
+		if int64(cap(f.buf)) < n {
+			f.buf = make([]byte, n)
+		}
+		f.buf = f.buf[:n]
+		read, err := f.fetch(f.buf, f.offset)
+		f.buf = f.buf[:read]
+		f.bufStart = f.offset
+		if read == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.buf[f.offset-f.bufStart:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close drops the read buffer. The streaming token simply expires.
+func (f *RemoteFile) Close() error {
+	f.readMu.Lock()
+	f.buf = nil
+	f.readMu.Unlock()
+	return nil
+}
+
+func httpError(resp *http.Response) *HTTPError {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Error == "" {
+		body.Error = resp.Status
+	}
+	return &HTTPError{StatusCode: resp.StatusCode, Message: body.Error}
+}
+
+// escapeKey escapes each path segment of an S3 key but keeps the slashes.
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
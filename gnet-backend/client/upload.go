@@ -0,0 +1,175 @@
+// upload.go - Whole-file upload and resume on top of the chunk commands
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ============================================
+// File Uploads
+// ============================================
+
+const (
+	MIN_SMALL_CHUNK_SIZE = 256 * 1024      // Server minimum; the server combines such chunks into parts
+	MIN_CHUNK_SIZE       = 5 * 1024 * 1024 // S3 multipart minimum, the smallest chunk that is its own part
+	MAX_CHUNK_SIZE       = 1024 * 1024 * 1024
+	DEFAULT_CHUNK_SIZE   = 8 * 1024 * 1024
+)
+
+type UploadOptions struct {
+	ChunkSize uint32 // Defaults to DEFAULT_CHUNK_SIZE
+	Name      string // Name sent to the server; defaults to the file's base name
+
+	// OnSession is called once the session exists, before any chunk is sent,
+	// so the caller can persist the ID for a later Resume.
+	OnSession func(*Session)
+
+	// OnChunk is called after every acknowledged chunk. Calls never overlap,
+	// even with Parallelism > 1, but may arrive out of index order.
+	OnChunk func(*ChunkResult)
+
+	// Parallelism is the number of connections sending chunks at once;
+	// 0 or 1 sends them one after another on the client's own connection.
+	// The extra connections are opened for the upload and closed after it.
+	// Fewer are used while the server reports it is busy.
+	Parallelism int
+
+	// SHA256 is the hex SHA-256 of the whole file, if known. The server then
+	// checks the assembled file against it (InitUploadVerified), and may
+	// complete the upload at once with a copy of a file it already stores.
+	SHA256 string
+
+	// HashChunks computes each chunk's SHA-256 (ChunkResult.SHA256) on the
+	// sending goroutine, e.g. for a manifest.
+	HashChunks bool
+
+	// Adaptive sizes chunks from the throughput measured on earlier chunks
+	// of this Client when ChunkSize is 0 (Session.ChunkSize reports the
+	// choice), and starts with one connection, adding more up to Parallelism
+	// only while each addition raises throughput.
+	Adaptive bool
+}
+
+// UploadFile uploads the file at path in one new session.
+func (c *Client) UploadFile(ctx context.Context, path string, opts UploadOptions) (*Completed, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(path)
+	}
+	return c.Upload(ctx, f, info.Size(), opts)
+}
+
+// Upload sends size bytes read from r as opts.Name in one new session.
+func (c *Client) Upload(ctx context.Context, r io.ReaderAt, size int64, opts UploadOptions) (*Completed, error) {
+	if opts.Adaptive && opts.ChunkSize == 0 {
+		opts.ChunkSize = c.opts.link.chunkSize()
+	}
+	chunkSize, totalChunks, err := chunkLayout(size, opts.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var session *Session
+	if opts.SHA256 != "" {
+		session, err = c.InitUploadVerified(ctx, opts.Name, totalChunks, chunkSize, opts.SHA256)
+	} else {
+		session, err = c.InitUpload(ctx, opts.Name, totalChunks, chunkSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Complete != nil {
+		return session.Complete, nil
+	}
+	if opts.OnSession != nil {
+		opts.OnSession(session)
+	}
+
+	chunks := make([]uint32, totalChunks)
+	for i := range chunks {
+		chunks[i] = uint32(i)
+	}
+	return c.sendChunks(ctx, session.ID, r, size, chunkSize, totalChunks, chunks, opts)
+}
+
+// ResumeFile continues an interrupted session with the same file and chunk
+// size it was started with.
+func (c *Client) ResumeFile(ctx context.Context, sessionID, path string, opts UploadOptions) (*Completed, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return c.ResumeUpload(ctx, sessionID, f, info.Size(), opts)
+}
+
+// ResumeUpload sends the chunks of an existing session the server has not
+// received. Sessions outlive their connection, so this works from a new
+// process as long as the session has not expired on the server.
+func (c *Client) ResumeUpload(ctx context.Context, sessionID string, r io.ReaderAt, size int64, opts UploadOptions) (*Completed, error) {
+	chunkSize, totalChunks, err := chunkLayout(size, opts.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := c.Status(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if status.Total != totalChunks {
+		return nil, fmt.Errorf("session has %d chunks but the file splits into %d; use the original chunk size", status.Total, totalChunks)
+	}
+
+	// Only RESUME reports the missing chunks, and it requires a paused session
+	switch status.State {
+	case "paused":
+	case "initialized", "uploading":
+		if _, err := c.Pause(ctx, sessionID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("session is %s and cannot be resumed", status.State)
+	}
+
+	_, missing, err := c.Resume(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) == 0 {
+		return nil, errors.New("server has every chunk but the session is not complete")
+	}
+	return c.sendChunks(ctx, sessionID, r, size, chunkSize, totalChunks, missing, opts)
+}
+
+func chunkLayout(size int64, chunkSize uint32) (uint32, uint32, error) {
+	if chunkSize == 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	if chunkSize < MIN_SMALL_CHUNK_SIZE || chunkSize > MAX_CHUNK_SIZE {
+		return 0, 0, fmt.Errorf("chunk size %d out of range [%d, %d]", chunkSize, MIN_SMALL_CHUNK_SIZE, MAX_CHUNK_SIZE)
+	}
+	if size <= 0 {
+		return 0, 0, errors.New("cannot upload an empty file")
+	}
+	totalChunks := (size + int64(chunkSize) - 1) / int64(chunkSize)
+	return chunkSize, uint32(totalChunks), nil
+}
@@ -0,0 +1,245 @@
+// bench - Upload throughput, CPU and allocation benchmarks per upload path
+//
+//	go run ./cmd/bench
+//	go run ./cmd/bench -paths binary -chunk-sizes 8MB,32MB -runs 5
+//	go run ./cmd/bench -json > baseline.json
+//	go run ./cmd/bench -baseline baseline.json -tolerance 0.15
+//	go run ./cmd/bench -paths binary,http,presigned -backend s3 -s3-endpoint http://localhost:9000
+//
+// For every combination of upload path and chunk size the harness starts a
+// fresh file server (built from . unless -server is given) on loopback ports
+// with the in-memory storage backend, does a warm-up upload, then times -runs
+// uploads of -size bytes each. Server CPU time and allocations are read from
+// the server's /metrics before and after the timed runs and reported per
+// chunk, so they do not depend on how fast the machine's disk or network is.
+//
+// Paths:
+//
+//	binary     the Go SDK over the gnet binary protocol
+//	http       multipart POSTs to the HTTP chunk API
+//	presigned  parts PUT straight to S3 through presigned URLs, no upload
+//	           server in the path; needs -s3-endpoint (MinIO)
+//	gateway    binary through a gateway (built from ../gateway unless
+//	           -gateway is given) in front of the file server; the CPU and
+//	           allocation columns are the gateway's, so its forwarding cost
+//	           can be compared across changes like the server's
+//
+// -baseline compares the results with an earlier -json report and exits
+// non-zero if throughput dropped or CPU or allocations per chunk grew by more
+// than -tolerance, so it can gate CI.
+//
+// The codec calls made for every frame have benchmarks and allocation
+// ceilings of their own in protocol/codec_test.go, run by go test. Storing
+// one chunk per upload path, without the network, is BenchmarkBinaryChunk
+// and BenchmarkHTTPChunk in the server package.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	PATH_BINARY    = "binary"
+	PATH_HTTP      = "http"
+	PATH_PRESIGNED = "presigned"
+	PATH_GATEWAY   = "gateway"
+)
+
+type config struct {
+	Paths      []string
+	ChunkSizes []int64
+	Size       int64
+	Runs       int
+	Warmup     int
+	Token      string
+	ServerBin  string
+	GatewayBin string
+	Backend    string
+	WorkDir    string
+
+	// Existing server instead of starting one per case
+	Addr       string
+	HTTPURL    string
+	MetricsURL string
+
+	S3Endpoint  string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Bucket    string
+}
+
+func main() {
+	cfg := config{Size: 64 << 20}
+	paths := flag.String("paths", PATH_BINARY+","+PATH_HTTP, "comma-separated upload paths: binary, http, presigned, gateway")
+	chunkSizes := flag.String("chunk-sizes", "5MB,16MB,64MB", "comma-separated chunk sizes")
+	flag.Func("size", "bytes per upload, e.g. 128MB (default 64MB)", sizeFlag(&cfg.Size))
+	flag.IntVar(&cfg.Runs, "runs", 3, "timed uploads per case")
+	flag.IntVar(&cfg.Warmup, "warmup", 1, "untimed uploads per case before the timed ones")
+	flag.StringVar(&cfg.Token, "token", "test_token_user123", "auth token known to the file server")
+	flag.StringVar(&cfg.ServerBin, "server", "", "file server binary (default: build .)")
+	flag.StringVar(&cfg.GatewayBin, "gateway", "", "gateway binary for the gateway path (default: build ../gateway)")
+	flag.StringVar(&cfg.Backend, "backend", "memory", "S3_BACKEND of the started file server: memory or s3")
+	flag.StringVar(&cfg.Addr, "addr", "", "binary address of a running file server (skips starting one)")
+	flag.StringVar(&cfg.HTTPURL, "http", "", "HTTP API base URL of the running file server, with -addr")
+	flag.StringVar(&cfg.MetricsURL, "metrics", "", "metrics URL of the running file server (default: -http + /metrics)")
+	flag.StringVar(&cfg.S3Endpoint, "s3-endpoint", "", "S3 endpoint for the presigned path, e.g. http://localhost:9000")
+	flag.StringVar(&cfg.S3Region, "s3-region", "us-east-1", "S3 region for the presigned path")
+	flag.StringVar(&cfg.S3AccessKey, "s3-access-key", "admin", "S3 access key for the presigned path")
+	flag.StringVar(&cfg.S3SecretKey, "s3-secret-key", "strongpassword", "S3 secret key for the presigned path")
+	flag.StringVar(&cfg.S3Bucket, "s3-bucket", "uploads", "S3 bucket for the presigned path")
+	jsonOut := flag.Bool("json", false, "print the report as JSON")
+	baseline := flag.String("baseline", "", "JSON report to compare against")
+	tolerance := flag.Float64("tolerance", 0.10, "allowed relative regression against -baseline")
+	flag.Parse()
+
+	log.SetFlags(0)
+	var err error
+	if cfg.Paths, err = parsePaths(*paths); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ChunkSizes, err = parseSizes(*chunkSizes); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Runs < 1 || cfg.Warmup < 0 {
+		log.Fatal("-runs must be positive and -warmup not negative")
+	}
+	if cfg.Addr != "" && cfg.HTTPURL == "" {
+		log.Fatal("-addr needs -http")
+	}
+	if cfg.MetricsURL == "" && cfg.HTTPURL != "" {
+		cfg.MetricsURL = strings.TrimSuffix(cfg.HTTPURL, "/") + "/metrics"
+	}
+
+	var base *report
+	if *baseline != "" {
+		if base, err = readReport(*baseline); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dir, err := os.MkdirTemp("", "hpu-bench-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.WorkDir = dir
+
+	if cfg.Addr == "" && cfg.ServerBin == "" {
+		if cfg.ServerBin, err = build(ctx, ".", filepath.Join(dir, "file_server")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.Addr == "" && cfg.GatewayBin == "" && slices.Contains(cfg.Paths, PATH_GATEWAY) {
+		if cfg.GatewayBin, err = build(ctx, "../gateway", filepath.Join(dir, "gateway")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	rep := run(ctx, cfg)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		rep.print(os.Stdout)
+	}
+
+	failed := rep.failures()
+	if len(failed) > 0 {
+		fmt.Fprintln(os.Stderr, "server logs in", dir)
+	} else {
+		os.RemoveAll(dir)
+	}
+	if base != nil {
+		failed = append(failed, rep.compare(base, *tolerance)...)
+	}
+	if len(failed) > 0 {
+		fmt.Fprintln(os.Stderr, "FAIL:")
+		for _, f := range failed {
+			fmt.Fprintln(os.Stderr, "  "+f)
+		}
+		os.Exit(1)
+	}
+}
+
+func parsePaths(s string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		switch p = strings.TrimSpace(p); p {
+		case PATH_BINARY, PATH_HTTP, PATH_PRESIGNED, PATH_GATEWAY:
+			paths = append(paths, p)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown upload path %q", p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no upload paths given")
+	}
+	return paths, nil
+}
+
+func parseSizes(s string) ([]int64, error) {
+	var sizes []int64
+	for _, part := range strings.Split(s, ",") {
+		var n int64
+		if err := sizeFlag(&n)(part); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// sizeFlag parses sizes such as 512KB, 64MB or 1GB (binary units).
+func sizeFlag(dst *int64) func(string) error {
+	return func(s string) error {
+		units := []struct {
+			suffix string
+			mult   int64
+		}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+		s = strings.ToUpper(strings.TrimSpace(s))
+		mult := int64(1)
+		for _, u := range units {
+			if strings.HasSuffix(s, u.suffix) {
+				s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+				break
+			}
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q", s)
+		}
+		*dst = n * mult
+		return nil
+	}
+}
+
+// build compiles the main package in dir to out.
+func build(ctx context.Context, dir, out string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to build %s: %w", dir, err)
+	}
+	return out, nil
+}
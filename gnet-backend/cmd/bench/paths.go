@@ -0,0 +1,255 @@
+// paths.go - One upload over each of the benchmarked paths
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"backend/client"
+)
+
+// target is where one case uploads to.
+type target struct {
+	Addr    string
+	HTTPURL string
+}
+
+// uploadFunc sends data in chunks of chunkSize as one file and calls onChunk
+// with the round trip of every chunk.
+type uploadFunc func(ctx context.Context, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error
+
+func (b *bench) uploader(path string, tgt target) uploadFunc {
+	switch path {
+	case PATH_HTTP:
+		return func(ctx context.Context, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+			return uploadHTTP(ctx, b.http, tgt.HTTPURL, b.cfg.Token, data, chunkSize, name, onChunk)
+		}
+	case PATH_PRESIGNED:
+		return func(ctx context.Context, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+			return uploadPresigned(ctx, b.s3, b.http, b.cfg.S3Bucket, data, chunkSize, name, onChunk)
+		}
+	default:
+		return func(ctx context.Context, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+			return uploadBinary(ctx, tgt.Addr, b.cfg.Token, data, chunkSize, name, onChunk)
+		}
+	}
+}
+
+// ============================================
+// Binary Protocol
+// ============================================
+
+func uploadBinary(ctx context.Context, addr, token string, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+	c := client.New(addr, token, client.WithRetries(0, 0))
+	defer c.Close()
+
+	// Chunks go one after another, so the gap between acks is the round trip
+	var last time.Time
+	_, err := c.Upload(ctx, bytes.NewReader(data), int64(len(data)), client.UploadOptions{
+		ChunkSize: uint32(chunkSize),
+		Name:      name,
+		OnSession: func(*client.Session) { last = time.Now() },
+		OnChunk: func(*client.ChunkResult) {
+			now := time.Now()
+			onChunk(now.Sub(last))
+			last = now
+		},
+	})
+	return err
+}
+
+// ============================================
+// HTTP Chunk API
+// ============================================
+
+type httpStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Message)
+}
+
+func uploadHTTP(ctx context.Context, hc *http.Client, baseURL, token string, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+	totalChunks := int((int64(len(data)) + chunkSize - 1) / chunkSize)
+
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	initBody, _ := json.Marshal(map[string]interface{}{
+		"file_name":    name,
+		"total_chunks": totalChunks,
+		"chunk_size":   chunkSize,
+	})
+	err := doJSON(ctx, hc, baseURL+"/upload/init", token, "application/json", bytes.NewReader(initBody), &session)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	var resp struct {
+		Complete bool   `json:"complete"`
+		State    string `json:"state"`
+	}
+	for index := 0; index < totalChunks; index++ {
+		chunk := data[int64(index)*chunkSize : min(int64(index+1)*chunkSize, int64(len(data)))]
+
+		// Building the form is client work, so it stays out of the round trip
+		body, contentType := chunkForm(session.SessionID, index, chunk)
+		start := time.Now()
+		err := doJSON(ctx, hc, baseURL+"/upload/chunk", token, contentType, bytes.NewReader(body), &resp)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", index, err)
+		}
+		onChunk(time.Since(start))
+	}
+	if !resp.Complete {
+		return fmt.Errorf("last chunk left the session %s", resp.State)
+	}
+	return nil
+}
+
+func chunkForm(sessionID string, index int, chunk []byte) ([]byte, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("session_id", sessionID)
+	w.WriteField("chunk_index", strconv.Itoa(index))
+	w.WriteField("size", strconv.Itoa(len(chunk)))
+	part, _ := w.CreateFormFile("chunk", "chunk")
+	part.Write(chunk)
+	w.Close()
+	return buf.Bytes(), w.FormDataContentType()
+}
+
+func doJSON(ctx context.Context, hc *http.Client, url, token, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &httpStatusError{Code: resp.StatusCode, Message: e.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ============================================
+// Presigned S3
+// ============================================
+
+// newS3Client connects to the S3 endpoint the presigned path uploads to.
+func newS3Client(cfg config) *s3.Client {
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(cfg.S3Endpoint),
+		Region:       cfg.S3Region,
+		Credentials:  credentials.NewStaticCredentialsProvider(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		UsePathStyle: true,
+	})
+}
+
+// uploadPresigned is the baseline without an upload server: a multipart
+// upload whose parts are PUT to presigned URLs, as a browser would. The
+// object is deleted afterwards.
+func uploadPresigned(ctx context.Context, s3c *s3.Client, hc *http.Client, bucket string, data []byte, chunkSize int64, name string, onChunk func(time.Duration)) error {
+	key := "bench/" + name
+	created, err := s3c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	presigner := s3.NewPresignClient(s3c)
+	var parts []types.CompletedPart
+	for offset := int64(0); offset < int64(len(data)); offset += chunkSize {
+		partNumber := int32(offset/chunkSize) + 1
+		chunk := data[offset:min(offset+chunkSize, int64(len(data)))]
+
+		presigned, err := presigner.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(partNumber),
+		})
+		if err != nil {
+			abortPresigned(s3c, bucket, key, uploadID)
+			return fmt.Errorf("presign part %d: %w", partNumber, err)
+		}
+
+		start := time.Now()
+		etag, err := putPart(ctx, hc, presigned.URL, chunk)
+		if err != nil {
+			abortPresigned(s3c, bucket, key, uploadID)
+			return fmt.Errorf("part %d: %w", partNumber, err)
+		}
+		onChunk(time.Since(start))
+		parts = append(parts, types.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int32(partNumber)})
+	}
+
+	_, err = s3c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abortPresigned(s3c, bucket, key, uploadID)
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	s3c.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	return nil
+}
+
+func putPart(ctx context.Context, hc *http.Client, url string, chunk []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(chunk))
+	if err != nil {
+		return "", err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", &httpStatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Header.Get("ETag"), nil
+}
+
+func abortPresigned(s3c *s3.Client, bucket, key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s3c.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+}
@@ -0,0 +1,176 @@
+// report.go - Results table, JSON and the baseline comparison
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+type report struct {
+	Size    int64     `json:"size"`
+	Runs    int       `json:"runs"`
+	Backend string    `json:"backend"`
+	Results []*result `json:"results"`
+}
+
+type result struct {
+	Path           string         `json:"path"`
+	ChunkSize      int64          `json:"chunk_size"`
+	Chunks         int            `json:"chunks"`
+	ThroughputMBps float64        `json:"throughput_mbps"` // Median of the runs
+	BestMBps       float64        `json:"best_mbps"`
+	ChunkLatency   latencySummary `json:"chunk_latency_ms"`
+	Server         *serverCost    `json:"server,omitempty"` // Absent for presigned
+	Skipped        string         `json:"skipped,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// serverCost is the file server's work per chunk during the timed runs, or
+// the gateway's on the gateway path.
+type serverCost struct {
+	CPUMsPerChunk   float64 `json:"cpu_ms_per_chunk"`
+	AllocsPerChunk  float64 `json:"allocs_per_chunk"`
+	AllocKBPerChunk float64 `json:"alloc_kb_per_chunk"`
+}
+
+func (r *result) name() string {
+	return r.Path + "/" + formatSize(r.ChunkSize)
+}
+
+type latencySummary struct {
+	P50 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+func summarize(samples []time.Duration) latencySummary {
+	if len(samples) == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// Nearest-rank percentile
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.999999) - 1
+		return sorted[max(0, min(i, len(sorted)-1))]
+	}
+	return latencySummary{P50: rank(0.50), P99: rank(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// MarshalJSON reports durations in milliseconds.
+func (s latencySummary) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(map[string]float64{"p50": ms(s.P50), "p99": ms(s.P99), "max": ms(s.Max)})
+}
+
+func (s *latencySummary) UnmarshalJSON(b []byte) error {
+	var v map[string]float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	d := func(ms float64) time.Duration { return time.Duration(ms * float64(time.Millisecond)) }
+	s.P50, s.P99, s.Max = d(v["p50"]), d(v["p99"]), d(v["max"])
+	return nil
+}
+
+func readReport(path string) (*report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rep report
+	if err := json.Unmarshal(data, &rep); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &rep, nil
+}
+
+func (rep *report) print(w io.Writer) {
+	fmt.Fprintf(w, "upload size: %s, %d timed run(s) per case, storage: %s\n\n", formatSize(rep.Size), rep.Runs, rep.Backend)
+	fmt.Fprintf(w, "%-10s %6s %10s %10s %10s %10s %12s %12s %12s\n",
+		"path", "chunk", "MB/s", "best MB/s", "chunk p50", "chunk p99", "cpu/chunk", "allocs/chunk", "KB/chunk")
+
+	for _, r := range rep.Results {
+		fmt.Fprintf(w, "%-10s %6s ", r.Path, formatSize(r.ChunkSize))
+		switch {
+		case r.Skipped != "":
+			fmt.Fprintf(w, "skipped: %s\n", r.Skipped)
+			continue
+		case r.Error != "":
+			fmt.Fprintf(w, "FAILED: %s\n", r.Error)
+			continue
+		}
+		round := func(d time.Duration) time.Duration { return d.Round(100 * time.Microsecond) }
+		fmt.Fprintf(w, "%10.1f %10.1f %10s %10s ", r.ThroughputMBps, r.BestMBps,
+			round(r.ChunkLatency.P50), round(r.ChunkLatency.P99))
+		if r.Server != nil {
+			fmt.Fprintf(w, "%10.2fms %12.0f %12.0f\n", r.Server.CPUMsPerChunk, r.Server.AllocsPerChunk, r.Server.AllocKBPerChunk)
+		} else {
+			fmt.Fprintf(w, "%12s %12s %12s\n", "-", "-", "-")
+		}
+	}
+}
+
+// failures lists the cases that did not complete.
+func (rep *report) failures() []string {
+	var failed []string
+	for _, r := range rep.Results {
+		if r.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.name(), r.Error))
+		}
+	}
+	return failed
+}
+
+// compare lists every case that regressed against base by more than
+// tolerance: lower throughput, or more server CPU or allocations per chunk.
+// Cases missing from either report are not compared.
+func (rep *report) compare(base *report, tolerance float64) []string {
+	baseline := map[string]*result{}
+	for _, r := range base.Results {
+		if r.Error == "" && r.Skipped == "" {
+			baseline[r.name()] = r
+		}
+	}
+
+	var regressions []string
+	worse := func(name, what string, got, want float64, higherIsBetter bool) {
+		if want <= 0 {
+			return
+		}
+		change := (got - want) / want
+		if higherIsBetter && change < -tolerance || !higherIsBetter && change > tolerance {
+			regressions = append(regressions, fmt.Sprintf("%s: %s %.2f, baseline %.2f (%+.1f%%)", name, what, got, want, change*100))
+		}
+	}
+	for _, r := range rep.Results {
+		b, ok := baseline[r.name()]
+		if !ok || r.Error != "" || r.Skipped != "" {
+			continue
+		}
+		worse(r.name(), "throughput MB/s", r.ThroughputMBps, b.ThroughputMBps, true)
+		if r.Server != nil && b.Server != nil {
+			worse(r.name(), "server CPU ms/chunk", r.Server.CPUMsPerChunk, b.Server.CPUMsPerChunk, false)
+			worse(r.name(), "server allocs/chunk", r.Server.AllocsPerChunk, b.Server.AllocsPerChunk, false)
+		}
+	}
+	return regressions
+}
+
+// formatSize prints a byte count in the largest binary unit that divides it.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,143 @@
+// runner.go - Runs every path and chunk size combination
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type bench struct {
+	cfg  config
+	data []byte
+	http *http.Client
+	s3   *s3.Client
+}
+
+// run measures every case in order. A failing case is recorded and the rest
+// still run.
+func run(ctx context.Context, cfg config) *report {
+	b := &bench{
+		cfg:  cfg,
+		data: make([]byte, cfg.Size),
+		http: &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 4}},
+	}
+	// Random data, so nothing along the way can compress it
+	rand.Read(b.data)
+	if cfg.S3Endpoint != "" {
+		b.s3 = newS3Client(cfg)
+	}
+
+	rep := &report{Size: cfg.Size, Runs: cfg.Runs, Backend: cfg.Backend}
+	if cfg.Addr != "" {
+		rep.Backend = "external"
+	}
+	for _, path := range cfg.Paths {
+		for _, chunkSize := range cfg.ChunkSizes {
+			if ctx.Err() != nil {
+				return rep
+			}
+			res := b.runCase(ctx, path, chunkSize)
+			rep.Results = append(rep.Results, res)
+		}
+	}
+	return rep
+}
+
+func (b *bench) runCase(ctx context.Context, path string, chunkSize int64) *result {
+	res := &result{Path: path, ChunkSize: chunkSize}
+	name := fmt.Sprintf("%s-%s", path, formatSize(chunkSize))
+
+	var tgt target
+	var metricsURL string
+	switch {
+	case path == PATH_PRESIGNED:
+		if b.s3 == nil {
+			res.Skipped = "needs -s3-endpoint"
+			return res
+		}
+	case path == PATH_GATEWAY && b.cfg.Addr != "":
+		res.Skipped = "needs a started file server, not -addr"
+		return res
+	case b.cfg.Addr != "":
+		tgt = target{Addr: b.cfg.Addr, HTTPURL: b.cfg.HTTPURL}
+		metricsURL = b.cfg.MetricsURL
+	default:
+		// A fresh server per case, so one case's garbage and stored
+		// objects do not weigh on the next
+		srv, err := startServer(ctx, b.cfg, name)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		defer srv.stop()
+		if path == PATH_GATEWAY {
+			if srv, err = startGateway(ctx, b.cfg, name, srv); err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			defer srv.stop()
+		}
+		tgt = target{Addr: srv.Addr, HTTPURL: srv.HTTPURL}
+		metricsURL = srv.MetricsURL
+	}
+	upload := b.uploader(path, tgt)
+	discard := func(time.Duration) {}
+
+	for i := 0; i < b.cfg.Warmup; i++ {
+		if err := upload(ctx, b.data, chunkSize, fmt.Sprintf("bench-%s-warmup-%d.mp4", name, i), discard); err != nil {
+			res.Error = fmt.Sprintf("warm-up: %v", err)
+			return res
+		}
+	}
+
+	var before counters
+	if metricsURL != "" {
+		var err error
+		if before, err = scrapeCounters(ctx, metricsURL); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+
+	var chunks []time.Duration
+	var rates []float64
+	for i := 0; i < b.cfg.Runs; i++ {
+		start := time.Now()
+		err := upload(ctx, b.data, chunkSize, fmt.Sprintf("bench-%s-%d.mp4", name, i), func(d time.Duration) {
+			chunks = append(chunks, d)
+		})
+		if err != nil {
+			res.Error = fmt.Sprintf("run %d: %v", i+1, err)
+			return res
+		}
+		rates = append(rates, float64(len(b.data))/(1<<20)/time.Since(start).Seconds())
+	}
+
+	sort.Float64s(rates)
+	res.Chunks = len(chunks)
+	res.ThroughputMBps = rates[(len(rates)-1)/2]
+	res.BestMBps = rates[len(rates)-1]
+	res.ChunkLatency = summarize(chunks)
+
+	if metricsURL != "" {
+		after, err := scrapeCounters(ctx, metricsURL)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		delta := after.sub(before)
+		n := float64(len(chunks))
+		res.Server = &serverCost{
+			CPUMsPerChunk:   delta.CPUSeconds * 1000 / n,
+			AllocsPerChunk:  delta.Mallocs / n,
+			AllocKBPerChunk: delta.AllocBytes / 1024 / n,
+		}
+	}
+	return res
+}
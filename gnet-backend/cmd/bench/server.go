@@ -0,0 +1,242 @@
+// server.go - File server per case and its /metrics counters
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	READY_TIMEOUT = 30 * time.Second
+	READY_POLL    = 100 * time.Millisecond
+)
+
+// ============================================
+// File Server
+// ============================================
+
+// server is a file server or gateway the harness started, on loopback ports
+// of its own.
+type server struct {
+	Addr       string
+	HTTPURL    string
+	MetricsURL string
+
+	cmd     *exec.Cmd
+	logPath string
+	done    chan struct{}
+}
+
+// startServer runs the file server binary with the in-memory (or -backend)
+// storage and waits until it serves both protocols.
+func startServer(ctx context.Context, cfg config, name string) (*server, error) {
+	s, httpAddr, err := newServer(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.start(ctx, cfg.ServerBin,
+		"GNET_ADDR="+s.Addr,
+		"HTTP_ADDR="+httpAddr,
+		"S3_BACKEND="+cfg.Backend,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// startGateway runs the gateway binary in front of backend. Its metrics are
+// the gateway's own.
+func startGateway(ctx context.Context, cfg config, name string, backend *server) (*server, error) {
+	s, httpAddr, err := newServer(cfg, name+"-gateway")
+	if err != nil {
+		return nil, err
+	}
+	err = s.start(ctx, cfg.GatewayBin,
+		"GATEWAY_BINARY_ADDR="+s.Addr,
+		"GATEWAY_HTTP_ADDR="+httpAddr,
+		"GNET_BINARY_BACKEND="+backend.Addr,
+		"GNET_HTTP_BACKEND="+backend.HTTPURL,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newServer picks the ports of a process to start; the HTTP one is returned
+// bare for its environment.
+func newServer(cfg config, name string) (*server, string, error) {
+	ports, err := freePorts(2)
+	if err != nil {
+		return nil, "", err
+	}
+	return &server{
+		Addr:       ports[0],
+		HTTPURL:    "http://" + ports[1],
+		MetricsURL: "http://" + ports[1] + "/metrics",
+		logPath:    filepath.Join(cfg.WorkDir, name+".log"),
+		done:       make(chan struct{}),
+	}, ports[1], nil
+}
+
+// start runs bin with env added and waits until it serves both protocols.
+func (s *server) start(ctx context.Context, bin string, env ...string) error {
+	log, err := os.Create(s.logPath)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	s.cmd = exec.Command(bin)
+	s.cmd.Env = append(os.Environ(), env...)
+	s.cmd.Stdout = log
+	s.cmd.Stderr = log
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := s.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", filepath.Base(bin), err)
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+
+	if err := s.waitReady(ctx); err != nil {
+		s.stop()
+		return err
+	}
+	return nil
+}
+
+func (s *server) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, READY_TIMEOUT)
+	defer cancel()
+	for {
+		err := s.ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-s.done:
+			return fmt.Errorf("process exited (see %s)", s.logPath)
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %w (see %s)", READY_TIMEOUT, err, s.logPath)
+		case <-time.After(READY_POLL):
+		}
+	}
+}
+
+func (s *server) ready(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.HTTPURL+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/readyz returned %s", resp.Status)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (s *server) stop() {
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	<-s.done
+}
+
+// freePorts reserves n loopback ports. They are released before the server
+// binds them, which is racy in theory but fine on a benchmark machine.
+func freePorts(n int) ([]string, error) {
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs, nil
+}
+
+// ============================================
+// Server Counters
+// ============================================
+
+// counters are the process-wide totals the Prometheus Go and process
+// collectors export; deltas over a run give the server's cost of it.
+type counters struct {
+	CPUSeconds float64 // process_cpu_seconds_total
+	Mallocs    float64 // go_memstats_mallocs_total
+	AllocBytes float64 // go_memstats_alloc_bytes_total
+}
+
+func (c counters) sub(o counters) counters {
+	return counters{
+		CPUSeconds: c.CPUSeconds - o.CPUSeconds,
+		Mallocs:    c.Mallocs - o.Mallocs,
+		AllocBytes: c.AllocBytes - o.AllocBytes,
+	}
+}
+
+// scrapeCounters reads the counters from a Prometheus text endpoint.
+func scrapeCounters(ctx context.Context, url string) (counters, error) {
+	var c counters
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return c, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	targets := map[string]*float64{
+		"process_cpu_seconds_total":     &c.CPUSeconds,
+		"go_memstats_mallocs_total":     &c.Mallocs,
+		"go_memstats_alloc_bytes_total": &c.AllocBytes,
+	}
+	found := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		dst, wanted := targets[name]
+		if !ok || !wanted {
+			continue
+		}
+		if *dst, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+			return c, fmt.Errorf("%s: %w", name, err)
+		}
+		found++
+	}
+	if err := scanner.Err(); err != nil {
+		return c, err
+	}
+	if found != len(targets) {
+		return c, fmt.Errorf("%s is missing the process or Go runtime metrics", url)
+	}
+	return c, nil
+}
@@ -0,0 +1,232 @@
+// dashgen - Generates Grafana dashboards from the metric catalog
+//
+//	go run ./cmd/dashgen -out ../grafana/dashboards
+//
+// One dashboard is written per component. Every catalog entry becomes a panel
+// and entries are grouped into rows by Metric.Group. Counters are plotted as
+// per-second rates, histograms as p50/p95/p99, gauges as-is.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	catalog "backend/metrics"
+)
+
+const (
+	PANEL_WIDTH  = 12 // Two panels per row on Grafana's 24-column grid
+	PANEL_HEIGHT = 8
+)
+
+type dashboardSpec struct {
+	File    string
+	UID     string
+	Title   string
+	Metrics []catalog.Metric
+}
+
+var dashboards = []dashboardSpec{
+	{File: "upload-server.json", UID: "upload-server", Title: "Upload Server", Metrics: catalog.UploadServer},
+	{File: "gateway.json", UID: "upload-gateway", Title: "Upload Gateway", Metrics: catalog.Gateway},
+}
+
+func main() {
+	out := flag.String("out", "grafana/dashboards", "output directory")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("failed to create %s: %v", *out, err)
+	}
+
+	for _, spec := range dashboards {
+		data, err := json.MarshalIndent(buildDashboard(spec), "", "  ")
+		if err != nil {
+			log.Fatalf("failed to encode %s: %v", spec.File, err)
+		}
+		path := filepath.Join(*out, spec.File)
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("failed to write %s: %v", path, err)
+		}
+		fmt.Println("wrote", path)
+	}
+}
+
+func buildDashboard(spec dashboardSpec) map[string]interface{} {
+	panels := make([]map[string]interface{}, 0)
+	id, y := 1, 0
+	group := ""
+	col := 0
+
+	for _, m := range spec.Metrics {
+		if m.Group != group {
+			if col != 0 {
+				y += PANEL_HEIGHT
+				col = 0
+			}
+			group = m.Group
+			panels = append(panels, map[string]interface{}{
+				"id":        id,
+				"type":      "row",
+				"title":     group,
+				"collapsed": false,
+				"gridPos":   gridPos(0, y, 24, 1),
+				"panels":    []interface{}{},
+			})
+			id++
+			y++
+		}
+
+		panels = append(panels, buildPanel(id, m, gridPos(col*PANEL_WIDTH, y, PANEL_WIDTH, PANEL_HEIGHT)))
+		id++
+		col++
+		if col == 24/PANEL_WIDTH {
+			col = 0
+			y += PANEL_HEIGHT
+		}
+	}
+
+	return map[string]interface{}{
+		"uid":           spec.UID,
+		"title":         spec.Title,
+		"tags":          []string{"upload", "generated"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"version":       1,
+		"editable":      true,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				map[string]interface{}{
+					"name":       "instance",
+					"label":      "Instance",
+					"type":       "query",
+					"datasource": datasource(),
+					"query":      fmt.Sprintf("label_values(%s, instance)", spec.Metrics[0].FullName()+seriesSuffix(spec.Metrics[0])),
+					"refresh":    2,
+					"includeAll": true,
+					"multi":      true,
+				},
+			},
+		},
+		"panels": panels,
+	}
+}
+
+func buildPanel(id int, m catalog.Metric, pos map[string]int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          id,
+		"type":        "timeseries",
+		"title":       panelTitle(m),
+		"description": m.Help,
+		"datasource":  datasource(),
+		"gridPos":     pos,
+		"fieldConfig": map[string]interface{}{
+			"defaults":  map[string]interface{}{"unit": m.Unit},
+			"overrides": []interface{}{},
+		},
+		"targets": targets(m),
+	}
+}
+
+// targets builds the PromQL for a metric according to its kind.
+func targets(m catalog.Metric) []map[string]interface{} {
+	selector := `{instance=~"$instance"}`
+	by := strings.Join(m.Labels, ", ")
+
+	switch m.Kind {
+	case catalog.Counter:
+		expr := fmt.Sprintf("sum(rate(%s%s[$__rate_interval]))", m.FullName(), selector)
+		legend := m.Name
+		if by != "" {
+			expr = fmt.Sprintf("sum by (%s) (rate(%s%s[$__rate_interval]))", by, m.FullName(), selector)
+			legend = legendFormat(m.Labels)
+		}
+		return []map[string]interface{}{target("A", expr, legend)}
+
+	case catalog.Histogram:
+		grouping := "le"
+		legendSuffix := ""
+		if by != "" {
+			grouping = by + ", le"
+			legendSuffix = " " + legendFormat(m.Labels)
+		}
+		out := make([]map[string]interface{}, 0, 3)
+		for i, q := range []string{"0.5", "0.95", "0.99"} {
+			expr := fmt.Sprintf("histogram_quantile(%s, sum by (%s) (rate(%s_bucket%s[$__rate_interval])))", q, grouping, m.FullName(), selector)
+			out = append(out, target(string(rune('A'+i)), expr, "p"+strings.TrimPrefix(q, "0.")+legendSuffix))
+		}
+		return out
+
+	default:
+		expr := fmt.Sprintf("sum(%s%s)", m.FullName(), selector)
+		legend := m.Name
+		if by != "" {
+			expr = fmt.Sprintf("sum by (%s) (%s%s)", by, m.FullName(), selector)
+			legend = legendFormat(m.Labels)
+		}
+		if m.Kind == catalog.Gauge && strings.HasSuffix(m.Name, "_timestamp_seconds") {
+			// Timestamps are shown as "x ago", max across instances
+			expr = fmt.Sprintf("max(%s%s) * 1000", m.FullName(), selector)
+		}
+		return []map[string]interface{}{target("A", expr, legend)}
+	}
+}
+
+func target(ref, expr, legend string) map[string]interface{} {
+	return map[string]interface{}{
+		"refId":        ref,
+		"datasource":   datasource(),
+		"expr":         expr,
+		"legendFormat": legend,
+	}
+}
+
+func legendFormat(labels []string) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = "{{" + label + "}}"
+	}
+	return strings.Join(parts, " ")
+}
+
+func panelTitle(m catalog.Metric) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(m.Name, "_total"), "_seconds")
+	title := strings.ReplaceAll(name, "_", " ")
+	title = strings.ToUpper(title[:1]) + title[1:]
+	switch m.Kind {
+	case catalog.Counter:
+		title += " (rate)"
+	case catalog.Histogram:
+		title += " (latency)"
+	}
+	return title
+}
+
+// seriesSuffix is what a histogram's series carry after the metric name.
+func seriesSuffix(m catalog.Metric) string {
+	if m.Kind == catalog.Histogram {
+		return "_count"
+	}
+	return ""
+}
+
+func datasource() map[string]string {
+	return map[string]string{"type": "prometheus", "uid": "${datasource}"}
+}
+
+func gridPos(x, y, w, h int) map[string]int {
+	return map[string]int{"x": x, "y": y, "w": w, "h": h}
+}
@@ -0,0 +1,229 @@
+// demo - The file server with filesystem storage and a browser UI
+//
+//	go run ./cmd/demo
+//	go run ./cmd/demo -addr :9000 -data ~/hpu-demo
+//
+// Runs the file server (built from . unless -server is given) with
+// S3_BACKEND=fs, so no MinIO, Flask or gateway is needed, and serves a
+// single-page UI at -addr to upload files over the HTTP chunk API, follow
+// uploads in progress, and list, play and download stored files. Requests
+// from the UI are forwarded to the file server with the demo user's token.
+// The binary protocol is open on -binary-addr for the SDK and hpu:
+//
+//	hpu config set demo --endpoint localhost:9090 --http-endpoint http://localhost:8080 --token test_token_user123
+//
+// Uploaded files are kept in -data across runs.
+package main
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+const (
+	READY_TIMEOUT = 30 * time.Second
+	READY_POLL    = 100 * time.Millisecond
+)
+
+// Routes of the file server's HTTP API the UI uses
+var apiRoutes = []string{"/upload/", "/files", "/files/", "/stream/", "/health", "/usage"}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address of the web UI")
+	binaryAddr := flag.String("binary-addr", "localhost:9090", "address of the binary upload protocol")
+	dataDir := flag.String("data", "hpu-demo-data", "directory for stored files")
+	serverBin := flag.String("server", "", "file server binary (default: build .)")
+	token := flag.String("token", "test_token_user123", "token the UI uses; must be known to the file server")
+	flag.Parse()
+
+	log.SetFlags(0)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dir, err := os.MkdirTemp("", "hpu-demo-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if *serverBin == "" {
+		log.Println("building the file server...")
+		*serverBin = filepath.Join(dir, "file_server")
+		cmd := exec.CommandContext(ctx, "go", "build", "-o", *serverBin, ".")
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("failed to build the file server (run from the gnet-backend directory or pass -server): %v", err)
+		}
+	}
+
+	data, err := filepath.Abs(*dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpAddr, err := freePort()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logPath := filepath.Join(data, "file_server.log")
+	if err := os.MkdirAll(data, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	server, err := startServer(*serverBin, logPath, []string{
+		"S3_BACKEND=fs",
+		"S3_FS_DIR=" + filepath.Join(data, "storage"),
+		"GNET_ADDR=" + *binaryAddr,
+		"HTTP_ADDR=" + httpAddr,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := waitReady(ctx, server, "http://"+httpAddr+"/readyz"); err != nil {
+		server.stop()
+		log.Fatalf("%v (see %s)", err, logPath)
+	}
+
+	handler, err := newHandler("http://"+httpAddr, *token)
+	if err != nil {
+		server.stop()
+		log.Fatal(err)
+	}
+	srv := &http.Server{Addr: *addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("demo UI:         http://%s", *addr)
+	log.Printf("binary protocol: %s (token %s)", *binaryAddr, *token)
+	log.Printf("files and log:   %s", data)
+	err = srv.ListenAndServe()
+	server.stop()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// newHandler serves the embedded UI and forwards API routes to the file
+// server, adding the demo token to requests that carry none.
+func newHandler(backend, token string) (http.Handler, error) {
+	target, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	// Stream progress and live previews without buffering
+	proxy.FlushInterval = -1
+
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	ui, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServerFS(ui))
+	for _, route := range apiRoutes {
+		mux.Handle(route, api)
+	}
+	return mux, nil
+}
+
+// ============================================
+// File Server Process
+// ============================================
+
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func startServer(bin, logPath string, env []string) (*process, error) {
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Own process group, so it goes down with the demo
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start the file server: %w", err)
+	}
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+func (p *process) stop() {
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+func waitReady(ctx context.Context, p *process, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, READY_TIMEOUT)
+	defer cancel()
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-p.done:
+			return fmt.Errorf("file server exited")
+		case <-ctx.Done():
+			return fmt.Errorf("file server not ready after %s", READY_TIMEOUT)
+		case <-time.After(READY_POLL):
+		}
+	}
+}
+
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
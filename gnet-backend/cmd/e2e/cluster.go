@@ -0,0 +1,206 @@
+// cluster.go - Starting, killing and restarting the servers under test
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ============================================
+// Processes
+// ============================================
+
+const (
+	READY_TIMEOUT = 30 * time.Second
+	READY_POLL    = 100 * time.Millisecond
+)
+
+// process is one server binary run with a fixed environment, so it can be
+// killed and started again on the same ports.
+type process struct {
+	name    string
+	bin     string
+	env     []string
+	logPath string
+	ready   func(ctx context.Context) error
+
+	cmd  *exec.Cmd
+	log  *os.File
+	done chan struct{}
+}
+
+func (p *process) start(ctx context.Context) error {
+	log, err := os.OpenFile(p.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(log, "\n==== %s started at %s ====\n", p.name, time.Now().Format(time.RFC3339Nano))
+
+	cmd := exec.Command(p.bin)
+	cmd.Env = append(os.Environ(), p.env...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// Own process group, so an interrupted harness does not leave it running
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return fmt.Errorf("failed to start %s: %w", p.name, err)
+	}
+
+	p.cmd, p.log, p.done = cmd, log, make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+
+	if err := p.waitReady(ctx); err != nil {
+		p.kill()
+		return err
+	}
+	return nil
+}
+
+// waitReady polls the readiness check until it passes.
+func (p *process) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, READY_TIMEOUT)
+	defer cancel()
+	for {
+		err := p.ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-p.done:
+			return fmt.Errorf("%s exited (see %s)", p.name, p.logPath)
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %s: %w (see %s)", p.name, READY_TIMEOUT, err, p.logPath)
+		case <-time.After(READY_POLL):
+		}
+	}
+}
+
+// kill stops the process with SIGKILL, as a crash would.
+func (p *process) kill() {
+	if p.cmd == nil {
+		return
+	}
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	<-p.done
+	p.log.Close()
+	p.cmd = nil
+}
+
+// ============================================
+// Cluster
+// ============================================
+
+// cluster is a file server (with its HTTP API) behind a gateway, all on
+// loopback ports picked at startup.
+type cluster struct {
+	server  *process
+	gateway *process
+
+	ServerBinary  string // File server's binary port
+	ServerHTTP    string // File server's HTTP API base URL
+	GatewayBinary string
+	GatewayHTTP   string
+}
+
+func startCluster(ctx context.Context, cfg config) (*cluster, error) {
+	ports, err := freePorts(4)
+	if err != nil {
+		return nil, err
+	}
+	c := &cluster{
+		ServerBinary:  ports[0],
+		ServerHTTP:    "http://" + ports[1],
+		GatewayBinary: ports[2],
+		GatewayHTTP:   "http://" + ports[3],
+	}
+
+	c.server = &process{
+		name: "file server",
+		bin:  cfg.ServerBin,
+		env: []string{
+			"GNET_ADDR=" + c.ServerBinary,
+			"HTTP_ADDR=" + ports[1],
+			"S3_BACKEND=" + cfg.Backend,
+		},
+		logPath: filepath.Join(cfg.WorkDir, "file_server.log"),
+		ready:   httpReady(c.ServerHTTP+"/readyz", c.ServerBinary),
+	}
+	c.gateway = &process{
+		name: "gateway",
+		bin:  cfg.GatewayBin,
+		env: []string{
+			"GATEWAY_HTTP_ADDR=" + ports[3],
+			"GATEWAY_BINARY_ADDR=" + c.GatewayBinary,
+			"GNET_HTTP_BACKEND=" + c.ServerHTTP,
+			"GNET_BINARY_BACKEND=" + c.ServerBinary,
+		},
+		logPath: filepath.Join(cfg.WorkDir, "gateway.log"),
+		ready:   httpReady(c.GatewayHTTP+"/readyz", c.GatewayBinary),
+	}
+
+	if err := c.server.start(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.gateway.start(ctx); err != nil {
+		c.server.kill()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *cluster) stop() {
+	c.gateway.kill()
+	c.server.kill()
+}
+
+// httpReady passes once url answers 200 and the binary port accepts
+// connections.
+func httpReady(url, binaryAddr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", binaryAddr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// freePorts reserves n loopback ports. They are released before the servers
+// bind them, which is racy in theory but fine on a test machine.
+func freePorts(n int) ([]string, error) {
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs, nil
+}
@@ -0,0 +1,96 @@
+//go:build e2e
+
+// e2e_test.go - The scenarios as go tests
+//
+//	go test -tags e2e ./cmd/e2e
+//	go test -tags e2e ./cmd/e2e -run Killed -v
+//	go test -tags e2e ./cmd/e2e -backend s3
+//
+// TestMain builds and starts one cluster, as main does, and the tests run
+// the scenarios against it in the order of the scenarios list. The build tag
+// keeps them out of go test ./..., which should not build two binaries and
+// start servers.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testConfig  config
+	testCluster *cluster
+)
+
+func init() {
+	flag.StringVar(&testConfig.ServerBin, "server", "", "file server binary (default: build ../..)")
+	flag.StringVar(&testConfig.GatewayBin, "gateway", "", "gateway binary (default: build ../../../gateway)")
+	flag.StringVar(&testConfig.Backend, "backend", "memory", "file server S3_BACKEND: memory or s3")
+	flag.StringVar(&testConfig.Token, "token", "test_token_user123", "auth token known to the file server")
+	flag.BoolVar(&testConfig.Keep, "keep", false, "keep the work directory (logs, test files) after a pass")
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	log.SetFlags(0)
+	testConfig.Verbose = testing.Verbose()
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "hpu-e2e-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testConfig.WorkDir = dir
+
+	// go test runs in the package directory, two below the server's
+	if testConfig.ServerBin == "" {
+		if testConfig.ServerBin, err = build(ctx, "../..", filepath.Join(dir, "file_server")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if testConfig.GatewayBin == "" {
+		if testConfig.GatewayBin, err = build(ctx, "../../../gateway", filepath.Join(dir, "gateway")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if testCluster, err = startCluster(ctx, testConfig); err != nil {
+		log.Fatalf("%v\nlogs in %s", err, dir)
+	}
+
+	code := m.Run()
+	testCluster.stop()
+	if code != 0 || testConfig.Keep {
+		fmt.Println("logs in", dir)
+	} else {
+		os.RemoveAll(dir)
+	}
+	os.Exit(code)
+}
+
+// runScenario runs fn against the shared cluster, within the test binary's
+// -timeout.
+func runScenario(t *testing.T, fn func(ctx context.Context, t *T) error) {
+	ctx := context.Background()
+	if deadline, ok := t.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-time.Second))
+		defer cancel()
+	}
+	sc := &T{cfg: testConfig, cluster: testCluster, name: t.Name()}
+	if err := sc.run(ctx, fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryUpload(t *testing.T)    { runScenario(t, binaryUpload) }
+func TestHTTPUpload(t *testing.T)      { runScenario(t, httpUpload) }
+func TestHTTPPauseResume(t *testing.T) { runScenario(t, httpPauseResume) }
+func TestBinaryCancel(t *testing.T)    { runScenario(t, binaryCancel) }
+func TestGatewayKilled(t *testing.T)   { runScenario(t, gatewayKilled) }
+func TestServerKilled(t *testing.T)    { runScenario(t, serverKilled) }
@@ -0,0 +1,233 @@
+// helpers.go - Test files, clients and the HTTP chunk API for scenarios
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"backend/client"
+)
+
+// T is the per-scenario context: the cluster, the config and logging.
+type T struct {
+	cfg     config
+	cluster *cluster
+	name    string
+}
+
+func (t *T) run(ctx context.Context, fn func(ctx context.Context, t *T) error) error {
+	return fn(ctx, t)
+}
+
+func (t *T) logf(format string, args ...interface{}) {
+	if t.cfg.Verbose {
+		fmt.Printf("      %s: %s\n", t.name, fmt.Sprintf(format, args...))
+	}
+}
+
+func (t *T) binaryClient(opts ...client.Option) *client.Client {
+	return client.New(t.cluster.GatewayBinary, t.cfg.Token, opts...)
+}
+
+func (t *T) api() *httpAPI {
+	return &httpAPI{base: t.cluster.GatewayHTTP, token: t.cfg.Token}
+}
+
+// ============================================
+// Test Files
+// ============================================
+
+type testFile struct {
+	path string
+	data []byte
+	sum  [sha256.Size]byte
+}
+
+func (t *T) testFile(name string, size int) (*testFile, error) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.cfg.WorkDir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return nil, err
+	}
+	return &testFile{path: path, data: data, sum: sha256.Sum256(data)}, nil
+}
+
+func (f *testFile) chunks() int {
+	return (len(f.data) + CHUNK_SIZE - 1) / CHUNK_SIZE
+}
+
+func (f *testFile) chunk(i int) []byte {
+	return f.data[i*CHUNK_SIZE : min((i+1)*CHUNK_SIZE, len(f.data))]
+}
+
+func (f *testFile) chunkSHA256(i int) string {
+	sum := sha256.Sum256(f.chunk(i))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDownload reads key back through the gateway and compares it with f.
+func (t *T) verifyDownload(ctx context.Context, key string, f *testFile) error {
+	resp, err := t.api().do(ctx, http.MethodGet, "/files/"+escapeKey(key), "", nil)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", key, err)
+	}
+	if n != int64(len(f.data)) {
+		return fmt.Errorf("downloaded %d bytes of %s, uploaded %d", n, key, len(f.data))
+	}
+	if !bytes.Equal(h.Sum(nil), f.sum[:]) {
+		return fmt.Errorf("downloaded %s does not match the uploaded file", key)
+	}
+	t.logf("downloaded %s intact (%d bytes)", key, n)
+	return nil
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// ============================================
+// HTTP Chunk API
+// ============================================
+
+type httpStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Code, e.Message)
+}
+
+type chunkResponse struct {
+	Duplicate bool   `json:"duplicate"`
+	State     string `json:"state"`
+	Complete  bool   `json:"complete"`
+	S3Key     string `json:"s3_key"`
+}
+
+type statusResponse struct {
+	State    string   `json:"state"`
+	Received uint32   `json:"received"`
+	Total    uint32   `json:"total"`
+	Missing  []uint32 `json:"missing"`
+}
+
+type httpAPI struct {
+	base  string
+	token string
+}
+
+func (a *httpAPI) do(ctx context.Context, method, route, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.base+route, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, &httpStatusError{Code: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+func (a *httpAPI) json(ctx context.Context, method, route, contentType string, body io.Reader, out interface{}) error {
+	resp, err := a.do(ctx, method, route, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (a *httpAPI) init(ctx context.Context, fileName string, totalChunks, chunkSize int) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"file_name":    fileName,
+		"total_chunks": totalChunks,
+		"chunk_size":   chunkSize,
+	})
+	var resp struct {
+		SessionID string `json:"session_id"`
+	}
+	err := a.json(ctx, http.MethodPost, "/upload/init", "application/json", bytes.NewReader(body), &resp)
+	return resp.SessionID, err
+}
+
+func (a *httpAPI) chunk(ctx context.Context, sessionID string, index int, data []byte, sha string) (*chunkResponse, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("session_id", sessionID)
+	w.WriteField("chunk_index", strconv.Itoa(index))
+	w.WriteField("sha256", sha)
+	part, _ := w.CreateFormFile("chunk", "chunk")
+	part.Write(data)
+	w.Close()
+
+	var resp chunkResponse
+	if err := a.json(ctx, http.MethodPost, "/upload/chunk", w.FormDataContentType(), &buf, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// control sends pause or resume.
+func (a *httpAPI) control(ctx context.Context, action, sessionID string) (*statusResponse, error) {
+	var resp statusResponse
+	if err := a.json(ctx, http.MethodPost, "/upload/"+action+"/"+url.PathEscape(sessionID), "", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// files lists the keys of the user's stored files.
+func (a *httpAPI) files(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Files []struct {
+			Key string `json:"key"`
+		} `json:"files"`
+	}
+	if err := a.json(ctx, http.MethodGet, "/files", "", nil, &resp); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(resp.Files))
+	for i, f := range resp.Files {
+		keys[i] = f.Key
+	}
+	return keys, nil
+}
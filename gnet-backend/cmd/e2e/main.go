@@ -0,0 +1,135 @@
+// e2e - End-to-end checks against a locally started file server and gateway
+//
+//	go run ./cmd/e2e
+//	go run ./cmd/e2e -run 'restart' -v
+//	go run ./cmd/e2e -backend s3    # MinIO at S3_ENDPOINT instead of memory
+//
+// The harness builds the file server and the gateway (or uses -server and
+// -gateway binaries), starts them on free loopback ports with the in-memory
+// storage backend, and runs each scenario against them: uploads over the
+// binary protocol and the HTTP chunk API, pause/resume, cancel, and
+// components killed with SIGKILL mid-upload. Logs of both processes are kept
+// in the work directory. The exit status is non-zero if any scenario fails,
+// so it can gate CI.
+//
+// The same scenarios run as go tests behind the e2e build tag, one TestXxx
+// each (e2e_test.go):
+//
+//	go test -tags e2e ./cmd/e2e
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	ServerBin  string
+	GatewayBin string
+	Backend    string
+	WorkDir    string
+	Run        string
+	Token      string
+	Verbose    bool
+	Keep       bool
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.ServerBin, "server", "", "file server binary (default: build .)")
+	flag.StringVar(&cfg.GatewayBin, "gateway", "", "gateway binary (default: build ../gateway)")
+	flag.StringVar(&cfg.Backend, "backend", "memory", "file server S3_BACKEND: memory or s3")
+	flag.StringVar(&cfg.Run, "run", "", "only run scenarios matching this regexp")
+	flag.StringVar(&cfg.Token, "token", "test_token_user123", "auth token known to the file server")
+	flag.BoolVar(&cfg.Verbose, "v", false, "log scenario steps")
+	flag.BoolVar(&cfg.Keep, "keep", false, "keep the work directory (logs, test files) after a pass")
+	timeout := flag.Duration("timeout", 10*time.Minute, "overall time limit")
+	flag.Parse()
+
+	log.SetFlags(0)
+	var filter *regexp.Regexp
+	if cfg.Run != "" {
+		var err error
+		if filter, err = regexp.Compile(cfg.Run); err != nil {
+			log.Fatalf("invalid -run: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "hpu-e2e-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.WorkDir = dir
+
+	if cfg.ServerBin == "" {
+		if cfg.ServerBin, err = build(ctx, ".", filepath.Join(dir, "file_server")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.GatewayBin == "" {
+		if cfg.GatewayBin, err = build(ctx, "../gateway", filepath.Join(dir, "gateway")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	c, err := startCluster(ctx, cfg)
+	if err != nil {
+		log.Fatalf("%v\nlogs in %s", err, dir)
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if filter != nil && !filter.MatchString(sc.name) {
+			continue
+		}
+		start := time.Now()
+		t := &T{cfg: cfg, cluster: c, name: sc.name}
+		err := t.run(ctx, sc.fn)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %-22s %6.2fs  %v\n", sc.name, time.Since(start).Seconds(), err)
+		} else {
+			fmt.Printf("ok    %-22s %6.2fs\n", sc.name, time.Since(start).Seconds())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	c.stop()
+
+	if failed > 0 || ctx.Err() != nil {
+		fmt.Printf("%d scenario(s) failed; logs in %s\n", failed, dir)
+		os.Exit(1)
+	}
+	if cfg.Keep {
+		fmt.Println("logs in", dir)
+	} else {
+		os.RemoveAll(dir)
+	}
+}
+
+// build compiles the main package in dir to out.
+func build(ctx context.Context, dir, out string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to build %s: %w", dir, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,281 @@
+// scenarios.go - Upload, resume and failure scenarios
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"backend/client"
+)
+
+const (
+	CHUNK_SIZE = client.MIN_CHUNK_SIZE
+	FILE_SIZE  = 3*CHUNK_SIZE + CHUNK_SIZE/2 // Four chunks, the last one short
+)
+
+type scenario struct {
+	name string
+	fn   func(ctx context.Context, t *T) error
+}
+
+var scenarios = []scenario{
+	{"binary-upload", binaryUpload},
+	{"http-upload", httpUpload},
+	{"http-pause-resume", httpPauseResume},
+	{"binary-cancel", binaryCancel},
+	{"gateway-killed", gatewayKilled},
+	{"server-killed", serverKilled},
+}
+
+// Parallel chunks over the gateway's binary port, then the file is read back
+// through the gateway's HTTP side.
+func binaryUpload(ctx context.Context, t *T) error {
+	f, err := t.testFile("binary.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	c := t.binaryClient()
+	defer c.Close()
+	done, err := c.UploadFile(ctx, f.path, client.UploadOptions{ChunkSize: CHUNK_SIZE, Parallelism: 3})
+	if err != nil {
+		return err
+	}
+	t.logf("uploaded %s", done.S3Key)
+	return t.verifyDownload(ctx, done.S3Key, f)
+}
+
+// The HTTP chunk API, including a duplicate chunk and a corrupted one.
+func httpUpload(ctx context.Context, t *T) error {
+	f, err := t.testFile("http.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	api := t.api()
+	sessionID, err := api.init(ctx, "http.mp4", f.chunks(), CHUNK_SIZE)
+	if err != nil {
+		return err
+	}
+
+	if _, err := api.chunk(ctx, sessionID, 0, f.chunk(0), "0000"); !isStatus(err, http.StatusUnprocessableEntity) {
+		return fmt.Errorf("chunk with a wrong sha256: want 422, got %v", err)
+	}
+
+	var last *chunkResponse
+	for i := 0; i < f.chunks(); i++ {
+		if last, err = api.chunk(ctx, sessionID, i, f.chunk(i), f.chunkSHA256(i)); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+		if i == 0 {
+			dup, err := api.chunk(ctx, sessionID, 0, f.chunk(0), f.chunkSHA256(0))
+			if err != nil {
+				return fmt.Errorf("duplicate chunk: %w", err)
+			}
+			if !dup.Duplicate {
+				return errors.New("resent chunk 0 was not reported as a duplicate")
+			}
+		}
+	}
+	if !last.Complete {
+		return fmt.Errorf("last chunk answered state %q, want a completed upload", last.State)
+	}
+	return t.verifyDownload(ctx, last.S3Key, f)
+}
+
+// A paused session rejects chunks and reports what is missing; after resume
+// the remaining chunks complete it.
+func httpPauseResume(ctx context.Context, t *T) error {
+	f, err := t.testFile("paused.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	api := t.api()
+	sessionID, err := api.init(ctx, "paused.mp4", f.chunks(), CHUNK_SIZE)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := api.chunk(ctx, sessionID, i, f.chunk(i), f.chunkSHA256(i)); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+
+	status, err := api.control(ctx, "pause", sessionID)
+	if err != nil {
+		return fmt.Errorf("pause: %w", err)
+	}
+	if status.State != "paused" {
+		return fmt.Errorf("after pause: state %q", status.State)
+	}
+	if _, err := api.chunk(ctx, sessionID, 2, f.chunk(2), f.chunkSHA256(2)); !isStatus(err, http.StatusConflict) {
+		return fmt.Errorf("chunk while paused: want 409, got %v", err)
+	}
+
+	status, err = api.control(ctx, "resume", sessionID)
+	if err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	if want := []uint32{2, 3}; !slices.Equal(status.Missing, want) {
+		return fmt.Errorf("missing after resume: got %v, want %v", status.Missing, want)
+	}
+	t.logf("resumed with %d/%d chunks", status.Received, status.Total)
+
+	var last *chunkResponse
+	for _, i := range status.Missing {
+		if last, err = api.chunk(ctx, sessionID, int(i), f.chunk(int(i)), f.chunkSHA256(int(i))); err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+	if !last.Complete {
+		return fmt.Errorf("last chunk answered state %q, want a completed upload", last.State)
+	}
+	return t.verifyDownload(ctx, last.S3Key, f)
+}
+
+// A cancelled session is gone: no status, no more chunks, no file.
+func binaryCancel(ctx context.Context, t *T) error {
+	f, err := t.testFile("cancel.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	c := t.binaryClient()
+	defer c.Close()
+	session, err := c.InitUpload(ctx, "cancel.mp4", uint32(f.chunks()), CHUNK_SIZE)
+	if err != nil {
+		return err
+	}
+	if _, err := c.UploadChunk(ctx, session.ID, 0, f.chunk(0)); err != nil {
+		return err
+	}
+	if err := c.Cancel(ctx, session.ID); err != nil {
+		return err
+	}
+
+	if _, err := c.Status(ctx, session.ID); !isServerError(err) {
+		return fmt.Errorf("status of a cancelled session: want a server error, got %v", err)
+	}
+	if _, err := c.UploadChunk(ctx, session.ID, 1, f.chunk(1)); !isServerError(err) {
+		return fmt.Errorf("chunk for a cancelled session: want a server error, got %v", err)
+	}
+	keys, err := t.api().files(ctx)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(keys, session.S3Key) {
+		return fmt.Errorf("cancelled upload %s was stored", session.S3Key)
+	}
+	return nil
+}
+
+// The gateway dies mid-upload. The session lives on the file server, so it
+// resumes through the restarted gateway with only the missing chunks.
+func gatewayKilled(ctx context.Context, t *T) error {
+	f, err := t.testFile("gateway.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	var sessionID string
+	c := t.binaryClient(client.WithRetries(0, 0))
+	_, err = c.UploadFile(ctx, f.path, client.UploadOptions{
+		ChunkSize: CHUNK_SIZE,
+		OnSession: func(s *client.Session) { sessionID = s.ID },
+		OnChunk: func(r *client.ChunkResult) {
+			if r.Index == 1 {
+				t.logf("killing the gateway after chunk %d", r.Index)
+				t.cluster.gateway.kill()
+			}
+		},
+	})
+	c.Close()
+	if err == nil {
+		return errors.New("upload succeeded although the gateway was killed")
+	}
+	t.logf("upload failed as expected: %v", err)
+
+	if err := t.cluster.gateway.start(ctx); err != nil {
+		return err
+	}
+
+	c = t.binaryClient()
+	defer c.Close()
+	status, err := c.Status(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("status after the gateway restart: %w", err)
+	}
+	if status.Received != 2 {
+		return fmt.Errorf("server has %d chunks, want 2", status.Received)
+	}
+
+	done, err := c.ResumeFile(ctx, sessionID, f.path, client.UploadOptions{ChunkSize: CHUNK_SIZE})
+	if err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	return t.verifyDownload(ctx, done.S3Key, f)
+}
+
+// The file server dies mid-upload. Sessions are held in memory, so the
+// session is gone after the restart: resuming must fail cleanly and a new
+// upload of the same file must succeed.
+func serverKilled(ctx context.Context, t *T) error {
+	f, err := t.testFile("server.mp4", FILE_SIZE)
+	if err != nil {
+		return err
+	}
+
+	var sessionID string
+	c := t.binaryClient(client.WithRetries(0, 0))
+	_, err = c.UploadFile(ctx, f.path, client.UploadOptions{
+		ChunkSize: CHUNK_SIZE,
+		OnSession: func(s *client.Session) { sessionID = s.ID },
+		OnChunk: func(r *client.ChunkResult) {
+			if r.Index == 1 {
+				t.logf("killing the file server after chunk %d", r.Index)
+				t.cluster.server.kill()
+			}
+		},
+	})
+	c.Close()
+	if err == nil {
+		return errors.New("upload succeeded although the file server was killed")
+	}
+	t.logf("upload failed as expected: %v", err)
+
+	if err := t.cluster.server.start(ctx); err != nil {
+		return err
+	}
+	// The gateway reports ready again once it reaches the new process
+	if err := t.cluster.gateway.waitReady(ctx); err != nil {
+		return err
+	}
+
+	c = t.binaryClient()
+	defer c.Close()
+	_, err = c.ResumeFile(ctx, sessionID, f.path, client.UploadOptions{ChunkSize: CHUNK_SIZE})
+	if !isServerError(err) || !strings.Contains(err.Error(), "Invalid session ID") {
+		return fmt.Errorf("resume after the restart: want an invalid session error, got %v", err)
+	}
+
+	done, err := c.UploadFile(ctx, f.path, client.UploadOptions{ChunkSize: CHUNK_SIZE, Parallelism: 2})
+	if err != nil {
+		return fmt.Errorf("upload after the restart: %w", err)
+	}
+	return t.verifyDownload(ctx, done.S3Key, f)
+}
+
+func isServerError(err error) bool {
+	var serverErr *client.ServerError
+	return errors.As(err, &serverErr)
+}
+
+func isStatus(err error, code int) bool {
+	var status *httpStatusError
+	return errors.As(err, &status) && status.Code == code
+}
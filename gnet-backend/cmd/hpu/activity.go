@@ -0,0 +1,88 @@
+// activity.go - activity command (HTTP API)
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type activityEntry struct {
+	ID        int64     `json:"id"`
+	Event     string    `json:"event"`
+	Key       string    `json:"key"`
+	Actor     string    `json:"actor"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newActivityCmd() *cobra.Command {
+	var (
+		event  string
+		limit  int
+		before int64
+	)
+
+	cmd := &cobra.Command{
+		Use:   "activity",
+		Short: "Show what happened to your files",
+		Long: "List uploads, downloads, streams, shares and deletions of your files,\n" +
+			"newest first. The actor is who did it; an empty one is someone with a\n" +
+			"share link. Page back with --before.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			query := url.Values{}
+			if event != "" {
+				query.Set("event", event)
+			}
+			if limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			if before > 0 {
+				query.Set("before", strconv.FormatInt(before, 10))
+			}
+			resp, err := apiGet(cmd.Context(), p, "/activity?"+query.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var page struct {
+				Activity   []activityEntry `json:"activity"`
+				NextBefore int64           `json:"next_before"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tTIME\tEVENT\tKEY\tACTOR\tDETAIL")
+			for _, e := range page.Activity {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.CreatedAt.Local().Format(time.DateTime),
+					e.Event, e.Key, e.Actor, e.Detail)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if page.NextBefore > 0 {
+				fmt.Fprintf(os.Stderr, "(more: hpu activity --before %d)\n", page.NextBefore)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&event, "event", "", "only this event, e.g. file.downloaded")
+	cmd.Flags().IntVar(&limit, "limit", 0, "at most this many entries (default: the server's)")
+	cmd.Flags().Int64Var(&before, "before", 0, "entries before this ID, for the next page")
+	return cmd
+}
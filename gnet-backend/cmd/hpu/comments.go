@@ -0,0 +1,147 @@
+// comments.go - comment and comments commands (HTTP API)
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type comment struct {
+	ID          int64      `json:"id"`
+	Author      string     `json:"author"`
+	Body        string     `json:"body"`
+	TimestampMS *int64     `json:"timestamp_ms"`
+	Page        *int       `json:"page"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at"`
+	Replies     []*comment `json:"replies"`
+}
+
+func newCommentCmd() *cobra.Command {
+	var (
+		replyTo int64
+		at      time.Duration
+		page    int
+		remove  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "comment <key> <text>",
+		Short: "Comment on a file",
+		Long: "Add a comment to a file you can read, or with --reply-to answer one.\n" +
+			"Pin it to a point in a video or audio file with --at (e.g. 1m30s), or\n" +
+			"to a page of a PDF with --page. --delete <id> removes a comment.",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if remove {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			if remove {
+				resp, err := apiDo(cmd.Context(), p, http.MethodDelete, "/files/comments/"+url.PathEscape(args[0]), nil, nil)
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				fmt.Fprintf(cmd.OutOrStdout(), "deleted comment %s\n", args[0])
+				return nil
+			}
+
+			req := map[string]interface{}{"key": args[0], "body": args[1]}
+			if replyTo > 0 {
+				req["parent_id"] = replyTo
+			}
+			if cmd.Flags().Changed("at") {
+				req["timestamp_ms"] = at.Milliseconds()
+			}
+			if page > 0 {
+				req["page"] = page
+			}
+			body, err := json.Marshal(req)
+			if err != nil {
+				return err
+			}
+			resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/files/comments", nil, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var c comment
+			if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "added comment %d to %s\n", c.ID, args[0])
+			return nil
+		},
+	}
+	cmd.Flags().Int64Var(&replyTo, "reply-to", 0, "reply to the comment with this ID")
+	cmd.Flags().DurationVar(&at, "at", 0, "position in a video or audio file")
+	cmd.Flags().IntVar(&page, "page", 0, "page of a PDF")
+	cmd.Flags().BoolVar(&remove, "delete", false, "delete the comment with the given ID instead")
+	return cmd
+}
+
+func newCommentsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "comments <key>",
+		Short: "Show the comments on a file, as threads",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiGet(cmd.Context(), p, "/files/comments?"+url.Values{"key": {args[0]}}.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var thread struct {
+				Comments []*comment `json:"comments"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&thread); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			for _, c := range thread.Comments {
+				printComment(cmd.OutOrStdout(), c, 0)
+			}
+			return nil
+		},
+	}
+}
+
+func printComment(w io.Writer, c *comment, depth int) {
+	indent := strings.Repeat("  ", depth)
+	anchor := ""
+	switch {
+	case c.TimestampMS != nil:
+		anchor = " @" + (time.Duration(*c.TimestampMS) * time.Millisecond).String()
+	case c.Page != nil:
+		anchor = fmt.Sprintf(" p.%d", *c.Page)
+	}
+	body := c.Body
+	if c.DeletedAt != nil {
+		body = "(deleted)"
+	}
+	fmt.Fprintf(w, "%s#%d %s %s%s: %s\n", indent, c.ID, c.CreatedAt.Local().Format(time.DateTime), c.Author, anchor, body)
+	for _, reply := range c.Replies {
+		printComment(w, reply, depth+1)
+	}
+}
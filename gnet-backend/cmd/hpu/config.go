@@ -0,0 +1,393 @@
+// config.go - Profiles and locally remembered upload sessions
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"backend/client"
+)
+
+// ============================================
+// Configuration
+// ============================================
+
+// Profiles live in $HPU_CONFIG, or hpu/config.json under the user config
+// directory. Flags and the HPU_ENDPOINT / HPU_HTTP_ENDPOINT / HPU_PROTOCOL /
+// HPU_TOKEN / HPU_SCHEDULE / HPU_TLS environment variables override the
+// selected profile.
+//
+// The protocol picks how uploads and their session commands (upload, resume,
+// pause, cancel, status, sync) reach the server: the binary port at the
+// endpoint, or the HTTP chunk API at the HTTP endpoint, for networks that only
+// let HTTP through. Everything else always uses the HTTP endpoint.
+//
+// Sessions started by this CLI are remembered in sessions.json next to the
+// config so `hpu resume <session-id>` can find the file and chunk size again.
+
+const (
+	DEFAULT_PROFILE       = "default"
+	DEFAULT_ENDPOINT      = "localhost:9090"
+	DEFAULT_HTTP_ENDPOINT = "http://localhost:5000"
+
+	PROTOCOL_BINARY = "binary"
+	PROTOCOL_HTTP   = "http"
+)
+
+type Profile struct {
+	Endpoint     string  `json:"endpoint"`           // Binary protocol host:port
+	HTTPEndpoint string  `json:"http_endpoint"`      // Gateway base URL for list/download, and uploads over http
+	Protocol     string  `json:"protocol,omitempty"` // Uploads over PROTOCOL_BINARY (default) or PROTOCOL_HTTP
+	Token        string  `json:"token"`
+	LimitMbps    float64 `json:"limit_mbps,omitempty"` // Upload bandwidth cap, 0 for none
+	Schedule     string  `json:"schedule,omitempty"`   // Off-peak window, e.g. 22:00-06:00
+	TLS          bool    `json:"tls,omitempty"`        // Endpoint is the server's TLS port
+}
+
+type Config struct {
+	Current  string             `json:"current"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+type SessionRecord struct {
+	SessionID string `json:"session_id"`
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	ChunkSize uint32 `json:"chunk_size"`
+	Profile   string `json:"profile"`
+}
+
+func configDir() (string, error) {
+	if path := os.Getenv("HPU_CONFIG"); path != "" {
+		return filepath.Dir(path), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hpu"), nil
+}
+
+func configPath() (string, error) {
+	if path := os.Getenv("HPU_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+func loadConfig() (*Config, error) {
+	cfg := &Config{Current: DEFAULT_PROFILE, Profiles: map[string]Profile{}}
+
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := readJSON(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	// The file holds tokens
+	return writeJSON(path, cfg, 0o600)
+}
+
+// resolveProfile merges the selected profile with environment and flags.
+func resolveProfile() (string, Profile, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return "", Profile{}, err
+	}
+
+	name := flagProfile
+	if name == "" {
+		name = cfg.Current
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok && flagProfile != "" {
+		return "", Profile{}, fmt.Errorf("unknown profile %q", name)
+	}
+
+	override := func(field *string, env, flag, fallback string) {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+		if flag != "" {
+			*field = flag
+		}
+		if *field == "" {
+			*field = fallback
+		}
+	}
+	override(&p.Endpoint, "HPU_ENDPOINT", flagEndpoint, DEFAULT_ENDPOINT)
+	override(&p.HTTPEndpoint, "HPU_HTTP_ENDPOINT", flagHTTPEndpoint, DEFAULT_HTTP_ENDPOINT)
+	override(&p.Protocol, "HPU_PROTOCOL", flagProtocol, PROTOCOL_BINARY)
+	override(&p.Token, "HPU_TOKEN", flagToken, "")
+	override(&p.Schedule, "HPU_SCHEDULE", flagSchedule, "")
+	if flagLimitMbps >= 0 {
+		p.LimitMbps = flagLimitMbps
+	}
+	if v, err := strconv.ParseBool(os.Getenv("HPU_TLS")); err == nil {
+		p.TLS = v
+	}
+	if flagTLS {
+		p.TLS = true
+	}
+
+	if err := checkProtocol(p.Protocol); err != nil {
+		return "", Profile{}, err
+	}
+	if p.Token == "" {
+		return "", Profile{}, errors.New("no auth token: set one with `hpu config set --token`, HPU_TOKEN or --token")
+	}
+	return name, p, nil
+}
+
+func checkProtocol(protocol string) error {
+	if protocol != PROTOCOL_BINARY && protocol != PROTOCOL_HTTP {
+		return fmt.Errorf("unknown protocol %q: use %s or %s", protocol, PROTOCOL_BINARY, PROTOCOL_HTTP)
+	}
+	return nil
+}
+
+// ============================================
+// Session Records
+// ============================================
+
+func sessionsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sessions.json"), nil
+}
+
+func loadSessions() (map[string]SessionRecord, error) {
+	records := map[string]SessionRecord{}
+	path, err := sessionsPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := readJSON(path, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func rememberSession(record SessionRecord) error {
+	records, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	records[record.SessionID] = record
+	return saveSessions(records)
+}
+
+func forgetSession(sessionID string) error {
+	records, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	if _, ok := records[sessionID]; !ok {
+		return nil
+	}
+	delete(records, sessionID)
+	return saveSessions(records)
+}
+
+func saveSessions(records map[string]SessionRecord) error {
+	path, err := sessionsPath()
+	if err != nil {
+		return err
+	}
+	return writeJSON(path, records, 0o600)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ============================================
+// Commands
+// ============================================
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage connection profiles",
+	}
+
+	var set Profile
+	setCmd := &cobra.Command{
+		Use:   "set [profile]",
+		Short: "Create or update a profile",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			name := cfg.Current
+			if len(args) == 1 {
+				name = args[0]
+			}
+
+			p := cfg.Profiles[name]
+			if cmd.Flags().Changed("endpoint") {
+				p.Endpoint = set.Endpoint
+			}
+			if cmd.Flags().Changed("http-endpoint") {
+				p.HTTPEndpoint = set.HTTPEndpoint
+			}
+			if cmd.Flags().Changed("protocol") {
+				if set.Protocol != "" {
+					if err := checkProtocol(set.Protocol); err != nil {
+						return err
+					}
+				}
+				p.Protocol = set.Protocol
+			}
+			if cmd.Flags().Changed("token") {
+				p.Token = set.Token
+			}
+			if cmd.Flags().Changed("limit-mbps") {
+				p.LimitMbps = set.LimitMbps
+			}
+			if cmd.Flags().Changed("schedule") {
+				if set.Schedule != "" {
+					if _, err := client.ParseDailyWindow(set.Schedule); err != nil {
+						return err
+					}
+				}
+				p.Schedule = set.Schedule
+			}
+			if cmd.Flags().Changed("tls") {
+				p.TLS = set.TLS
+			}
+			cfg.Profiles[name] = p
+			if len(cfg.Profiles) == 1 {
+				cfg.Current = name
+			}
+			return cfg.save()
+		},
+	}
+	// Local flags shadow the root's persistent ones inside `config set`
+	setCmd.Flags().StringVar(&set.Endpoint, "endpoint", "", "binary protocol address (host:port)")
+	setCmd.Flags().StringVar(&set.HTTPEndpoint, "http-endpoint", "", "HTTP gateway URL")
+	setCmd.Flags().StringVar(&set.Protocol, "protocol", "", "upload over binary or http (empty for binary)")
+	setCmd.Flags().StringVar(&set.Token, "token", "", "auth token")
+	setCmd.Flags().Float64Var(&set.LimitMbps, "limit-mbps", 0, "upload bandwidth cap in Mbit/s (0 for none)")
+	setCmd.Flags().StringVar(&set.Schedule, "schedule", "", "only upload between these local times, e.g. 22:00-06:00 (empty for any time)")
+	setCmd.Flags().BoolVar(&set.TLS, "tls", false, "connect to the binary endpoint over TLS")
+
+	useCmd := &cobra.Command{
+		Use:   "use <profile>",
+		Short: "Select the default profile",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if _, ok := cfg.Profiles[args[0]]; !ok {
+				return fmt.Errorf("unknown profile %q", args[0])
+			}
+			cfg.Current = args[0]
+			return cfg.save()
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show",
+		Short: "List profiles",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(cfg.Profiles))
+			for name := range cfg.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "\tPROFILE\tENDPOINT\tHTTP ENDPOINT\tPROTOCOL\tTOKEN\tLIMIT\tSCHEDULE")
+			for _, name := range names {
+				p := cfg.Profiles[name]
+				marker := ""
+				if name == cfg.Current {
+					marker = "*"
+				}
+				limit := "-"
+				if p.LimitMbps > 0 {
+					limit = fmt.Sprintf("%g Mbit/s", p.LimitMbps)
+				}
+				protocol := p.Protocol
+				if protocol == "" {
+					protocol = PROTOCOL_BINARY
+				}
+				schedule := p.Schedule
+				if schedule == "" {
+					schedule = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", marker, name, p.Endpoint, p.HTTPEndpoint, protocol, maskToken(p.Token), limit, schedule)
+			}
+			return tw.Flush()
+		},
+	}
+
+	cmd.AddCommand(setCmd, useCmd, showCmd)
+	return cmd
+}
+
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
@@ -0,0 +1,351 @@
+// download.go - Parallel ranged downloads and checksum verification
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// ============================================
+// Ranged Download
+// ============================================
+
+// A download is split into ranges fetched concurrently with Range GETs and
+// written in place. Finished ranges are recorded in <output>.hpu-download so
+// an interrupted download only fetches what is missing; every request carries
+// If-Match so a file replaced on the server midway is detected rather than
+// stitched together. The result is checked against the S3 ETag, which for a
+// multipart upload is the MD5 of the part MD5s (parts are the upload chunks).
+
+const (
+	DEFAULT_RANGE_SIZE    = 16 * 1024 * 1024
+	RANGE_RETRIES         = 3
+	RANGE_RETRY_BACKOFF   = time.Second
+	DOWNLOAD_STATE_SUFFIX = ".hpu-download"
+)
+
+type remoteFile struct {
+	Size      int64
+	ETag      string
+	ChunkSize int64 // Upload chunk size (S3 part size), 0 if the server did not record it
+}
+
+type downloadState struct {
+	Key       string `json:"key"`
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	RangeSize int64  `json:"range_size"`
+	Done      []bool `json:"done"`
+}
+
+func (s *downloadState) ranges() int {
+	return int((s.Size + s.RangeSize - 1) / s.RangeSize)
+}
+
+func (s *downloadState) bounds(i int) (start, end int64) {
+	start = int64(i) * s.RangeSize
+	return start, min(start+s.RangeSize, s.Size)
+}
+
+func (s *downloadState) doneBytes() int64 {
+	var n int64
+	for i, done := range s.Done {
+		if done {
+			start, end := s.bounds(i)
+			n += end - start
+		}
+	}
+	return n
+}
+
+// statRemote reads the size, ETag and part size of key with a one-byte GET.
+func statRemote(ctx context.Context, p Profile, key string) (remoteFile, error) {
+	resp, err := apiGet(ctx, p, "/files/"+escapeKey(key), http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		var status *httpStatusError
+		if errors.As(err, &status) && status.Code == http.StatusRequestedRangeNotSatisfiable {
+			return remoteFile{}, nil // Empty object
+		}
+		return remoteFile{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return remoteFile{}, errors.New("server does not support ranged downloads")
+	}
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+
+	file := remoteFile{Size: size, ETag: resp.Header.Get("ETag")}
+	if chunkSize := resp.Header.Get("X-Chunk-Size"); chunkSize != "" {
+		file.ChunkSize, _ = strconv.ParseInt(chunkSize, 10, 64)
+	}
+	return file, nil
+}
+
+// prepareDownload opens output and returns the ranges still to fetch. A
+// partial output without a state file (from an older hpu) keeps its complete
+// leading ranges.
+func prepareDownload(output, key string, remote remoteFile, rangeSize int64) (*os.File, *downloadState, error) {
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	saved, err := loadDownloadState(output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring download state:", err)
+	}
+
+	var state *downloadState
+	switch {
+	case saved != nil && saved.Key == key && saved.ETag == remote.ETag && saved.Size == remote.Size && saved.RangeSize > 0:
+		state = saved
+	default:
+		if saved != nil {
+			fmt.Fprintln(os.Stderr, "file changed on the server since the last attempt; starting over")
+		}
+		state = &downloadState{Key: key, ETag: remote.ETag, Size: remote.Size, RangeSize: rangeSize}
+		state.Done = make([]bool, state.ranges())
+		if saved == nil && info.Size() <= remote.Size {
+			for i := range state.Done {
+				if _, end := state.bounds(i); end <= info.Size() {
+					state.Done[i] = true
+				}
+			}
+		}
+	}
+
+	if err := f.Truncate(remote.Size); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, state, nil
+}
+
+// fetchRanges downloads every range not yet done with parallel workers,
+// saving the state after each one.
+func fetchRanges(ctx context.Context, p Profile, output string, f *os.File, state *downloadState, parallel int, bar *progressbar.ProgressBar) error {
+	var pending []int
+	for i, done := range state.Done {
+		if !done {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	queue := make(chan int, len(pending))
+	for _, i := range pending {
+		queue <- i
+	}
+	close(queue)
+
+	var (
+		mu sync.Mutex // Guards state and its file
+		wg sync.WaitGroup
+	)
+	for w := 0; w < max(1, min(parallel, len(pending))); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				start, end := state.bounds(i)
+				if err := fetchRange(ctx, p, state.Key, state.ETag, f, start, end, bar); err != nil {
+					cancel(fmt.Errorf("bytes %d-%d: %w", start, end-1, err))
+					return
+				}
+
+				mu.Lock()
+				state.Done[i] = true
+				err := saveDownloadState(output, state)
+				mu.Unlock()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "warning: failed to save download state:", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// fetchRange writes [start, end) of the file at the same offset of f,
+// retrying network errors. A file replaced on the server fails immediately.
+func fetchRange(ctx context.Context, p Profile, key, etag string, f *os.File, start, end int64, bar *progressbar.ProgressBar) error {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end-1)}}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+
+	backoff := RANGE_RETRY_BACKOFF
+	for attempt := 0; ; attempt++ {
+		n, err := copyRange(ctx, p, key, header, f, start, end, bar)
+		if err == nil {
+			return nil
+		}
+		bar.Add64(-n)
+
+		var status *httpStatusError
+		if errors.As(err, &status) {
+			if status.Code == http.StatusPreconditionFailed {
+				return errors.New("file changed on the server during the download; run again to start over")
+			}
+			if status.Code < 500 {
+				return err
+			}
+		}
+		if ctx.Err() != nil || attempt >= RANGE_RETRIES {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func copyRange(ctx context.Context, p Profile, key string, header http.Header, f *os.File, start, end int64, bar *progressbar.ProgressBar) (int64, error) {
+	resp, err := apiGet(ctx, p, "/files/"+escapeKey(key), header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("expected a partial response, got %s", resp.Status)
+	}
+
+	n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(f, start), bar), io.LimitReader(resp.Body, end-start))
+	if err == nil && n != end-start {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func downloadStatePath(output string) string {
+	return output + DOWNLOAD_STATE_SUFFIX
+}
+
+func loadDownloadState(output string) (*downloadState, error) {
+	data, err := os.ReadFile(downloadStatePath(output))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if len(state.Done) != state.ranges() {
+		return nil, errors.New("range count does not match the file size")
+	}
+	return &state, nil
+}
+
+func saveDownloadState(output string, state *downloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(downloadStatePath(output), data, 0o600)
+}
+
+// ============================================
+// Checksum
+// ============================================
+
+var (
+	errUnverifiable     = errors.New("the server did not record the part size needed to verify this file")
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// verifyETag recomputes the S3 ETag of f: the MD5 of the file for a single
+// PUT, or "md5(part md5s)-N" for a multipart upload.
+func verifyETag(f *os.File, remote remoteFile) error {
+	etag := strings.Trim(remote.ETag, `"`)
+	if etag == "" {
+		return errors.New("the server sent no ETag")
+	}
+
+	want, parts, multipart := strings.Cut(etag, "-")
+	var partSize int64
+	if multipart {
+		count, err := strconv.ParseInt(parts, 10, 64)
+		if err != nil || count <= 0 {
+			return fmt.Errorf("unrecognized ETag %q", remote.ETag)
+		}
+		switch {
+		case remote.ChunkSize > 0:
+			partSize = remote.ChunkSize
+		case count == 1:
+			partSize = remote.Size
+		default:
+			return errUnverifiable
+		}
+		if (remote.Size+partSize-1)/partSize != count {
+			return fmt.Errorf("ETag has %d parts but the file splits into %d", count, (remote.Size+partSize-1)/partSize)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var got string
+	if !multipart {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		got = hex.EncodeToString(h.Sum(nil))
+	} else {
+		sums := md5.New()
+		for offset := int64(0); offset < remote.Size; offset += partSize {
+			part := md5.New()
+			if _, err := io.CopyN(part, f, min(partSize, remote.Size-offset)); err != nil {
+				return err
+			}
+			sums.Write(part.Sum(nil))
+		}
+		got = hex.EncodeToString(sums.Sum(nil))
+	}
+
+	if got != want {
+		return fmt.Errorf("%w: got %s, server has %s", errChecksumMismatch, got, want)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// export.go - export and exports commands (HTTP API)
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// exportPollInterval is how often export --wait checks on the job.
+const exportPollInterval = 2 * time.Second
+
+type exportJob struct {
+	ID          string    `json:"id"`
+	Mode        string    `json:"mode"`
+	Bucket      string    `json:"bucket"`
+	State       string    `json:"state"`
+	TotalFiles  int       `json:"total_files"`
+	Files       int       `json:"files"`
+	Bytes       int64     `json:"bytes"`
+	Error       string    `json:"error"`
+	ManifestURL string    `json:"manifest_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (job *exportJob) done() bool {
+	return job.State == "completed" || job.State == "failed"
+}
+
+func newExportCmd() *cobra.Command {
+	var (
+		bucket, prefix string
+		wait           bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export all of your files",
+		Long: "Start a job that copies every file to --bucket (one the server allows\n" +
+			"exporting to), or without --bucket writes a manifest of download URLs\n" +
+			"that need no token. Follow it with exports <id>, or --wait.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			req := map[string]string{"mode": "manifest"}
+			if bucket != "" {
+				req = map[string]string{"mode": "copy", "bucket": bucket, "prefix": prefix}
+			}
+			body, err := json.Marshal(req)
+			if err != nil {
+				return err
+			}
+			resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/exports", nil, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			job, err := decodeExport(resp)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "started export %s\n", job.ID)
+			if !wait {
+				return nil
+			}
+
+			for !job.done() {
+				select {
+				case <-cmd.Context().Done():
+					return cmd.Context().Err()
+				case <-time.After(exportPollInterval):
+				}
+				if job, err = getExport(cmd.Context(), p, job.ID); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "\r%d/%d files, %s", job.Files, job.TotalFiles, formatBytes(job.Bytes))
+			}
+			fmt.Fprintln(os.Stderr)
+			return printExport(cmd, job)
+		},
+	}
+	cmd.Flags().StringVar(&bucket, "bucket", "", "copy the files to this bucket instead of writing a manifest")
+	cmd.Flags().StringVar(&prefix, "prefix", "", "put the copies under this prefix in --bucket")
+	cmd.Flags().BoolVar(&wait, "wait", false, "wait for the export to finish")
+	return cmd
+}
+
+func newExportsCmd() *cobra.Command {
+	var manifest bool
+
+	cmd := &cobra.Command{
+		Use:   "exports [id]",
+		Short: "List your exports, or show one",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 1 && manifest {
+				resp, err := apiGet(cmd.Context(), p, "/exports/"+args[0]+"/manifest", nil)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				_, err = io.Copy(cmd.OutOrStdout(), resp.Body)
+				return err
+			}
+			if len(args) == 1 {
+				job, err := getExport(cmd.Context(), p, args[0])
+				if err != nil {
+					return err
+				}
+				return printExport(cmd, job)
+			}
+
+			resp, err := apiGet(cmd.Context(), p, "/exports", nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			var result struct {
+				Exports []exportJob `json:"exports"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tMODE\tSTATE\tFILES\tSIZE\tSTARTED")
+			for _, job := range result.Exports {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", job.ID, job.Mode, job.State, job.Files, job.TotalFiles,
+					formatBytes(job.Bytes), job.CreatedAt.Local().Format(time.DateTime))
+			}
+			return tw.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&manifest, "manifest", false, "print the manifest of a finished manifest export")
+	return cmd
+}
+
+func getExport(ctx context.Context, p Profile, id string) (*exportJob, error) {
+	resp, err := apiGet(ctx, p, "/exports/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExport(resp)
+}
+
+func decodeExport(resp *http.Response) (*exportJob, error) {
+	defer resp.Body.Close()
+	var job exportJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &job, nil
+}
+
+func printExport(cmd *cobra.Command, job *exportJob) error {
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "export %s (%s): %s, %d/%d files, %s\n", job.ID, job.Mode, job.State, job.Files, job.TotalFiles, formatBytes(job.Bytes))
+	if job.Error != "" {
+		return fmt.Errorf("export failed: %s", job.Error)
+	}
+	if job.ManifestURL != "" {
+		fmt.Fprintf(out, "manifest: hpu exports %s --manifest\n", job.ID)
+	}
+	return nil
+}
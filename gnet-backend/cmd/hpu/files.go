@@ -0,0 +1,686 @@
+// files.go - list, search, download, tag, trash, version and grant commands (HTTP API)
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type fileSummary struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type sessionSummary struct {
+	SessionID      string    `json:"session_id"`
+	FileName       string    `json:"file_name"`
+	State          string    `json:"state"`
+	ReceivedChunks uint32    `json:"received_chunks"`
+	TotalChunks    uint32    `json:"total_chunks"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type filesResponse struct {
+	Files     []fileSummary    `json:"files"`
+	Truncated bool             `json:"truncated"`
+	Sessions  []sessionSummary `json:"sessions"`
+}
+
+func newListCmd() *cobra.Command {
+	var (
+		asJSON, fresh bool
+		starred       bool
+		tags          []string
+		prefix        string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List uploaded files and open sessions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			query := url.Values{"tag": tags}
+			if fresh {
+				query.Set("fresh", "true")
+			}
+			if prefix != "" {
+				query.Set("prefix", prefix)
+			}
+			if starred {
+				query.Set("starred", "true")
+			}
+			route := "/files"
+			if len(query) > 0 {
+				route += "?" + query.Encode()
+			}
+			resp, err := apiGet(cmd.Context(), p, route, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var files filesResponse
+			if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			out := cmd.OutOrStdout()
+			if asJSON {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(files)
+			}
+
+			tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			if len(files.Sessions) > 0 {
+				fmt.Fprintln(tw, "SESSION\tFILE\tSTATE\tCHUNKS\tUPDATED")
+				for _, s := range files.Sessions {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\n", s.SessionID, s.FileName, s.State,
+						s.ReceivedChunks, s.TotalChunks, s.UpdatedAt.Local().Format(time.DateTime))
+				}
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintln(tw, "KEY\tSIZE\tMODIFIED")
+			for _, f := range files.Files {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Key, formatBytes(f.Size), f.LastModified.Local().Format(time.DateTime))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if files.Truncated {
+				fmt.Fprintln(os.Stderr, "(list truncated)")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the raw JSON response")
+	cmd.Flags().BoolVar(&fresh, "fresh", false, "list from storage instead of the server's listing cache")
+	cmd.Flags().StringArrayVar(&tags, "tag", nil, "only files with this tag (repeatable; files must have all)")
+	cmd.Flags().StringVar(&prefix, "prefix", "", "only keys under this prefix, which may be another user's granted to you")
+	cmd.Flags().BoolVar(&starred, "starred", false, "only files you starred, most recently starred first")
+	return cmd
+}
+
+type searchResult struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	CompletedAt time.Time `json:"completed_at"`
+	Matched     []string  `json:"matched"`
+}
+
+func newSearchCmd() *cobra.Command {
+	var limit int
+
+	cmd := &cobra.Command{
+		Use:   "search <words>...",
+		Short: "Find files by name and by the text inside them",
+		Long: "List files with every word in their name or their text, best matches\n" +
+			"first. Text is indexed from PDFs (and, if the server transcribes\n" +
+			"them, videos) shortly after upload. Search needs a server with a\n" +
+			"metadata database.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			query := url.Values{"q": {strings.Join(args, " ")}}
+			if limit > 0 {
+				query.Set("limit", strconv.Itoa(limit))
+			}
+			resp, err := apiGet(cmd.Context(), p, "/files/search?"+query.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var result struct {
+				Results   []searchResult `json:"results"`
+				Truncated bool           `json:"truncated"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "KEY\tSIZE\tUPLOADED\tMATCHED")
+			for _, r := range result.Results {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Key, formatBytes(r.Size),
+					r.CompletedAt.Local().Format(time.DateTime), strings.Join(r.Matched, ","))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if result.Truncated {
+				fmt.Fprintln(os.Stderr, "(results truncated)")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&limit, "limit", 0, "at most this many results (default: the server's)")
+	return cmd
+}
+
+func newTagCmd() *cobra.Command {
+	var remove []string
+
+	cmd := &cobra.Command{
+		Use:   "tag <key> [tag...]",
+		Short: "Add or remove tags on an uploaded file",
+		Long: "Add the given tags to an uploaded file and remove those given with\n" +
+			"--remove, then print its tags. Without either, just print them. Tagging\n" +
+			"needs a server with a metadata database.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			body, err := json.Marshal(map[string][]string{"add": args[1:], "remove": remove})
+			if err != nil {
+				return err
+			}
+			resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/tags/"+escapeKey(args[0]), nil, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var result struct {
+				Tags []string `json:"tags"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), strings.Join(result.Tags, " "))
+			return nil
+		},
+	}
+	cmd.Flags().StringArrayVar(&remove, "remove", nil, "tag to remove (repeatable)")
+	return cmd
+}
+
+func newStarCmd() *cobra.Command {
+	var remove bool
+
+	cmd := &cobra.Command{
+		Use:   "star <key>...",
+		Short: "Star files, to find them with \"hpu list --starred\"",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			method, verb := http.MethodPut, "starred"
+			if remove {
+				method, verb = http.MethodDelete, "unstarred"
+			}
+			for _, key := range args {
+				resp, err := apiDo(cmd.Context(), p, method, "/files/starred/"+escapeKey(key), nil, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				resp.Body.Close()
+				fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", verb, key)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&remove, "remove", false, "unstar the files instead")
+	return cmd
+}
+
+type trashedFile struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+func newRmCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rm <key>...",
+		Short: "Delete uploaded files",
+		Long: "Delete uploaded files. Unless the server deletes at once, they go to\n" +
+			"the trash, from which \"hpu restore\" brings them back until purged.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			for _, key := range args {
+				resp, err := apiDo(cmd.Context(), p, http.MethodDelete, "/files/"+escapeKey(key), nil, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				var trashed trashedFile
+				if resp.StatusCode == http.StatusOK {
+					json.NewDecoder(resp.Body).Decode(&trashed)
+				}
+				resp.Body.Close()
+
+				if trashed.PurgeAt.IsZero() {
+					fmt.Fprintf(cmd.OutOrStdout(), "deleted %s\n", key)
+				} else {
+					fmt.Fprintf(cmd.OutOrStdout(), "moved %s to the trash until %s\n", key, trashed.PurgeAt.Local().Format(time.DateTime))
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func newTrashCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "trash",
+		Short: "List deleted files that can still be restored",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiGet(cmd.Context(), p, "/files/trash", nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var trash struct {
+				Files []trashedFile `json:"files"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&trash); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "KEY\tSIZE\tDELETED\tPURGED")
+			for _, f := range trash.Files {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Key, formatBytes(f.Size),
+					f.DeletedAt.Local().Format(time.DateTime), f.PurgeAt.Local().Format(time.DateTime))
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newRestoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <key>...",
+		Short: "Restore deleted files from the trash",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			for _, key := range args {
+				body, err := json.Marshal(map[string]string{"key": key})
+				if err != nil {
+					return err
+				}
+				resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/files/restore", nil, bytes.NewReader(body))
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				resp.Body.Close()
+				fmt.Fprintf(cmd.OutOrStdout(), "restored %s\n", key)
+			}
+			return nil
+		},
+	}
+}
+
+type fileVersion struct {
+	Key         string     `json:"key"`
+	Version     int        `json:"version"`
+	Size        int64      `json:"size"`
+	CompletedAt time.Time  `json:"completed_at"`
+	DeletedAt   *time.Time `json:"deleted_at"`
+}
+
+func newVersionsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "versions <path>",
+		Short: "List the versions of a file uploaded more than once",
+		Long: "List every upload of a path (its file name on the server), newest\n" +
+			"first. Versions need a server with a metadata database.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiGet(cmd.Context(), p, "/files/versions?"+url.Values{"path": {args[0]}}.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var result struct {
+				Current  int           `json:"current"`
+				Versions []fileVersion `json:"versions"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "VERSION\tKEY\tSIZE\tUPLOADED\t")
+			for _, v := range result.Versions {
+				note := ""
+				switch {
+				case v.Version == result.Current:
+					note = "current"
+				case v.DeletedAt != nil:
+					note = "in trash"
+				}
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", v.Version, v.Key, formatBytes(v.Size),
+					v.CompletedAt.Local().Format(time.DateTime), note)
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newRollbackCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rollback <path> <version>",
+		Short: "Make an earlier version of a file the current one",
+		Long: "Copy an earlier version of a path to a new upload, which becomes its\n" +
+			"current version. Later versions are kept.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+			version, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version %q", args[1])
+			}
+
+			body, err := json.Marshal(map[string]interface{}{"path": args[0], "version": version})
+			if err != nil {
+				return err
+			}
+			resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/files/rollback", nil, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var file fileVersion
+			if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s is now version %d (%s)\n", args[0], file.Version, file.Key)
+			return nil
+		},
+	}
+}
+
+type grant struct {
+	Path   string `json:"path"`
+	Owner  string `json:"owner"`
+	UserID string `json:"user_id"`
+	Access string `json:"access"`
+}
+
+func newGrantCmd() *cobra.Command {
+	var write bool
+
+	cmd := &cobra.Command{
+		Use:   "grant <path> <user-id>",
+		Short: "Let another user read (or change) a file or folder",
+		Long: "Give another user access to a key, or to every key under a prefix\n" +
+			"ending in \"/\". Read access lets them list and download the files;\n" +
+			"with --write they can also tag them and move them to your trash.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			access := "read"
+			if write {
+				access = "write"
+			}
+			body, err := json.Marshal(map[string]string{"path": args[0], "user_id": args[1], "access": access})
+			if err != nil {
+				return err
+			}
+			resp, err := apiDo(cmd.Context(), p, http.MethodPost, "/files/grants", nil, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			fmt.Fprintf(cmd.OutOrStdout(), "granted %s access to %s to %s\n", access, args[0], args[1])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&write, "write", false, "also allow tagging and deleting")
+	return cmd
+}
+
+func newRevokeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <path> <user-id>",
+		Short: "Take back access given with \"hpu grant\"",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			query := url.Values{"path": {args[0]}, "user_id": {args[1]}}
+			resp, err := apiDo(cmd.Context(), p, http.MethodDelete, "/files/grants?"+query.Encode(), nil, nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			fmt.Fprintf(cmd.OutOrStdout(), "revoked access to %s from %s\n", args[0], args[1])
+			return nil
+		},
+	}
+}
+
+func newGrantsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "grants",
+		Short: "List access you gave to others and were given",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			resp, err := apiGet(cmd.Context(), p, "/files/grants", nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			var grants struct {
+				Granted  []grant `json:"granted"`
+				Received []grant `json:"received"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&grants); err != nil {
+				return fmt.Errorf("failed to decode response: %w", err)
+			}
+
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "PATH\tOWNER\tUSER\tACCESS")
+			for _, g := range append(grants.Granted, grants.Received...) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Path, g.Owner, g.UserID, g.Access)
+			}
+			return tw.Flush()
+		},
+	}
+}
+
+func newDownloadCmd() *cobra.Command {
+	var (
+		output   string
+		parallel int
+		rangeMB  int
+		noVerify bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "download <key>",
+		Short: "Download an uploaded file",
+		Long: "Download an uploaded file by its key (see `hpu list`), fetching ranges in\n" +
+			"parallel and verifying the result against the server's checksum. An\n" +
+			"interrupted download is continued from where it stopped.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if rangeMB <= 0 {
+				return errors.New("--range-size must be positive")
+			}
+			_, p, err := resolveProfile()
+			if err != nil {
+				return err
+			}
+
+			key := args[0]
+			if output == "" {
+				output = path.Base(key)
+			}
+
+			remote, err := statRemote(cmd.Context(), p, key)
+			if err != nil {
+				return err
+			}
+
+			f, state, err := prepareDownload(output, key, remote, int64(rangeMB)*1024*1024)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			resumed := state.doneBytes()
+			bar := newProgressBar(remote.Size, path.Base(key))
+			bar.Set64(resumed)
+			err = fetchRanges(cmd.Context(), p, output, f, state, parallel, bar)
+			bar.Finish()
+			if err != nil {
+				return fmt.Errorf("download interrupted after %s, run again to continue: %w", formatBytes(state.doneBytes()), err)
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+
+			if !noVerify && remote.Size > 0 {
+				switch err := verifyETag(f, remote); {
+				case errors.Is(err, errUnverifiable):
+					fmt.Fprintln(os.Stderr, "warning: checksum not verified:", err)
+				case err != nil:
+					// Start from scratch next time rather than trusting any range
+					f.Truncate(0)
+					os.Remove(downloadStatePath(output))
+					return fmt.Errorf("%s is corrupt, run again to download it anew: %w", output, err)
+				}
+			}
+			os.Remove(downloadStatePath(output))
+
+			if resumed == remote.Size {
+				fmt.Fprintln(cmd.OutOrStdout(), output, "is already complete")
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "downloaded %s (%s)\n", output, formatBytes(remote.Size))
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "output path (default: the key's base name)")
+	cmd.Flags().IntVar(&parallel, "parallel", 4, "ranges fetched at once")
+	cmd.Flags().IntVar(&rangeMB, "range-size", DEFAULT_RANGE_SIZE/(1024*1024), "size of each ranged request in MB")
+	cmd.Flags().BoolVar(&noVerify, "no-verify", false, "skip the checksum check")
+	return cmd
+}
+
+// ============================================
+// HTTP
+// ============================================
+
+type httpStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Code, e.Message)
+}
+
+func apiGet(ctx context.Context, p Profile, route string, header http.Header) (*http.Response, error) {
+	return apiDo(ctx, p, http.MethodGet, route, header, nil)
+}
+
+func apiDo(ctx context.Context, p Profile, method, route string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(p.HTTPEndpoint, "/")+route, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Error == "" {
+			body.Error = resp.Status
+		}
+		return nil, &httpStatusError{Code: resp.StatusCode, Message: body.Error}
+	}
+	return resp, nil
+}
+
+// escapeKey escapes each path segment of an S3 key but keeps the slashes.
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,128 @@
+// hpu - Command-line uploader for the high performance upload server
+//
+//	hpu config set --endpoint gateway:9090 --http-endpoint http://gateway:5000 --token $TOKEN
+//	hpu upload video.mp4
+//	hpu upload --limit-mbps 20 --schedule 22:00-06:00 backup.tar
+//	hpu upload --protocol http video.mp4
+//	hpu resume <session-id>
+//	hpu sync ~/Videos
+//	hpu list
+//	hpu download <key>
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"backend/client"
+)
+
+var (
+	flagProfile      string
+	flagEndpoint     string
+	flagHTTPEndpoint string
+	flagProtocol     string
+	flagToken        string
+	flagLimitMbps    float64
+	flagSchedule     string
+	flagTLS          bool
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "hpu",
+		Short:         "Upload, resume and download files on the upload server",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVarP(&flagProfile, "profile", "p", "", "config profile (default: the current profile)")
+	root.PersistentFlags().StringVar(&flagEndpoint, "endpoint", "", "binary protocol address (host:port)")
+	root.PersistentFlags().StringVar(&flagHTTPEndpoint, "http-endpoint", "", "HTTP gateway URL")
+	root.PersistentFlags().StringVar(&flagProtocol, "protocol", "", "upload over binary or http (default: the profile's)")
+	root.PersistentFlags().StringVar(&flagToken, "token", "", "auth token")
+	root.PersistentFlags().Float64Var(&flagLimitMbps, "limit-mbps", -1, "upload bandwidth cap in Mbit/s, 0 for none (default: the profile's)")
+	root.PersistentFlags().StringVar(&flagSchedule, "schedule", "", "only upload between these local times, e.g. 22:00-06:00 (default: the profile's)")
+	root.PersistentFlags().BoolVar(&flagTLS, "tls", false, "connect to the binary endpoint over TLS (default: the profile's)")
+
+	root.AddCommand(
+		newUploadCmd(),
+		newResumeCmd(),
+		newPauseCmd(),
+		newCancelCmd(),
+		newStatusCmd(),
+		newSyncCmd(),
+		newListCmd(),
+		newSearchCmd(),
+		newDownloadCmd(),
+		newTagCmd(),
+		newStarCmd(),
+		newRmCmd(),
+		newTrashCmd(),
+		newRestoreCmd(),
+		newVersionsCmd(),
+		newRollbackCmd(),
+		newGrantCmd(),
+		newRevokeCmd(),
+		newGrantsCmd(),
+		newExportCmd(),
+		newExportsCmd(),
+		newActivityCmd(),
+		newCommentCmd(),
+		newCommentsCmd(),
+		newConfigCmd(),
+	)
+
+	// Ctrl-C stops between chunks; the session stays resumable
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := root.ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// newClient connects to the resolved profile's binary endpoint, or to its
+// HTTP endpoint's chunk API if its protocol is http, applying its bandwidth
+// limit and schedule, then extra.
+func newClient(extra ...client.Option) (*client.Client, string, Profile, error) {
+	name, p, err := resolveProfile()
+	if err != nil {
+		return nil, "", Profile{}, err
+	}
+
+	overHTTP := p.Protocol == PROTOCOL_HTTP
+	var opts []client.Option
+	if p.LimitMbps > 0 {
+		if overHTTP {
+			fmt.Fprintln(os.Stderr, "the bandwidth limit does not apply over http; uploading without it")
+		} else {
+			opts = append(opts, client.WithBandwidthLimit(int64(p.LimitMbps*1e6/8)))
+		}
+	}
+	if p.Schedule != "" {
+		window, err := client.ParseDailyWindow(p.Schedule)
+		if err != nil {
+			return nil, "", Profile{}, err
+		}
+		if !window.Contains(time.Now()) {
+			fmt.Fprintf(os.Stderr, "outside the upload schedule %s; waiting until %s\n",
+				window, window.Next(time.Now()).Format(time.Kitchen))
+		}
+		opts = append(opts, client.WithSendWindow(window))
+	}
+	if p.TLS && !overHTTP {
+		opts = append(opts, client.WithTLS(nil))
+	}
+	opts = append(opts, extra...)
+	if overHTTP {
+		return client.NewHTTP(p.HTTPEndpoint, p.Token, opts...), name, p, nil
+	}
+	return client.New(p.Endpoint, p.Token, opts...), name, p, nil
+}
@@ -0,0 +1,327 @@
+// sync.go - sync command: upload the new and changed files of a directory
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"backend/client"
+)
+
+// ============================================
+// Directory Sync
+// ============================================
+
+// Every file under the directory is uploaded as <prefix>/<relative path>.
+// Keys are user_id/timestamp/name, so the newest key per name is the file's
+// last synced version. A file is skipped when that version has the same size
+// and the same checksum (the S3 ETag, recomputed locally as in download), so
+// unchanged files cost a read but no transfer. Nothing is deleted remotely.
+
+const (
+	SYNC_NEW       = "new"
+	SYNC_CHANGED   = "changed"
+	SYNC_UNCHANGED = "unchanged"
+)
+
+type syncFile struct {
+	path string // Local path
+	name string // Name on the server
+	size int64
+}
+
+type syncStats struct {
+	mu        sync.Mutex
+	uploaded  int
+	unchanged int
+	failed    int
+}
+
+func newSyncCmd() *cobra.Command {
+	var (
+		prefix   string
+		chunkMB  int
+		parallel int
+		dryRun   bool
+		verbose  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "sync <dir>",
+		Short: "Upload the new and changed files of a directory",
+		Long: "Upload every file under <dir> whose content differs from the last version\n" +
+			"synced under the same name, several files at once. Files are named\n" +
+			"<prefix>/<path relative to dir>; hidden files and directories are skipped.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if parallel < 1 {
+				return errors.New("--parallel must be at least 1")
+			}
+			dir := args[0]
+			if !cmd.Flags().Changed("prefix") {
+				abs, err := filepath.Abs(dir)
+				if err != nil {
+					return err
+				}
+				prefix = filepath.Base(abs)
+			}
+
+			local, err := walkSyncDir(dir, prefix)
+			if err != nil {
+				return err
+			}
+
+			c, profile, p, err := newClient()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			remote, err := latestRemoteFiles(cmd.Context(), p)
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			var (
+				stats   syncStats
+				outMu   sync.Mutex
+				records sync.Mutex // sessions.json is rewritten on every change
+				wg      sync.WaitGroup
+				files   = make(chan syncFile)
+				printf  = func(format string, a ...interface{}) {
+					outMu.Lock()
+					fmt.Fprintf(out, format, a...)
+					outMu.Unlock()
+				}
+			)
+			for i := 0; i < parallel; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					wc := c.Clone()
+					defer wc.Close()
+
+					for file := range files {
+						status, err := compareRemote(cmd.Context(), p, file, remote)
+						if err != nil {
+							stats.record(&stats.failed)
+							printf("failed     %s: %v\n", file.name, err)
+							continue
+						}
+						if status == SYNC_UNCHANGED {
+							stats.record(&stats.unchanged)
+							if verbose {
+								printf("unchanged  %s\n", file.name)
+							}
+							continue
+						}
+						if dryRun {
+							stats.record(&stats.uploaded)
+							printf("%-10s %s (%s)\n", status, file.name, formatBytes(file.size))
+							continue
+						}
+
+						err = syncUpload(cmd.Context(), wc, file, client.UploadOptions{
+							ChunkSize: uint32(chunkMB) * 1024 * 1024,
+							Name:      file.name,
+						}, profile, &records)
+						if err != nil {
+							stats.record(&stats.failed)
+							printf("failed     %s: %v\n", file.name, err)
+							continue
+						}
+						stats.record(&stats.uploaded)
+						printf("uploaded   %s (%s, %s)\n", file.name, status, formatBytes(file.size))
+					}
+				}()
+			}
+
+			for _, file := range local {
+				select {
+				case files <- file:
+				case <-cmd.Context().Done():
+				}
+			}
+			close(files)
+			wg.Wait()
+
+			verb := "uploaded"
+			if dryRun {
+				verb = "to upload"
+			}
+			fmt.Fprintf(out, "%d %s, %d unchanged, %d failed\n", stats.uploaded, verb, stats.unchanged, stats.failed)
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			if stats.failed > 0 {
+				return fmt.Errorf("%d files failed to sync", stats.failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&prefix, "prefix", "", "name prefix on the server (default: the directory's name)")
+	cmd.Flags().IntVar(&chunkMB, "chunk-size", client.DEFAULT_CHUNK_SIZE/(1024*1024), "chunk size in MB (5-100)")
+	cmd.Flags().IntVar(&parallel, "parallel", 2, "files uploaded at once, each in its own session")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "list what would be uploaded without uploading")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "also list unchanged files")
+	return cmd
+}
+
+func (s *syncStats) record(counter *int) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+// walkSyncDir lists the regular, non-empty files under dir with their names
+// on the server.
+func walkSyncDir(dir, prefix string) ([]syncFile, error) {
+	var files []syncFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(p, DOWNLOAD_STATE_SUFFIX) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 {
+			return nil // The server cannot store empty files
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, syncFile{
+			path: p,
+			name: path.Join(prefix, filepath.ToSlash(rel)),
+			size: info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// latestRemoteFiles maps each name on the server to its newest key. The
+// listing bypasses the server's cache, which may not have seen uploads
+// through other servers yet.
+func latestRemoteFiles(ctx context.Context, p Profile) (map[string]fileSummary, error) {
+	resp, err := apiGet(ctx, p, "/files?fresh=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var files filesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if files.Truncated {
+		fmt.Fprintln(os.Stderr, "warning: the server listed only part of your files; unlisted ones are uploaded again")
+	}
+
+	latest := make(map[string]fileSummary, len(files.Files))
+	for _, f := range files.Files {
+		// user_id/timestamp/name
+		parts := strings.SplitN(f.Key, "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if prev, ok := latest[parts[2]]; !ok || f.LastModified.After(prev.LastModified) {
+			latest[parts[2]] = f
+		}
+	}
+	return latest, nil
+}
+
+// compareRemote reports whether file is new, changed or unchanged relative to
+// its latest version on the server.
+func compareRemote(ctx context.Context, p Profile, file syncFile, remote map[string]fileSummary) (string, error) {
+	summary, ok := remote[file.name]
+	if !ok {
+		return SYNC_NEW, nil
+	}
+	if summary.Size != file.size {
+		return SYNC_CHANGED, nil
+	}
+
+	stat, err := statRemote(ctx, p, summary.Key)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(file.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	switch err := verifyETag(f, stat); {
+	case err == nil:
+		return SYNC_UNCHANGED, nil
+	case errors.Is(err, errUnverifiable), errors.Is(err, errChecksumMismatch):
+		return SYNC_CHANGED, nil
+	default:
+		return "", err
+	}
+}
+
+// syncUpload uploads one file, remembering its session so a failed upload
+// can be finished with `hpu resume`.
+func syncUpload(ctx context.Context, c *client.Client, file syncFile, opts client.UploadOptions, profile string, records *sync.Mutex) error {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	abs, _ := filepath.Abs(file.path)
+	var sessionID string
+	opts.OnSession = func(s *client.Session) {
+		sessionID = s.ID
+		records.Lock()
+		defer records.Unlock()
+		err := rememberSession(SessionRecord{
+			SessionID: s.ID,
+			Path:      abs,
+			Name:      file.name,
+			ChunkSize: s.ChunkSize,
+			Profile:   profile,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to remember session:", err)
+		}
+	}
+
+	if _, err := c.Upload(ctx, f, file.size, opts); err != nil {
+		if sessionID != "" {
+			return fmt.Errorf("%w (continue with `hpu resume %s`)", err, sessionID)
+		}
+		return err
+	}
+
+	records.Lock()
+	defer records.Unlock()
+	forgetSession(sessionID)
+	return nil
+}
@@ -0,0 +1,346 @@
+// upload.go - upload, resume, cancel and status commands
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+
+	"backend/client"
+	"backend/compression"
+)
+
+func newUploadCmd() *cobra.Command {
+	var (
+		chunkMB  int
+		name     string
+		parallel int
+		adaptive bool
+		verify   bool
+		compress bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "upload <file>...",
+		Short: "Upload one or more files",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if name != "" && len(args) > 1 {
+				return errors.New("--name only applies to a single file")
+			}
+
+			c, profile, _, err := newClient(compressOption(compress)...)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			for _, path := range args {
+				opts := client.UploadOptions{
+					ChunkSize:   uint32(chunkMB) * 1024 * 1024,
+					Name:        name,
+					Parallelism: parallel,
+					Adaptive:    adaptive,
+				}
+				// Later files get a chunk size measured on the earlier ones
+				if adaptive && !cmd.Flags().Changed("chunk-size") {
+					opts.ChunkSize = 0
+				}
+				if err := uploadOne(cmd, c, profile, path, opts, verify); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&chunkMB, "chunk-size", client.DEFAULT_CHUNK_SIZE/(1024*1024), "chunk size in MB (5-100)")
+	cmd.Flags().StringVar(&name, "name", "", "file name stored on the server (default: the local name)")
+	cmd.Flags().IntVar(&parallel, "parallel", 1, "chunks sent at once, each on its own connection")
+	cmd.Flags().BoolVar(&adaptive, "adaptive", false, "size chunks from measured throughput and use up to --parallel connections while they help")
+	cmd.Flags().BoolVar(&verify, "verify", false, "hash each file first and have the server check the uploaded file against it")
+	cmd.Flags().BoolVar(&compress, "compress", false, "compress chunks if the server agrees; for text and documents, not media")
+	return cmd
+}
+
+func uploadOne(cmd *cobra.Command, c *client.Client, profile, path string, opts client.UploadOptions, verify bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(path)
+	}
+	abs, _ := filepath.Abs(path)
+	if verify {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		opts.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	bar := newProgressBar(info.Size(), opts.Name)
+	var (
+		sessionID string
+		track     func(*client.ChunkResult)
+	)
+	// An adaptive upload's chunk size is only known once the session exists
+	opts.OnSession = func(s *client.Session) {
+		sessionID = s.ID
+		track = trackProgress(bar, opts.Name, info.Size(), s.ChunkSize)
+		err := rememberSession(SessionRecord{
+			SessionID: s.ID,
+			Path:      abs,
+			Name:      opts.Name,
+			ChunkSize: s.ChunkSize,
+			Profile:   profile,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to remember session:", err)
+		}
+		bar.Describe(fmt.Sprintf("%s (%s)", opts.Name, s.ID))
+	}
+	opts.OnChunk = func(result *client.ChunkResult) { track(result) }
+
+	done, err := c.Upload(cmd.Context(), f, info.Size(), opts)
+	bar.Finish()
+	if err != nil {
+		// A file that failed its hash check has failed its session too
+		var mismatch *client.HashMismatchError
+		if sessionID != "" && !errors.As(err, &mismatch) {
+			return fmt.Errorf("%s: %w (continue with `hpu resume %s`)", path, err, sessionID)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	printCompleted(cmd, done)
+	forgetSession(sessionID)
+	return nil
+}
+
+func newResumeCmd() *cobra.Command {
+	var (
+		chunkMB  int
+		parallel int
+		adaptive bool
+		compress bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "resume <session-id> [file]",
+		Short: "Continue an interrupted upload",
+		Long: "Continue an interrupted upload. The file and chunk size are remembered for\n" +
+			"sessions started by this CLI; pass them explicitly for any other session.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessionID := args[0]
+
+			records, err := loadSessions()
+			if err != nil {
+				return err
+			}
+			record, known := records[sessionID]
+			if len(args) == 2 {
+				record.Path = args[1]
+				record.Name = filepath.Base(args[1])
+			}
+			if cmd.Flags().Changed("chunk-size") || record.ChunkSize == 0 {
+				record.ChunkSize = uint32(chunkMB) * 1024 * 1024
+			}
+			if record.Path == "" {
+				return fmt.Errorf("session %s was not started here; pass the file to resume", sessionID)
+			}
+			if known && record.Profile != "" && flagProfile == "" {
+				flagProfile = record.Profile
+			}
+
+			c, _, _, err := newClient(compressOption(compress)...)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			f, err := os.Open(record.Path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			bar := newProgressBar(info.Size(), record.Name)
+			opts := client.UploadOptions{
+				ChunkSize:   record.ChunkSize,
+				OnChunk:     trackProgress(bar, record.Name, info.Size(), record.ChunkSize),
+				Parallelism: parallel,
+				Adaptive:    adaptive,
+			}
+
+			// Count what the server already has
+			if status, err := c.Status(cmd.Context(), sessionID); err == nil {
+				bar.Set64(min(int64(status.Received)*int64(record.ChunkSize), info.Size()))
+			}
+
+			done, err := c.ResumeUpload(cmd.Context(), sessionID, f, info.Size(), opts)
+			bar.Finish()
+			if err != nil {
+				return err
+			}
+			printCompleted(cmd, done)
+			forgetSession(sessionID)
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&chunkMB, "chunk-size", client.DEFAULT_CHUNK_SIZE/(1024*1024), "chunk size in MB the session was started with")
+	cmd.Flags().IntVar(&parallel, "parallel", 1, "chunks sent at once, each on its own connection")
+	cmd.Flags().BoolVar(&adaptive, "adaptive", false, "use up to --parallel connections while they raise throughput")
+	cmd.Flags().BoolVar(&compress, "compress", false, "compress chunks if the server agrees")
+	return cmd
+}
+
+func compressOption(compress bool) []client.Option {
+	if !compress {
+		return nil
+	}
+	return []client.Option{client.WithCompression(compression.Supported)}
+}
+
+func newPauseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause <session-id>",
+		Short: "Pause an upload; the server refuses its chunks until it is resumed",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, _, err := newClient()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			progress, err := c.Pause(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "paused %s at %d/%d chunks (continue with `hpu resume %s`)\n",
+				args[0], progress.Received, progress.Total, args[0])
+			return nil
+		},
+	}
+}
+
+func newCancelCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel <session-id>",
+		Short: "Cancel an upload and discard its chunks",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, _, err := newClient()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			if err := c.Cancel(cmd.Context(), args[0]); err != nil {
+				return err
+			}
+			forgetSession(args[0])
+			fmt.Fprintln(cmd.OutOrStdout(), "cancelled", args[0])
+			return nil
+		},
+	}
+}
+
+func newStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status <session-id>",
+		Short: "Show the state and progress of an upload",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, _, _, err := newClient()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			status, err := c.Status(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			pct := 0.0
+			if status.Total > 0 {
+				pct = float64(status.Received) / float64(status.Total) * 100
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: %s, %d/%d chunks (%.1f%%)\n",
+				args[0], status.State, status.Received, status.Total, pct)
+			return nil
+		},
+	}
+}
+
+// ============================================
+// Helpers
+// ============================================
+
+func newProgressBar(size int64, name string) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(size,
+		progressbar.OptionSetDescription(name),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionThrottle(100*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionOnCompletion(func() { fmt.Fprintln(os.Stderr) }),
+	)
+}
+
+// trackProgress advances the bar per acknowledged chunk and shows the
+// server-measured throughput and ETA.
+func trackProgress(bar *progressbar.ProgressBar, name string, size int64, chunkSize uint32) func(*client.ChunkResult) {
+	return func(result *client.ChunkResult) {
+		offset := int64(result.Index) * int64(chunkSize)
+		bar.Add64(min(int64(chunkSize), size-offset))
+
+		if result.BytesPerSec > 0 {
+			eta := "?"
+			if result.ETA >= 0 {
+				eta = result.ETA.Round(time.Second).String()
+			}
+			bar.Describe(fmt.Sprintf("%s [server %s/s, eta %s]", name, formatBytes(int64(result.BytesPerSec)), eta))
+		}
+	}
+}
+
+func printCompleted(cmd *cobra.Command, done *client.Completed) {
+	fmt.Fprintf(cmd.OutOrStdout(), "uploaded %s (%s)\n", done.S3Key, formatBytes(int64(done.Size)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,79 @@
+// faults.go - Client-side latency and connection loss injection
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errInjectedLoss = errors.New("injected connection loss")
+
+// faultInjector wraps dialed connections so every write is delayed by
+// latency plus up to jitter, and fails with probability loss, closing the
+// connection as a dropped link would.
+type faultInjector struct {
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	drops atomic.Int64
+}
+
+func newFaultInjector(cfg config) *faultInjector {
+	return &faultInjector{
+		latency: cfg.Latency,
+		jitter:  cfg.Jitter,
+		loss:    cfg.Loss,
+		rng:     rand.New(rand.NewPCG(uint64(cfg.Seed), 0)),
+	}
+}
+
+func (f *faultInjector) enabled() bool {
+	return f.latency > 0 || f.jitter > 0 || f.loss > 0
+}
+
+func (f *faultInjector) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil || !f.enabled() {
+		return conn, err
+	}
+	return &faultyConn{Conn: conn, faults: f}, nil
+}
+
+// next draws the delay and drop decision for one write.
+func (f *faultInjector) next() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delay := f.latency
+	if f.jitter > 0 {
+		delay += time.Duration(f.rng.Int64N(int64(f.jitter)))
+	}
+	return delay, f.loss > 0 && f.rng.Float64() < f.loss
+}
+
+type faultyConn struct {
+	net.Conn
+	faults *faultInjector
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	delay, drop := c.faults.next()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if drop {
+		c.faults.drops.Add(1)
+		c.Conn.Close()
+		return 0, errInjectedLoss
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,135 @@
+// loadtest - Drives concurrent uploads against the upload server
+//
+//	go run ./cmd/loadtest -mode binary -addr localhost:9090 -token $TOKEN -uploads 200 -concurrency 20 -size 64MB
+//	go run ./cmd/loadtest -mode http -http http://localhost:5000 -token $TOKEN -latency 40ms -loss 0.01
+//
+// Each upload sends synthetic data in its own session over its own
+// connection. Latency and connection loss can be injected on the client side
+// to see how the server and retry paths behave on bad links. The report lists
+// aggregate throughput and chunk/upload latency percentiles; -json emits the
+// same as JSON and -max-p99 / -min-throughput turn it into a pass/fail check
+// for CI.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	MODE_BINARY = "binary"
+	MODE_HTTP   = "http"
+)
+
+type config struct {
+	Mode        string
+	Addr        string
+	HTTPURL     string
+	Token       string
+	Uploads     int
+	Concurrency int
+	Size        int64
+	ChunkSize   int64
+	Latency     time.Duration
+	Jitter      time.Duration
+	Loss        float64
+	Retries     int
+	Seed        int64
+}
+
+func main() {
+	cfg := config{Size: 32 << 20, ChunkSize: 8 << 20}
+	flag.StringVar(&cfg.Mode, "mode", MODE_BINARY, "protocol to test: binary or http")
+	flag.StringVar(&cfg.Addr, "addr", "localhost:9090", "binary protocol address (host:port)")
+	flag.StringVar(&cfg.HTTPURL, "http", "http://localhost:5000", "HTTP API base URL")
+	flag.StringVar(&cfg.Token, "token", os.Getenv("LOADTEST_TOKEN"), "auth token (default $LOADTEST_TOKEN)")
+	flag.IntVar(&cfg.Uploads, "uploads", 20, "total number of uploads")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 5, "uploads in flight at once")
+	flag.Func("size", "file size per upload, e.g. 64MB (default 32MB)", sizeFlag(&cfg.Size))
+	flag.Func("chunk-size", "chunk size, e.g. 8MB (default 8MB)", sizeFlag(&cfg.ChunkSize))
+	flag.DurationVar(&cfg.Latency, "latency", 0, "delay added before every write")
+	flag.DurationVar(&cfg.Jitter, "jitter", 0, "random extra delay up to this much per write")
+	flag.Float64Var(&cfg.Loss, "loss", 0, "probability (0-1) that a write drops the connection")
+	flag.IntVar(&cfg.Retries, "retries", 5, "retries per command after a network error")
+	flag.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "seed for fault injection")
+	jsonOut := flag.Bool("json", false, "print the report as JSON")
+	maxP99 := flag.Duration("max-p99", 0, "fail if the chunk p99 latency exceeds this")
+	minThroughput := flag.Float64("min-throughput", 0, "fail if aggregate throughput is below this many MB/s")
+	flag.Parse()
+
+	if cfg.Token == "" {
+		log.Fatal("no auth token: pass -token or set LOADTEST_TOKEN")
+	}
+	if cfg.Mode != MODE_BINARY && cfg.Mode != MODE_HTTP {
+		log.Fatalf("unknown mode %q", cfg.Mode)
+	}
+	if cfg.Uploads < 1 || cfg.Concurrency < 1 {
+		log.Fatal("-uploads and -concurrency must be positive")
+	}
+	if cfg.Loss < 0 || cfg.Loss >= 1 {
+		log.Fatal("-loss must be in [0, 1)")
+	}
+
+	// Ctrl-C stops starting new uploads and reports what finished
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rep := run(ctx, cfg)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		rep.print(os.Stdout)
+	}
+
+	var failed []string
+	if *maxP99 > 0 && rep.ChunkLatency.P99 > *maxP99 {
+		failed = append(failed, fmt.Sprintf("chunk p99 %s > %s", rep.ChunkLatency.P99, *maxP99))
+	}
+	if *minThroughput > 0 && rep.ThroughputMBps < *minThroughput {
+		failed = append(failed, fmt.Sprintf("throughput %.1f MB/s < %.1f MB/s", rep.ThroughputMBps, *minThroughput))
+	}
+	if rep.Failed > 0 {
+		failed = append(failed, fmt.Sprintf("%d uploads failed", rep.Failed))
+	}
+	if len(failed) > 0 {
+		fmt.Fprintln(os.Stderr, "FAIL:", strings.Join(failed, "; "))
+		os.Exit(1)
+	}
+}
+
+// sizeFlag parses sizes such as 512KB, 64MB or 1GB (binary units).
+func sizeFlag(dst *int64) func(string) error {
+	return func(s string) error {
+		units := []struct {
+			suffix string
+			mult   int64
+		}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+		s = strings.ToUpper(strings.TrimSpace(s))
+		mult := int64(1)
+		for _, u := range units {
+			if strings.HasSuffix(s, u.suffix) {
+				s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+				break
+			}
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q", s)
+		}
+		*dst = n * mult
+		return nil
+	}
+}
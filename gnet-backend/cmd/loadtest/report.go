@@ -0,0 +1,174 @@
+// report.go - Latency recording and the final report
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type recorder struct {
+	mu        sync.Mutex
+	chunks    []time.Duration
+	uploads   []time.Duration
+	bytes     int64
+	completed int
+	failed    int
+	errors    map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{errors: map[string]int{}}
+}
+
+func (r *recorder) chunk(d time.Duration) {
+	r.mu.Lock()
+	r.chunks = append(r.chunks, d)
+	r.mu.Unlock()
+}
+
+func (r *recorder) success(size int64, d time.Duration) {
+	r.mu.Lock()
+	r.uploads = append(r.uploads, d)
+	r.bytes += size
+	r.completed++
+	r.mu.Unlock()
+}
+
+func (r *recorder) failure(err error) {
+	r.mu.Lock()
+	r.failed++
+	if _, ok := r.errors[err.Error()]; ok || len(r.errors) < MAX_ERROR_KINDS {
+		r.errors[err.Error()]++
+	}
+	r.mu.Unlock()
+}
+
+// ============================================
+// Report
+// ============================================
+
+type report struct {
+	Mode           string         `json:"mode"`
+	Uploads        int            `json:"uploads"`
+	Completed      int            `json:"completed"`
+	Failed         int            `json:"failed"`
+	Bytes          int64          `json:"bytes"`
+	Elapsed        time.Duration  `json:"-"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	ThroughputMBps float64        `json:"throughput_mbps"`
+	ChunkLatency   latencySummary `json:"chunk_latency_ms"`
+	UploadDuration latencySummary `json:"upload_duration_ms"`
+	InjectedDrops  int64          `json:"injected_drops"`
+	Errors         map[string]int `json:"errors,omitempty"`
+}
+
+type latencySummary struct {
+	Count int
+	Min   time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+}
+
+func summarize(samples []time.Duration) latencySummary {
+	if len(samples) == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	// Nearest-rank percentile
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.999999) - 1
+		return sorted[max(0, min(i, len(sorted)-1))]
+	}
+	return latencySummary{
+		Count: len(sorted),
+		Min:   sorted[0],
+		P50:   rank(0.50),
+		P90:   rank(0.90),
+		P99:   rank(0.99),
+		Max:   sorted[len(sorted)-1],
+		Mean:  total / time.Duration(len(sorted)),
+	}
+}
+
+// MarshalJSON reports durations in milliseconds.
+func (s latencySummary) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(map[string]interface{}{
+		"count": s.Count,
+		"min":   ms(s.Min),
+		"p50":   ms(s.P50),
+		"p90":   ms(s.P90),
+		"p99":   ms(s.P99),
+		"max":   ms(s.Max),
+		"mean":  ms(s.Mean),
+	})
+}
+
+func (r *recorder) report(cfg config, elapsed time.Duration, drops int64) *report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := &report{
+		Mode:           cfg.Mode,
+		Uploads:        cfg.Uploads,
+		Completed:      r.completed,
+		Failed:         r.failed,
+		Bytes:          r.bytes,
+		Elapsed:        elapsed,
+		ElapsedSeconds: elapsed.Seconds(),
+		ChunkLatency:   summarize(r.chunks),
+		UploadDuration: summarize(r.uploads),
+		InjectedDrops:  drops,
+		Errors:         r.errors,
+	}
+	if elapsed > 0 {
+		rep.ThroughputMBps = float64(r.bytes) / (1 << 20) / elapsed.Seconds()
+	}
+	return rep
+}
+
+func (rep *report) print(w io.Writer) {
+	fmt.Fprintf(w, "mode:        %s\n", rep.Mode)
+	fmt.Fprintf(w, "uploads:     %d completed, %d failed, %d requested\n", rep.Completed, rep.Failed, rep.Uploads)
+	fmt.Fprintf(w, "elapsed:     %s\n", rep.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:  %.1f MB/s (%.1f Mbit/s)\n", rep.ThroughputMBps, rep.ThroughputMBps*8*1.048576)
+	if rep.InjectedDrops > 0 {
+		fmt.Fprintf(w, "drops:       %d injected\n", rep.InjectedDrops)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "%-10s %8s %10s %10s %10s %10s %10s %10s\n", "", "count", "min", "p50", "p90", "p99", "max", "mean")
+	for _, row := range []struct {
+		name string
+		s    latencySummary
+	}{{"chunk", rep.ChunkLatency}, {"upload", rep.UploadDuration}} {
+		r := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+		fmt.Fprintf(w, "%-10s %8d %10s %10s %10s %10s %10s %10s\n", row.name, row.s.Count,
+			r(row.s.Min), r(row.s.P50), r(row.s.P90), r(row.s.P99), r(row.s.Max), r(row.s.Mean))
+	}
+
+	if len(rep.Errors) > 0 {
+		fmt.Fprintln(w, "\nerrors:")
+		msgs := make([]string, 0, len(rep.Errors))
+		for msg := range rep.Errors {
+			msgs = append(msgs, msg)
+		}
+		sort.Strings(msgs)
+		for _, msg := range msgs {
+			fmt.Fprintf(w, "  %5d  %s\n", rep.Errors[msg], msg)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// runner.go - Upload workers for the binary and HTTP modes
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/client"
+)
+
+const (
+	RETRY_BACKOFF   = 200 * time.Millisecond
+	MAX_ERROR_KINDS = 10 // Distinct error messages kept for the report
+)
+
+// run starts cfg.Uploads uploads, cfg.Concurrency at a time, and waits for
+// them (or ctx) to finish.
+func run(ctx context.Context, cfg config) *report {
+	faults := newFaultInjector(cfg)
+	data := newPatternData(cfg.Size)
+	rec := newRecorder()
+
+	upload := func(ctx context.Context, i int) error {
+		return uploadBinary(ctx, cfg, faults, data, rec, i)
+	}
+	if cfg.Mode == MODE_HTTP {
+		httpClient := &http.Client{Transport: &http.Transport{
+			DialContext:         faults.dial,
+			MaxIdleConnsPerHost: cfg.Concurrency,
+		}}
+		upload = func(ctx context.Context, i int) error {
+			return uploadHTTP(ctx, cfg, httpClient, data, rec, i)
+		}
+	}
+
+	start := time.Now()
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Uploads; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			uploadStart := time.Now()
+			if err := upload(ctx, i); err != nil {
+				rec.failure(err)
+				return
+			}
+			rec.success(cfg.Size, time.Since(uploadStart))
+		}(i)
+	}
+	wg.Wait()
+
+	return rec.report(cfg, time.Since(start), faults.drops.Load())
+}
+
+// ============================================
+// Binary Mode
+// ============================================
+
+func uploadBinary(ctx context.Context, cfg config, faults *faultInjector, data *patternData, rec *recorder, i int) error {
+	c := client.New(cfg.Addr, cfg.Token,
+		client.WithRetries(cfg.Retries, RETRY_BACKOFF),
+		client.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return faults.dial(ctx, "tcp", addr)
+		}),
+	)
+	defer c.Close()
+
+	// The SDK sends chunks one after another, so the gap between acks is the
+	// chunk round trip
+	var last time.Time
+	_, err := c.Upload(ctx, data, cfg.Size, client.UploadOptions{
+		ChunkSize: uint32(cfg.ChunkSize),
+		Name:      fmt.Sprintf("loadtest-%d.bin", i),
+		OnSession: func(*client.Session) { last = time.Now() },
+		OnChunk: func(*client.ChunkResult) {
+			now := time.Now()
+			rec.chunk(now.Sub(last))
+			last = now
+		},
+	})
+	return err
+}
+
+// ============================================
+// HTTP Mode
+// ============================================
+
+type httpStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Message)
+}
+
+func uploadHTTP(ctx context.Context, cfg config, hc *http.Client, data *patternData, rec *recorder, i int) error {
+	totalChunks := int((cfg.Size + cfg.ChunkSize - 1) / cfg.ChunkSize)
+
+	var session struct {
+		SessionID string `json:"session_id"`
+	}
+	initBody, _ := json.Marshal(map[string]interface{}{
+		"file_name":    fmt.Sprintf("loadtest-%d.bin", i),
+		"total_chunks": totalChunks,
+		"chunk_size":   cfg.ChunkSize,
+	})
+	err := retryHTTP(ctx, cfg, func() error {
+		return doJSON(ctx, hc, cfg, http.MethodPost, "/upload/init", "application/json", bytes.NewReader(initBody), &session)
+	})
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	chunk := make([]byte, cfg.ChunkSize)
+	var resp struct {
+		Complete bool   `json:"complete"`
+		State    string `json:"state"`
+	}
+	for index := 0; index < totalChunks; index++ {
+		offset := int64(index) * cfg.ChunkSize
+		n, _ := data.ReadAt(chunk[:min(cfg.ChunkSize, cfg.Size-offset)], offset)
+		body, contentType := chunkForm(session.SessionID, index, chunk[:n])
+
+		err := retryHTTP(ctx, cfg, func() error {
+			start := time.Now()
+			err := doJSON(ctx, hc, cfg, http.MethodPost, "/upload/chunk", contentType, bytes.NewReader(body), &resp)
+			if err == nil {
+				rec.chunk(time.Since(start))
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", index, err)
+		}
+	}
+	if resp.Complete {
+		return nil
+	}
+
+	// The final chunk lost a race with a retried one that is still finalizing
+	var status struct {
+		State string `json:"state"`
+	}
+	for status.State != "completed" {
+		if status.State == "failed" || status.State == "cancelled" {
+			return fmt.Errorf("session %s %s", session.SessionID, status.State)
+		}
+		select {
+		case <-time.After(RETRY_BACKOFF):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := doJSON(ctx, hc, cfg, http.MethodGet, "/upload/status/"+session.SessionID, "", nil, &status)
+		if err != nil {
+			return fmt.Errorf("status: %w", err)
+		}
+	}
+	return nil
+}
+
+func chunkForm(sessionID string, index int, chunk []byte) ([]byte, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("session_id", sessionID)
+	w.WriteField("chunk_index", strconv.Itoa(index))
+	w.WriteField("size", strconv.Itoa(len(chunk)))
+	part, _ := w.CreateFormFile("chunk", "chunk")
+	part.Write(chunk)
+	w.Close()
+	return buf.Bytes(), w.FormDataContentType()
+}
+
+func doJSON(ctx context.Context, hc *http.Client, cfg config, method, route, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(cfg.HTTPURL, "/")+route, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return &httpStatusError{Code: resp.StatusCode, Message: e.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// retryHTTP retries network errors and 5xx responses with exponential
+// backoff, mirroring the binary SDK's policy.
+func retryHTTP(ctx context.Context, cfg config, fn func() error) error {
+	backoff := RETRY_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var status *httpStatusError
+		if errors.As(err, &status) && status.Code < 500 {
+			return err
+		}
+		if attempt >= cfg.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, client.MAX_RETRY_BACKOFF)
+	}
+}
+
+// ============================================
+// Synthetic Data
+// ============================================
+
+const PATTERN_SIZE = 1 << 20
+
+// patternData is a read-only file of the given size that repeats a fixed
+// pseudo-random 1 MB block, so uploads need no disk and do not compress.
+type patternData struct {
+	size  int64
+	block []byte
+}
+
+func newPatternData(size int64) *patternData {
+	block := make([]byte, PATTERN_SIZE)
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range block {
+		// xorshift64
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		block[i] = byte(x)
+	}
+	return &patternData{size: size, block: block}
+}
+
+func (d *patternData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	end := int(min(int64(len(p)), d.size-off))
+	n := 0
+	for n < end {
+		n += copy(p[n:end], d.block[(off+int64(n))%PATTERN_SIZE:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
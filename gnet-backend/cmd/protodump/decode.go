@@ -0,0 +1,266 @@
+// decode.go - Request and response decoding with stream offsets
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"backend/compression"
+	"backend/protocol"
+)
+
+var errTruncated = errors.New("truncated")
+
+// message is one decoded frame and where it sits in its stream.
+type message struct {
+	Offset int
+	Length int
+	Text   string
+	Err    error // Set on the final entry when decoding stopped early
+}
+
+type options struct {
+	showToken bool
+	dataBytes int // Leading chunk bytes shown in hex
+}
+
+// ============================================
+// Requests
+// ============================================
+
+// decodeRequests splits a client-to-server stream into frames. It stops at
+// the first frame the server would also reject or that runs past the data.
+func decodeRequests(data []byte, opts options) []message {
+	var msgs []message
+	for offset := 0; offset < len(data); {
+		msg, err := decodeRequest(data[offset:], opts)
+		msg.Offset = offset
+		if err != nil {
+			msg.Err = err
+			msgs = append(msgs, msg)
+			break
+		}
+		msgs = append(msgs, msg)
+		offset += msg.Length
+	}
+	return msgs
+}
+
+func decodeRequest(data []byte, opts options) (message, error) {
+	r := &cursor{buf: data}
+
+	tokenSize, err := r.uint32()
+	if err != nil {
+		return message{}, fmt.Errorf("frame header: %w", err)
+	}
+	if tokenSize > protocol.MAX_TOKEN_SIZE {
+		return message{}, fmt.Errorf("token size %d exceeds %d (misframed stream?)", tokenSize, protocol.MAX_TOKEN_SIZE)
+	}
+	token, err := r.bytes(int(tokenSize))
+	if err != nil {
+		return message{}, fmt.Errorf("token: %w", err)
+	}
+	payloadSize, err := r.uint32()
+	if err != nil {
+		return message{}, fmt.Errorf("payload size: %w", err)
+	}
+	if payloadSize == 0 {
+		return message{}, errors.New("empty payload")
+	}
+	if int(payloadSize) > r.remaining() {
+		return message{}, fmt.Errorf("payload of %d bytes, only %d captured: %w", payloadSize, r.remaining(), errTruncated)
+	}
+	payload, _ := r.bytes(int(payloadSize))
+
+	cmd := payload[0]
+	name, ok := protocol.CommandNames[cmd]
+	if !ok {
+		name = fmt.Sprintf("UNKNOWN(0x%02x)", cmd)
+	}
+
+	fields := []string{name, "token=" + formatToken(token, opts.showToken)}
+	body := payload[1:]
+	command := protocol.NewCommand(cmd)
+	if command == nil {
+		fields = append(fields, fmt.Sprintf("body=%d bytes", len(body)))
+		return message{Length: r.pos, Text: strings.Join(fields, " ")}, nil
+	}
+	n, err := protocol.Decode(command, body)
+	if err != nil {
+		fields = append(fields, "malformed body: "+err.Error())
+		return message{Length: r.pos, Text: strings.Join(fields, " ")}, nil
+	}
+
+	switch command := command.(type) {
+	case *protocol.InitUpload:
+		fields = append(fields, fmt.Sprintf("file=%q total_chunks=%d chunk_size=%d", command.FileName, command.TotalChunks, command.ChunkSize))
+		fields = appendOffer(fields, command.Compression)
+	case *protocol.InitUploadVerified:
+		fields = append(fields, fmt.Sprintf("file=%q total_chunks=%d chunk_size=%d sha256=%s", command.FileName, command.TotalChunks, command.ChunkSize, command.SHA256))
+		fields = appendOffer(fields, command.Compression)
+	case *protocol.UploadChunk:
+		fields = append(fields, fmt.Sprintf("session=%s index=%d size=%d", command.SessionID, command.ChunkIndex, len(command.ChunkData)))
+		if opts.dataBytes > 0 {
+			fields = append(fields, "data="+hexPreview(command.ChunkData, opts.dataBytes))
+		}
+	case *protocol.PauseUpload:
+		fields = append(fields, "session="+command.SessionID)
+	case *protocol.ResumeUpload:
+		fields = append(fields, "session="+command.SessionID)
+		fields = appendOffer(fields, command.Compression)
+	case *protocol.CancelUpload:
+		fields = append(fields, "session="+command.SessionID)
+	case *protocol.GetStatus:
+		fields = append(fields, "session="+command.SessionID)
+	}
+	if trailing := len(body) - n; trailing > 0 {
+		fields = append(fields, fmt.Sprintf("MISMATCH: %d trailing bytes in payload", trailing))
+	}
+
+	return message{Length: r.pos, Text: strings.Join(fields, " ")}, nil
+}
+
+// ============================================
+// Responses
+// ============================================
+
+// decodeResponses splits a server-to-client stream. Responses have no length
+// prefix, so decoding cannot continue past an unknown code.
+func decodeResponses(data []byte) []message {
+	var msgs []message
+	for offset := 0; offset < len(data); {
+		msg, err := decodeResponse(data[offset:])
+		msg.Offset = offset
+		if err != nil {
+			msg.Err = err
+			msgs = append(msgs, msg)
+			break
+		}
+		msgs = append(msgs, msg)
+		offset += msg.Length
+	}
+	return msgs
+}
+
+func decodeResponse(data []byte) (message, error) {
+	code := data[0]
+	resp := protocol.NewResponse(code)
+	if resp == nil {
+		return message{}, fmt.Errorf("unknown response code 0x%02x", code)
+	}
+	name := protocol.ResponseNames[code]
+	n, err := protocol.Decode(resp, data[1:])
+	if err != nil {
+		return message{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var text string
+	switch resp := resp.(type) {
+	case *protocol.ErrorResp:
+		text = fmt.Sprintf("%q", resp.Message)
+	case *protocol.ReadyResp:
+		text = fmt.Sprintf("session=%s s3_key=%s", resp.SessionID, resp.S3Key)
+	case *protocol.ChunkAckResp:
+		eta := "unknown"
+		if resp.ETASeconds != protocol.ETA_UNKNOWN {
+			eta = fmt.Sprintf("%ds", resp.ETASeconds)
+		}
+		text = fmt.Sprintf("index=%d progress=%d/%d rate=%dB/s eta=%s",
+			resp.ChunkIndex, resp.Received, resp.Total, resp.BytesPerSec, eta)
+	case *protocol.DuplicateResp:
+		text = fmt.Sprintf("index=%d received=%d", resp.ChunkIndex, resp.Received)
+	case *protocol.CompleteResp:
+		text = fmt.Sprintf("s3_key=%s size=%d", resp.S3Key, resp.FileSize)
+	case *protocol.StatusResp:
+		text = fmt.Sprintf("state=%s progress=%d/%d", resp.State, resp.Received, resp.Total)
+	case *protocol.PausedResp:
+		text = fmt.Sprintf("progress=%d/%d", resp.Received, resp.Total)
+	case *protocol.ResumedResp:
+		text = fmt.Sprintf("progress=%d/%d missing=%s", resp.Received, resp.Total, formatMissing(resp.Missing))
+	case *protocol.ReadyCompressedResp:
+		text = fmt.Sprintf("session=%s s3_key=%s compression=%s", resp.SessionID, resp.S3Key, compression.Name(resp.Compression))
+	case *protocol.ResumedCompressedResp:
+		text = fmt.Sprintf("progress=%d/%d missing=%s compression=%s", resp.Received, resp.Total, formatMissing(resp.Missing), compression.Name(resp.Compression))
+	case *protocol.HashMismatchResp:
+		text = fmt.Sprintf("declared=%s sha256=%s", resp.Declared, resp.SHA256)
+	case *protocol.RateLimitedResp:
+		text = fmt.Sprintf("retry_after=%dms", resp.RetryAfterMS)
+	}
+
+	return message{Length: 1 + n, Text: strings.TrimSpace(name + " " + text)}, nil
+}
+
+// ============================================
+// Helpers
+// ============================================
+
+type cursor struct {
+	buf []byte
+	pos int
+}
+
+func (c *cursor) remaining() int {
+	return len(c.buf) - c.pos
+}
+
+func (c *cursor) bytes(n int) ([]byte, error) {
+	if n > c.remaining() {
+		return nil, errTruncated
+	}
+	b := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return b, nil
+}
+
+func (c *cursor) uint32() (uint32, error) {
+	b, err := c.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func formatToken(token []byte, show bool) string {
+	if show || len(token) == 0 {
+		return fmt.Sprintf("%q", token)
+	}
+	if len(token) <= 8 {
+		return fmt.Sprintf("<%d bytes>", len(token))
+	}
+	return fmt.Sprintf("%s...%s<%d bytes>", token[:4], token[len(token)-4:], len(token))
+}
+
+// appendOffer shows the codecs a command offers, if any.
+func appendOffer(fields []string, offered uint8) []string {
+	if offered == 0 {
+		return fields
+	}
+	var names []string
+	for bit := uint8(1); bit != 0; bit <<= 1 {
+		if offered&bit != 0 {
+			names = append(names, compression.Name(bit))
+		}
+	}
+	return append(fields, "compression="+strings.Join(names, ","))
+}
+
+func formatMissing(missing []uint32) string {
+	indexes := make([]string, 0, min(len(missing), 16))
+	for _, index := range missing[:min(len(missing), 16)] {
+		indexes = append(indexes, fmt.Sprint(index))
+	}
+	if len(missing) > 16 {
+		indexes = append(indexes, "...")
+	}
+	return fmt.Sprintf("%d [%s]", len(missing), strings.Join(indexes, " "))
+}
+
+func hexPreview(data []byte, n int) string {
+	s := fmt.Sprintf("% x", data[:min(n, len(data))])
+	if len(data) > n {
+		s += " ..."
+	}
+	return "[" + s + "]"
+}
@@ -0,0 +1,135 @@
+// protodump - Decodes captured binary protocol traffic
+//
+//	tcpdump -i any -w upload.pcap 'tcp port 9090'
+//	go run ./cmd/protodump -pcap upload.pcap -port 9090
+//
+//	go run ./cmd/protodump -requests client.bin -responses server.bin
+//
+// Every frame is printed with its direction and byte offset in the stream, so
+// a framing bug shows up as the exact offset where decoding goes wrong. Raw
+// mode reads the bytes one side wrote (e.g. a client's debug dump); requests
+// and responses are then paired in order.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+type entry struct {
+	Time   time.Time
+	Dir    string
+	Msg    message
+	Stream int // Tie-breaker: requests before their responses
+}
+
+func main() {
+	pcapPath := flag.String("pcap", "", "classic pcap capture to decode")
+	port := flag.Uint("port", 9090, "server port identifying the binary protocol in the capture")
+	requestsPath := flag.String("requests", "", "raw client-to-server bytes")
+	responsesPath := flag.String("responses", "", "raw server-to-client bytes")
+	showToken := flag.Bool("show-token", false, "print auth tokens in full")
+	dataBytes := flag.Int("data", 16, "leading chunk data bytes to show in hex (0 to hide)")
+	flag.Parse()
+
+	opts := options{showToken: *showToken, dataBytes: *dataBytes}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	switch {
+	case *pcapPath != "":
+		f, err := os.Open(*pcapPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		packets, err := readPcap(bufio.NewReaderSize(f, 1<<20))
+		if err != nil {
+			// Keep what was read before a truncated record
+			log.Printf("warning: %v", err)
+		}
+		conns := reassemble(packets, uint16(*port))
+		if len(conns) == 0 {
+			log.Fatalf("no TCP traffic on port %d in %s", *port, *pcapPath)
+		}
+		for _, c := range conns {
+			dumpConn(out, c, opts)
+		}
+
+	case *requestsPath != "" || *responsesPath != "":
+		var requests, responses []message
+		if *requestsPath != "" {
+			requests = decodeRequests(readFile(*requestsPath), opts)
+		}
+		if *responsesPath != "" {
+			responses = decodeResponses(readFile(*responsesPath))
+		}
+		for i := 0; i < max(len(requests), len(responses)); i++ {
+			if i < len(requests) {
+				printMessage(out, "", "C>S", requests[i])
+			}
+			if i < len(responses) {
+				printMessage(out, "", "S>C", responses[i])
+			}
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func dumpConn(w io.Writer, c *conn, opts options) {
+	fmt.Fprintf(w, "== %s -> %s  (%d bytes sent, %d bytes received)\n",
+		c.Client, c.Server, len(c.Requests.Data), len(c.Replies.Data))
+
+	var entries []entry
+	for _, msg := range decodeRequests(c.Requests.Data, opts) {
+		entries = append(entries, entry{Time: c.Requests.timeAt(msg.Offset), Dir: "C>S", Msg: msg, Stream: 0})
+	}
+	for _, msg := range decodeResponses(c.Replies.Data) {
+		entries = append(entries, entry{Time: c.Replies.timeAt(msg.Offset), Dir: "S>C", Msg: msg, Stream: 1})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].Stream < entries[j].Stream
+	})
+
+	for _, e := range entries {
+		printMessage(w, fmt.Sprintf("%10.6f ", e.Time.Sub(c.Start).Seconds()), e.Dir, e.Msg)
+	}
+	for _, side := range []struct {
+		dir string
+		s   *stream
+	}{{"C>S", c.Requests}, {"S>C", c.Replies}} {
+		if side.s.Holes > 0 {
+			fmt.Fprintf(w, "           %s  capture has missing bytes after offset %d; later frames not decoded\n", side.dir, len(side.s.Data))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func printMessage(w io.Writer, prefix, dir string, msg message) {
+	if msg.Err != nil {
+		fmt.Fprintf(w, "%s%s @%-10d !! %v\n", prefix, dir, msg.Offset, msg.Err)
+		return
+	}
+	fmt.Fprintf(w, "%s%s @%-10d len=%-9d %s\n", prefix, dir, msg.Offset, msg.Length, msg.Text)
+}
+
+func readFile(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
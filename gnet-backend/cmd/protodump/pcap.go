@@ -0,0 +1,306 @@
+// pcap.go - Classic pcap reading and TCP stream reassembly
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Only the classic libpcap format is read (tcpdump -w writes it by default);
+// convert pcapng captures with `editcap -F pcap`. Reassembly is deliberately
+// simple: segments are placed by sequence number, retransmitted bytes are
+// ignored and holes are reported rather than guessed across.
+
+const (
+	LINKTYPE_NULL       = 0
+	LINKTYPE_ETHERNET   = 1
+	LINKTYPE_RAW        = 101
+	LINKTYPE_LINUX_SLL  = 113
+	LINKTYPE_IPV4       = 228
+	LINKTYPE_IPV6       = 229
+	LINKTYPE_LINUX_SLL2 = 276
+
+	MAX_SNAPLEN = 256 * 1024 * 1024
+)
+
+type packet struct {
+	Time    time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Seq     uint32
+	SYN     bool
+	Payload []byte
+}
+
+func readPcap(r io.Reader) ([]packet, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("pcap header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	nanos := false
+	switch magic := binary.LittleEndian.Uint32(header[0:4]); magic {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng is not supported; convert with `editcap -F pcap in.pcapng out.pcap`")
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic 0x%08x)", magic)
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0fffffff
+
+	var packets []packet
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return packets, fmt.Errorf("record header: %w", err)
+		}
+
+		sec := int64(order.Uint32(record[0:4]))
+		frac := int64(order.Uint32(record[4:8]))
+		if !nanos {
+			frac *= 1000
+		}
+		capLen := order.Uint32(record[8:12])
+		if capLen > MAX_SNAPLEN {
+			return packets, fmt.Errorf("record of %d bytes (corrupt capture?)", capLen)
+		}
+		data := make([]byte, capLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return packets, fmt.Errorf("record data: %w", err)
+		}
+
+		pkt, ok := parseFrame(linkType, data)
+		if !ok {
+			continue // Not TCP, or a link type we do not know
+		}
+		pkt.Time = time.Unix(sec, frac)
+		packets = append(packets, pkt)
+	}
+}
+
+// parseFrame strips the link layer and IP header down to the TCP segment.
+func parseFrame(linkType uint32, data []byte) (packet, bool) {
+	var ipData []byte
+	switch linkType {
+	case LINKTYPE_ETHERNET:
+		if len(data) < 14 {
+			return packet{}, false
+		}
+		etherType, rest := binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == 0x8100 && len(rest) >= 4 { // 802.1Q VLAN tags
+			etherType, rest = binary.BigEndian.Uint16(rest[2:4]), rest[4:]
+		}
+		ipData = rest
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return packet{}, false
+		}
+		ipData = data[16:]
+	case LINKTYPE_LINUX_SLL2:
+		if len(data) < 20 {
+			return packet{}, false
+		}
+		ipData = data[20:]
+	case LINKTYPE_NULL:
+		if len(data) < 4 {
+			return packet{}, false
+		}
+		ipData = data[4:]
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		ipData = data
+	default:
+		return packet{}, false
+	}
+	if len(ipData) < 1 {
+		return packet{}, false
+	}
+
+	var src, dst netip.Addr
+	var tcp []byte
+	switch ipData[0] >> 4 {
+	case 4:
+		if len(ipData) < 20 || ipData[9] != 6 {
+			return packet{}, false
+		}
+		ihl := int(ipData[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ipData[2:4]))
+		if total > len(ipData) || total == 0 {
+			total = len(ipData) // Truncated capture or TSO
+		}
+		if ihl < 20 || ihl > total {
+			return packet{}, false
+		}
+		src = netip.AddrFrom4([4]byte(ipData[12:16]))
+		dst = netip.AddrFrom4([4]byte(ipData[16:20]))
+		tcp = ipData[ihl:total]
+	case 6:
+		// Extension headers are not followed
+		if len(ipData) < 40 || ipData[6] != 6 {
+			return packet{}, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(ipData[4:6]))
+		if end > len(ipData) || end == 40 {
+			end = len(ipData)
+		}
+		src = netip.AddrFrom16([16]byte(ipData[8:24]))
+		dst = netip.AddrFrom16([16]byte(ipData[24:40]))
+		tcp = ipData[40:end]
+	default:
+		return packet{}, false
+	}
+
+	if len(tcp) < 20 {
+		return packet{}, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return packet{}, false
+	}
+	return packet{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:2])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:4])),
+		Seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		SYN:     tcp[13]&0x02 != 0,
+		Payload: tcp[dataOffset:],
+	}, true
+}
+
+// ============================================
+// Reassembly
+// ============================================
+
+// stream is one direction of a TCP connection.
+type stream struct {
+	Data  []byte
+	Holes int        // Missing byte ranges; decoding stops at the first
+	times []timeMark // Arrival time of the segment starting at each offset
+	base  uint32
+	init  bool
+	segs  []segment
+}
+
+type timeMark struct {
+	Offset int
+	Time   time.Time
+}
+
+type segment struct {
+	offset int64
+	time   time.Time
+	data   []byte
+}
+
+type conn struct {
+	Client   netip.AddrPort
+	Server   netip.AddrPort
+	Start    time.Time
+	Requests *stream
+	Replies  *stream
+}
+
+// reassemble groups packets into connections to or from port and rebuilds
+// both byte streams. Connections are returned in order of first packet.
+func reassemble(packets []packet, port uint16) []*conn {
+	conns := map[[2]netip.AddrPort]*conn{}
+	var order []*conn
+
+	for _, pkt := range packets {
+		var c2s bool
+		switch {
+		case pkt.Dst.Port() == port:
+			c2s = true
+		case pkt.Src.Port() == port:
+			c2s = false
+		default:
+			continue
+		}
+
+		key := [2]netip.AddrPort{pkt.Src, pkt.Dst}
+		if !c2s {
+			key = [2]netip.AddrPort{pkt.Dst, pkt.Src}
+		}
+		c, ok := conns[key]
+		if !ok {
+			c = &conn{Client: key[0], Server: key[1], Start: pkt.Time, Requests: &stream{}, Replies: &stream{}}
+			conns[key] = c
+			order = append(order, c)
+		}
+
+		s := c.Replies
+		if c2s {
+			s = c.Requests
+		}
+		s.add(pkt)
+	}
+
+	for _, c := range order {
+		c.Requests.finish()
+		c.Replies.finish()
+	}
+	return order
+}
+
+func (s *stream) add(pkt packet) {
+	seq := pkt.Seq
+	if pkt.SYN {
+		seq++ // SYN consumes one sequence number
+		s.base, s.init = seq, true
+		s.segs = s.segs[:0] // A reused port starts a new stream
+	}
+	if len(pkt.Payload) == 0 {
+		return
+	}
+	if !s.init {
+		// Capture started mid-connection; the first frame may be partial
+		s.base, s.init = seq, true
+	}
+	offset := int64(int32(seq - s.base))
+	if offset < 0 {
+		return
+	}
+	s.segs = append(s.segs, segment{offset: offset, time: pkt.Time, data: pkt.Payload})
+}
+
+func (s *stream) finish() {
+	sort.SliceStable(s.segs, func(i, j int) bool { return s.segs[i].offset < s.segs[j].offset })
+
+	for _, seg := range s.segs {
+		end := seg.offset + int64(len(seg.data))
+		have := int64(len(s.Data))
+		switch {
+		case end <= have:
+			continue // Retransmission
+		case seg.offset > have:
+			// Bytes never captured; keep what follows only for the count
+			s.Holes++
+			return
+		}
+		s.times = append(s.times, timeMark{Offset: int(have), Time: seg.time})
+		s.Data = append(s.Data, seg.data[have-seg.offset:]...)
+	}
+	s.segs = nil
+}
+
+// timeAt is when the byte at offset arrived.
+func (s *stream) timeAt(offset int) time.Time {
+	i := sort.Search(len(s.times), func(i int) bool { return s.times[i].Offset > offset })
+	if i == 0 {
+		return time.Time{}
+	}
+	return s.times[i-1].Time
+}
@@ -0,0 +1,158 @@
+// golang.go - Go output: the protocol package and the gateway's constants
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+func generateGo(schema *Schema) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s\n\npackage protocol\n\n", HEADER)
+	b.WriteString("import \"encoding/binary\"\n\n")
+
+	writeGoConstants(&b, schema)
+	writeGoNames(&b, "CommandNames", schema.Commands)
+	writeGoNames(&b, "ResponseNames", schema.Responses)
+	writeGoConstructor(&b, "NewCommand", "command", schema.Commands)
+	writeGoConstructor(&b, "NewResponse", "response", schema.Responses)
+
+	for _, m := range schema.Commands {
+		writeGoMessage(&b, m)
+	}
+	for _, m := range schema.Responses {
+		writeGoMessage(&b, m)
+	}
+	return format.Source([]byte(b.String()))
+}
+
+// generateGateway writes only the codes: the gateway forwards frames and
+// reads nothing past the command byte.
+func generateGateway(schema *Schema) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s\n\npackage main\n\n", HEADER)
+	writeGoConstants(&b, schema)
+	writeGoNames(&b, "commandNames", schema.Commands)
+	return format.Source([]byte(b.String()))
+}
+
+func writeGoConstants(b *strings.Builder, schema *Schema) {
+	b.WriteString("const (\n")
+	for _, c := range schema.Constants {
+		fmt.Fprintf(b, "\t%s = %s%s\n", c.Name, c.Value, lineComment("//", c.Doc))
+	}
+	b.WriteString("\n\t// Commands\n")
+	for _, m := range schema.Commands {
+		fmt.Fprintf(b, "\t%s = %s%s\n", m.constName(), m.Code, lineComment("//", m.Doc))
+	}
+	b.WriteString("\n\t// Responses\n")
+	for _, m := range schema.Responses {
+		fmt.Fprintf(b, "\t%s = %s%s\n", m.constName(), m.Code, lineComment("//", m.Doc))
+	}
+	b.WriteString(")\n\n")
+}
+
+func writeGoNames(b *strings.Builder, name string, msgs []Message) {
+	fmt.Fprintf(b, "var %s = map[byte]string{\n", name)
+	for _, m := range msgs {
+		fmt.Fprintf(b, "\t%s: %q,\n", m.constName(), m.Name)
+	}
+	b.WriteString("}\n\n")
+}
+
+func writeGoConstructor(b *strings.Builder, name, kind string, msgs []Message) {
+	fmt.Fprintf(b, "// %s returns an empty %s for code, or nil if the code is unknown.\n", name, kind)
+	fmt.Fprintf(b, "func %s(code byte) Message {\n\tswitch code {\n", name)
+	for _, m := range msgs {
+		fmt.Fprintf(b, "\tcase %s:\n\t\treturn &%s{}\n", m.constName(), m.goType())
+	}
+	b.WriteString("\t}\n\treturn nil\n}\n\n")
+}
+
+func writeGoMessage(b *strings.Builder, m Message) {
+	typ := m.goType()
+
+	fmt.Fprintf(b, "// %s is the %s %s: %s.\n", typ, m.Name, m.kind(), lowerFirst(m.Doc))
+	if len(m.Fields) > 0 {
+		fmt.Fprintf(b, "//\n//\t%s\n", m.layout())
+	}
+	fmt.Fprintf(b, "type %s struct {\n", typ)
+	for _, f := range m.Fields {
+		fmt.Fprintf(b, "\t%s %s%s\n", goName(f.Name), fieldTypes[f.Type].goType, lineComment("//", f.Doc))
+	}
+	b.WriteString("}\n\n")
+
+	fmt.Fprintf(b, "func (m *%s) Code() byte { return %s }\n\n", typ, m.constName())
+
+	fixed := 0
+	var variable []string
+	var optional *Field
+	for _, f := range m.Fields {
+		if f.Optional {
+			optional = &f
+			continue
+		}
+		fixed += fieldTypes[f.Type].size
+		field := "m." + goName(f.Name)
+		switch f.Type {
+		case "string8":
+			variable = append(variable, fmt.Sprintf("min(len(%s), 0xFF)", field))
+		case "string16":
+			variable = append(variable, fmt.Sprintf("min(len(%s), 0xFFFF)", field))
+		case "bytes32":
+			variable = append(variable, fmt.Sprintf("len(%s)", field))
+		case "uint32list":
+			variable = append(variable, fmt.Sprintf("4*len(%s)", field))
+		}
+	}
+	size := strings.Join(append([]string{fmt.Sprint(fixed)}, variable...), " + ")
+	if optional != nil {
+		fmt.Fprintf(b, "func (m *%s) Size() int {\n\tsize := %s\n", typ, size)
+		fmt.Fprintf(b, "\tif m.%s != 0 {\n\t\tsize += %d\n\t}\n\treturn size\n}\n\n", goName(optional.Name), fieldTypes[optional.Type].size)
+	} else {
+		fmt.Fprintf(b, "func (m *%s) Size() int { return %s }\n\n", typ, size)
+	}
+
+	fmt.Fprintf(b, "func (m *%s) Append(b []byte) []byte {\n\tb = append(b, %s)\n", typ, m.constName())
+	for _, f := range m.Fields {
+		field := "m." + goName(f.Name)
+		indent := "\t"
+		if f.Optional {
+			fmt.Fprintf(b, "\tif %s != 0 {\n", field)
+			indent = "\t\t"
+		}
+		b.WriteString(indent)
+		switch f.Type {
+		case "uint8":
+			fmt.Fprintf(b, "b = append(b, %s)\n", field)
+		case "uint16", "uint32", "uint64":
+			fmt.Fprintf(b, "b = binary.BigEndian.Append%s(b, %s)\n", goName(f.Type), field)
+		case "string8", "string16", "bytes32":
+			fmt.Fprintf(b, "b = append%s(b, %s)\n", goName(f.Type), field)
+		case "uint32list":
+			fmt.Fprintf(b, "b = appendUint32List(b, %s)\n", field)
+		}
+		if f.Optional {
+			b.WriteString("\t}\n")
+		}
+	}
+	b.WriteString("\treturn b\n}\n\n")
+
+	if len(m.Fields) == 0 {
+		fmt.Fprintf(b, "func (m *%s) decodeFields(d *decoder) {}\n\n", typ)
+		return
+	}
+	fmt.Fprintf(b, "func (m *%s) decodeFields(d *decoder) {\n", typ)
+	for _, f := range m.Fields {
+		switch {
+		case f.Type == "uint32list":
+			fmt.Fprintf(b, "\tm.%s = d.uint32list(%q, m.%s)\n", goName(f.Name), f.Name, goName(f.Max))
+		case f.Optional:
+			fmt.Fprintf(b, "\tif d.more() {\n\t\tm.%s = d.%s(%q)\n\t}\n", goName(f.Name), f.Type, f.Name)
+		default:
+			fmt.Fprintf(b, "\tm.%s = d.%s(%q)\n", goName(f.Name), f.Type, f.Name)
+		}
+	}
+	b.WriteString("}\n\n")
+}
@@ -0,0 +1,242 @@
+// protogen - Generates the binary protocol codecs from protocol/protocol.json
+//
+//	go run ./cmd/protogen -schema protocol/protocol.json -go protocol/protocol_gen.go \
+//	    -gateway ../gateway/protocol_gen.go -ts ../web-client/src/protocol.gen.ts \
+//	    -py ../python-client/hpu_client/protocol_gen.py
+//
+// Normally run through `go generate ./protocol`. Each output is optional. The
+// Go package gets message types with encoders and decoders, the gateway only
+// the codes (it forwards frames without decoding them), TypeScript gets
+// command encoders and a response decoder, Python the codes.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const HEADER = "Code generated by protogen from protocol.json. DO NOT EDIT."
+
+type Schema struct {
+	Doc       string     `json:"doc"`
+	Constants []Constant `json:"constants"`
+	Commands  []Message  `json:"commands"`
+	Responses []Message  `json:"responses"`
+}
+
+type Constant struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Doc   string `json:"doc"`
+}
+
+type Message struct {
+	Name   string  `json:"name"`
+	Code   string  `json:"code"`
+	Doc    string  `json:"doc"`
+	Fields []Field `json:"fields"`
+
+	// Set by load
+	Prefix string // CMD_ or RESP_
+	Suffix string // Go type suffix
+}
+
+type Field struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Max      string `json:"max"`      // uint32list: earlier field bounding the count
+	Optional bool   `json:"optional"` // Sent only when not zero; see load
+	Doc      string `json:"doc"`
+}
+
+// fieldType describes one wire type. size is the fixed part, including the
+// length prefix of variable-size types.
+type fieldType struct {
+	size   int
+	prefix string // Length prefix in layout comments, "" for fixed-size types
+	goType string
+	tsType string
+}
+
+var fieldTypes = map[string]fieldType{
+	"uint8":      {size: 1, goType: "uint8", tsType: "number"},
+	"uint16":     {size: 2, goType: "uint16", tsType: "number"},
+	"uint32":     {size: 4, goType: "uint32", tsType: "number"},
+	"uint64":     {size: 8, goType: "uint64", tsType: "number"},
+	"string8":    {size: 1, prefix: "_size(1)", goType: "string", tsType: "string"},
+	"string16":   {size: 2, prefix: "_size(2)", goType: "string", tsType: "string"},
+	"bytes32":    {size: 4, prefix: "_size(4)", goType: "[]byte", tsType: "Uint8Array"},
+	"uint32list": {size: 4, prefix: "_count(4)", goType: "[]uint32", tsType: "number[]"},
+}
+
+func main() {
+	schemaPath := flag.String("schema", "protocol.json", "protocol schema")
+	goOut := flag.String("go", "", "Go package output")
+	gatewayOut := flag.String("gateway", "", "gateway constants output")
+	tsOut := flag.String("ts", "", "TypeScript output")
+	pyOut := flag.String("py", "", "Python output")
+	flag.Parse()
+
+	schema, err := load(*schemaPath)
+	if err != nil {
+		log.Fatalf("invalid schema %s: %v", *schemaPath, err)
+	}
+
+	outputs := []struct {
+		path     string
+		generate func(*Schema) ([]byte, error)
+	}{
+		{*goOut, generateGo},
+		{*gatewayOut, generateGateway},
+		{*tsOut, generateTS},
+		{*pyOut, generatePython},
+	}
+	for _, out := range outputs {
+		if out.path == "" {
+			continue
+		}
+		data, err := out.generate(schema)
+		if err != nil {
+			log.Fatalf("failed to generate %s: %v", out.path, err)
+		}
+		if err := os.WriteFile(out.path, data, 0o644); err != nil {
+			log.Fatalf("failed to write %s: %v", out.path, err)
+		}
+		fmt.Println("wrote", out.path)
+	}
+}
+
+// load reads and checks the schema: codes are unique bytes, field types are
+// known and list bounds name an earlier uint32 field. Only the last field of
+// a command may be optional, and only if it is a fixed-size integer: the
+// payload size says whether it was sent, and older peers that do not know it
+// ignore it. Responses have no size to tell, so none of their fields can be.
+func load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+
+	codes := make(map[uint64]string)
+	check := func(msgs []Message, prefix, suffix string) error {
+		for i := range msgs {
+			m := &msgs[i]
+			m.Prefix, m.Suffix = prefix, suffix
+			code, err := strconv.ParseUint(m.Code, 0, 8)
+			if err != nil {
+				return fmt.Errorf("%s: invalid code %q", m.Name, m.Code)
+			}
+			if other, ok := codes[code]; ok {
+				return fmt.Errorf("%s: code %s already used by %s", m.Name, m.Code, other)
+			}
+			codes[code] = m.Name
+
+			seen := make(map[string]string)
+			for i, f := range m.Fields {
+				if _, ok := fieldTypes[f.Type]; !ok {
+					return fmt.Errorf("%s.%s: unknown type %q", m.Name, f.Name, f.Type)
+				}
+				if f.Type == "uint32list" && seen[f.Max] != "uint32" {
+					return fmt.Errorf("%s.%s: max must name an earlier uint32 field", m.Name, f.Name)
+				}
+				if f.Optional && (prefix != "CMD_" || i != len(m.Fields)-1 || fieldTypes[f.Type].prefix != "") {
+					return fmt.Errorf("%s.%s: only the last field of a command can be optional, and only an integer", m.Name, f.Name)
+				}
+				seen[f.Name] = f.Type
+			}
+		}
+		return nil
+	}
+	if err := check(schema.Commands, "CMD_", ""); err != nil {
+		return nil, err
+	}
+	if err := check(schema.Responses, "RESP_", "Resp"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// ============================================
+// Naming
+// ============================================
+
+var initialisms = map[string]string{"id": "ID", "ok": "OK", "eta": "ETA", "sha256": "SHA256", "ms": "MS"}
+
+// goName turns INIT_UPLOAD or session_id into InitUpload or SessionID.
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(strings.ToLower(name), "_") {
+		if upper, ok := initialisms[word]; ok {
+			b.WriteString(upper)
+		} else if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// tsName turns session_id into sessionId.
+func tsName(name string) string {
+	words := strings.Split(strings.ToLower(name), "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+func (m Message) constName() string { return m.Prefix + m.Name }
+func (m Message) goType() string    { return goName(m.Name) + m.Suffix }
+func (m Message) tsType() string    { return goName(m.Name) + m.Suffix }
+
+func (m Message) kind() string {
+	if m.Prefix == "CMD_" {
+		return "command"
+	}
+	return "response"
+}
+
+// layout describes the fields as in the hand-written comments they replace:
+// session_id_size(2) | session_id | chunk_index(4)
+func (m Message) layout() string {
+	parts := make([]string, 0, len(m.Fields))
+	for _, f := range m.Fields {
+		ft := fieldTypes[f.Type]
+		switch {
+		case f.Optional:
+			parts = append(parts, fmt.Sprintf("[%s(%d)]", f.Name, ft.size))
+		case ft.prefix == "":
+			parts = append(parts, fmt.Sprintf("%s(%d)", f.Name, ft.size))
+		case f.Type == "uint32list":
+			parts = append(parts, f.Name+ft.prefix, f.Name+"(4 each)")
+		default:
+			parts = append(parts, f.Name+ft.prefix, f.Name)
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// lineComment renders doc as a trailing comment, or nothing.
+func lineComment(marker, doc string) string {
+	if doc == "" {
+		return ""
+	}
+	return " " + marker + " " + doc
+}
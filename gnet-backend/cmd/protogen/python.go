@@ -0,0 +1,45 @@
+// python.go - Python output: codes and names for the binary client
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func generatePython(schema *Schema) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", HEADER)
+	b.WriteString("\"\"\"Binary protocol codes, generated from gnet-backend/protocol/protocol.json.\"\"\"\n\n")
+
+	for _, c := range schema.Constants {
+		fmt.Fprintf(&b, "%s = %s%s\n", c.Name, c.Value, pyComment(c.Doc))
+	}
+	b.WriteString("\n")
+	for _, m := range schema.Commands {
+		fmt.Fprintf(&b, "%s = %s%s\n", m.constName(), m.Code, pyComment(m.Doc))
+	}
+	b.WriteString("\n")
+	for _, m := range schema.Responses {
+		fmt.Fprintf(&b, "%s = %s%s\n", m.constName(), m.Code, pyComment(m.Doc))
+	}
+
+	writePyNames(&b, "COMMAND_NAMES", schema.Commands)
+	writePyNames(&b, "RESPONSE_NAMES", schema.Responses)
+	return []byte(b.String()), nil
+}
+
+func writePyNames(b *strings.Builder, name string, msgs []Message) {
+	fmt.Fprintf(b, "\n%s = {\n", name)
+	for _, m := range msgs {
+		fmt.Fprintf(b, "    %s: %q,\n", m.constName(), m.Name)
+	}
+	b.WriteString("}\n")
+}
+
+// pyComment follows PEP 8: two spaces before an inline comment.
+func pyComment(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	return "  # " + doc
+}
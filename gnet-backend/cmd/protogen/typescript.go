@@ -0,0 +1,247 @@
+// typescript.go - TypeScript output: command encoders and a response decoder
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TS_RUNTIME is the fixed part of the TypeScript output. uint64 fields are
+// numbers, exact below 2^53 bytes.
+const TS_RUNTIME = `const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+class Truncated extends Error {}
+
+class Writer {
+  private parts: Uint8Array[] = [];
+  private length = 0;
+
+  private push(b: Uint8Array) {
+    this.parts.push(b);
+    this.length += b.length;
+  }
+
+  private fixed(size: number, set: (view: DataView) => void) {
+    const b = new Uint8Array(size);
+    set(new DataView(b.buffer));
+    this.push(b);
+  }
+
+  uint8(v: number) { this.fixed(1, (view) => view.setUint8(0, v)); }
+  uint16(v: number) { this.fixed(2, (view) => view.setUint16(0, v)); }
+  uint32(v: number) { this.fixed(4, (view) => view.setUint32(0, v)); }
+  uint64(v: number) { this.fixed(8, (view) => view.setBigUint64(0, BigInt(v))); }
+
+  // Strings longer than their size prefix allows are truncated
+  string8(s: string) {
+    const b = textEncoder.encode(s).subarray(0, 0xff);
+    this.uint8(b.length);
+    this.push(b);
+  }
+
+  string16(s: string) {
+    const b = textEncoder.encode(s).subarray(0, 0xffff);
+    this.uint16(b.length);
+    this.push(b);
+  }
+
+  bytes32(b: Uint8Array) {
+    this.uint32(b.length);
+    this.push(b);
+  }
+
+  uint32list(list: number[]) {
+    this.uint32(list.length);
+    for (const v of list) this.uint32(v);
+  }
+
+  bytes(): Uint8Array {
+    const out = new Uint8Array(this.length);
+    let offset = 0;
+    for (const part of this.parts) {
+      out.set(part, offset);
+      offset += part.length;
+    }
+    return out;
+  }
+}
+
+class Reader {
+  pos = 0;
+  private view: DataView;
+
+  constructor(private buf: Uint8Array) {
+    this.view = new DataView(buf.buffer, buf.byteOffset, buf.byteLength);
+  }
+
+  private next(n: number): number {
+    if (this.pos + n > this.buf.length) throw new Truncated();
+    const pos = this.pos;
+    this.pos += n;
+    return pos;
+  }
+
+  uint8(): number { return this.view.getUint8(this.next(1)); }
+  uint16(): number { return this.view.getUint16(this.next(2)); }
+  uint32(): number { return this.view.getUint32(this.next(4)); }
+  uint64(): number { return Number(this.view.getBigUint64(this.next(8))); }
+
+  bytes(n: number): Uint8Array {
+    const pos = this.next(n);
+    return this.buf.subarray(pos, pos + n);
+  }
+
+  string8(): string { return textDecoder.decode(this.bytes(this.uint8())); }
+  string16(): string { return textDecoder.decode(this.bytes(this.uint16())); }
+  bytes32(): Uint8Array { return this.bytes(this.uint32()); }
+
+  uint32list(field: string, max: number): number[] {
+    const count = this.uint32();
+    if (count > max) throw new Error(field + ": " + count + " entries exceed the limit of " + max);
+    const list = new Array<number>(count);
+    for (let i = 0; i < count; i++) list[i] = this.uint32();
+    return list;
+  }
+}
+
+/** encodeFrame wraps a command in the authenticated request frame. */
+export function encodeFrame(token: string, cmd: Command): Uint8Array {
+  // auth_token_size(4) | auth_token | payload_size(4) | payload
+  const w = new Writer();
+  w.bytes32(textEncoder.encode(token));
+  w.bytes32(encodeCommand(cmd));
+  return w.bytes();
+}
+`
+
+func generateTS(schema *Schema) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s\n//\n", HEADER)
+	for _, line := range wrap(schema.Doc, 76) {
+		fmt.Fprintf(&b, "// %s\n", line)
+	}
+	b.WriteString("\n")
+
+	for _, c := range schema.Constants {
+		fmt.Fprintf(&b, "export const %s = %s;%s\n", c.Name, c.Value, lineComment("//", c.Doc))
+	}
+	b.WriteString("\n// Commands\n")
+	for _, m := range schema.Commands {
+		fmt.Fprintf(&b, "export const %s = %s;%s\n", m.constName(), m.Code, lineComment("//", m.Doc))
+	}
+	b.WriteString("\n// Responses\n")
+	for _, m := range schema.Responses {
+		fmt.Fprintf(&b, "export const %s = %s;%s\n", m.constName(), m.Code, lineComment("//", m.Doc))
+	}
+	b.WriteString("\n")
+	writeTSNames(&b, "COMMAND_NAMES", schema.Commands)
+	writeTSNames(&b, "RESPONSE_NAMES", schema.Responses)
+
+	for _, m := range schema.Commands {
+		writeTSInterface(&b, m)
+	}
+	for _, m := range schema.Responses {
+		writeTSInterface(&b, m)
+	}
+	writeTSUnion(&b, "Command", schema.Commands)
+	writeTSUnion(&b, "Response", schema.Responses)
+
+	b.WriteString(TS_RUNTIME)
+
+	b.WriteString("\n/** encodeCommand returns the command code followed by its fields. */\n")
+	b.WriteString("export function encodeCommand(cmd: Command): Uint8Array {\n  const w = new Writer();\n  w.uint8(cmd.code);\n  switch (cmd.code) {\n")
+	for _, m := range schema.Commands {
+		if len(m.Fields) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "    case %s:\n", m.constName())
+		for _, f := range m.Fields {
+			if f.Optional {
+				fmt.Fprintf(&b, "      if (cmd.%[1]s) w.%[2]s(cmd.%[1]s);\n", tsName(f.Name), f.Type)
+			} else {
+				fmt.Fprintf(&b, "      w.%s(cmd.%s);\n", f.Type, tsName(f.Name))
+			}
+		}
+		b.WriteString("      break;\n")
+	}
+	b.WriteString("  }\n  return w.bytes();\n}\n")
+
+	b.WriteString("\n/**\n * decodeResponse decodes the response at the start of buf. It returns null if\n")
+	b.WriteString(" * buf ends inside the response, so callers can wait for more data, and throws\n")
+	b.WriteString(" * on an unknown code or malformed response.\n */\n")
+	b.WriteString("export function decodeResponse(buf: Uint8Array): { response: Response; length: number } | null {\n")
+	b.WriteString("  const r = new Reader(buf);\n  try {\n    const code = r.uint8();\n    let response: Response;\n    switch (code) {\n")
+	for _, m := range schema.Responses {
+		fmt.Fprintf(&b, "      case %s: {\n", m.constName())
+		for _, f := range m.Fields {
+			if f.Type == "uint32list" {
+				fmt.Fprintf(&b, "        const %s = r.uint32list(%q, %s);\n", tsName(f.Name), f.Name, tsName(f.Max))
+			} else {
+				fmt.Fprintf(&b, "        const %s = r.%s();\n", tsName(f.Name), f.Type)
+			}
+		}
+		fields := []string{"code: " + m.constName()}
+		for _, f := range m.Fields {
+			fields = append(fields, tsName(f.Name))
+		}
+		fmt.Fprintf(&b, "        response = { %s };\n        break;\n      }\n", strings.Join(fields, ", "))
+	}
+	b.WriteString("      default:\n        throw new Error(\"unknown response code 0x\" + code.toString(16).padStart(2, \"0\"));\n    }\n")
+	b.WriteString("    return { response, length: r.pos };\n  } catch (err) {\n    if (err instanceof Truncated) return null;\n    throw err;\n  }\n}\n")
+
+	return []byte(b.String()), nil
+}
+
+func writeTSNames(b *strings.Builder, name string, msgs []Message) {
+	fmt.Fprintf(b, "export const %s: Record<number, string> = {\n", name)
+	for _, m := range msgs {
+		fmt.Fprintf(b, "  [%s]: %q,\n", m.constName(), m.Name)
+	}
+	b.WriteString("};\n\n")
+}
+
+func writeTSInterface(b *strings.Builder, m Message) {
+	fmt.Fprintf(b, "/** %s %s: %s. */\n", m.Name, m.kind(), lowerFirst(m.Doc))
+	fmt.Fprintf(b, "export interface %s {\n  code: typeof %s;\n", m.tsType(), m.constName())
+	for _, f := range m.Fields {
+		optional := ""
+		if f.Optional {
+			optional = "?"
+		}
+		fmt.Fprintf(b, "  %s%s: %s;%s\n", tsName(f.Name), optional, fieldTypes[f.Type].tsType, lineComment("//", f.Doc))
+	}
+	b.WriteString("}\n\n")
+}
+
+func writeTSUnion(b *strings.Builder, name string, msgs []Message) {
+	fmt.Fprintf(b, "export type %s =\n", name)
+	for i, m := range msgs {
+		end := ""
+		if i == len(msgs)-1 {
+			end = ";"
+		}
+		fmt.Fprintf(b, "  | %s%s\n", m.tsType(), end)
+	}
+	b.WriteString("\n")
+}
+
+// wrap splits text into lines of at most width characters.
+func wrap(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,108 @@
+//go:build js && wasm
+
+// js.go - Blob reads, promises and option parsing
+package main
+
+import (
+	"errors"
+	"io"
+	"syscall/js"
+)
+
+// blobReader reads a File or Blob with slice().arrayBuffer(). It blocks on
+// the promise, so it must only be used off the JS event loop goroutine, as
+// the upload workers are.
+type blobReader struct {
+	blob js.Value
+}
+
+func (b blobReader) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(b.blob.Get("size").Float())
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), size)
+	buf, err := await(b.blob.Call("slice", off, end).Call("arrayBuffer"))
+	if err != nil {
+		return 0, err
+	}
+	n := js.CopyBytesToGo(p, js.Global().Get("Uint8Array").New(buf))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// await blocks until promise settles.
+func await(promise js.Value) (js.Value, error) {
+	done := make(chan struct{})
+	var result js.Value
+	var err error
+	onResult := js.FuncOf(func(this js.Value, args []js.Value) any {
+		result = args[0]
+		close(done)
+		return nil
+	})
+	onError := js.FuncOf(func(this js.Value, args []js.Value) any {
+		err = errors.New(args[0].Call("toString").String())
+		close(done)
+		return nil
+	})
+	defer onResult.Release()
+	defer onError.Release()
+
+	promise.Call("then", onResult, onError)
+	<-done
+	return result, err
+}
+
+func newPromise() (promise, resolve, reject js.Value) {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject = args[0], args[1]
+		return nil
+	})
+	defer executor.Release()
+	promise = js.Global().Get("Promise").New(executor)
+	return promise, resolve, reject
+}
+
+// async runs fn on its own goroutine, since it may wait on fetch, and returns
+// a promise of its outcome.
+func async(fn func() error) js.Value {
+	promise, resolve, reject := newPromise()
+	go func() {
+		if err := fn(); err != nil {
+			reject.Invoke(jsError(err))
+			return
+		}
+		resolve.Invoke(js.Undefined())
+	}()
+	return promise
+}
+
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
+
+func nullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func stringOption(options js.Value, name string) string {
+	v := options.Get(name)
+	if v.Type() != js.TypeString {
+		return ""
+	}
+	return v.String()
+}
+
+func intOption(options js.Value, name string, fallback int) int {
+	v := options.Get(name)
+	if v.Type() != js.TypeNumber {
+		return fallback
+	}
+	return v.Int()
+}
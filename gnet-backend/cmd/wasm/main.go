@@ -0,0 +1,275 @@
+//go:build js && wasm
+
+// wasm - The Go SDK's upload state machine for the browser
+//
+//	GOOS=js GOARCH=wasm go build -o hpu.wasm ./cmd/wasm
+//
+// Defines globalThis.hpu.upload(file, options), which runs client.Upload (or
+// ResumeUpload, given options.sessionId) over the HTTP chunk API, so chunking,
+// hashing, retries and the adaptive window are the same code as the native
+// SDK. The returned handle has done, pause(), resume() and cancel() like the
+// web client's Upload; web-client/src/wasm.ts loads it with its types.
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"backend/client"
+)
+
+func main() {
+	js.Global().Set("hpu", js.ValueOf(map[string]any{
+		"upload": js.FuncOf(startUpload),
+	}))
+	select {}
+}
+
+// ============================================
+// Clients
+// ============================================
+
+// One client per endpoint and token, so the throughput estimate behind
+// adaptive chunk sizes carries over from one upload to the next.
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[[2]string]*client.Client)
+)
+
+func clientFor(baseURL, token string, retries int) *client.Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	key := [2]string{baseURL, token}
+	if c, ok := clients[key]; ok {
+		return c.Clone()
+	}
+	var opts []client.Option
+	if retries >= 0 {
+		opts = append(opts, client.WithRetries(retries, client.DEFAULT_RETRY_BACKOFF))
+	}
+	c := client.NewHTTP(baseURL, token, opts...)
+	clients[key] = c
+	return c.Clone()
+}
+
+// ============================================
+// Uploads
+// ============================================
+
+type upload struct {
+	handle js.Value
+	client *client.Client
+	file   blobReader
+	size   int64
+	opts   client.UploadOptions
+
+	onSession  js.Value
+	onProgress js.Value
+	resolve    js.Value
+	reject     js.Value
+
+	mu        sync.Mutex
+	state     string
+	sessionID string
+	bytesSent int64
+	stop      context.CancelFunc
+	stopped   chan struct{} // Closed when the current run returns
+}
+
+// startUpload is hpu.upload(file, options).
+func startUpload(this js.Value, args []js.Value) any {
+	if len(args) < 2 || args[0].Type() != js.TypeObject || args[1].Type() != js.TypeObject {
+		panic("hpu.upload(file, options) needs a Blob and an options object")
+	}
+	file, options := args[0], args[1]
+
+	u := &upload{
+		handle:     js.Global().Get("Object").New(),
+		file:       blobReader{file},
+		size:       int64(file.Get("size").Float()),
+		onSession:  options.Get("onSession"),
+		onProgress: options.Get("onProgress"),
+		state:      "uploading",
+		sessionID:  stringOption(options, "sessionId"),
+	}
+	u.client = clientFor(stringOption(options, "baseUrl"), stringOption(options, "token"), intOption(options, "retries", -1))
+	u.opts = client.UploadOptions{
+		Name:        stringOption(options, "name"),
+		ChunkSize:   uint32(intOption(options, "chunkSize", 0)),
+		Parallelism: intOption(options, "concurrency", 4),
+		Adaptive:    options.Get("adaptive").Truthy(),
+		OnSession:   u.session,
+		OnChunk:     u.progress,
+	}
+	if u.opts.Name == "" {
+		u.opts.Name = stringOption(file, "name")
+	}
+	if u.opts.Name == "" {
+		u.opts.Name = "upload.bin"
+	}
+
+	done, resolve, reject := newPromise()
+	done.Call("catch", js.FuncOf(func(js.Value, []js.Value) any { return nil }))
+	u.resolve, u.reject = resolve, reject
+	u.handle.Set("done", done)
+	u.handle.Set("sessionId", nullable(u.sessionID))
+	u.handle.Set("state", u.state)
+	u.handle.Set("pause", js.FuncOf(func(js.Value, []js.Value) any { return async(u.pause) }))
+	u.handle.Set("resume", js.FuncOf(func(js.Value, []js.Value) any { return async(u.resume) }))
+	u.handle.Set("cancel", js.FuncOf(func(js.Value, []js.Value) any { return async(u.cancel) }))
+
+	u.mu.Lock()
+	u.start()
+	u.mu.Unlock()
+	return u.handle
+}
+
+// start runs the upload until it completes, fails or is stopped. Called with
+// u.mu held.
+func (u *upload) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	u.stop, u.stopped = cancel, stopped
+	sessionID, opts := u.sessionID, u.opts
+
+	go func() {
+		defer close(stopped)
+		var done *client.Completed
+		var err error
+		if sessionID == "" {
+			done, err = u.client.Upload(ctx, u.file, u.size, opts)
+		} else {
+			done, err = u.client.ResumeUpload(ctx, sessionID, u.file, u.size, opts)
+		}
+
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if ctx.Err() != nil {
+			return // Paused or cancelled
+		}
+		if err != nil {
+			u.setState("failed")
+			u.reject.Invoke(jsError(err))
+			return
+		}
+		u.setState("completed")
+		u.resolve.Invoke(map[string]any{
+			"sessionId": u.sessionID,
+			"s3Key":     done.S3Key,
+			"size":      float64(done.Size),
+		})
+	}()
+}
+
+// halt stops the current run and waits for it to return. Called with u.mu
+// held; releases it while waiting.
+func (u *upload) halt(state string) {
+	u.setState(state)
+	u.stop()
+	stopped := u.stopped
+	u.mu.Unlock()
+	<-stopped
+	u.mu.Lock()
+}
+
+// pause aborts the chunks in flight and pauses the server session.
+func (u *upload) pause() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state != "uploading" {
+		return nil
+	}
+	u.halt("paused")
+	if u.sessionID == "" {
+		return nil
+	}
+	_, err := u.client.Pause(context.Background(), u.sessionID)
+	return err
+}
+
+// resume continues with whatever chunks the server is still missing.
+func (u *upload) resume() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state != "paused" {
+		return nil
+	}
+	u.setState("uploading")
+	u.start()
+	return nil
+}
+
+func (u *upload) cancel() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state == "completed" || u.state == "cancelled" {
+		return nil
+	}
+	if u.state == "uploading" {
+		u.halt("cancelled")
+	}
+	u.setState("cancelled")
+	var err error
+	if u.sessionID != "" {
+		err = u.client.Cancel(context.Background(), u.sessionID)
+	}
+	u.reject.Invoke(jsError(errors.New("Upload was cancelled")))
+	return err
+}
+
+func (u *upload) setState(state string) {
+	u.state = state
+	u.handle.Set("state", state)
+}
+
+// session is UploadOptions.OnSession. The chunk size is kept so resume()
+// splits the file the same way when it was chosen adaptively.
+func (u *upload) session(s *client.Session) {
+	u.mu.Lock()
+	u.sessionID = s.ID
+	u.opts.ChunkSize = s.ChunkSize
+	u.handle.Set("sessionId", s.ID)
+	u.mu.Unlock()
+
+	if u.onSession.Type() == js.TypeFunction {
+		u.onSession.Invoke(s.ID)
+	}
+}
+
+// progress is UploadOptions.OnChunk, reported in the web client's Progress
+// shape.
+func (u *upload) progress(r *client.ChunkResult) {
+	u.mu.Lock()
+	chunkSize := int64(u.opts.ChunkSize)
+	if chunkSize == 0 {
+		chunkSize = client.DEFAULT_CHUNK_SIZE
+	}
+	u.bytesSent = min(u.bytesSent+min(chunkSize, u.size-int64(r.Index)*chunkSize), u.size)
+	totalChunks := (u.size + chunkSize - 1) / chunkSize
+	sessionID, bytesSent := u.sessionID, u.bytesSent
+	u.mu.Unlock()
+
+	if u.onProgress.Type() != js.TypeFunction {
+		return
+	}
+	state, received, eta := "uploading", float64(r.Progress.Received), any(nil)
+	if r.Complete != nil {
+		state, received = "completed", float64(totalChunks)
+	}
+	if r.ETA >= 0 {
+		eta = r.ETA.Round(time.Second).Seconds()
+	}
+	u.onProgress.Invoke(map[string]any{
+		"sessionId":      sessionID,
+		"received":       received,
+		"total":          float64(totalChunks),
+		"bytesSent":      float64(bytesSent),
+		"bytesTotal":     float64(u.size),
+		"bytesPerSecond": float64(r.BytesPerSec),
+		"etaSeconds":     eta,
+		"state":          state,
+	})
+}
@@ -0,0 +1,307 @@
+// comments.go - Threaded comments on files, for reviewing them
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Comments
+// ============================================
+
+// Uploaded cuts and documents get reviewed, and the review belongs with the
+// file rather than in someone's mail. Anyone who can read a file (its owner,
+// or a user granted access in acl.go) can comment on it, reply to a comment,
+// and pin a comment to a point in it: a position in a video or audio file,
+// or a page of a PDF.
+//
+//	POST   /files/comments        {"key", "body", ["parent_id"], ["timestamp_ms" | "page"]}
+//	GET    /files/comments?key=   the file's comments as threads, oldest first
+//	DELETE /files/comments/{id}   by its author, or anyone who can write the file
+//
+// A deleted comment keeps its place in its thread, without its body, so the
+// replies to it still make sense. GET /metadata returns a file's comments
+// with its record. Comments are kept in the metadata store (metadata.go) and
+// need METADATA_DB; a file's comments go with its record when it is purged.
+
+const (
+	COMMENT_MAX_BODY     = 4096
+	COMMENTS_MAX_PER_KEY = 1000
+)
+
+var (
+	errCommentNotFound = errors.New("Comment not found")
+	errTooManyComments = fmt.Errorf("At most %d comments per file", COMMENTS_MAX_PER_KEY)
+)
+
+type Comment struct {
+	ID          int64      `json:"id"`
+	Key         string     `json:"key"`
+	ParentID    *int64     `json:"parent_id,omitempty"`
+	Author      string     `json:"author"`
+	Body        string     `json:"body"`
+	TimestampMS *int64     `json:"timestamp_ms,omitempty"` // Position in a video or audio file
+	Page        *int       `json:"page,omitempty"`         // Page of a PDF, from 1
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Replies     []*Comment `json:"replies,omitempty"`
+}
+
+type CreateCommentRequest struct {
+	Key         string `json:"key"`
+	Body        string `json:"body"`
+	ParentID    *int64 `json:"parent_id"`
+	TimestampMS *int64 `json:"timestamp_ms"`
+	Page        *int   `json:"page"`
+}
+
+func (hs *HTTPServer) registerCommentRoutes() {
+	hs.mux.HandleFunc("POST /files/comments", hs.handleCreateComment)
+	hs.mux.HandleFunc("GET /files/comments", hs.handleListComments)
+	hs.mux.HandleFunc("DELETE /files/comments/{id}", hs.handleDeleteComment)
+}
+
+// validateAnchor checks that a comment's position, if any, suits a file of
+// contentType.
+func validateAnchor(req *CreateCommentRequest, contentType string) error {
+	switch {
+	case req.TimestampMS != nil && req.Page != nil:
+		return errors.New("Give timestamp_ms or page, not both")
+	case req.TimestampMS != nil:
+		if !strings.HasPrefix(contentType, "video/") && !strings.HasPrefix(contentType, "audio/") {
+			return errors.New("timestamp_ms is for video and audio files")
+		}
+		if *req.TimestampMS < 0 {
+			return errors.New("timestamp_ms must not be negative")
+		}
+	case req.Page != nil:
+		if contentType != "application/pdf" {
+			return errors.New("page is for PDF files")
+		}
+		if *req.Page < 1 {
+			return errors.New("page must be at least 1")
+		}
+	}
+	return nil
+}
+
+// threadComments nests comments, oldest first, under their parents.
+func threadComments(comments []Comment) []*Comment {
+	byID := make(map[int64]*Comment, len(comments))
+	for i := range comments {
+		byID[comments[i].ID] = &comments[i]
+	}
+	threads := make([]*Comment, 0)
+	for i := range comments {
+		comment := &comments[i]
+		if comment.ParentID != nil {
+			if parent, ok := byID[*comment.ParentID]; ok {
+				parent.Replies = append(parent.Replies, comment)
+				continue
+			}
+		}
+		threads = append(threads, comment)
+	}
+	return threads
+}
+
+// POST /files/comments
+func (hs *HTTPServer) handleCreateComment(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req CreateCommentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" || len(req.Body) > COMMENT_MAX_BODY {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("body must be 1 to %d bytes", COMMENT_MAX_BODY))
+		return
+	}
+	if !hs.authorize(w, r, tokenInfo.UserID, req.Key, ACCESS_READ) {
+		return
+	}
+
+	ctx := r.Context()
+	file, err := hs.uploads.metadata.GetFile(ctx, req.Key)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	if err := validateAnchor(&req, file.ContentType); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ParentID != nil {
+		parent, err := hs.uploads.metadata.GetComment(ctx, *req.ParentID)
+		if err == nil && parent.Key != req.Key {
+			err = errCommentNotFound
+		}
+		if !hs.writeMetadataError(w, r, err) {
+			return
+		}
+	}
+
+	comment := &Comment{
+		Key:         req.Key,
+		ParentID:    req.ParentID,
+		Author:      tokenInfo.UserID,
+		Body:        req.Body,
+		TimestampMS: req.TimestampMS,
+		Page:        req.Page,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.CreateComment(ctx, comment)) {
+		return
+	}
+	hs.uploads.activity.Record(ACTIVITY_COMMENT_ADDED, req.Key, tokenInfo.UserID, "")
+	httpLog.InfoContext(ctx, "added comment", "key", req.Key, "comment_id", comment.ID)
+	writeJSON(w, http.StatusCreated, comment)
+}
+
+// GET /files/comments?key=
+func (hs *HTTPServer) handleListComments(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_READ) {
+		return
+	}
+
+	comments, err := hs.uploads.metadata.ListComments(r.Context(), key)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "comments": threadComments(comments)})
+}
+
+// DELETE /files/comments/{id}
+func (hs *HTTPServer) handleDeleteComment(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid comment ID")
+		return
+	}
+	ctx := r.Context()
+	comment, err := hs.uploads.metadata.GetComment(ctx, id)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	// Others' comments take write access to the file
+	if comment.Author != tokenInfo.UserID && !hs.authorize(w, r, tokenInfo.UserID, comment.Key, ACCESS_WRITE) {
+		return
+	}
+
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.DeleteComment(ctx, id, time.Now().UTC())) {
+		return
+	}
+	httpLog.InfoContext(ctx, "deleted comment", "key", comment.Key, "comment_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) CreateComment(ctx context.Context, comment *Comment) error {
+	var count int
+	err := ms.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM comments WHERE s3_key = $1`, comment.Key).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= COMMENTS_MAX_PER_KEY {
+		return errTooManyComments
+	}
+
+	return ms.db.QueryRowContext(ctx, `
+		INSERT INTO comments (s3_key, parent_id, author, body, timestamp_ms, page, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		comment.Key, comment.ParentID, comment.Author, comment.Body, comment.TimestampMS, comment.Page, comment.CreatedAt).
+		Scan(&comment.ID)
+}
+
+func (ms *sqlMetadataStore) GetComment(ctx context.Context, id int64) (*Comment, error) {
+	comments, err := ms.queryComments(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(comments) == 0 {
+		return nil, errCommentNotFound
+	}
+	return &comments[0], nil
+}
+
+func (ms *sqlMetadataStore) ListComments(ctx context.Context, key string) ([]Comment, error) {
+	return ms.queryComments(ctx, `WHERE s3_key = $1`, key)
+}
+
+func (ms *sqlMetadataStore) queryComments(ctx context.Context, where string, arg interface{}) ([]Comment, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT id, s3_key, parent_id, author, body, timestamp_ms, page, created_at, deleted_at
+		FROM comments `+where+`
+		ORDER BY id`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]Comment, 0)
+	for rows.Next() {
+		var comment Comment
+		var parentID, timestampMS sql.NullInt64
+		var page sql.NullInt32
+		if err := rows.Scan(&comment.ID, &comment.Key, &parentID, &comment.Author, &comment.Body, &timestampMS, &page,
+			&comment.CreatedAt, &comment.DeletedAt); err != nil {
+			return nil, err
+		}
+		if parentID.Valid {
+			comment.ParentID = &parentID.Int64
+		}
+		if timestampMS.Valid {
+			comment.TimestampMS = &timestampMS.Int64
+		}
+		if page.Valid {
+			n := int(page.Int32)
+			comment.Page = &n
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+func (ms *sqlMetadataStore) DeleteComment(ctx context.Context, id int64, deletedAt time.Time) error {
+	// The body goes; the row stays for the replies
+	_, err := ms.db.ExecContext(ctx, `UPDATE comments SET body = '', deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, deletedAt, id)
+	return err
+}
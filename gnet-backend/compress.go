@@ -0,0 +1,100 @@
+// compress.go - Compressed chunks over the binary protocol
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"backend/compression"
+)
+
+// ============================================
+// Chunk Compression
+// ============================================
+
+// Documents, logs and raw images often shrink by half or more, which on a
+// slow uplink halves the upload. A client that can compress sets the bits of
+// the codecs it has in the compression field of INIT_UPLOAD (or
+// INIT_UPLOAD_VERIFIED); the server picks the first of UPLOAD_COMPRESSION
+// (comma-separated, default "zstd,lz4") among them and answers
+// READY_COMPRESSED with its choice instead of READY, with 0 when none fits.
+// Every UPLOAD_CHUNK of the session then carries its data compressed, as one
+// zstd frame or LZ4 block (backend/compression). A chunk worker decompresses
+// it into a buffer of the session's chunk size before anything else, so the
+// chunk hash, the preview spool, S3 and the file's SHA-256 all see the
+// original bytes; data that would decompress past the chunk size is refused.
+//
+// RESUME_UPLOAD negotiates again, since the client resuming may not be the
+// one that started: with an offer it is answered RESUMED_COMPRESSED, without
+// one RESUMED, and chunks go uncompressed from then on. Clients that send
+// neither field, and servers that predate it, see the protocol as it was.
+// Chunks past MAX_MEMORY_CHUNK_SIZE are received into files and never
+// compressed. The HTTP chunk API does not compress: its chunks are stored as
+// they arrive. UPLOAD_COMPRESSION=none turns compression off.
+
+var UPLOAD_COMPRESSION = envString("UPLOAD_COMPRESSION", "zstd,lz4")
+
+// uploadCodecs is UPLOAD_COMPRESSION parsed by main, in order of preference.
+var uploadCodecs []uint8
+
+var errCompressedTooLarge = errors.New("Compressed chunk too large")
+
+func parseCodecs(list string) ([]uint8, error) {
+	var codecs []uint8
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" || name == "none" {
+			continue
+		}
+		codec, ok := compression.Parse(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
+
+// chooseCompression picks the codec for a session's chunks from the bits a
+// client offered, or 0 for none.
+func chooseCompression(offered uint8, chunkSize uint32) uint8 {
+	if chunkSize > MAX_MEMORY_CHUNK_SIZE {
+		return 0
+	}
+	for _, codec := range uploadCodecs {
+		if offered&codec != 0 {
+			return codec
+		}
+	}
+	return 0
+}
+
+// decompressChunk returns the chunk in body decompressed with the session's
+// codec, in a buffer of its own that release frees, hashed for storeChunk.
+func (fus *FileUploadServer) decompressChunk(session *UploadSession, codec uint8, body chunkBody) (chunkBody, func(), error) {
+	compressed, ok := body.(*memoryChunk)
+	if !ok {
+		return nil, nil, errCompressedTooLarge
+	}
+	size := int(session.ChunkSize)
+	if !fus.chunkMemory.Reserve(size) {
+		return nil, nil, errServerBusy
+	}
+	buf := getChunkBuffer(size)
+	release := func() {
+		putChunkBuffer(buf)
+		fus.chunkMemory.Release(size)
+	}
+
+	data, err := compression.Decompress(codec, buf[:0:size], compressed.data)
+	if err != nil {
+		release()
+		if errors.Is(err, compression.ErrTooLarge) {
+			return nil, nil, errors.New("Chunk decompresses past the session's chunk size")
+		}
+		return nil, nil, fmt.Errorf("Failed to decompress chunk: %w", err)
+	}
+	compressedBytes.WithLabelValues(compression.Name(codec)).Add(float64(len(compressed.data)))
+	return newMemoryChunk(data, sha256.Sum256(data), compressed.receiveTime()), release, nil
+}
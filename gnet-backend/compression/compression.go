@@ -0,0 +1,119 @@
+// Package compression holds the chunk codecs a client and the file server
+// can agree on at INIT_UPLOAD (protocol.COMPRESSION_*). A compressed chunk
+// is one self-contained zstd frame or LZ4 block, so chunks stay independent:
+// any one can be sent again, or on another connection, and decoded alone.
+//
+// zstd compresses text and office documents about as well as gzip, several
+// times faster; LZ4 gives up some ratio to cost almost nothing on either
+// side, for clients with little CPU to spare. Neither helps media that is
+// already compressed, which is most of what is uploaded, so the SDK only
+// offers compression when asked to.
+package compression
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"backend/protocol"
+)
+
+// Supported has a bit for every codec this package implements.
+const Supported = protocol.COMPRESSION_ZSTD | protocol.COMPRESSION_LZ4
+
+var (
+	// ErrTooLarge is returned by Decompress when the data does not fit in
+	// dst's capacity.
+	ErrTooLarge = errors.New("decompressed data too large")
+	ErrCorrupt  = errors.New("corrupt compressed data")
+)
+
+// Name is codec's name in logs, metrics and UPLOAD_COMPRESSION.
+func Name(codec uint8) string {
+	switch codec {
+	case 0:
+		return "none"
+	case protocol.COMPRESSION_ZSTD:
+		return "zstd"
+	case protocol.COMPRESSION_LZ4:
+		return "lz4"
+	default:
+		return "unknown"
+	}
+}
+
+// Parse is the codec called name, or false if there is none.
+func Parse(name string) (uint8, bool) {
+	for _, codec := range []uint8{protocol.COMPRESSION_ZSTD, protocol.COMPRESSION_LZ4} {
+		if Name(codec) == name {
+			return codec, true
+		}
+	}
+	return 0, false
+}
+
+// Compress appends src compressed with codec to dst.
+func Compress(codec uint8, dst, src []byte) ([]byte, error) {
+	switch codec {
+	case protocol.COMPRESSION_ZSTD:
+		z, err := sharedZstd()
+		if err != nil {
+			return nil, err
+		}
+		return z.enc.EncodeAll(src, dst), nil
+	case protocol.COMPRESSION_LZ4:
+		if len(src) > LZ4_MAX_INPUT_SIZE {
+			return nil, errors.New("data too large for an LZ4 block")
+		}
+		return compressLZ4(dst, src), nil
+	default:
+		return nil, errors.New("unsupported compression")
+	}
+}
+
+// Decompress appends src decompressed with codec to dst. Its capacity is the
+// limit: data that decompresses to more than cap(dst)-len(dst) bytes fails
+// with ErrTooLarge, before more than that is written, so a small frame
+// cannot expand to exhaust memory.
+func Decompress(codec uint8, dst, src []byte) ([]byte, error) {
+	switch codec {
+	case protocol.COMPRESSION_ZSTD:
+		z, err := sharedZstd()
+		if err != nil {
+			return nil, err
+		}
+		out, err := z.dec.DecodeAll(src, dst)
+		switch {
+		case errors.Is(err, zstd.ErrDecoderSizeExceeded):
+			return nil, ErrTooLarge
+		case err != nil:
+			return nil, ErrCorrupt
+		}
+		return out, nil
+	case protocol.COMPRESSION_LZ4:
+		return decompressLZ4(dst, src)
+	default:
+		return nil, errors.New("unsupported compression")
+	}
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, and costly to create, so one of each is shared. They are
+// created on first use: most processes never compress anything.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+var sharedZstd = sync.OnceValues(func() (*zstdCodec, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCodec{enc: enc, dec: dec}, nil
+})
@@ -0,0 +1,179 @@
+// lz4.go - The LZ4 block format
+package compression
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// ============================================
+// LZ4 Blocks
+// ============================================
+
+// A chunk is one raw LZ4 block, as LZ4_compress_default writes it and
+// LZ4_decompress_safe reads it: a series of sequences, each a token byte
+// holding a literal length and a match length, the literals, then a 2-byte
+// little-endian offset back into the output and the match. The last
+// sequence has literals only. Lengths of 15 or more continue in extra bytes,
+// each 255 but the last. The frame format around blocks, with its checksums,
+// is left out: the protocol already carries sizes, and chunk hashes are
+// checked after decompression.
+//
+// The compressor is the reference one's fast greedy search: a hash of every
+// 4 bytes looked at remembers where they were last seen, and the search
+// skips ahead faster the longer it goes without a match, so incompressible
+// data passes through at memory speed.
+
+const (
+	LZ4_MAX_INPUT_SIZE = 0x7E000000
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // The block ends with at least this many literals
+	lz4MatchLimit   = 12 // No match starts in the last this many bytes
+	lz4MaxOffset    = 0xFFFF
+	lz4HashLog      = 16
+	lz4SkipTrigger  = 6 // Step grows by 1 every 2^6 bytes without a match
+)
+
+// Positions are stored plus one, so that zero is an empty slot
+var lz4Tables = sync.Pool{New: func() any { return new([1 << lz4HashLog]int32) }}
+
+func lz4Hash(seq uint32) uint32 {
+	return (seq * 2654435761) >> (32 - lz4HashLog)
+}
+
+func compressLZ4(dst, src []byte) []byte {
+	anchor := 0 // Start of the literals not yet written
+	if len(src) > lz4MatchLimit {
+		table := lz4Tables.Get().(*[1 << lz4HashLog]int32)
+		defer lz4Tables.Put(table)
+		clear(table[:])
+
+		last := len(src) - lz4MatchLimit
+		for i := 0; i < last; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := lz4Hash(seq)
+			cand := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if cand < 0 || i-cand > lz4MaxOffset || binary.LittleEndian.Uint32(src[cand:]) != seq {
+				i += 1 + (i-anchor)>>lz4SkipTrigger
+				continue
+			}
+
+			for i > anchor && cand > 0 && src[i-1] == src[cand-1] {
+				i--
+				cand--
+			}
+			end := i + lz4MinMatch
+			for end < len(src)-lz4LastLiterals && src[end] == src[cand+end-i] {
+				end++
+			}
+			dst = appendLZ4Sequence(dst, src[anchor:i], i-cand, end-i)
+			anchor, i = end, end
+		}
+	}
+	return appendLZ4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// appendLZ4Sequence appends literals and a match of length matchLen at
+// offset, or only the literals when matchLen is 0.
+func appendLZ4Sequence(dst, literals []byte, offset, matchLen int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if matchLen > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = appendLZ4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = appendLZ4Length(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func appendLZ4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// decompressLZ4 appends the block in src to dst, within dst's capacity.
+func decompressLZ4(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, ErrCorrupt
+		}
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, next, ok := readLZ4Length(src, i)
+			if !ok {
+				return nil, ErrCorrupt
+			}
+			literals, i = literals+n, next
+		}
+		if literals > len(src)-i {
+			return nil, ErrCorrupt
+		}
+		if literals > cap(dst)-len(dst) {
+			return nil, ErrTooLarge
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			return dst, nil // The last sequence has no match
+		}
+
+		if len(src)-i < 2 {
+			return nil, ErrCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst)-start {
+			return nil, ErrCorrupt
+		}
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			n, next, ok := readLZ4Length(src, i)
+			if !ok {
+				return nil, ErrCorrupt
+			}
+			matchLen, i = matchLen+n, next
+		}
+		matchLen += lz4MinMatch
+		if matchLen > cap(dst)-len(dst) {
+			return nil, ErrTooLarge
+		}
+
+		// A match may overlap its own output, repeating the last offset
+		// bytes; each copy doubles what is available to copy from
+		from := len(dst) - offset
+		for matchLen > 0 {
+			n := min(matchLen, len(dst)-from)
+			dst = append(dst, dst[from:from+n]...)
+			matchLen -= n
+		}
+	}
+}
+
+func readLZ4Length(src []byte, i int) (n, next int, ok bool) {
+	for i < len(src) {
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, true
+		}
+	}
+	return 0, 0, false
+}
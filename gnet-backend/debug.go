@@ -0,0 +1,213 @@
+// debug.go - Admin-only profiling and runtime debug endpoints
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Connection Registry
+// ============================================
+
+// ConnRegistry tracks open binary protocol connections for the debug dump.
+type ConnRegistry struct {
+	conns map[string]*ClientContext
+	mu    sync.RWMutex
+}
+
+type ConnInfo struct {
+	ConnID        string    `json:"conn_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	UserID        string    `json:"user_id,omitempty"`
+	SessionID     string    `json:"session_id,omitempty"`
+	BufferedBytes int       `json:"buffered_bytes"`
+	RecvBuffer    int       `json:"recv_buffer,omitempty"` // SO_RCVBUF, if not autotuned
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{
+		conns: make(map[string]*ClientContext),
+	}
+}
+
+func (cr *ConnRegistry) Add(ctx *ClientContext) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.conns[ctx.connID] = ctx
+}
+
+func (cr *ConnRegistry) Remove(connID string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.conns, connID)
+}
+
+func (cr *ConnRegistry) Snapshot() []ConnInfo {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	infos := make([]ConnInfo, 0, len(cr.conns))
+	for _, ctx := range cr.conns {
+		ctx.mu.Lock()
+		info := ConnInfo{
+			ConnID:        ctx.connID,
+			RemoteAddr:    ctx.remoteAddr,
+			ConnectedAt:   ctx.connectedAt,
+			UserID:        ctx.userID,
+			BufferedBytes: ctx.buffered,
+			RecvBuffer:    ctx.recvBuffer,
+		}
+		if ctx.session != nil {
+			info.SessionID = ctx.session.SessionID
+		}
+		ctx.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ============================================
+// Admin Authentication
+// ============================================
+
+// requireAdmin guards a handler with "Authorization: Bearer <ADMIN_TOKEN>".
+// When ADMIN_TOKEN is unset the endpoints do not exist at all.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ADMIN_TOKEN == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !isAdminRequest(r) {
+			authFailures.Inc()
+			auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+			writeJSONError(w, http.StatusUnauthorized, "Admin authentication required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdminRequest reports whether r carries ADMIN_TOKEN, for endpoints that
+// users and the admin share.
+func isAdminRequest(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ADMIN_TOKEN != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) == 1
+}
+
+// adminOrCaller returns the user r is about and who is asking: the admin
+// about adminUserID, or a user about themselves. It answers the request
+// itself if neither is asking.
+func (hs *HTTPServer) adminOrCaller(w http.ResponseWriter, r *http.Request, adminUserID string) (userID, requestedBy string, ok bool) {
+	if isAdminRequest(r) {
+		if adminUserID == "" || keyOwner(adminUserID+"/") != adminUserID {
+			writeJSONError(w, http.StatusBadRequest, "user_id is required")
+			return "", "", false
+		}
+		return adminUserID, "admin", true
+	}
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return "", "", false
+	}
+	return tokenInfo.UserID, tokenInfo.UserID, true
+}
+
+// ============================================
+// Debug Endpoints
+// ============================================
+
+func (hs *HTTPServer) registerDebugRoutes() {
+	// Block and mutex profiles are empty unless sampling is switched on
+	if rate := envInt("PPROF_BLOCK_RATE", 0); rate > 0 {
+		runtime.SetBlockProfileRate(rate)
+	}
+	if fraction := envInt("PPROF_MUTEX_FRACTION", 0); fraction > 0 {
+		runtime.SetMutexProfileFraction(fraction)
+	}
+
+	// pprof.Index also serves the named profiles (heap, goroutine, block, mutex, ...)
+	hs.mux.Handle("GET /debug/pprof/", requireAdmin(http.HandlerFunc(pprof.Index)))
+	hs.mux.Handle("GET /debug/pprof/cmdline", requireAdmin(http.HandlerFunc(pprof.Cmdline)))
+	hs.mux.Handle("GET /debug/pprof/profile", requireAdmin(http.HandlerFunc(pprof.Profile)))
+	hs.mux.Handle("GET /debug/pprof/symbol", requireAdmin(http.HandlerFunc(pprof.Symbol)))
+	hs.mux.Handle("GET /debug/pprof/trace", requireAdmin(http.HandlerFunc(pprof.Trace)))
+
+	hs.mux.Handle("GET /debug/goroutines", requireAdmin(http.HandlerFunc(handleGoroutineDump)))
+	hs.mux.Handle("GET /debug/connections", requireAdmin(http.HandlerFunc(hs.handleConnectionDump)))
+
+	hs.mux.Handle("GET /debug/log-level", requireAdmin(http.HandlerFunc(handleLogLevel)))
+	hs.mux.Handle("PUT /debug/log-level", requireAdmin(http.HandlerFunc(handleLogLevel)))
+}
+
+// GET /debug/goroutines
+// Full stack dump of every goroutine, as plain text.
+func handleGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+// GET /debug/connections
+// Open binary connections plus runtime counters useful when the event loop stalls.
+func (hs *HTTPServer) handleConnectionDump(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	conns := hs.conns.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"goroutines":       runtime.NumGoroutine(),
+		"heap_alloc":       mem.HeapAlloc,
+		"heap_inuse":       mem.HeapInuse,
+		"num_gc":           mem.NumGC,
+		"connection_count": len(conns),
+		"connections":      conns,
+	})
+}
+
+// GET /debug/log-level
+// PUT /debug/log-level  {"component": "chunk", "level": "debug"}
+// Lists or changes component log levels without a restart. An empty component
+// applies the level to every component.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			Component string `json:"component"`
+			Level     string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		if err := setLogLevel(req.Component, req.Level); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		serverLog.InfoContext(r.Context(), "log level changed", "target", req.Component, "level", req.Level)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelSnapshot())
+}
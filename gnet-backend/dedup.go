@@ -0,0 +1,161 @@
+// dedup.go - Instant upload of files the deployment already stores
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Instant Upload
+// ============================================
+
+// The same file is often uploaded many times: an installer, a stock video,
+// a document mailed round a team. A client can hash the whole file before
+// sending any of it and put the SHA-256 (hex) in POST /upload/init as
+// "sha256". If a file with that content is already stored, the upload is
+// completed there and then by copying it within S3 (as trash.go copies, so
+// the checksum is the stored file's), and the init answers "complete": true
+// with the file's key and size; there are no chunks to send. The copy is the
+// uploader's file like any other: it counts towards their quota, is recorded
+// with their attributes and none of the stored file's tags, and is a new
+// version of its path. Otherwise the upload goes ahead as usual.
+//
+// The content index is the sha256 column of the metadata database, so
+// instant uploads need METADATA_DB. The client's hash is only a claim: an
+// upload that declared one fails at finalize unless the assembled file
+// matches it (filehash.go), so only verified hashes are ever recorded and
+// matched. Uploads that declare no hash are not indexed.
+//
+// Knowing a file's hash is enough to get a copy of it, so matches are only
+// made within a tenant (the default tenant being one), and DEDUP=1 is needed
+// to enable it.
+
+var DEDUP_ENABLED = os.Getenv("DEDUP") == "1"
+
+var errInvalidFileHash = errors.New("sha256 must be 64 hex digits")
+
+// normalizeFileHash checks the whole-file hash of an init, if any, and
+// returns it in lower case.
+func normalizeFileHash(fileHash string) (string, error) {
+	if fileHash == "" {
+		return "", nil
+	}
+	if len(fileHash) != 2*sha256.Size {
+		return "", errInvalidFileHash
+	}
+	if _, err := hex.DecodeString(fileHash); err != nil {
+		return "", errInvalidFileHash
+	}
+	return strings.ToLower(fileHash), nil
+}
+
+// completeByCopy completes a new session by copying a stored file with its
+// FileHash, and reports whether it did. The declared size must fit the
+// stored file's.
+func (fus *FileUploadServer) completeByCopy(reqCtx context.Context, session *UploadSession) bool {
+	if !DEDUP_ENABLED {
+		return false
+	}
+	source, err := fus.metadata.FindContent(reqCtx, session.FileHash, fus.tenantOf(session.UserID))
+	if err != nil {
+		if !errors.Is(err, errFileNotRecorded) && !errors.Is(err, errMetadataDisabled) {
+			sessionLog.WarnContext(reqCtx, "content lookup failed", "session_id", session.SessionID, "err", err)
+		}
+		instantUploads.WithLabelValues("miss").Inc()
+		return false
+	}
+	// The last chunk may be short, but not empty
+	size := uint64(source.Size)
+	if size > session.TotalSize || size+uint64(session.ChunkSize) <= session.TotalSize {
+		sessionLog.InfoContext(reqCtx, "stored file does not fit the declared size", "session_id", session.SessionID,
+			"size_bytes", size, "declared_bytes", session.TotalSize)
+		instantUploads.WithLabelValues("miss").Inc()
+		return false
+	}
+
+	if _, err := fus.s3Client.copyObject(reqCtx, source.Key, session.S3Key); err != nil {
+		s3Log.WarnContext(reqCtx, "failed to copy stored file, uploading instead", "session_id", session.SessionID, "src", source.Key, "err", err)
+		instantUploads.WithLabelValues("miss").Inc()
+		return false
+	}
+	// The stored file's tags are its owner's
+	if err := fus.s3Client.mirrorTags(reqCtx, session.S3Key, nil); err != nil {
+		s3Log.WarnContext(reqCtx, "failed to clear copied object tags", "s3_key", session.S3Key, "err", err)
+	}
+
+	session.mu.Lock()
+	session.TotalSize = size
+	session.setState(STATE_COMPLETED)
+	session.UpdatedAt = time.Now()
+	session.save()
+	file := &FileRecord{
+		Key:         session.S3Key,
+		Owner:       session.UserID,
+		FileName:    session.FileName,
+		Size:        source.Size,
+		Checksum:    source.Checksum,
+		SHA256:      session.FileHash,
+		ContentType: session.ContentType,
+		CreatedAt:   session.CreatedAt.UTC(),
+		CompletedAt: time.Now().UTC(),
+		Attributes:  session.Attributes,
+	}
+	session.mu.Unlock()
+	fus.putFile(reqCtx, session, file)
+	fus.indexer.Enqueue(session.S3Key, session.ContentType)
+
+	instantUploads.WithLabelValues("hit").Inc()
+	instantUploadBytes.Add(float64(size))
+	fus.usage.RecordStored(session.UserID, size)
+	auditLog.Record(AUDIT_SESSION_COMPLETED, session.UserID, session.SessionID, "", session.S3Key)
+	fus.activity.Record(ACTIVITY_UPLOAD_COMPLETED, session.S3Key, session.UserID, "Instant: content already stored")
+	eventBus.Publish(EVENT_SESSION_COMPLETED, session, session.Preset.eventData(map[string]interface{}{
+		"size_bytes":   size,
+		"content_type": session.ContentType,
+		"instant":      true,
+	}))
+	fus.deliverPreset(reqCtx, session)
+	sessionLog.InfoContext(reqCtx, "upload completed by copy", "session_id", session.SessionID, "file", session.FileName,
+		"size_bytes", size, "s3_key", session.S3Key, "src", source.Key)
+	return true
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) FindContent(ctx context.Context, contentHash string, tenant *Tenant) (*FileRecord, error) {
+	// substr rather than LIKE, which would read '_' in a tenant ID as a
+	// wildcard. SQLite numbers $N parameters in order of appearance, so $2
+	// comes before $3
+	scope, prefix := `$2 <> substr(owner, 1, $3)`, TENANT_KEY_ROOT
+	if tenant != nil {
+		scope, prefix = `$2 = substr(owner, 1, $3)`, tenant.userPrefix()
+	}
+
+	file := &FileRecord{SHA256: contentHash}
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT s3_key, owner, file_name, version, size, checksum, content_type, created_at, completed_at
+		FROM files WHERE sha256 = $1 AND deleted_at IS NULL AND `+scope+`
+		ORDER BY completed_at DESC LIMIT 1`, contentHash, prefix, len(prefix)).
+		Scan(&file.Key, &file.Owner, &file.FileName, &file.Version, &file.Size, &file.Checksum, &file.ContentType, &file.CreatedAt, &file.CompletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errFileNotRecorded
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (ms *sqlMetadataStore) SetContentHash(ctx context.Context, key, contentHash string) error {
+	_, err := ms.db.ExecContext(ctx, `UPDATE files SET sha256 = $1 WHERE s3_key = $2`, contentHash, key)
+	return err
+}
@@ -0,0 +1,437 @@
+// drops.go - Links that let anyone upload into a user's folder
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Drop Links
+// ============================================
+
+// Shares (shares.go) hand a file out; a drop takes files in, from people
+// without an account. A user creates a drop link, limited in how long it
+// lasts, how large each file may be and how many files it takes, and
+// whoever has the link uploads with it, in chunks, as over the HTTP upload
+// API (upload_http.go):
+//
+//	POST   /files/drops    {["folder"], ["expires_in_seconds"], ["max_file_size"], ["max_files"], ["extensions"]}
+//	GET    /files/drops    the caller's drops, newest first
+//	DELETE /files/drops/{token}
+//
+//	GET  /drop/{token}                      the drop's limits, for the uploader's page
+//	POST /drop/{token}/init                 {"file_name", "total_chunks", "chunk_size"}
+//	POST /drop/{token}/chunk                multipart form, as POST /upload/chunk
+//	GET  /drop/{token}/status/{sessionID}
+//
+// The link is the only credential, so it is all the uploader gets: files
+// land under user_id/folder/timestamp/filename (folder defaults to "drop"),
+// count towards the owner's quota and are the owner's from then on; the
+// uploader cannot list, read or overwrite anything. Each init takes one of
+// max_files, whether or not its upload completes. A drop that expires or is
+// revoked stops taking chunks as well as inits. Drops are kept in the
+// metadata store (metadata.go) and need METADATA_DB.
+
+const DROP_DEFAULT_FOLDER = "drop"
+
+var (
+	DROP_DEFAULT_TTL = time.Duration(envInt("DROP_DEFAULT_TTL_HOURS", 7*24)) * time.Hour
+	DROP_MAX_TTL     = time.Duration(envInt("DROP_MAX_TTL_HOURS", 30*24)) * time.Hour
+)
+
+var (
+	errDropNotFound = errors.New("Drop not found")
+	errDropFull     = errors.New("Drop takes no more files")
+
+	dropFolderPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+)
+
+type Drop struct {
+	Token       string    `json:"token"`
+	URL         string    `json:"url"` // Relative to the API root
+	Owner       string    `json:"-"`
+	Folder      string    `json:"folder"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	MaxFileSize uint64    `json:"max_file_size,omitempty"` // 0 for the server's limit
+	MaxFiles    int       `json:"max_files,omitempty"`     // 0 for no limit
+	Files       int       `json:"files"`                   // Uploads started
+	Extensions  []string  `json:"extensions,omitempty"`    // Empty for any supported
+}
+
+type CreateDropRequest struct {
+	Folder           string   `json:"folder"`
+	ExpiresInSeconds int64    `json:"expires_in_seconds"`
+	MaxFileSize      uint64   `json:"max_file_size"`
+	MaxFiles         int      `json:"max_files"`
+	Extensions       []string `json:"extensions"`
+}
+
+type DropInitRequest struct {
+	FileName    string `json:"file_name"`
+	TotalChunks uint32 `json:"total_chunks"`
+	ChunkSize   uint32 `json:"chunk_size"`
+}
+
+func (hs *HTTPServer) registerDropRoutes() {
+	hs.mux.HandleFunc("POST /files/drops", hs.handleCreateDrop)
+	hs.mux.HandleFunc("GET /files/drops", hs.handleListDrops)
+	hs.mux.HandleFunc("DELETE /files/drops/{token}", hs.handleRevokeDrop)
+	hs.mux.HandleFunc("GET /drop/{token}", hs.handleGetDrop)
+	hs.mux.HandleFunc("POST /drop/{token}/init", hs.handleDropInit)
+	hs.mux.HandleFunc("POST /drop/{token}/chunk", hs.handleDropChunk)
+	hs.mux.HandleFunc("GET /drop/{token}/status/{sessionID}", hs.handleDropStatus)
+}
+
+// preset is the upload policy of the drop; its uploads are checked and
+// placed as presets' are (presets.go).
+func (d *Drop) preset() *UploadPreset {
+	return &UploadPreset{
+		Name:        "drop",
+		Extensions:  d.Extensions,
+		MaxFileSize: d.MaxFileSize,
+		Prefix:      d.Folder,
+	}
+}
+
+func dropURL(token string) string {
+	return "/drop/" + token
+}
+
+// POST /files/drops
+func (hs *HTTPServer) handleCreateDrop(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req CreateDropRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	folder := strings.Trim(req.Folder, "/")
+	if folder == "" {
+		folder = DROP_DEFAULT_FOLDER
+	}
+	if !dropFolderPattern.MatchString(folder) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid folder %q", req.Folder))
+		return
+	}
+	ttl := time.Duration(req.ExpiresInSeconds) * time.Second
+	if ttl == 0 {
+		ttl = DROP_DEFAULT_TTL
+	}
+	if ttl < 0 || ttl > DROP_MAX_TTL {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("expires_in_seconds must be between 1 and %d", int64(DROP_MAX_TTL.Seconds())))
+		return
+	}
+	if req.MaxFileSize > MAX_FILE_SIZE {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("max_file_size must be at most %d", MAX_FILE_SIZE))
+		return
+	}
+	if req.MaxFiles < 0 {
+		writeJSONError(w, http.StatusBadRequest, "max_files must not be negative")
+		return
+	}
+	if err := normalizeExtensions(req.Extensions); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now().UTC()
+	drop := &Drop{
+		Token:       hex.EncodeToString(b),
+		Owner:       tokenInfo.UserID,
+		Folder:      folder,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		MaxFileSize: req.MaxFileSize,
+		MaxFiles:    req.MaxFiles,
+		Extensions:  req.Extensions,
+	}
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.CreateDrop(r.Context(), drop)) {
+		return
+	}
+	auditLog.Record(AUDIT_DROP_CREATED, tokenInfo.UserID, "", r.RemoteAddr, folder)
+	httpLog.InfoContext(r.Context(), "created drop", "folder", folder, "expires_at", drop.ExpiresAt, "max_files", drop.MaxFiles)
+
+	drop.URL = dropURL(drop.Token)
+	writeJSON(w, http.StatusCreated, drop)
+}
+
+// GET /files/drops
+func (hs *HTTPServer) handleListDrops(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	drops, err := hs.uploads.metadata.ListDrops(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range drops {
+		drops[i].URL = dropURL(drops[i].Token)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"drops": drops})
+}
+
+// DELETE /files/drops/{token}
+func (hs *HTTPServer) handleRevokeDrop(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	token := r.PathValue("token")
+	err := hs.uploads.metadata.DeleteDrop(r.Context(), tokenInfo.UserID, token)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	auditLog.Record(AUDIT_DROP_REVOKED, tokenInfo.UserID, "", r.RemoteAddr, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openDrop looks up the drop of a /drop/ request and checks it is still
+// open. The answer for a wrong token is the same as for a revoked one.
+func (hs *HTTPServer) openDrop(w http.ResponseWriter, r *http.Request) (*Drop, bool) {
+	drop, err := hs.uploads.metadata.GetDrop(r.Context(), r.PathValue("token"))
+	if errors.Is(err, errDropNotFound) {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+	}
+	if !hs.writeMetadataError(w, r, err) {
+		return nil, false
+	}
+	if time.Now().After(drop.ExpiresAt) {
+		writeJSONError(w, http.StatusGone, "Drop has expired")
+		return nil, false
+	}
+	return drop, true
+}
+
+// GET /drop/{token}
+func (hs *HTTPServer) handleGetDrop(w http.ResponseWriter, r *http.Request) {
+	drop, ok := hs.openDrop(w, r)
+	if !ok {
+		return
+	}
+	remaining := -1 // No limit
+	if drop.MaxFiles > 0 {
+		remaining = max(drop.MaxFiles-drop.Files, 0)
+	}
+	// Not the owner or the folder: the uploader learns only what it needs
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"expires_at":      drop.ExpiresAt,
+		"max_file_size":   drop.preset().maxFileSize(),
+		"extensions":      drop.Extensions,
+		"files_remaining": remaining,
+	})
+}
+
+// POST /drop/{token}/init
+func (hs *HTTPServer) handleDropInit(w http.ResponseWriter, r *http.Request) {
+	drop, ok := hs.openDrop(w, r)
+	if !ok {
+		return
+	}
+	// A drop's uploader has no user of their own, so only the IP limits apply
+	if !hs.allowHTTP(w, r, RATE_INIT, "", 0) {
+		return
+	}
+
+	var req DropInitRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+
+	ctx := r.Context()
+	taken, err := hs.uploads.metadata.TakeDropFile(ctx, drop.Token)
+	if err == nil && !taken {
+		err = errDropFull
+	}
+	if errors.Is(err, errDropFull) {
+		writeJSONError(w, http.StatusGone, err.Error())
+		return
+	}
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+
+	// The owner's tenant limits and quota apply, as to their own uploads
+	session, err := hs.uploads.startUpload(ctx, hs.uploads.tenantOf(drop.Owner), drop.preset(), drop.Owner, "", req.FileName, req.TotalChunks, req.ChunkSize, "", nil)
+	if err != nil {
+		// A refused init does not use up the drop
+		if err := hs.uploads.metadata.ReturnDropFile(context.WithoutCancel(ctx), drop.Token); err != nil {
+			httpLog.WarnContext(ctx, "failed to return drop file", "err", err)
+		}
+		if errors.Is(err, errDraining) {
+			w.Header().Set("Retry-After", "5")
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Saved again, or a restart before the first chunk loses the drop token
+	session.mu.Lock()
+	session.Drop = drop.Token
+	session.save()
+	session.mu.Unlock()
+	httpLog.InfoContext(ctx, "started drop upload", "owner", drop.Owner, "session_id", session.SessionID, "remote", r.RemoteAddr)
+
+	writeJSON(w, http.StatusCreated, InitUploadResponse{
+		SessionID:   session.SessionID,
+		TotalChunks: session.TotalChunks,
+		ChunkSize:   session.ChunkSize,
+	})
+}
+
+// POST /drop/{token}/chunk
+func (hs *HTTPServer) handleDropChunk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	drop, ok := hs.openDrop(w, r)
+	if !ok {
+		return
+	}
+	hs.receiveChunk(w, r, start, nil, func(sessionID string) (*UploadSession, bool) {
+		return dropSession(w, drop, hs.sessionMgr.GetSession(sessionID))
+	})
+}
+
+// GET /drop/{token}/status/{sessionID}
+func (hs *HTTPServer) handleDropStatus(w http.ResponseWriter, r *http.Request) {
+	drop, ok := hs.openDrop(w, r)
+	if !ok {
+		return
+	}
+	session, ok := dropSession(w, drop, hs.sessionMgr.GetSession(r.PathValue("sessionID")))
+	if !ok {
+		return
+	}
+	status := uploadStatus(session)
+	status.S3Key = "" // The owner's, not the uploader's
+	writeJSON(w, http.StatusOK, status)
+}
+
+// dropSession checks that session was started through drop.
+func dropSession(w http.ResponseWriter, drop *Drop, session *UploadSession) (*UploadSession, bool) {
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, "Invalid session ID")
+		return nil, false
+	}
+	session.mu.Lock()
+	token := session.Drop
+	session.mu.Unlock()
+	if token != drop.Token {
+		writeJSONError(w, http.StatusNotFound, "Invalid session ID")
+		return nil, false
+	}
+	return session, true
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) CreateDrop(ctx context.Context, drop *Drop) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO drops (token, owner, folder, created_at, expires_at, max_file_size, max_files, files, extensions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $8)`,
+		drop.Token, drop.Owner, drop.Folder, drop.CreatedAt, drop.ExpiresAt, int64(drop.MaxFileSize), drop.MaxFiles,
+		strings.Join(drop.Extensions, ","))
+	return err
+}
+
+func (ms *sqlMetadataStore) GetDrop(ctx context.Context, token string) (*Drop, error) {
+	drops, err := ms.queryDrops(ctx, `WHERE token = $1`, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(drops) == 0 {
+		return nil, errDropNotFound
+	}
+	return &drops[0], nil
+}
+
+func (ms *sqlMetadataStore) ListDrops(ctx context.Context, owner string) ([]Drop, error) {
+	return ms.queryDrops(ctx, `WHERE owner = $1`, owner)
+}
+
+func (ms *sqlMetadataStore) queryDrops(ctx context.Context, where string, arg interface{}) ([]Drop, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT token, owner, folder, created_at, expires_at, max_file_size, max_files, files, extensions
+		FROM drops `+where+`
+		ORDER BY created_at DESC`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drops := make([]Drop, 0)
+	for rows.Next() {
+		var drop Drop
+		var maxFileSize int64
+		var extensions sql.NullString
+		if err := rows.Scan(&drop.Token, &drop.Owner, &drop.Folder, &drop.CreatedAt, &drop.ExpiresAt, &maxFileSize,
+			&drop.MaxFiles, &drop.Files, &extensions); err != nil {
+			return nil, err
+		}
+		drop.MaxFileSize = uint64(maxFileSize)
+		if extensions.String != "" {
+			drop.Extensions = strings.Split(extensions.String, ",")
+		}
+		drops = append(drops, drop)
+	}
+	return drops, rows.Err()
+}
+
+func (ms *sqlMetadataStore) TakeDropFile(ctx context.Context, token string) (bool, error) {
+	// One statement, so concurrent inits cannot both take the last file
+	result, err := ms.db.ExecContext(ctx, `
+		UPDATE drops SET files = files + 1
+		WHERE token = $1 AND (max_files = 0 OR files < max_files)`, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (ms *sqlMetadataStore) ReturnDropFile(ctx context.Context, token string) error {
+	_, err := ms.db.ExecContext(ctx, `UPDATE drops SET files = files - 1 WHERE token = $1 AND files > 0`, token)
+	return err
+}
+
+func (ms *sqlMetadataStore) DeleteDrop(ctx context.Context, owner, token string) error {
+	result, err := ms.db.ExecContext(ctx, `DELETE FROM drops WHERE token = $1 AND owner = $2`, token, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errDropNotFound
+	}
+	return nil
+}
@@ -0,0 +1,864 @@
+// erase.go - Erasing everything the server keeps about a user
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Erasure
+// ============================================
+
+// An erasure removes everything the server holds about a user, then checks
+// that nothing is left:
+//
+//	POST /admin/erasures        {"user_id", "operator", "reason"}
+//	GET  /admin/erasures        this server's erasures, newest first
+//	GET  /admin/erasures/{id}   one erasure, with its report when done
+//
+// It runs in the background, one per user at a time. In order, it revokes
+// the user's tokens and ends impersonations of them; cancels their sessions
+// and aborts their multipart uploads; deletes their objects, trash copies
+// and export manifests; deletes their metadata rows; forgets their usage;
+// and anonymizes their audit events, buffered and exported. Their comments
+// on others' files stay, deleted, and their name becomes "[erased]" there
+// and in others' activity feeds.
+//
+// Files under a legal hold (legalhold.go) or a running Object Lock
+// (immutable.go) are kept, with their records, and listed in the report.
+// The verification pass looks for objects, multipart uploads, rows,
+// sessions, tokens, usage and buffered audit events; the erasure is
+// "completed" if it finds none and nothing failed, otherwise "incomplete",
+// and running it again picks up what is left.
+//
+// The report is written to ERASURE_PREFIX/<id>.json in the upload bucket and
+// kept until deleted by hand. Copies exported to other buckets and server
+// logs are out of reach.
+
+const (
+	ERASURE_RUNNING    = "running"
+	ERASURE_COMPLETED  = "completed"
+	ERASURE_INCOMPLETE = "incomplete"
+
+	ERASED_USER          = "[erased]" // In place of the user's name where records are kept
+	ERASURE_MAX_EXPORTS  = 10000
+	ERASURE_LIST_MAX     = 20 // Objects and errors listed in a report at most
+	ERASURE_MAX_REASON   = 1024
+	ERASURE_BATCH_DELETE = 1000 // DeleteObjects takes at most 1000 keys per call
+)
+
+var ERASURE_PREFIX = envString("ERASURE_PREFIX", "_erasures") // Reports, outside every user's prefix
+
+var errErasureNotFound = errors.New("Erasure not found")
+
+type Erasure struct {
+	ID          string         `json:"id"`
+	UserID      string         `json:"user_id"`
+	Operator    string         `json:"operator"`
+	Reason      string         `json:"reason"`
+	State       string         `json:"state"`
+	StartedAt   time.Time      `json:"started_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+	Report      *ErasureReport `json:"report,omitempty"`
+}
+
+type CreateErasureRequest struct {
+	UserID   string `json:"user_id"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+// ErasureReport counts what an erasure removed and what it found left.
+type ErasureReport struct {
+	Tokens           int              `json:"tokens"`
+	Impersonations   int              `json:"impersonations"`
+	Sessions         int              `json:"sessions"`
+	MultipartUploads int              `json:"multipart_uploads"`
+	Objects          int              `json:"objects"`
+	Bytes            int64            `json:"bytes"`
+	TrashObjects     int              `json:"trash_objects"`
+	TrashBytes       int64            `json:"trash_bytes"`
+	ExportManifests  int              `json:"export_manifests"`
+	Rows             map[string]int64 `json:"rows"` // Metadata rows deleted or anonymized, by table
+	UsageDays        int              `json:"usage_days"`
+	AuditEvents      int              `json:"audit_events"`  // Buffered events anonymized
+	AuditExports     int              `json:"audit_exports"` // Exported audit objects rewritten
+	Retained         []RetainedFile   `json:"retained"`
+	Errors           []string         `json:"errors,omitempty"`
+	Verification     ErasureCheck     `json:"verification"`
+}
+
+// RetainedFile is a file an erasure had to keep.
+type RetainedFile struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"` // "legal_hold" or "immutable"
+}
+
+// ErasureCheck is what the verification pass found left of the user.
+type ErasureCheck struct {
+	Clean            bool             `json:"clean"`
+	Objects          int              `json:"objects"` // Not counting retained files
+	ObjectKeys       []string         `json:"object_keys,omitempty"`
+	MultipartUploads int              `json:"multipart_uploads"`
+	Rows             map[string]int64 `json:"rows"` // Only tables with rows left
+	Sessions         int              `json:"sessions"`
+	Tokens           int              `json:"tokens"`
+	Impersonations   int              `json:"impersonations"`
+	UsageDays        int              `json:"usage_days"`
+	AuditEvents      int              `json:"audit_events"`
+	CheckedAt        time.Time        `json:"checked_at"`
+}
+
+func (report *ErasureReport) fail(format string, args ...interface{}) {
+	if len(report.Errors) < ERASURE_LIST_MAX {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+func erasureKey(id string) string {
+	return path.Join(ERASURE_PREFIX, id+".json")
+}
+
+// Erasures holds this server's erasures, by ID.
+type Erasures struct {
+	byID map[string]*Erasure
+	mu   sync.Mutex
+}
+
+func NewErasures() *Erasures {
+	return &Erasures{byID: make(map[string]*Erasure)}
+}
+
+// start adds erasure, unless one of its user's is running.
+func (es *Erasures) start(erasure *Erasure) (*Erasure, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for _, other := range es.byID {
+		if other.UserID == erasure.UserID && other.State == ERASURE_RUNNING {
+			return other, false
+		}
+	}
+	es.byID[erasure.ID] = erasure
+	return erasure, true
+}
+
+func (es *Erasures) finish(erasure *Erasure, report *ErasureReport) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	now := time.Now().UTC()
+	erasure.CompletedAt = &now
+	erasure.Report = report
+	erasure.State = ERASURE_COMPLETED
+	if !report.Verification.Clean {
+		erasure.State = ERASURE_INCOMPLETE
+	}
+}
+
+func (es *Erasures) get(id string) (Erasure, bool) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	erasure, ok := es.byID[id]
+	if !ok {
+		return Erasure{}, false
+	}
+	return *erasure, true
+}
+
+// list returns the erasures, newest first, without their reports.
+func (es *Erasures) list() []Erasure {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	erasures := make([]Erasure, 0, len(es.byID))
+	for _, erasure := range es.byID {
+		listed := *erasure
+		listed.Report = nil
+		erasures = append(erasures, listed)
+	}
+	sort.Slice(erasures, func(i, j int) bool { return erasures[i].StartedAt.After(erasures[j].StartedAt) })
+	return erasures
+}
+
+func (hs *HTTPServer) registerErasureRoutes() {
+	hs.mux.Handle("POST /admin/erasures", requireAdmin(http.HandlerFunc(hs.handleCreateErasure)))
+	hs.mux.Handle("GET /admin/erasures", requireAdmin(http.HandlerFunc(hs.handleListErasures)))
+	hs.mux.Handle("GET /admin/erasures/{id}", requireAdmin(http.HandlerFunc(hs.handleGetErasure)))
+}
+
+// POST /admin/erasures
+func (hs *HTTPServer) handleCreateErasure(w http.ResponseWriter, r *http.Request) {
+	var req CreateErasureRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.UserID == "" || keyOwner(req.UserID+"/") != req.UserID {
+		writeJSONError(w, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if req.Operator == "" || len(req.Operator) > 256 {
+		writeJSONError(w, http.StatusBadRequest, "operator must be 1 to 256 bytes")
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > ERASURE_MAX_REASON {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reason must be 1 to %d bytes", ERASURE_MAX_REASON))
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	erasure, ok := hs.erasures.start(&Erasure{
+		ID:        hex.EncodeToString(id),
+		UserID:    req.UserID,
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		State:     ERASURE_RUNNING,
+		StartedAt: time.Now().UTC(),
+	})
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "An erasure of this user is already running: "+erasure.ID)
+		return
+	}
+	// Not the user's ID: the audit trail is anonymized along with the rest
+	auditLog.Record(AUDIT_ERASURE_STARTED, "", "", r.RemoteAddr, erasure.ID+" by "+erasure.Operator+": "+erasure.Reason)
+	httpLog.InfoContext(r.Context(), "started erasure", "erasure_id", erasure.ID, "operator", erasure.Operator)
+	writeJSON(w, http.StatusAccepted, erasure)
+
+	go hs.runErasure(context.WithoutCancel(r.Context()), erasure)
+}
+
+// GET /admin/erasures
+func (hs *HTTPServer) handleListErasures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"erasures": hs.erasures.list()})
+}
+
+// GET /admin/erasures/{id}
+func (hs *HTTPServer) handleGetErasure(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if erasure, ok := hs.erasures.get(id); ok {
+		writeJSON(w, http.StatusOK, erasure)
+		return
+	}
+
+	// One from before a restart, if it finished
+	s3Client := hs.uploads.s3Client
+	out, err := s3Client.client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(erasureKey(id)),
+	})
+	if isNotFound(err) {
+		writeJSONError(w, http.StatusNotFound, errErasureNotFound.Error())
+		return
+	}
+	if err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to read erasure report", "erasure_id", id, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read erasure report")
+		return
+	}
+	defer out.Body.Close()
+	var erasure Erasure
+	if err := json.NewDecoder(out.Body).Decode(&erasure); err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to decode erasure report", "erasure_id", id, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read erasure report")
+		return
+	}
+	writeJSON(w, http.StatusOK, erasure)
+}
+
+// ============================================
+// Erasure Job
+// ============================================
+
+// runErasure erases the user's data, verifies it is gone and records the
+// report. A step that fails is reported and the others still run.
+func (hs *HTTPServer) runErasure(ctx context.Context, erasure *Erasure) {
+	fus := hs.uploads
+	userID := erasure.UserID
+	prefix := userID + "/"
+	report := &ErasureReport{Rows: make(map[string]int64), Retained: make([]RetainedFile, 0)}
+
+	report.Tokens = hs.authMgr.revokeUser(userID)
+	report.Impersonations = hs.impersonations.endUser(userID)
+
+	for _, session := range hs.sessionMgr.Sessions() {
+		if session.UserID != userID {
+			continue
+		}
+		if err := hs.sessionMgr.dropSession(ctx, session); err != nil {
+			report.fail("abort session %s: %v", session.SessionID, err)
+		}
+		report.Sessions++
+	}
+	uploads, err := fus.s3Client.listMultipartUploads(ctx, prefix)
+	if err != nil {
+		report.fail("list multipart uploads: %v", err)
+	}
+	for _, upload := range uploads {
+		_, err := fus.s3Client.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(fus.s3Client.bucket),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil && !isNotFound(err) {
+			report.fail("abort multipart upload of %s: %v", aws.ToString(upload.Key), err)
+			continue
+		}
+		report.MultipartUploads++
+	}
+
+	retained := make(map[string]bool)
+	for _, trash := range []bool{false, true} {
+		listPrefix := prefix
+		if trash {
+			listPrefix = trashKey(prefix)
+		}
+		objects, err := fus.s3Client.listObjects(ctx, listPrefix)
+		if err != nil {
+			report.fail("list %s: %v", listPrefix, err)
+			continue
+		}
+		var erasable []types.Object
+		for _, obj := range objects {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), trashKey(""))
+			if reason, err := fus.retainReason(ctx, key); err != nil {
+				report.fail("check %s: %v", key, err)
+				continue
+			} else if reason != "" {
+				if !retained[key] {
+					report.Retained = append(report.Retained, RetainedFile{Key: key, Reason: reason})
+				}
+				retained[key] = true
+				continue
+			}
+			erasable = append(erasable, obj)
+		}
+		deleted, failed := fus.s3Client.deleteObjects(ctx, erasable)
+		for _, err := range failed {
+			report.fail("delete: %v", err)
+		}
+		for _, obj := range deleted {
+			if trash {
+				report.TrashObjects++
+				report.TrashBytes += aws.ToInt64(obj.Size)
+			} else {
+				report.Objects++
+				report.Bytes += aws.ToInt64(obj.Size)
+			}
+		}
+	}
+
+	exports, err := fus.metadata.ListExports(ctx, userID, ERASURE_MAX_EXPORTS)
+	if err != nil && !errors.Is(err, errMetadataDisabled) {
+		report.fail("list exports: %v", err)
+	}
+	for _, job := range exports {
+		if job.Mode != EXPORT_MANIFEST {
+			continue
+		}
+		if err := fus.s3Client.deleteObject(ctx, manifestKey(job.ID)); err != nil && !isNotFound(err) {
+			report.fail("delete manifest of export %s: %v", job.ID, err)
+			continue
+		}
+		report.ExportManifests++
+	}
+
+	rows, err := fus.metadata.EraseUser(ctx, userID, time.Now().UTC())
+	if err != nil && !errors.Is(err, errMetadataDisabled) {
+		report.fail("erase metadata: %v", err)
+	}
+	for table, n := range rows {
+		report.Rows[table] += n
+	}
+
+	report.UsageDays = fus.usage.forget(userID)
+	report.AuditEvents = auditLog.redact(userID)
+	report.AuditExports, err = fus.s3Client.redactAuditExports(ctx, userID)
+	if err != nil {
+		report.fail("anonymize audit exports: %v", err)
+	}
+
+	report.Verification = hs.checkErasure(ctx, userID, retained)
+	if len(report.Errors) > 0 {
+		report.Verification.Clean = false
+	}
+	hs.erasures.finish(erasure, report)
+
+	final, _ := hs.erasures.get(erasure.ID)
+	body, err := json.MarshalIndent(final, "", "  ")
+	if err == nil {
+		_, err = fus.s3Client.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(fus.s3Client.bucket),
+			Key:         aws.String(erasureKey(erasure.ID)),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+	}
+	if err != nil {
+		serverLog.ErrorContext(ctx, "failed to save erasure report", "erasure_id", erasure.ID, "err", err)
+	}
+
+	auditLog.Record(AUDIT_ERASURE_FINISHED, "", "", "", erasure.ID+" "+final.State)
+	serverLog.InfoContext(ctx, "erasure finished", "erasure_id", erasure.ID, "state", final.State,
+		"objects", report.Objects+report.TrashObjects, "bytes", report.Bytes+report.TrashBytes,
+		"retained", len(report.Retained), "errors", len(report.Errors))
+}
+
+// retainReason says why key must be kept, if it must.
+func (fus *FileUploadServer) retainReason(ctx context.Context, key string) (string, error) {
+	switch err := fus.checkLegalHold(ctx, key); {
+	case errors.Is(err, errLegalHold):
+		return "legal_hold", nil
+	case err != nil:
+		return "", err
+	}
+	switch err := fus.checkImmutable(ctx, key); {
+	case errors.Is(err, errImmutable):
+		return "immutable", nil
+	case err != nil:
+		return "", err
+	}
+	return "", nil
+}
+
+// checkErasure is the verification pass: it looks for what is left of the
+// user, retained files aside. What it finds in memory it also removes, so
+// that is gone too, but counted.
+func (hs *HTTPServer) checkErasure(ctx context.Context, userID string, retained map[string]bool) ErasureCheck {
+	fus := hs.uploads
+	prefix := userID + "/"
+	check := ErasureCheck{Rows: make(map[string]int64)}
+	failed := false
+
+	for _, listPrefix := range []string{prefix, trashKey(prefix)} {
+		objects, err := fus.s3Client.listObjects(ctx, listPrefix)
+		if err != nil {
+			failed = true
+			continue
+		}
+		for _, obj := range objects {
+			key := aws.ToString(obj.Key)
+			if retained[strings.TrimPrefix(key, trashKey(""))] {
+				continue
+			}
+			check.Objects++
+			if len(check.ObjectKeys) < ERASURE_LIST_MAX {
+				check.ObjectKeys = append(check.ObjectKeys, key)
+			}
+		}
+	}
+	uploads, err := fus.s3Client.listMultipartUploads(ctx, prefix)
+	failed = failed || err != nil
+	check.MultipartUploads = len(uploads)
+
+	rows, err := fus.metadata.UserDataRows(ctx, userID, time.Now().UTC())
+	failed = failed || (err != nil && !errors.Is(err, errMetadataDisabled))
+	for table, n := range rows {
+		if n > 0 {
+			check.Rows[table] = n
+		}
+	}
+
+	for _, session := range hs.sessionMgr.Sessions() {
+		if session.UserID == userID {
+			check.Sessions++
+		}
+	}
+	check.Tokens = hs.authMgr.revokeUser(userID)
+	check.Impersonations = hs.impersonations.endUser(userID)
+	check.UsageDays = fus.usage.forget(userID)
+	check.AuditEvents = auditLog.redact(userID)
+
+	check.CheckedAt = time.Now().UTC()
+	check.Clean = !failed && check.Objects == 0 && check.MultipartUploads == 0 && len(check.Rows) == 0 &&
+		check.Sessions == 0 && check.Tokens == 0 && check.Impersonations == 0 && check.UsageDays == 0 && check.AuditEvents == 0
+	return check
+}
+
+// revokeUser removes userID's tokens, returning how many there were, and
+// refuses the JWTs issued to them so far.
+func (am *AuthManager) revokeUser(userID string) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.revoked[userID] = time.Now()
+	revoked := 0
+	for token, info := range am.tokens {
+		if info.UserID == userID {
+			delete(am.tokens, token)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// endUser ends the impersonations of userID, returning how many there were.
+func (is *Impersonations) endUser(userID string) int {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	ended := 0
+	for token, imp := range is.byToken {
+		if imp.UserID == userID {
+			delete(is.byToken, token)
+			ended++
+		}
+	}
+	return ended
+}
+
+// dropSession cancels session, aborting its multipart upload unless it
+// completed, and forgets it.
+func (sm *SessionManager) dropSession(ctx context.Context, session *UploadSession) error {
+	var err error
+	if session.UploadID != "" && session.GetState() != STATE_COMPLETED {
+		_, err = sm.s3Client.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(sm.s3Client.bucket),
+			Key:      aws.String(session.S3Key),
+			UploadId: aws.String(session.UploadID),
+		})
+		if isNotFound(err) {
+			err = nil
+		}
+	}
+	sm.DeleteSession(session.SessionID)
+	eventBus.Forget(session.SessionID)
+	return err
+}
+
+// forget drops userID's usage records, returning how many days they had.
+func (um *UsageMeter) forget(userID string) int {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	days := len(um.days[userID])
+	if _, ok := um.days[userID]; ok {
+		delete(um.days, userID)
+		um.dirty = true
+	}
+	return days
+}
+
+// redact anonymizes the buffered events about userID, returning how many
+// it changed.
+func (al *AuditLog) redact(userID string) int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	changed := 0
+	for i := range al.events {
+		if al.events[i].redact(userID) {
+			changed++
+		}
+	}
+	return changed
+}
+
+// redact anonymizes the event if it is about userID: one of theirs loses
+// its user, session, address and detail, and another's has their name
+// replaced in its detail.
+func (ae *AuditEvent) redact(userID string) bool {
+	sessionID, ok := strings.CutPrefix(ae.SessionID, strings.ReplaceAll(userID, "/", ".")+"_")
+	if ae.UserID == userID || (ok && sessionID != "" && strings.Trim(sessionID, "0123456789") == "") {
+		ae.UserID, ae.SessionID, ae.RemoteAddr, ae.Detail = ERASED_USER, "", "", ""
+		return true
+	}
+	detail, ok := replaceID(ae.Detail, userID)
+	ae.Detail = detail
+	return ok
+}
+
+// replaceID replaces the occurrences of id in s that are not part of a
+// longer ID with ERASED_USER.
+func replaceID(s, id string) (string, bool) {
+	isIDByte := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+	}
+	var b strings.Builder
+	replaced := false
+	for {
+		i := strings.Index(s, id)
+		if i < 0 {
+			break
+		}
+		end := i + len(id)
+		if (i > 0 && isIDByte(s[i-1])) || (end < len(s) && isIDByte(s[end])) {
+			b.WriteString(s[:end])
+		} else {
+			b.WriteString(s[:i])
+			b.WriteString(ERASED_USER)
+			replaced = true
+		}
+		s = s[end:]
+	}
+	b.WriteString(s)
+	return b.String(), replaced
+}
+
+// redactAuditExports rewrites the exported audit objects (audit.go) that
+// have events about userID, returning how many it rewrote.
+func (s3c *S3Client) redactAuditExports(ctx context.Context, userID string) (int, error) {
+	objects, err := s3c.listObjects(ctx, AUDIT_PREFIX+"/")
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		out, err := s3c.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3c.bucket), Key: obj.Key})
+		if isNotFound(err) {
+			continue // Pruned since the listing
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		records, err := readAuditCSV(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return rewritten, fmt.Errorf("%s: %w", key, err)
+		}
+
+		changed := false
+		for i, rec := range records {
+			if i == 0 || len(rec) != len(AUDIT_CSV_HEADER) {
+				continue
+			}
+			event := AuditEvent{UserID: rec[2], SessionID: rec[3], RemoteAddr: rec[4], Detail: rec[5]}
+			if event.redact(userID) {
+				rec[2], rec[3], rec[4], rec[5] = event.UserID, event.SessionID, event.RemoteAddr, event.Detail
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		w := csv.NewWriter(gz)
+		w.WriteAll(records)
+		if err := w.Error(); err != nil {
+			return rewritten, fmt.Errorf("%s: %w", key, err)
+		}
+		if err := gz.Close(); err != nil {
+			return rewritten, fmt.Errorf("%s: %w", key, err)
+		}
+		_, err = s3c.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:          aws.String(s3c.bucket),
+			Key:             obj.Key,
+			Body:            bytes.NewReader(buf.Bytes()),
+			ContentType:     aws.String("text/csv"),
+			ContentEncoding: aws.String("gzip"),
+		})
+		if err != nil {
+			return rewritten, fmt.Errorf("%s: %w", key, err)
+		}
+		s3c.listings.Invalidate(key)
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func readAuditCSV(body io.Reader) ([][]string, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return csv.NewReader(gz).ReadAll()
+}
+
+func (s3c *S3Client) listObjects(ctx context.Context, prefix string) ([]types.Object, error) {
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(s3c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Contents...)
+	}
+	return objects, nil
+}
+
+func (s3c *S3Client) listMultipartUploads(ctx context.Context, prefix string) ([]types.MultipartUpload, error) {
+	var uploads []types.MultipartUpload
+	paginator := s3.NewListMultipartUploadsPaginator(s3c.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3c.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, page.Uploads...)
+	}
+	return uploads, nil
+}
+
+// deleteObjects deletes objects in batches, returning those deleted and
+// the errors for the others.
+func (s3c *S3Client) deleteObjects(ctx context.Context, objects []types.Object) (deleted []types.Object, failed []error) {
+	for start := 0; start < len(objects); start += ERASURE_BATCH_DELETE {
+		batch := objects[start:min(start+ERASURE_BATCH_DELETE, len(objects))]
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, obj := range batch {
+			ids[i] = types.ObjectIdentifier{Key: obj.Key}
+			s3c.listings.Invalidate(aws.ToString(obj.Key))
+		}
+		out, err := s3c.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s3c.bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			failed = append(failed, err)
+			continue
+		}
+		errored := make(map[string]bool, len(out.Errors))
+		for _, e := range out.Errors {
+			errored[aws.ToString(e.Key)] = true
+			failed = append(failed, fmt.Errorf("%s: %s: %s", aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message)))
+		}
+		for _, obj := range batch {
+			if !errored[aws.ToString(obj.Key)] {
+				deleted = append(deleted, obj)
+			}
+		}
+	}
+	return deleted, failed
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+// A user's files are those under their prefix, which also finds rows a
+// file's purge left behind where foreign keys are not enforced. Files kept
+// by a legal hold or a running Object Lock are not theirs to erase.
+const erasableKey = `$1 = substr(s3_key, 1, $2) AND s3_key NOT IN (SELECT s3_key FROM legal_holds)
+	AND s3_key NOT IN (SELECT s3_key FROM object_locks WHERE retain_until > $3)`
+
+type erasureStatement struct {
+	table string
+	query string
+	args  func(userID, prefix string, now time.Time) []interface{}
+}
+
+func keyArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{prefix, len(prefix), now}
+}
+
+func userArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{userID}
+}
+
+func prefixUserArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{prefix, len(prefix), userID}
+}
+
+func keyUserArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{prefix, len(prefix), now, userID}
+}
+
+func renameArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{ERASED_USER, userID}
+}
+
+func renameDeletedArgs(userID, prefix string, now time.Time) []interface{} {
+	return []interface{}{ERASED_USER, now, userID}
+}
+
+// The user's rows, as the statements that erase them (in order) and the
+// queries that count what is left
+var (
+	erasureStatements = []erasureStatement{
+		{"file_attributes", `DELETE FROM file_attributes WHERE ` + erasableKey, keyArgs},
+		{"file_tags", `DELETE FROM file_tags WHERE ` + erasableKey, keyArgs},
+		{"file_terms", `DELETE FROM file_terms WHERE ` + erasableKey, keyArgs},
+		{"file_verifications", `DELETE FROM file_verifications WHERE ` + erasableKey, keyArgs},
+		{"comments", `DELETE FROM comments WHERE ` + erasableKey, keyArgs},
+		{"comments", `UPDATE comments SET author = $1, body = '', deleted_at = COALESCE(deleted_at, $2) WHERE author = $3`, renameDeletedArgs},
+		{"stars", `DELETE FROM stars WHERE ` + erasableKey, keyArgs},
+		{"stars", `DELETE FROM stars WHERE user_id = $1`, userArgs},
+		{"shares", `DELETE FROM shares WHERE $1 = substr(s3_key, 1, $2) OR owner = $3`, prefixUserArgs},
+		{"grants", `DELETE FROM grants WHERE owner = $1 OR grantee = $1`, userArgs},
+		{"exports", `DELETE FROM exports WHERE user_id = $1`, userArgs},
+		{"activity", `DELETE FROM activity WHERE user_id = $1`, userArgs},
+		{"activity", `UPDATE activity SET actor = $1, detail = '' WHERE actor = $2`, renameArgs},
+		{"notification_prefs", `DELETE FROM notification_prefs WHERE user_id = $1`, userArgs},
+		{"drops", `DELETE FROM drops WHERE owner = $1`, userArgs},
+		{"object_locks", `DELETE FROM object_locks WHERE $1 = substr(s3_key, 1, $2) AND retain_until <= $3`, keyArgs},
+		{"files", `DELETE FROM files WHERE ` + erasableKey, keyArgs},
+		{"file_paths", `DELETE FROM file_paths WHERE owner = $1
+			AND NOT EXISTS (SELECT 1 FROM files WHERE files.owner = file_paths.owner AND files.file_name = file_paths.file_name)`, userArgs},
+	}
+	erasureChecks = []erasureStatement{
+		{"file_attributes", `SELECT COUNT(*) FROM file_attributes WHERE ` + erasableKey, keyArgs},
+		{"file_tags", `SELECT COUNT(*) FROM file_tags WHERE ` + erasableKey, keyArgs},
+		{"file_terms", `SELECT COUNT(*) FROM file_terms WHERE ` + erasableKey, keyArgs},
+		{"file_verifications", `SELECT COUNT(*) FROM file_verifications WHERE ` + erasableKey, keyArgs},
+		{"comments", `SELECT COUNT(*) FROM comments WHERE (` + erasableKey + `) OR author = $4`, keyUserArgs},
+		{"stars", `SELECT COUNT(*) FROM stars WHERE (` + erasableKey + `) OR user_id = $4`, keyUserArgs},
+		{"shares", `SELECT COUNT(*) FROM shares WHERE $1 = substr(s3_key, 1, $2) OR owner = $3`, prefixUserArgs},
+		{"grants", `SELECT COUNT(*) FROM grants WHERE owner = $1 OR grantee = $1`, userArgs},
+		{"exports", `SELECT COUNT(*) FROM exports WHERE user_id = $1`, userArgs},
+		{"activity", `SELECT COUNT(*) FROM activity WHERE user_id = $1 OR actor = $1`, userArgs},
+		{"notification_prefs", `SELECT COUNT(*) FROM notification_prefs WHERE user_id = $1`, userArgs},
+		{"drops", `SELECT COUNT(*) FROM drops WHERE owner = $1`, userArgs},
+		{"object_locks", `SELECT COUNT(*) FROM object_locks WHERE $1 = substr(s3_key, 1, $2) AND retain_until <= $3`, keyArgs},
+		{"files", `SELECT COUNT(*) FROM files WHERE ` + erasableKey, keyArgs},
+		{"file_paths", `SELECT COUNT(*) FROM file_paths WHERE owner = $1
+			AND NOT EXISTS (SELECT 1 FROM files WHERE files.owner = file_paths.owner AND files.file_name = file_paths.file_name)`, userArgs},
+	}
+)
+
+func (ms *sqlMetadataStore) EraseUser(ctx context.Context, userID string, now time.Time) (map[string]int64, error) {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows := make(map[string]int64)
+	for _, stmt := range erasureStatements {
+		res, err := tx.ExecContext(ctx, stmt.query, stmt.args(userID, userID+"/", now)...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", stmt.table, err)
+		}
+		n, _ := res.RowsAffected()
+		rows[stmt.table] += n
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (ms *sqlMetadataStore) UserDataRows(ctx context.Context, userID string, now time.Time) (map[string]int64, error) {
+	rows := make(map[string]int64)
+	for _, check := range erasureChecks {
+		var n int64
+		if err := ms.db.QueryRowContext(ctx, check.query, check.args(userID, userID+"/", now)...).Scan(&n); err != nil {
+			return nil, fmt.Errorf("%s: %w", check.table, err)
+		}
+		rows[check.table] += n
+	}
+	return rows, nil
+}
@@ -0,0 +1,336 @@
+// events.go - Upload lifecycle events published to NATS or Kafka
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ============================================
+// Event Bus
+// ============================================
+
+// Session lifecycle events are published so indexers, transcoders and billing
+// can react without polling the API. EVENT_BUS selects the publisher:
+//
+//   - nats:  EVENT_BUS_URL is the server URL; each event goes to the subject
+//     <EVENT_SUBJECT_PREFIX>.<type>, e.g. upload.session.completed
+//   - kafka: EVENT_BUS_URL is a Kafka REST Proxy; every event goes to the
+//     topic EVENT_SUBJECT_PREFIX keyed by session ID, so a session's events
+//     stay ordered within one partition
+//
+// Chunks are reported in batches of EVENT_CHUNK_BATCH rather than one event
+// each. Publishing happens on a background goroutine and never blocks the
+// upload path; when the queue is full, events are dropped and counted.
+
+const (
+	EVENT_SESSION_CREATED   = "session.created"
+	EVENT_CHUNKS_RECEIVED   = "session.chunks_received"
+	EVENT_SESSION_COMPLETED = "session.completed"
+	EVENT_SESSION_FAILED    = "session.failed"
+	EVENT_SESSION_CANCELLED = "session.cancelled"
+
+	EVENT_QUEUE_SIZE      = 10000
+	EVENT_PUBLISH_TIMEOUT = 10 * time.Second
+)
+
+var (
+	EVENT_BUS            = envString("EVENT_BUS", "") // nats, kafka or empty to disable
+	EVENT_BUS_URL        = envString("EVENT_BUS_URL", "")
+	EVENT_SUBJECT_PREFIX = envString("EVENT_SUBJECT_PREFIX", "upload")
+	EVENT_CHUNK_BATCH    = envInt("EVENT_CHUNK_BATCH", 50)
+)
+
+type LifecycleEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	SessionID string      `json:"session_id"`
+	UserID    string      `json:"user_id"`
+	FileName  string      `json:"file_name"`
+	S3Key     string      `json:"s3_key"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+type ChunkBatch struct {
+	Chunks   []uint32 `json:"chunks"`
+	Bytes    uint64   `json:"bytes"`
+	Received uint32   `json:"received"` // Session totals after this batch
+	Total    uint32   `json:"total"`
+}
+
+// Publisher delivers one encoded event. Implementations may block; the
+// EventBus calls them from a single goroutine.
+type Publisher interface {
+	Publish(ctx context.Context, event *LifecycleEvent, payload []byte) error
+	Close() error
+}
+
+type EventBus struct {
+	publisher Publisher
+	queue     chan *LifecycleEvent
+	done      chan struct{}
+	batches   map[string]*ChunkBatch // Session ID -> unpublished chunks
+	mu        sync.Mutex
+}
+
+// eventBus is replaced in main once the publisher is configured; until then
+// events are discarded.
+var eventBus = NewEventBus(nopPublisher{})
+
+func NewEventBus(publisher Publisher) *EventBus {
+	eb := &EventBus{
+		publisher: publisher,
+		queue:     make(chan *LifecycleEvent, EVENT_QUEUE_SIZE),
+		done:      make(chan struct{}),
+		batches:   make(map[string]*ChunkBatch),
+	}
+	go eb.run()
+	return eb
+}
+
+// NewPublisher builds the publisher selected by EVENT_BUS.
+func NewPublisher() (Publisher, error) {
+	switch EVENT_BUS {
+	case "":
+		return nopPublisher{}, nil
+	case "nats":
+		return NewNATSPublisher(EVENT_BUS_URL, EVENT_SUBJECT_PREFIX)
+	case "kafka":
+		return NewKafkaRESTPublisher(EVENT_BUS_URL, EVENT_SUBJECT_PREFIX)
+	default:
+		return nil, fmt.Errorf("unknown EVENT_BUS %q (want nats or kafka)", EVENT_BUS)
+	}
+}
+
+// Publish queues a lifecycle event for the session. Terminal events first
+// flush the session's pending chunk batch so consumers see every chunk before
+// the session ends.
+func (eb *EventBus) Publish(eventType string, session *UploadSession, data interface{}) {
+	switch eventType {
+	case EVENT_SESSION_COMPLETED, EVENT_SESSION_FAILED, EVENT_SESSION_CANCELLED:
+		eb.flushChunks(session)
+	}
+	eb.enqueue(newLifecycleEvent(eventType, session, data))
+}
+
+// ChunkReceived adds a stored chunk to the session's batch and publishes the
+// batch once it reaches EVENT_CHUNK_BATCH chunks.
+func (eb *EventBus) ChunkReceived(session *UploadSession, index, size uint32) {
+	eb.mu.Lock()
+	batch, ok := eb.batches[session.SessionID]
+	if !ok {
+		batch = &ChunkBatch{}
+		eb.batches[session.SessionID] = batch
+	}
+	batch.Chunks = append(batch.Chunks, index)
+	batch.Bytes += uint64(size)
+	full := len(batch.Chunks) >= EVENT_CHUNK_BATCH
+	if full {
+		delete(eb.batches, session.SessionID)
+	}
+	eb.mu.Unlock()
+
+	if full {
+		eb.publishBatch(session, batch)
+	}
+}
+
+// Forget drops the pending chunk batch of a session that ended without a
+// terminal event, e.g. one removed by the cleanup loop.
+func (eb *EventBus) Forget(sessionID string) {
+	eb.mu.Lock()
+	delete(eb.batches, sessionID)
+	eb.mu.Unlock()
+}
+
+func (eb *EventBus) flushChunks(session *UploadSession) {
+	eb.mu.Lock()
+	batch, ok := eb.batches[session.SessionID]
+	delete(eb.batches, session.SessionID)
+	eb.mu.Unlock()
+
+	if ok {
+		eb.publishBatch(session, batch)
+	}
+}
+
+func (eb *EventBus) publishBatch(session *UploadSession, batch *ChunkBatch) {
+	batch.Received, batch.Total = session.GetProgress()
+	eb.enqueue(newLifecycleEvent(EVENT_CHUNKS_RECEIVED, session, batch))
+}
+
+func (eb *EventBus) enqueue(event *LifecycleEvent) {
+	select {
+	case eb.queue <- event:
+	default:
+		eventsPublished.WithLabelValues(event.Type, "dropped").Inc()
+		eventLog.Warn("event queue full, dropping event", "type", event.Type, "session_id", event.SessionID)
+	}
+}
+
+func (eb *EventBus) run() {
+	defer close(eb.done)
+
+	for event := range eb.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			eventsPublished.WithLabelValues(event.Type, "error").Inc()
+			eventLog.Error("failed to encode event", "type", event.Type, "err", err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), EVENT_PUBLISH_TIMEOUT)
+		err = eb.publisher.Publish(ctx, event, payload)
+		cancel()
+
+		if err != nil {
+			eventsPublished.WithLabelValues(event.Type, "error").Inc()
+			eventLog.Warn("failed to publish event", "type", event.Type, "session_id", event.SessionID, "err", err)
+			continue
+		}
+		eventsPublished.WithLabelValues(event.Type, "ok").Inc()
+	}
+}
+
+// Close publishes the events still queued, waiting at most timeout, then
+// closes the publisher. No events may be published afterwards.
+func (eb *EventBus) Close(timeout time.Duration) error {
+	close(eb.queue)
+	select {
+	case <-eb.done:
+	case <-time.After(timeout):
+		eventLog.Warn("event queue not drained before shutdown", "pending", len(eb.queue))
+	}
+	return eb.publisher.Close()
+}
+
+func newLifecycleEvent(eventType string, session *UploadSession, data interface{}) *LifecycleEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &LifecycleEvent{
+		ID:        hex.EncodeToString(id),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		SessionID: session.SessionID,
+		UserID:    session.UserID,
+		FileName:  session.FileName,
+		S3Key:     session.S3Key,
+		Data:      data,
+	}
+}
+
+// ============================================
+// Publishers
+// ============================================
+
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(ctx context.Context, event *LifecycleEvent, payload []byte) error {
+	return nil
+}
+
+func (nopPublisher) Close() error { return nil }
+
+type NATSPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+func NewNATSPublisher(url, prefix string) (*NATSPublisher, error) {
+	if url == "" {
+		url = nats.DefaultURL
+	}
+
+	// Keep retrying in the background rather than failing startup when the
+	// bus is briefly unavailable; nats.go buffers publishes while reconnecting.
+	conn, err := nats.Connect(url,
+		nats.Name("file-upload-server"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			eventLog.Warn("disconnected from NATS", "err", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			eventLog.Info("reconnected to NATS", "url", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS at %s: %w", url, err)
+	}
+
+	eventLog.Info("publishing lifecycle events to NATS", "url", url, "subject_prefix", prefix)
+	return &NATSPublisher{conn: conn, prefix: prefix}, nil
+}
+
+func (np *NATSPublisher) Publish(ctx context.Context, event *LifecycleEvent, payload []byte) error {
+	msg := nats.NewMsg(np.prefix + "." + event.Type)
+	msg.Data = payload
+	msg.Header.Set(nats.MsgIdHdr, event.ID) // Lets JetStream deduplicate retries
+	return np.conn.PublishMsg(msg)
+}
+
+func (np *NATSPublisher) Close() error {
+	return np.conn.Drain()
+}
+
+// KafkaRESTPublisher produces to Kafka through a Confluent-compatible REST
+// Proxy (API v2), which keeps a native Kafka client out of the server.
+type KafkaRESTPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func NewKafkaRESTPublisher(baseURL, topic string) (*KafkaRESTPublisher, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("EVENT_BUS_URL must point at a Kafka REST Proxy")
+	}
+
+	eventLog.Info("publishing lifecycle events to Kafka", "proxy", baseURL, "topic", topic)
+	return &KafkaRESTPublisher{
+		url:    strings.TrimSuffix(baseURL, "/") + "/topics/" + topic,
+		client: &http.Client{Timeout: EVENT_PUBLISH_TIMEOUT},
+	}, nil
+}
+
+func (kp *KafkaRESTPublisher) Publish(ctx context.Context, event *LifecycleEvent, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{
+			{"key": event.SessionID, "value": json.RawMessage(payload)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, kp.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := kp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka rest proxy returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (kp *KafkaRESTPublisher) Close() error { return nil }
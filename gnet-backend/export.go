@@ -0,0 +1,516 @@
+// export.go - Bulk export of a user's files
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// ============================================
+// Exports
+// ============================================
+
+// When a user leaves, or asks for their data, all of their files have to
+// go somewhere else at once. An export job does that in the background:
+//
+//	POST /exports                  {"mode", ["bucket"], ["prefix"]}; the admin also gives "user_id"
+//	GET  /exports                  the caller's jobs, newest first (admin: ?user_id=)
+//	GET  /exports/{id}             one job, with its progress
+//	GET  /exports/{id}/manifest    the manifest of a finished manifest job
+//
+// "copy" copies every file under the user's prefix to the same key, after
+// the job's prefix if any, in bucket, which must be one of EXPORT_BUCKETS
+// (the server's credentials need write access to it). Copies keep the
+// checksum, content type and tags, as trash.go copies do. "manifest"
+// writes a JSON manifest listing each file with its size, ETag and a
+// presigned URL valid for EXPORT_URL_TTL_HOURS, for downloading without a
+// token; presigning needs S3_BACKEND=s3. Files in the trash are not
+// exported.
+//
+// A user has at most one job queued or running, and the server runs
+// EXPORT_WORKERS at a time. Jobs are kept in the metadata store (metadata.go)
+// and need METADATA_DB. A job whose server stops is not resumed: one that
+// has made no progress for EXPORT_STALE reads as failed, and can be started
+// again.
+
+const (
+	EXPORT_COPY     = "copy"
+	EXPORT_MANIFEST = "manifest"
+
+	EXPORT_QUEUED    = "queued"
+	EXPORT_RUNNING   = "running"
+	EXPORT_COMPLETED = "completed"
+	EXPORT_FAILED    = "failed"
+
+	EXPORT_HEARTBEAT = 30 * time.Second // Progress is saved at least this often
+	EXPORT_STALE     = 4 * EXPORT_HEARTBEAT
+	EXPORT_LIST_MAX  = 100
+)
+
+var (
+	EXPORT_PREFIX  = envString("EXPORT_PREFIX", "_exports") // Manifests, outside every user's prefix
+	EXPORT_BUCKETS = envString("EXPORT_BUCKETS", "")        // Comma-separated; empty disables copy exports
+	EXPORT_WORKERS = envInt("EXPORT_WORKERS", 2)
+	EXPORT_URL_TTL = time.Duration(envInt("EXPORT_URL_TTL_HOURS", 7*24)) * time.Hour // S3 allows at most 7 days
+)
+
+var errExportNotFound = errors.New("Export not found")
+
+// exportSlots limits the jobs running at once; the others wait as queued.
+var exportSlots = make(chan struct{}, max(EXPORT_WORKERS, 1))
+
+type ExportJob struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	RequestedBy string     `json:"requested_by"` // The user, or "admin"
+	Mode        string     `json:"mode"`
+	Bucket      string     `json:"bucket,omitempty"`
+	Prefix      string     `json:"prefix,omitempty"`
+	State       string     `json:"state"`
+	TotalFiles  int        `json:"total_files"` // Known once the files are listed
+	Files       int        `json:"files"`
+	Bytes       int64      `json:"bytes"`
+	Error       string     `json:"error,omitempty"`
+	ManifestURL string     `json:"manifest_url,omitempty"` // Relative to the API root
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type CreateExportRequest struct {
+	Mode   string `json:"mode"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	UserID string `json:"user_id"` // Admin only
+}
+
+type ExportManifest struct {
+	JobID     string           `json:"job_id"`
+	UserID    string           `json:"user_id"`
+	CreatedAt time.Time        `json:"created_at"`
+	ExpiresAt time.Time        `json:"expires_at"` // Of the URLs
+	Files     []ExportedObject `json:"files"`
+}
+
+type ExportedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+	URL          string    `json:"url"`
+}
+
+// active reports whether the job is queued or running on a live server.
+func (job *ExportJob) active() bool {
+	return (job.State == EXPORT_QUEUED || job.State == EXPORT_RUNNING) && time.Since(job.UpdatedAt) < EXPORT_STALE
+}
+
+// settle reports a job left active by a server that stopped as failed.
+func (job *ExportJob) settle() {
+	if (job.State == EXPORT_QUEUED || job.State == EXPORT_RUNNING) && !job.active() {
+		job.State = EXPORT_FAILED
+		job.Error = "Interrupted; start a new export"
+	}
+	if job.Mode == EXPORT_MANIFEST && job.State == EXPORT_COMPLETED {
+		job.ManifestURL = "/exports/" + job.ID + "/manifest"
+	}
+}
+
+// exportBucketAllowed reports whether files may be copied to bucket, which
+// is never the upload bucket, where copies would land in users' prefixes.
+func exportBucketAllowed(bucket string) bool {
+	return bucket != "" && bucket != S3_BUCKET && slices.Contains(strings.Split(EXPORT_BUCKETS, ","), bucket)
+}
+
+// presignPlainGET keeps the retry middleware's amz-sdk-request header out of
+// presigned requests. It would be signed, and a browser or curl fetching
+// the URL does not send it.
+func presignPlainGET(o *s3.PresignOptions) {
+	o.ClientOptions = append(o.ClientOptions, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			if _, ok := stack.Finalize.Get("RetryMetricsHeader"); !ok {
+				return nil
+			}
+			_, err := stack.Finalize.Remove("RetryMetricsHeader")
+			return err
+		})
+	})
+}
+
+func manifestKey(id string) string {
+	return path.Join(EXPORT_PREFIX, id+".json")
+}
+
+func (hs *HTTPServer) registerExportRoutes() {
+	hs.mux.HandleFunc("POST /exports", hs.handleCreateExport)
+	hs.mux.HandleFunc("GET /exports", hs.handleListExports)
+	hs.mux.HandleFunc("GET /exports/{id}", hs.handleGetExport)
+	hs.mux.HandleFunc("GET /exports/{id}/manifest", hs.handleExportManifest)
+}
+
+// POST /exports
+func (hs *HTTPServer) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	var req CreateExportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	userID, requestedBy, ok := hs.adminOrCaller(w, r, req.UserID)
+	if !ok {
+		return
+	}
+
+	switch req.Mode {
+	case EXPORT_COPY:
+		if !exportBucketAllowed(req.Bucket) {
+			writeJSONError(w, http.StatusForbidden, "bucket is not an export destination")
+			return
+		}
+	case EXPORT_MANIFEST:
+		if hs.sessionMgr.s3Client.presign == nil {
+			writeJSONError(w, http.StatusNotImplemented, "Manifest exports need S3_BACKEND=s3")
+			return
+		}
+		req.Bucket, req.Prefix = "", ""
+	default:
+		writeJSONError(w, http.StatusBadRequest, `mode must be "copy" or "manifest"`)
+		return
+	}
+
+	jobs, err := hs.uploads.metadata.ListExports(r.Context(), userID, EXPORT_LIST_MAX)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range jobs {
+		if jobs[i].active() {
+			writeJSONError(w, http.StatusConflict, "An export of this user's files is already in progress: "+jobs[i].ID)
+			return
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now().UTC()
+	job := &ExportJob{
+		ID:          hex.EncodeToString(b),
+		UserID:      userID,
+		RequestedBy: requestedBy,
+		Mode:        req.Mode,
+		Bucket:      req.Bucket,
+		Prefix:      req.Prefix,
+		State:       EXPORT_QUEUED,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.CreateExport(r.Context(), job)) {
+		return
+	}
+	auditLog.Record(AUDIT_EXPORT_STARTED, userID, "", r.RemoteAddr, job.Mode+" "+job.ID+" by "+requestedBy)
+	httpLog.InfoContext(r.Context(), "started export", "export_id", job.ID, "user_id", userID, "mode", job.Mode, "bucket", job.Bucket)
+	writeJSON(w, http.StatusAccepted, job)
+
+	// After the response, which would race with the job's progress
+	go hs.uploads.runExport(context.WithoutCancel(r.Context()), job)
+}
+
+// GET /exports
+func (hs *HTTPServer) handleListExports(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := hs.adminOrCaller(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
+		return
+	}
+
+	jobs, err := hs.uploads.metadata.ListExports(r.Context(), userID, EXPORT_LIST_MAX)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range jobs {
+		jobs[i].settle()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"exports": jobs})
+}
+
+// GET /exports/{id}
+func (hs *HTTPServer) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := hs.callerExport(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, job)
+}
+
+// GET /exports/{id}/manifest
+func (hs *HTTPServer) handleExportManifest(w http.ResponseWriter, r *http.Request) {
+	job, ok := hs.callerExport(w, r)
+	if !ok {
+		return
+	}
+	if job.ManifestURL == "" {
+		writeJSONError(w, http.StatusNotFound, "Export has no manifest")
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	out, err := s3Client.client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(manifestKey(job.ID)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			writeJSONError(w, http.StatusNotFound, "Manifest not found")
+			return
+		}
+		s3Log.ErrorContext(r.Context(), "failed to read export manifest", "export_id", job.ID, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to fetch manifest")
+		return
+	}
+	defer out.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	io.Copy(w, out.Body)
+}
+
+// callerExport looks up the job in r's path, answering the request itself
+// if it is not the caller's (or the admin is not asking).
+func (hs *HTTPServer) callerExport(w http.ResponseWriter, r *http.Request) (*ExportJob, bool) {
+	admin := isAdminRequest(r)
+	var userID string
+	if !admin {
+		tokenInfo, ok := hs.authenticate(r)
+		if !ok {
+			auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+			writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+			return nil, false
+		}
+		userID = tokenInfo.UserID
+	}
+
+	job, err := hs.uploads.metadata.GetExport(r.Context(), r.PathValue("id"))
+	if err == nil && !admin && job.UserID != userID {
+		err = errExportNotFound
+	}
+	if !hs.writeMetadataError(w, r, err) {
+		return nil, false
+	}
+	job.settle()
+	return job, true
+}
+
+// ============================================
+// Running Jobs
+// ============================================
+
+// runExport waits for a slot, exports the job's files and records the
+// outcome. Progress is saved after every file, and at least every
+// EXPORT_HEARTBEAT so a long copy is not taken for a stopped server.
+func (fus *FileUploadServer) runExport(ctx context.Context, job *ExportJob) {
+	// save applies update, if any, to the job and saves it
+	var mu sync.Mutex
+	save := func(update func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		if update != nil {
+			update()
+		}
+		job.UpdatedAt = time.Now().UTC()
+
+		ctx, cancel := context.WithTimeout(ctx, METADATA_TIMEOUT)
+		defer cancel()
+		if err := fus.metadata.UpdateExport(ctx, job); err != nil {
+			serverLog.ErrorContext(ctx, "failed to save export progress", "export_id", job.ID, "err", err)
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(EXPORT_HEARTBEAT)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save(nil)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	exportSlots <- struct{}{}
+	defer func() { <-exportSlots }()
+	save(func() { job.State = EXPORT_RUNNING })
+
+	err := fus.exportFiles(ctx, job, save)
+	save(func() {
+		now := time.Now().UTC()
+		job.CompletedAt = &now
+		job.State = EXPORT_COMPLETED
+		if err != nil {
+			job.State, job.Error = EXPORT_FAILED, err.Error()
+		}
+	})
+
+	exportJobs.WithLabelValues(job.Mode, job.State).Inc()
+	auditLog.Record(AUDIT_EXPORT_FINISHED, job.UserID, "", "", job.Mode+" "+job.ID+" "+job.State)
+	if err != nil {
+		serverLog.ErrorContext(ctx, "export failed", "export_id", job.ID, "user_id", job.UserID, "files", job.Files, "err", err)
+		return
+	}
+	serverLog.InfoContext(ctx, "export completed", "export_id", job.ID, "user_id", job.UserID, "mode", job.Mode,
+		"files", job.Files, "bytes", job.Bytes)
+}
+
+// exportFiles copies or presigns each of the job's files, counting them
+// with save.
+func (fus *FileUploadServer) exportFiles(ctx context.Context, job *ExportJob, save func(update func())) error {
+	var objects []ExportedObject
+	paginator := s3.NewListObjectsV2Paginator(fus.s3Client.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(fus.s3Client.bucket),
+		Prefix: aws.String(job.UserID + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ExportedObject{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         strings.Trim(aws.ToString(obj.ETag), `"`),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	save(func() { job.TotalFiles = len(objects) })
+
+	manifest := ExportManifest{
+		JobID:     job.ID,
+		UserID:    job.UserID,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().UTC().Add(EXPORT_URL_TTL),
+		Files:     make([]ExportedObject, 0, len(objects)),
+	}
+	for _, obj := range objects {
+		if job.Mode == EXPORT_COPY {
+			// A file deleted since the listing is not an error
+			if _, err := fus.s3Client.copyObjectTo(ctx, obj.Key, job.Bucket, job.Prefix+obj.Key); isNotFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		} else {
+			req, err := fus.s3Client.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(fus.s3Client.bucket),
+				Key:    aws.String(obj.Key),
+			}, s3.WithPresignExpires(EXPORT_URL_TTL))
+			if err != nil {
+				return err
+			}
+			obj.URL = req.URL
+			manifest.Files = append(manifest.Files, obj)
+		}
+		exportBytes.Add(float64(obj.Size))
+		save(func() {
+			job.Files++
+			job.Bytes += obj.Size
+		})
+	}
+
+	if job.Mode == EXPORT_MANIFEST {
+		body, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fus.s3Client.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(fus.s3Client.bucket),
+			Key:         aws.String(manifestKey(job.ID)),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		return err
+	}
+	return nil
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) CreateExport(ctx context.Context, job *ExportJob) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO exports (id, user_id, requested_by, mode, bucket, prefix, state, total_files, files, bytes, error, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		job.ID, job.UserID, job.RequestedBy, job.Mode, job.Bucket, job.Prefix, job.State,
+		job.TotalFiles, job.Files, job.Bytes, job.Error, job.CreatedAt, job.UpdatedAt)
+	return err
+}
+
+func (ms *sqlMetadataStore) UpdateExport(ctx context.Context, job *ExportJob) error {
+	_, err := ms.db.ExecContext(ctx, `
+		UPDATE exports SET state = $1, total_files = $2, files = $3, bytes = $4, error = $5, updated_at = $6, completed_at = $7
+		WHERE id = $8`,
+		job.State, job.TotalFiles, job.Files, job.Bytes, job.Error, job.UpdatedAt, job.CompletedAt, job.ID)
+	return err
+}
+
+func (ms *sqlMetadataStore) GetExport(ctx context.Context, id string) (*ExportJob, error) {
+	jobs, err := ms.queryExports(ctx, `WHERE id = $1`, id, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, errExportNotFound
+	}
+	return &jobs[0], nil
+}
+
+func (ms *sqlMetadataStore) ListExports(ctx context.Context, userID string, limit int) ([]ExportJob, error) {
+	return ms.queryExports(ctx, `WHERE user_id = $1`, userID, limit)
+}
+
+func (ms *sqlMetadataStore) queryExports(ctx context.Context, where, arg string, limit int) ([]ExportJob, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT id, user_id, requested_by, mode, bucket, prefix, state, total_files, files, bytes, error, created_at, updated_at, completed_at
+		FROM exports `+where+`
+		ORDER BY created_at DESC
+		LIMIT $2`, arg, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]ExportJob, 0)
+	for rows.Next() {
+		var job ExportJob
+		var completedAt sql.NullTime
+		if err := rows.Scan(&job.ID, &job.UserID, &job.RequestedBy, &job.Mode, &job.Bucket, &job.Prefix, &job.State,
+			&job.TotalFiles, &job.Files, &job.Bytes, &job.Error, &job.CreatedAt, &job.UpdatedAt, &completedAt); err != nil {
+			return nil, err
+		}
+		if completedAt.Valid {
+			job.CompletedAt = &completedAt.Time
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
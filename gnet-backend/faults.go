@@ -0,0 +1,124 @@
+// faults.go - Fault injection for exercising client retry and resume logic
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// ============================================
+// Fault Injection
+// ============================================
+
+// A test mode for hardening clients: with any FAULT_*_PERCENT set, that share
+// of chunk uploads (binary protocol and HTTP) fails on purpose.
+//
+//	FAULT_NACK_PERCENT      chunk rejected with an error before it is stored
+//	FAULT_DELAY_PERCENT     chunk stored, ack held back for FAULT_DELAY_MS
+//	FAULT_DROP_PERCENT      chunk stored, connection closed instead of the ack
+//	FAULT_S3_ERROR_PERCENT  S3 multipart call (create, part, complete) fails
+//
+// A dropped ack leaves the client unsure whether the chunk arrived, so a
+// correct client resends it and gets a duplicate. Never enable in production.
+
+const (
+	FAULT_NACK     = "nack"
+	FAULT_DELAY    = "delay"
+	FAULT_DROP     = "drop"
+	FAULT_S3_ERROR = "s3_error"
+)
+
+var (
+	FAULT_NACK_PERCENT     = envInt("FAULT_NACK_PERCENT", 0)
+	FAULT_DELAY_PERCENT    = envInt("FAULT_DELAY_PERCENT", 0)
+	FAULT_DROP_PERCENT     = envInt("FAULT_DROP_PERCENT", 0)
+	FAULT_S3_ERROR_PERCENT = envInt("FAULT_S3_ERROR_PERCENT", 0)
+	FAULT_DELAY_MS         = envInt("FAULT_DELAY_MS", 2000)
+)
+
+var errInjectedNack = errors.New("Injected fault: chunk rejected")
+
+func faultsEnabled() bool {
+	return FAULT_NACK_PERCENT > 0 || FAULT_DELAY_PERCENT > 0 || FAULT_DROP_PERCENT > 0 || FAULT_S3_ERROR_PERCENT > 0
+}
+
+// enableFaults logs the fault rates and makes S3 calls fail when configured.
+func enableFaults(s3Client *S3Client) {
+	if !faultsEnabled() {
+		return
+	}
+	serverLog.Warn("fault injection enabled; do not use in production",
+		"nack_percent", FAULT_NACK_PERCENT,
+		"delay_percent", FAULT_DELAY_PERCENT,
+		"delay_ms", FAULT_DELAY_MS,
+		"drop_percent", FAULT_DROP_PERCENT,
+		"s3_error_percent", FAULT_S3_ERROR_PERCENT)
+	if FAULT_S3_ERROR_PERCENT > 0 {
+		s3Client.client = &faultyS3{S3API: s3Client.client}
+	}
+}
+
+// injectFault reports whether a fault of the given kind hits this request.
+func injectFault(ctx context.Context, kind string, percent int) bool {
+	if percent <= 0 || rand.IntN(100) >= percent {
+		return false
+	}
+	faultsInjected.WithLabelValues(kind).Inc()
+	chunkLog.WarnContext(ctx, "injected fault", "kind", kind)
+	return true
+}
+
+// ackFault picks what happens to the ack of a stored chunk: FAULT_DROP,
+// FAULT_DELAY or "" to send it normally.
+func ackFault(ctx context.Context) string {
+	if injectFault(ctx, FAULT_DROP, FAULT_DROP_PERCENT) {
+		return FAULT_DROP
+	}
+	if injectFault(ctx, FAULT_DELAY, FAULT_DELAY_PERCENT) {
+		return FAULT_DELAY
+	}
+	return ""
+}
+
+func faultDelay() time.Duration {
+	return time.Duration(FAULT_DELAY_MS) * time.Millisecond
+}
+
+// faultyS3 fails the multipart calls of the upload path like an overloaded
+// S3 would, and passes everything else through.
+type faultyS3 struct {
+	S3API
+}
+
+func s3Fault(ctx context.Context) error {
+	if !injectFault(ctx, FAULT_S3_ERROR, FAULT_S3_ERROR_PERCENT) {
+		return nil
+	}
+	return &smithy.GenericAPIError{Code: "InternalError", Message: "injected fault", Fault: smithy.FaultServer}
+}
+
+func (f *faultyS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := s3Fault(ctx); err != nil {
+		return nil, err
+	}
+	return f.S3API.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (f *faultyS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if err := s3Fault(ctx); err != nil {
+		return nil, err
+	}
+	return f.S3API.UploadPart(ctx, params, optFns...)
+}
+
+func (f *faultyS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := s3Fault(ctx); err != nil {
+		return nil, err
+	}
+	return f.S3API.CompleteMultipartUpload(ctx, params, optFns...)
+}
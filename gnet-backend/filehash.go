@@ -0,0 +1,90 @@
+// filehash.go - Checking finished uploads against their declared SHA-256
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ============================================
+// Whole-File Verification
+// ============================================
+
+// Chunk checksums catch a chunk damaged on the way, not a file the client
+// split wrongly or chunks sent under the wrong index. An init can declare the
+// SHA-256 (hex) of the whole file: "sha256" in POST /upload/init, or
+// INIT_UPLOAD_VERIFIED instead of INIT_UPLOAD on the binary port. Once
+// CompleteMultipartUpload has assembled the object, the server reads it back
+// and hashes it before answering the last chunk; chunks arrive in parallel
+// and out of order, so a hash rolled across them would mean holding them
+// back. That read costs a download of the whole file from S3.
+//
+// If the hashes differ, the object is deleted and the session fails: the
+// binary port answers the last chunk with RESP_HASH_MISMATCH, the HTTP API
+// with 422 and the assembled file's hash as "sha256". If the object cannot be
+// read back the session fails as any other failed finalize does. A verified
+// hash is recorded with the file, and is what instant uploads (dedup.go)
+// match.
+
+const FILE_HASH_TIMEOUT = 30 * time.Minute // Reading an assembled file back to hash it
+
+// fileHashError is a finalized upload whose assembled file is not the one
+// declared at init.
+type fileHashError struct {
+	declared string
+	sha256   string
+}
+
+func (e *fileHashError) Error() string {
+	return fmt.Sprintf("File does not match its declared sha256 %s (assembled file: %s)", e.declared, e.sha256)
+}
+
+// checkFileHash hashes the assembled object of a session that declared a
+// FileHash, returning a *fileHashError if it does not match.
+func (fus *FileUploadServer) checkFileHash(ctx context.Context, session *UploadSession) error {
+	ctx, cancel := context.WithTimeout(ctx, FILE_HASH_TIMEOUT)
+	defer cancel()
+
+	out, err := fus.s3Client.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(fus.s3Client.bucket),
+		Key:    aws.String(session.S3Key),
+	})
+	if err != nil {
+		fileHashChecks.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to read the file back: %w", err)
+	}
+	defer out.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, out.Body); err != nil {
+		fileHashChecks.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to read the file back: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if sum != session.FileHash {
+		fileHashChecks.WithLabelValues("mismatch").Inc()
+		sessionLog.WarnContext(ctx, "assembled file does not match the declared hash", "session_id", session.SessionID,
+			"declared", session.FileHash, "sha256", sum)
+		return &fileHashError{declared: session.FileHash, sha256: sum}
+	}
+	fileHashChecks.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// writeFileHashError answers a chunk whose upload failed its hash check.
+func writeFileHashError(w http.ResponseWriter, hashErr *fileHashError) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+		"error":      hashErr.Error(),
+		"declared":   hashErr.declared,
+		"sha256":     hashErr.sha256,
+		"request_id": w.Header().Get("X-Request-ID"),
+	})
+}
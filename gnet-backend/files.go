@@ -0,0 +1,340 @@
+// files.go - Listing and downloading a user's uploads
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// ============================================
+// User Files
+// ============================================
+
+// Completed uploads are read back from S3 under the caller's own prefix
+// (user_id/...), so a user can never list or fetch another user's objects
+// unless the owner granted them access (acl.go).
+
+const FILES_LIST_MAX = 1000
+
+// OBJECT_META_CHUNK_SIZE is the object metadata key holding the upload's chunk
+// size, which is also its S3 part size. Downloads return it as X-Chunk-Size so
+// clients can verify the file against the multipart ETag.
+const OBJECT_META_CHUNK_SIZE = "chunk-size"
+
+type FileSummary struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// GET /files[?fresh=true][?tag=...][?prefix=...][?starred=true]
+//
+// The listing comes from the listing cache unless fresh is set; see below.
+// With tags or starred it comes from the metadata store instead (tags.go,
+// stars.go). A prefix narrows the listing, or lists files granted by another
+// user (acl.go).
+func (hs *HTTPServer) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	if starred, _ := strconv.ParseBool(r.URL.Query().Get("starred")); starred {
+		hs.listStarredFiles(w, r, tokenInfo.UserID, r.URL.Query()["tag"])
+		return
+	}
+	if tags := r.URL.Query()["tag"]; len(tags) > 0 {
+		hs.listTaggedFiles(w, r, tokenInfo.UserID, tags)
+		return
+	}
+
+	prefix := tokenInfo.UserID + "/"
+	if p := r.URL.Query().Get("prefix"); p != "" {
+		if !strings.HasPrefix(p, prefix) {
+			hs.listGrantedFiles(w, r, tokenInfo.UserID, p)
+			return
+		}
+		prefix = p
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	fresh, _ := strconv.ParseBool(r.URL.Query().Get("fresh"))
+
+	var files []FileSummary
+	var truncated bool
+	result := "bypass"
+	if !fresh {
+		var cached bool
+		if files, truncated, cached = s3Client.listings.Get(prefix); cached {
+			result = "hit"
+		} else {
+			result = "miss"
+		}
+	}
+	if result != "hit" {
+		generation := s3Client.listings.Generation()
+		var err error
+		if files, truncated, err = listFiles(r.Context(), s3Client, prefix); err != nil {
+			s3Log.ErrorContext(r.Context(), "failed to list user files", "user_id", tokenInfo.UserID, "err", err)
+			writeJSONError(w, http.StatusBadGateway, "Failed to list files")
+			return
+		}
+		s3Client.listings.Put(prefix, generation, files, truncated)
+	}
+	fileListings.WithLabelValues(result).Inc()
+
+	// Sessions still held in memory, including unfinished ones
+	sessions := make([]SessionSummary, 0)
+	for _, session := range hs.sessionMgr.Sessions() {
+		if session.UserID != tokenInfo.UserID {
+			continue
+		}
+		session.mu.Lock()
+		sessions = append(sessions, SessionSummary{
+			SessionID:      session.SessionID,
+			UserID:         session.UserID,
+			FileName:       session.FileName,
+			State:          session.State,
+			ReceivedChunks: uint32(len(session.ReceivedChunks)),
+			TotalChunks:    session.TotalChunks,
+			BytesPerSecond: uint64(session.throughput),
+			SlowCause:      session.SlowCause,
+			CreatedAt:      session.CreatedAt,
+			UpdatedAt:      session.UpdatedAt,
+		})
+		session.mu.Unlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Listing-Cache", result)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":     files,
+		"truncated": truncated,
+		"sessions":  sessions,
+	})
+}
+
+// listFiles lists up to FILES_LIST_MAX objects under prefix, newest first.
+func listFiles(ctx context.Context, s3Client *S3Client, prefix string) (files []FileSummary, truncated bool, err error) {
+	paginator := s3.NewListObjectsV2Paginator(s3Client.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3Client.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	files = make([]FileSummary, 0)
+	for paginator.HasMorePages() && !truncated {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, obj := range page.Contents {
+			if len(files) == FILES_LIST_MAX {
+				truncated = true
+				break
+			}
+			files = append(files, FileSummary{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].LastModified.After(files[j].LastModified) })
+	return files, truncated, nil
+}
+
+// GET /files/{key...}
+//
+// Range and If-Match are passed through to S3, so interrupted or parallel
+// ranged downloads can be continued and detect an object replaced midway.
+func (hs *HTTPServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.PathValue("key")
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_READ) {
+		return
+	}
+	hs.serveObject(w, r, tokenInfo.UserID, key, ACTIVITY_FILE_DOWNLOADED)
+}
+
+// serveObject writes key from S3, honouring Range and If-Match, and records
+// the read as event in the owner's activity (activity.go). The caller has
+// checked that userID may read it.
+func (hs *HTTPServer) serveObject(w http.ResponseWriter, r *http.Request, userID, key, event string) {
+	s3Client := hs.sessionMgr.s3Client
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(key),
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		input.Range = aws.String(rng)
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	obj, err := s3Client.client.GetObject(r.Context(), input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "NoSuchKey":
+				writeJSONError(w, http.StatusNotFound, "File not found")
+				return
+			case "InvalidRange":
+				writeJSONError(w, http.StatusRequestedRangeNotSatisfiable, "Invalid range")
+				return
+			case "PreconditionFailed":
+				writeJSONError(w, http.StatusPreconditionFailed, "File has changed")
+				return
+			}
+		}
+		s3Log.ErrorContext(r.Context(), "failed to get object", "key", key, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to fetch file")
+		return
+	}
+	defer obj.Body.Close()
+
+	if readActivity(r) {
+		actor := userID
+		if event == ACTIVITY_SHARE_DOWNLOADED {
+			actor = "" // Whoever has the link; userID is the owner
+		}
+		hs.uploads.activity.Record(event, key, actor, "")
+	}
+
+	w.Header().Set("Content-Type", aws.ToString(obj.ContentType))
+	w.Header().Set("Content-Length", strconv.FormatInt(aws.ToInt64(obj.ContentLength), 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if obj.ETag != nil {
+		w.Header().Set("ETag", *obj.ETag)
+	}
+	if chunkSize := obj.Metadata[OBJECT_META_CHUNK_SIZE]; chunkSize != "" {
+		w.Header().Set("X-Chunk-Size", chunkSize)
+	}
+	status := http.StatusOK
+	if obj.ContentRange != nil {
+		w.Header().Set("Content-Range", *obj.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	n, err := io.Copy(w, obj.Body)
+	hs.usage.RecordStream(userID, uint64(n))
+	if event == ACTIVITY_FILE_STREAMED {
+		streamBytes.WithLabelValues("stream").Add(float64(n))
+	} else {
+		streamBytes.WithLabelValues("download").Add(float64(n))
+	}
+	if err != nil {
+		httpLog.WarnContext(r.Context(), "download interrupted", "key", key, "bytes", n, "err", err)
+		return
+	}
+	httpLog.InfoContext(r.Context(), "served download", "key", key, "bytes", n)
+}
+
+// ============================================
+// Listing Cache
+// ============================================
+
+// Listing a user's objects takes a ListObjectsV2 call per 1000 keys, and
+// clients poll GET /files. A listing is kept for FILES_CACHE_TTL_SECONDS
+// (0 disables the cache), keyed by prefix. Everything this server writes or
+// deletes goes through S3Client, which drops the cached listings covering
+// the key, so a user sees their own finished upload at once. Objects changed
+// behind the server's back show up when the listing expires, or straight
+// away with ?fresh=true.
+//
+// A listing started before an invalidation may not include its change, so
+// it is not cached: every invalidation moves the cache to a new generation
+// and Put ignores listings from an older one.
+
+var FILES_CACHE_TTL = time.Duration(envInt("FILES_CACHE_TTL_SECONDS", 30)) * time.Second
+
+type cachedListing struct {
+	files     []FileSummary
+	truncated bool
+	expires   time.Time
+}
+
+type ListingCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	generation uint64
+	listings   map[string]*cachedListing
+}
+
+func NewListingCache(ttl time.Duration) *ListingCache {
+	return &ListingCache{ttl: ttl, listings: make(map[string]*cachedListing)}
+}
+
+// Get returns the cached listing of prefix. files must not be modified.
+func (lc *ListingCache) Get(prefix string) (files []FileSummary, truncated, ok bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	listing, ok := lc.listings[prefix]
+	if !ok || time.Now().After(listing.expires) {
+		return nil, false, false
+	}
+	return listing.files, listing.truncated, true
+}
+
+// Generation is taken before listing and passed to Put.
+func (lc *ListingCache) Generation() uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.generation
+}
+
+// Put caches the listing of prefix unless something was invalidated since
+// generation.
+func (lc *ListingCache) Put(prefix string, generation uint64, files []FileSummary, truncated bool) {
+	if lc.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if generation != lc.generation {
+		return
+	}
+	for p, listing := range lc.listings {
+		if now.After(listing.expires) {
+			delete(lc.listings, p)
+		}
+	}
+	lc.listings[prefix] = &cachedListing{files: files, truncated: truncated, expires: now.Add(lc.ttl)}
+}
+
+// Invalidate drops every cached listing whose prefix covers key.
+func (lc *ListingCache) Invalidate(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.generation++
+	for prefix := range lc.listings {
+		if strings.HasPrefix(key, prefix) {
+			delete(lc.listings, prefix)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newTestHTTPServer is the HTTP API over a memS3 bucket, with the demo
+// tokens of NewAuthManager and no metadata database.
+func newTestHTTPServer(t testing.TB) (*HTTPServer, *S3Client) {
+	t.Helper()
+	mem := newMemS3()
+	if _, err := mem.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("test")}); err != nil {
+		t.Fatal(err)
+	}
+	s3Client := &S3Client{client: mem, bucket: "test", listings: NewListingCache(0)}
+	usage, err := NewUsageMeter(filepath.Join(t.TempDir(), "usage.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := NewPreviewSpool(filepath.Join(t.TempDir(), "preview"), PREVIEW_MAX_CHUNKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, err := NewPartStaging(filepath.Join(t.TempDir(), "staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMgr := NewAuthManager()
+	sessionMgr := NewSessionManager(s3Client, authMgr, spool, staging)
+	uploads := &FileUploadServer{
+		sessionMgr:  sessionMgr,
+		s3Client:    s3Client,
+		authMgr:     authMgr,
+		spool:       spool,
+		staging:     staging,
+		usage:       usage,
+		quotas:      &UserQuotas{},
+		limiter:     NewRateLimiter(nil),
+		chunkMemory: NewMemoryBudget(MAX_CHUNK_MEMORY, chunkMemoryBytes),
+		metadata:    nopMetadataStore{},
+	}
+	return NewHTTPServer(sessionMgr, authMgr, spool, NewConnRegistry(), usage, nil, uploads), s3Client
+}
+
+func TestHandleDownload(t *testing.T) {
+	hs, s3Client := newTestHTTPServer(t)
+	data := []byte("0123456789")
+	_, err := s3Client.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String("test"),
+		Key:         aws.String("user_123/1/file.mp4"),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("video/mp4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		token  string
+		rng    string
+		status int
+		body   string
+	}{
+		{"whole file", "user_123/1/file.mp4", "test_token_user123", "", http.StatusOK, "0123456789"},
+		{"range", "user_123/1/file.mp4", "test_token_user123", "bytes=2-4", http.StatusPartialContent, "234"},
+		{"suffix range", "user_123/1/file.mp4", "test_token_user123", "bytes=-3", http.StatusPartialContent, "789"},
+		{"range past the end", "user_123/1/file.mp4", "test_token_user123", "bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"missing file", "user_123/1/other.mp4", "test_token_user123", "", http.StatusNotFound, ""},
+		{"another user's file", "user_123/1/file.mp4", "test_token_user456", "", http.StatusForbidden, ""},
+		{"bad token", "user_123/1/file.mp4", "nope", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/"+tt.key, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			w := httptest.NewRecorder()
+			hs.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body == "" {
+				return
+			}
+			if body, _ := io.ReadAll(w.Body); string(body) != tt.body {
+				t.Fatalf("body %q, want %q", body, tt.body)
+			}
+			if got := w.Header().Get("ETag"); got == "" {
+				t.Fatal("no ETag")
+			}
+		})
+	}
+}
@@ -0,0 +1,756 @@
+// fsstore.go - S3 stand-in on the local filesystem for demos and single hosts
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Filesystem Backend
+// ============================================
+
+// fsS3 implements S3API under a root directory (S3_BACKEND=fs, S3_FS_DIR),
+// following the same S3 rules as memS3 but keeping objects across restarts:
+//
+//	<root>/<bucket>/objects/<key>            object data
+//	<root>/<bucket>/meta/<key>.json          ETag, content type, metadata, tags
+//	<root>/<bucket>/uploads/<id>/upload.json multipart upload being assembled
+//	<root>/<bucket>/uploads/<id>/<n>         part n, with its ETag in <n>.etag
+//
+// Files are written to a temporary name and renamed into place, so a reader
+// never sees a partial object and a crash leaves at most a stray temp file.
+
+var S3_FS_DIR = envString("S3_FS_DIR", "data")
+
+type fsObjectMeta struct {
+	ETag            string            `json:"etag"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Tags            []types.Tag       `json:"tags,omitempty"`
+	LastModified    time.Time         `json:"last_modified"`
+}
+
+type fsUploadMeta struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Initiated   time.Time         `json:"initiated"`
+}
+
+type fsS3 struct {
+	root string
+	mu   sync.Mutex // Serializes metadata changes; data is written outside it
+}
+
+func newFsS3(root string) (*fsS3, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &fsS3{root: root}, nil
+}
+
+// bucketDir returns the bucket's directory if the bucket exists.
+func (f *fsS3) bucketDir(bucket *string) (string, error) {
+	name := aws.ToString(bucket)
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", memError("InvalidBucketName", "The specified bucket is not valid")
+	}
+	dir := filepath.Join(f.root, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", &types.NoSuchBucket{Message: aws.String("The specified bucket does not exist")}
+	}
+	return dir, nil
+}
+
+// keyPath maps an object key below base, rejecting keys that would escape it.
+func keyPath(base, key, suffix string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return "", memError("InvalidArgument", "Invalid object key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", memError("InvalidArgument", "Invalid object key %q", key)
+		}
+	}
+	return filepath.Join(base, filepath.FromSlash(key)) + suffix, nil
+}
+
+// writeFileAtomic writes r to path through a temporary file and returns the
+// bytes written and their MD5.
+func writeFileAtomic(path string, r io.Reader) (int64, []byte, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, nil, err
+	}
+	return n, h.Sum(nil), nil
+}
+
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, _, err = writeFileAtomic(path, bytes.NewReader(data))
+	return err
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (f *fsS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if _, err := f.bucketDir(params.Bucket); err != nil {
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fsS3) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.bucketDir(params.Bucket); err == nil {
+		return nil, &types.BucketAlreadyOwnedByYou{Message: aws.String("Bucket already exists")}
+	}
+	name := aws.ToString(params.Bucket)
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, memError("InvalidBucketName", "The specified bucket is not valid")
+	}
+	for _, sub := range []string{"objects", "meta", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(f.root, name, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &s3.CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+// ============================================
+// Multipart Uploads
+// ============================================
+
+// uploadDir returns the directory and manifest of a multipart upload.
+func (f *fsS3) uploadDir(bucket, key, uploadID *string) (string, *fsUploadMeta, error) {
+	dir, err := f.bucketDir(bucket)
+	if err != nil {
+		return "", nil, err
+	}
+	noSuchUpload := &types.NoSuchUpload{Message: aws.String("The specified multipart upload does not exist")}
+	id := aws.ToString(uploadID)
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", nil, noSuchUpload
+	}
+
+	udir := filepath.Join(dir, "uploads", id)
+	var meta fsUploadMeta
+	if err := readJSON(filepath.Join(udir, "upload.json"), &meta); err != nil || meta.Key != aws.ToString(key) {
+		return "", nil, noSuchUpload
+	}
+	return udir, &meta, nil
+}
+
+func (f *fsS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	dir, err := f.bucketDir(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := keyPath(dir, aws.ToString(params.Key), ""); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+	err = writeJSONAtomic(filepath.Join(dir, "uploads", uploadID, "upload.json"), fsUploadMeta{
+		Key:         aws.ToString(params.Key),
+		ContentType: aws.ToString(params.ContentType),
+		Metadata:    maps.Clone(params.Metadata),
+		Initiated:   time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   params.Bucket,
+		Key:      params.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func (f *fsS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	partNumber := aws.ToInt32(params.PartNumber)
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, memError("InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	udir, _, err := f.uploadDir(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = strings.NewReader("")
+	if params.Body != nil {
+		body = params.Body
+	}
+	name := filepath.Join(udir, strconv.Itoa(int(partNumber)))
+	_, sum, err := writeFileAtomic(name, body)
+	if err != nil {
+		return nil, err
+	}
+	etag := memETag(sum)
+	if _, _, err := writeFileAtomic(name+".etag", strings.NewReader(etag)); err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fsS3) UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	return uploadPartCopy(ctx, f, params)
+}
+
+// parts lists the stored parts of an upload, sorted by number.
+func (f *fsS3) parts(udir string) ([]types.Part, error) {
+	entries, err := os.ReadDir(udir)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]types.Part, 0)
+	for _, e := range entries {
+		number, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		etag, err := os.ReadFile(filepath.Join(udir, e.Name()+".etag"))
+		if err != nil {
+			// Part written but its ETag not yet; S3 would not list it either
+			continue
+		}
+		parts = append(parts, types.Part{
+			PartNumber:   aws.Int32(int32(number)),
+			ETag:         aws.String(string(etag)),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+func (f *fsS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	udir, meta, err := f.uploadDir(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if params.MultipartUpload == nil || len(params.MultipartUpload.Parts) == 0 {
+		return nil, memError("MalformedXML", "You must specify at least one part")
+	}
+
+	stored, err := f.parts(udir)
+	if err != nil {
+		return nil, err
+	}
+	byNumber := make(map[int32]types.Part, len(stored))
+	for _, p := range stored {
+		byNumber[aws.ToInt32(p.PartNumber)] = p
+	}
+
+	completed := params.MultipartUpload.Parts
+	var (
+		files []string
+		sums  []byte
+		last  int32
+	)
+	for i, cp := range completed {
+		number := aws.ToInt32(cp.PartNumber)
+		if number <= last {
+			return nil, memError("InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+		last = number
+
+		part, ok := byNumber[number]
+		if !ok || aws.ToString(part.ETag) != aws.ToString(cp.ETag) {
+			return nil, memError("InvalidPart", "Part %d could not be found or its ETag does not match", number)
+		}
+		if i < len(completed)-1 && aws.ToInt64(part.Size) < MIN_CHUNK_SIZE {
+			return nil, memError("EntityTooSmall", "Part %d is smaller than the minimum allowed size", number)
+		}
+		sum, err := hex.DecodeString(strings.Trim(aws.ToString(part.ETag), `"`))
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, sum...)
+		files = append(files, filepath.Join(udir, strconv.Itoa(int(number))))
+	}
+
+	dir := filepath.Dir(filepath.Dir(udir))
+	objPath, err := keyPath(filepath.Join(dir, "objects"), meta.Key, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := concatFiles(objPath, files); err != nil {
+		return nil, err
+	}
+
+	total := md5.Sum(sums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(total[:]), len(completed))
+	metaPath, _ := keyPath(filepath.Join(dir, "meta"), meta.Key, ".json")
+	err = writeJSONAtomic(metaPath, fsObjectMeta{
+		ETag:         etag,
+		ContentType:  meta.ContentType,
+		Metadata:     meta.Metadata,
+		LastModified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(udir)
+
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: params.Bucket,
+		Key:    params.Key,
+		ETag:   aws.String(etag),
+	}, nil
+}
+
+// concatFiles writes the concatenation of files to path.
+func concatFiles(path string, files []string) error {
+	readers := make([]io.Reader, 0, len(files))
+	for _, name := range files {
+		part, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer part.Close()
+		readers = append(readers, part)
+	}
+	_, _, err := writeFileAtomic(path, io.MultiReader(readers...))
+	return err
+}
+
+func (f *fsS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	udir, _, err := f.uploadDir(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(udir); err != nil {
+		return nil, err
+	}
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// ListMultipartUploads returns every upload under the prefix in one page.
+func (f *fsS3) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	dir, err := f.bucketDir(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "uploads"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	prefix := aws.ToString(params.Prefix)
+	uploads := make([]types.MultipartUpload, 0)
+	for _, e := range entries {
+		var meta fsUploadMeta
+		if readJSON(filepath.Join(dir, "uploads", e.Name(), "upload.json"), &meta) != nil {
+			continue
+		}
+		if strings.HasPrefix(meta.Key, prefix) {
+			uploads = append(uploads, types.MultipartUpload{
+				Key:       aws.String(meta.Key),
+				UploadId:  aws.String(e.Name()),
+				Initiated: aws.Time(meta.Initiated),
+			})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return aws.ToString(uploads[i].Key) < aws.ToString(uploads[j].Key)
+	})
+	return &s3.ListMultipartUploadsOutput{
+		Bucket:      params.Bucket,
+		Prefix:      params.Prefix,
+		Uploads:     uploads,
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+// ListParts returns every part of the upload in one page.
+func (f *fsS3) ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	udir, _, err := f.uploadDir(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := f.parts(udir)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.ListPartsOutput{
+		Bucket:      params.Bucket,
+		Key:         params.Key,
+		UploadId:    params.UploadId,
+		Parts:       parts,
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+// ============================================
+// Objects
+// ============================================
+
+// objectPaths returns the data and metadata paths of a key.
+func (f *fsS3) objectPaths(bucket, key *string) (string, string, error) {
+	dir, err := f.bucketDir(bucket)
+	if err != nil {
+		return "", "", err
+	}
+	data, err := keyPath(filepath.Join(dir, "objects"), aws.ToString(key), "")
+	if err != nil {
+		return "", "", err
+	}
+	meta, _ := keyPath(filepath.Join(dir, "meta"), aws.ToString(key), ".json")
+	return data, meta, nil
+}
+
+// objectMeta reads an object's metadata, reporting NoSuchKey if it is absent.
+func (f *fsS3) objectMeta(metaPath string) (*fsObjectMeta, error) {
+	var meta fsObjectMeta
+	if err := readJSON(metaPath, &meta); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+		}
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (f *fsS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	dataPath, metaPath, err := f.objectPaths(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = strings.NewReader("")
+	if params.Body != nil {
+		body = params.Body
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, sum, err := writeFileAtomic(dataPath, body)
+	if err != nil {
+		return nil, err
+	}
+	meta := fsObjectMeta{
+		ETag:            memETag(sum),
+		ContentType:     aws.ToString(params.ContentType),
+		ContentEncoding: aws.ToString(params.ContentEncoding),
+		Metadata:        maps.Clone(params.Metadata),
+		LastModified:    time.Now(),
+	}
+	if err := writeJSONAtomic(metaPath, meta); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(meta.ETag)}, nil
+}
+
+func (f *fsS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	dataPath, metaPath, err := f.objectPaths(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open under the lock so data and metadata match; the open file stays
+	// valid if the object is replaced meanwhile
+	f.mu.Lock()
+	meta, err := f.objectMeta(metaPath)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(dataPath)
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if ifMatch := aws.ToString(params.IfMatch); ifMatch != "" && ifMatch != meta.ETag {
+		file.Close()
+		return nil, memError("PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	size := info.Size()
+	out := &s3.GetObjectOutput{
+		ContentType:     aws.String(meta.ContentType),
+		ContentEncoding: nilIfEmpty(meta.ContentEncoding),
+		ETag:            aws.String(meta.ETag),
+		Metadata:        maps.Clone(meta.Metadata),
+		LastModified:    aws.Time(meta.LastModified),
+		AcceptRanges:    aws.String("bytes"),
+	}
+
+	start, end := int64(0), size
+	if rng := aws.ToString(params.Range); rng != "" {
+		var ok bool
+		if start, end, ok = parseByteRange(rng, size); !ok {
+			file.Close()
+			return nil, memError("InvalidRange", "The requested range is not satisfiable")
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	out.Body = &fileBody{LimitedReader: io.LimitedReader{R: file, N: end - start}, file: file}
+	out.ContentLength = aws.Int64(end - start)
+	return out, nil
+}
+
+// fileBody is a GetObject body read from the object's own file. io.Copy to an
+// HTTP response goes through WriteTo, which hands the limited file to the
+// response's ReadFrom: net/http recognises it and sends the range with
+// sendfile(2), so the bytes never pass through user space.
+type fileBody struct {
+	io.LimitedReader
+	file *os.File
+}
+
+func (b *fileBody) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, &b.LimitedReader)
+}
+
+func (b *fileBody) Close() error {
+	return b.file.Close()
+}
+
+func (f *fsS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	notFound := &types.NotFound{Message: aws.String("Not Found")}
+	dataPath, metaPath, err := f.objectPaths(params.Bucket, params.Key)
+	if err != nil {
+		return nil, notFound
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	meta, err := f.objectMeta(metaPath)
+	if err != nil {
+		// HEAD responses have no body, so S3 reports a generic NotFound
+		return nil, notFound
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, notFound
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength:   aws.Int64(info.Size()),
+		ContentType:     aws.String(meta.ContentType),
+		ContentEncoding: nilIfEmpty(meta.ContentEncoding),
+		ETag:            aws.String(meta.ETag),
+		Metadata:        maps.Clone(meta.Metadata),
+		LastModified:    aws.Time(meta.LastModified),
+	}, nil
+}
+
+func (f *fsS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	_, metaPath, err := f.objectPaths(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	meta, err := f.objectMeta(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: append([]types.Tag{}, meta.Tags...)}, nil
+}
+
+func (f *fsS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	_, metaPath, err := f.objectPaths(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	meta, err := f.objectMeta(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	meta.Tags = nil
+	if params.Tagging != nil {
+		meta.Tags = append([]types.Tag(nil), params.Tagging.TagSet...)
+	}
+	if err := writeJSONAtomic(metaPath, meta); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (f *fsS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if _, err := f.bucketDir(params.Bucket); err != nil {
+		return nil, err
+	}
+
+	out := &s3.DeleteObjectsOutput{}
+	if params.Delete == nil {
+		return out, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range params.Delete.Objects {
+		dataPath, metaPath, err := f.objectPaths(params.Bucket, id.Key)
+		if err != nil {
+			out.Errors = append(out.Errors, types.Error{Key: id.Key, Code: aws.String("InvalidArgument"), Message: aws.String(err.Error())})
+			continue
+		}
+		// Metadata first: without it the object no longer exists
+		os.Remove(metaPath)
+		os.Remove(dataPath)
+		if !aws.ToBool(params.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2 pages through keys in lexical order; the continuation token
+// is the last key returned. Keys are found by walking the metadata tree.
+func (f *fsS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	dir, err := f.bucketDir(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := aws.ToString(params.Prefix)
+	after := aws.ToString(params.StartAfter)
+	if token := aws.ToString(params.ContinuationToken); token != "" {
+		after = token
+	}
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys <= 0 || maxKeys > MEM_S3_LIST_MAX {
+		maxKeys = MEM_S3_LIST_MAX
+	}
+
+	metaRoot := filepath.Join(dir, "meta")
+	keys := make([]string, 0)
+	err = filepath.WalkDir(metaRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || strings.HasPrefix(name, ".tmp-") || !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(metaRoot, path)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:        params.Bucket,
+		Prefix:      params.Prefix,
+		MaxKeys:     aws.Int32(int32(maxKeys)),
+		IsTruncated: aws.Bool(len(keys) > maxKeys),
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		dataPath, metaPath, err := f.objectPaths(params.Bucket, aws.String(key))
+		if err != nil {
+			continue
+		}
+		meta, err := f.objectMeta(metaPath)
+		if err != nil {
+			continue // Deleted since the walk
+		}
+		info, err := os.Stat(dataPath)
+		if err != nil {
+			continue
+		}
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(info.Size()),
+			ETag:         aws.String(meta.ETag),
+			LastModified: aws.Time(meta.LastModified),
+		})
+	}
+	out.KeyCount = aws.Int32(int32(len(out.Contents)))
+	return out, nil
+}
@@ -0,0 +1,229 @@
+// health.go - Dependency-aware health checks for the HTTP API
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ============================================
+// Health Checks
+// ============================================
+
+const (
+	HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+	HEALTH_STATUS_OK       = "ok"
+	HEALTH_STATUS_DEGRADED = "degraded"
+	HEALTH_STATUS_DOWN     = "down"
+)
+
+// draining is set on SIGTERM; /readyz fails from then on so no new uploads
+// are routed here while in-flight ones finish.
+var draining atomic.Bool
+
+var (
+	// Below this much free space on the spool volume the server reports degraded
+	HEALTH_MIN_FREE_MB = envInt("HEALTH_MIN_FREE_MB", 512)
+	// Above this many goroutines something is leaking
+	HEALTH_MAX_GOROUTINES = envInt("HEALTH_MAX_GOROUTINES", 10000)
+)
+
+type CheckResult struct {
+	Status    string                 `json:"status"`
+	LatencyMS int64                  `json:"latency_ms"`
+	Error     string                 `json:"error,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+type HealthReport struct {
+	Status    string                  `json:"status"`
+	Timestamp time.Time               `json:"timestamp"`
+	Checks    map[string]*CheckResult `json:"checks"`
+}
+
+// Ping verifies the bucket is reachable with the configured credentials.
+func (s3c *S3Client) Ping(ctx context.Context) error {
+	_, err := s3c.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s3c.bucket),
+	})
+	return err
+}
+
+// Ping verifies the session table can be locked, catching a wedged manager.
+func (sm *SessionManager) Ping(ctx context.Context) (int, error) {
+	done := make(chan int, 1)
+	go func() {
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+		done <- len(sm.sessions)
+	}()
+
+	select {
+	case n := <-done:
+		return n, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("session store lock not acquired: %w", ctx.Err())
+	}
+}
+
+func (hs *HTTPServer) checkS3(ctx context.Context) *CheckResult {
+	if err := hs.sessionMgr.s3Client.Ping(ctx); err != nil {
+		return &CheckResult{Status: HEALTH_STATUS_DOWN, Error: err.Error()}
+	}
+	return &CheckResult{Status: HEALTH_STATUS_OK}
+}
+
+func (hs *HTTPServer) checkSessionStore(ctx context.Context) *CheckResult {
+	n, err := hs.sessionMgr.Ping(ctx)
+	if err != nil {
+		return &CheckResult{Status: HEALTH_STATUS_DOWN, Error: err.Error()}
+	}
+	result := &CheckResult{
+		Status:  HEALTH_STATUS_OK,
+		Details: map[string]interface{}{"sessions": n, "backend": SESSION_STORE},
+	}
+	// Uploads carry on in memory without the persistent store
+	if store := hs.sessionMgr.store; store != nil {
+		if err := store.Ping(ctx); err != nil {
+			result.Status = HEALTH_STATUS_DEGRADED
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+func (hs *HTTPServer) checkResources(ctx context.Context) *CheckResult {
+	result := &CheckResult{
+		Status: HEALTH_STATUS_OK,
+		Details: map[string]interface{}{
+			"goroutines": runtime.NumGoroutine(),
+		},
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	result.Details["heap_alloc"] = mem.HeapAlloc
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(hs.spool.dir, &fs); err != nil {
+		result.Status = HEALTH_STATUS_DEGRADED
+		result.Error = fmt.Sprintf("failed to stat spool volume: %v", err)
+		return result
+	}
+	freeBytes := fs.Bavail * uint64(fs.Bsize)
+	result.Details["spool_free_bytes"] = freeBytes
+
+	if freeBytes < uint64(HEALTH_MIN_FREE_MB)*1024*1024 {
+		result.Status = HEALTH_STATUS_DEGRADED
+		result.Error = fmt.Sprintf("spool volume low on space: %d MB free", freeBytes/1024/1024)
+	} else if runtime.NumGoroutine() > HEALTH_MAX_GOROUTINES {
+		result.Status = HEALTH_STATUS_DEGRADED
+		result.Error = "goroutine count above threshold"
+	}
+	return result
+}
+
+// runHealthChecks runs the given checks concurrently under one timeout.
+func runHealthChecks(ctx context.Context, checks map[string]func(context.Context) *CheckResult) *HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	report := &HealthReport{
+		Status:    HEALTH_STATUS_OK,
+		Timestamp: time.Now(),
+		Checks:    make(map[string]*CheckResult, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			result := check(ctx)
+			result.LatencyMS = time.Since(start).Milliseconds()
+
+			mu.Lock()
+			report.Checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Any failing dependency means uploads can't be accepted reliably
+	for _, result := range report.Checks {
+		switch result.Status {
+		case HEALTH_STATUS_DOWN:
+			report.Status = HEALTH_STATUS_DOWN
+		case HEALTH_STATUS_DEGRADED:
+			if report.Status == HEALTH_STATUS_OK {
+				report.Status = HEALTH_STATUS_DEGRADED
+			}
+		}
+	}
+	return report
+}
+
+// GET /health
+// Per-dependency status; 503 unless every check is ok.
+func (hs *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := runHealthChecks(r.Context(), map[string]func(context.Context) *CheckResult{
+		"s3":            hs.checkS3,
+		"session_store": hs.checkSessionStore,
+		"resources":     hs.checkResources,
+	})
+	writeHealthReport(w, r, report)
+}
+
+// GET /livez
+// The process is up and serving HTTP. Never checks dependencies, so a storage
+// outage does not get the pod restarted.
+func (hs *HTTPServer) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz
+// Whether this instance should receive new uploads: S3 and the session store
+// are reachable and the server is not draining.
+func (hs *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := runHealthChecks(r.Context(), map[string]func(context.Context) *CheckResult{
+		"s3":            hs.checkS3,
+		"session_store": hs.checkSessionStore,
+		"draining":      checkDraining,
+	})
+	writeHealthReport(w, r, report)
+}
+
+func checkDraining(ctx context.Context) *CheckResult {
+	if draining.Load() {
+		return &CheckResult{Status: HEALTH_STATUS_DOWN, Error: "server is draining"}
+	}
+	return &CheckResult{Status: HEALTH_STATUS_OK}
+}
+
+func writeHealthReport(w http.ResponseWriter, r *http.Request, report *HealthReport) {
+	status := http.StatusOK
+	if report.Status != HEALTH_STATUS_OK {
+		status = http.StatusServiceUnavailable
+		httpLog.WarnContext(r.Context(), "health check failing", "status", report.Status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
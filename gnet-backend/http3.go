@@ -0,0 +1,58 @@
+// http3.go - HTTP/3 listener for the HTTP API
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ============================================
+// HTTP/3
+// ============================================
+
+// Over TCP one lost packet stalls every request on the connection until it
+// is sent again, which on lossy mobile networks holds up the chunks in
+// flight and the streams being played. HTTP/3 runs each request on a QUIC
+// stream of its own over UDP, so a loss only delays the request it hit.
+//
+// With HTTP3_ADDR set the HTTP API is also served over HTTP/3 on that UDP
+// address, by the same handler as HTTP_ADDR: POST /upload/chunk, GET
+// /stream/... and every other route behave exactly as over TCP. QUIC always
+// uses TLS 1.3, with the certificate and key in HTTP3_TLS_CERT and
+// HTTP3_TLS_KEY, by default the binary TLS port's (tls.go). The gateway does
+// not proxy UDP, so clients reach HTTP3_ADDR directly. The Go SDK speaks it
+// given client.WithHTTPClient(&http.Client{Transport: &http3.Transport{}}).
+//
+// quic-go asks the kernel for UDP socket buffers of several MB and logs a
+// warning at startup when net.core.rmem_max and wmem_max are below that;
+// throughput suffers until they are raised.
+
+var (
+	HTTP3_ADDR     = envString("HTTP3_ADDR", "")
+	HTTP3_TLS_CERT = envString("HTTP3_TLS_CERT", GNET_TLS_CERT)
+	HTTP3_TLS_KEY  = envString("HTTP3_TLS_KEY", GNET_TLS_KEY)
+)
+
+// listenHTTP3 serves handler on HTTP3_ADDR until the listener fails.
+func listenHTTP3(handler http.Handler) error {
+	if HTTP3_TLS_CERT == "" || HTTP3_TLS_KEY == "" {
+		return errors.New("HTTP3_ADDR needs HTTP3_TLS_CERT and HTTP3_TLS_KEY")
+	}
+	cert, err := tls.LoadX509KeyPair(HTTP3_TLS_CERT, HTTP3_TLS_KEY)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	server := &http3.Server{
+		Addr:           HTTP3_ADDR,
+		Handler:        handler,
+		TLSConfig:      http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		IdleTimeout:    HTTP_IDLE_TIMEOUT,
+		MaxHeaderBytes: HTTP_MAX_HEADER_BYTES,
+	}
+	return server.ListenAndServe()
+}
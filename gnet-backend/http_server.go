@@ -0,0 +1,242 @@
+// http_server.go - HTTP API served alongside the binary protocol
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ============================================
+// HTTP Server
+// ============================================
+
+type HTTPServer struct {
+	sessionMgr *SessionManager
+	authMgr    *AuthManager
+	spool      *PreviewSpool
+	conns      *ConnRegistry
+	usage      *UsageMeter
+	recovery   *RecoveryReport
+	uploads    *FileUploadServer
+	streams    *StreamTokens
+	mux        *http.ServeMux
+
+	impersonations *Impersonations // Support admins acting as users; see impersonate.go
+	erasures       *Erasures       // Users' data being erased; see erase.go
+}
+
+func NewHTTPServer(sessionMgr *SessionManager, authMgr *AuthManager, spool *PreviewSpool, conns *ConnRegistry, usage *UsageMeter, recovery *RecoveryReport, uploads *FileUploadServer) *HTTPServer {
+	hs := &HTTPServer{
+		sessionMgr: sessionMgr,
+		authMgr:    authMgr,
+		spool:      spool,
+		conns:      conns,
+		usage:      usage,
+		recovery:   recovery,
+		uploads:    uploads,
+		streams:    NewStreamTokens(),
+		mux:        http.NewServeMux(),
+
+		impersonations: NewImpersonations(),
+		erasures:       NewErasures(),
+	}
+
+	hs.mux.HandleFunc("GET /stream/preview/{sessionID}", hs.handlePreview)
+	hs.mux.HandleFunc("POST /stream/token/{key...}", hs.handleStreamToken)
+	hs.mux.HandleFunc("GET /stream/files/{key...}", hs.handleStreamFile)
+	hs.mux.Handle("GET /metrics", promhttp.Handler())
+	hs.mux.HandleFunc("GET /health", hs.handleHealth)
+	hs.mux.HandleFunc("GET /livez", hs.handleLivez)
+	hs.mux.HandleFunc("GET /readyz", hs.handleReadyz)
+	hs.mux.HandleFunc("GET /usage", hs.handleUsage)
+	hs.mux.HandleFunc("GET /files", hs.handleListFiles)
+	hs.mux.HandleFunc("GET /files/{key...}", hs.handleDownload)
+	hs.mux.Handle("GET /admin/stats", requireAdmin(http.HandlerFunc(hs.handleAdminStats)))
+	hs.mux.Handle("GET /admin/recovery", requireAdmin(http.HandlerFunc(hs.handleRecoveryReport)))
+	hs.mux.Handle("GET /admin/tenants", requireAdmin(http.HandlerFunc(hs.handleListTenants)))
+	hs.registerUploadRoutes()
+	hs.registerQuotaRoutes()
+	hs.registerMetadataRoutes()
+	hs.registerTagRoutes()
+	hs.registerShareRoutes()
+	hs.registerTrashRoutes()
+	hs.registerVersionRoutes()
+	hs.registerTransferRoutes()
+	hs.registerGrantRoutes()
+	hs.registerSearchRoutes()
+	hs.registerExportRoutes()
+	hs.registerRetentionRoutes()
+	hs.registerVerificationRoutes()
+	hs.registerLegalHoldRoutes()
+	hs.registerActivityRoutes()
+	hs.registerCommentRoutes()
+	hs.registerStarRoutes()
+	hs.registerPresetRoutes()
+	hs.registerNotificationRoutes()
+	hs.registerDropRoutes()
+	hs.registerWebSocketRoutes()
+	hs.registerImpersonationRoutes()
+	hs.registerAnalyticsRoutes()
+	hs.registerErasureRoutes()
+	hs.registerDebugRoutes()
+
+	return hs
+}
+
+func (hs *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Reuse the gateway's request ID when present so both hops share it
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newCorrelationID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	r = r.WithContext(withCorrelationID(r.Context(), "request_id", requestID))
+
+	httpLog.InfoContext(r.Context(), "request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+	hs.mux.ServeHTTP(w, r)
+}
+
+// authenticate accepts "Authorization: Bearer <token>" or a ?token= query
+// parameter (needed by <video> tags, which cannot set headers).
+func (hs *HTTPServer) authenticate(r *http.Request) (*TokenInfo, bool) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil, false
+	}
+	if tokenInfo, ok := hs.authMgr.ValidateToken(token); ok {
+		return tokenInfo, true
+	}
+	return hs.authenticateImpersonation(r, token)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      message,
+		"request_id": w.Header().Get("X-Request-ID"),
+	})
+}
+
+// GET /stream/preview/{sessionID}[?follow=1]
+// Streams the contiguous leading chunks already received for a session. With
+// follow=1 the response is sent with chunked transfer encoding and keeps
+// growing as new leading chunks arrive.
+func (hs *HTTPServer) handlePreview(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	sessionID := r.PathValue("sessionID")
+	session := hs.sessionMgr.GetSession(sessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, "Invalid session ID")
+		return
+	}
+
+	if session.UserID != tokenInfo.UserID {
+		writeJSONError(w, http.StatusForbidden, "Session does not belong to user")
+		return
+	}
+
+	if r.URL.Query().Get("follow") == "1" {
+		hs.streamPreviewLive(w, r, session)
+		return
+	}
+
+	reader, err := hs.spool.Open(sessionID)
+	if err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to open preview spool", "session_id", sessionID, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to open preview")
+		return
+	}
+	defer reader.Close()
+
+	if reader.Size() == 0 {
+		writeJSONError(w, http.StatusNotFound, "No leading chunks received yet")
+		return
+	}
+
+	httpLog.InfoContext(r.Context(), "serving preview", "session_id", sessionID, "bytes", reader.Size())
+
+	w.Header().Set("Content-Type", session.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, session.FileName, time.Time{}, reader)
+	hs.usage.RecordStream(tokenInfo.UserID, cw.n)
+	streamBytes.WithLabelValues("preview").Add(float64(cw.n))
+}
+
+// streamPreviewLive writes spooled chunks in order as they become available.
+// The total size is unknown up front, so no Content-Length is set and the
+// response falls back to chunked transfer encoding.
+func (hs *HTTPServer) streamPreviewLive(w http.ResponseWriter, r *http.Request, session *UploadSession) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", session.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	limit := min(session.TotalChunks, hs.spool.maxChunks)
+	ticker := time.NewTicker(PREVIEW_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	var written int64
+	defer func() {
+		hs.usage.RecordStream(session.UserID, uint64(written))
+		streamBytes.WithLabelValues("preview").Add(float64(written))
+	}()
+	for index := uint32(0); index < limit; {
+		f, err := hs.spool.OpenChunk(session.SessionID, index)
+		if err == nil {
+			n, err := io.Copy(w, f)
+			f.Close()
+			written += n
+			if err != nil {
+				httpLog.WarnContext(r.Context(), "live preview aborted", "session_id", session.SessionID, "err", err)
+				return
+			}
+			flusher.Flush()
+			index++
+			continue
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			httpLog.ErrorContext(r.Context(), "failed to read spooled chunk", "session_id", session.SessionID, "chunk_index", index, "err", err)
+			return
+		}
+
+		// Chunk not there yet: stop once the session can no longer produce it
+		switch session.GetState() {
+		case STATE_COMPLETED, STATE_CANCELLED, STATE_FAILED:
+			httpLog.InfoContext(r.Context(), "live preview ended", "session_id", session.SessionID, "bytes", written)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	httpLog.InfoContext(r.Context(), "live preview finished", "session_id", session.SessionID, "bytes", written)
+}
@@ -0,0 +1,178 @@
+// immutable.go - Write-once uploads, kept by S3 Object Lock
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Immutable Uploads
+// ============================================
+
+// Some files must provably stay as they were uploaded: records kept for a
+// regulator, evidence, signed originals. An HTTP init can ask for that:
+//
+//	POST /upload/init   {..., "immutable": {"mode": "compliance", "retain_days": 2555}}
+//
+// When the upload completes, the object gets an S3 Object Lock retention in
+// that mode until retain_days after completion, and the lock is recorded with
+// the file, where GET /metadata shows it. Until then this server neither
+// deletes the file (nor moves it to the trash), whoever asks, nor lets
+// retention rules (retention.go) expire it; deletes answer 409. Its tags,
+// comments and stars can still change, but not its content. In S3,
+// governance mode can be lifted by a user with s3:BypassGovernanceRetention;
+// compliance mode by no one, the account's root included, until it runs out.
+//
+// This needs IMMUTABLE_UPLOADS=1, S3_BACKEND=s3 with a bucket that has
+// Object Lock enabled (a bucket the server creates has it), and METADATA_DB.
+// An immutable upload whose lock cannot be set fails, and its object is
+// removed rather than left unlocked. Instant uploads (dedup.go) do not apply
+// to immutable ones, and the binary protocol's init cannot ask for one.
+
+const (
+	IMMUTABLE_GOVERNANCE = "governance"
+	IMMUTABLE_COMPLIANCE = "compliance"
+)
+
+var (
+	IMMUTABLE_UPLOADS         = envBool("IMMUTABLE_UPLOADS", false)
+	IMMUTABLE_MAX_RETAIN_DAYS = envInt("IMMUTABLE_MAX_RETAIN_DAYS", 3650)
+)
+
+var (
+	errImmutable               = errors.New("File is immutable until its retention ends")
+	errImmutableNotFound       = errors.New("File is not immutable")
+	errImmutableUploadDisabled = errors.New("Immutable uploads are not enabled")
+)
+
+// ImmutableRequest is what an init asks for.
+type ImmutableRequest struct {
+	Mode       string `json:"mode"`
+	RetainDays int    `json:"retain_days"`
+}
+
+// ObjectLock is the retention of a completed immutable upload.
+type ObjectLock struct {
+	Key         string    `json:"-"`
+	Mode        string    `json:"mode"`
+	RetainUntil time.Time `json:"retain_until"`
+}
+
+func (req *ImmutableRequest) validate() error {
+	if !IMMUTABLE_UPLOADS || METADATA_DB == "" {
+		return errImmutableUploadDisabled
+	}
+	req.Mode = strings.ToLower(req.Mode)
+	if req.Mode != IMMUTABLE_GOVERNANCE && req.Mode != IMMUTABLE_COMPLIANCE {
+		return fmt.Errorf("immutable mode must be %s or %s", IMMUTABLE_GOVERNANCE, IMMUTABLE_COMPLIANCE)
+	}
+	if req.RetainDays < 1 || req.RetainDays > IMMUTABLE_MAX_RETAIN_DAYS {
+		return fmt.Errorf("retain_days must be 1 to %d", IMMUTABLE_MAX_RETAIN_DAYS)
+	}
+	return nil
+}
+
+// lockUpload records and sets the lock of session's just completed object,
+// if it asked for one. On failure the object is deleted.
+func (fus *FileUploadServer) lockUpload(ctx context.Context, session *UploadSession) error {
+	session.mu.Lock()
+	req := session.Immutable
+	session.mu.Unlock()
+	if req == nil {
+		return nil
+	}
+
+	lock := &ObjectLock{
+		Key:         session.S3Key,
+		Mode:        req.Mode,
+		RetainUntil: time.Now().UTC().AddDate(0, 0, req.RetainDays),
+	}
+	// Recorded first: a locked object this server does not know about
+	// could still be moved to the trash
+	err := fus.metadata.PutObjectLock(ctx, lock)
+	if err == nil {
+		if err = fus.s3Client.setObjectRetention(ctx, lock); err != nil {
+			if err := fus.metadata.DeleteObjectLock(context.WithoutCancel(ctx), lock.Key); err != nil {
+				s3Log.ErrorContext(ctx, "failed to remove object lock record", "s3_key", lock.Key, "err", err)
+			}
+		}
+	}
+	if err != nil {
+		if err := fus.s3Client.deleteObject(context.WithoutCancel(ctx), session.S3Key); err != nil {
+			s3Log.ErrorContext(ctx, "failed to remove object that could not be locked", "s3_key", session.S3Key, "err", err)
+		}
+		return fmt.Errorf("failed to lock immutable upload: %w", err)
+	}
+	s3Log.InfoContext(ctx, "locked immutable upload", "s3_key", lock.Key, "mode", lock.Mode, "retain_until", lock.RetainUntil)
+	return nil
+}
+
+// checkImmutable returns errImmutable if key is locked, or the error that
+// keeps it from knowing. Without a metadata store nothing is locked.
+func (fus *FileUploadServer) checkImmutable(ctx context.Context, key string) error {
+	lock, err := fus.metadata.GetObjectLock(ctx, key)
+	switch {
+	case err == nil && time.Now().Before(lock.RetainUntil):
+		return errImmutable
+	case err == nil, errors.Is(err, errImmutableNotFound), errors.Is(err, errMetadataDisabled):
+		return nil
+	default:
+		return err
+	}
+}
+
+// setObjectRetention sets the Object Lock retention of lock's object.
+func (s3c *S3Client) setObjectRetention(ctx context.Context, lock *ObjectLock) error {
+	if s3c.locks == nil {
+		return errImmutableUploadDisabled
+	}
+	mode := types.ObjectLockRetentionModeGovernance
+	if lock.Mode == IMMUTABLE_COMPLIANCE {
+		mode = types.ObjectLockRetentionModeCompliance
+	}
+	_, err := s3c.locks.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{
+		Bucket:    aws.String(s3c.bucket),
+		Key:       aws.String(lock.Key),
+		Retention: &types.ObjectLockRetention{Mode: mode, RetainUntilDate: aws.Time(lock.RetainUntil)},
+	})
+	return err
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) PutObjectLock(ctx context.Context, lock *ObjectLock) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO object_locks (s3_key, mode, retain_until) VALUES ($1, $2, $3)
+		ON CONFLICT (s3_key) DO UPDATE SET mode = excluded.mode, retain_until = excluded.retain_until`,
+		lock.Key, lock.Mode, lock.RetainUntil)
+	return err
+}
+
+func (ms *sqlMetadataStore) GetObjectLock(ctx context.Context, key string) (*ObjectLock, error) {
+	lock := &ObjectLock{Key: key}
+	err := ms.db.QueryRowContext(ctx, `SELECT mode, retain_until FROM object_locks WHERE s3_key = $1`, key).
+		Scan(&lock.Mode, &lock.RetainUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errImmutableNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (ms *sqlMetadataStore) DeleteObjectLock(ctx context.Context, key string) error {
+	_, err := ms.db.ExecContext(ctx, `DELETE FROM object_locks WHERE s3_key = $1`, key)
+	return err
+}
@@ -0,0 +1,275 @@
+// impersonate.go - Support admins acting on behalf of a user
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Impersonation
+// ============================================
+
+// A support admin opens an impersonation to act for a user: a token that
+// acts as the user on the HTTP API, for a while, within a scope, and leaves
+// a trail:
+//
+//	POST   /admin/impersonations        {"user_id", "operator", "reason", ["scopes"], ["read_only"], ["expires_in_seconds"]}
+//	GET    /admin/impersonations        the open ones, newest first
+//	DELETE /admin/impersonations/{id}   end one early
+//
+// Scopes are "sessions" (the upload API: status, pause, resume, cancel and
+// chunks, plus previews) and "files" (listing, downloads, metadata, tags,
+// versions, the trash and the activity feed); both by default. With
+// read_only only GET and HEAD requests go through. Share and drop links,
+// streaming tokens, grants, comments, copies and transfers to other users,
+// exports and notification preferences are never in scope: they would
+// outlive the impersonation, speak for the user, give their files away or
+// reach their mailbox.
+//
+// The token goes in Authorization like the user's own. Every request made
+// with it, in scope or not, is audit-logged as impersonation.request with
+// the operator, the impersonation's ID and the request line; opening and
+// ending one are logged too. Impersonations are kept in memory and end with
+// the server (or after IMPERSONATION_MAX_TTL_MINUTES at most). The binary
+// protocol does not take them.
+
+var (
+	IMPERSONATION_DEFAULT_TTL = time.Duration(envInt("IMPERSONATION_DEFAULT_TTL_MINUTES", 60)) * time.Minute
+	IMPERSONATION_MAX_TTL     = time.Duration(envInt("IMPERSONATION_MAX_TTL_MINUTES", 240)) * time.Minute
+)
+
+const (
+	IMPERSONATION_SCOPE_SESSIONS = "sessions"
+	IMPERSONATION_SCOPE_FILES    = "files"
+
+	IMPERSONATION_MAX_REASON = 1024
+)
+
+// The paths each scope opens, by prefix
+var impersonationScopes = map[string][]string{
+	IMPERSONATION_SCOPE_SESSIONS: {"/upload/", "/stream/preview/", "/usage"},
+	IMPERSONATION_SCOPE_FILES:    {"/files", "/metadata", "/tags", "/stream/", "/activity", "/usage"},
+}
+
+// Paths no scope opens, though a scope's prefix covers them
+var impersonationDenied = []string{"/files/share", "/files/drops", "/files/grants", "/files/comments", "/files/copy", "/files/transfer", "/stream/token/", "/exports", "/notifications"}
+
+type Impersonation struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token,omitempty"` // Only when created
+	UserID    string    `json:"user_id"`
+	Operator  string    `json:"operator"` // The support admin acting
+	Reason    string    `json:"reason"`
+	Scopes    []string  `json:"scopes"`
+	ReadOnly  bool      `json:"read_only"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type CreateImpersonationRequest struct {
+	UserID           string   `json:"user_id"`
+	Operator         string   `json:"operator"`
+	Reason           string   `json:"reason"`
+	Scopes           []string `json:"scopes"`
+	ReadOnly         bool     `json:"read_only"`
+	ExpiresInSeconds int64    `json:"expires_in_seconds"`
+}
+
+// allows reports whether r is in the impersonation's scope.
+func (imp *Impersonation) allows(r *http.Request) bool {
+	if imp.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	path := r.URL.Path
+	if slices.ContainsFunc(impersonationDenied, func(p string) bool { return strings.HasPrefix(path, p) }) {
+		return false
+	}
+	for _, scope := range imp.Scopes {
+		if slices.ContainsFunc(impersonationScopes[scope], func(p string) bool { return strings.HasPrefix(path, p) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Impersonations holds the open impersonations, by token.
+type Impersonations struct {
+	byToken map[string]*Impersonation
+	mu      sync.Mutex
+}
+
+func NewImpersonations() *Impersonations {
+	return &Impersonations{byToken: make(map[string]*Impersonation)}
+}
+
+func (is *Impersonations) add(imp *Impersonation) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.byToken[imp.Token] = imp
+}
+
+// lookup returns the open impersonation of token, if any.
+func (is *Impersonations) lookup(token string) (*Impersonation, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	imp, ok := is.byToken[token]
+	if ok && time.Now().After(imp.ExpiresAt) {
+		delete(is.byToken, token)
+		auditLog.Record(AUDIT_IMPERSONATION_ENDED, imp.UserID, "", "", imp.ID+" expired")
+		return nil, false
+	}
+	return imp, ok
+}
+
+// list returns the open impersonations, newest first, without their tokens.
+func (is *Impersonations) list() []Impersonation {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	now := time.Now()
+	open := make([]Impersonation, 0, len(is.byToken))
+	for token, imp := range is.byToken {
+		if now.After(imp.ExpiresAt) {
+			delete(is.byToken, token)
+			auditLog.Record(AUDIT_IMPERSONATION_ENDED, imp.UserID, "", "", imp.ID+" expired")
+			continue
+		}
+		listed := *imp
+		listed.Token = ""
+		open = append(open, listed)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].CreatedAt.After(open[j].CreatedAt) })
+	return open
+}
+
+// end removes the impersonation with id, reporting whether it was open.
+func (is *Impersonations) end(id string) (*Impersonation, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for token, imp := range is.byToken {
+		if imp.ID == id {
+			delete(is.byToken, token)
+			return imp, true
+		}
+	}
+	return nil, false
+}
+
+// authenticateImpersonation is authenticate's fallback for tokens that are
+// not users' own. A request out of the impersonation's scope is refused
+// like one with a bad token.
+func (hs *HTTPServer) authenticateImpersonation(r *http.Request, token string) (*TokenInfo, bool) {
+	imp, ok := hs.impersonations.lookup(token)
+	if !ok {
+		return nil, false
+	}
+	allowed := imp.allows(r)
+	detail := fmt.Sprintf("%s by %s: %s %s", imp.ID, imp.Operator, r.Method, r.URL.Path)
+	if !allowed {
+		detail += " (out of scope)"
+	}
+	auditLog.Record(AUDIT_IMPERSONATED_REQUEST, imp.UserID, "", r.RemoteAddr, detail)
+	if !allowed {
+		return nil, false
+	}
+	return &TokenInfo{
+		UserID:    imp.UserID,
+		Username:  imp.UserID,
+		ExpiresAt: imp.ExpiresAt,
+		Tenant:    hs.uploads.tenantOf(imp.UserID),
+	}, true
+}
+
+func (hs *HTTPServer) registerImpersonationRoutes() {
+	hs.mux.Handle("POST /admin/impersonations", requireAdmin(http.HandlerFunc(hs.handleCreateImpersonation)))
+	hs.mux.Handle("GET /admin/impersonations", requireAdmin(http.HandlerFunc(hs.handleListImpersonations)))
+	hs.mux.Handle("DELETE /admin/impersonations/{id}", requireAdmin(http.HandlerFunc(hs.handleEndImpersonation)))
+}
+
+// POST /admin/impersonations
+func (hs *HTTPServer) handleCreateImpersonation(w http.ResponseWriter, r *http.Request) {
+	var req CreateImpersonationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.UserID == "" || keyOwner(req.UserID+"/") != req.UserID {
+		writeJSONError(w, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if req.Operator == "" || len(req.Operator) > 256 {
+		writeJSONError(w, http.StatusBadRequest, "operator must be 1 to 256 bytes")
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > IMPERSONATION_MAX_REASON {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("reason must be 1 to %d bytes", IMPERSONATION_MAX_REASON))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{IMPERSONATION_SCOPE_SESSIONS, IMPERSONATION_SCOPE_FILES}
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := impersonationScopes[scope]; !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope %q (want sessions or files)", scope))
+			return
+		}
+	}
+	ttl := time.Duration(req.ExpiresInSeconds) * time.Second
+	if ttl == 0 {
+		ttl = IMPERSONATION_DEFAULT_TTL
+	}
+	if ttl < 0 || ttl > IMPERSONATION_MAX_TTL {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("expires_in_seconds must be between 1 and %d", int64(IMPERSONATION_MAX_TTL.Seconds())))
+		return
+	}
+
+	id, token := make([]byte, 8), make([]byte, 32)
+	rand.Read(id)
+	rand.Read(token)
+	now := time.Now().UTC()
+	imp := &Impersonation{
+		ID:        hex.EncodeToString(id),
+		Token:     hex.EncodeToString(token),
+		UserID:    req.UserID,
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		ReadOnly:  req.ReadOnly,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	hs.impersonations.add(imp)
+	auditLog.Record(AUDIT_IMPERSONATION_STARTED, imp.UserID, "", r.RemoteAddr,
+		fmt.Sprintf("%s by %s (%s, read_only=%t, until %s): %s", imp.ID, imp.Operator, strings.Join(imp.Scopes, ","), imp.ReadOnly,
+			imp.ExpiresAt.Format(time.RFC3339), imp.Reason))
+	authLog.Warn("impersonation started", "id", imp.ID, "user_id", imp.UserID, "operator", imp.Operator,
+		"scopes", imp.Scopes, "read_only", imp.ReadOnly, "expires_at", imp.ExpiresAt)
+
+	writeJSON(w, http.StatusCreated, imp)
+}
+
+// GET /admin/impersonations
+func (hs *HTTPServer) handleListImpersonations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"impersonations": hs.impersonations.list()})
+}
+
+// DELETE /admin/impersonations/{id}
+func (hs *HTTPServer) handleEndImpersonation(w http.ResponseWriter, r *http.Request) {
+	imp, ok := hs.impersonations.end(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Impersonation not found")
+		return
+	}
+	auditLog.Record(AUDIT_IMPERSONATION_ENDED, imp.UserID, "", r.RemoteAddr, imp.ID+" ended by admin")
+	authLog.Info("impersonation ended", "id", imp.ID, "user_id", imp.UserID, "operator", imp.Operator)
+	w.WriteHeader(http.StatusNoContent)
+}
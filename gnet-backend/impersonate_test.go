@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestImpersonationScope(t *testing.T) {
+	imp := &Impersonation{Scopes: []string{IMPERSONATION_SCOPE_SESSIONS, IMPERSONATION_SCOPE_FILES}}
+	tests := []struct {
+		method string
+		path   string
+		allow  bool
+	}{
+		{http.MethodGet, "/files/user_123/1/file.mp4", true},
+		{http.MethodGet, "/stream/files/user_123/1/file.mp4", true},
+		{http.MethodGet, "/stream/preview/user_123_1", true},
+		{http.MethodPost, "/upload/pause/user_123_1", true},
+		// Outlive the impersonation or give files away
+		{http.MethodPost, "/stream/token/user_123/1/file.mp4", false},
+		{http.MethodPost, "/files/share", false},
+		{http.MethodPost, "/files/copy", false},
+		{http.MethodPost, "/files/transfer", false},
+		{http.MethodPost, "/exports", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := imp.allows(r); got != tt.allow {
+			t.Errorf("%s %s: allowed %v, want %v", tt.method, tt.path, got, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// integrity.go - Structural validation of finalized media objects
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Media Integrity Probe
+// ============================================
+
+const (
+	PROBE_TIMEOUT      = 30 * time.Second
+	PROBE_HEADER_BYTES = 16
+	PROBE_MAX_BOXES    = 256 // Upper bound on top-level MP4 boxes walked
+
+	INTEGRITY_OK      = "ok"
+	INTEGRITY_CORRUPT = "corrupt"
+)
+
+type IntegrityResult struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	S3Key     string `json:"s3_key"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// readRange fetches [offset, offset+length) of an object.
+func (c *S3Client) readRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// probeMedia checks that the object looks like the file type it claims to be.
+// It only reads headers, never the full object.
+func (c *S3Client) probeMedia(ctx context.Context, key, ext string, size int64) error {
+	if size < PROBE_HEADER_BYTES {
+		return fmt.Errorf("object too small: %d bytes", size)
+	}
+
+	header, err := c.readRange(ctx, key, 0, PROBE_HEADER_BYTES)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	switch ext {
+	case ".mp4", ".mov":
+		return c.probeMP4(ctx, key, size)
+	case ".jpg", ".jpeg":
+		if !bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}) {
+			return fmt.Errorf("missing JPEG SOI marker")
+		}
+	case ".png":
+		if !bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")) {
+			return fmt.Errorf("missing PNG signature")
+		}
+	case ".gif":
+		if !bytes.HasPrefix(header, []byte("GIF87a")) && !bytes.HasPrefix(header, []byte("GIF89a")) {
+			return fmt.Errorf("missing GIF signature")
+		}
+	case ".webp":
+		if !bytes.HasPrefix(header, []byte("RIFF")) || !bytes.Equal(header[8:12], []byte("WEBP")) {
+			return fmt.Errorf("missing RIFF/WEBP signature")
+		}
+	case ".avi":
+		if !bytes.HasPrefix(header, []byte("RIFF")) || !bytes.Equal(header[8:12], []byte("AVI ")) {
+			return fmt.Errorf("missing RIFF/AVI signature")
+		}
+	case ".mkv":
+		if !bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+			return fmt.Errorf("missing EBML header")
+		}
+	case ".pdf":
+		if !bytes.HasPrefix(header, []byte("%PDF-")) {
+			return fmt.Errorf("missing %%PDF- header")
+		}
+	}
+
+	return nil
+}
+
+// probeMP4 walks the top-level boxes and requires a moov atom. The moov atom
+// may sit at either end of the file, so every box header is visited.
+func (c *S3Client) probeMP4(ctx context.Context, key string, size int64) error {
+	var offset int64
+	hasFtyp, hasMoov := false, false
+
+	for i := 0; i < PROBE_MAX_BOXES && offset < size; i++ {
+		length := min(int64(PROBE_HEADER_BYTES), size-offset)
+		if length < 8 {
+			return fmt.Errorf("truncated box header at offset %d", offset)
+		}
+
+		hdr, err := c.readRange(ctx, key, offset, length)
+		if err != nil {
+			return fmt.Errorf("failed to read box at offset %d: %w", offset, err)
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		boxType := string(hdr[4:8])
+
+		switch boxSize {
+		case 0: // Box extends to end of file
+			boxSize = size - offset
+		case 1: // 64-bit extended size
+			if len(hdr) < 16 {
+				return fmt.Errorf("truncated extended box header at offset %d", offset)
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		}
+
+		if boxSize < 8 || offset+boxSize > size {
+			return fmt.Errorf("invalid %q box size %d at offset %d", boxType, boxSize, offset)
+		}
+
+		switch boxType {
+		case "ftyp":
+			hasFtyp = true
+		case "moov":
+			hasMoov = true
+		}
+
+		offset += boxSize
+	}
+
+	if !hasFtyp {
+		return fmt.Errorf("missing ftyp box")
+	}
+	if !hasMoov {
+		return fmt.Errorf("missing moov atom")
+	}
+	return nil
+}
+
+// verifyIntegrity probes a finalized upload, tags the object with the result
+// and fires the integrity webhook if the object looks corrupt.
+func (fus *FileUploadServer) verifyIntegrity(ctx context.Context, session *UploadSession) {
+	ctx, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+	defer cancel()
+
+	result := IntegrityResult{
+		SessionID: session.SessionID,
+		UserID:    session.UserID,
+		S3Key:     session.S3Key,
+		Status:    INTEGRITY_OK,
+	}
+
+	// session.TotalSize assumes every chunk is full-sized; use the real length
+	head, err := fus.s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(fus.s3Client.bucket),
+		Key:    aws.String(session.S3Key),
+	})
+	if err != nil {
+		s3Log.WarnContext(ctx, "integrity probe skipped, HeadObject failed", "session_id", session.SessionID, "s3_key", session.S3Key, "err", err)
+		return
+	}
+
+	if err := fus.s3Client.probeMedia(ctx, session.S3Key, session.FileExtension, aws.ToInt64(head.ContentLength)); err != nil {
+		result.Status = INTEGRITY_CORRUPT
+		result.Reason = err.Error()
+		s3Log.ErrorContext(ctx, "integrity probe failed", "session_id", session.SessionID, "s3_key", session.S3Key, "reason", err)
+	} else {
+		s3Log.InfoContext(ctx, "integrity probe passed", "session_id", session.SessionID, "s3_key", session.S3Key)
+	}
+
+	session.mu.Lock()
+	session.Integrity = result.Status
+	session.mu.Unlock()
+
+	// Keeps the user's tags (tags.go)
+	isIntegrityTag := func(name string) bool { return name == "integrity" }
+	err = fus.s3Client.replaceObjectTags(ctx, session.S3Key, isIntegrityTag,
+		[]types.Tag{{Key: aws.String("integrity"), Value: aws.String(result.Status)}})
+	if err != nil {
+		s3Log.WarnContext(ctx, "failed to tag object", "s3_key", session.S3Key, "err", err)
+	}
+
+	if result.Status == INTEGRITY_CORRUPT {
+		sendWebhook(ctx, INTEGRITY_WEBHOOK_URL, "upload.corrupt", result)
+	}
+}
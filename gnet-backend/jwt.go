@@ -0,0 +1,409 @@
+// jwt.go - JSON Web Token authentication
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// JWT Authentication
+// ============================================
+
+// Besides the static tokens of AuthManager and TENANTS_FILE, both protocols
+// accept JWTs from an identity provider:
+//
+//   - HS256, signed with JWT_SECRET
+//   - RS256, signed with a key of the JWKS at JWT_JWKS_URL, picked by the
+//     token's kid
+//
+// A token must carry exp, and iss and aud must match JWT_ISSUER and
+// JWT_AUDIENCE when those are set. JWT_USER_CLAIM (sub) is the user ID and
+// JWT_USERNAME_CLAIM (preferred_username, falling back to the user ID) the
+// name. With JWT_TENANT_CLAIM set, a token naming a tenant of TENANTS_FILE
+// belongs to that tenant's user; one naming an unknown or disabled tenant is
+// refused.
+//
+// Authentication runs on the event loop, so it never waits on the JWKS: the
+// keys are fetched in the background every JWT_JWKS_REFRESH_SECONDS, and a
+// token with an unknown kid is refused while the keys are fetched again (at
+// most every JWKS_MIN_REFETCH), so the client's retry succeeds after a key
+// rotation. JWTs cannot be revoked one by one; revoking a user (erase.go)
+// refuses the tokens issued to them before it.
+
+const (
+	JWKS_MIN_REFETCH = 30 * time.Second
+	JWKS_TIMEOUT     = 10 * time.Second
+	JWKS_MAX_SIZE    = 1024 * 1024
+)
+
+var (
+	JWT_SECRET         = envString("JWT_SECRET", "")   // HS256 key; empty refuses HS256
+	JWT_JWKS_URL       = envString("JWT_JWKS_URL", "") // RS256 keys; empty refuses RS256
+	JWT_ISSUER         = envString("JWT_ISSUER", "")
+	JWT_AUDIENCE       = envString("JWT_AUDIENCE", "")
+	JWT_USER_CLAIM     = envString("JWT_USER_CLAIM", "sub")
+	JWT_USERNAME_CLAIM = envString("JWT_USERNAME_CLAIM", "preferred_username")
+	JWT_TENANT_CLAIM   = envString("JWT_TENANT_CLAIM", "")
+	JWT_LEEWAY         = time.Duration(envInt("JWT_LEEWAY_SECONDS", 60)) * time.Second
+	JWT_JWKS_REFRESH   = time.Duration(envInt("JWT_JWKS_REFRESH_SECONDS", 3600)) * time.Second
+)
+
+// A JWT's user ID becomes the first segment of S3 keys. It cannot start with
+// "_", like the server's own prefixes (audit, trash, exports, erasures).
+var jwtUserIDPattern = regexp.MustCompile(`^[A-Za-z0-9@|:-][A-Za-z0-9_.@|:-]{0,127}$`)
+
+var (
+	errJWTMalformed  = errors.New("Malformed token")
+	errJWTSignature  = errors.New("Invalid signature")
+	errJWTUnknownKey = errors.New("Unknown signing key")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type JWTVerifier struct {
+	secret  []byte
+	jwks    *JWKS
+	tenants map[string]*Tenant
+}
+
+// NewJWTVerifier returns nil when neither JWT_SECRET nor JWT_JWKS_URL is set.
+func NewJWTVerifier(tenants map[string]*Tenant) (*JWTVerifier, error) {
+	if JWT_SECRET == "" && JWT_JWKS_URL == "" {
+		return nil, nil
+	}
+	if JWT_TENANT_CLAIM != "" && len(tenants) == 0 {
+		return nil, fmt.Errorf("JWT_TENANT_CLAIM needs TENANTS_FILE")
+	}
+
+	jv := &JWTVerifier{tenants: tenants}
+	if JWT_SECRET != "" {
+		jv.secret = []byte(JWT_SECRET)
+	}
+	if JWT_JWKS_URL != "" {
+		jv.jwks = NewJWKS(JWT_JWKS_URL)
+	}
+	authLog.Info("accepting JWTs", "hs256", jv.secret != nil, "jwks", JWT_JWKS_URL,
+		"issuer", JWT_ISSUER, "audience", JWT_AUDIENCE, "user_claim", JWT_USER_CLAIM)
+	return jv, nil
+}
+
+// looksLikeJWT tells a JWT from a static token without decoding it.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// Verify checks token's signature and claims, returning who it is for and
+// when it was issued (zero without iat).
+func (jv *JWTVerifier) Verify(token string) (*TokenInfo, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, time.Time{}, errJWTMalformed
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, time.Time{}, errJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, time.Time{}, errJWTMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if jv.secret == nil {
+			return nil, time.Time{}, fmt.Errorf("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, jv.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, time.Time{}, errJWTSignature
+		}
+	case "RS256":
+		if jv.jwks == nil {
+			return nil, time.Time{}, fmt.Errorf("RS256 tokens are not accepted")
+		}
+		key := jv.jwks.Key(header.Kid)
+		if key == nil {
+			return nil, time.Time{}, errJWTUnknownKey
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, time.Time{}, errJWTSignature
+		}
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, time.Time{}, errJWTMalformed
+	}
+	return jv.tokenInfo(claims)
+}
+
+func (jv *JWTVerifier) tokenInfo(claims map[string]interface{}) (*TokenInfo, time.Time, error) {
+	now := time.Now()
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("missing exp")
+	}
+	if now.After(exp.Add(JWT_LEEWAY)) {
+		return nil, time.Time{}, fmt.Errorf("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(JWT_LEEWAY).Before(nbf) {
+		return nil, time.Time{}, fmt.Errorf("token not yet valid")
+	}
+	iat, _ := numericDate(claims["iat"])
+	if JWT_ISSUER != "" && claims["iss"] != JWT_ISSUER {
+		return nil, time.Time{}, fmt.Errorf("wrong issuer")
+	}
+	if JWT_AUDIENCE != "" && !hasAudience(claims["aud"], JWT_AUDIENCE) {
+		return nil, time.Time{}, fmt.Errorf("wrong audience")
+	}
+
+	userID, _ := claims[JWT_USER_CLAIM].(string)
+	if !jwtUserIDPattern.MatchString(userID) {
+		return nil, time.Time{}, fmt.Errorf("invalid %s claim", JWT_USER_CLAIM)
+	}
+	username, _ := claims[JWT_USERNAME_CLAIM].(string)
+	if username == "" {
+		username = userID
+	}
+	info := &TokenInfo{UserID: userID, Username: username, ExpiresAt: exp}
+
+	if JWT_TENANT_CLAIM != "" {
+		if id, _ := claims[JWT_TENANT_CLAIM].(string); id != "" {
+			tenant := jv.tenants[id]
+			if tenant == nil || tenant.Disabled {
+				return nil, time.Time{}, fmt.Errorf("unknown tenant %q", id)
+			}
+			info.UserID = tenant.userPrefix() + userID
+			info.Tenant = tenant
+		}
+	}
+	if info.Tenant == nil && reservedKeyRoot(userID) {
+		return nil, time.Time{}, fmt.Errorf("invalid %s claim", JWT_USER_CLAIM)
+	}
+	return info, iat, nil
+}
+
+// reservedKeyRoot reports whether userID is the first segment of a prefix the
+// server writes itself. Ownership is a key prefix, so such a user could list,
+// read and delete everything under it. The prefixes are configurable and need
+// not start with "_".
+func reservedKeyRoot(userID string) bool {
+	for _, prefix := range []string{TENANT_KEY_ROOT, AUDIT_PREFIX, TRASH_PREFIX, EXPORT_PREFIX, ERASURE_PREFIX} {
+		if strings.HasPrefix(strings.TrimSuffix(prefix, "/")+"/", userID+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience reports whether aud, a string or an array of them, has want.
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateJWT is ValidateToken for a token not in am.tokens. Caller holds
+// am.mu for reading.
+func (am *AuthManager) validateJWT(token string) (*TokenInfo, bool) {
+	if am.jwt == nil || !looksLikeJWT(token) {
+		return nil, false
+	}
+	info, issuedAt, err := am.jwt.Verify(token)
+	if err != nil {
+		authLog.Debug("JWT refused", "err", err)
+		return nil, false
+	}
+	if revokedAt, ok := am.revoked[info.UserID]; ok && !issuedAt.After(revokedAt) {
+		authLog.Debug("JWT refused", "user", info.UserID, "err", "issued before the user was revoked")
+		return nil, false
+	}
+	return info, true
+}
+
+// ============================================
+// JWKS
+// ============================================
+
+// JWKS holds the RSA keys of a JSON Web Key Set, refreshed in the background.
+type JWKS struct {
+	url       string
+	client    *http.Client
+	keys      map[string]*rsa.PublicKey // By kid
+	fetchedAt time.Time
+	fetching  bool
+	mu        sync.RWMutex
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewJWKS(url string) *JWKS {
+	jwks := &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: JWKS_TIMEOUT},
+		keys:   make(map[string]*rsa.PublicKey),
+	}
+	if err := jwks.fetch(); err != nil {
+		// Keep going; the refresh loop retries
+		authLog.Warn("failed to fetch JWKS", "url", url, "err", err)
+	}
+	go jwks.refreshLoop()
+	return jwks
+}
+
+// Key returns the key with kid, or the only key when kid is empty. An
+// unknown kid starts a fetch in the background.
+func (jwks *JWKS) Key(kid string) *rsa.PublicKey {
+	jwks.mu.RLock()
+	key := jwks.keys[kid]
+	if key == nil && kid == "" && len(jwks.keys) == 1 {
+		for _, only := range jwks.keys {
+			key = only
+		}
+	}
+	stale := key == nil && !jwks.fetching && time.Since(jwks.fetchedAt) > JWKS_MIN_REFETCH
+	jwks.mu.RUnlock()
+
+	if stale {
+		jwks.mu.Lock()
+		if !jwks.fetching {
+			jwks.fetching = true
+			go func() {
+				if err := jwks.fetch(); err != nil {
+					authLog.Warn("failed to fetch JWKS", "url", jwks.url, "err", err)
+				}
+			}()
+		}
+		jwks.mu.Unlock()
+	}
+	return key
+}
+
+func (jwks *JWKS) refreshLoop() {
+	ticker := time.NewTicker(JWT_JWKS_REFRESH)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := jwks.fetch(); err != nil {
+			authLog.Warn("failed to refresh JWKS", "url", jwks.url, "err", err)
+		}
+	}
+}
+
+// fetch replaces the keys with the set at jwks.url. The old keys stay when
+// the fetch fails.
+func (jwks *JWKS) fetch() error {
+	defer func() {
+		jwks.mu.Lock()
+		jwks.fetching = false
+		jwks.fetchedAt = time.Now()
+		jwks.mu.Unlock()
+	}()
+
+	resp, err := jwks.client.Get(jwks.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, JWKS_MAX_SIZE)).Decode(&set); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+		key, err := jwk.rsaKey()
+		if err != nil {
+			authLog.Warn("skipping invalid JWKS key", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS has no RS256 keys")
+	}
+
+	jwks.mu.Lock()
+	jwks.keys = keys
+	jwks.mu.Unlock()
+	authLog.Info("fetched JWKS", "url", jwks.url, "keys", len(keys))
+	return nil
+}
+
+func (jwk *jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	if key.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("key shorter than 2048 bits")
+	}
+	return key, nil
+}
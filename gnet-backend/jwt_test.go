@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signTestJWT returns an HS256 token for sub, signed with secret.
+func signTestJWT(t *testing.T, secret, sub string) string {
+	t.Helper()
+	claims, err := json.Marshal(map[string]any{"sub": sub, "exp": time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// A user whose ID is the first segment of a server prefix would own
+// everything under it.
+func TestJWTReservedUserIDs(t *testing.T) {
+	hs, _ := newTestHTTPServer(t)
+	hs.uploads.authMgr.jwt = &JWTVerifier{secret: []byte("secret")}
+
+	trashPrefix := TRASH_PREFIX
+	TRASH_PREFIX = "system/trash"
+	defer func() { TRASH_PREFIX = trashPrefix }()
+
+	tests := []struct {
+		sub    string
+		status int
+	}{
+		{AUDIT_PREFIX, http.StatusUnauthorized},
+		{"_trash", http.StatusUnauthorized},
+		{EXPORT_PREFIX, http.StatusUnauthorized},
+		{ERASURE_PREFIX, http.StatusUnauthorized},
+		{"tenants", http.StatusUnauthorized},
+		{"system", http.StatusUnauthorized}, // A configured prefix without "_"
+		{"user_9", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/"+tt.sub+"/1/file.mp4", nil)
+			r.Header.Set("Authorization", "Bearer "+signTestJWT(t, "secret", tt.sub))
+			w := httptest.NewRecorder()
+			hs.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// largechunk.go - Binary chunks too large to hold in memory
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ============================================
+// Large Chunks
+// ============================================
+
+// A binary chunk over MAX_MEMORY_CHUNK_SIZE, up to MAX_CHUNK_SIZE, is
+// written to a file as its frame arrives instead of being held in memory,
+// and hashed on the way like any other. It takes nothing from
+// MAX_CHUNK_MEMORY; the connection's inbound buffer still holds no more than
+// one read of it.
+//
+// The file is uploaded as the chunk's part once the frame is complete rather
+// than piped into an UploadPart that starts with the first byte: the event
+// loop cannot wait for S3 to take each read, and a file can be seeked, so the
+// part is signed and the S3 client retries it. Writes land in the page cache,
+// so they cost the event loop a copy, not a disk wait, as long as
+// CHUNK_FILE_DIR keeps up.
+//
+// MAX_CHUNK_FILE_SPACE caps the bytes of the files in CHUNK_FILE_DIR as
+// MAX_CHUNK_MEMORY caps those in memory: a connection whose next large chunk
+// does not fit is held back until a chunk file is released. The file is
+// only created once the frame's token has been checked; a chunk sent with a
+// bad one is discarded as it arrives and answered AUTH_FAILED.
+//
+// The file is unlinked as soon as it is created, so it goes away when its
+// chunk is released, or with the process if the server dies.
+
+const MAX_MEMORY_CHUNK_SIZE = 100 * 1024 * 1024
+
+var (
+	CHUNK_FILE_DIR       = envString("CHUNK_FILE_DIR", "/tmp/gnet_chunk_files")
+	MAX_CHUNK_FILE_SPACE = envInt("MAX_CHUNK_FILE_SPACE", 16*1024*1024*1024)
+)
+
+type ChunkFiles struct {
+	dir string
+}
+
+func NewChunkFiles(dir string) (*ChunkFiles, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk file directory: %w", err)
+	}
+	return &ChunkFiles{dir: dir}, nil
+}
+
+// Create opens an anonymous file for one chunk. Closing it frees its space.
+func (cf *ChunkFiles) Create() (*os.File, error) {
+	f, err := os.CreateTemp(cf.dir, "chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fileChunk is a received chunk in a file. Like a memoryChunk it can be
+// seeked, so the S3 client signs it and retries failed requests.
+type fileChunk struct {
+	*io.SectionReader
+	file    *os.File
+	hash    [sha256.Size]byte
+	receive time.Duration
+}
+
+func newFileChunk(file *os.File, size int, hash [sha256.Size]byte, receive time.Duration) *fileChunk {
+	return &fileChunk{SectionReader: io.NewSectionReader(file, 0, int64(size)), file: file, hash: hash, receive: receive}
+}
+
+func (fc *fileChunk) size() uint32                       { return uint32(fc.Size()) }
+func (fc *fileChunk) digest() ([sha256.Size]byte, error) { return fc.hash, nil }
+func (fc *fileChunk) receiveTime() time.Duration         { return fc.receive }
+
+func (fc *fileChunk) tee(w io.Writer) {
+	io.Copy(w, io.NewSectionReader(fc.file, 0, fc.Size()))
+}
@@ -0,0 +1,227 @@
+// legalhold.go - Keeping files from being deleted while under legal hold
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Legal Hold
+// ============================================
+
+// Files that may be evidence in litigation or an investigation have to be
+// kept, whatever their owner or a retention rule would do with them. The
+// admin places a legal hold on such a file, and until it is released the
+// file cannot be deleted (nor so moved to the trash) by its owner or anyone
+// they granted write access to, nor expired by retention rules
+// (retention.go):
+//
+//	GET    /admin/holds              every hold, newest first (?prefix= to narrow by key)
+//	PUT    /admin/holds/{key...}     {"reason"}: place a hold, or change its reason
+//	DELETE /admin/holds/{key...}     release it
+//
+// A delete of a held file answers 409. Holds are kept in the metadata store
+// (metadata.go) and need METADATA_DB; while the store cannot be read,
+// deletes are refused rather than risk a held file. GET /metadata shows a
+// file's hold to its owner.
+//
+// That protects files from this server. With LEGAL_HOLD_OBJECT_LOCK=1 a hold
+// is also placed as an S3 Object Lock legal hold on the object, which keeps
+// its data from anyone with access to the bucket; this needs S3_BACKEND=s3
+// and a bucket with Object Lock enabled (a bucket the server creates has it).
+
+const LEGAL_HOLD_MAX_REASON = 1024
+
+var LEGAL_HOLD_OBJECT_LOCK = envBool("LEGAL_HOLD_OBJECT_LOCK", false)
+
+var (
+	errLegalHold         = errors.New("File is under legal hold")
+	errLegalHoldNotFound = errors.New("File is not under legal hold")
+)
+
+type LegalHold struct {
+	Key       string    `json:"key"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PlaceHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (hs *HTTPServer) registerLegalHoldRoutes() {
+	hs.mux.Handle("GET /admin/holds", requireAdmin(http.HandlerFunc(hs.handleListHolds)))
+	hs.mux.Handle("PUT /admin/holds/{key...}", requireAdmin(http.HandlerFunc(hs.handlePlaceHold)))
+	hs.mux.Handle("DELETE /admin/holds/{key...}", requireAdmin(http.HandlerFunc(hs.handleReleaseHold)))
+}
+
+// checkLegalHold returns errLegalHold if key is held, or the error that
+// keeps it from knowing. Without a metadata store nothing is held.
+func (fus *FileUploadServer) checkLegalHold(ctx context.Context, key string) error {
+	_, err := fus.metadata.GetLegalHold(ctx, key)
+	switch {
+	case err == nil:
+		return errLegalHold
+	case errors.Is(err, errLegalHoldNotFound), errors.Is(err, errMetadataDisabled):
+		return nil
+	default:
+		return err
+	}
+}
+
+// GET /admin/holds
+func (hs *HTTPServer) handleListHolds(w http.ResponseWriter, r *http.Request) {
+	holds, err := hs.uploads.metadata.ListLegalHolds(r.Context(), r.URL.Query().Get("prefix"))
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"holds": holds})
+}
+
+// PUT /admin/holds/{key...}
+func (hs *HTTPServer) handlePlaceHold(w http.ResponseWriter, r *http.Request) {
+	var req PlaceHoldRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > LEGAL_HOLD_MAX_REASON {
+		writeJSONError(w, http.StatusBadRequest, "reason must be 1 to 1024 bytes")
+		return
+	}
+
+	key := r.PathValue("key")
+	s3Client := hs.sessionMgr.s3Client
+	ctx := r.Context()
+	_, err := s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(key),
+	})
+	// The object is locked first: a hold recorded without its lock would
+	// look complete
+	if err == nil {
+		err = s3Client.setObjectLegalHold(ctx, key, true)
+	}
+	if writeTrashError(w, r, key, err) {
+		return
+	}
+
+	hold := &LegalHold{Key: key, Reason: req.Reason, CreatedAt: time.Now().UTC()}
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.PutLegalHold(ctx, hold)) {
+		return
+	}
+	auditLog.Record(AUDIT_HOLD_PLACED, keyOwner(key), "", r.RemoteAddr, key+" "+req.Reason)
+	httpLog.InfoContext(ctx, "placed legal hold", "key", key)
+	writeJSON(w, http.StatusOK, hold)
+}
+
+// DELETE /admin/holds/{key...}
+func (hs *HTTPServer) handleReleaseHold(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	ctx := r.Context()
+	_, err := hs.uploads.metadata.GetLegalHold(ctx, key)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+
+	// The lock is released first, so a failure leaves the file held and
+	// the release can be retried
+	err = hs.sessionMgr.s3Client.setObjectLegalHold(ctx, key, false)
+	if err != nil && !isNotFound(err) {
+		s3Log.ErrorContext(ctx, "failed to release object legal hold", "key", key, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to release object lock")
+		return
+	}
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.DeleteLegalHold(ctx, key)) {
+		return
+	}
+	auditLog.Record(AUDIT_HOLD_RELEASED, keyOwner(key), "", r.RemoteAddr, key)
+	httpLog.InfoContext(ctx, "released legal hold", "key", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setObjectLegalHold places or releases the Object Lock legal hold of key,
+// with LEGAL_HOLD_OBJECT_LOCK.
+func (s3c *S3Client) setObjectLegalHold(ctx context.Context, key string, on bool) error {
+	if s3c.locks == nil || !LEGAL_HOLD_OBJECT_LOCK {
+		return nil
+	}
+	status := types.ObjectLockLegalHoldStatusOff
+	if on {
+		status = types.ObjectLockLegalHoldStatusOn
+	}
+	_, err := s3c.locks.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(s3c.bucket),
+		Key:       aws.String(key),
+		LegalHold: &types.ObjectLockLegalHold{Status: status},
+	})
+	return err
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) PutLegalHold(ctx context.Context, hold *LegalHold) error {
+	// A hold placed again keeps its date
+	return ms.db.QueryRowContext(ctx, `
+		INSERT INTO legal_holds (s3_key, reason, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (s3_key) DO UPDATE SET reason = excluded.reason
+		RETURNING created_at`, hold.Key, hold.Reason, hold.CreatedAt).Scan(&hold.CreatedAt)
+}
+
+func (ms *sqlMetadataStore) GetLegalHold(ctx context.Context, key string) (*LegalHold, error) {
+	hold := &LegalHold{Key: key}
+	err := ms.db.QueryRowContext(ctx, `SELECT reason, created_at FROM legal_holds WHERE s3_key = $1`, key).
+		Scan(&hold.Reason, &hold.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errLegalHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (ms *sqlMetadataStore) ListLegalHolds(ctx context.Context, prefix string) ([]LegalHold, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT s3_key, reason, created_at FROM legal_holds
+		WHERE $1 = substr(s3_key, 1, $2)
+		ORDER BY created_at DESC`, prefix, len(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := make([]LegalHold, 0)
+	for rows.Next() {
+		var hold LegalHold
+		if err := rows.Scan(&hold.Key, &hold.Reason, &hold.CreatedAt); err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+func (ms *sqlMetadataStore) DeleteLegalHold(ctx context.Context, key string) error {
+	res, err := ms.db.ExecContext(ctx, `DELETE FROM legal_holds WHERE s3_key = $1`, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errLegalHoldNotFound
+	}
+	return nil
+}
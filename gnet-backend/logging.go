@@ -0,0 +1,253 @@
+// logging.go - Structured leveled logging with per-component loggers
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Logging Configuration
+// ============================================
+
+// LOG_FORMAT=json|text selects the output encoding (default text).
+// LOG_LEVEL sets the default level; LOG_LEVEL_<COMPONENT> overrides it for one
+// component, e.g. LOG_LEVEL_CHUNK=debug.
+// LOG_SAMPLE_INITIAL / LOG_SAMPLE_THEREAFTER control sampling of per-chunk
+// logs: the first N records per message per second are kept, then every Mth.
+
+const (
+	LOG_SAMPLE_INITIAL_DEFAULT    = 10
+	LOG_SAMPLE_THEREAFTER_DEFAULT = 100
+)
+
+var (
+	logLevels   = map[string]*slog.LevelVar{}
+	logLevelsMu sync.Mutex
+	logBase     = newBaseHandler()
+)
+
+// Component loggers
+var (
+	serverLog  = newLogger("server")
+	protoLog   = newLogger("protocol")
+	sessionLog = newLogger("session")
+	chunkLog   = newSampledLogger("chunk")
+	s3Log      = newLogger("s3")
+	authLog    = newLogger("auth")
+	httpLog    = newLogger("http")
+	webhookLog = newLogger("webhook")
+	eventLog   = newLogger("events")
+)
+
+func newBaseHandler() slog.Handler {
+	// Level filtering happens per component, so the base handler accepts everything
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	return slog.NewTextHandler(os.Stderr, opts)
+}
+
+func parseLevel(s string, fallback slog.Level) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return fallback
+	}
+	return level
+}
+
+func componentLevel(component string) *slog.LevelVar {
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+
+	if lv, ok := logLevels[component]; ok {
+		return lv
+	}
+
+	level := parseLevel(os.Getenv("LOG_LEVEL"), slog.LevelInfo)
+	level = parseLevel(os.Getenv("LOG_LEVEL_"+strings.ToUpper(component)), level)
+
+	lv := &slog.LevelVar{}
+	lv.Set(level)
+	logLevels[component] = lv
+	return lv
+}
+
+func newLogger(component string) *slog.Logger {
+	h := &levelHandler{Handler: logBase, level: componentLevel(component)}
+	return slog.New(h).With("component", component)
+}
+
+// newSampledLogger is for high-volume per-chunk logs. Warnings and errors are
+// never sampled.
+func newSampledLogger(component string) *slog.Logger {
+	h := &levelHandler{Handler: logBase, level: componentLevel(component)}
+	sampler := &samplingHandler{
+		Handler:    h,
+		state:      &samplerState{counts: map[string]int{}},
+		initial:    envInt("LOG_SAMPLE_INITIAL", LOG_SAMPLE_INITIAL_DEFAULT),
+		thereafter: envInt("LOG_SAMPLE_THEREAFTER", LOG_SAMPLE_THEREAFTER_DEFAULT),
+	}
+	return slog.New(sampler).With("component", component)
+}
+
+// ============================================
+// Runtime Level Control
+// ============================================
+
+// setLogLevel changes the level of one component at runtime, or of every
+// component when component is empty.
+func setLogLevel(component, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid level %q", level)
+	}
+
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+
+	if component == "" {
+		for _, lv := range logLevels {
+			lv.Set(lvl)
+		}
+		return nil
+	}
+
+	lv, ok := logLevels[component]
+	if !ok {
+		return fmt.Errorf("unknown component %q", component)
+	}
+	lv.Set(lvl)
+	return nil
+}
+
+// logLevelSnapshot returns the current level of every component.
+func logLevelSnapshot() map[string]string {
+	logLevelsMu.Lock()
+	defer logLevelsMu.Unlock()
+
+	levels := make(map[string]string, len(logLevels))
+	for component, lv := range logLevels {
+		levels[component] = lv.Level().String()
+	}
+	return levels
+}
+
+// ============================================
+// Correlation IDs
+// ============================================
+
+// Every HTTP request gets a request_id and every binary connection a conn_id.
+// The ID travels in the context, and every record logged with a *Context
+// method carries it automatically.
+
+type correlationKey struct{}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withCorrelationID(ctx context.Context, key, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, slog.String(key, id))
+}
+
+// correlationID returns the request or connection ID carried by ctx, if any.
+func correlationID(ctx context.Context) string {
+	if attr, ok := ctx.Value(correlationKey{}).(slog.Attr); ok {
+		return attr.Value.String()
+	}
+	return ""
+}
+
+// logFatal logs at error level and exits, replacing log.Fatal.
+func logFatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// ============================================
+// Handlers
+// ============================================
+
+// levelHandler gates records on a per-component level that can change at runtime.
+type levelHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attr, ok := ctx.Value(correlationKey{}).(slog.Attr); ok {
+		r.AddAttrs(attr)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+type samplerState struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+// samplingHandler keeps the first `initial` records per message each second
+// and every `thereafter`-th record after that.
+type samplingHandler struct {
+	slog.Handler
+	state      *samplerState
+	initial    int
+	thereafter int
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn || h.keep(r.Message, r.Time) {
+		return h.Handler.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *samplingHandler) keep(msg string, now time.Time) bool {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	window := now.Truncate(time.Second)
+	if !window.Equal(h.state.window) {
+		h.state.window = window
+		clear(h.state.counts)
+	}
+
+	h.state.counts[msg]++
+	n := h.state.counts[msg]
+	if n <= h.initial {
+		return true
+	}
+	return h.thereafter > 0 && (n-h.initial)%h.thereafter == 0
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state, initial: h.initial, thereafter: h.thereafter}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), state: h.state, initial: h.initial, thereafter: h.thereafter}
+}
@@ -5,13 +5,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,6 +29,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/panjf2000/gnet/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"backend/compression"
+	"backend/protocol"
 )
 
 // ============================================
@@ -27,42 +45,17 @@ import (
 // ============================================
 
 const (
-	GNET_PORT = ":8081"
-
 	S3_ENDPOINT   = "http://minio:9000"
 	S3_REGION     = "us-east-1"
 	S3_ACCESS_KEY = "admin"
 	S3_SECRET_KEY = "strongpassword"
 	S3_BUCKET     = "uploads"
 
-	// Protocol structure: size_of_auth_token|auth_token|size_of_payload|payload
-	// Header: auth_token_size(4 bytes) | auth_token | payload_size(4 bytes) | command(1 byte) | payload
-
-	// Protocol commands
-	CMD_INIT_UPLOAD   = 0x01 // Initialize upload session
-	CMD_UPLOAD_CHUNK  = 0x02 // Upload a chunk
-	CMD_PAUSE_UPLOAD  = 0x03 // Pause upload
-	CMD_RESUME_UPLOAD = 0x04 // Resume upload
-	CMD_CANCEL_UPLOAD = 0x05 // Cancel upload
-	CMD_GET_STATUS    = 0x06 // Get upload status
-
-	// Response codes
-	RESP_OK           = 0x10 // Success
-	RESP_ERROR        = 0x11 // Error
-	RESP_READY        = 0x12 // Session ready
-	RESP_CHUNK_ACK    = 0x13 // Chunk acknowledged
-	RESP_COMPLETE     = 0x14 // Upload complete
-	RESP_STATUS       = 0x15 // Status response
-	RESP_PAUSED       = 0x16 // Upload paused
-	RESP_RESUMED      = 0x17 // Upload resumed
-	RESP_CANCELLED    = 0x18 // Upload cancelled
-	RESP_AUTH_FAILED  = 0x19 // Authentication failed
-	RESP_DUPLICATE    = 0x1A // Duplicate chunk (already received)
-
 	// Session states
 	STATE_INITIALIZED = "initialized"
 	STATE_UPLOADING   = "uploading"
 	STATE_PAUSED      = "paused"
+	STATE_FINALIZING  = "finalizing"
 	STATE_COMPLETED   = "completed"
 	STATE_CANCELLED   = "cancelled"
 	STATE_FAILED      = "failed"
@@ -70,12 +63,58 @@ const (
 	// File constraints
 	MAX_FILE_SIZE = 10 * 1024 * 1024 * 1024 // 10 GB
 	MIN_CHUNK_SIZE = 5 * 1024 * 1024         // 5 MB (S3 minimum for multipart)
-	MAX_CHUNK_SIZE = 100 * 1024 * 1024       // 100 MB
+	MAX_CHUNK_SIZE = 1024 * 1024 * 1024      // 1 GB; see largechunk.go
+
+	// Progress reporting
+	THROUGHPUT_SMOOTHING = 0.3 // EWMA weight of the newest chunk
 
 	// Timeouts
 	SESSION_TIMEOUT = 2 * time.Hour
+	DRAIN_TIMEOUT   = 5 * time.Minute // Max wait for in-flight uploads on SIGTERM
+
+	// Preview of in-progress uploads
+	PREVIEW_SPOOL_DIR     = "/tmp/gnet_preview_spool"
+	PREVIEW_MAX_CHUNKS    = 4 // Leading chunks kept locally per session
+	PREVIEW_POLL_INTERVAL = 500 * time.Millisecond
 )
 
+// Listen addresses; overridable to run several instances on one host
+var (
+	GNET_PORT = envString("GNET_ADDR", ":8081")
+	HTTP_PORT = envString("HTTP_ADDR", ":8085")
+)
+
+// Optional features (toggled via environment)
+var (
+	INTEGRITY_PROBE_ENABLED = os.Getenv("INTEGRITY_PROBE") == "1"
+	INTEGRITY_WEBHOOK_URL   = os.Getenv("INTEGRITY_WEBHOOK_URL")
+
+	// Bearer token for admin/debug endpoints; they are disabled when empty
+	ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+
+	// Chunks of one session stored concurrently; parallel clients back off
+	// when they get errSessionBusy
+	MAX_SESSION_INFLIGHT = envInt("MAX_SESSION_INFLIGHT", 8)
+
+	// "s3" (MinIO at S3_ENDPOINT), "memory" for tests, or "fs" to keep
+	// files under S3_FS_DIR for demos and single-host setups
+	S3_BACKEND = envString("S3_BACKEND", "s3")
+)
+
+func envInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func envString(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
 // Supported file types
 var SUPPORTED_EXTENSIONS = map[string]string{
 	".mp4":  "video/mp4",
@@ -95,11 +134,34 @@ var SUPPORTED_EXTENSIONS = map[string]string{
 // ============================================
 
 type S3Client struct {
-	client *s3.Client
-	bucket string
+	client   S3API
+	bucket   string
+	listings *ListingCache // Of GET /files; invalidate after writing a key (files.go)
+	presign  *s3.PresignClient
+	locks    *s3.Client // Object Lock, with LEGAL_HOLD_OBJECT_LOCK or IMMUTABLE_UPLOADS; see legalhold.go, immutable.go
 }
 
 func NewS3Client() (*S3Client, error) {
+	if S3_BACKEND == "memory" {
+		mem := newMemS3()
+		mem.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(S3_BUCKET)})
+		s3Log.Warn("using in-memory storage; uploads are lost on exit", "bucket", S3_BUCKET)
+		return &S3Client{client: mem, bucket: S3_BUCKET, listings: NewListingCache(FILES_CACHE_TTL)}, nil
+	}
+	if S3_BACKEND == "fs" {
+		store, err := newFsS3(S3_FS_DIR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", S3_FS_DIR, err)
+		}
+		if _, err := store.HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: aws.String(S3_BUCKET)}); err != nil {
+			if _, err := store.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(S3_BUCKET)}); err != nil {
+				return nil, fmt.Errorf("failed to create bucket: %w", err)
+			}
+		}
+		s3Log.Info("using filesystem storage", "dir", S3_FS_DIR, "bucket", S3_BUCKET)
+		return &S3Client{client: store, bucket: S3_BUCKET, listings: NewListingCache(FILES_CACHE_TTL)}, nil
+	}
+
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		if service == s3.ServiceID {
 			return aws.Endpoint{
@@ -124,8 +186,12 @@ func NewS3Client() (*S3Client, error) {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// Trace every S3 call as a child of the command being processed
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.UsePathStyle = true
+		o.APIOptions = append(o.APIOptions, s3MetricsMiddleware)
 	})
 
 	// Ensure bucket exists
@@ -134,19 +200,29 @@ func NewS3Client() (*S3Client, error) {
 		Bucket: aws.String(S3_BUCKET),
 	})
 	if err != nil {
-		_, err = client.CreateBucket(ctx, &s3.CreateBucketInput{
+		input := &s3.CreateBucketInput{
 			Bucket: aws.String(S3_BUCKET),
-		})
+		}
+		if LEGAL_HOLD_OBJECT_LOCK || IMMUTABLE_UPLOADS {
+			input.ObjectLockEnabledForBucket = aws.Bool(true)
+		}
+		_, err = client.CreateBucket(ctx, input)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create bucket: %w", err)
 		}
-		log.Printf("✅ Created S3 bucket: %s", S3_BUCKET)
+		s3Log.Info("created bucket", "bucket", S3_BUCKET)
 	}
 
-	return &S3Client{
-		client: client,
-		bucket: S3_BUCKET,
-	}, nil
+	s3c := &S3Client{
+		client:   client,
+		bucket:   S3_BUCKET,
+		listings: NewListingCache(FILES_CACHE_TTL),
+		presign:  s3.NewPresignClient(client, presignPlainGET),
+	}
+	if LEGAL_HOLD_OBJECT_LOCK || IMMUTABLE_UPLOADS {
+		s3c.locks = client
+	}
+	return s3c, nil
 }
 
 // ============================================
@@ -154,19 +230,23 @@ func NewS3Client() (*S3Client, error) {
 // ============================================
 
 type AuthManager struct {
-	tokens map[string]*TokenInfo
-	mu     sync.RWMutex
+	tokens  map[string]*TokenInfo
+	jwt     *JWTVerifier         // nil unless JWTs are accepted; see jwt.go
+	revoked map[string]time.Time // User ID -> when their tokens were revoked
+	mu      sync.RWMutex
 }
 
 type TokenInfo struct {
 	UserID    string
 	Username  string
 	ExpiresAt time.Time
+	Tenant    *Tenant // nil for the default tenant; see tenants.go
 }
 
 func NewAuthManager() *AuthManager {
 	am := &AuthManager{
-		tokens: make(map[string]*TokenInfo),
+		tokens:  make(map[string]*TokenInfo),
+		revoked: make(map[string]time.Time),
 	}
 
 	// Add some demo tokens for testing
@@ -182,10 +262,10 @@ func (am *AuthManager) ValidateToken(token string) (*TokenInfo, bool) {
 
 	info, exists := am.tokens[token]
 	if !exists {
-		return nil, false
+		return am.validateJWT(token)
 	}
 
-	if time.Now().After(info.ExpiresAt) {
+	if !info.ExpiresAt.IsZero() && time.Now().After(info.ExpiresAt) {
 		return nil, false
 	}
 
@@ -201,7 +281,7 @@ func (am *AuthManager) AddToken(token, userID, username string, duration time.Du
 		Username:  username,
 		ExpiresAt: time.Now().Add(duration),
 	}
-	log.Printf("🔑 Added auth token for user: %s (expires in %v)", username, duration)
+	authLog.Info("added auth token", "user", username, "expires_in", duration)
 }
 
 // ============================================
@@ -225,8 +305,15 @@ type UploadSession struct {
 	S3Key          string // user_id/timestamp/filename
 	FileExtension  string
 	ContentType    string
+	Attributes     map[string]string
+	FileHash       string            // SHA-256 the client declared at init; see dedup.go
+	Preset         *UploadPreset     // Named at init, or nil; see presets.go
+	Drop           string            // Token of the drop link it came through; see drops.go
+	Immutable      *ImmutableRequest // Object Lock asked for at init, or nil; see immutable.go
+	Compression    uint8             // COMPRESSION_* of its binary chunks, 0 for none; see compress.go
 	TotalChunks    uint32
 	ChunkSize      uint32
+	ChunksPerPart  uint32 // Over 1 when chunks are below MIN_CHUNK_SIZE; see aggregate.go
 	TotalSize      uint64
 	State          string
 	ReceivedChunks map[uint32]*ChunkInfo
@@ -235,21 +322,49 @@ type UploadSession struct {
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 	PausedAt       *time.Time
+	SlowChunks     int    // Consecutive chunks over SLOW_CHUNK_SECONDS
+	SlowCause      string // Set once the session is flagged as slow
+	Integrity      string // Result of the post-finalize media probe, if enabled
+	BytesReceived  uint64
+	throughput     float64          // Smoothed bytes/sec over recent chunks
+	lastChunkAt    time.Time        // Start of the current measurement interval
+	inflight       int              // Chunks currently being stored
+	staged         map[uint32]bool  // Chunks written to the staging file of their part
+	stagedParts    map[int32]uint32 // Staged chunks per part
 	mu             sync.Mutex
 }
 
+// beginChunk reserves one of the session's MAX_SESSION_INFLIGHT slots.
+func (us *UploadSession) beginChunk() bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.inflight >= MAX_SESSION_INFLIGHT {
+		return false
+	}
+	us.inflight++
+	return true
+}
+
+func (us *UploadSession) endChunk() {
+	us.mu.Lock()
+	us.inflight--
+	us.mu.Unlock()
+}
+
 func (us *UploadSession) AddChunk(index uint32, size uint32, hash string, partNumber int32, etag string) bool {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
 	// Check if chunk already exists (duplicate)
 	if existing, exists := us.ReceivedChunks[index]; exists {
-		log.Printf("⚠️  Duplicate chunk detected: session=%s, chunk=%d (hash: %s)", us.SessionID, index, hash)
-		// Verify hash matches
-		if existing.Hash == hash {
+		chunkLog.Warn("duplicate chunk", "session_id", us.SessionID, "chunk_index", index, "hash", hash)
+		// Verify hash matches; a chunk rebuilt from S3 after a restart has
+		// none to compare (recovery.go)
+		if existing.Hash == hash || existing.Hash == "" {
+			existing.Hash = hash
 			return true // Same chunk, skip (idempotent)
 		}
-		log.Printf("❌ Hash mismatch for chunk %d: expected %s, got %s", index, existing.Hash, hash)
+		chunkLog.Error("chunk hash mismatch", "session_id", us.SessionID, "chunk_index", index, "expected", existing.Hash, "got", hash)
 		return false
 	}
 
@@ -263,16 +378,65 @@ func (us *UploadSession) AddChunk(index uint32, size uint32, hash string, partNu
 		ETag:       etag,
 	}
 
-	us.CompletedParts = append(us.CompletedParts, types.CompletedPart{
-		PartNumber: aws.Int32(partNumber),
-		ETag:       aws.String(etag),
-	})
+	// Parts finish out of order (pipelined and parallel chunks, resumes);
+	// keep them sorted as S3 requires for completion. In-order parts, the
+	// common case, land at the end without moving any others. A staged chunk
+	// has no ETag: its part is not in S3 yet (aggregate.go).
+	if etag != "" {
+		at := sort.Search(len(us.CompletedParts), func(i int) bool { return *us.CompletedParts[i].PartNumber > partNumber })
+		us.CompletedParts = slices.Insert(us.CompletedParts, at, types.CompletedPart{
+			PartNumber: aws.Int32(partNumber),
+			ETag:       aws.String(etag),
+		})
+	}
+
+	us.updateThroughput(size)
 
-	us.State = STATE_UPLOADING
+	us.setState(STATE_UPLOADING)
 	us.UpdatedAt = time.Now()
+	us.save(index)
 	return false // Not duplicate
 }
 
+// updateThroughput folds a new chunk into the smoothed rate. Caller holds us.mu.
+func (us *UploadSession) updateThroughput(size uint32) {
+	now := time.Now()
+	since := us.lastChunkAt
+	if since.IsZero() {
+		since = us.CreatedAt
+	}
+	us.lastChunkAt = now
+	us.BytesReceived += uint64(size)
+
+	elapsed := now.Sub(since).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed
+	if us.throughput == 0 {
+		us.throughput = rate
+	} else {
+		us.throughput = THROUGHPUT_SMOOTHING*rate + (1-THROUGHPUT_SMOOTHING)*us.throughput
+	}
+}
+
+// GetThroughput returns the smoothed upload rate and the estimated time to
+// receive the remaining bytes. ok is false until a rate has been measured.
+func (us *UploadSession) GetThroughput() (bytesPerSec uint64, eta time.Duration, ok bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if us.throughput <= 0 {
+		return 0, 0, false
+	}
+	var remaining uint64
+	if us.TotalSize > us.BytesReceived {
+		remaining = us.TotalSize - us.BytesReceived
+	}
+	eta = time.Duration(float64(remaining) / us.throughput * float64(time.Second))
+	return uint64(us.throughput), eta, true
+}
+
 func (us *UploadSession) GetProgress() (received, total uint32) {
 	us.mu.Lock()
 	defer us.mu.Unlock()
@@ -282,7 +446,7 @@ func (us *UploadSession) GetProgress() (received, total uint32) {
 func (us *UploadSession) IsComplete() bool {
 	us.mu.Lock()
 	defer us.mu.Unlock()
-	return len(us.ReceivedChunks) == int(us.TotalChunks)
+	return len(us.ReceivedChunks) == int(us.TotalChunks) && len(us.CompletedParts) == int(us.PartCount())
 }
 
 func (us *UploadSession) GetMissingChunks() []uint32 {
@@ -298,28 +462,52 @@ func (us *UploadSession) GetMissingChunks() []uint32 {
 	return missing
 }
 
+// setState moves the session to a new state and counts the transition.
+// Caller holds us.mu.
+func (us *UploadSession) setState(state string) {
+	if us.State == state {
+		return
+	}
+	sessionTransitions.WithLabelValues(us.State, state).Inc()
+	us.State = state
+}
+
+func (us *UploadSession) GetState() string {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.State
+}
+
 func (us *UploadSession) Pause() {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 	now := time.Now()
-	us.State = STATE_PAUSED
+	us.setState(STATE_PAUSED)
 	us.PausedAt = &now
 	us.UpdatedAt = now
+	us.save()
 }
 
-func (us *UploadSession) Resume() {
+// Resume continues the session with its binary chunks compressed with
+// codec, 0 for none (see compress.go).
+func (us *UploadSession) Resume(codec uint8) {
 	us.mu.Lock()
 	defer us.mu.Unlock()
-	us.State = STATE_UPLOADING
+	us.setState(STATE_UPLOADING)
 	us.PausedAt = nil
+	us.Compression = codec
 	us.UpdatedAt = time.Now()
+	// Time spent paused must not count against the measured rate
+	us.lastChunkAt = us.UpdatedAt
+	us.save()
 }
 
 func (us *UploadSession) Cancel() {
 	us.mu.Lock()
 	defer us.mu.Unlock()
-	us.State = STATE_CANCELLED
+	us.setState(STATE_CANCELLED)
 	us.UpdatedAt = time.Now()
+	us.save()
 }
 
 // ============================================
@@ -331,13 +519,22 @@ type SessionManager struct {
 	mu       sync.RWMutex
 	s3Client *S3Client
 	authMgr  *AuthManager
+	spool    *PreviewSpool
+	staging  *PartStaging
+	store    SessionStore                 // Set by restoreSessions; see sessionstore.go
+	presets  map[string]*UploadPreset     // For sessions loaded from the store
+	metadata MetadataStore                // For their drops
+	orphans  map[string][]*OrphanedUpload // Uploads a restart left without a session; see recovery.go
 }
 
-func NewSessionManager(s3Client *S3Client, authMgr *AuthManager) *SessionManager {
+func NewSessionManager(s3Client *S3Client, authMgr *AuthManager, spool *PreviewSpool, staging *PartStaging) *SessionManager {
 	sm := &SessionManager{
 		sessions: make(map[string]*UploadSession),
+		orphans:  make(map[string][]*OrphanedUpload),
 		s3Client: s3Client,
 		authMgr:  authMgr,
+		spool:    spool,
+		staging:  staging,
 	}
 
 	go sm.cleanupLoop()
@@ -345,34 +542,42 @@ func NewSessionManager(s3Client *S3Client, authMgr *AuthManager) *SessionManager
 	return sm
 }
 
-func (sm *SessionManager) CreateSession(userID, username, fileName string, totalChunks, chunkSize uint32) (*UploadSession, error) {
+func (sm *SessionManager) CreateSession(tenant *Tenant, preset *UploadPreset, userID, username, fileName string, totalChunks, chunkSize uint32) (*UploadSession, error) {
 	// Validate file extension
 	ext := strings.ToLower(filepath.Ext(fileName))
 	contentType, supported := SUPPORTED_EXTENSIONS[ext]
 	if !supported {
 		return nil, fmt.Errorf("unsupported file type: %s (supported: mp4, pdf, jpg, png, gif, webp, mov, avi, mkv)", ext)
 	}
+	if !tenant.allowsExtension(ext) {
+		return nil, fmt.Errorf("file type not allowed: %s (allowed: %s)", ext, strings.Join(tenant.Extensions, ", "))
+	}
+	if !preset.allowsExtension(ext) {
+		return nil, fmt.Errorf("file type not allowed by preset %s: %s (allowed: %s)", preset.Name, ext, strings.Join(preset.Extensions, ", "))
+	}
 
 	// Validate file size
 	totalSize := uint64(totalChunks) * uint64(chunkSize)
-	if totalSize > MAX_FILE_SIZE {
-		return nil, fmt.Errorf("file size exceeds maximum: %d bytes (max: %d)", totalSize, MAX_FILE_SIZE)
+	if totalSize > tenant.maxFileSize() {
+		return nil, fmt.Errorf("file size exceeds maximum: %d bytes (max: %d)", totalSize, tenant.maxFileSize())
+	}
+	if totalSize > preset.maxFileSize() {
+		return nil, fmt.Errorf("file size exceeds maximum of preset %s: %d bytes (max: %d)", preset.Name, totalSize, preset.maxFileSize())
 	}
 
-	// Validate chunk size
-	if chunkSize < MIN_CHUNK_SIZE {
-		return nil, fmt.Errorf("chunk size too small: %d bytes (min: %d)", chunkSize, MIN_CHUNK_SIZE)
+	// Validate chunk size; below MIN_CHUNK_SIZE chunks are combined into parts
+	if chunkSize < MIN_SMALL_CHUNK_SIZE {
+		return nil, fmt.Errorf("chunk size too small: %d bytes (min: %d)", chunkSize, MIN_SMALL_CHUNK_SIZE)
 	}
-	if chunkSize > MAX_CHUNK_SIZE {
-		return nil, fmt.Errorf("chunk size too large: %d bytes (max: %d)", chunkSize, MAX_CHUNK_SIZE)
+	if chunkSize > tenant.maxChunkSize() {
+		return nil, fmt.Errorf("chunk size too large: %d bytes (max: %d)", chunkSize, tenant.maxChunkSize())
 	}
 
-	// Generate S3 key: user_id/timestamp/filename
-	timestamp := time.Now().Format("20060102_150405")
-	s3Key := fmt.Sprintf("%s/%s/%s", userID, timestamp, fileName)
+	s3Key := newS3Key(preset.userFolder(userID), fileName)
 
-	// Generate session ID
-	sessionID := fmt.Sprintf("%s_%d", userID, time.Now().UnixNano())
+	// Generate session ID; it goes in URL paths, where a tenant user's
+	// slashes would not
+	sessionID := fmt.Sprintf("%s_%d", strings.ReplaceAll(userID, "/", "."), time.Now().UnixNano())
 
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -385,33 +590,90 @@ func (sm *SessionManager) CreateSession(userID, username, fileName string, total
 		S3Key:          s3Key,
 		FileExtension:  ext,
 		ContentType:    contentType,
+		Preset:         preset,
 		TotalChunks:    totalChunks,
 		ChunkSize:      chunkSize,
+		ChunksPerPart:  chunksPerPart(chunkSize),
 		TotalSize:      totalSize,
 		State:          STATE_INITIALIZED,
 		ReceivedChunks: make(map[uint32]*ChunkInfo),
-		CompletedParts: make([]types.CompletedPart, 0),
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
 
+	session.CompletedParts = make([]types.CompletedPart, 0, session.PartCount()) // Never regrows
 	sm.sessions[sessionID] = session
-	log.Printf("📦 Created session: %s (user: %s, file: %s, size: %.2f MB, chunks: %d, s3: %s)",
-		sessionID, username, fileName, float64(totalSize)/(1024*1024), totalChunks, s3Key)
+	session.save()
+	sessionTransitions.WithLabelValues("new", STATE_INITIALIZED).Inc()
+	auditLog.Record(AUDIT_SESSION_CREATED, userID, sessionID, "", fileName)
+	eventBus.Publish(EVENT_SESSION_CREATED, session, preset.eventData(map[string]interface{}{
+		"size_bytes":   totalSize,
+		"chunks":       totalChunks,
+		"chunk_size":   chunkSize,
+		"content_type": contentType,
+	}))
+	sessionLog.Info("created session", "session_id", sessionID, "user", username, "file", fileName,
+		"size_bytes", totalSize, "chunks", totalChunks, "s3_key", s3Key)
 
 	return session, nil
 }
 
+// newS3Key returns the key of a new upload: user_id/timestamp/filename, with
+// folder in place of user_id for a preset's prefix
+func newS3Key(folder, fileName string) string {
+	return fmt.Sprintf("%s/%s/%s", folder, time.Now().Format("20060102_150405"), fileName)
+}
+
 func (sm *SessionManager) GetSession(sessionID string) *UploadSession {
+	sm.mu.RLock()
+	session, ok := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+	if !ok {
+		return sm.loadSession(sessionID)
+	}
+	return session
+}
+
+// Sessions returns every session currently held in memory.
+func (sm *SessionManager) Sessions() []*UploadSession {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
-	return sm.sessions[sessionID]
+
+	sessions := make([]*UploadSession, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// SessionStates returns the current state of every session.
+func (sm *SessionManager) SessionStates() []string {
+	sessions := sm.Sessions()
+	states := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		states = append(states, session.GetState())
+	}
+	return states
+}
+
+// ActiveUploads counts sessions that are still receiving chunks.
+func (sm *SessionManager) ActiveUploads() int {
+	active := 0
+	for _, state := range sm.SessionStates() {
+		if state == STATE_INITIALIZED || state == STATE_UPLOADING || state == STATE_FINALIZING {
+			active++
+		}
+	}
+	return active
 }
 
 func (sm *SessionManager) DeleteSession(sessionID string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	delete(sm.sessions, sessionID)
+	sessionWriter.Delete(sessionID)
+	sm.spool.Remove(sessionID)
+	sm.staging.Remove(sessionID)
 }
 
 func (sm *SessionManager) cleanupLoop() {
@@ -443,7 +705,15 @@ func (sm *SessionManager) cleanupLoop() {
 			}
 
 			if shouldCleanup {
-				log.Printf("🧹 Cleaning up session: %s (state: %s, age: %v)", id, session.State, now.Sub(session.CreatedAt))
+				sessionLog.Info("cleaning up session", "session_id", id, "state", session.State, "age", now.Sub(session.CreatedAt))
+				if session.State != STATE_COMPLETED && session.State != STATE_CANCELLED {
+					auditLog.Record(AUDIT_SESSION_EXPIRED, session.UserID, id, "", session.State)
+				}
+				if session.State == STATE_COMPLETED || session.State == STATE_CANCELLED || session.State == STATE_FAILED {
+					eventBus.Forget(id)
+				} else {
+					eventBus.Publish(EVENT_SESSION_FAILED, session, map[string]string{"reason": "expired", "state": session.State})
+				}
 
 				// Abort S3 multipart upload if not completed
 				if session.UploadID != "" && session.State != STATE_COMPLETED {
@@ -453,14 +723,25 @@ func (sm *SessionManager) cleanupLoop() {
 						UploadId: aws.String(session.UploadID),
 					})
 					if err != nil {
-						log.Printf("⚠️  Failed to abort multipart upload for session %s: %v", id, err)
+						s3Log.Warn("failed to abort multipart upload", "session_id", id, "err", err)
+						cleanupAborted.WithLabelValues("error").Inc()
+					} else {
+						cleanupAborted.WithLabelValues("ok").Inc()
 					}
 				}
 
+				cleanupReaped.WithLabelValues(session.State).Inc()
 				delete(sm.sessions, id)
+				sessionWriter.Delete(id)
+				sm.spool.Remove(id)
+				sm.staging.Remove(id)
 			}
 		}
+		sm.pruneOrphans(now)
 		sm.mu.Unlock()
+
+		cleanupRuns.Inc()
+		cleanupLastRun.SetToCurrentTime()
 	}
 }
 
@@ -468,239 +749,535 @@ func (sm *SessionManager) cleanupLoop() {
 // File Upload Server (gnet)
 // ============================================
 
+var (
+	errDraining   = errors.New("Server is draining, retry on another instance")
+	errFinalizing = errors.New("Upload is already being finalized")
+
+	// The SDK matches on this text (client.BUSY_MESSAGE); keep them in sync
+	errSessionBusy = errors.New("Too many chunks in flight for this session, retry later")
+)
+
 type FileUploadServer struct {
 	gnet.BuiltinEventEngine
 
-	sessionMgr *SessionManager
-	s3Client   *S3Client
-	authMgr    *AuthManager
+	eng         gnet.Engine
+	booted      chan struct{} // Closed once eng is set
+	sessionMgr  *SessionManager
+	s3Client    *S3Client
+	authMgr     *AuthManager
+	spool       *PreviewSpool
+	staging     *PartStaging
+	conns       *ConnRegistry
+	usage       *UsageMeter
+	chunkPool   *ChunkPool
+	chunkMemory *MemoryBudget
+	chunkSpace  *MemoryBudget // Of chunkFiles
+	chunkFiles  *ChunkFiles
+	metadata    MetadataStore
+	indexer     *ContentIndexer
+	retention   *RetentionPolicy
+	verifier    *Verifier
+	activity    *ActivityFeed
+	tenants     map[string]*Tenant
+	presets     map[string]*UploadPreset
+	notifier    *Notifier
+	quotas      *UserQuotas
+	limiter     *RateLimiter
+	tlsConfig   *tls.Config // nil without GNET_TLS_ADDR
+	quotaMu     sync.Mutex  // Serializes user quota checks and creation of sessions
 }
 
 type ClientContext struct {
-	buffer      []byte
+	buffered    int          // Bytes of the next frame left in the connection's buffer
+	held        int          // Of them, counted against chunkMemory while held back. Event loop only
+	rateUntil   time.Time    // When a chunk held back by the rate limits may pass. Event loop only
+	chunk       *chunkStream // UPLOAD_CHUNK being received; see chunkpool.go
+	inflight    int          // UPLOAD_CHUNKs with chunk workers
+	recvBuffer  int          // SO_RCVBUF set by sizeRecvBuffer, 0 while autotuned
+	replies     []*reply     // Responses not written yet, in frame order
+	outbox      [][]byte     // Responses to write at the end of OnTraffic
 	session     *UploadSession
 	userID      string
 	username    string
+	tenant      *Tenant
+	connID      string          // Correlation ID for logs, spans and error responses
+	connCtx     context.Context // Carries connID for the lifetime of the connection
+	remoteAddr  string
+	connectedAt time.Time
+	frameStart  time.Time // Arrival of the first byte of the pending message
 	mu          sync.Mutex
 }
 
 func (fus *FileUploadServer) OnBoot(eng gnet.Engine) (action gnet.Action) {
-	log.Printf("🚀 File upload server started on %s", GNET_PORT)
-	log.Printf("📦 S3: %s/%s", S3_ENDPOINT, S3_BUCKET)
-	log.Printf("📁 Upload path format: user_id/timestamp/filename")
-	log.Printf("📄 Supported formats: mp4, pdf, jpg, png, gif, webp, mov, avi, mkv")
-	log.Printf("📊 Max file size: %.2f GB, Chunk size: %d-%d MB",
-		float64(MAX_FILE_SIZE)/(1024*1024*1024),
-		MIN_CHUNK_SIZE/(1024*1024),
-		MAX_CHUNK_SIZE/(1024*1024))
+	fus.eng = eng
+	close(fus.booted)
+	serverLog.Info("file upload server started",
+		"addr", GNET_PORT,
+		"s3_backend", S3_BACKEND,
+		"s3_endpoint", S3_ENDPOINT,
+		"bucket", S3_BUCKET,
+		"max_file_size", MAX_FILE_SIZE,
+		"min_chunk_size", MIN_CHUNK_SIZE,
+		"min_small_chunk_size", MIN_SMALL_CHUNK_SIZE,
+		"max_chunk_size", MAX_CHUNK_SIZE,
+		"max_memory_chunk_size", MAX_MEMORY_CHUNK_SIZE)
+	if fus.tlsConfig != nil {
+		go fus.serveTLS(fus.tlsConfig)
+	}
 	return gnet.None
 }
 
 func (fus *FileUploadServer) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	log.Printf("✅ Client connected: %s", c.RemoteAddr())
-
+	connID := newCorrelationID()
 	ctx := &ClientContext{
-		buffer: make([]byte, 0, 8192),
+		connID:      connID,
+		connCtx:     withCorrelationID(context.Background(), "conn_id", connID),
+		remoteAddr:  c.RemoteAddr().String(),
+		connectedAt: time.Now(),
+	}
+	if peer, ok := c.Context().(*bridgedPeer); ok {
+		ctx.remoteAddr = peer.remoteAddr // From the TLS port or a WebSocket (tls.go, websocket.go)
 	}
 	c.SetContext(ctx)
+	fus.conns.Add(ctx)
+
+	protoLog.InfoContext(ctx.connCtx, "client connected", "remote", ctx.remoteAddr)
 
 	return nil, gnet.None
 }
 
 func (fus *FileUploadServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
 	ctx := c.Context().(*ClientContext)
-
-	// Read all available data
-	data, err := c.Next(-1)
-	if err != nil {
-		log.Printf("❌ Error reading data: %v", err)
-		return gnet.Close
-	}
+	defer ctx.flushReplies(c)
 
 	ctx.mu.Lock()
-	ctx.buffer = append(ctx.buffer, data...)
+	if ctx.buffered == 0 {
+		ctx.frameStart = time.Now()
+	}
 	ctx.mu.Unlock()
+	if ctx.held > 0 {
+		fus.chunkMemory.Hold(-ctx.held)
+		ctx.held = 0
+	}
+	held := false
 
-	// Process messages
+	// Frames are read in place from the connection's inbound buffer and
+	// discarded once handled; an incomplete frame stays buffered by gnet
+	// until more data arrives. The data of an UPLOAD_CHUNK is the exception:
+	// it is moved into the chunk's own buffer as it arrives (chunkpool.go).
 	for {
-		ctx.mu.Lock()
-		bufLen := len(ctx.buffer)
-		ctx.mu.Unlock()
+		if ctx.chunk != nil {
+			if action := fus.receiveChunk(c, ctx); action != gnet.None {
+				return action
+			}
+			if ctx.chunk != nil {
+				break // Need more chunk data
+			}
+			continue
+		}
 
-		if bufLen < 4 {
+		prefix, err := c.Peek(4)
+		if err != nil {
 			break // Need at least auth token size
 		}
+		authTokenSize := binary.BigEndian.Uint32(prefix)
 
-		ctx.mu.Lock()
-		authTokenSize := binary.BigEndian.Uint32(ctx.buffer[0:4])
-		ctx.mu.Unlock()
-
-		if authTokenSize > 1024 {
-			log.Printf("❌ Invalid auth token size: %d", authTokenSize)
-			c.AsyncWrite(fus.errorResponse("Invalid auth token size"), nil)
+		if authTokenSize > protocol.MAX_TOKEN_SIZE {
+			protoLog.WarnContext(ctx.connCtx, "invalid auth token size", "remote", ctx.remoteAddr, "size", authTokenSize)
+			ctx.sendReply(ctx.reserveReply(), tagErrorResponse(fus.errorResponse("Invalid auth token size"), ctx.connID))
 			return gnet.Close
 		}
 
 		headerSize := 4 + int(authTokenSize) + 4
-		if bufLen < headerSize {
-			break // Need complete header
+		header, err := c.Peek(headerSize + 1)
+		if err != nil {
+			if _, err := c.Peek(headerSize); err != nil {
+				break // Need complete header
+			}
+			header = append(header, 0) // Empty payload
 		}
+		payloadSize := binary.BigEndian.Uint32(header[4+authTokenSize:])
+		totalSize := headerSize + int(payloadSize)
 
+		// Chunks are pipelined up to MAX_SESSION_INFLIGHT; any other command
+		// waits until they are answered so it sees their effect. A chunk
+		// worker wakes the connection when it is done.
+		isChunk := payloadSize > 0 && header[headerSize] == protocol.CMD_UPLOAD_CHUNK
 		ctx.mu.Lock()
-		authToken := string(ctx.buffer[4 : 4+authTokenSize])
-		payloadSize := binary.BigEndian.Uint32(ctx.buffer[4+authTokenSize : headerSize])
+		wait := ctx.inflight >= MAX_SESSION_INFLIGHT || (ctx.inflight > 0 && !isChunk)
 		ctx.mu.Unlock()
+		// A held back chunk is refused once the connection has buffered
+		// MAX_CONN_BUFFER (chunkpool.go)
+		full := c.InboundBuffered() > MAX_CONN_BUFFER
+		if wait && !(isChunk && full) {
+			held = true
+			break
+		}
 
-		totalSize := headerSize + int(payloadSize)
-		if bufLen < totalSize {
+		if isChunk {
+			if head, size, ok := peekChunk(c, headerSize, totalSize); ok {
+				if size > MAX_CHUNK_SIZE {
+					protoLog.WarnContext(ctx.connCtx, "chunk too large", "remote", ctx.remoteAddr, "size", size)
+					ctx.sendReply(ctx.reserveReply(), tagErrorResponse(fus.errorResponse("Chunk too large"), ctx.connID))
+					return gnet.Close
+				}
+				// The token is checked before anything is reserved for the
+				// chunk; a chunk sent with a bad one is discarded
+				tokenInfo, _ := fus.authMgr.ValidateToken(string(head[4 : headerSize-4]))
+				var refused []byte
+				if tokenInfo != nil {
+					limited, ok := time.Duration(0), false
+					if !wait {
+						limited, ok = fus.admitChunk(c, ctx, tokenInfo.UserID, size)
+					}
+					if !ok && !full {
+						held = true
+						break // Until woken to try again
+					}
+					if !ok {
+						refused = fus.refuseChunk(limited)
+					}
+				}
+				if action := fus.startChunk(c, ctx, head, headerSize, size, tokenInfo, refused); action != gnet.None {
+					return action
+				}
+				continue
+			}
+			// A malformed one is decoded and answered like any other command
+		}
+
+		frame, err := c.Peek(totalSize)
+		if err != nil {
 			break // Need complete message
 		}
 
-		// Authenticate
-		tokenInfo, valid := fus.authMgr.ValidateToken(authToken)
-		if !valid {
-			log.Printf("❌ Authentication failed for token: %s", authToken)
-			c.AsyncWrite(fus.authFailedResponse(), nil)
+		action := fus.handleFrame(c, ctx, frame[4:4+authTokenSize], frame[headerSize:], nil)
+		c.Discard(totalSize)
+		if action != gnet.None {
+			return action
+		}
 
+		if c.InboundBuffered() > 0 {
+			// The next message started arriving in this read
 			ctx.mu.Lock()
-			ctx.buffer = ctx.buffer[totalSize:]
+			ctx.frameStart = time.Now()
 			ctx.mu.Unlock()
-			continue
 		}
+	}
 
-		ctx.userID = tokenInfo.UserID
-		ctx.username = tokenInfo.Username
+	if c.InboundBuffered() > MAX_CONN_BUFFER {
+		protoLog.WarnContext(ctx.connCtx, "message too large", "remote", ctx.remoteAddr, "buffered", c.InboundBuffered())
+		ctx.sendReply(ctx.reserveReply(), tagErrorResponse(fus.errorResponse("Message too large"), ctx.connID))
+		return gnet.Close
+	}
+	if held {
+		ctx.held = c.InboundBuffered()
+		fus.chunkMemory.Hold(ctx.held)
+	}
 
-		// Extract payload
-		ctx.mu.Lock()
-		payload := ctx.buffer[headerSize:totalSize]
-		ctx.mu.Unlock()
+	ctx.mu.Lock()
+	ctx.buffered = c.InboundBuffered()
+	if ctx.chunk != nil {
+		ctx.buffered += ctx.chunk.filled
+	}
+	ctx.mu.Unlock()
 
-		if len(payload) < 1 {
-			log.Printf("❌ Empty payload")
-			c.AsyncWrite(fus.errorResponse("Empty payload"), nil)
+	return gnet.None
+}
 
-			ctx.mu.Lock()
-			ctx.buffer = ctx.buffer[totalSize:]
-			ctx.mu.Unlock()
-			continue
+// handleFrame authenticates and runs one complete frame: either payload,
+// which points into the connection's inbound buffer and is only valid until
+// the frame is discarded, or a received chunk.
+func (fus *FileUploadServer) handleFrame(c gnet.Conn, ctx *ClientContext, authToken, payload []byte, chunk *chunkStream) gnet.Action {
+	slot := ctx.reserveReply()
+
+	// Authenticate; a chunk's token was checked when its head arrived
+	var tokenInfo *TokenInfo
+	if chunk != nil {
+		tokenInfo = chunk.tokenInfo
+	} else {
+		tokenInfo, _ = fus.authMgr.ValidateToken(string(authToken))
+	}
+	if tokenInfo == nil {
+		authLog.WarnContext(ctx.connCtx, "authentication failed", "remote", ctx.remoteAddr, "token_len", len(authToken))
+		authFailures.Inc()
+		uploadStats.RecordFailure(FAILURE_AUTH, "", "", fmt.Errorf("invalid token from %s", ctx.remoteAddr))
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", ctx.remoteAddr, "binary protocol")
+		if chunk != nil {
+			fus.releaseChunk(chunk)
 		}
+		ctx.sendReply(slot, fus.authFailedResponse())
+		return gnet.None
+	}
 
-		// Process command
-		cmd := payload[0]
-		cmdData := payload[1:]
-
-		var response []byte
-		switch cmd {
-		case CMD_INIT_UPLOAD:
-			response = fus.handleInitUpload(ctx, cmdData)
-		case CMD_UPLOAD_CHUNK:
-			response = fus.handleUploadChunk(ctx, cmdData)
-		case CMD_PAUSE_UPLOAD:
-			response = fus.handlePauseUpload(ctx, cmdData)
-		case CMD_RESUME_UPLOAD:
-			response = fus.handleResumeUpload(ctx, cmdData)
-		case CMD_CANCEL_UPLOAD:
-			response = fus.handleCancelUpload(ctx, cmdData)
-		case CMD_GET_STATUS:
-			response = fus.handleGetStatus(ctx, cmdData)
-		default:
-			log.Printf("❌ Unknown command: 0x%02x", cmd)
-			response = fus.errorResponse(fmt.Sprintf("Unknown command: 0x%02x", cmd))
+	ctx.mu.Lock()
+	ctx.userID = tokenInfo.UserID
+	ctx.username = tokenInfo.Username
+	ctx.tenant = tokenInfo.Tenant
+	ctx.mu.Unlock()
+
+	if chunk != nil {
+		payload = chunk.head
+	}
+	if len(payload) < 1 {
+		protoLog.WarnContext(ctx.connCtx, "empty payload", "remote", ctx.remoteAddr)
+		ctx.sendReply(slot, tagErrorResponse(fus.errorResponse("Empty payload"), ctx.connID))
+		return gnet.None
+	}
+
+	// Process command
+	cmd := payload[0]
+	name, ok := protocol.CommandNames[cmd]
+	if !ok {
+		name = "UNKNOWN"
+	}
+
+	frameSize := 8 + len(authToken) + len(payload)
+	if chunk != nil {
+		frameSize += chunk.size
+	}
+	reqCtx, span := tracer.Start(ctx.connCtx, "binary."+name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("conn.id", ctx.connID),
+			attribute.String("user.id", ctx.userID),
+			attribute.String("net.peer.addr", ctx.remoteAddr),
+			attribute.Int("message.size", frameSize),
+		))
+
+	var response []byte
+	if chunk != nil && chunk.refused != nil {
+		response = chunk.refused
+	} else if wait, ok := fus.allowCommand(ctx, tokenInfo.UserID, cmd); !ok {
+		response = rateLimitedResponse(wait)
+	} else if chunk != nil {
+		response = fus.submitChunk(c, ctx, slot, reqCtx, span, chunk, tokenInfo.UserID)
+		if response == nil {
+			return gnet.None // A chunk worker answers
 		}
+	} else if command := protocol.NewCommand(cmd); command == nil {
+		protoLog.WarnContext(ctx.connCtx, "unknown command", "remote", ctx.remoteAddr, "command", fmt.Sprintf("0x%02x", cmd))
+		response = fus.errorResponse(fmt.Sprintf("Unknown command: 0x%02x", cmd))
+	} else if _, err := protocol.Decode(command, payload[1:]); err != nil {
+		response = fus.errorResponse(fmt.Sprintf("Invalid %s: %v", name, err))
+	} else {
+		response = fus.handleCommand(reqCtx, ctx, command)
+	}
+	return fus.respond(c, ctx, slot, reqCtx, span, cmd, response)
+}
 
-		c.AsyncWrite(response, nil)
+// submitChunk hands a received UPLOAD_CHUNK to a chunk worker and returns
+// nil, or returns the error response if the workers are all busy.
+func (fus *FileUploadServer) submitChunk(c gnet.Conn, ctx *ClientContext, slot *reply, reqCtx context.Context, span trace.Span, chunk *chunkStream, userID string) []byte {
+	ctx.mu.Lock()
+	receiveTime := time.Since(ctx.frameStart)
+	ctx.inflight++
+	ctx.mu.Unlock()
+
+	body := chunk.body(receiveTime)
+	err := fus.chunkPool.Submit(func() {
+		response := fus.handleUploadChunk(reqCtx, userID, chunk.cmd, body)
+		fus.releaseChunk(chunk)
+		if fus.respond(c, ctx, slot, reqCtx, span, protocol.CMD_UPLOAD_CHUNK, response) == gnet.Close {
+			c.Close()
+			return
+		}
 
-		// Remove processed message
 		ctx.mu.Lock()
-		ctx.buffer = ctx.buffer[totalSize:]
+		ctx.inflight--
+		ctx.mu.Unlock()
+		// Writes the ACK and reads any frames held back meanwhile
+		c.Wake(nil)
+	})
+	if err != nil {
+		fus.releaseChunk(chunk)
+		ctx.mu.Lock()
+		ctx.inflight--
 		ctx.mu.Unlock()
+		chunksReceived.WithLabelValues("busy").Inc()
+		return fus.errorResponse(err.Error())
+	}
+	return nil
+}
+
+// respond finishes a command: it tags errors with the connection ID, ends the
+// span and fills the command's reply slot, unless fault injection delays or
+// drops the response. Safe to call off the event loop.
+func (fus *FileUploadServer) respond(c gnet.Conn, ctx *ClientContext, slot *reply, reqCtx context.Context, span trace.Span, cmd byte, response []byte) gnet.Action {
+	if len(response) > 0 && response[0] == protocol.RESP_ERROR {
+		span.SetStatus(codes.Error, string(response[2:]))
+		response = tagErrorResponse(response, ctx.connID)
 	}
+	span.End()
 
+	fault := ""
+	if cmd == protocol.CMD_UPLOAD_CHUNK && len(response) > 0 && response[0] != protocol.RESP_ERROR {
+		fault = ackFault(reqCtx)
+	}
+	switch fault {
+	case FAULT_DROP:
+		return gnet.Close
+	case FAULT_DELAY:
+		time.AfterFunc(faultDelay(), func() {
+			ctx.sendReply(slot, response)
+			c.Wake(nil)
+		})
+	default:
+		ctx.sendReply(slot, response)
+	}
 	return gnet.None
 }
 
-// CMD_INIT_UPLOAD: filename_size(2) | filename | total_chunks(4) | chunk_size(4)
-func (fus *FileUploadServer) handleInitUpload(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid INIT_UPLOAD: missing filename size")
+// handleCommand runs the handler of a decoded command. UPLOAD_CHUNK goes to
+// a chunk worker instead (submitChunk).
+func (fus *FileUploadServer) handleCommand(reqCtx context.Context, ctx *ClientContext, cmd protocol.Message) []byte {
+	switch cmd := cmd.(type) {
+	case *protocol.InitUpload:
+		return fus.handleInitUpload(reqCtx, ctx, cmd.FileName, cmd.TotalChunks, cmd.ChunkSize, "", cmd.Compression)
+	case *protocol.InitUploadVerified:
+		fileHash, err := normalizeFileHash(cmd.SHA256)
+		if err != nil {
+			return fus.errorResponse(err.Error())
+		}
+		return fus.handleInitUpload(reqCtx, ctx, cmd.FileName, cmd.TotalChunks, cmd.ChunkSize, fileHash, cmd.Compression)
+	case *protocol.PauseUpload:
+		return fus.handlePauseUpload(reqCtx, ctx, cmd)
+	case *protocol.ResumeUpload:
+		return fus.handleResumeUpload(reqCtx, ctx, cmd)
+	case *protocol.CancelUpload:
+		return fus.handleCancelUpload(reqCtx, ctx, cmd)
+	case *protocol.GetStatus:
+		return fus.handleGetStatus(reqCtx, ctx, cmd)
+	default:
+		return fus.errorResponse(fmt.Sprintf("Unsupported command: 0x%02x", cmd.Code()))
 	}
+}
+
+// handleInitUpload serves INIT_UPLOAD, and INIT_UPLOAD_VERIFIED with a
+// fileHash. A session completed by copy at once (dedup.go) is answered with
+// RESP_COMPLETE instead of RESP_READY, and a client that offered compression
+// codecs with RESP_READY_COMPRESSED (compress.go).
+func (fus *FileUploadServer) handleInitUpload(reqCtx context.Context, ctx *ClientContext, fileName string, totalChunks, chunkSize uint32, fileHash string, offered uint8) []byte {
+	protoLog.InfoContext(reqCtx, "INIT_UPLOAD", "user", ctx.username, "file", fileName,
+		"chunks", totalChunks, "chunk_size", chunkSize, "sha256", fileHash, "compression", offered)
 
-	fileNameSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+fileNameSize+4+4) {
-		return fus.errorResponse("Invalid INIT_UPLOAD: incomplete data")
+	session, err := fus.startUpload(reqCtx, ctx.tenant, nil, ctx.userID, ctx.username, fileName, totalChunks, chunkSize, fileHash, nil)
+	if err != nil {
+		return fus.errorResponse(err.Error())
+	}
+	if session.GetState() == STATE_COMPLETED {
+		return protocol.Encode(&protocol.CompleteResp{S3Key: session.S3Key, FileSize: session.TotalSize})
 	}
 
-	fileName := string(data[2 : 2+fileNameSize])
-	totalChunks := binary.BigEndian.Uint32(data[2+fileNameSize : 2+fileNameSize+4])
-	chunkSize := binary.BigEndian.Uint32(data[2+fileNameSize+4 : 2+fileNameSize+8])
+	ctx.mu.Lock()
+	ctx.session = session
+	ctx.mu.Unlock()
+
+	if offered != 0 {
+		codec := chooseCompression(offered, chunkSize)
+		if codec != 0 {
+			session.mu.Lock()
+			session.Compression = codec
+			session.save()
+			session.mu.Unlock()
+		}
+		return protocol.Encode(&protocol.ReadyCompressedResp{SessionID: session.SessionID, S3Key: session.S3Key, Compression: codec})
+	}
+	return protocol.Encode(&protocol.ReadyResp{SessionID: session.SessionID, S3Key: session.S3Key})
+}
 
-	log.Printf("📥 INIT_UPLOAD: user=%s, file=%s, chunks=%d, chunk_size=%d MB",
-		ctx.username, fileName, totalChunks, chunkSize/(1024*1024))
+// startUpload creates a session and its S3 multipart upload. Shared by the
+// binary protocol and the HTTP API. A session with a fileHash already stored
+// is completed at once instead (see dedup.go).
+func (fus *FileUploadServer) startUpload(reqCtx context.Context, tenant *Tenant, preset *UploadPreset, userID, username, fileName string, totalChunks, chunkSize uint32, fileHash string, attributes map[string]string) (*UploadSession, error) {
+	if draining.Load() {
+		return nil, errDraining
+	}
 
 	// Create session
-	session, err := fus.sessionMgr.CreateSession(ctx.userID, ctx.username, fileName, totalChunks, chunkSize)
+	session, err := fus.createSession(tenant, preset, userID, username, fileName, totalChunks, chunkSize)
 	if err != nil {
-		log.Printf("❌ Failed to create session: %v", err)
-		return fus.errorResponse(err.Error())
+		sessionLog.WarnContext(reqCtx, "failed to create session", "user", username, "file", fileName, "err", err)
+		return nil, err
 	}
+	trace.SpanFromContext(reqCtx).SetAttributes(attribute.String("upload.session_id", session.SessionID))
+	session.mu.Lock()
+	session.FileHash = fileHash
+	session.Attributes = attributes
+	session.mu.Unlock()
 
-	ctx.session = session
+	if fileHash != "" && fus.completeByCopy(reqCtx, session) {
+		return session, nil
+	}
+
+	// A restart may have left this file's upload without its session
+	if fus.sessionMgr.adoptOrphan(session) {
+		return session, nil
+	}
 
 	// Initialize S3 multipart upload
 	result, err := fus.s3Client.client.CreateMultipartUpload(
-		context.Background(),
+		reqCtx,
 		&s3.CreateMultipartUploadInput{
 			Bucket:      aws.String(fus.s3Client.bucket),
 			Key:         aws.String(session.S3Key),
 			ContentType: aws.String(session.ContentType),
+			// Lets downloaders recompute the multipart ETag (see handleDownload)
+			Metadata: map[string]string{OBJECT_META_CHUNK_SIZE: strconv.FormatUint(uint64(session.ChunkSize), 10)},
 		},
 	)
 	if err != nil {
-		log.Printf("❌ Failed to initialize S3 multipart upload: %v", err)
-		return fus.errorResponse(err.Error())
+		s3Log.ErrorContext(reqCtx, "failed to initialize multipart upload", "session_id", session.SessionID, "err", err)
+		return nil, err
 	}
 
+	session.mu.Lock()
 	session.UploadID = *result.UploadId
-	log.Printf("✅ S3 multipart upload initialized: %s (path: %s)", session.UploadID, session.S3Key)
-
-	// Response: RESP_READY | session_id_size(2) | session_id | s3_key_size(2) | s3_key
-	sessionIDBytes := []byte(session.SessionID)
-	s3KeyBytes := []byte(session.S3Key)
-
-	response := make([]byte, 1+2+len(sessionIDBytes)+2+len(s3KeyBytes))
-	response[0] = RESP_READY
-	binary.BigEndian.PutUint16(response[1:3], uint16(len(sessionIDBytes)))
-	copy(response[3:3+len(sessionIDBytes)], sessionIDBytes)
-	binary.BigEndian.PutUint16(response[3+len(sessionIDBytes):5+len(sessionIDBytes)], uint16(len(s3KeyBytes)))
-	copy(response[5+len(sessionIDBytes):], s3KeyBytes)
+	session.save()
+	session.mu.Unlock()
+	s3Log.InfoContext(reqCtx, "multipart upload initialized", "session_id", session.SessionID, "upload_id", session.UploadID, "s3_key", session.S3Key)
 
-	return response
+	return session, nil
 }
 
-func (fus *FileUploadServer) handleUploadChunk(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid UPLOAD_CHUNK: missing session ID size")
+// createSession creates the session once the tenant's quota and session cap,
+// and the user's quota, allow it.
+func (fus *FileUploadServer) createSession(tenant *Tenant, preset *UploadPreset, userID, username, fileName string, totalChunks, chunkSize uint32) (*UploadSession, error) {
+	totalSize := uint64(totalChunks) * uint64(chunkSize)
+	if tenant != nil {
+		tenant.mu.Lock()
+		defer tenant.mu.Unlock()
+		if err := fus.checkTenantLimits(tenant, totalSize); err != nil {
+			return nil, err
+		}
 	}
-
-	sessionIDSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+sessionIDSize+4+4) {
-		return fus.errorResponse("Invalid UPLOAD_CHUNK: incomplete header")
+	if quota := fus.userQuota(userID); quota > 0 {
+		fus.quotaMu.Lock()
+		defer fus.quotaMu.Unlock()
+		if err := fus.checkUserQuota(userID, quota, totalSize); err != nil {
+			return nil, err
+		}
 	}
+	return fus.sessionMgr.CreateSession(tenant, preset, userID, username, fileName, totalChunks, chunkSize)
+}
 
-	sessionID := string(data[2 : 2+sessionIDSize])
-	chunkIndex := binary.BigEndian.Uint32(data[2+sessionIDSize : 2+sessionIDSize+4])
-	chunkSize := binary.BigEndian.Uint32(data[2+sessionIDSize+4 : 2+sessionIDSize+8])
+// handleUploadChunk runs on a chunk worker for userID, the frame's user.
+// body holds the chunk's data, hashed while the frame arrived.
+func (fus *FileUploadServer) handleUploadChunk(reqCtx context.Context, userID string, cmd *protocol.UploadChunk, body chunkBody) []byte {
+	start := time.Now()
+	defer func() {
+		chunkDuration.Observe(time.Since(start).Seconds())
+	}()
 
-	// FIX: Cast to int to avoid type mismatch
-	headerSize := int(2 + sessionIDSize + 8)
-	totalSize := headerSize + int(chunkSize)
+	chunkReceiveDuration.Observe(body.receiveTime().Seconds())
 
-	if len(data) < totalSize {
-		return fus.errorResponse("Invalid UPLOAD_CHUNK: incomplete chunk data")
-	}
+	sessionID, chunkIndex := cmd.SessionID, cmd.ChunkIndex
 
-	chunkData := data[headerSize:totalSize]
+	trace.SpanFromContext(reqCtx).SetAttributes(
+		attribute.String("upload.session_id", sessionID),
+		attribute.Int64("upload.chunk_index", int64(chunkIndex)),
+		attribute.Int64("upload.chunk_size", int64(body.size())),
+	)
 
 	// Verify session
 	session := fus.sessionMgr.GetSession(sessionID)
@@ -708,84 +1285,193 @@ func (fus *FileUploadServer) handleUploadChunk(ctx *ClientContext, data []byte)
 		return fus.errorResponse("Invalid session ID")
 	}
 
-	if session.UserID != ctx.userID {
+	if session.UserID != userID {
 		return fus.errorResponse("Session does not belong to user")
 	}
 
-	if session.State == STATE_PAUSED {
-		return fus.errorResponse("Upload is paused. Resume first.")
-	}
-
-	if session.State == STATE_CANCELLED {
-		return fus.errorResponse("Upload was cancelled")
+	session.mu.Lock()
+	codec := session.Compression
+	session.mu.Unlock()
+	if codec != 0 {
+		decompressed, release, err := fus.decompressChunk(session, codec, body)
+		if err != nil {
+			if errors.Is(err, errServerBusy) {
+				chunksReceived.WithLabelValues("busy").Inc()
+			} else {
+				chunksReceived.WithLabelValues("error").Inc()
+			}
+			return fus.errorResponse(err.Error())
+		}
+		defer release()
+		body = decompressed
 	}
 
-	// Calculate chunk hash
-	hash := sha256.Sum256(chunkData)
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Upload chunk to S3
-	partNumber := int32(chunkIndex) + 1
-
-	result, err := fus.s3Client.client.UploadPart(
-		context.Background(),
-		&s3.UploadPartInput{
-			Bucket:     aws.String(fus.s3Client.bucket),
-			Key:        aws.String(session.S3Key),
-			UploadId:   aws.String(session.UploadID),
-			PartNumber: aws.Int32(partNumber),
-			Body:       bytes.NewReader(chunkData),
-		},
-	)
+	isDuplicate, err := fus.storeChunk(reqCtx, session, chunkIndex, body)
 	if err != nil {
-		log.Printf("❌ Failed to upload part %d: %v", partNumber, err)
-		return fus.errorResponse(fmt.Sprintf("S3 upload failed: %v", err))
+		return fus.errorResponse(err.Error())
 	}
-
-	// Add chunk to session
-	isDuplicate := session.AddChunk(chunkIndex, chunkSize, hashStr, partNumber, *result.ETag)
-
 	received, total := session.GetProgress()
-	log.Printf("📦 Chunk %d/%d uploaded (%.1f%%, hash: %s, etag: %s)",
-		received, total, float64(received)/float64(total)*100, hashStr[:8], *result.ETag)
 
-	// Check if upload is complete
+	// Check if upload is complete. With parallel connections another chunk
+	// may already be finalizing; this one is then acknowledged as usual.
 	if session.IsComplete() {
-		return fus.finalizeUpload(session)
+		if response := fus.finalizeUpload(reqCtx, session); response != nil {
+			return response
+		}
 	}
 
 	// Response
 	if isDuplicate {
-		// RESP_DUPLICATE | chunk_index(4) | progress(4)
-		response := make([]byte, 9)
-		response[0] = RESP_DUPLICATE
-		binary.BigEndian.PutUint32(response[1:5], chunkIndex)
-		binary.BigEndian.PutUint32(response[5:9], received)
-		return response
+		return protocol.Encode(&protocol.DuplicateResp{ChunkIndex: chunkIndex, Received: received})
+	}
+
+	bytesPerSec, eta, measured := session.GetThroughput()
+	etaSeconds := uint32(protocol.ETA_UNKNOWN)
+	if measured {
+		etaSeconds = uint32(min(eta.Seconds(), protocol.ETA_UNKNOWN-1))
 	}
 
-	// RESP_CHUNK_ACK | chunk_index(4) | progress(4) | total(4)
-	response := make([]byte, 13)
-	response[0] = RESP_CHUNK_ACK
-	binary.BigEndian.PutUint32(response[1:5], chunkIndex)
-	binary.BigEndian.PutUint32(response[5:9], received)
-	binary.BigEndian.PutUint32(response[9:13], total)
+	return protocol.Encode(&protocol.ChunkAckResp{
+		ChunkIndex:  chunkIndex,
+		Received:    received,
+		Total:       total,
+		BytesPerSec: bytesPerSec,
+		ETASeconds:  etaSeconds,
+	})
+}
+
+// chunkBody is a chunk's data on its way to storage. A chunk sent over the
+// binary protocol is whole in memory, or past MAX_MEMORY_CHUNK_SIZE in a file
+// (largechunk.go), hashed while it arrived. The HTTP API
+// streams each chunk from the request body into storage (upload_http.go),
+// so its digest is known only once the last byte has been read.
+type chunkBody interface {
+	io.Reader
+	size() uint32
+	// tee copies the data to w as it is read.
+	tee(w io.Writer)
+	// digest reads whatever storage left unread and returns the chunk's
+	// SHA-256. An error means the chunk arrived damaged and must not count.
+	digest() ([sha256.Size]byte, error)
+	// receiveTime is how long the chunk has waited on the client so far.
+	receiveTime() time.Duration
+}
+
+// memoryChunk is a received chunk. It can be seeked, so the S3 client signs
+// it and retries failed requests.
+type memoryChunk struct {
+	*bytes.Reader
+	data    []byte
+	hash    [sha256.Size]byte
+	receive time.Duration
+}
 
-	return response
+func newMemoryChunk(data []byte, hash [sha256.Size]byte, receive time.Duration) *memoryChunk {
+	return &memoryChunk{Reader: bytes.NewReader(data), data: data, hash: hash, receive: receive}
 }
 
-// CMD_PAUSE_UPLOAD: session_id_size(2) | session_id
-func (fus *FileUploadServer) handlePauseUpload(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid PAUSE_UPLOAD: missing session ID size")
+func (mc *memoryChunk) size() uint32                       { return uint32(len(mc.data)) }
+func (mc *memoryChunk) tee(w io.Writer)                    { w.Write(mc.data) }
+func (mc *memoryChunk) digest() ([sha256.Size]byte, error) { return mc.hash, nil }
+func (mc *memoryChunk) receiveTime() time.Duration         { return mc.receive }
+
+// storeChunk writes one chunk of a session to S3 and records it. Shared by
+// the binary protocol and the HTTP API; the caller has checked ownership.
+func (fus *FileUploadServer) storeChunk(reqCtx context.Context, session *UploadSession, chunkIndex uint32, body chunkBody) (isDuplicate bool, err error) {
+	sessionID := session.SessionID
+	chunkSize := body.size()
+
+	state := session.GetState()
+	if state == STATE_PAUSED {
+		return false, errors.New("Upload is paused. Resume first.")
+	}
+
+	if state == STATE_CANCELLED {
+		return false, errors.New("Upload was cancelled")
 	}
 
-	sessionIDSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+sessionIDSize) {
-		return fus.errorResponse("Invalid PAUSE_UPLOAD: incomplete data")
+	if injectFault(reqCtx, FAULT_NACK, FAULT_NACK_PERCENT) {
+		chunksReceived.WithLabelValues("error").Inc()
+		return false, errInjectedNack
 	}
 
-	sessionID := string(data[2 : 2+sessionIDSize])
+	if !session.beginChunk() {
+		chunksReceived.WithLabelValues("busy").Inc()
+		return false, errSessionBusy
+	}
+	defer session.endChunk()
+
+	// Keep leading chunks locally so the upload can be previewed
+	spooled, err := fus.spool.Create(sessionID, chunkIndex)
+	if err != nil {
+		chunkLog.WarnContext(reqCtx, "failed to spool chunk for preview", "session_id", sessionID, "chunk_index", chunkIndex, "err", err)
+	}
+	if spooled != nil {
+		body.tee(spooled)
+	}
+
+	// Upload chunk to S3, as its own part or once its part is complete. A
+	// chunk that is already stored is not sent again: its part may be gone
+	// from staging, and a damaged copy would replace a good one.
+	partNumber := session.PartNumber(chunkIndex)
+	receivedBefore := body.receiveTime()
+	partStart := time.Now()
+	var etag string
+	switch {
+	case session.hasChunk(chunkIndex):
+	case session.ChunksPerPart > 1:
+		etag, err = fus.aggregateChunk(reqCtx, session, chunkIndex, body)
+	default:
+		etag, err = fus.uploadPart(reqCtx, session, partNumber, body, int64(chunkSize))
+	}
+	var hash [sha256.Size]byte
+	if err == nil {
+		hash, err = body.digest()
+	}
+	if err != nil {
+		if spooled != nil {
+			spooled.Discard()
+		}
+		chunksReceived.WithLabelValues("error").Inc()
+		uploadStats.RecordFailure(FAILURE_CHUNK, sessionID, session.UserID, err)
+		return false, err
+	}
+	// A streamed chunk arrives while it is stored; the wait on the client
+	// is not S3's
+	partTime := time.Since(partStart) - (body.receiveTime() - receivedBefore)
+	session.recordChunkTiming(reqCtx, chunkIndex, chunkSize, body.receiveTime(), partTime)
+
+	// Add chunk to session
+	hashStr := hex.EncodeToString(hash[:])
+	isDuplicate = session.AddChunk(chunkIndex, chunkSize, hashStr, partNumber, etag)
+
+	if isDuplicate {
+		chunksReceived.WithLabelValues("duplicate").Inc()
+	} else {
+		chunksReceived.WithLabelValues("ok").Inc()
+		bytesUploaded.Add(float64(chunkSize))
+		uploadStats.RecordChunk(session.UserID, chunkSize)
+		fus.usage.RecordUpload(session.UserID, uint64(chunkSize))
+		eventBus.ChunkReceived(session, chunkIndex, chunkSize)
+	}
+
+	if spooled != nil {
+		if isDuplicate {
+			spooled.Discard()
+		} else if err := spooled.Commit(); err != nil {
+			chunkLog.WarnContext(reqCtx, "failed to spool chunk for preview", "session_id", sessionID, "chunk_index", chunkIndex, "err", err)
+		}
+	}
+
+	received, total := session.GetProgress()
+	chunkLog.InfoContext(reqCtx, "chunk uploaded", "session_id", sessionID, "chunk_index", chunkIndex,
+		"received", received, "total", total, "hash", hashStr[:8], "etag", etag)
+
+	return isDuplicate, nil
+}
+
+func (fus *FileUploadServer) handlePauseUpload(reqCtx context.Context, ctx *ClientContext, cmd *protocol.PauseUpload) []byte {
+	sessionID := cmd.SessionID
 
 	session := fus.sessionMgr.GetSession(sessionID)
 	if session == nil {
@@ -797,31 +1483,16 @@ func (fus *FileUploadServer) handlePauseUpload(ctx *ClientContext, data []byte)
 	}
 
 	session.Pause()
+	auditLog.Record(AUDIT_SESSION_PAUSED, ctx.userID, sessionID, ctx.remoteAddr, "")
 	received, total := session.GetProgress()
 
-	log.Printf("⏸️  Upload paused: session=%s, progress=%d/%d", sessionID, received, total)
+	sessionLog.InfoContext(reqCtx, "upload paused", "session_id", sessionID, "received", received, "total", total)
 
-	// Response: RESP_PAUSED | received(4) | total(4)
-	response := make([]byte, 9)
-	response[0] = RESP_PAUSED
-	binary.BigEndian.PutUint32(response[1:5], received)
-	binary.BigEndian.PutUint32(response[5:9], total)
-
-	return response
+	return protocol.Encode(&protocol.PausedResp{Received: received, Total: total})
 }
 
-// CMD_RESUME_UPLOAD: session_id_size(2) | session_id
-func (fus *FileUploadServer) handleResumeUpload(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid RESUME_UPLOAD: missing session ID size")
-	}
-
-	sessionIDSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+sessionIDSize) {
-		return fus.errorResponse("Invalid RESUME_UPLOAD: incomplete data")
-	}
-
-	sessionID := string(data[2 : 2+sessionIDSize])
+func (fus *FileUploadServer) handleResumeUpload(reqCtx context.Context, ctx *ClientContext, cmd *protocol.ResumeUpload) []byte {
+	sessionID := cmd.SessionID
 
 	session := fus.sessionMgr.GetSession(sessionID)
 	if session == nil {
@@ -832,42 +1503,27 @@ func (fus *FileUploadServer) handleResumeUpload(ctx *ClientContext, data []byte)
 		return fus.errorResponse("Session does not belong to user")
 	}
 
-	if session.State != STATE_PAUSED {
+	if session.GetState() != STATE_PAUSED {
 		return fus.errorResponse("Upload is not paused")
 	}
 
-	session.Resume()
+	codec := chooseCompression(cmd.Compression, session.ChunkSize)
+	session.Resume(codec)
+	auditLog.Record(AUDIT_SESSION_RESUMED, ctx.userID, sessionID, ctx.remoteAddr, "")
 	received, total := session.GetProgress()
 	missing := session.GetMissingChunks()
 
-	log.Printf("▶️  Upload resumed: session=%s, progress=%d/%d, missing=%d", sessionID, received, total, len(missing))
-
-	// Response: RESP_RESUMED | received(4) | total(4) | missing_count(4) | missing_chunks...
-	response := make([]byte, 13+len(missing)*4)
-	response[0] = RESP_RESUMED
-	binary.BigEndian.PutUint32(response[1:5], received)
-	binary.BigEndian.PutUint32(response[5:9], total)
-	binary.BigEndian.PutUint32(response[9:13], uint32(len(missing)))
+	sessionLog.InfoContext(reqCtx, "upload resumed", "session_id", sessionID, "received", received, "total", total, "missing", len(missing),
+		"compression", compression.Name(codec))
 
-	for i, chunkIdx := range missing {
-		binary.BigEndian.PutUint32(response[13+i*4:13+(i+1)*4], chunkIdx)
+	if cmd.Compression != 0 {
+		return protocol.Encode(&protocol.ResumedCompressedResp{Received: received, Total: total, Missing: missing, Compression: codec})
 	}
-
-	return response
+	return protocol.Encode(&protocol.ResumedResp{Received: received, Total: total, Missing: missing})
 }
 
-// CMD_CANCEL_UPLOAD: session_id_size(2) | session_id
-func (fus *FileUploadServer) handleCancelUpload(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid CANCEL_UPLOAD: missing session ID size")
-	}
-
-	sessionIDSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+sessionIDSize) {
-		return fus.errorResponse("Invalid CANCEL_UPLOAD: incomplete data")
-	}
-
-	sessionID := string(data[2 : 2+sessionIDSize])
+func (fus *FileUploadServer) handleCancelUpload(reqCtx context.Context, ctx *ClientContext, cmd *protocol.CancelUpload) []byte {
+	sessionID := cmd.SessionID
 
 	session := fus.sessionMgr.GetSession(sessionID)
 	if session == nil {
@@ -878,41 +1534,39 @@ func (fus *FileUploadServer) handleCancelUpload(ctx *ClientContext, data []byte)
 		return fus.errorResponse("Session does not belong to user")
 	}
 
+	fus.cancelUpload(reqCtx, session, ctx.remoteAddr)
+
+	return protocol.Encode(&protocol.CancelledResp{})
+}
+
+// cancelUpload aborts the S3 multipart upload and forgets the session.
+func (fus *FileUploadServer) cancelUpload(reqCtx context.Context, session *UploadSession, remoteAddr string) {
+	sessionID := session.SessionID
+
 	session.Cancel()
+	auditLog.Record(AUDIT_SESSION_CANCELLED, session.UserID, sessionID, remoteAddr, "")
+	eventBus.Publish(EVENT_SESSION_CANCELLED, session, nil)
 
-	log.Printf("🛑 Upload cancelled: session=%s", sessionID)
+	sessionLog.InfoContext(reqCtx, "upload cancelled", "session_id", sessionID)
 
 	// Abort S3 multipart upload
 	if session.UploadID != "" {
-		_, err := fus.s3Client.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		_, err := fus.s3Client.client.AbortMultipartUpload(reqCtx, &s3.AbortMultipartUploadInput{
 			Bucket:   aws.String(fus.s3Client.bucket),
 			Key:      aws.String(session.S3Key),
 			UploadId: aws.String(session.UploadID),
 		})
 		if err != nil {
-			log.Printf("⚠️  Failed to abort S3 upload: %v", err)
+			s3Log.WarnContext(reqCtx, "failed to abort multipart upload", "session_id", sessionID, "err", err)
 		}
 	}
 
 	// Clean up session
 	fus.sessionMgr.DeleteSession(sessionID)
-
-	// Response: RESP_CANCELLED
-	return []byte{RESP_CANCELLED}
 }
 
-// CMD_GET_STATUS: session_id_size(2) | session_id
-func (fus *FileUploadServer) handleGetStatus(ctx *ClientContext, data []byte) []byte {
-	if len(data) < 2 {
-		return fus.errorResponse("Invalid GET_STATUS: missing session ID size")
-	}
-
-	sessionIDSize := binary.BigEndian.Uint16(data[0:2])
-	if len(data) < int(2+sessionIDSize) {
-		return fus.errorResponse("Invalid GET_STATUS: incomplete data")
-	}
-
-	sessionID := string(data[2 : 2+sessionIDSize])
+func (fus *FileUploadServer) handleGetStatus(reqCtx context.Context, ctx *ClientContext, cmd *protocol.GetStatus) []byte {
+	sessionID := cmd.SessionID
 
 	session := fus.sessionMgr.GetSession(sessionID)
 	if session == nil {
@@ -924,82 +1578,175 @@ func (fus *FileUploadServer) handleGetStatus(ctx *ClientContext, data []byte) []
 	}
 
 	received, total := session.GetProgress()
-	stateBytes := []byte(session.State)
+	return protocol.Encode(&protocol.StatusResp{State: session.GetState(), Received: received, Total: total})
+}
 
-	// Response: RESP_STATUS | state_size(1) | state | received(4) | total(4)
-	response := make([]byte, 1+1+len(stateBytes)+4+4)
-	response[0] = RESP_STATUS
-	response[1] = byte(len(stateBytes))
-	copy(response[2:2+len(stateBytes)], stateBytes)
-	binary.BigEndian.PutUint32(response[2+len(stateBytes):6+len(stateBytes)], received)
-	binary.BigEndian.PutUint32(response[6+len(stateBytes):10+len(stateBytes)], total)
+// finalizeUpload returns nil if another request is finalizing the session.
+func (fus *FileUploadServer) finalizeUpload(reqCtx context.Context, session *UploadSession) []byte {
+	err := fus.completeUpload(reqCtx, session)
+	if errors.Is(err, errFinalizing) {
+		return nil
+	}
+	var hashErr *fileHashError
+	if errors.As(err, &hashErr) {
+		return protocol.Encode(&protocol.HashMismatchResp{Declared: hashErr.declared, SHA256: hashErr.sha256})
+	}
+	if err != nil {
+		return fus.errorResponse(fmt.Sprintf("Failed to complete upload: %v", err))
+	}
 
-	return response
+	return protocol.Encode(&protocol.CompleteResp{S3Key: session.S3Key, FileSize: session.TotalSize})
 }
 
-func (fus *FileUploadServer) finalizeUpload(session *UploadSession) []byte {
-	log.Printf("🔄 Finalizing upload: session=%s, file=%s, parts=%d", session.SessionID, session.FileName, len(session.CompletedParts))
+// completeUpload assembles the S3 object once every chunk has arrived.
+func (fus *FileUploadServer) completeUpload(reqCtx context.Context, session *UploadSession) error {
+	// Concurrent chunks (parallel HTTP requests) can all see the session
+	// complete; only the first one finalizes
+	session.mu.Lock()
+	switch session.State {
+	case STATE_COMPLETED:
+		session.mu.Unlock()
+		return nil
+	case STATE_FINALIZING:
+		session.mu.Unlock()
+		return errFinalizing
+	}
+	session.setState(STATE_FINALIZING)
+	// AddChunk keeps the parts in ascending order
+	parts := slices.Clone(session.CompletedParts)
+	session.mu.Unlock()
+
+	sessionLog.InfoContext(reqCtx, "finalizing upload", "session_id", session.SessionID, "file", session.FileName, "parts", len(parts))
+
+	reqCtx, span := tracer.Start(reqCtx, "finalize_upload", trace.WithAttributes(
+		attribute.String("upload.session_id", session.SessionID),
+		attribute.Int("upload.parts", len(parts)),
+	))
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		finalizeDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	// Complete S3 multipart upload
-	_, err := fus.s3Client.client.CompleteMultipartUpload(
-		context.Background(),
+	result, err := fus.s3Client.client.CompleteMultipartUpload(
+		reqCtx,
 		&s3.CompleteMultipartUploadInput{
 			Bucket:   aws.String(fus.s3Client.bucket),
 			Key:      aws.String(session.S3Key),
 			UploadId: aws.String(session.UploadID),
 			MultipartUpload: &types.CompletedMultipartUpload{
-				Parts: session.CompletedParts,
+				Parts: parts,
 			},
 		},
 	)
+	// Before the lock, which would keep a mismatched file from being deleted
+	if err == nil && session.FileHash != "" {
+		err = fus.checkFileHash(reqCtx, session)
+	}
+	if err == nil {
+		err = fus.lockUpload(reqCtx, session)
+	}
 	if err != nil {
-		log.Printf("❌ Failed to complete S3 upload: %v", err)
-		session.State = STATE_FAILED
-		return fus.errorResponse(fmt.Sprintf("Failed to complete upload: %v", err))
+		reason, message := "finalize", "the file could not be assembled in storage"
+		var hashErr *fileHashError
+		if errors.As(err, &hashErr) {
+			reason, message = "file_hash", "the file received does not match the one declared"
+			if err := fus.s3Client.deleteObject(reqCtx, session.S3Key); err != nil {
+				s3Log.WarnContext(reqCtx, "failed to delete mismatched file", "s3_key", session.S3Key, "err", err)
+			}
+		} else {
+			s3Log.ErrorContext(reqCtx, "failed to complete multipart upload", "session_id", session.SessionID, "err", err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "complete multipart upload failed")
+		session.mu.Lock()
+		session.setState(STATE_FAILED)
+		session.save()
+		session.mu.Unlock()
+		uploadStats.RecordFailure(FAILURE_FINALIZE, session.SessionID, session.UserID, err)
+		auditLog.Record(AUDIT_SESSION_FAILED, session.UserID, session.SessionID, "", err.Error())
+		eventBus.Publish(EVENT_SESSION_FAILED, session, map[string]string{"reason": reason, "error": err.Error()})
+		fus.notifier.UploadFailed(session, message)
+		return err
 	}
+	fus.s3Client.listings.Invalidate(session.S3Key)
+	fus.recordFile(reqCtx, session, aws.ToString(result.ETag))
 
 	session.mu.Lock()
-	session.State = STATE_COMPLETED
+	session.setState(STATE_COMPLETED)
 	session.UpdatedAt = time.Now()
+	session.save()
 	session.mu.Unlock()
 
-	log.Printf("✅ Upload completed: file=%s, size=%.2f MB, s3_key=%s",
-		session.FileName, float64(session.TotalSize)/(1024*1024), session.S3Key)
+	fus.usage.RecordStored(session.UserID, session.TotalSize)
+	auditLog.Record(AUDIT_SESSION_COMPLETED, session.UserID, session.SessionID, "", session.S3Key)
+	fus.activity.Record(ACTIVITY_UPLOAD_COMPLETED, session.S3Key, session.UserID, "")
+	eventBus.Publish(EVENT_SESSION_COMPLETED, session, session.Preset.eventData(map[string]interface{}{
+		"size_bytes":   session.TotalSize,
+		"content_type": session.ContentType,
+	}))
+	fus.deliverPreset(reqCtx, session)
+	fus.notifier.UploadCompleted(session)
+
+	// The object is now readable from S3, the preview copy is no longer needed
+	fus.spool.Remove(session.SessionID)
+	fus.staging.Remove(session.SessionID)
+
+	// Catch bad client-side chunking early without delaying the response
+	if INTEGRITY_PROBE_ENABLED {
+		go fus.verifyIntegrity(context.WithoutCancel(reqCtx), session)
+	}
+	fus.indexer.Enqueue(session.S3Key, session.ContentType)
 
-	// Response: RESP_COMPLETE | s3_key_size(2) | s3_key | file_size(8)
-	s3KeyBytes := []byte(session.S3Key)
-	response := make([]byte, 1+2+len(s3KeyBytes)+8)
-	response[0] = RESP_COMPLETE
-	binary.BigEndian.PutUint16(response[1:3], uint16(len(s3KeyBytes)))
-	copy(response[3:3+len(s3KeyBytes)], s3KeyBytes)
-	binary.BigEndian.PutUint64(response[3+len(s3KeyBytes):], session.TotalSize)
+	sessionLog.InfoContext(reqCtx, "upload completed", "session_id", session.SessionID, "file", session.FileName,
+		"size_bytes", session.TotalSize, "s3_key", session.S3Key)
 
-	return response
+	return nil
 }
 
 func (fus *FileUploadServer) errorResponse(message string) []byte {
-	msgBytes := []byte(message)
-	if len(msgBytes) > 255 {
-		msgBytes = msgBytes[:255]
-	}
+	return protocol.Encode(&protocol.ErrorResp{Message: message})
+}
 
-	response := make([]byte, 2+len(msgBytes))
-	response[0] = RESP_ERROR
-	response[1] = byte(len(msgBytes))
-	copy(response[2:], msgBytes)
+// tagErrorResponse appends the connection ID to a RESP_ERROR message so a
+// client-reported error can be matched to the server logs.
+func tagErrorResponse(response []byte, connID string) []byte {
+	var resp protocol.ErrorResp
+	if len(response) == 0 || response[0] != protocol.RESP_ERROR {
+		return response
+	}
+	if _, err := protocol.Decode(&resp, response[1:]); err != nil {
+		return response
+	}
 
-	return response
+	suffix := " [conn_id=" + connID + "]"
+	resp.Message = resp.Message[:min(len(resp.Message), 255-len(suffix))] + suffix
+	return protocol.Encode(&resp)
 }
 
 func (fus *FileUploadServer) authFailedResponse() []byte {
-	return []byte{RESP_AUTH_FAILED}
+	return protocol.Encode(&protocol.AuthFailedResp{})
 }
 
 func (fus *FileUploadServer) OnClose(c gnet.Conn, err error) (action gnet.Action) {
+	connCtx, remote := context.Background(), c.RemoteAddr().String()
+	if ctx, ok := c.Context().(*ClientContext); ok {
+		connCtx, remote = ctx.connCtx, ctx.remoteAddr
+		fus.conns.Remove(ctx.connID)
+		if ctx.chunk != nil {
+			fus.releaseChunk(ctx.chunk)
+		}
+		if ctx.held > 0 {
+			fus.chunkMemory.Hold(-ctx.held)
+		}
+	}
+
 	if err != nil {
-		log.Printf("❌ Client disconnected with error: %v", err)
+		protoLog.WarnContext(connCtx, "client disconnected with error", "remote", remote, "err", err)
 	} else {
-		log.Printf("👋 Client disconnected: %s", c.RemoteAddr())
+		protoLog.InfoContext(connCtx, "client disconnected", "remote", remote)
 	}
 	return gnet.None
 }
@@ -1009,35 +1756,223 @@ func (fus *FileUploadServer) OnClose(c gnet.Conn, err error) (action gnet.Action
 // ============================================
 
 func main() {
-	log.Printf("🚀 Starting advanced file upload server")
-	log.Printf("📁 S3 path format: user_id/timestamp/filename")
-	log.Printf("📄 Supported: MP4, PDF, Images (up to 10GB)")
+	// Route the standard library logger and third-party slog users through our handler
+	slog.SetDefault(serverLog)
+
+	serverLog.Info("starting file upload server", "s3_path_format", "user_id/timestamp/filename")
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logFatal(serverLog, "failed to initialize tracing", "err", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Initialize S3 client
 	s3Client, err := NewS3Client()
 	if err != nil {
-		log.Fatalf("❌ Failed to initialize S3: %v", err)
+		logFatal(serverLog, "failed to initialize S3", "err", err)
+	}
+	serverLog.Info("S3 client initialized")
+	if LEGAL_HOLD_OBJECT_LOCK && s3Client.locks == nil {
+		logFatal(serverLog, "LEGAL_HOLD_OBJECT_LOCK needs S3_BACKEND=s3")
 	}
-	log.Printf("✅ S3 client initialized")
+	if IMMUTABLE_UPLOADS && s3Client.locks == nil {
+		logFatal(serverLog, "IMMUTABLE_UPLOADS needs S3_BACKEND=s3")
+	}
+	enableFaults(s3Client)
 
 	// Initialize auth manager
 	authMgr := NewAuthManager()
+	tenants, err := LoadTenants(TENANTS_FILE, authMgr)
+	if err != nil {
+		logFatal(serverLog, "failed to load tenants", "err", err)
+	}
+	if authMgr.jwt, err = NewJWTVerifier(tenants); err != nil {
+		logFatal(serverLog, "failed to configure JWT authentication", "err", err)
+	}
+	retention, err := NewRetentionPolicy(RETENTION_RULES)
+	if err != nil {
+		logFatal(serverLog, "failed to load retention rules", "err", err)
+	}
+	presets, err := LoadUploadPresets(UPLOAD_PRESETS_FILE)
+	if err != nil {
+		logFatal(serverLog, "failed to load upload presets", "err", err)
+	}
+
+	// Initialize preview spool
+	spool, err := NewPreviewSpool(PREVIEW_SPOOL_DIR, PREVIEW_MAX_CHUNKS)
+	if err != nil {
+		logFatal(serverLog, "failed to initialize preview spool", "err", err)
+	}
 
 	// Create session manager
-	sessionMgr := NewSessionManager(s3Client, authMgr)
+	staging, err := NewPartStaging(PART_STAGING_DIR)
+	if err != nil {
+		logFatal(serverLog, "failed to create part staging", "err", err)
+	}
+
+	chunkFiles, err := NewChunkFiles(CHUNK_FILE_DIR)
+	if err != nil {
+		logFatal(serverLog, "failed to create chunk file directory", "err", err)
+	}
+
+	sessionMgr := NewSessionManager(s3Client, authMgr, spool, staging)
+
+	metadata, err := NewMetadataStore()
+	if err != nil {
+		logFatal(serverLog, "failed to initialize metadata store", "err", err)
+	}
+
+	// Restore sessions persisted by the previous run, then reconcile the
+	// multipart uploads no session claims
+	sessionStore, err := NewSessionStore()
+	if err != nil {
+		logFatal(serverLog, "failed to initialize session store", "err", err)
+	}
+	sessionWriter = NewSessionWriter(sessionStore)
+	restored, err := sessionMgr.restoreSessions(context.Background(), sessionStore, presets, metadata)
+	if err != nil {
+		logFatal(serverLog, "failed to restore sessions", "err", err)
+	}
+	if sessionWriter.Enabled() {
+		serverLog.Info("restored sessions", "sessions", restored)
+	}
+	recovery := reconcileMultipartUploads(context.Background(), s3Client, sessionMgr)
+	conns := NewConnRegistry()
+
+	usage, err := NewUsageMeter(USAGE_FILE)
+	if err != nil {
+		logFatal(serverLog, "failed to initialize usage meter", "err", err)
+	}
+	quotas, err := NewUserQuotas(USER_QUOTAS_FILE)
+	if err != nil {
+		logFatal(serverLog, "failed to load user quotas", "err", err)
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		logFatal(serverLog, "failed to configure binary TLS", "err", err)
+	}
+
+	uploadCodecs, err = parseCodecs(UPLOAD_COMPRESSION)
+	if err != nil {
+		logFatal(serverLog, "invalid UPLOAD_COMPRESSION", "err", err)
+	}
+
+	mailer, err := NewMailer()
+	if err != nil {
+		logFatal(serverLog, "failed to initialize mailer", "err", err)
+	}
+
+	prometheus.MustRegister(newSessionCollector(sessionMgr))
+
+	publisher, err := NewPublisher()
+	if err != nil {
+		logFatal(serverLog, "failed to initialize event bus", "err", err)
+	}
+	eventBus = NewEventBus(publisher)
+
+	auditExporter := NewAuditExporter(s3Client, auditLog)
+	go auditExporter.Run()
+
+	if alerter := NewAlerter(defaultAlertRules(uploadStats)); alerter.Enabled() {
+		go alerter.Run()
+	}
 
-	// Start gnet server
 	fileServer := &FileUploadServer{
-		sessionMgr: sessionMgr,
-		s3Client:   s3Client,
-		authMgr:    authMgr,
+		sessionMgr:  sessionMgr,
+		s3Client:    s3Client,
+		authMgr:     authMgr,
+		spool:       spool,
+		staging:     staging,
+		conns:       conns,
+		usage:       usage,
+		quotas:      quotas,
+		limiter:     NewRateLimiter(rateLimitsFromEnv()),
+		tlsConfig:   tlsConfig,
+		booted:      make(chan struct{}),
+		chunkPool:   NewChunkPool(UPLOAD_WORKERS, UPLOAD_QUEUE),
+		chunkMemory: NewMemoryBudget(MAX_CHUNK_MEMORY, chunkMemoryBytes),
+		chunkSpace:  NewMemoryBudget(MAX_CHUNK_FILE_SPACE, chunkFileBytes),
+		chunkFiles:  chunkFiles,
+		metadata:    metadata,
+		indexer:     NewContentIndexer(s3Client, metadata),
+		retention:   retention,
+		verifier:    NewVerifier(),
+		presets:     presets,
+		activity:    NewActivityFeed(metadata),
+		notifier:    NewNotifier(mailer, metadata),
+		tenants:     tenants,
+	}
+	fileServer.finalizeRecovered(context.Background(), recovery)
+	recovery.log()
+	go fileServer.RunTrashPurge()
+	go fileServer.RunRetention()
+	go fileServer.RunVerification()
+
+	logTuning()
+
+	// Start HTTP API, and HTTP/3 if configured (http3.go)
+	httpServer := NewHTTPServer(sessionMgr, authMgr, spool, conns, usage, recovery, fileServer)
+	httpHandler := otelhttp.NewHandler(httpServer, "gnet-http")
+	go func() {
+		httpLog.Info("HTTP API listening", "addr", HTTP_PORT)
+		err := listenHTTP(httpHandler)
+		logFatal(httpLog, "HTTP API stopped", "err", err)
+	}()
+	if HTTP3_ADDR != "" {
+		go func() {
+			httpLog.Info("HTTP/3 API listening", "addr", HTTP3_ADDR)
+			err := listenHTTP3(httpHandler)
+			logFatal(httpLog, "HTTP/3 API stopped", "err", err)
+		}()
 	}
 
-	// FIX: Remove WithEdgeTriggeredIO as it might not be available in your gnet version
-	log.Fatal(gnet.Run(fileServer, fmt.Sprintf("tcp://%s", GNET_PORT),
-		gnet.WithMulticore(true),
-		gnet.WithReusePort(true),
-		gnet.WithReadBufferCap(64*1024*1024), // 64MB read buffer for large chunks
-		gnet.WithWriteBufferCap(4*1024*1024), // 4MB write buffer
-	))
+	// Start gnet server
+	go fileServer.drainOnSignal()
+
+	err = gnet.Run(fileServer, fmt.Sprintf("tcp://%s", GNET_PORT), gnetOptions()...)
+	if err != nil {
+		logFatal(serverLog, "gnet server stopped", "err", err)
+	}
+	fileServer.chunkPool.Close()
+	if err := usage.Flush(); err != nil {
+		serverLog.Error("failed to flush usage", "err", err)
+	}
+	if err := auditExporter.Export(context.Background()); err != nil {
+		serverLog.Error("failed to export audit events", "err", err)
+	}
+	if err := eventBus.Close(30 * time.Second); err != nil {
+		serverLog.Error("failed to close event bus", "err", err)
+	}
+	if err := sessionWriter.Close(30 * time.Second); err != nil {
+		serverLog.Error("failed to close session store", "err", err)
+	}
+	if err := metadata.Close(); err != nil {
+		serverLog.Error("failed to close metadata store", "err", err)
+	}
+	serverLog.Info("file upload server stopped")
+}
+
+// drainOnSignal marks the server as draining on SIGTERM/SIGINT so /readyz
+// fails and new uploads are refused, waits for in-flight uploads (at most
+// DRAIN_TIMEOUT), then stops the event loop.
+func (fus *FileUploadServer) drainOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+
+	draining.Store(true)
+	serverLog.Info("draining", "signal", sig.String(), "active_uploads", fus.sessionMgr.ActiveUploads(), "timeout", DRAIN_TIMEOUT)
+
+	deadline := time.Now().Add(DRAIN_TIMEOUT)
+	for fus.sessionMgr.ActiveUploads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := fus.eng.Stop(ctx); err != nil {
+		logFatal(serverLog, "failed to stop gnet server", "err", err)
+	}
 }
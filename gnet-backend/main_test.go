@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"backend/protocol"
+)
+
+// Chunks are acknowledged in whatever order the workers finish them; the
+// session must still hand S3 its parts in ascending order.
+func TestAddChunkOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		chunkSize   uint32
+		totalChunks uint32
+	}{
+		{"one chunk per part", MIN_CHUNK_SIZE, 5},
+		{"aggregated parts", MIN_SMALL_CHUNK_SIZE, 2*chunksPerPart(MIN_SMALL_CHUNK_SIZE) + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemS3()
+			bucket := aws.String("test")
+			if _, err := store.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: bucket}); err != nil {
+				t.Fatal(err)
+			}
+			session := &UploadSession{
+				SessionID:      "session",
+				S3Key:          "user/1/file.mp4",
+				TotalChunks:    tt.totalChunks,
+				ChunkSize:      tt.chunkSize,
+				ChunksPerPart:  chunksPerPart(tt.chunkSize),
+				ReceivedChunks: make(map[uint32]*ChunkInfo),
+			}
+			upload, err := store.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String(session.S3Key)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// As with staging, the last chunk to arrive of a part uploads it
+			received := make(map[int32]uint32)
+			for _, i := range rand.New(rand.NewPCG(1, 2)).Perm(int(tt.totalChunks)) {
+				index := uint32(i)
+				part := session.PartNumber(index)
+				received[part]++
+				var etag string
+				if received[part] == session.partChunks(part) {
+					data := bytes.Repeat([]byte{byte(part)}, int(session.partChunks(part)*tt.chunkSize))
+					out, err := store.UploadPart(ctx, &s3.UploadPartInput{
+						Bucket:     bucket,
+						Key:        aws.String(session.S3Key),
+						UploadId:   upload.UploadId,
+						PartNumber: aws.Int32(part),
+						Body:       bytes.NewReader(data),
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					etag = aws.ToString(out.ETag)
+				}
+				if session.AddChunk(index, tt.chunkSize, "hash", part, etag) {
+					t.Fatalf("chunk %d reported as a duplicate", index)
+				}
+			}
+
+			for i, part := range session.CompletedParts {
+				if want := int32(i + 1); aws.ToInt32(part.PartNumber) != want {
+					t.Fatalf("CompletedParts[%d] is part %d, want %d", i, aws.ToInt32(part.PartNumber), want)
+				}
+			}
+			if !session.IsComplete() {
+				t.Fatalf("session not complete: %d chunks, %d of %d parts", len(session.ReceivedChunks), len(session.CompletedParts), session.PartCount())
+			}
+			_, err = store.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+				Bucket:          bucket,
+				Key:             aws.String(session.S3Key),
+				UploadId:        upload.UploadId,
+				MultipartUpload: &types.CompletedMultipartUpload{Parts: session.CompletedParts},
+			})
+			if err != nil {
+				t.Fatalf("CompleteMultipartUpload: %v", err)
+			}
+		})
+	}
+}
+
+// benchmarkChunks stores b.N chunks of each size with store, the way one
+// upload path hands them to the server, and reports throughput and
+// allocations per chunk. Sessions never complete: a new one is started every
+// few chunks and the old one's parts dropped, so memS3 holds only a few.
+func benchmarkChunks(b *testing.B, store func(b *testing.B, hs *HTTPServer, session *UploadSession, index uint32, data []byte)) {
+	const chunksPerSession = 8
+	for _, size := range []uint32{MIN_CHUNK_SIZE, 16 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			hs, s3Client := newTestHTTPServer(b)
+			ctx := context.Background()
+			data := bytes.Repeat([]byte{7}, int(size))
+			var session *UploadSession
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				index := uint32(i % chunksPerSession)
+				if index == 0 {
+					b.StopTimer()
+					if session != nil {
+						s3Client.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+							Bucket: aws.String(s3Client.bucket), Key: aws.String(session.S3Key), UploadId: aws.String(session.UploadID),
+						})
+					}
+					var err error
+					session, err = hs.uploads.startUpload(ctx, nil, nil, "user_123", "testuser", "bench.mp4", chunksPerSession+1, size, "", nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+				}
+				store(b, hs, session, index, data)
+			}
+		})
+	}
+}
+
+// The binary path: a chunk received by OnTraffic, hashed on the way, then
+// stored by a chunk worker.
+func BenchmarkBinaryChunk(b *testing.B) {
+	benchmarkChunks(b, func(b *testing.B, hs *HTTPServer, session *UploadSession, index uint32, data []byte) {
+		cmd := &protocol.UploadChunk{SessionID: session.SessionID, ChunkIndex: index, ChunkData: data}
+		response := hs.uploads.handleUploadChunk(context.Background(), session.UserID, cmd, newMemoryChunk(data, sha256.Sum256(data), 0))
+		if response[0] == protocol.RESP_ERROR {
+			b.Fatalf("chunk %d: %s", index, response[2:])
+		}
+	})
+}
@@ -0,0 +1,615 @@
+// memstore.go - In-memory S3 stand-in for tests and local runs
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ============================================
+// Storage Interface
+// ============================================
+
+// S3API is the part of the S3 client the servers use. *s3.Client satisfies
+// it; memS3 implements it in memory when S3_BACKEND=memory, and fsS3 on the
+// local filesystem when S3_BACKEND=fs.
+type S3API interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// ============================================
+// In-Memory Backend
+// ============================================
+
+// memS3 keeps buckets, objects and multipart uploads in memory. It follows
+// the S3 rules the upload path depends on: parts are listed in order, every
+// part but the last must be at least MIN_CHUNK_SIZE, multipart ETags are
+// md5(part md5s)-N, and errors carry the same codes (NoSuchKey, NoSuchUpload,
+// InvalidRange, ...) as the real service. Every object is lost on exit.
+
+const MEM_S3_LIST_MAX = 1000 // Default MaxKeys, as in S3
+
+type memObject struct {
+	data            []byte
+	etag            string
+	contentType     string
+	contentEncoding string
+	metadata        map[string]string
+	tags            []types.Tag
+	lastModified    time.Time
+}
+
+type memPart struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+}
+
+type memUpload struct {
+	key         string
+	contentType string
+	metadata    map[string]string
+	initiated   time.Time
+	parts       map[int32]*memPart
+}
+
+type memBucket struct {
+	objects map[string]*memObject
+	uploads map[string]*memUpload // By upload ID
+}
+
+type memS3 struct {
+	mu      sync.Mutex
+	buckets map[string]*memBucket
+}
+
+func newMemS3() *memS3 {
+	return &memS3{buckets: make(map[string]*memBucket)}
+}
+
+func memError(code, format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{Code: code, Message: fmt.Sprintf(format, args...), Fault: smithy.FaultClient}
+}
+
+func memETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
+
+// bucket returns the named bucket. Caller holds m.mu.
+func (m *memS3) bucket(name *string) (*memBucket, error) {
+	b, ok := m.buckets[aws.ToString(name)]
+	if !ok {
+		return nil, &types.NoSuchBucket{Message: aws.String("The specified bucket does not exist")}
+	}
+	return b, nil
+}
+
+// upload returns the multipart upload with the given ID. Caller holds m.mu.
+func (m *memS3) upload(bucket, key, uploadID *string) (*memBucket, *memUpload, error) {
+	b, err := m.bucket(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, ok := b.uploads[aws.ToString(uploadID)]
+	if !ok || u.key != aws.ToString(key) {
+		return nil, nil, &types.NoSuchUpload{Message: aws.String("The specified multipart upload does not exist")}
+	}
+	return b, u, nil
+}
+
+func (m *memS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.buckets[aws.ToString(params.Bucket)]; !ok {
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *memS3) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := aws.ToString(params.Bucket)
+	if _, ok := m.buckets[name]; ok {
+		return nil, &types.BucketAlreadyOwnedByYou{Message: aws.String("Bucket already exists")}
+	}
+	m.buckets[name] = &memBucket{
+		objects: make(map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+	}
+	return &s3.CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+// ============================================
+// Multipart Uploads
+// ============================================
+
+func (m *memS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+	b.uploads[uploadID] = &memUpload{
+		key:         aws.ToString(params.Key),
+		contentType: aws.ToString(params.ContentType),
+		metadata:    maps.Clone(params.Metadata),
+		initiated:   time.Now(),
+		parts:       make(map[int32]*memPart),
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   params.Bucket,
+		Key:      params.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func (m *memS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	partNumber := aws.ToInt32(params.PartNumber)
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, memError("InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	// Read before locking; the body may be slow
+	var data []byte
+	if params.Body != nil {
+		var err error
+		if data, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, u, err := m.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	part := &memPart{data: data, etag: memETag(sum[:]), lastModified: time.Now()}
+	u.parts[partNumber] = part
+	return &s3.UploadPartOutput{ETag: aws.String(part.etag)}, nil
+}
+
+func (m *memS3) UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	return uploadPartCopy(ctx, m, params)
+}
+
+// uploadPartCopy implements UploadPartCopy for the stand-ins as a ranged
+// GetObject of the source fed to UploadPart.
+func uploadPartCopy(ctx context.Context, api S3API, params *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	source, err := url.PathUnescape(strings.TrimPrefix(aws.ToString(params.CopySource), "/"))
+	if err != nil {
+		return nil, memError("InvalidArgument", "Invalid copy source %q", aws.ToString(params.CopySource))
+	}
+	bucket, key, found := strings.Cut(source, "/")
+	if !found {
+		return nil, memError("InvalidArgument", "Invalid copy source %q", source)
+	}
+
+	src, err := api.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  params.CopySourceRange,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+
+	part, err := api.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     params.Bucket,
+		Key:        params.Key,
+		UploadId:   params.UploadId,
+		PartNumber: params.PartNumber,
+		Body:       src.Body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &types.CopyPartResult{ETag: part.ETag, LastModified: aws.Time(time.Now())},
+	}, nil
+}
+
+func (m *memS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, u, err := m.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	if params.MultipartUpload == nil || len(params.MultipartUpload.Parts) == 0 {
+		return nil, memError("MalformedXML", "You must specify at least one part")
+	}
+
+	completed := params.MultipartUpload.Parts
+	var (
+		data []byte
+		sums []byte
+		last int32
+	)
+	for i, cp := range completed {
+		number := aws.ToInt32(cp.PartNumber)
+		if number <= last {
+			return nil, memError("InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+		last = number
+
+		part, ok := u.parts[number]
+		if !ok || part.etag != aws.ToString(cp.ETag) {
+			return nil, memError("InvalidPart", "Part %d could not be found or its ETag does not match", number)
+		}
+		if i < len(completed)-1 && len(part.data) < MIN_CHUNK_SIZE {
+			return nil, memError("EntityTooSmall", "Part %d is smaller than the minimum allowed size", number)
+		}
+		data = append(data, part.data...)
+		sum := md5.Sum(part.data)
+		sums = append(sums, sum[:]...)
+	}
+
+	total := md5.Sum(sums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(total[:]), len(completed))
+	b.objects[u.key] = &memObject{
+		data:         data,
+		etag:         etag,
+		contentType:  u.contentType,
+		metadata:     u.metadata,
+		lastModified: time.Now(),
+	}
+	delete(b.uploads, aws.ToString(params.UploadId))
+
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: params.Bucket,
+		Key:    params.Key,
+		ETag:   aws.String(etag),
+	}, nil
+}
+
+func (m *memS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, _, err := m.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	delete(b.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// ListMultipartUploads returns every upload under the prefix in one page.
+func (m *memS3) ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := aws.ToString(params.Prefix)
+	uploads := make([]types.MultipartUpload, 0)
+	for id, u := range b.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			uploads = append(uploads, types.MultipartUpload{
+				Key:       aws.String(u.key),
+				UploadId:  aws.String(id),
+				Initiated: aws.Time(u.initiated),
+			})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return aws.ToString(uploads[i].Key) < aws.ToString(uploads[j].Key)
+	})
+	return &s3.ListMultipartUploadsOutput{
+		Bucket:      params.Bucket,
+		Prefix:      params.Prefix,
+		Uploads:     uploads,
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+// ListParts returns every part of the upload in one page.
+func (m *memS3) ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, u, err := m.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]types.Part, 0, len(u.parts))
+	for number, part := range u.parts {
+		parts = append(parts, types.Part{
+			PartNumber:   aws.Int32(number),
+			ETag:         aws.String(part.etag),
+			Size:         aws.Int64(int64(len(part.data))),
+			LastModified: aws.Time(part.lastModified),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	return &s3.ListPartsOutput{
+		Bucket:      params.Bucket,
+		Key:         params.Key,
+		UploadId:    params.UploadId,
+		Parts:       parts,
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+// ============================================
+// Objects
+// ============================================
+
+func (m *memS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var data []byte
+	if params.Body != nil {
+		var err error
+		if data, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	obj := &memObject{
+		data:            data,
+		etag:            memETag(sum[:]),
+		contentType:     aws.ToString(params.ContentType),
+		contentEncoding: aws.ToString(params.ContentEncoding),
+		metadata:        maps.Clone(params.Metadata),
+		lastModified:    time.Now(),
+	}
+	b.objects[aws.ToString(params.Key)] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+// object returns the named object. Caller holds m.mu.
+func (m *memS3) object(bucket, key *string) (*memObject, error) {
+	b, err := m.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[aws.ToString(key)]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return obj, nil
+}
+
+func (m *memS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, err := m.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch := aws.ToString(params.IfMatch); ifMatch != "" && ifMatch != obj.etag {
+		return nil, memError("PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+
+	size := int64(len(obj.data))
+	out := &s3.GetObjectOutput{
+		ContentType:     aws.String(obj.contentType),
+		ContentEncoding: nilIfEmpty(obj.contentEncoding),
+		ETag:            aws.String(obj.etag),
+		Metadata:        maps.Clone(obj.metadata),
+		LastModified:    aws.Time(obj.lastModified),
+		AcceptRanges:    aws.String("bytes"),
+	}
+
+	start, end := int64(0), size
+	if rng := aws.ToString(params.Range); rng != "" {
+		var ok bool
+		if start, end, ok = parseByteRange(rng, size); !ok {
+			return nil, memError("InvalidRange", "The requested range is not satisfiable")
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+
+	// The object is never modified in place, so the slice stays valid
+	out.Body = io.NopCloser(bytes.NewReader(obj.data[start:end]))
+	out.ContentLength = aws.Int64(end - start)
+	return out, nil
+}
+
+func (m *memS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, err := m.object(params.Bucket, params.Key)
+	if err != nil {
+		// HEAD responses have no body, so S3 reports a generic NotFound
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength:   aws.Int64(int64(len(obj.data))),
+		ContentType:     aws.String(obj.contentType),
+		ContentEncoding: nilIfEmpty(obj.contentEncoding),
+		ETag:            aws.String(obj.etag),
+		Metadata:        maps.Clone(obj.metadata),
+		LastModified:    aws.Time(obj.lastModified),
+	}, nil
+}
+
+func (m *memS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, err := m.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: append([]types.Tag{}, obj.tags...)}, nil
+}
+
+func (m *memS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, err := m.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	obj.tags = nil
+	if params.Tagging != nil {
+		obj.tags = append([]types.Tag(nil), params.Tagging.TagSet...)
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (m *memS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &s3.DeleteObjectsOutput{}
+	if params.Delete == nil {
+		return out, nil
+	}
+	for _, id := range params.Delete.Objects {
+		delete(b.objects, aws.ToString(id.Key))
+		if !aws.ToBool(params.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: id.Key})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2 pages through keys in lexical order; the continuation token
+// is the last key returned.
+func (m *memS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := aws.ToString(params.Prefix)
+	after := aws.ToString(params.StartAfter)
+	if token := aws.ToString(params.ContinuationToken); token != "" {
+		after = token
+	}
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys <= 0 || maxKeys > MEM_S3_LIST_MAX {
+		maxKeys = MEM_S3_LIST_MAX
+	}
+
+	keys := make([]string, 0)
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:        params.Bucket,
+		Prefix:      params.Prefix,
+		MaxKeys:     aws.Int32(int32(maxKeys)),
+		IsTruncated: aws.Bool(len(keys) > maxKeys),
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		obj := b.objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.lastModified),
+		})
+	}
+	out.KeyCount = aws.Int32(int32(len(out.Contents)))
+	return out, nil
+}
+
+// parseByteRange resolves a single "bytes=" range against size, returning
+// [start, end). Unsatisfiable or multi-range specs return ok=false.
+func parseByteRange(spec string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	from, to, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if from == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(0, size-n), size, true
+	}
+
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if to != "" {
+		last, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		end = min(last+1, size)
+	}
+	return start, end, true
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// newTestUpload starts a multipart upload of key in a fresh memS3 and
+// uploads parts of the given sizes, numbered from 1, returning them in
+// order for CompleteMultipartUpload.
+func newTestUpload(t *testing.T, key string, sizes ...int) (*memS3, *string, []types.CompletedPart) {
+	t.Helper()
+	ctx := context.Background()
+	m := newMemS3()
+	if _, err := m.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("test")}); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := m.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("test"), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []types.CompletedPart
+	for i, size := range sizes {
+		number := int32(i + 1)
+		out, err := m.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String("test"),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(number),
+			Body:       bytes.NewReader(bytes.Repeat([]byte{byte(number)}, size)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(number), ETag: out.ETag})
+	}
+	return m, upload.UploadId, parts
+}
+
+func completeTestUpload(m *memS3, key string, uploadID *string, parts []types.CompletedPart) (*s3.CompleteMultipartUploadOutput, error) {
+	return m.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("test"),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+}
+
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func TestMemS3MinimumPartSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+		code  string
+	}{
+		{"short last part", []int{MIN_CHUNK_SIZE, MIN_CHUNK_SIZE, 10}, ""},
+		{"single short part", []int{10}, ""},
+		{"short middle part", []int{MIN_CHUNK_SIZE, 10, MIN_CHUNK_SIZE}, "EntityTooSmall"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, uploadID, parts := newTestUpload(t, "user/file", tt.sizes...)
+			_, err := completeTestUpload(m, "user/file", uploadID, parts)
+			if code := errorCode(err); code != tt.code || (tt.code == "" && err != nil) {
+				t.Fatalf("CompleteMultipartUpload: %v, want code %q", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestMemS3PartOrder(t *testing.T) {
+	m, uploadID, parts := newTestUpload(t, "user/file", MIN_CHUNK_SIZE, MIN_CHUNK_SIZE, 10)
+
+	listed, err := m.ListParts(context.Background(), &s3.ListPartsInput{Bucket: aws.String("test"), Key: aws.String("user/file"), UploadId: uploadID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range listed.Parts {
+		if want := int32(i + 1); aws.ToInt32(part.PartNumber) != want {
+			t.Fatalf("ListParts[%d] is part %d, want %d", i, aws.ToInt32(part.PartNumber), want)
+		}
+	}
+
+	swapped := []types.CompletedPart{parts[1], parts[0], parts[2]}
+	if _, err := completeTestUpload(m, "user/file", uploadID, swapped); errorCode(err) != "InvalidPartOrder" {
+		t.Fatalf("parts out of order: %v, want InvalidPartOrder", err)
+	}
+	if _, err := completeTestUpload(m, "user/file", uploadID, parts); err != nil {
+		t.Fatalf("parts in order: %v", err)
+	}
+}
+
+func TestMemS3ETags(t *testing.T) {
+	sizes := []int{MIN_CHUNK_SIZE, 10}
+	m, uploadID, parts := newTestUpload(t, "user/file", sizes...)
+
+	var sums []byte
+	for i, size := range sizes {
+		sum := md5.Sum(bytes.Repeat([]byte{byte(i + 1)}, size))
+		sums = append(sums, sum[:]...)
+		if want := `"` + hex.EncodeToString(sum[:]) + `"`; aws.ToString(parts[i].ETag) != want {
+			t.Errorf("part %d ETag %s, want %s", i+1, aws.ToString(parts[i].ETag), want)
+		}
+	}
+
+	out, err := completeTestUpload(m, "user/file", uploadID, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := md5.Sum(sums)
+	if want := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(total[:]), len(parts)); aws.ToString(out.ETag) != want {
+		t.Fatalf("multipart ETag %s, want %s", aws.ToString(out.ETag), want)
+	}
+	head, err := m.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("test"), Key: aws.String("user/file")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(head.ETag) != aws.ToString(out.ETag) {
+		t.Fatalf("HeadObject ETag %s, want %s", aws.ToString(head.ETag), aws.ToString(out.ETag))
+	}
+}
@@ -0,0 +1,13 @@
+//go:build cgo
+
+// metadata_sqlite.go - SQLite driver for the metadata store
+package main
+
+import _ "github.com/mattn/go-sqlite3"
+
+// The SQLite driver is a cgo package and the Docker image is built with
+// CGO_ENABLED=0, so METADATA_DB=sqlite is for single-node deployments built
+// with cgo; Postgres for everything else.
+func init() {
+	sqliteDriver = "sqlite3"
+}
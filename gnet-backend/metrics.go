@@ -0,0 +1,170 @@
+// metrics.go - Prometheus instrumentation for the upload server
+package main
+
+import (
+	"context"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	catalog "backend/metrics"
+)
+
+// ============================================
+// Metrics
+// ============================================
+
+// Names, help text and labels come from the catalog in backend/metrics, which
+// also drives the generated Grafana dashboards. Only buckets are chosen here.
+
+var (
+	chunksReceived       = newCounterVec(catalog.ChunksReceived)
+	bytesUploaded        = newCounter(catalog.BytesUploaded)
+	compressedBytes      = newCounterVec(catalog.CompressedBytes)
+	chunkDuration        = newHistogram(catalog.ChunkProcessing, prometheus.ExponentialBuckets(0.01, 2, 14)) // 10ms .. ~80s
+	chunkReceiveDuration = newHistogram(catalog.ChunkReceive, prometheus.ExponentialBuckets(0.01, 2, 14))    // 10ms .. ~80s
+	chunkQueueDepth      = newGauge(catalog.ChunkQueue)
+	chunkQueueWait       = newHistogram(catalog.ChunkQueueWait, prometheus.ExponentialBuckets(0.001, 2, 16)) // 1ms .. ~30s
+	chunkMemoryBytes     = newGauge(catalog.ChunkMemory)
+	chunkFileBytes       = newGauge(catalog.ChunkFileSpace)
+	backpressure         = newCounterVec(catalog.Backpressure)
+	slowChunks           = newCounterVec(catalog.SlowChunks)
+	slowSessions         = newCounterVec(catalog.SlowSessions)
+
+	uploadPartDuration = newHistogram(catalog.UploadPart, prometheus.ExponentialBuckets(0.01, 2, 14))    // 10ms .. ~80s
+	s3RequestDuration  = newHistogramVec(catalog.S3Request, prometheus.ExponentialBuckets(0.005, 2, 15)) // 5ms .. ~80s
+	s3Errors           = newCounterVec(catalog.S3Errors)
+	finalizeDuration   = newHistogram(catalog.Finalize, prometheus.ExponentialBuckets(0.05, 2, 12)) // 50ms .. ~100s
+	fileListings       = newCounterVec(catalog.FileListings)
+	streamBytes        = newCounterVec(catalog.StreamBytes)
+
+	sessionTransitions = newCounterVec(catalog.SessionTransitions)
+	sessionStoreWrites = newCounterVec(catalog.SessionStoreWrites)
+
+	authFailures         = newCounter(catalog.AuthFailures)
+	rateLimited          = newCounterVec(catalog.RateLimited)
+	tlsHandshakeFailures = newCounter(catalog.TLSHandshakeFailures)
+	websocketConnections = newCounter(catalog.WebSocketConnections)
+
+	cleanupRuns    = newCounter(catalog.CleanupRuns)
+	cleanupLastRun = newGauge(catalog.CleanupLastRun)
+	cleanupReaped  = newCounterVec(catalog.CleanupReaped)
+	cleanupAborted = newCounterVec(catalog.CleanupAborted)
+
+	eventsPublished = newCounterVec(catalog.EventsPublished)
+
+	metadataWrites        = newCounterVec(catalog.MetadataWrites)
+	metadataWriteDuration = newHistogram(catalog.MetadataWrite, prometheus.ExponentialBuckets(0.001, 2, 14)) // 1ms .. ~8s
+
+	instantUploads     = newCounterVec(catalog.InstantUploads)
+	instantUploadBytes = newCounter(catalog.InstantUploadBytes)
+	fileHashChecks     = newCounterVec(catalog.FileHashChecks)
+
+	searchIndexJobs = newCounterVec(catalog.SearchIndexJobs)
+
+	exportJobs  = newCounterVec(catalog.ExportJobs)
+	exportBytes = newCounter(catalog.ExportBytes)
+
+	retentionFiles = newCounterVec(catalog.RetentionFiles)
+	retentionBytes = newCounterVec(catalog.RetentionBytes)
+
+	verifiedFiles = newCounterVec(catalog.VerifiedFiles)
+	verifiedBytes = newCounter(catalog.VerifiedBytes)
+
+	activityEntries = newCounterVec(catalog.ActivityEntries)
+	presetCopies    = newCounterVec(catalog.PresetCopies)
+	notifications   = newCounterVec(catalog.Notifications)
+
+	faultsInjected = newCounterVec(catalog.FaultsInjected)
+)
+
+func newCounter(m catalog.Metric) prometheus.Counter {
+	return promauto.NewCounter(prometheus.CounterOpts{Namespace: m.Namespace, Name: m.Name, Help: m.Help})
+}
+
+func newCounterVec(m catalog.Metric) *prometheus.CounterVec {
+	return promauto.NewCounterVec(prometheus.CounterOpts{Namespace: m.Namespace, Name: m.Name, Help: m.Help}, m.Labels)
+}
+
+func newGauge(m catalog.Metric) prometheus.Gauge {
+	return promauto.NewGauge(prometheus.GaugeOpts{Namespace: m.Namespace, Name: m.Name, Help: m.Help})
+}
+
+func newHistogram(m catalog.Metric, buckets []float64) prometheus.Histogram {
+	return promauto.NewHistogram(prometheus.HistogramOpts{Namespace: m.Namespace, Name: m.Name, Help: m.Help, Buckets: buckets})
+}
+
+func newHistogramVec(m catalog.Metric, buckets []float64) *prometheus.HistogramVec {
+	return promauto.NewHistogramVec(prometheus.HistogramOpts{Namespace: m.Namespace, Name: m.Name, Help: m.Help, Buckets: buckets}, m.Labels)
+}
+
+// ============================================
+// Session Collector
+// ============================================
+
+// sessionCollector reports live sessions by state straight from the
+// SessionManager at scrape time, so the gauge can never drift.
+type sessionCollector struct {
+	sessionMgr *SessionManager
+	desc       *prometheus.Desc
+}
+
+func newSessionCollector(sessionMgr *SessionManager) *sessionCollector {
+	return &sessionCollector{
+		sessionMgr: sessionMgr,
+		desc: prometheus.NewDesc(
+			catalog.SessionsActive.FullName(),
+			catalog.SessionsActive.Help,
+			catalog.SessionsActive.Labels, nil,
+		),
+	}
+}
+
+func (sc *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.desc
+}
+
+func (sc *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]int{
+		STATE_INITIALIZED: 0,
+		STATE_UPLOADING:   0,
+		STATE_PAUSED:      0,
+		STATE_FINALIZING:  0,
+		STATE_COMPLETED:   0,
+		STATE_CANCELLED:   0,
+		STATE_FAILED:      0,
+	}
+	for _, state := range sc.sessionMgr.SessionStates() {
+		counts[state]++
+	}
+
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(sc.desc, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+// ============================================
+// S3 Instrumentation
+// ============================================
+
+// s3MetricsMiddleware times every S3 call made through the SDK client. It sits
+// in the initialize step so the measurement covers retries.
+func s3MetricsMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3Metrics",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+
+			operation := awsmiddleware.GetOperationName(ctx)
+			s3RequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+			if err != nil {
+				s3Errors.WithLabelValues(operation).Inc()
+			}
+			uploadStats.RecordS3Call(err != nil)
+
+			return out, metadata, err
+		}), middleware.After)
+}
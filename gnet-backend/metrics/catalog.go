@@ -0,0 +1,374 @@
+// Package metrics is the catalog of every Prometheus metric exported by the
+// upload server and the gateway. Instrumentation code and the dashboard
+// generator both read names from here, so a rename shows up in both.
+//
+// Naming scheme: <namespace>_<subject>_<unit>, with counters ending in _total
+// and durations in _seconds. Namespaces are "upload" for the file server and
+// "gateway" for the gateway. Names in this file are stable; retire a metric
+// by adding its replacement next to it rather than renaming it in place.
+package metrics
+
+//go:generate go run ../cmd/dashgen -out ../../grafana/dashboards
+
+type Kind string
+
+const (
+	Counter   Kind = "counter"
+	Gauge     Kind = "gauge"
+	Histogram Kind = "histogram"
+)
+
+const (
+	UploadNamespace  = "upload"
+	GatewayNamespace = "gateway"
+)
+
+type Metric struct {
+	Namespace string
+	Name      string // Without the namespace prefix
+	Kind      Kind
+	Help      string
+	Labels    []string
+	Unit      string // Grafana panel unit, e.g. "bytes", "s", "short"
+	Group     string // Dashboard row
+}
+
+// FullName is the exported series name, e.g. upload_chunks_received_total.
+func (m Metric) FullName() string {
+	return m.Namespace + "_" + m.Name
+}
+
+// ============================================
+// Upload Server
+// ============================================
+
+var (
+	ChunksReceived = Metric{
+		Namespace: UploadNamespace, Name: "chunks_received_total", Kind: Counter,
+		Help:   "Chunks received, by result (ok, duplicate, busy, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Chunks",
+	}
+	BytesUploaded = Metric{
+		Namespace: UploadNamespace, Name: "bytes_uploaded_total", Kind: Counter,
+		Help: "Chunk payload bytes successfully written to S3.",
+		Unit: "Bps", Group: "Chunks",
+	}
+	CompressedBytes = Metric{
+		Namespace: UploadNamespace, Name: "compressed_bytes_total", Kind: Counter,
+		Help:   "Compressed chunk bytes received over the binary protocol, by codec (zstd, lz4); bytes_uploaded_total counts them decompressed.",
+		Labels: []string{"codec"}, Unit: "Bps", Group: "Chunks",
+	}
+	ChunkProcessing = Metric{
+		Namespace: UploadNamespace, Name: "chunk_processing_seconds", Kind: Histogram,
+		Help: "Time to process one UPLOAD_CHUNK command, including the S3 part upload.",
+		Unit: "s", Group: "Chunks",
+	}
+	ChunkReceive = Metric{
+		Namespace: UploadNamespace, Name: "chunk_receive_seconds", Kind: Histogram,
+		Help: "Time from the first to the last byte of an UPLOAD_CHUNK message (client bandwidth).",
+		Unit: "s", Group: "Chunks",
+	}
+	ChunkQueue = Metric{
+		Namespace: UploadNamespace, Name: "chunk_queue_depth", Kind: Gauge,
+		Help: "UPLOAD_CHUNK commands waiting for a chunk worker (UPLOAD_WORKERS).",
+		Unit: "short", Group: "Chunks",
+	}
+	ChunkQueueWait = Metric{
+		Namespace: UploadNamespace, Name: "chunk_queue_wait_seconds", Kind: Histogram,
+		Help: "Time an UPLOAD_CHUNK command waited for a chunk worker.",
+		Unit: "s", Group: "Chunks",
+	}
+	ChunkMemory = Metric{
+		Namespace: UploadNamespace, Name: "chunk_memory_bytes", Kind: Gauge,
+		Help: "Chunk data held in memory, out of MAX_CHUNK_MEMORY.",
+		Unit: "bytes", Group: "Chunks",
+	}
+	ChunkFileSpace = Metric{
+		Namespace: UploadNamespace, Name: "chunk_file_bytes", Kind: Gauge,
+		Help: "Chunk data held in files under CHUNK_FILE_DIR, out of MAX_CHUNK_FILE_SPACE.",
+		Unit: "bytes", Group: "Chunks",
+	}
+	Backpressure = Metric{
+		Namespace: UploadNamespace, Name: "backpressure_total", Kind: Counter,
+		Help:   "Chunks held back (binary) or refused with 503 (http) because MAX_CHUNK_MEMORY or MAX_CHUNK_FILE_SPACE was reached.",
+		Labels: []string{"transport"}, Unit: "short", Group: "Chunks",
+	}
+	SlowChunks = Metric{
+		Namespace: UploadNamespace, Name: "slow_chunks_total", Kind: Counter,
+		Help:   "Chunks slower than SLOW_CHUNK_SECONDS, by dominant cause (client, s3).",
+		Labels: []string{"cause"}, Unit: "short", Group: "Chunks",
+	}
+	SlowSessions = Metric{
+		Namespace: UploadNamespace, Name: "slow_sessions_total", Kind: Counter,
+		Help:   "Sessions flagged after SLOW_SESSION_STREAK consecutive slow chunks, by dominant cause.",
+		Labels: []string{"cause"}, Unit: "short", Group: "Chunks",
+	}
+
+	UploadPart = Metric{
+		Namespace: UploadNamespace, Name: "upload_part_seconds", Kind: Histogram,
+		Help: "S3 UploadPart latency for one chunk.",
+		Unit: "s", Group: "S3",
+	}
+	S3Request = Metric{
+		Namespace: UploadNamespace, Name: "s3_request_seconds", Kind: Histogram,
+		Help:   "S3 API call latency (including SDK retries), by operation.",
+		Labels: []string{"operation"}, Unit: "s", Group: "S3",
+	}
+	S3Errors = Metric{
+		Namespace: UploadNamespace, Name: "s3_errors_total", Kind: Counter,
+		Help:   "Failed S3 API calls, by operation.",
+		Labels: []string{"operation"}, Unit: "short", Group: "S3",
+	}
+	Finalize = Metric{
+		Namespace: UploadNamespace, Name: "finalize_seconds", Kind: Histogram,
+		Help: "Time to complete the S3 multipart upload of a finished session.",
+		Unit: "s", Group: "S3",
+	}
+	FileListings = Metric{
+		Namespace: UploadNamespace, Name: "file_listings_total", Kind: Counter,
+		Help:   "GET /files listings, by result (hit, miss, bypass) of the listing cache.",
+		Labels: []string{"result"}, Unit: "reqps", Group: "S3",
+	}
+	StreamBytes = Metric{
+		Namespace: UploadNamespace, Name: "stream_bytes_served_total", Kind: Counter,
+		Help:   "Response bytes of downloads and streams, by source (preview, download, stream).",
+		Labels: []string{"source"}, Unit: "Bps", Group: "S3",
+	}
+
+	SessionsActive = Metric{
+		Namespace: UploadNamespace, Name: "sessions_active", Kind: Gauge,
+		Help:   "Upload sessions held in memory, by state.",
+		Labels: []string{"state"}, Unit: "short", Group: "Sessions",
+	}
+	SessionTransitions = Metric{
+		Namespace: UploadNamespace, Name: "session_transitions_total", Kind: Counter,
+		Help:   "Session state changes, by previous and new state (from=\"new\" on creation).",
+		Labels: []string{"from", "to"}, Unit: "short", Group: "Sessions",
+	}
+	SessionStoreWrites = Metric{
+		Namespace: UploadNamespace, Name: "session_store_writes_total", Kind: Counter,
+		Help:   "Session snapshots written to the session store, by operation (save, delete) and result (ok, error, dropped).",
+		Labels: []string{"op", "result"}, Unit: "short", Group: "Sessions",
+	}
+
+	AuthFailures = Metric{
+		Namespace: UploadNamespace, Name: "auth_failures_total", Kind: Counter,
+		Help: "Requests rejected because of an invalid or expired token.",
+		Unit: "short", Group: "Auth",
+	}
+	RateLimited = Metric{
+		Namespace: UploadNamespace, Name: "rate_limited_total", Kind: Counter,
+		Help:   "Inits and chunks refused by a rate limit, by request (init, chunk), limit (init, chunk, bytes) and scope (user, ip).",
+		Labels: []string{"request", "limit", "scope"}, Unit: "short", Group: "Auth",
+	}
+	TLSHandshakeFailures = Metric{
+		Namespace: UploadNamespace, Name: "tls_handshake_failures_total", Kind: Counter,
+		Help: "Connections to the binary TLS port closed because the TLS handshake failed.",
+		Unit: "short", Group: "Auth",
+	}
+	WebSocketConnections = Metric{
+		Namespace: UploadNamespace, Name: "websocket_connections_total", Kind: Counter,
+		Help: "Binary protocol connections opened over WebSocket (GET /upload/ws).",
+		Unit: "short", Group: "HTTP",
+	}
+
+	CleanupRuns = Metric{
+		Namespace: UploadNamespace, Name: "cleanup_runs_total", Kind: Counter,
+		Help: "Completed passes of the session cleanup loop.",
+		Unit: "short", Group: "Cleanup",
+	}
+	CleanupLastRun = Metric{
+		Namespace: UploadNamespace, Name: "cleanup_last_run_timestamp_seconds", Kind: Gauge,
+		Help: "Unix time the session cleanup loop last finished.",
+		Unit: "dateTimeFromNow", Group: "Cleanup",
+	}
+	CleanupReaped = Metric{
+		Namespace: UploadNamespace, Name: "cleanup_reaped_sessions_total", Kind: Counter,
+		Help:   "Sessions removed by the cleanup loop, by state at removal.",
+		Labels: []string{"state"}, Unit: "short", Group: "Cleanup",
+	}
+	CleanupAborted = Metric{
+		Namespace: UploadNamespace, Name: "cleanup_aborted_multiparts_total", Kind: Counter,
+		Help:   "Multipart uploads aborted by the cleanup loop, by result (ok, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Cleanup",
+	}
+
+	EventsPublished = Metric{
+		Namespace: UploadNamespace, Name: "events_published_total", Kind: Counter,
+		Help:   "Lifecycle events sent to the event bus, by type and result (ok, error, dropped).",
+		Labels: []string{"type", "result"}, Unit: "short", Group: "Events",
+	}
+
+	MetadataWrites = Metric{
+		Namespace: UploadNamespace, Name: "metadata_writes_total", Kind: Counter,
+		Help:   "Completed uploads recorded in the metadata database, by result (ok, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Metadata",
+	}
+	MetadataWrite = Metric{
+		Namespace: UploadNamespace, Name: "metadata_write_seconds", Kind: Histogram,
+		Help: "Time to record a completed upload in the metadata database.",
+		Unit: "s", Group: "Metadata",
+	}
+
+	InstantUploads = Metric{
+		Namespace: UploadNamespace, Name: "instant_uploads_total", Kind: Counter,
+		Help:   "Inits that declared the file's SHA-256, by result (hit: completed by copying a stored file, miss: uploaded as usual).",
+		Labels: []string{"result"}, Unit: "short", Group: "Dedup",
+	}
+	InstantUploadBytes = Metric{
+		Namespace: UploadNamespace, Name: "instant_upload_bytes_total", Kind: Counter,
+		Help: "Bytes of files completed by copy rather than uploaded.",
+		Unit: "Bps", Group: "Dedup",
+	}
+	FileHashChecks = Metric{
+		Namespace: UploadNamespace, Name: "file_hash_checks_total", Kind: Counter,
+		Help:   "Finalized uploads checked against the SHA-256 declared at init, by result (ok, mismatch, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Dedup",
+	}
+
+	SearchIndexJobs = Metric{
+		Namespace: UploadNamespace, Name: "search_index_jobs_total", Kind: Counter,
+		Help:   "Completed files queued for content indexing, by result (ok, skipped, error, dropped: queue full).",
+		Labels: []string{"result"}, Unit: "short", Group: "Search",
+	}
+
+	ExportJobs = Metric{
+		Namespace: UploadNamespace, Name: "export_jobs_total", Kind: Counter,
+		Help:   "Finished bulk export jobs, by mode (copy, manifest) and state (completed, failed).",
+		Labels: []string{"mode", "state"}, Unit: "short", Group: "Exports",
+	}
+	ExportBytes = Metric{
+		Namespace: UploadNamespace, Name: "export_bytes_total", Kind: Counter,
+		Help: "Bytes of files copied or presigned by export jobs.",
+		Unit: "Bps", Group: "Exports",
+	}
+
+	RetentionFiles = Metric{
+		Namespace: UploadNamespace, Name: "retention_files_total", Kind: Counter,
+		Help:   "Files expired by retention rules, by action (delete, archive) and result (ok, error).",
+		Labels: []string{"action", "result"}, Unit: "short", Group: "Retention",
+	}
+	RetentionBytes = Metric{
+		Namespace: UploadNamespace, Name: "retention_bytes_total", Kind: Counter,
+		Help:   "Bytes of files expired by retention rules, by action.",
+		Labels: []string{"action"}, Unit: "Bps", Group: "Retention",
+	}
+
+	VerifiedFiles = Metric{
+		Namespace: UploadNamespace, Name: "verified_files_total", Kind: Counter,
+		Help:   "Stored files re-read by the verification job, by result (ok, recorded, corrupt, missing, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Verification",
+	}
+	VerifiedBytes = Metric{
+		Namespace: UploadNamespace, Name: "verified_bytes_total", Kind: Counter,
+		Help: "Bytes re-read by the verification job.",
+		Unit: "Bps", Group: "Verification",
+	}
+
+	ActivityEntries = Metric{
+		Namespace: UploadNamespace, Name: "activity_entries_total", Kind: Counter,
+		Help:   "Activity feed entries, by result (ok: written, error, dropped: queue full).",
+		Labels: []string{"result"}, Unit: "short", Group: "Activity",
+	}
+
+	PresetCopies = Metric{
+		Namespace: UploadNamespace, Name: "preset_copies_total", Kind: Counter,
+		Help:   "Completed uploads copied to their preset's bucket, by result (ok, error).",
+		Labels: []string{"result"}, Unit: "short", Group: "Presets",
+	}
+
+	Notifications = Metric{
+		Namespace: UploadNamespace, Name: "notifications_total", Kind: Counter,
+		Help:   "Notification emails by kind (upload_completed, upload_failed, share_received) and result (ok, error, skipped, dropped).",
+		Labels: []string{"kind", "result"}, Unit: "short", Group: "Notifications",
+	}
+
+	FaultsInjected = Metric{
+		Namespace: UploadNamespace, Name: "faults_injected_total", Kind: Counter,
+		Help:   "Failures injected on purpose in fault injection mode, by kind (nack, delay, drop, s3_error).",
+		Labels: []string{"kind"}, Unit: "short", Group: "Faults",
+	}
+)
+
+// UploadServer lists the file server's metrics in dashboard order.
+var UploadServer = []Metric{
+	ChunksReceived, BytesUploaded, CompressedBytes, ChunkProcessing, ChunkReceive, ChunkQueue, ChunkQueueWait, ChunkMemory, ChunkFileSpace, Backpressure, SlowChunks, SlowSessions,
+	UploadPart, S3Request, S3Errors, Finalize, FileListings, StreamBytes,
+	SessionsActive, SessionTransitions, SessionStoreWrites,
+	AuthFailures, RateLimited, TLSHandshakeFailures, WebSocketConnections,
+	CleanupRuns, CleanupLastRun, CleanupReaped, CleanupAborted,
+	EventsPublished,
+	MetadataWrites, MetadataWrite,
+	InstantUploads, InstantUploadBytes, FileHashChecks,
+	SearchIndexJobs,
+	ExportJobs, ExportBytes,
+	RetentionFiles, RetentionBytes,
+	VerifiedFiles, VerifiedBytes,
+	ActivityEntries,
+	PresetCopies,
+	Notifications,
+	FaultsInjected,
+}
+
+// ============================================
+// Gateway
+// ============================================
+
+// The gateway is a separate module and cannot import this package; its
+// metrics.go declares the same names and must be kept in step with these.
+
+var (
+	GatewayHTTPRequests = Metric{
+		Namespace: GatewayNamespace, Name: "http_requests_total", Kind: Counter,
+		Help:   "HTTP requests handled, by backend (flask, gnet, local) and status code.",
+		Labels: []string{"backend", "code"}, Unit: "reqps", Group: "HTTP",
+	}
+	GatewayHTTPDuration = Metric{
+		Namespace: GatewayNamespace, Name: "http_request_seconds", Kind: Histogram,
+		Help:   "HTTP request latency including the backend round trip, by backend.",
+		Labels: []string{"backend"}, Unit: "s", Group: "HTTP",
+	}
+	GatewayBinaryConnections = Metric{
+		Namespace: GatewayNamespace, Name: "binary_connections_active", Kind: Gauge,
+		Help: "Proxied binary protocol connections currently open.",
+		Unit: "short", Group: "Binary",
+	}
+	GatewayBinaryBytes = Metric{
+		Namespace: GatewayNamespace, Name: "binary_bytes_forwarded_total", Kind: Counter,
+		Help:   "Bytes forwarded on binary connections, by direction (upstream, downstream).",
+		Labels: []string{"direction"}, Unit: "Bps", Group: "Binary",
+	}
+	GatewayBinaryFrames = Metric{
+		Namespace: GatewayNamespace, Name: "binary_frames_total", Kind: Counter,
+		Help:   "Binary protocol frames forwarded to the file server, by command.",
+		Labels: []string{"command"}, Unit: "reqps", Group: "Binary",
+	}
+	GatewayBinaryFramesRejected = Metric{
+		Namespace: GatewayNamespace, Name: "binary_frames_rejected_total", Kind: Counter,
+		Help:   "Binary protocol frames refused by the gateway, by reason (token_size, frame_size).",
+		Labels: []string{"reason"}, Unit: "short", Group: "Binary",
+	}
+	GatewayTLSHandshakeFailures = Metric{
+		Namespace: GatewayNamespace, Name: "tls_handshake_failures_total", Kind: Counter,
+		Help: "Connections to the binary TLS port closed because the TLS handshake failed.",
+		Unit: "short", Group: "Binary",
+	}
+	GatewayBackendDialErrors = Metric{
+		Namespace: GatewayNamespace, Name: "backend_dial_errors_total", Kind: Counter,
+		Help: "Failed connection attempts to the file server's binary port.",
+		Unit: "short", Group: "Binary",
+	}
+	GatewayForwardBatch = Metric{
+		Namespace: GatewayNamespace, Name: "binary_forward_batch_reads", Kind: Histogram,
+		Help: "Backend reads written to a client with one writev.",
+		Unit: "short", Group: "Binary",
+	}
+)
+
+// Gateway lists the gateway's metrics in dashboard order.
+var Gateway = []Metric{
+	GatewayHTTPRequests, GatewayHTTPDuration,
+	GatewayBinaryConnections, GatewayBinaryBytes, GatewayBinaryFrames,
+	GatewayBinaryFramesRejected, GatewayTLSHandshakeFailures, GatewayBackendDialErrors,
+	GatewayForwardBatch,
+}
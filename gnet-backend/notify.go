@@ -0,0 +1,514 @@
+// notify.go - Email to owners about their uploads and to share recipients
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// ============================================
+// Email Notifications
+// ============================================
+
+// A large upload can run for hours, and its owner should not have to watch
+// it. With NOTIFY_MAILER set, the server emails:
+//
+//   - the owner, when an upload of at least NOTIFY_LARGE_UPLOAD_BYTES
+//     completes or fails to finalize
+//   - the addresses given as "notify" to POST /files/share (shares.go), with
+//     the link
+//
+// Mail goes out through a Mailer, selected by NOTIFY_MAILER:
+//
+//   - smtp: SMTP_ADDR (host:port), with SMTP_USERNAME and SMTP_PASSWORD if
+//     the server wants them; STARTTLS is used when offered
+//   - ses:  the Amazon SES v2 API in SES_REGION, with the default AWS
+//     credentials chain
+//
+// The server knows users by token, not by address, so owners get email only
+// once they set their preferences:
+//
+//	GET /notifications/preferences
+//	PUT /notifications/preferences   {"email", "upload_completed", "upload_failed", "share_received"}
+//
+// Each switch is on unless set false. "share_received": false also stops
+// share emails to the user's address from anyone else. Preferences are kept
+// in the metadata store (metadata.go) and need METADATA_DB. Links in email
+// are relative to NOTIFY_BASE_URL, the API root as users reach it.
+//
+// Sending happens on a background worker and never blocks a request; with
+// NOTIFY_QUEUE emails waiting, new ones are dropped and counted in
+// upload_notifications_total.
+
+const (
+	NOTIFY_UPLOAD_COMPLETED = "upload_completed"
+	NOTIFY_UPLOAD_FAILED    = "upload_failed"
+	NOTIFY_SHARE_RECEIVED   = "share_received"
+
+	NOTIFY_QUEUE          = 1000
+	NOTIFY_SEND_TIMEOUT   = 30 * time.Second
+	NOTIFY_MAX_RECIPIENTS = 20
+	NOTIFY_MAX_EMAIL      = 254
+)
+
+var (
+	NOTIFY_MAILER             = envString("NOTIFY_MAILER", "") // smtp, ses or empty to disable
+	NOTIFY_FROM               = envString("NOTIFY_FROM", "")
+	NOTIFY_BASE_URL           = strings.TrimSuffix(envString("NOTIFY_BASE_URL", ""), "/")
+	NOTIFY_LARGE_UPLOAD_BYTES = int64(envInt("NOTIFY_LARGE_UPLOAD_MB", 1024)) << 20
+	SMTP_ADDR                 = envString("SMTP_ADDR", "")
+	SMTP_USERNAME             = envString("SMTP_USERNAME", "")
+	SMTP_PASSWORD             = envString("SMTP_PASSWORD", "")
+	SES_REGION                = envString("SES_REGION", "us-east-1")
+)
+
+type NotificationPrefs struct {
+	UserID          string    `json:"-"`
+	Email           string    `json:"email"`
+	UploadCompleted bool      `json:"upload_completed"`
+	UploadFailed    bool      `json:"upload_failed"`
+	ShareReceived   bool      `json:"share_received"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type UpdatePrefsRequest struct {
+	Email           string `json:"email"`
+	UploadCompleted *bool  `json:"upload_completed"`
+	UploadFailed    *bool  `json:"upload_failed"`
+	ShareReceived   *bool  `json:"share_received"`
+}
+
+type Email struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers one email. Implementations may block; the Notifier calls
+// them from a single goroutine.
+type Mailer interface {
+	Send(ctx context.Context, email *Email) error
+}
+
+// NewMailer builds the mailer selected by NOTIFY_MAILER, or nil for none.
+func NewMailer() (Mailer, error) {
+	if NOTIFY_MAILER != "" && NOTIFY_FROM == "" {
+		return nil, errors.New("NOTIFY_MAILER needs NOTIFY_FROM")
+	}
+	switch NOTIFY_MAILER {
+	case "":
+		return nil, nil
+	case "smtp":
+		return newSMTPMailer(SMTP_ADDR, SMTP_USERNAME, SMTP_PASSWORD)
+	case "ses":
+		return newSESMailer(SES_REGION)
+	default:
+		return nil, fmt.Errorf("unknown NOTIFY_MAILER %q (want smtp or ses)", NOTIFY_MAILER)
+	}
+}
+
+// notification is an email waiting for the worker. One for a user is sent
+// to the address of their preferences, if they want this kind; one for
+// addresses goes to each that has not refused it.
+type notification struct {
+	kind    string
+	userID  string
+	to      []string
+	subject string
+	body    string
+}
+
+type Notifier struct {
+	mailer   Mailer
+	metadata MetadataStore
+	queue    chan notification
+}
+
+// NewNotifier starts the notifier's worker, or returns nil without a
+// mailer; a nil notifier sends nothing.
+func NewNotifier(mailer Mailer, metadata MetadataStore) *Notifier {
+	if mailer == nil {
+		return nil
+	}
+	n := &Notifier{
+		mailer:   mailer,
+		metadata: metadata,
+		queue:    make(chan notification, NOTIFY_QUEUE),
+	}
+	go n.run()
+	return n
+}
+
+func (n *Notifier) enqueue(note notification) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.queue <- note:
+	default:
+		notifications.WithLabelValues(note.kind, "dropped").Inc()
+	}
+}
+
+// UploadCompleted emails the owner of a completed session, if it was large.
+func (n *Notifier) UploadCompleted(session *UploadSession) {
+	if int64(session.TotalSize) < NOTIFY_LARGE_UPLOAD_BYTES {
+		return
+	}
+	n.enqueue(notification{
+		kind:    NOTIFY_UPLOAD_COMPLETED,
+		userID:  session.UserID,
+		subject: "Upload complete: " + session.FileName,
+		body: fmt.Sprintf("Your upload of %s (%s) has completed.\n\nKey: %s\n",
+			session.FileName, formatSize(session.TotalSize), session.S3Key),
+	})
+}
+
+// UploadFailed emails the owner of a session that failed to finalize, if
+// it was large.
+func (n *Notifier) UploadFailed(session *UploadSession, reason string) {
+	if int64(session.TotalSize) < NOTIFY_LARGE_UPLOAD_BYTES {
+		return
+	}
+	n.enqueue(notification{
+		kind:    NOTIFY_UPLOAD_FAILED,
+		userID:  session.UserID,
+		subject: "Upload failed: " + session.FileName,
+		body: fmt.Sprintf("Your upload of %s (%s) could not be completed: %s\n\nUpload it again to retry.\n",
+			session.FileName, formatSize(session.TotalSize), reason),
+	})
+}
+
+// ShareCreated emails the link of share to recipients.
+func (n *Notifier) ShareCreated(share *Share, from string, recipients []string) {
+	if len(recipients) == 0 {
+		return
+	}
+	body := fmt.Sprintf("%s shared %s with you.\n\nDownload it until %s:\n%s%s\n",
+		from, path.Base(share.Key), share.ExpiresAt.Format(time.RFC1123), NOTIFY_BASE_URL, share.URL)
+	if share.Protected {
+		body += "\nThe link is password protected; ask " + from + " for the password.\n"
+	}
+	n.enqueue(notification{
+		kind:    NOTIFY_SHARE_RECEIVED,
+		to:      recipients,
+		subject: from + " shared " + path.Base(share.Key) + " with you",
+		body:    body,
+	})
+}
+
+func (n *Notifier) run() {
+	for note := range n.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_SEND_TIMEOUT)
+		to, err := n.recipients(ctx, note)
+		if err == nil && len(to) == 0 {
+			cancel()
+			notifications.WithLabelValues(note.kind, "skipped").Inc()
+			continue
+		}
+		if err == nil {
+			err = n.mailer.Send(ctx, &Email{To: to, Subject: note.subject, Body: note.body})
+		}
+		cancel()
+
+		if err != nil {
+			notifications.WithLabelValues(note.kind, "error").Inc()
+			serverLog.Warn("failed to send notification", "kind", note.kind, "user_id", note.userID, "err", err)
+			continue
+		}
+		notifications.WithLabelValues(note.kind, "ok").Inc()
+	}
+}
+
+// recipients returns the addresses a notification goes to, after
+// preferences.
+func (n *Notifier) recipients(ctx context.Context, note notification) ([]string, error) {
+	if note.userID != "" {
+		prefs, err := n.metadata.GetNotificationPrefs(ctx, note.userID)
+		if errors.Is(err, errMetadataDisabled) {
+			return nil, nil
+		}
+		if err != nil || !prefs.wants(note.kind) {
+			return nil, err
+		}
+		return []string{prefs.Email}, nil
+	}
+
+	to := make([]string, 0, len(note.to))
+	for _, addr := range note.to {
+		refused, err := n.metadata.RefusesShareEmail(ctx, addr)
+		if err != nil && !errors.Is(err, errMetadataDisabled) {
+			return nil, err
+		}
+		if !refused {
+			to = append(to, addr)
+		}
+	}
+	return to, nil
+}
+
+func (p *NotificationPrefs) wants(kind string) bool {
+	switch {
+	case p == nil || p.Email == "":
+		return false
+	case kind == NOTIFY_UPLOAD_COMPLETED:
+		return p.UploadCompleted
+	case kind == NOTIFY_UPLOAD_FAILED:
+		return p.UploadFailed
+	default:
+		return p.ShareReceived
+	}
+}
+
+// validateEmails checks the addresses a share is sent to and returns them
+// bare, without display names.
+func validateEmails(addrs []string) ([]string, error) {
+	if len(addrs) > NOTIFY_MAX_RECIPIENTS {
+		return nil, fmt.Errorf("At most %d recipients", NOTIFY_MAX_RECIPIENTS)
+	}
+	bare := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil || len(parsed.Address) > NOTIFY_MAX_EMAIL {
+			return nil, fmt.Errorf("Invalid email address %q", addr)
+		}
+		bare = append(bare, parsed.Address)
+	}
+	return bare, nil
+}
+
+// formatSize renders a byte count for people.
+func formatSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ============================================
+// Mailers
+// ============================================
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr, username, password string) (*smtpMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q: %w", addr, err)
+	}
+	m := &smtpMailer{addr: addr}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (m *smtpMailer) Send(ctx context.Context, email *Email) error {
+	// net/smtp takes no context; the send is bounded by the server instead
+	return smtp.SendMail(m.addr, m.auth, NOTIFY_FROM, email.To, email.message())
+}
+
+// message is email as an RFC 5322 message of plain text.
+func (email *Email) message() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", NOTIFY_FROM)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(email.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// sesMailer calls SendEmail of the SES v2 API directly, signed with the
+// SDK's signer; the server has no SES client otherwise.
+type sesMailer struct {
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	client      *http.Client
+}
+
+func newSESMailer(region string) (*sesMailer, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return &sesMailer{
+		region:      region,
+		credentials: cfg.Credentials,
+		signer:      v4.NewSigner(),
+		client:      &http.Client{Timeout: NOTIFY_SEND_TIMEOUT},
+	}, nil
+}
+
+func (m *sesMailer) Send(ctx context.Context, email *Email) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": NOTIFY_FROM,
+		"Destination":      map[string]interface{}{"ToAddresses": email.To},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": map[string]string{"Data": email.Subject, "Charset": "UTF-8"},
+				"Body":    map[string]interface{}{"Text": map[string]string{"Data": email.Body, "Charset": "UTF-8"}},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/outbound-emails", m.region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	creds, err := m.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	if err := m.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "ses", m.region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("SES returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// ============================================
+// Preferences
+// ============================================
+
+func (hs *HTTPServer) registerNotificationRoutes() {
+	hs.mux.HandleFunc("GET /notifications/preferences", hs.handleGetPrefs)
+	hs.mux.HandleFunc("PUT /notifications/preferences", hs.handleUpdatePrefs)
+}
+
+// GET /notifications/preferences
+func (hs *HTTPServer) handleGetPrefs(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	prefs, err := hs.uploads.metadata.GetNotificationPrefs(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// PUT /notifications/preferences
+func (hs *HTTPServer) handleUpdatePrefs(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req UpdatePrefsRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	prefs := &NotificationPrefs{
+		UserID:          tokenInfo.UserID,
+		UploadCompleted: req.UploadCompleted == nil || *req.UploadCompleted,
+		UploadFailed:    req.UploadFailed == nil || *req.UploadFailed,
+		ShareReceived:   req.ShareReceived == nil || *req.ShareReceived,
+		UpdatedAt:       time.Now().UTC(),
+	}
+	// No address turns email off
+	if req.Email != "" {
+		addrs, err := validateEmails([]string{req.Email})
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		prefs.Email = addrs[0]
+	}
+
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.PutNotificationPrefs(r.Context(), prefs)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) GetNotificationPrefs(ctx context.Context, userID string) (*NotificationPrefs, error) {
+	prefs := &NotificationPrefs{UserID: userID, UploadCompleted: true, UploadFailed: true, ShareReceived: true}
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT email, upload_completed, upload_failed, share_received, updated_at
+		FROM notification_prefs WHERE user_id = $1`, userID).
+		Scan(&prefs.Email, &prefs.UploadCompleted, &prefs.UploadFailed, &prefs.ShareReceived, &prefs.UpdatedAt)
+	// Someone who never set theirs has the defaults, without an address
+	if errors.Is(err, sql.ErrNoRows) {
+		return prefs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (ms *sqlMetadataStore) PutNotificationPrefs(ctx context.Context, prefs *NotificationPrefs) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO notification_prefs (user_id, email, upload_completed, upload_failed, share_received, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET email = excluded.email, upload_completed = excluded.upload_completed,
+			upload_failed = excluded.upload_failed, share_received = excluded.share_received, updated_at = excluded.updated_at`,
+		prefs.UserID, prefs.Email, prefs.UploadCompleted, prefs.UploadFailed, prefs.ShareReceived, prefs.UpdatedAt)
+	return err
+}
+
+func (ms *sqlMetadataStore) RefusesShareEmail(ctx context.Context, email string) (bool, error) {
+	var n int
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM notification_prefs WHERE lower(email) = lower($1) AND NOT share_received`, email).Scan(&n)
+	return n > 0, err
+}
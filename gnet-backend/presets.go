@@ -0,0 +1,206 @@
+// presets.go - Named upload policies that clients pick at init
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ============================================
+// Upload Presets
+// ============================================
+
+// Upload presets are named upload policies defined in UPLOAD_PRESETS_FILE.
+// An HTTP init names one with "preset":
+//
+//	{
+//	  "raw-footage": {
+//	    "extensions": [".mp4", ".mov"],
+//	    "max_file_size": 53687091200,
+//	    "chunk_size": 16777216,
+//	    "prefix": "raw",
+//	    "bucket": "footage-ingest",
+//	    "required_attributes": ["project", "camera"],
+//	    "transcode": true
+//	  }
+//	}
+//
+//	GET /upload/presets   the presets, for clients to offer
+//
+// An upload with a preset is held to its extensions and size on top of the
+// tenant's limits (tenants.go). Its chunk size is the preset's: the client
+// may leave out chunk_size and total_chunks and give the file's "size"
+// instead, and gets both back; a different chunk_size is refused. The init's
+// attributes must include every required one. The key gets the prefix after
+// the user ID (user_id/raw/timestamp/filename), and once the upload completes
+// the file is also copied to the bucket, if set. "transcode" is passed on in
+// the session.created and session.completed events (events.go) for the
+// transcoders listening there; the server itself does not transcode.
+//
+// The binary protocol's init has no room for a preset, so presets are for
+// the HTTP API.
+
+var UPLOAD_PRESETS_FILE = envString("UPLOAD_PRESETS_FILE", "")
+
+var (
+	presetNamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	presetPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+)
+
+type UploadPreset struct {
+	Name               string   `json:"name"`
+	Extensions         []string `json:"extensions,omitempty"`
+	MaxFileSize        uint64   `json:"max_file_size,omitempty"`
+	ChunkSize          uint32   `json:"chunk_size,omitempty"`
+	Prefix             string   `json:"prefix,omitempty"`
+	Bucket             string   `json:"bucket,omitempty"`
+	RequiredAttributes []string `json:"required_attributes,omitempty"`
+	Transcode          bool     `json:"transcode"`
+}
+
+// LoadUploadPresets reads UPLOAD_PRESETS_FILE, if set.
+func LoadUploadPresets(path string) (map[string]*UploadPreset, error) {
+	presets := make(map[string]*UploadPreset)
+	if path == "" {
+		return presets, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read presets file: %w", err)
+	}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return nil, fmt.Errorf("failed to parse presets file: %w", err)
+	}
+	for name, preset := range presets {
+		preset.Name = name
+		if err := preset.validate(); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", name, err)
+		}
+	}
+	serverLog.Info("loaded upload presets", "file", path, "presets", len(presets))
+	return presets, nil
+}
+
+func (p *UploadPreset) validate() error {
+	if !presetNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid preset name: 1 to 64 lowercase letters, digits, '_' or '-'")
+	}
+	if p.MaxFileSize > MAX_FILE_SIZE {
+		return fmt.Errorf("max_file_size above the server's %d", MAX_FILE_SIZE)
+	}
+	if p.ChunkSize != 0 && (p.ChunkSize < MIN_SMALL_CHUNK_SIZE || p.ChunkSize > MAX_CHUNK_SIZE) {
+		return fmt.Errorf("chunk_size must be %d to %d", MIN_SMALL_CHUNK_SIZE, MAX_CHUNK_SIZE)
+	}
+	if err := normalizeExtensions(p.Extensions); err != nil {
+		return err
+	}
+	p.Prefix = strings.Trim(p.Prefix, "/")
+	if p.Prefix != "" && !presetPrefixPattern.MatchString(p.Prefix) {
+		return fmt.Errorf("invalid prefix %q", p.Prefix)
+	}
+	for _, name := range p.RequiredAttributes {
+		if name == "" || len(name) > METADATA_MAX_ATTRIBUTE_NAME {
+			return fmt.Errorf("required attribute names must be 1 to %d bytes", METADATA_MAX_ATTRIBUTE_NAME)
+		}
+	}
+	return nil
+}
+
+// The limits of a preset, nil for none
+
+func (p *UploadPreset) allowsExtension(ext string) bool {
+	return p == nil || len(p.Extensions) == 0 || slices.Contains(p.Extensions, ext)
+}
+
+func (p *UploadPreset) maxFileSize() uint64 {
+	if p == nil || p.MaxFileSize == 0 {
+		return MAX_FILE_SIZE
+	}
+	return p.MaxFileSize
+}
+
+// userFolder is where the keys of userID's uploads with p go.
+func (p *UploadPreset) userFolder(userID string) string {
+	if p == nil || p.Prefix == "" {
+		return userID
+	}
+	return userID + "/" + p.Prefix
+}
+
+// applyInit fills in an init's chunk size and count from the preset and
+// checks its attributes.
+func (p *UploadPreset) applyInit(req *InitUploadRequest) error {
+	if p.ChunkSize != 0 {
+		switch {
+		case req.ChunkSize != 0 && req.ChunkSize != p.ChunkSize:
+			return fmt.Errorf("preset %s uploads in chunks of %d bytes", p.Name, p.ChunkSize)
+		case req.TotalChunks == 0:
+			if req.Size == 0 {
+				return fmt.Errorf("size or total_chunks is required")
+			}
+			req.TotalChunks = uint32((req.Size + uint64(p.ChunkSize) - 1) / uint64(p.ChunkSize))
+		}
+		req.ChunkSize = p.ChunkSize
+	}
+	for _, name := range p.RequiredAttributes {
+		if req.Attributes[name] == "" {
+			return fmt.Errorf("preset %s requires the attribute %q", p.Name, name)
+		}
+	}
+	return nil
+}
+
+// eventData adds the preset of an upload to the data of its events.
+func (p *UploadPreset) eventData(data map[string]interface{}) map[string]interface{} {
+	if p != nil {
+		data["preset"] = p.Name
+		data["transcode"] = p.Transcode
+	}
+	return data
+}
+
+// deliverPreset copies a completed upload to its preset's bucket, if any.
+func (fus *FileUploadServer) deliverPreset(ctx context.Context, session *UploadSession) {
+	preset := session.Preset
+	if preset == nil || preset.Bucket == "" {
+		return
+	}
+	go func() {
+		if _, err := fus.s3Client.copyObjectTo(context.WithoutCancel(ctx), session.S3Key, preset.Bucket, session.S3Key); err != nil {
+			presetCopies.WithLabelValues("error").Inc()
+			s3Log.ErrorContext(ctx, "failed to copy upload to preset bucket", "s3_key", session.S3Key,
+				"preset", preset.Name, "bucket", preset.Bucket, "err", err)
+			return
+		}
+		presetCopies.WithLabelValues("ok").Inc()
+		s3Log.InfoContext(ctx, "copied upload to preset bucket", "s3_key", session.S3Key, "preset", preset.Name, "bucket", preset.Bucket)
+	}()
+}
+
+func (hs *HTTPServer) registerPresetRoutes() {
+	hs.mux.HandleFunc("GET /upload/presets", hs.handleListPresets)
+}
+
+// GET /upload/presets
+func (hs *HTTPServer) handleListPresets(w http.ResponseWriter, r *http.Request) {
+	if _, ok := hs.authenticate(r); !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	presets := make([]*UploadPreset, 0, len(hs.uploads.presets))
+	for _, preset := range hs.uploads.presets {
+		presets = append(presets, preset)
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"presets": presets})
+}
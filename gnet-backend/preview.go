@@ -0,0 +1,236 @@
+// preview.go - Local spool of leading chunks for previewing in-progress uploads
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ============================================
+// Preview Spool
+// ============================================
+
+// S3 does not allow reading the parts of an incomplete multipart upload, so
+// the leading chunks of every session are also written to a local spool.
+// The preview endpoint stitches the contiguous prefix back together.
+
+type PreviewSpool struct {
+	dir       string
+	maxChunks uint32
+}
+
+func NewPreviewSpool(dir string, maxChunks uint32) (*PreviewSpool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create preview spool: %w", err)
+	}
+	return &PreviewSpool{
+		dir:       dir,
+		maxChunks: maxChunks,
+	}, nil
+}
+
+func (ps *PreviewSpool) chunkPath(sessionID string, index uint32) string {
+	return filepath.Join(ps.dir, sessionID, fmt.Sprintf("%08d.part", index))
+}
+
+// Create starts spooling a chunk that is written as it streams past, or
+// returns nil if the chunk is outside the previewable prefix.
+func (ps *PreviewSpool) Create(sessionID string, index uint32) (*SpoolFile, error) {
+	if index >= ps.maxChunks {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(ps.dir, sessionID), 0o755); err != nil {
+		return nil, err
+	}
+
+	// Written to a temp file first so readers never see a partial chunk
+	path := ps.chunkPath(sessionID, index)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &SpoolFile{file: file, path: path}, nil
+}
+
+// SpoolFile is a chunk being spooled. Writes never fail: the chunk is being
+// stored too, and losing its preview must not stop that. The first error
+// is returned by Commit instead.
+type SpoolFile struct {
+	file *os.File
+	path string
+	err  error
+}
+
+func (sf *SpoolFile) Write(p []byte) (int, error) {
+	if sf.err == nil {
+		_, sf.err = sf.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// Commit makes the chunk visible to readers.
+func (sf *SpoolFile) Commit() error {
+	if err := sf.file.Close(); sf.err == nil {
+		sf.err = err
+	}
+	if sf.err != nil {
+		os.Remove(sf.file.Name())
+		return sf.err
+	}
+	return os.Rename(sf.file.Name(), sf.path)
+}
+
+// Discard drops the chunk.
+func (sf *SpoolFile) Discard() {
+	sf.file.Close()
+	os.Remove(sf.file.Name())
+}
+
+// Remove drops every spooled chunk of a session.
+func (ps *PreviewSpool) Remove(sessionID string) {
+	if err := os.RemoveAll(filepath.Join(ps.dir, sessionID)); err != nil {
+		sessionLog.Warn("failed to remove preview spool", "session_id", sessionID, "err", err)
+	}
+}
+
+// OpenChunk opens a single spooled chunk.
+func (ps *PreviewSpool) OpenChunk(sessionID string, index uint32) (*os.File, error) {
+	return os.Open(ps.chunkPath(sessionID, index))
+}
+
+// Open returns a reader over the contiguous run of spooled chunks starting at
+// chunk 0, along with its total size.
+func (ps *PreviewSpool) Open(sessionID string) (*SpoolReader, error) {
+	reader := &SpoolReader{}
+
+	for i := uint32(0); i < ps.maxChunks; i++ {
+		f, err := os.Open(ps.chunkPath(sessionID, i))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			reader.Close()
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			reader.Close()
+			return nil, err
+		}
+
+		reader.files = append(reader.files, f)
+		reader.offsets = append(reader.offsets, reader.size)
+		reader.size += info.Size()
+	}
+
+	return reader, nil
+}
+
+// ============================================
+// Spool Reader
+// ============================================
+
+// SpoolReader presents a sequence of chunk files as a single io.ReadSeeker so
+// it can be served with http.ServeContent (and therefore Range requests).
+type SpoolReader struct {
+	files   []*os.File
+	offsets []int64
+	size    int64
+	pos     int64
+}
+
+func (sr *SpoolReader) Size() int64 {
+	return sr.size
+}
+
+func (sr *SpoolReader) Read(p []byte) (int, error) {
+	if sr.pos >= sr.size {
+		return 0, io.EOF
+	}
+
+	// Locate the file containing the current position
+	idx := len(sr.offsets) - 1
+	for idx > 0 && sr.offsets[idx] > sr.pos {
+		idx--
+	}
+
+	n, err := sr.files[idx].ReadAt(p, sr.pos-sr.offsets[idx])
+	sr.pos += int64(n)
+	if err == io.EOF && sr.pos < sr.size {
+		err = nil // Continue with the next file on the following Read
+	}
+	return n, err
+}
+
+// WriteTo writes the rest of the spool. Each chunk file goes to the
+// writer's ReadFrom, so an HTTP response sends it with sendfile(2).
+func (sr *SpoolReader) WriteTo(w io.Writer) (int64, error) {
+	return sr.writeTo(w, sr.size-sr.pos)
+}
+
+// writeTo writes up to limit bytes from the current position.
+func (sr *SpoolReader) writeTo(w io.Writer, limit int64) (int64, error) {
+	var written int64
+	for i, f := range sr.files {
+		end := sr.size
+		if i+1 < len(sr.offsets) {
+			end = sr.offsets[i+1]
+		}
+		if sr.pos >= end {
+			continue
+		}
+		if written >= limit {
+			break
+		}
+
+		if _, err := f.Seek(sr.pos-sr.offsets[i], io.SeekStart); err != nil {
+			return written, err
+		}
+		want := min(end-sr.pos, limit-written)
+		n, err := io.Copy(w, &io.LimitedReader{R: f, N: want})
+		sr.pos += n
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < want {
+			return written, io.ErrUnexpectedEOF // Chunk file shrank
+		}
+	}
+	return written, nil
+}
+
+func (sr *SpoolReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = sr.pos + offset
+	case io.SeekEnd:
+		abs = sr.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	sr.pos = abs
+	return abs, nil
+}
+
+func (sr *SpoolReader) Close() error {
+	for _, f := range sr.files {
+		f.Close()
+	}
+	sr.files = nil
+	return nil
+}
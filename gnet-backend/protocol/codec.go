@@ -0,0 +1,267 @@
+// codec.go - Framing and field codecs shared by the generated messages
+//
+// The byte layout of the binary protocol is defined once, in protocol.json.
+// protogen turns it into protocol_gen.go (this package, used by the server,
+// the Go SDK and protodump), the gateway's constants, the TypeScript codec
+// and the Python constants:
+//
+//	go generate ./protocol
+//
+// Change the schema and regenerate rather than editing the generated files.
+package protocol
+
+//go:generate go run ../cmd/protogen -schema protocol.json -go protocol_gen.go -gateway ../../gateway/protocol_gen.go -ts ../../web-client/src/protocol.gen.ts -py ../../python-client/hpu_client/protocol_gen.py
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ============================================
+// Messages
+// ============================================
+
+// ErrTruncated is returned by Decode when the buffer ends inside a message.
+var ErrTruncated = errors.New("truncated")
+
+// Message is a command or response. Every type in protocol_gen.go is one.
+type Message interface {
+	Code() byte
+	// Size is the encoded length of the fields, without the code byte.
+	Size() int
+	// Append appends the code byte and the fields to b.
+	Append(b []byte) []byte
+
+	decodeFields(d *decoder)
+}
+
+// Encode returns m with its code byte.
+func Encode(m Message) []byte {
+	return m.Append(make([]byte, 0, 1+m.Size()))
+}
+
+// Decode reads the fields of m (everything after the code byte) from b and
+// returns how many bytes they took. Byte fields alias b.
+func Decode(m Message, b []byte) (int, error) {
+	d := &decoder{buf: b}
+	m.decodeFields(d)
+	return d.pos, d.err
+}
+
+// DecodeHead decodes the fields of m from b up to its first bytes32 field,
+// whose data it does not read: it returns where the data starts in b and its
+// size, so a server can take the data of an UPLOAD_CHUNK as it arrives.
+// Fields after that one stay unset. ErrTruncated means b ends before the
+// data starts.
+func DecodeHead(m Message, b []byte) (offset, size int, err error) {
+	d := &decoder{buf: b, head: true}
+	m.decodeFields(d)
+	if d.err == errHeadDone {
+		return d.pos, d.headSize, nil
+	}
+	return d.pos, 0, d.err
+}
+
+// Read reads the fields of m (everything after the code byte) from r.
+func Read(m Message, r io.Reader) error {
+	d := &decoder{r: r}
+	m.decodeFields(d)
+	return d.err
+}
+
+// ============================================
+// Framing
+// ============================================
+
+// Request frame:
+//
+//	auth_token_size(4) | auth_token | payload_size(4) | command(1) | command fields
+//
+// Responses carry no length prefix; each response code has its own fixed or
+// self-describing layout.
+
+// FRAME_HEADER_SIZE is the frame header without the token.
+const FRAME_HEADER_SIZE = 8
+
+// AppendFrame appends cmd, wrapped in the authenticated request frame, to b.
+func AppendFrame(b []byte, token string, cmd Message) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(token)))
+	b = append(b, token...)
+	b = binary.BigEndian.AppendUint32(b, uint32(1+cmd.Size()))
+	return cmd.Append(b)
+}
+
+// ReadResponse reads one response from r.
+func ReadResponse(r io.Reader) (Message, error) {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return nil, err
+	}
+	m := NewResponse(code[0])
+	if m == nil {
+		return nil, fmt.Errorf("unknown response code 0x%02x", code[0])
+	}
+	if err := Read(m, r); err != nil {
+		return nil, fmt.Errorf("malformed %s response: %w", ResponseNames[code[0]], err)
+	}
+	return m, nil
+}
+
+// ============================================
+// Field Codecs
+// ============================================
+
+// Strings longer than their size prefix allows are truncated; only error
+// messages come close in practice.
+
+func appendString8(b []byte, s string) []byte {
+	s = s[:min(len(s), 0xFF)]
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+func appendString16(b []byte, s string) []byte {
+	s = s[:min(len(s), 0xFFFF)]
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes32(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func appendUint32List(b []byte, list []uint32) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(list)))
+	for _, v := range list {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// decoder reads fields from a buffer or a stream. The first error sticks and
+// later reads return zero values, so generated code checks once at the end.
+type decoder struct {
+	buf []byte
+	pos int
+
+	r       io.Reader
+	scratch [8]byte
+
+	// DecodeHead stops at the first bytes32 field and records its size
+	head     bool
+	headSize int
+
+	err error
+}
+
+// errHeadDone stops decoding once DecodeHead has reached the data.
+var errHeadDone = errors.New("head decoded")
+
+// next returns the next n bytes of field. Stream reads of fixed-size fields
+// reuse the scratch buffer.
+func (d *decoder) next(field string, n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if d.r == nil {
+		if n > len(d.buf)-d.pos {
+			d.err = fmt.Errorf("%s: %w", field, ErrTruncated)
+			return nil
+		}
+		b := d.buf[d.pos : d.pos+n]
+		d.pos += n
+		return b
+	}
+
+	b := d.scratch[:0]
+	if n > len(d.scratch) {
+		b = make([]byte, n)
+	}
+	b = b[:n]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = fmt.Errorf("%s: %w", field, err)
+		return nil
+	}
+	return b
+}
+
+// more reports whether an optional field was sent. Only commands have them,
+// and commands are decoded from their payload.
+func (d *decoder) more() bool {
+	return d.err == nil && d.r == nil && d.pos < len(d.buf)
+}
+
+func (d *decoder) uint8(field string) uint8 {
+	if b := d.next(field, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16(field string) uint16 {
+	if b := d.next(field, 2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32(field string) uint32 {
+	if b := d.next(field, 4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64(field string) uint64 {
+	if b := d.next(field, 8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) string8(field string) string {
+	return string(d.next(field, int(d.uint8(field))))
+}
+
+func (d *decoder) string16(field string) string {
+	return string(d.next(field, int(d.uint16(field))))
+}
+
+func (d *decoder) bytes32(field string) []byte {
+	size := int(d.uint32(field))
+	if d.head && d.err == nil {
+		d.headSize, d.err = size, errHeadDone
+		return nil
+	}
+	if d.r != nil && size <= len(d.scratch) {
+		// Small fields would otherwise alias the reused scratch buffer
+		return bytes.Clone(d.next(field, size))
+	}
+	return d.next(field, size)
+}
+
+// uint32list reads a counted list whose length is bounded by max, an earlier
+// field, so a corrupt count fails instead of allocating or blocking.
+func (d *decoder) uint32list(field string, max uint32) []uint32 {
+	count := d.uint32(field)
+	if d.err != nil {
+		return nil
+	}
+	if count > max {
+		d.err = fmt.Errorf("%s: %d entries exceed the limit of %d", field, count, max)
+		return nil
+	}
+	b := d.next(field, int(count)*4)
+	if d.err != nil {
+		return nil
+	}
+	list := make([]uint32, count)
+	for i := range list {
+		list[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	return list
+}
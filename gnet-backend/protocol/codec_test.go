@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The upload benchmarks (cmd/bench) measure the server's allocations per
+// chunk end to end, but a few extra allocations disappear in a whole upload
+// and the report cannot say where they came from. These are the codec calls
+// every frame goes through, each with a ceiling on its allocations:
+// TestHotPathAllocs fails, naming the call, when a copy is added back into
+// frame parsing or response encoding. Ceilings are today's counts: lower
+// them when a change removes an allocation, never raise them to make the
+// test pass.
+//
+// Storing a chunk once it is decoded is measured per upload path next to
+// its handler: BenchmarkBinaryChunk and BenchmarkHTTPChunk in package main.
+
+const testSessionID = "user_123_1792161484106314454"
+
+// Sinks keep results alive so the compiler cannot drop the work. A slice
+// stored in an interface would add an allocation of its own.
+var (
+	sink      any
+	sinkBytes []byte
+)
+
+// Each returns one operation of a hot path.
+
+// OnTraffic decodes an UPLOAD_CHUNK up to its data: the command, the
+// session ID string and the decoder, which escapes through the Message
+// interface.
+func decodeChunkHead() func() {
+	payload := Encode(&UploadChunk{SessionID: testSessionID, ChunkIndex: 7, ChunkData: make([]byte, 1<<20)})[1:]
+	return func() {
+		cmd := &UploadChunk{}
+		DecodeHead(cmd, payload)
+		sink = cmd
+	}
+}
+
+// Every other command is decoded whole; the same three.
+func decodeCommand() func() {
+	payload := Encode(&GetStatus{SessionID: testSessionID})[1:]
+	return func() {
+		cmd := &GetStatus{}
+		Decode(cmd, payload)
+		sink = cmd
+	}
+}
+
+// The reply to each chunk: its buffer.
+func encodeChunkAck() func() {
+	ack := &ChunkAckResp{ChunkIndex: 7, Received: 8, Total: 64, BytesPerSec: 120 << 20, ETASeconds: 3}
+	return func() {
+		sinkBytes = Encode(ack)
+	}
+}
+
+// The SDK's frame around a chunk, into a buffer it reuses.
+func appendChunkFrame() func() {
+	cmd := &UploadChunk{SessionID: testSessionID, ChunkIndex: 7, ChunkData: make([]byte, 1<<20)}
+	buf := AppendFrame(nil, "test_token_user123", cmd)
+	return func() {
+		buf = AppendFrame(buf[:0], "test_token_user123", cmd)
+	}
+}
+
+// The SDK reading a chunk's ACK: the response, its decoder and the buffer
+// its code byte is read into.
+func readChunkAck() func() {
+	resp := Encode(&ChunkAckResp{ChunkIndex: 7, Received: 8, Total: 64})
+	r := bytes.NewReader(resp)
+	return func() {
+		r.Reset(resp)
+		sink, _ = ReadResponse(r)
+	}
+}
+
+var hotPaths = []struct {
+	name      string
+	maxAllocs float64
+	setup     func() func()
+}{
+	{"DecodeChunkHead", 3, decodeChunkHead},
+	{"DecodeCommand", 3, decodeCommand},
+	{"EncodeChunkAck", 1, encodeChunkAck},
+	{"AppendChunkFrame", 0, appendChunkFrame},
+	{"ReadChunkAck", 3, readChunkAck},
+}
+
+func TestHotPathAllocs(t *testing.T) {
+	for _, hp := range hotPaths {
+		if allocs := testing.AllocsPerRun(100, hp.setup()); allocs > hp.maxAllocs {
+			t.Errorf("%s: %v allocs/op, ceiling %v", hp.name, allocs, hp.maxAllocs)
+		}
+	}
+}
+
+func benchmark(b *testing.B, setup func() func()) {
+	op := setup()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		op()
+	}
+}
+
+func BenchmarkDecodeChunkHead(b *testing.B)  { benchmark(b, decodeChunkHead) }
+func BenchmarkDecodeCommand(b *testing.B)    { benchmark(b, decodeCommand) }
+func BenchmarkEncodeChunkAck(b *testing.B)   { benchmark(b, encodeChunkAck) }
+func BenchmarkAppendChunkFrame(b *testing.B) { benchmark(b, appendChunkFrame) }
+func BenchmarkReadChunkAck(b *testing.B)     { benchmark(b, readChunkAck) }
@@ -0,0 +1,686 @@
+// Code generated by protogen from protocol.json. DO NOT EDIT.
+
+package protocol
+
+import "encoding/binary"
+
+const (
+	MAX_TOKEN_SIZE   = 4096       // Largest auth token the server accepts
+	ETA_UNKNOWN      = 0xFFFFFFFF // eta_seconds before any rate is measured
+	COMPRESSION_ZSTD = 0x01       // Chunk data compressed as one zstd frame
+	COMPRESSION_LZ4  = 0x02       // Chunk data compressed as one LZ4 block
+
+	// Commands
+	CMD_INIT_UPLOAD          = 0x01 // Initialize upload session
+	CMD_UPLOAD_CHUNK         = 0x02 // Upload a chunk
+	CMD_PAUSE_UPLOAD         = 0x03 // Pause upload
+	CMD_RESUME_UPLOAD        = 0x04 // Resume upload
+	CMD_CANCEL_UPLOAD        = 0x05 // Cancel upload
+	CMD_GET_STATUS           = 0x06 // Get upload status
+	CMD_INIT_UPLOAD_VERIFIED = 0x07 // Initialize upload session for a file of known SHA-256
+
+	// Responses
+	RESP_OK                 = 0x10 // Success
+	RESP_ERROR              = 0x11 // Error
+	RESP_READY              = 0x12 // Session ready
+	RESP_CHUNK_ACK          = 0x13 // Chunk acknowledged
+	RESP_COMPLETE           = 0x14 // Upload complete
+	RESP_STATUS             = 0x15 // Status response
+	RESP_PAUSED             = 0x16 // Upload paused
+	RESP_RESUMED            = 0x17 // Upload resumed
+	RESP_CANCELLED          = 0x18 // Upload cancelled
+	RESP_AUTH_FAILED        = 0x19 // Authentication failed
+	RESP_DUPLICATE          = 0x1A // Duplicate chunk (already received)
+	RESP_HASH_MISMATCH      = 0x1B // Assembled file does not match the declared SHA-256; the session has failed
+	RESP_RATE_LIMITED       = 0x1C // Refused by a rate limit; send the command again after the wait
+	RESP_READY_COMPRESSED   = 0x1D // Session ready, with chunks compressed; sent instead of READY to clients that offered compression
+	RESP_RESUMED_COMPRESSED = 0x1E // Upload resumed, with chunks compressed; sent instead of RESUMED to clients that offered compression
+)
+
+var CommandNames = map[byte]string{
+	CMD_INIT_UPLOAD:          "INIT_UPLOAD",
+	CMD_UPLOAD_CHUNK:         "UPLOAD_CHUNK",
+	CMD_PAUSE_UPLOAD:         "PAUSE_UPLOAD",
+	CMD_RESUME_UPLOAD:        "RESUME_UPLOAD",
+	CMD_CANCEL_UPLOAD:        "CANCEL_UPLOAD",
+	CMD_GET_STATUS:           "GET_STATUS",
+	CMD_INIT_UPLOAD_VERIFIED: "INIT_UPLOAD_VERIFIED",
+}
+
+var ResponseNames = map[byte]string{
+	RESP_OK:                 "OK",
+	RESP_ERROR:              "ERROR",
+	RESP_READY:              "READY",
+	RESP_CHUNK_ACK:          "CHUNK_ACK",
+	RESP_COMPLETE:           "COMPLETE",
+	RESP_STATUS:             "STATUS",
+	RESP_PAUSED:             "PAUSED",
+	RESP_RESUMED:            "RESUMED",
+	RESP_CANCELLED:          "CANCELLED",
+	RESP_AUTH_FAILED:        "AUTH_FAILED",
+	RESP_DUPLICATE:          "DUPLICATE",
+	RESP_HASH_MISMATCH:      "HASH_MISMATCH",
+	RESP_RATE_LIMITED:       "RATE_LIMITED",
+	RESP_READY_COMPRESSED:   "READY_COMPRESSED",
+	RESP_RESUMED_COMPRESSED: "RESUMED_COMPRESSED",
+}
+
+// NewCommand returns an empty command for code, or nil if the code is unknown.
+func NewCommand(code byte) Message {
+	switch code {
+	case CMD_INIT_UPLOAD:
+		return &InitUpload{}
+	case CMD_UPLOAD_CHUNK:
+		return &UploadChunk{}
+	case CMD_PAUSE_UPLOAD:
+		return &PauseUpload{}
+	case CMD_RESUME_UPLOAD:
+		return &ResumeUpload{}
+	case CMD_CANCEL_UPLOAD:
+		return &CancelUpload{}
+	case CMD_GET_STATUS:
+		return &GetStatus{}
+	case CMD_INIT_UPLOAD_VERIFIED:
+		return &InitUploadVerified{}
+	}
+	return nil
+}
+
+// NewResponse returns an empty response for code, or nil if the code is unknown.
+func NewResponse(code byte) Message {
+	switch code {
+	case RESP_OK:
+		return &OKResp{}
+	case RESP_ERROR:
+		return &ErrorResp{}
+	case RESP_READY:
+		return &ReadyResp{}
+	case RESP_CHUNK_ACK:
+		return &ChunkAckResp{}
+	case RESP_COMPLETE:
+		return &CompleteResp{}
+	case RESP_STATUS:
+		return &StatusResp{}
+	case RESP_PAUSED:
+		return &PausedResp{}
+	case RESP_RESUMED:
+		return &ResumedResp{}
+	case RESP_CANCELLED:
+		return &CancelledResp{}
+	case RESP_AUTH_FAILED:
+		return &AuthFailedResp{}
+	case RESP_DUPLICATE:
+		return &DuplicateResp{}
+	case RESP_HASH_MISMATCH:
+		return &HashMismatchResp{}
+	case RESP_RATE_LIMITED:
+		return &RateLimitedResp{}
+	case RESP_READY_COMPRESSED:
+		return &ReadyCompressedResp{}
+	case RESP_RESUMED_COMPRESSED:
+		return &ResumedCompressedResp{}
+	}
+	return nil
+}
+
+// InitUpload is the INIT_UPLOAD command: initialize upload session.
+//
+//	file_name_size(2) | file_name | total_chunks(4) | chunk_size(4) | [compression(1)]
+type InitUpload struct {
+	FileName    string
+	TotalChunks uint32
+	ChunkSize   uint32
+	Compression uint8 // COMPRESSION_* bits the client can send
+}
+
+func (m *InitUpload) Code() byte { return CMD_INIT_UPLOAD }
+
+func (m *InitUpload) Size() int {
+	size := 10 + min(len(m.FileName), 0xFFFF)
+	if m.Compression != 0 {
+		size += 1
+	}
+	return size
+}
+
+func (m *InitUpload) Append(b []byte) []byte {
+	b = append(b, CMD_INIT_UPLOAD)
+	b = appendString16(b, m.FileName)
+	b = binary.BigEndian.AppendUint32(b, m.TotalChunks)
+	b = binary.BigEndian.AppendUint32(b, m.ChunkSize)
+	if m.Compression != 0 {
+		b = append(b, m.Compression)
+	}
+	return b
+}
+
+func (m *InitUpload) decodeFields(d *decoder) {
+	m.FileName = d.string16("file_name")
+	m.TotalChunks = d.uint32("total_chunks")
+	m.ChunkSize = d.uint32("chunk_size")
+	if d.more() {
+		m.Compression = d.uint8("compression")
+	}
+}
+
+// UploadChunk is the UPLOAD_CHUNK command: upload a chunk.
+//
+//	session_id_size(2) | session_id | chunk_index(4) | chunk_data_size(4) | chunk_data
+type UploadChunk struct {
+	SessionID  string
+	ChunkIndex uint32
+	ChunkData  []byte
+}
+
+func (m *UploadChunk) Code() byte { return CMD_UPLOAD_CHUNK }
+
+func (m *UploadChunk) Size() int { return 10 + min(len(m.SessionID), 0xFFFF) + len(m.ChunkData) }
+
+func (m *UploadChunk) Append(b []byte) []byte {
+	b = append(b, CMD_UPLOAD_CHUNK)
+	b = appendString16(b, m.SessionID)
+	b = binary.BigEndian.AppendUint32(b, m.ChunkIndex)
+	b = appendBytes32(b, m.ChunkData)
+	return b
+}
+
+func (m *UploadChunk) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+	m.ChunkIndex = d.uint32("chunk_index")
+	m.ChunkData = d.bytes32("chunk_data")
+}
+
+// PauseUpload is the PAUSE_UPLOAD command: pause upload.
+//
+//	session_id_size(2) | session_id
+type PauseUpload struct {
+	SessionID string
+}
+
+func (m *PauseUpload) Code() byte { return CMD_PAUSE_UPLOAD }
+
+func (m *PauseUpload) Size() int { return 2 + min(len(m.SessionID), 0xFFFF) }
+
+func (m *PauseUpload) Append(b []byte) []byte {
+	b = append(b, CMD_PAUSE_UPLOAD)
+	b = appendString16(b, m.SessionID)
+	return b
+}
+
+func (m *PauseUpload) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+}
+
+// ResumeUpload is the RESUME_UPLOAD command: resume upload.
+//
+//	session_id_size(2) | session_id | [compression(1)]
+type ResumeUpload struct {
+	SessionID   string
+	Compression uint8 // COMPRESSION_* bits the client can send
+}
+
+func (m *ResumeUpload) Code() byte { return CMD_RESUME_UPLOAD }
+
+func (m *ResumeUpload) Size() int {
+	size := 2 + min(len(m.SessionID), 0xFFFF)
+	if m.Compression != 0 {
+		size += 1
+	}
+	return size
+}
+
+func (m *ResumeUpload) Append(b []byte) []byte {
+	b = append(b, CMD_RESUME_UPLOAD)
+	b = appendString16(b, m.SessionID)
+	if m.Compression != 0 {
+		b = append(b, m.Compression)
+	}
+	return b
+}
+
+func (m *ResumeUpload) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+	if d.more() {
+		m.Compression = d.uint8("compression")
+	}
+}
+
+// CancelUpload is the CANCEL_UPLOAD command: cancel upload.
+//
+//	session_id_size(2) | session_id
+type CancelUpload struct {
+	SessionID string
+}
+
+func (m *CancelUpload) Code() byte { return CMD_CANCEL_UPLOAD }
+
+func (m *CancelUpload) Size() int { return 2 + min(len(m.SessionID), 0xFFFF) }
+
+func (m *CancelUpload) Append(b []byte) []byte {
+	b = append(b, CMD_CANCEL_UPLOAD)
+	b = appendString16(b, m.SessionID)
+	return b
+}
+
+func (m *CancelUpload) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+}
+
+// GetStatus is the GET_STATUS command: get upload status.
+//
+//	session_id_size(2) | session_id
+type GetStatus struct {
+	SessionID string
+}
+
+func (m *GetStatus) Code() byte { return CMD_GET_STATUS }
+
+func (m *GetStatus) Size() int { return 2 + min(len(m.SessionID), 0xFFFF) }
+
+func (m *GetStatus) Append(b []byte) []byte {
+	b = append(b, CMD_GET_STATUS)
+	b = appendString16(b, m.SessionID)
+	return b
+}
+
+func (m *GetStatus) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+}
+
+// InitUploadVerified is the INIT_UPLOAD_VERIFIED command: initialize upload session for a file of known SHA-256.
+//
+//	file_name_size(2) | file_name | total_chunks(4) | chunk_size(4) | sha256_size(1) | sha256 | [compression(1)]
+type InitUploadVerified struct {
+	FileName    string
+	TotalChunks uint32
+	ChunkSize   uint32
+	SHA256      string // Hex SHA-256 of the whole file
+	Compression uint8  // COMPRESSION_* bits the client can send
+}
+
+func (m *InitUploadVerified) Code() byte { return CMD_INIT_UPLOAD_VERIFIED }
+
+func (m *InitUploadVerified) Size() int {
+	size := 11 + min(len(m.FileName), 0xFFFF) + min(len(m.SHA256), 0xFF)
+	if m.Compression != 0 {
+		size += 1
+	}
+	return size
+}
+
+func (m *InitUploadVerified) Append(b []byte) []byte {
+	b = append(b, CMD_INIT_UPLOAD_VERIFIED)
+	b = appendString16(b, m.FileName)
+	b = binary.BigEndian.AppendUint32(b, m.TotalChunks)
+	b = binary.BigEndian.AppendUint32(b, m.ChunkSize)
+	b = appendString8(b, m.SHA256)
+	if m.Compression != 0 {
+		b = append(b, m.Compression)
+	}
+	return b
+}
+
+func (m *InitUploadVerified) decodeFields(d *decoder) {
+	m.FileName = d.string16("file_name")
+	m.TotalChunks = d.uint32("total_chunks")
+	m.ChunkSize = d.uint32("chunk_size")
+	m.SHA256 = d.string8("sha256")
+	if d.more() {
+		m.Compression = d.uint8("compression")
+	}
+}
+
+// OKResp is the OK response: success.
+type OKResp struct {
+}
+
+func (m *OKResp) Code() byte { return RESP_OK }
+
+func (m *OKResp) Size() int { return 0 }
+
+func (m *OKResp) Append(b []byte) []byte {
+	b = append(b, RESP_OK)
+	return b
+}
+
+func (m *OKResp) decodeFields(d *decoder) {}
+
+// ErrorResp is the ERROR response: error.
+//
+//	message_size(1) | message
+type ErrorResp struct {
+	Message string
+}
+
+func (m *ErrorResp) Code() byte { return RESP_ERROR }
+
+func (m *ErrorResp) Size() int { return 1 + min(len(m.Message), 0xFF) }
+
+func (m *ErrorResp) Append(b []byte) []byte {
+	b = append(b, RESP_ERROR)
+	b = appendString8(b, m.Message)
+	return b
+}
+
+func (m *ErrorResp) decodeFields(d *decoder) {
+	m.Message = d.string8("message")
+}
+
+// ReadyResp is the READY response: session ready.
+//
+//	session_id_size(2) | session_id | s3_key_size(2) | s3_key
+type ReadyResp struct {
+	SessionID string
+	S3Key     string
+}
+
+func (m *ReadyResp) Code() byte { return RESP_READY }
+
+func (m *ReadyResp) Size() int { return 4 + min(len(m.SessionID), 0xFFFF) + min(len(m.S3Key), 0xFFFF) }
+
+func (m *ReadyResp) Append(b []byte) []byte {
+	b = append(b, RESP_READY)
+	b = appendString16(b, m.SessionID)
+	b = appendString16(b, m.S3Key)
+	return b
+}
+
+func (m *ReadyResp) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+	m.S3Key = d.string16("s3_key")
+}
+
+// ChunkAckResp is the CHUNK_ACK response: chunk acknowledged.
+//
+//	chunk_index(4) | received(4) | total(4) | bytes_per_sec(8) | eta_seconds(4)
+type ChunkAckResp struct {
+	ChunkIndex  uint32
+	Received    uint32
+	Total       uint32
+	BytesPerSec uint64
+	ETASeconds  uint32 // ETA_UNKNOWN until a rate is measured
+}
+
+func (m *ChunkAckResp) Code() byte { return RESP_CHUNK_ACK }
+
+func (m *ChunkAckResp) Size() int { return 24 }
+
+func (m *ChunkAckResp) Append(b []byte) []byte {
+	b = append(b, RESP_CHUNK_ACK)
+	b = binary.BigEndian.AppendUint32(b, m.ChunkIndex)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	b = binary.BigEndian.AppendUint32(b, m.Total)
+	b = binary.BigEndian.AppendUint64(b, m.BytesPerSec)
+	b = binary.BigEndian.AppendUint32(b, m.ETASeconds)
+	return b
+}
+
+func (m *ChunkAckResp) decodeFields(d *decoder) {
+	m.ChunkIndex = d.uint32("chunk_index")
+	m.Received = d.uint32("received")
+	m.Total = d.uint32("total")
+	m.BytesPerSec = d.uint64("bytes_per_sec")
+	m.ETASeconds = d.uint32("eta_seconds")
+}
+
+// CompleteResp is the COMPLETE response: upload complete.
+//
+//	s3_key_size(2) | s3_key | file_size(8)
+type CompleteResp struct {
+	S3Key    string
+	FileSize uint64
+}
+
+func (m *CompleteResp) Code() byte { return RESP_COMPLETE }
+
+func (m *CompleteResp) Size() int { return 10 + min(len(m.S3Key), 0xFFFF) }
+
+func (m *CompleteResp) Append(b []byte) []byte {
+	b = append(b, RESP_COMPLETE)
+	b = appendString16(b, m.S3Key)
+	b = binary.BigEndian.AppendUint64(b, m.FileSize)
+	return b
+}
+
+func (m *CompleteResp) decodeFields(d *decoder) {
+	m.S3Key = d.string16("s3_key")
+	m.FileSize = d.uint64("file_size")
+}
+
+// StatusResp is the STATUS response: status response.
+//
+//	state_size(1) | state | received(4) | total(4)
+type StatusResp struct {
+	State    string
+	Received uint32
+	Total    uint32
+}
+
+func (m *StatusResp) Code() byte { return RESP_STATUS }
+
+func (m *StatusResp) Size() int { return 9 + min(len(m.State), 0xFF) }
+
+func (m *StatusResp) Append(b []byte) []byte {
+	b = append(b, RESP_STATUS)
+	b = appendString8(b, m.State)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	b = binary.BigEndian.AppendUint32(b, m.Total)
+	return b
+}
+
+func (m *StatusResp) decodeFields(d *decoder) {
+	m.State = d.string8("state")
+	m.Received = d.uint32("received")
+	m.Total = d.uint32("total")
+}
+
+// PausedResp is the PAUSED response: upload paused.
+//
+//	received(4) | total(4)
+type PausedResp struct {
+	Received uint32
+	Total    uint32
+}
+
+func (m *PausedResp) Code() byte { return RESP_PAUSED }
+
+func (m *PausedResp) Size() int { return 8 }
+
+func (m *PausedResp) Append(b []byte) []byte {
+	b = append(b, RESP_PAUSED)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	b = binary.BigEndian.AppendUint32(b, m.Total)
+	return b
+}
+
+func (m *PausedResp) decodeFields(d *decoder) {
+	m.Received = d.uint32("received")
+	m.Total = d.uint32("total")
+}
+
+// ResumedResp is the RESUMED response: upload resumed.
+//
+//	received(4) | total(4) | missing_count(4) | missing(4 each)
+type ResumedResp struct {
+	Received uint32
+	Total    uint32
+	Missing  []uint32 // Chunk indexes not received yet
+}
+
+func (m *ResumedResp) Code() byte { return RESP_RESUMED }
+
+func (m *ResumedResp) Size() int { return 12 + 4*len(m.Missing) }
+
+func (m *ResumedResp) Append(b []byte) []byte {
+	b = append(b, RESP_RESUMED)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	b = binary.BigEndian.AppendUint32(b, m.Total)
+	b = appendUint32List(b, m.Missing)
+	return b
+}
+
+func (m *ResumedResp) decodeFields(d *decoder) {
+	m.Received = d.uint32("received")
+	m.Total = d.uint32("total")
+	m.Missing = d.uint32list("missing", m.Total)
+}
+
+// CancelledResp is the CANCELLED response: upload cancelled.
+type CancelledResp struct {
+}
+
+func (m *CancelledResp) Code() byte { return RESP_CANCELLED }
+
+func (m *CancelledResp) Size() int { return 0 }
+
+func (m *CancelledResp) Append(b []byte) []byte {
+	b = append(b, RESP_CANCELLED)
+	return b
+}
+
+func (m *CancelledResp) decodeFields(d *decoder) {}
+
+// AuthFailedResp is the AUTH_FAILED response: authentication failed.
+type AuthFailedResp struct {
+}
+
+func (m *AuthFailedResp) Code() byte { return RESP_AUTH_FAILED }
+
+func (m *AuthFailedResp) Size() int { return 0 }
+
+func (m *AuthFailedResp) Append(b []byte) []byte {
+	b = append(b, RESP_AUTH_FAILED)
+	return b
+}
+
+func (m *AuthFailedResp) decodeFields(d *decoder) {}
+
+// DuplicateResp is the DUPLICATE response: duplicate chunk (already received).
+//
+//	chunk_index(4) | received(4)
+type DuplicateResp struct {
+	ChunkIndex uint32
+	Received   uint32
+}
+
+func (m *DuplicateResp) Code() byte { return RESP_DUPLICATE }
+
+func (m *DuplicateResp) Size() int { return 8 }
+
+func (m *DuplicateResp) Append(b []byte) []byte {
+	b = append(b, RESP_DUPLICATE)
+	b = binary.BigEndian.AppendUint32(b, m.ChunkIndex)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	return b
+}
+
+func (m *DuplicateResp) decodeFields(d *decoder) {
+	m.ChunkIndex = d.uint32("chunk_index")
+	m.Received = d.uint32("received")
+}
+
+// HashMismatchResp is the HASH_MISMATCH response: assembled file does not match the declared SHA-256; the session has failed.
+//
+//	declared_size(1) | declared | sha256_size(1) | sha256
+type HashMismatchResp struct {
+	Declared string
+	SHA256   string // Hex SHA-256 of the assembled file
+}
+
+func (m *HashMismatchResp) Code() byte { return RESP_HASH_MISMATCH }
+
+func (m *HashMismatchResp) Size() int {
+	return 2 + min(len(m.Declared), 0xFF) + min(len(m.SHA256), 0xFF)
+}
+
+func (m *HashMismatchResp) Append(b []byte) []byte {
+	b = append(b, RESP_HASH_MISMATCH)
+	b = appendString8(b, m.Declared)
+	b = appendString8(b, m.SHA256)
+	return b
+}
+
+func (m *HashMismatchResp) decodeFields(d *decoder) {
+	m.Declared = d.string8("declared")
+	m.SHA256 = d.string8("sha256")
+}
+
+// RateLimitedResp is the RATE_LIMITED response: refused by a rate limit; send the command again after the wait.
+//
+//	retry_after_ms(4)
+type RateLimitedResp struct {
+	RetryAfterMS uint32
+}
+
+func (m *RateLimitedResp) Code() byte { return RESP_RATE_LIMITED }
+
+func (m *RateLimitedResp) Size() int { return 4 }
+
+func (m *RateLimitedResp) Append(b []byte) []byte {
+	b = append(b, RESP_RATE_LIMITED)
+	b = binary.BigEndian.AppendUint32(b, m.RetryAfterMS)
+	return b
+}
+
+func (m *RateLimitedResp) decodeFields(d *decoder) {
+	m.RetryAfterMS = d.uint32("retry_after_ms")
+}
+
+// ReadyCompressedResp is the READY_COMPRESSED response: session ready, with chunks compressed; sent instead of READY to clients that offered compression.
+//
+//	session_id_size(2) | session_id | s3_key_size(2) | s3_key | compression(1)
+type ReadyCompressedResp struct {
+	SessionID   string
+	S3Key       string
+	Compression uint8 // The one COMPRESSION_* chunks must use, 0 for none
+}
+
+func (m *ReadyCompressedResp) Code() byte { return RESP_READY_COMPRESSED }
+
+func (m *ReadyCompressedResp) Size() int {
+	return 5 + min(len(m.SessionID), 0xFFFF) + min(len(m.S3Key), 0xFFFF)
+}
+
+func (m *ReadyCompressedResp) Append(b []byte) []byte {
+	b = append(b, RESP_READY_COMPRESSED)
+	b = appendString16(b, m.SessionID)
+	b = appendString16(b, m.S3Key)
+	b = append(b, m.Compression)
+	return b
+}
+
+func (m *ReadyCompressedResp) decodeFields(d *decoder) {
+	m.SessionID = d.string16("session_id")
+	m.S3Key = d.string16("s3_key")
+	m.Compression = d.uint8("compression")
+}
+
+// ResumedCompressedResp is the RESUMED_COMPRESSED response: upload resumed, with chunks compressed; sent instead of RESUMED to clients that offered compression.
+//
+//	received(4) | total(4) | missing_count(4) | missing(4 each) | compression(1)
+type ResumedCompressedResp struct {
+	Received    uint32
+	Total       uint32
+	Missing     []uint32 // Chunk indexes not received yet
+	Compression uint8    // The one COMPRESSION_* chunks must use, 0 for none
+}
+
+func (m *ResumedCompressedResp) Code() byte { return RESP_RESUMED_COMPRESSED }
+
+func (m *ResumedCompressedResp) Size() int { return 13 + 4*len(m.Missing) }
+
+func (m *ResumedCompressedResp) Append(b []byte) []byte {
+	b = append(b, RESP_RESUMED_COMPRESSED)
+	b = binary.BigEndian.AppendUint32(b, m.Received)
+	b = binary.BigEndian.AppendUint32(b, m.Total)
+	b = appendUint32List(b, m.Missing)
+	b = append(b, m.Compression)
+	return b
+}
+
+func (m *ResumedCompressedResp) decodeFields(d *decoder) {
+	m.Received = d.uint32("received")
+	m.Total = d.uint32("total")
+	m.Missing = d.uint32list("missing", m.Total)
+	m.Compression = d.uint8("compression")
+}
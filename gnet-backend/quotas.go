@@ -0,0 +1,210 @@
+// quotas.go - Per-user storage quotas set by an admin
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ============================================
+// User Quotas
+// ============================================
+
+// USER_QUOTA_BYTES (usage.go) is the same for every user. An admin can give
+// a user a quota of their own, higher or lower, which replaces it; 0 leaves
+// that user without one. Quotas are kept in USER_QUOTAS_FILE, a JSON object
+// of user ID to bytes, so they survive restarts. They are checked where
+// USER_QUOTA_BYTES is: at the init of an upload on either protocol, and when
+// a file is copied, transferred or rolled back to a user.
+//
+//	GET    /quota                       the caller's storage and quota
+//	GET    /admin/quotas                every user quota
+//	PUT    /admin/quotas/{user_id...}   {"quota_bytes": N}
+//	DELETE /admin/quotas/{user_id...}   back to USER_QUOTA_BYTES
+
+var USER_QUOTAS_FILE = envString("USER_QUOTAS_FILE", "/data/quotas.json")
+
+type UserQuota struct {
+	UserID     string `json:"user_id"`
+	QuotaBytes uint64 `json:"quota_bytes"`
+}
+
+type SetQuotaRequest struct {
+	QuotaBytes *uint64 `json:"quota_bytes"`
+}
+
+type UserQuotas struct {
+	path   string
+	quotas map[string]uint64 // user_id -> bytes
+	mu     sync.Mutex
+}
+
+func NewUserQuotas(path string) (*UserQuotas, error) {
+	uq := &UserQuotas{path: path, quotas: make(map[string]uint64)}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read quotas file: %w", err)
+	default:
+		if err := json.Unmarshal(data, &uq.quotas); err != nil {
+			return nil, fmt.Errorf("failed to parse quotas file: %w", err)
+		}
+	}
+	return uq, nil
+}
+
+// Get returns userID's own quota, if an admin set one.
+func (uq *UserQuotas) Get(userID string) (uint64, bool) {
+	uq.mu.Lock()
+	defer uq.mu.Unlock()
+	quota, ok := uq.quotas[userID]
+	return quota, ok
+}
+
+func (uq *UserQuotas) List() []UserQuota {
+	uq.mu.Lock()
+	defer uq.mu.Unlock()
+	quotas := make([]UserQuota, 0, len(uq.quotas))
+	for userID, quota := range uq.quotas {
+		quotas = append(quotas, UserQuota{UserID: userID, QuotaBytes: quota})
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].UserID < quotas[j].UserID })
+	return quotas
+}
+
+// Set gives userID a quota of their own. The change is kept only if it could
+// be written to disk.
+func (uq *UserQuotas) Set(userID string, quota uint64) error {
+	uq.mu.Lock()
+	defer uq.mu.Unlock()
+	previous, had := uq.quotas[userID]
+	uq.quotas[userID] = quota
+	if err := uq.save(); err != nil {
+		if had {
+			uq.quotas[userID] = previous
+		} else {
+			delete(uq.quotas, userID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete puts userID back under USER_QUOTA_BYTES, reporting whether they had
+// a quota of their own.
+func (uq *UserQuotas) Delete(userID string) (bool, error) {
+	uq.mu.Lock()
+	defer uq.mu.Unlock()
+	previous, had := uq.quotas[userID]
+	if !had {
+		return false, nil
+	}
+	delete(uq.quotas, userID)
+	if err := uq.save(); err != nil {
+		uq.quotas[userID] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the quotas; the caller holds mu.
+func (uq *UserQuotas) save() error {
+	data, err := json.Marshal(uq.quotas)
+	if err != nil {
+		return err
+	}
+	tmp := uq.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uq.path)
+}
+
+// userQuota is the quota of userID's own uploads, 0 for none.
+func (fus *FileUploadServer) userQuota(userID string) uint64 {
+	if quota, ok := fus.quotas.Get(userID); ok {
+		return quota
+	}
+	return USER_QUOTA_BYTES
+}
+
+// ============================================
+// Quota API
+// ============================================
+
+func (hs *HTTPServer) registerQuotaRoutes() {
+	hs.mux.HandleFunc("GET /quota", hs.handleGetQuota)
+	hs.mux.Handle("GET /admin/quotas", requireAdmin(http.HandlerFunc(hs.handleListQuotas)))
+	hs.mux.Handle("PUT /admin/quotas/{userID...}", requireAdmin(http.HandlerFunc(hs.handleSetQuota)))
+	hs.mux.Handle("DELETE /admin/quotas/{userID...}", requireAdmin(http.HandlerFunc(hs.handleDeleteQuota)))
+}
+
+// GET /quota
+// The tenant's quota counts if it leaves the user less room than their own.
+func (hs *HTTPServer) handleGetQuota(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+	hs.setStorageHeaders(w, tokenInfo.UserID)
+	writeJSON(w, http.StatusOK, hs.uploads.storageStatus(tokenInfo.UserID))
+}
+
+// GET /admin/quotas
+func (hs *HTTPServer) handleListQuotas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"default_quota_bytes": USER_QUOTA_BYTES,
+		"quotas":              hs.uploads.quotas.List(),
+	})
+}
+
+// PUT /admin/quotas/{userID...}
+// Lowering a quota below what the user stores refuses their new uploads; it
+// deletes nothing.
+func (hs *HTTPServer) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	var req SetQuotaRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.QuotaBytes == nil {
+		writeJSONError(w, http.StatusBadRequest, "quota_bytes is required")
+		return
+	}
+
+	userID := r.PathValue("userID")
+	if err := hs.uploads.quotas.Set(userID, *req.QuotaBytes); err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to save quotas", "path", USER_QUOTAS_FILE, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save quota")
+		return
+	}
+	auditLog.Record(AUDIT_QUOTA_SET, userID, "", r.RemoteAddr, fmt.Sprint(*req.QuotaBytes))
+	httpLog.InfoContext(r.Context(), "set user quota", "user_id", userID, "quota_bytes", *req.QuotaBytes)
+	writeJSON(w, http.StatusOK, UserQuota{UserID: userID, QuotaBytes: *req.QuotaBytes})
+}
+
+// DELETE /admin/quotas/{userID...}
+func (hs *HTTPServer) handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userID")
+	deleted, err := hs.uploads.quotas.Delete(userID)
+	if err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to save quotas", "path", USER_QUOTAS_FILE, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save quota")
+		return
+	}
+	if !deleted {
+		writeJSONError(w, http.StatusNotFound, "User has no quota of their own")
+		return
+	}
+	auditLog.Record(AUDIT_QUOTA_SET, userID, "", r.RemoteAddr, "default")
+	httpLog.InfoContext(r.Context(), "removed user quota", "user_id", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+// ratelimit.go - Per-user and per-IP limits on inits, chunks and bytes
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"backend/protocol"
+)
+
+// ============================================
+// Rate Limits
+// ============================================
+
+// Quotas bound what a user stores, not how fast they send it: one client in
+// a loop can open sessions or push chunks as fast as the workers take them,
+// at everyone else's expense. Each limit is a token bucket, refilled at the
+// configured rate and holding up to one second's worth (one minute's for
+// inits), kept per user and, separately, per client IP:
+//
+//	RATE_LIMIT_INITS_PER_MINUTE      RATE_LIMIT_IP_INITS_PER_MINUTE
+//	RATE_LIMIT_CHUNKS_PER_SECOND     RATE_LIMIT_IP_CHUNKS_PER_SECOND
+//	RATE_LIMIT_BYTES_PER_SECOND      RATE_LIMIT_IP_BYTES_PER_SECOND
+//
+// 0, the default, leaves a limit off. Inits are INIT_UPLOAD and
+// INIT_UPLOAD_VERIFIED, POST /upload/init and a drop's init; chunks are
+// UPLOAD_CHUNK, POST /upload/chunk and a drop's chunk. A chunk larger than a
+// second's worth of bytes waits for a full bucket and empties it. A request
+// is charged to every bucket or to none, and one that would overdraw any is
+// refused: RESP_RATE_LIMITED on the binary port, 429 on the HTTP API, both
+// with the wait until it would pass (retry_after_ms, and Retry-After in
+// seconds). A refused chunk is not stored and is sent again like a busy one.
+// On the binary port a chunk is checked as soon as its frame head arrives,
+// and one that would overdraw is held back instead, like a chunk waiting for
+// memory (chunkpool.go), until it would pass; it is only refused if its
+// connection buffers MAX_CONN_BUFFER meanwhile.
+//
+// The client IP is the peer address, so behind the gateway the IP limits
+// count every client of the gateway together. The HTTP gateway adds the
+// client's address to X-Forwarded-For; RATE_LIMIT_TRUST_FORWARDED=1 uses the
+// last one there instead, and is only safe when nothing else can reach the
+// HTTP port.
+
+const (
+	RATE_INIT  = "init"
+	RATE_CHUNK = "chunk"
+	RATE_BYTES = "bytes"
+
+	RATE_SCOPE_USER = "user"
+	RATE_SCOPE_IP   = "ip"
+
+	RATE_LIMIT_IDLE = 10 * time.Minute // A bucket unused this long is dropped
+)
+
+var RATE_LIMIT_TRUST_FORWARDED = envBool("RATE_LIMIT_TRUST_FORWARDED", false)
+
+type rateLimit struct {
+	kind  string
+	scope string
+	rate  rate.Limit
+	burst int
+}
+
+func rateLimitsFromEnv() []rateLimit {
+	var limits []rateLimit
+	add := func(kind, scope string, perSecond float64, burst int) {
+		if perSecond > 0 {
+			limits = append(limits, rateLimit{kind: kind, scope: scope, rate: rate.Limit(perSecond), burst: max(burst, 1)})
+		}
+	}
+	for _, scope := range []struct{ name, env string }{{RATE_SCOPE_USER, "RATE_LIMIT_"}, {RATE_SCOPE_IP, "RATE_LIMIT_IP_"}} {
+		inits := envInt(scope.env+"INITS_PER_MINUTE", 0)
+		chunks := envInt(scope.env+"CHUNKS_PER_SECOND", 0)
+		bytes := envInt(scope.env+"BYTES_PER_SECOND", 0)
+		add(RATE_INIT, scope.name, float64(inits)/60, inits)
+		add(RATE_CHUNK, scope.name, float64(chunks), chunks)
+		add(RATE_BYTES, scope.name, float64(bytes), bytes)
+	}
+	return limits
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+type RateLimiter struct {
+	limits  []rateLimit
+	buckets map[string]*rateBucket // scope:kind:key
+	mu      sync.Mutex
+}
+
+func NewRateLimiter(limits []rateLimit) *RateLimiter {
+	rl := &RateLimiter{limits: limits, buckets: make(map[string]*rateBucket)}
+	if len(limits) > 0 {
+		go rl.sweepLoop()
+	}
+	return rl
+}
+
+// Allow charges one request (RATE_INIT or RATE_CHUNK), and a chunk's bytes,
+// to the buckets of userID and ip, either of which may be empty. If any
+// bucket is short nothing is charged and Allow returns how long until it
+// would pass.
+func (rl *RateLimiter) Allow(request, userID, ip string, bytes int) (time.Duration, bool) {
+	if len(rl.limits) == 0 {
+		return 0, true
+	}
+	now := time.Now()
+	var (
+		reservations []*rate.Reservation
+		wait         time.Duration
+		short        rateLimit
+	)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, limit := range rl.limits {
+		cost := 1
+		switch {
+		case limit.kind == RATE_BYTES && request == RATE_CHUNK:
+			cost = bytes
+		case limit.kind != request:
+			continue
+		}
+		key := userID
+		if limit.scope == RATE_SCOPE_IP {
+			key = ip
+		}
+		if key == "" || cost <= 0 {
+			continue
+		}
+
+		bucketKey := limit.scope + ":" + limit.kind + ":" + key
+		bucket := rl.buckets[bucketKey]
+		if bucket == nil {
+			bucket = &rateBucket{limiter: rate.NewLimiter(limit.rate, limit.burst)}
+			rl.buckets[bucketKey] = bucket
+		}
+		bucket.used = now
+
+		r := bucket.limiter.ReserveN(now, min(cost, limit.burst))
+		reservations = append(reservations, r)
+		if delay := r.DelayFrom(now); delay > wait {
+			wait, short = delay, limit
+		}
+	}
+	if wait == 0 {
+		return 0, true
+	}
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+	rateLimited.WithLabelValues(request, short.kind, short.scope).Inc()
+	return wait, false
+}
+
+func (rl *RateLimiter) sweepLoop() {
+	ticker := time.NewTicker(RATE_LIMIT_IDLE)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.mu.Lock()
+		for key, bucket := range rl.buckets {
+			if time.Since(bucket.used) > RATE_LIMIT_IDLE {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// ============================================
+// Enforcement
+// ============================================
+
+// allowCommand checks a binary command against the rate limits. Chunks are
+// checked by admitChunk before they are received.
+func (fus *FileUploadServer) allowCommand(ctx *ClientContext, userID string, cmd byte) (time.Duration, bool) {
+	if cmd == protocol.CMD_INIT_UPLOAD || cmd == protocol.CMD_INIT_UPLOAD_VERIFIED {
+		return fus.limiter.Allow(RATE_INIT, userID, peerIP(ctx.remoteAddr), 0)
+	}
+	return 0, true
+}
+
+func rateLimitedResponse(wait time.Duration) []byte {
+	return protocol.Encode(&protocol.RateLimitedResp{RetryAfterMS: uint32(min(wait.Milliseconds()+1, 1<<31))})
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":          "Rate limit exceeded, retry later",
+		"retry_after_ms": wait.Milliseconds() + 1,
+		"request_id":     w.Header().Get("X-Request-ID"),
+	})
+}
+
+// allowHTTP checks a request against the rate limits and answers it with
+// 429 if it is refused.
+func (hs *HTTPServer) allowHTTP(w http.ResponseWriter, r *http.Request, request, userID string, bytes int) bool {
+	wait, ok := hs.uploads.limiter.Allow(request, userID, requestIP(r), bytes)
+	if !ok {
+		writeRateLimited(w, wait)
+	}
+	return ok
+}
+
+// requestIP is the address r came from, as RATE_LIMIT_TRUST_FORWARDED says.
+func requestIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); RATE_LIMIT_TRUST_FORWARDED && forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return peerIP(r.RemoteAddr)
+}
+
+// peerIP drops the port of a host:port address.
+func peerIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
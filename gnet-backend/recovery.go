@@ -0,0 +1,404 @@
+// recovery.go - Startup reconciliation of multipart uploads left by a crash
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Crash Recovery
+// ============================================
+
+// Unless sessions are persisted (sessionstore.go), a crash or restart loses
+// the session of every multipart upload still open in the bucket. On startup
+// each one is listed with its parts and classified:
+//
+//   - recovered: its session was restored from the session store; the parts
+//     in S3 are the truth, so chunks whose write to the store was lost are
+//     added and chunks of parts S3 does not have are sent again
+//   - finalized: a recovered session that already had every part, completed
+//     once the server is up (its client may have given up waiting)
+//   - resumable: no session, but recent activity; it is rebuilt from its
+//     parts when the same user starts the same file again with the same
+//     chunk size (adoptOrphan), and left alone otherwise
+//   - aborted:   no part written for SESSION_TIMEOUT, the upload is dead
+//   - in_flight: recent activity on a key this server did not lay out, left
+//     alone (the next restart re-checks it)
+//   - failed:    looked stale but the abort call failed
+//
+// A resumable upload may belong to another instance sharing the bucket; it
+// is only adopted by its own user restarting the same file. The report is
+// logged and served on GET /admin/recovery.
+
+const RECOVERY_TIMEOUT = 5 * time.Minute
+
+type RecoveredUpload struct {
+	Key          string    `json:"key"`
+	UploadID     string    `json:"upload_id"`
+	Initiated    time.Time `json:"initiated"`
+	LastActivity time.Time `json:"last_activity"`
+	Parts        int       `json:"parts"`
+	Bytes        int64     `json:"bytes"`
+	Outcome      string    `json:"outcome"`
+	SessionID    string    `json:"session_id,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type RecoveryReport struct {
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Recovered  int               `json:"recovered"`
+	Finalized  int               `json:"finalized"`
+	Resumable  int               `json:"resumable"`
+	Aborted    int               `json:"aborted"`
+	InFlight   int               `json:"in_flight"`
+	Failed     int               `json:"failed"`
+	BytesLost  int64             `json:"bytes_lost"` // Parts discarded by aborts
+	Uploads    []RecoveredUpload `json:"uploads"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// OrphanedUpload is a multipart upload left without a session, waiting for
+// its client to start the file again.
+type OrphanedUpload struct {
+	Key          string
+	UploadID     string
+	Parts        []types.Part
+	LastActivity time.Time
+}
+
+// reconcileMultipartUploads builds the startup recovery report: restored
+// sessions are brought in line with their parts, recent uploads without a
+// session are kept for adoption and dead ones aborted.
+func reconcileMultipartUploads(ctx context.Context, s3Client *S3Client, sm *SessionManager) *RecoveryReport {
+	ctx, cancel := context.WithTimeout(ctx, RECOVERY_TIMEOUT)
+	defer cancel()
+
+	report := &RecoveryReport{
+		StartedAt: time.Now(),
+		Uploads:   make([]RecoveredUpload, 0),
+	}
+	defer func() { report.FinishedAt = time.Now() }()
+
+	sessions := make(map[string]*UploadSession) // Restored sessions by upload ID
+	for _, session := range sm.Sessions() {
+		if session.UploadID != "" {
+			sessions[session.UploadID] = session
+		}
+	}
+
+	paginator := s3.NewListMultipartUploadsPaginator(s3Client.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3Client.bucket),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			report.Error = err.Error()
+			s3Log.Error("failed to list multipart uploads", "err", err)
+			return report
+		}
+
+		for _, upload := range page.Uploads {
+			key := aws.ToString(upload.Key)
+			if strings.HasPrefix(key, AUDIT_PREFIX+"/") {
+				continue
+			}
+			uploadID := aws.ToString(upload.UploadId)
+			report.Uploads = append(report.Uploads, reconcileUpload(ctx, s3Client, sm, sessions[uploadID], key, uploadID, aws.ToTime(upload.Initiated), report))
+		}
+	}
+
+	return report
+}
+
+func reconcileUpload(ctx context.Context, s3Client *S3Client, sm *SessionManager, session *UploadSession, key, uploadID string, initiated time.Time, report *RecoveryReport) RecoveredUpload {
+	ru := RecoveredUpload{
+		Key:          key,
+		UploadID:     uploadID,
+		Initiated:    initiated,
+		LastActivity: initiated,
+	}
+
+	parts, err := s3Client.listParts(ctx, key, uploadID)
+	if err != nil {
+		// Judge staleness on the initiation time alone
+		s3Log.Warn("failed to list parts", "key", key, "upload_id", uploadID, "err", err)
+	}
+	for _, part := range parts {
+		ru.Parts++
+		ru.Bytes += aws.ToInt64(part.Size)
+		if t := aws.ToTime(part.LastModified); t.After(ru.LastActivity) {
+			ru.LastActivity = t
+		}
+	}
+
+	if session != nil {
+		ru.Outcome = "recovered"
+		ru.SessionID = session.SessionID
+		report.Recovered++
+		if err == nil && !session.syncParts(parts) {
+			ru.Error = "parts do not fit the session's chunks"
+			s3Log.Warn("restored session does not match its parts", "session_id", session.SessionID, "upload_id", uploadID)
+		}
+		return ru
+	}
+
+	if time.Since(ru.LastActivity) < SESSION_TIMEOUT {
+		if err == nil && sm.addOrphan(&OrphanedUpload{Key: key, UploadID: uploadID, Parts: parts, LastActivity: ru.LastActivity}) {
+			ru.Outcome = "resumable"
+			report.Resumable++
+		} else {
+			ru.Outcome = "in_flight"
+			report.InFlight++
+		}
+		return ru
+	}
+
+	_, err = s3Client.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3Client.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		ru.Outcome = "failed"
+		ru.Error = err.Error()
+		report.Failed++
+		return ru
+	}
+
+	ru.Outcome = "aborted"
+	report.Aborted++
+	report.BytesLost += ru.Bytes
+	auditLog.Record(AUDIT_SESSION_EXPIRED, strings.SplitN(key, "/", 2)[0], "", "", "aborted on startup: "+key)
+	return ru
+}
+
+// listParts returns every part of a multipart upload.
+func (s3c *S3Client) listParts(ctx context.Context, key, uploadID string) ([]types.Part, error) {
+	var parts []types.Part
+	paginator := s3.NewListPartsPaginator(s3c.client, &s3.ListPartsInput{
+		Bucket:   aws.String(s3c.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return parts, err
+		}
+		parts = append(parts, page.Parts...)
+	}
+	return parts, nil
+}
+
+// syncParts makes the session's chunks those of the parts S3 holds. Chunks
+// rebuilt from a part have no hash; the client's copy of one is taken as a
+// duplicate (AddChunk). Returns false, changing nothing, when the parts do
+// not fit the session's chunk size.
+func (us *UploadSession) syncParts(parts []types.Part) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	chunks := make(map[uint32]*ChunkInfo)
+	etags := make(map[int32]string)
+	var bytes uint64
+	for _, part := range parts {
+		number, size := aws.ToInt32(part.PartNumber), uint64(aws.ToInt64(part.Size))
+		if number < 1 || uint32(number) > us.PartCount() {
+			return false
+		}
+		// Every part is whole but the last, whose last chunk may be short
+		n := us.partChunks(number)
+		full := uint64(n) * uint64(us.ChunkSize)
+		if size > full || (size != full && uint32(number) != us.PartCount()) || size <= full-uint64(us.ChunkSize) {
+			return false
+		}
+
+		first := uint32(number-1) * us.ChunksPerPart
+		for i := uint32(0); i < n; i++ {
+			chunk := &ChunkInfo{
+				Index:      first + i,
+				Size:       us.ChunkSize,
+				UploadedAt: aws.ToTime(part.LastModified),
+				PartNumber: number,
+				ETag:       aws.ToString(part.ETag),
+			}
+			if i == n-1 {
+				chunk.Size = uint32(size - uint64(n-1)*uint64(us.ChunkSize))
+			}
+			if existing, ok := us.ReceivedChunks[chunk.Index]; ok {
+				chunk.Hash = existing.Hash
+			}
+			chunks[chunk.Index] = chunk
+			bytes += uint64(chunk.Size)
+		}
+		etags[number] = aws.ToString(part.ETag)
+	}
+
+	us.ReceivedChunks = chunks
+	us.BytesReceived = bytes
+	us.rebuildParts(etags)
+	if len(chunks) > 0 && us.State == STATE_INITIALIZED {
+		us.setState(STATE_UPLOADING)
+	}
+	indexes := make([]uint32, 0, len(chunks))
+	for index := range chunks {
+		indexes = append(indexes, index)
+	}
+	us.save(indexes...)
+	return true
+}
+
+// orphanKey groups uploads of one file by one user: the S3 key
+// folder/timestamp/filename without its timestamp.
+func orphanKey(s3Key string) (string, bool) {
+	dir, fileName := path.Split(s3Key)
+	folder, stamp := path.Split(strings.TrimSuffix(dir, "/"))
+	if folder == "" || fileName == "" {
+		return "", false
+	}
+	if _, err := time.Parse("20060102_150405", stamp); err != nil {
+		return "", false
+	}
+	return folder + fileName, true
+}
+
+// addOrphan keeps an upload for adoption, reporting false for a key this
+// server did not lay out.
+func (sm *SessionManager) addOrphan(orphan *OrphanedUpload) bool {
+	key, ok := orphanKey(orphan.Key)
+	if !ok {
+		return false
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.orphans[key] = append(sm.orphans[key], orphan)
+	return true
+}
+
+// adoptOrphan continues in session, just created, the most recent orphaned
+// upload of the same file whose parts fit its chunks. Reports whether it did.
+func (sm *SessionManager) adoptOrphan(session *UploadSession) bool {
+	key, ok := orphanKey(session.S3Key)
+	if !ok {
+		return false
+	}
+	sm.mu.Lock()
+	orphans := sm.orphans[key]
+	delete(sm.orphans, key)
+	sm.mu.Unlock()
+	if len(orphans) == 0 {
+		return false
+	}
+
+	slices.SortFunc(orphans, func(a, b *OrphanedUpload) int { return b.LastActivity.Compare(a.LastActivity) })
+	adopted := -1
+	for i, orphan := range orphans {
+		if time.Since(orphan.LastActivity) < SESSION_TIMEOUT && session.syncParts(orphan.Parts) {
+			adopted = i
+			break
+		}
+	}
+	if adopted < 0 {
+		sm.mu.Lock()
+		sm.orphans[key] = append(sm.orphans[key], orphans...)
+		sm.mu.Unlock()
+		return false
+	}
+
+	orphan := orphans[adopted]
+	session.mu.Lock()
+	session.S3Key = orphan.Key
+	session.UploadID = orphan.UploadID
+	session.UpdatedAt = time.Now()
+	session.save()
+	received := len(session.ReceivedChunks)
+	session.mu.Unlock()
+
+	if rest := slices.Delete(orphans, adopted, adopted+1); len(rest) > 0 {
+		sm.mu.Lock()
+		sm.orphans[key] = append(sm.orphans[key], rest...)
+		sm.mu.Unlock()
+	}
+	sessionLog.Info("resumed orphaned upload", "session_id", session.SessionID, "s3_key", orphan.Key,
+		"upload_id", orphan.UploadID, "received", received, "total", session.TotalChunks)
+	return true
+}
+
+// pruneOrphans forgets orphaned uploads idle for SESSION_TIMEOUT; the next
+// restart aborts them. Caller holds sm.mu.
+func (sm *SessionManager) pruneOrphans(now time.Time) {
+	for key, orphans := range sm.orphans {
+		orphans = slices.DeleteFunc(orphans, func(o *OrphanedUpload) bool { return now.Sub(o.LastActivity) > SESSION_TIMEOUT })
+		if len(orphans) == 0 {
+			delete(sm.orphans, key)
+		} else {
+			sm.orphans[key] = orphans
+		}
+	}
+}
+
+// finalizeRecovered completes the recovered sessions that already had every
+// part when the server stopped.
+func (fus *FileUploadServer) finalizeRecovered(ctx context.Context, report *RecoveryReport) {
+	for i := range report.Uploads {
+		ru := &report.Uploads[i]
+		if ru.Outcome != "recovered" {
+			continue
+		}
+		session := fus.sessionMgr.GetSession(ru.SessionID)
+		if session == nil || !session.IsComplete() {
+			continue
+		}
+		switch session.GetState() {
+		case STATE_COMPLETED, STATE_CANCELLED, STATE_FAILED, STATE_PAUSED:
+			continue
+		}
+		if err := fus.completeUpload(ctx, session); err != nil {
+			ru.Error = err.Error()
+			continue
+		}
+		ru.Outcome = "finalized"
+		report.Recovered--
+		report.Finalized++
+	}
+}
+
+func (r *RecoveryReport) log() {
+	level := slog.LevelInfo
+	if r.Failed > 0 || r.Error != "" {
+		level = slog.LevelWarn
+	}
+	s3Log.Log(context.Background(), level, "startup recovery report",
+		"recovered", r.Recovered,
+		"finalized", r.Finalized,
+		"resumable", r.Resumable,
+		"aborted", r.Aborted,
+		"in_flight", r.InFlight,
+		"failed", r.Failed,
+		"bytes_lost", r.BytesLost,
+		"duration", r.FinishedAt.Sub(r.StartedAt))
+
+	for _, upload := range r.Uploads {
+		s3Log.Info("recovery outcome", "key", upload.Key, "upload_id", upload.UploadID, "outcome", upload.Outcome,
+			"parts", upload.Parts, "bytes", upload.Bytes, "last_activity", upload.LastActivity, "err", upload.Error)
+	}
+}
+
+// GET /admin/recovery
+func (hs *HTTPServer) handleRecoveryReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hs.recovery)
+}
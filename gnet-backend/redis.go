@@ -0,0 +1,336 @@
+// redis.go - Minimal Redis client
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Redis Client
+// ============================================
+
+// The server needs a handful of Redis commands, not a client library: this
+// speaks RESP2 over a small pool of connections, as the Kafka publisher
+// (events.go) speaks the REST proxy's HTTP. URLs are the usual
+//
+//	redis://[:password@]host:port[/db]   (rediss:// for TLS)
+//
+// Commands are strings in and replies out: nil, string, int64, []interface{}
+// or an error for a Redis error reply (redisError).
+
+const (
+	REDIS_POOL_SIZE = 8
+	REDIS_TIMEOUT   = 5 * time.Second // Per command when the context has no deadline
+)
+
+// redisError is an error reply, as opposed to a failed connection.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	tls      *tls.Config
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func NewRedisClient(rawURL string) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	rc := &RedisClient{addr: u.Host, idle: make(chan *redisConn, REDIS_POOL_SIZE)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		rc.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid Redis URL scheme %q (want redis or rediss)", u.Scheme)
+	}
+	if u.Port() == "" {
+		rc.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		rc.password = password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if rc.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return rc, nil
+}
+
+func (rc *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: REDIS_TIMEOUT}
+	var conn net.Conn
+	var err error
+	if rc.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: rc.tls}).DialContext(ctx, "tcp", rc.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", rc.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if rc.password != "" {
+		if _, err := c.do(ctx, "AUTH", rc.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rc.db != 0 {
+		if _, err := c.do(ctx, "SELECT", strconv.Itoa(rc.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do runs one command on a pooled connection.
+func (rc *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-rc.idle:
+	default:
+		var err error
+		if c, err = rc.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state
+		c.Close()
+		return nil, err
+	}
+	select {
+	case rc.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (rc *RedisClient) Close() error {
+	for {
+		select {
+		case c := <-rc.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(REDIS_TIMEOUT)
+	}
+	c.SetDeadline(deadline)
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// Strings runs a command that replies with an array of strings.
+func (rc *RedisClient) Strings(ctx context.Context, args ...string) ([]string, error) {
+	reply, err := rc.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: %s replied %T, not an array", args[0], reply)
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i], _ = item.(string)
+	}
+	return strs, nil
+}
+
+// redisPipeline sends several commands in one round trip.
+type redisPipeline struct {
+	rc   *RedisClient
+	cmds [][]string
+	mu   sync.Mutex
+}
+
+func (rc *RedisClient) Pipeline() *redisPipeline {
+	return &redisPipeline{rc: rc}
+}
+
+func (p *redisPipeline) Add(args ...string) {
+	p.mu.Lock()
+	p.cmds = append(p.cmds, args)
+	p.mu.Unlock()
+}
+
+// Exec runs the commands in a MULTI/EXEC transaction, so they apply all
+// together or not at all.
+func (p *redisPipeline) Exec(ctx context.Context) error {
+	p.mu.Lock()
+	cmds := p.cmds
+	p.cmds = nil
+	p.mu.Unlock()
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	var c *redisConn
+	select {
+	case c = <-p.rc.idle:
+	default:
+		var err error
+		if c, err = p.rc.dial(ctx); err != nil {
+			return err
+		}
+	}
+	err := c.exec(ctx, cmds)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.Close()
+		return err
+	}
+	select {
+	case p.rc.idle <- c:
+	default:
+		c.Close()
+	}
+	return err
+}
+
+func (c *redisConn) exec(ctx context.Context, cmds [][]string) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(REDIS_TIMEOUT)
+	}
+	c.SetDeadline(deadline)
+
+	write := func(args []string) {
+		fmt.Fprintf(c.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	write([]string{"MULTI"})
+	for _, args := range cmds {
+		write(args)
+	}
+	write([]string{"EXEC"})
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	// +OK, then +QUEUED (or an error) per command, then the EXEC array
+	var first error
+	for i := 0; i < len(cmds)+1; i++ {
+		if _, err := c.read(); err != nil {
+			var replyErr redisError
+			if !errors.As(err, &replyErr) {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	reply, err := c.read()
+	if err != nil {
+		return err
+	}
+	if first != nil {
+		return first // EXEC answered EXECABORT
+	}
+	items, _ := reply.([]interface{})
+	for _, item := range items {
+		if err, ok := item.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+// retention.go - Expiring old files by per-tenant rules
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Retention
+// ============================================
+
+// Deployments that take temporary uploads (a file shared for a week, a
+// video waiting to be transcoded) grow without bound unless something
+// removes what nobody needs anymore. Retention rules do, per tenant: each
+// expires the tenant's files completed more than "days" ago, optionally only
+// those tagged "tag" (tags.go).
+//
+//	"retention": [
+//	  {"days": 7, "tag": "tmp", "action": "delete"},
+//	  {"days": 365, "action": "archive"}
+//	]
+//
+// A tenant's rules go in its TENANTS_FILE entry; the default tenant's are
+// RETENTION_RULES, the same JSON list. "delete" deletes the file as DELETE
+// /files does, through the trash (trash.go) if there is one. "archive" moves
+// it to the same key in RETENTION_ARCHIVE_BUCKET, which lifecycle rules can
+// then put in cold storage; it is gone from the user's files and usage.
+// Files under legal hold (legalhold.go) are left alone.
+//
+// Every RETENTION_INTERVAL the worker applies the rules in order, each to
+// at most RETENTION_BATCH files, oldest first (the rest wait for the next
+// run); a file goes with the first rule that expires it. Files are found in
+// the metadata store, so rules need METADATA_DB. With RETENTION_DRY_RUN=1 the
+// worker only reports what it would expire:
+//
+//	GET  /admin/retention       the rules and the last run's report
+//	POST /admin/retention/run   run now and return the report (?dry_run=1: report only)
+
+const (
+	RETENTION_DELETE  = "delete"
+	RETENTION_ARCHIVE = "archive"
+
+	RETENTION_REPORT_KEYS = 20 // Keys listed per rule in a report
+)
+
+var (
+	RETENTION_RULES          = envString("RETENTION_RULES", "") // The default tenant's, as JSON
+	RETENTION_ARCHIVE_BUCKET = envString("RETENTION_ARCHIVE_BUCKET", "")
+	RETENTION_INTERVAL       = time.Duration(envInt("RETENTION_MINUTES", 60)) * time.Minute
+	RETENTION_BATCH          = envInt("RETENTION_BATCH", 1000)
+	RETENTION_DRY_RUN        = envBool("RETENTION_DRY_RUN", false)
+)
+
+type RetentionRule struct {
+	Days   int    `json:"days"`
+	Tag    string `json:"tag,omitempty"` // Empty for every file
+	Action string `json:"action"`        // "delete" if empty
+}
+
+// RetentionPolicy holds the default tenant's rules and the last run's report.
+type RetentionPolicy struct {
+	rules []RetentionRule
+
+	runMu sync.Mutex // Serializes runs
+	mu    sync.Mutex
+	last  *RetentionReport
+}
+
+type RetentionReport struct {
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	DryRun     bool                  `json:"dry_run"`
+	Rules      []RetentionRuleReport `json:"rules"`
+}
+
+// TenantRetentionRule is a rule with the tenant whose files it expires.
+type TenantRetentionRule struct {
+	Tenant string `json:"tenant"` // Empty for the default tenant
+	RetentionRule
+}
+
+type RetentionRuleReport struct {
+	TenantRetentionRule
+	Files     int      `json:"files"` // Expired, or that would be on a dry run
+	Bytes     int64    `json:"bytes"`
+	Failed    int      `json:"failed,omitempty"`
+	Truncated bool     `json:"truncated"` // More than RETENTION_BATCH matched
+	Keys      []string `json:"keys,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// NewRetentionPolicy parses the default tenant's rules.
+func NewRetentionPolicy(rules string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{}
+	if rules == "" {
+		return policy, nil
+	}
+	if err := json.Unmarshal([]byte(rules), &policy.rules); err != nil {
+		return nil, fmt.Errorf("failed to parse RETENTION_RULES: %w", err)
+	}
+	if err := validateRetentionRules(policy.rules); err != nil {
+		return nil, fmt.Errorf("RETENTION_RULES: %w", err)
+	}
+	return policy, nil
+}
+
+// validateRetentionRules checks rules and fills in their default action.
+func validateRetentionRules(rules []RetentionRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Days <= 0 {
+			return fmt.Errorf("retention rule %d: days must be positive", i+1)
+		}
+		if rule.Tag != "" {
+			tags, err := normalizeTags([]string{rule.Tag})
+			if err != nil {
+				return fmt.Errorf("retention rule %d: %w", i+1, err)
+			}
+			rule.Tag = tags[0]
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = RETENTION_DELETE
+		case RETENTION_DELETE:
+		case RETENTION_ARCHIVE:
+			if RETENTION_ARCHIVE_BUCKET == "" || RETENTION_ARCHIVE_BUCKET == S3_BUCKET {
+				return fmt.Errorf("retention rule %d: archiving needs RETENTION_ARCHIVE_BUCKET, other than S3_BUCKET", i+1)
+			}
+		default:
+			return fmt.Errorf("retention rule %d: action must be %q or %q", i+1, RETENTION_DELETE, RETENTION_ARCHIVE)
+		}
+	}
+	return nil
+}
+
+func (hs *HTTPServer) registerRetentionRoutes() {
+	hs.mux.Handle("GET /admin/retention", requireAdmin(http.HandlerFunc(hs.handleRetentionStatus)))
+	hs.mux.Handle("POST /admin/retention/run", requireAdmin(http.HandlerFunc(hs.handleRunRetention)))
+}
+
+// GET /admin/retention
+func (hs *HTTPServer) handleRetentionStatus(w http.ResponseWriter, r *http.Request) {
+	rules := make([]TenantRetentionRule, 0)
+	for _, scoped := range hs.uploads.retentionRules() {
+		rules = append(rules, scoped.status())
+	}
+
+	policy := hs.uploads.retention
+	policy.mu.Lock()
+	last := policy.last
+	policy.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dry_run":  RETENTION_DRY_RUN,
+		"interval": RETENTION_INTERVAL.String(),
+		"rules":    rules,
+		"last_run": last,
+	})
+}
+
+// POST /admin/retention/run
+func (hs *HTTPServer) handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	// A run stopped halfway is safe, but the report would be cut short
+	report := hs.uploads.applyRetention(context.WithoutCancel(r.Context()), dryRun || RETENTION_DRY_RUN)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// ============================================
+// Worker
+// ============================================
+
+// scopedRule is a rule with the tenant it applies to, nil for the default
+// tenant.
+type scopedRule struct {
+	tenant *Tenant
+	rule   RetentionRule
+}
+
+func (sr scopedRule) status() TenantRetentionRule {
+	status := TenantRetentionRule{RetentionRule: sr.rule}
+	if sr.tenant != nil {
+		status.Tenant = sr.tenant.ID
+	}
+	return status
+}
+
+// retentionRules lists every tenant's rules, the default tenant's first.
+func (fus *FileUploadServer) retentionRules() []scopedRule {
+	var rules []scopedRule
+	for _, rule := range fus.retention.rules {
+		rules = append(rules, scopedRule{rule: rule})
+	}
+	ids := make([]string, 0, len(fus.tenants))
+	for id := range fus.tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, rule := range fus.tenants[id].Retention {
+			rules = append(rules, scopedRule{tenant: fus.tenants[id], rule: rule})
+		}
+	}
+	return rules
+}
+
+// RunRetention applies the retention rules every RETENTION_INTERVAL.
+func (fus *FileUploadServer) RunRetention() {
+	if len(fus.retentionRules()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(RETENTION_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fus.applyRetention(context.Background(), RETENTION_DRY_RUN)
+	}
+}
+
+// applyRetention expires the files matched by each rule, or on a dry run
+// only counts them, and keeps the report as the last run's.
+func (fus *FileUploadServer) applyRetention(ctx context.Context, dryRun bool) *RetentionReport {
+	fus.retention.runMu.Lock()
+	defer fus.retention.runMu.Unlock()
+
+	report := &RetentionReport{StartedAt: time.Now().UTC(), DryRun: dryRun, Rules: make([]RetentionRuleReport, 0)}
+	seen := make(map[string]bool) // A file matched by an earlier rule is that rule's
+	for _, scoped := range fus.retentionRules() {
+		result := fus.applyRetentionRule(ctx, scoped, dryRun, seen)
+		report.Rules = append(report.Rules, result)
+		if result.Error != "" {
+			serverLog.WarnContext(ctx, "retention rule failed", "tenant", result.Tenant, "days", result.Days, "tag", result.Tag, "err", result.Error)
+		}
+		if result.Files > 0 || result.Failed > 0 {
+			serverLog.InfoContext(ctx, "retention rule applied", "tenant", result.Tenant, "days", result.Days, "tag", result.Tag,
+				"action", result.Action, "dry_run", dryRun, "files", result.Files, "bytes", result.Bytes, "failed", result.Failed)
+		}
+	}
+	report.FinishedAt = time.Now().UTC()
+
+	fus.retention.mu.Lock()
+	fus.retention.last = report
+	fus.retention.mu.Unlock()
+	return report
+}
+
+func (fus *FileUploadServer) applyRetentionRule(ctx context.Context, scoped scopedRule, dryRun bool, seen map[string]bool) RetentionRuleReport {
+	result := RetentionRuleReport{TenantRetentionRule: scoped.status()}
+	before := time.Now().UTC().AddDate(0, 0, -scoped.rule.Days)
+
+	// One more than the batch tells whether there is more
+	files, err := fus.metadata.ExpiredFiles(ctx, scoped.tenant, scoped.rule.Tag, before, RETENTION_BATCH+1)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(files) > RETENTION_BATCH {
+		files, result.Truncated = files[:RETENTION_BATCH], true
+	}
+
+	for _, file := range files {
+		if seen[file.Key] {
+			continue
+		}
+		seen[file.Key] = true
+
+		if !dryRun {
+			if err := fus.expireFile(ctx, file.Key, scoped.rule.Action); err != nil {
+				retentionFiles.WithLabelValues(scoped.rule.Action, "error").Inc()
+				serverLog.WarnContext(ctx, "failed to expire file", "key", file.Key, "action", scoped.rule.Action, "err", err)
+				result.Failed++
+				continue
+			}
+			retentionFiles.WithLabelValues(scoped.rule.Action, "ok").Inc()
+			retentionBytes.WithLabelValues(scoped.rule.Action).Add(float64(file.Size))
+			auditLog.Record(AUDIT_FILE_EXPIRED, file.Owner, "", "", file.Key+" "+scoped.rule.Action)
+			event := ACTIVITY_FILE_DELETED
+			if scoped.rule.Action == RETENTION_ARCHIVE {
+				event = ACTIVITY_FILE_ARCHIVED
+			}
+			fus.activity.Record(event, file.Key, "retention", fmt.Sprintf("Older than %d days", scoped.rule.Days))
+		}
+		result.Files++
+		result.Bytes += file.Size
+		if len(result.Keys) < RETENTION_REPORT_KEYS {
+			result.Keys = append(result.Keys, file.Key)
+		}
+	}
+	return result
+}
+
+// expireFile deletes or archives key. A file already gone is not an error.
+func (fus *FileUploadServer) expireFile(ctx context.Context, key, action string) error {
+	if action == RETENTION_DELETE {
+		_, err := fus.deleteFile(ctx, key)
+		if isNotFound(err) {
+			return fus.metadata.DeleteFile(ctx, key)
+		}
+		return err
+	}
+
+	if err := fus.checkLegalHold(ctx, key); err != nil {
+		return err
+	}
+	if err := fus.checkImmutable(ctx, key); err != nil {
+		return err
+	}
+	size, err := fus.s3Client.copyObjectTo(ctx, key, RETENTION_ARCHIVE_BUCKET, key)
+	if isNotFound(err) {
+		return fus.metadata.DeleteFile(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := fus.s3Client.deleteObject(ctx, key); err != nil {
+		return err
+	}
+	fus.usage.RecordDeleted(keyOwner(key), uint64(size))
+	if err := fus.metadata.DeleteFile(ctx, key); err != nil {
+		serverLog.WarnContext(ctx, "failed to delete archived file metadata", "key", key, "err", err)
+	}
+	return nil
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) ExpiredFiles(ctx context.Context, tenant *Tenant, tag string, before time.Time, limit int) ([]FileRecord, error) {
+	// Scoped as FindContent (dedup.go) scopes
+	scope, prefix := `$2 <> substr(owner, 1, $3)`, TENANT_KEY_ROOT
+	if tenant != nil {
+		scope, prefix = `$2 = substr(owner, 1, $3)`, tenant.userPrefix()
+	}
+	args := []interface{}{before, prefix, len(prefix)}
+	if tag != "" {
+		args = append(args, tag)
+		scope += ` AND s3_key IN (SELECT s3_key FROM file_tags WHERE tag = $4)`
+	}
+	args = append(args, limit)
+
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT s3_key, owner, file_name, version, size, checksum, content_type, created_at, completed_at
+		FROM files WHERE completed_at < $1 AND deleted_at IS NULL AND `+scope+`
+		AND s3_key NOT IN (SELECT s3_key FROM legal_holds)
+		ORDER BY completed_at
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]FileRecord, 0)
+	for rows.Next() {
+		var file FileRecord
+		if err := rows.Scan(&file.Key, &file.Owner, &file.FileName, &file.Version, &file.Size, &file.Checksum, &file.ContentType, &file.CreatedAt, &file.CompletedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,431 @@
+// search.go - Searching files by name and by the text inside them
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ledongthuc/pdf"
+)
+
+// ============================================
+// Content Search
+// ============================================
+
+// GET /files/search?q=... finds the caller's files (not in the trash) that
+// match every word of the query, each either in the file name or in the text
+// of the file:
+//
+//	GET /files/search?q=...[&limit=N]   {"results": [...], "truncated": bool}
+//
+// Each result says where its words were found, "file_name" and/or
+// "content". Files matching more words by name come first, then those with
+// more words in their text, then the newest.
+//
+// The text is extracted after an upload completes (an instant upload or a
+// rollback too) by a small pool of workers, so a file can be found by name
+// straight away and by content a little later. PDFs are read page by page;
+// the soundtrack of a video is sent to SEARCH_TRANSCRIBE_URL, if set, which
+// takes the file as the request body (with its Content-Type) and answers
+// with the transcript as plain text. The words of the text, lower-cased, go
+// in the file_terms table of the metadata store (metadata.go), so search
+// needs METADATA_DB, and content indexing SEARCH_INDEX=1 as well. Files
+// completed while the queue is full are not indexed.
+
+const (
+	SEARCH_QUEUE           = 1000
+	SEARCH_INDEX_TIMEOUT   = 10 * time.Minute // Extracting one file's text
+	SEARCH_MAX_TEXT        = 4 << 20          // Bytes of text read from one file
+	SEARCH_MAX_QUERY_TERMS = 8
+	SEARCH_MAX_CANDIDATES  = 1000 // Newest matches ranked per query
+	SEARCH_MIN_TERM        = 2    // Shorter words are not indexed
+	SEARCH_MAX_TERM        = 64   // Nor are longer ones
+)
+
+var (
+	SEARCH_INDEX_ENABLED  = os.Getenv("SEARCH_INDEX") == "1"
+	SEARCH_WORKERS        = envInt("SEARCH_WORKERS", 2)
+	SEARCH_MAX_TERMS      = envInt("SEARCH_MAX_TERMS", 20000)                     // Distinct words kept per file
+	SEARCH_MAX_PDF_BYTES  = int64(envInt("SEARCH_MAX_PDF_MB", 200)) << 20         // Larger PDFs are not read
+	SEARCH_TRANSCRIBE_URL = envString("SEARCH_TRANSCRIBE_URL", "")                // Empty to not index videos
+	SEARCH_TRANSCRIBE_MAX = int64(envInt("SEARCH_TRANSCRIBE_MAX_MB", 2048)) << 20 // Larger videos are not sent
+)
+
+type SearchResult struct {
+	Key         string    `json:"key"`
+	FileName    string    `json:"file_name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	CompletedAt time.Time `json:"completed_at"`
+	Matched     []string  `json:"matched"`
+
+	nameHits    int // Query words in the file name
+	contentHits int // Query words in the text
+}
+
+type indexJob struct {
+	key         string
+	contentType string
+}
+
+// ContentIndexer extracts the text of completed files in the background and
+// records its words for search.
+type ContentIndexer struct {
+	s3Client *S3Client
+	metadata MetadataStore
+	client   *http.Client
+	jobs     chan indexJob
+}
+
+// NewContentIndexer starts SEARCH_WORKERS indexing workers, or returns nil
+// if content indexing is off; a nil indexer indexes nothing.
+func NewContentIndexer(s3Client *S3Client, metadata MetadataStore) *ContentIndexer {
+	if !SEARCH_INDEX_ENABLED || METADATA_DB == "" {
+		return nil
+	}
+	ci := &ContentIndexer{
+		s3Client: s3Client,
+		metadata: metadata,
+		client:   &http.Client{Timeout: SEARCH_INDEX_TIMEOUT},
+		jobs:     make(chan indexJob, SEARCH_QUEUE),
+	}
+	for i := 0; i < SEARCH_WORKERS; i++ {
+		go ci.worker()
+	}
+	return ci
+}
+
+// Enqueue queues key's file for indexing if its type has text to extract.
+// It never blocks: with the queue full the file is left unindexed.
+func (ci *ContentIndexer) Enqueue(key, contentType string) {
+	if ci == nil || !indexable(contentType) {
+		return
+	}
+	select {
+	case ci.jobs <- indexJob{key: key, contentType: contentType}:
+	default:
+		searchIndexJobs.WithLabelValues("dropped").Inc()
+		serverLog.Warn("search index queue full, file not indexed", "s3_key", key)
+	}
+}
+
+func indexable(contentType string) bool {
+	return contentType == "application/pdf" || (SEARCH_TRANSCRIBE_URL != "" && strings.HasPrefix(contentType, "video/"))
+}
+
+func (ci *ContentIndexer) worker() {
+	for job := range ci.jobs {
+		ci.index(job)
+	}
+}
+
+func (ci *ContentIndexer) index(job indexJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), SEARCH_INDEX_TIMEOUT)
+	defer cancel()
+
+	text, err := ci.extractText(ctx, job)
+	if err != nil {
+		searchIndexJobs.WithLabelValues("error").Inc()
+		serverLog.Warn("failed to extract text for search", "s3_key", job.key, "err", err)
+		return
+	}
+	if text == "" {
+		searchIndexJobs.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	terms := searchTerms(text, SEARCH_MAX_TERMS)
+	if err := ci.metadata.PutTerms(ctx, job.key, terms); err != nil {
+		searchIndexJobs.WithLabelValues("error").Inc()
+		serverLog.Error("failed to record search terms", "s3_key", job.key, "err", err)
+		return
+	}
+	searchIndexJobs.WithLabelValues("ok").Inc()
+	serverLog.Debug("indexed file for search", "s3_key", job.key, "terms", len(terms))
+}
+
+// extractText returns the text of job's file, or "" if it is too large to
+// read.
+func (ci *ContentIndexer) extractText(ctx context.Context, job indexJob) (string, error) {
+	head, err := ci.s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(ci.s3Client.bucket),
+		Key:    aws.String(job.key),
+	})
+	if err != nil {
+		return "", err
+	}
+	size := aws.ToInt64(head.ContentLength)
+
+	if job.contentType == "application/pdf" {
+		if size > SEARCH_MAX_PDF_BYTES {
+			return "", nil
+		}
+		return ci.extractPDF(ctx, job.key)
+	}
+	if size > SEARCH_TRANSCRIBE_MAX {
+		return "", nil
+	}
+	return ci.transcribe(ctx, job)
+}
+
+// extractPDF reads the text of a PDF, which the parser needs random access
+// to, from a temporary copy.
+func (ci *ContentIndexer) extractPDF(ctx context.Context, key string) (text string, err error) {
+	out, err := ci.s3Client.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(ci.s3Client.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	f, err := os.CreateTemp("", "search-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, out.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// The parser panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(f, size)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i := 1; i <= reader.NumPage() && b.Len() < SEARCH_MAX_TEXT; i++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		// A page that cannot be read is skipped, not the whole file
+		pageText, err := page.GetPlainText(nil)
+		if err != nil {
+			continue
+		}
+		b.WriteString(pageText)
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// transcribe sends a video to SEARCH_TRANSCRIBE_URL and returns the
+// transcript of its soundtrack.
+func (ci *ContentIndexer) transcribe(ctx context.Context, job indexJob) (string, error) {
+	out, err := ci.s3Client.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(ci.s3Client.bucket),
+		Key:    aws.String(job.key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, SEARCH_TRANSCRIBE_URL, out.Body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = aws.ToInt64(out.ContentLength)
+	req.Header.Set("Content-Type", job.contentType)
+	resp, err := ci.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcription service answered %s", resp.Status)
+	}
+	transcript, err := io.ReadAll(io.LimitReader(resp.Body, SEARCH_MAX_TEXT))
+	if err != nil {
+		return "", err
+	}
+	return string(transcript), nil
+}
+
+// searchTerms splits text into lower-cased words of letters and digits,
+// returning at most max distinct ones in the order they first appear.
+func searchTerms(text string, max int) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if n := utf8.RuneCountInString(word); n < SEARCH_MIN_TERM || n > SEARCH_MAX_TERM || seen[word] {
+			continue
+		}
+		if len(terms) == max {
+			break
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+func (hs *HTTPServer) registerSearchRoutes() {
+	hs.mux.HandleFunc("GET /files/search", hs.handleSearchFiles)
+}
+
+// GET /files/search?q=...[&limit=N]
+func (hs *HTTPServer) handleSearchFiles(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	terms := searchTerms(r.URL.Query().Get("q"), SEARCH_MAX_QUERY_TERMS+1)
+	if len(terms) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("q must have a word of at least %d letters or digits", SEARCH_MIN_TERM))
+		return
+	}
+	if len(terms) > SEARCH_MAX_QUERY_TERMS {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("At most %d words allowed in q", SEARCH_MAX_QUERY_TERMS))
+		return
+	}
+	limit := FILES_LIST_MAX
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > FILES_LIST_MAX {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1 to %d", FILES_LIST_MAX))
+			return
+		}
+		limit = n
+	}
+
+	// Ranking needs more matches than are returned
+	results, err := hs.uploads.metadata.SearchFiles(r.Context(), tokenInfo.UserID, terms, SEARCH_MAX_CANDIDATES)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range results {
+		result := &results[i]
+		name := strings.ToLower(result.FileName)
+		for _, term := range terms {
+			if strings.Contains(name, term) {
+				result.nameHits++
+			}
+		}
+		result.Matched = make([]string, 0, 2)
+		if result.nameHits > 0 {
+			result.Matched = append(result.Matched, "file_name")
+		}
+		if result.contentHits > 0 {
+			result.Matched = append(result.Matched, "content")
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].nameHits != results[j].nameHits {
+			return results[i].nameHits > results[j].nameHits
+		}
+		return results[i].contentHits > results[j].contentHits
+	})
+	truncated := len(results) > limit
+	if truncated {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results":   results,
+		"truncated": truncated,
+	})
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+// SEARCH_TERM_BATCH terms are inserted per statement
+const SEARCH_TERM_BATCH = 500
+
+func (ms *sqlMetadataStore) PutTerms(ctx context.Context, key string, terms []string) error {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM file_terms WHERE s3_key = $1`, key); err != nil {
+		return err
+	}
+	for len(terms) > 0 {
+		batch := terms[:min(len(terms), SEARCH_TERM_BATCH)]
+		terms = terms[len(batch):]
+
+		args := []any{key}
+		values := make([]string, 0, len(batch))
+		for _, term := range batch {
+			args = append(args, term)
+			values = append(values, "($1, $"+strconv.Itoa(len(args))+")")
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO file_terms (s3_key, term) VALUES `+strings.Join(values, ", "), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ms *sqlMetadataStore) SearchFiles(ctx context.Context, owner string, terms []string, limit int) ([]SearchResult, error) {
+	// The terms, then owner and the limit: SQLite numbers $N parameters in
+	// order of appearance, and the terms are counted in the select list
+	args := make([]any, 0, len(terms)+2)
+	placeholders := make([]string, 0, len(terms))
+	var where strings.Builder
+	for _, term := range terms {
+		args = append(args, term)
+		p := "$" + strconv.Itoa(len(args))
+		placeholders = append(placeholders, p)
+		// Each in the name or the text. LIKE would read '%' and '_' as
+		// wildcards; terms have neither
+		fmt.Fprintf(&where, ` AND (LOWER(f.file_name) LIKE '%%' || %s || '%%'
+			OR EXISTS (SELECT 1 FROM file_terms t WHERE t.term = %s AND t.s3_key = f.s3_key))`, p, p)
+	}
+	args = append(args, owner, limit)
+
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT f.s3_key, f.file_name, f.size, f.content_type, f.completed_at,
+			(SELECT COUNT(*) FROM file_terms t WHERE t.s3_key = f.s3_key AND t.term IN (`+strings.Join(placeholders, ", ")+`))
+		FROM files f
+		WHERE f.owner = $`+strconv.Itoa(len(args)-1)+` AND f.deleted_at IS NULL`+where.String()+`
+		ORDER BY f.completed_at DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.Key, &result.FileName, &result.Size, &result.ContentType, &result.CompletedAt, &result.contentHits); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,545 @@
+// sessionstore.go - Upload sessions persisted outside the process
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Session Store
+// ============================================
+
+// Sessions are held in memory, so without a store a restart loses every
+// in-flight upload: its multipart upload is left for the startup recovery
+// pass (recovery.go) and the client must start over. SESSION_STORE selects
+// where sessions are copied:
+//
+//   - memory: nowhere, the default
+//   - redis:  REDIS_URL; each session is a hash <SESSION_STORE_PREFIX>session:<id>
+//     with its fields in "meta" and each received chunk in "chunk:<index>",
+//     and the set <SESSION_STORE_PREFIX>sessions lists the session IDs
+//
+// Sessions are restored on startup, and a chunk or status request for a
+// session this instance does not hold loads it from the store, so a client
+// can resume on another instance sharing the store. A session is meant to be
+// served by one instance at a time: an instance that loads a session keeps
+// its own copy and does not see another's later writes.
+//
+// Writes happen on a background goroutine in the order they were made and
+// never block the upload path; when the queue is full they are dropped and
+// counted. A chunk whose write was lost is simply missing after a restore
+// and the client sends it again.
+
+const (
+	SESSION_STORE_QUEUE_SIZE = 10000
+	SESSION_STORE_TIMEOUT    = 10 * time.Second
+)
+
+var (
+	SESSION_STORE        = envString("SESSION_STORE", "memory") // memory or redis
+	REDIS_URL            = envString("REDIS_URL", "redis://localhost:6379/0")
+	SESSION_STORE_PREFIX = envString("SESSION_STORE_PREFIX", "gnet:")
+)
+
+// SessionRecord is the persisted form of an UploadSession. The preset is
+// kept by name and resolved against the presets loaded at restore.
+type SessionRecord struct {
+	SessionID     string                `json:"session_id"`
+	UserID        string                `json:"user_id"`
+	Username      string                `json:"username"`
+	FileName      string                `json:"file_name"`
+	S3Key         string                `json:"s3_key"`
+	FileExtension string                `json:"file_extension"`
+	ContentType   string                `json:"content_type"`
+	Attributes    map[string]string     `json:"attributes,omitempty"`
+	FileHash      string                `json:"file_hash,omitempty"`
+	Preset        string                `json:"preset,omitempty"`
+	Drop          string                `json:"drop,omitempty"`
+	Immutable     *ImmutableRequest     `json:"immutable,omitempty"`
+	Compression   uint8                 `json:"compression,omitempty"`
+	TotalChunks   uint32                `json:"total_chunks"`
+	ChunkSize     uint32                `json:"chunk_size"`
+	ChunksPerPart uint32                `json:"chunks_per_part"`
+	TotalSize     uint64                `json:"total_size"`
+	State         string                `json:"state"`
+	UploadID      string                `json:"upload_id,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+	PausedAt      *time.Time            `json:"paused_at,omitempty"`
+	SlowCause     string                `json:"slow_cause,omitempty"`
+	Integrity     string                `json:"integrity,omitempty"`
+	Chunks        map[uint32]*ChunkInfo `json:"-"` // Stored one by one
+}
+
+// SessionStore persists sessions. Save writes the session's fields and the
+// given chunks; chunks saved earlier are kept.
+type SessionStore interface {
+	Save(ctx context.Context, record *SessionRecord, chunks []*ChunkInfo) error
+	Delete(ctx context.Context, sessionID string) error
+	Load(ctx context.Context, sessionID string) (*SessionRecord, error) // nil when unknown
+	LoadAll(ctx context.Context) ([]*SessionRecord, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// NewSessionStore builds the store selected by SESSION_STORE.
+func NewSessionStore() (SessionStore, error) {
+	switch SESSION_STORE {
+	case "", "memory":
+		return nopSessionStore{}, nil
+	case "redis":
+		return NewRedisSessionStore(REDIS_URL, SESSION_STORE_PREFIX)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q (want memory or redis)", SESSION_STORE)
+	}
+}
+
+// record snapshots the session's fields. Caller holds us.mu.
+func (us *UploadSession) record() *SessionRecord {
+	rec := &SessionRecord{
+		SessionID:     us.SessionID,
+		UserID:        us.UserID,
+		Username:      us.Username,
+		FileName:      us.FileName,
+		S3Key:         us.S3Key,
+		FileExtension: us.FileExtension,
+		ContentType:   us.ContentType,
+		Attributes:    us.Attributes,
+		FileHash:      us.FileHash,
+		Drop:          us.Drop,
+		Immutable:     us.Immutable,
+		Compression:   us.Compression,
+		TotalChunks:   us.TotalChunks,
+		ChunkSize:     us.ChunkSize,
+		ChunksPerPart: us.ChunksPerPart,
+		TotalSize:     us.TotalSize,
+		State:         us.State,
+		UploadID:      us.UploadID,
+		CreatedAt:     us.CreatedAt,
+		UpdatedAt:     us.UpdatedAt,
+		PausedAt:      us.PausedAt,
+		SlowCause:     us.SlowCause,
+		Integrity:     us.Integrity,
+	}
+	if us.Preset != nil {
+		rec.Preset = us.Preset.Name
+	}
+	return rec
+}
+
+// save queues the session for the store, with the chunk just received if
+// any. Caller holds us.mu.
+func (us *UploadSession) save(chunks ...uint32) {
+	if !sessionWriter.Enabled() {
+		return
+	}
+	infos := make([]*ChunkInfo, 0, len(chunks))
+	for _, index := range chunks {
+		if chunk, ok := us.ReceivedChunks[index]; ok {
+			info := *chunk
+			infos = append(infos, &info)
+		}
+	}
+	sessionWriter.Save(us.record(), infos)
+}
+
+// restoreSession rebuilds a session from its record. A chunk staged for a
+// part that never reached S3 is dropped: the staging file may be gone, or on
+// another instance, so the client sends the chunk again. A drop upload's
+// preset is rebuilt from the drop, never looked up by name.
+func restoreSession(ctx context.Context, rec *SessionRecord, presets map[string]*UploadPreset, metadata MetadataStore) (*UploadSession, error) {
+	session := &UploadSession{
+		SessionID:      rec.SessionID,
+		UserID:         rec.UserID,
+		Username:       rec.Username,
+		FileName:       rec.FileName,
+		S3Key:          rec.S3Key,
+		FileExtension:  rec.FileExtension,
+		ContentType:    rec.ContentType,
+		Attributes:     rec.Attributes,
+		FileHash:       rec.FileHash,
+		Drop:           rec.Drop,
+		Immutable:      rec.Immutable,
+		Compression:    rec.Compression,
+		TotalChunks:    rec.TotalChunks,
+		ChunkSize:      rec.ChunkSize,
+		ChunksPerPart:  max(1, rec.ChunksPerPart),
+		TotalSize:      rec.TotalSize,
+		State:          rec.State,
+		ReceivedChunks: make(map[uint32]*ChunkInfo, len(rec.Chunks)),
+		UploadID:       rec.UploadID,
+		CreatedAt:      rec.CreatedAt,
+		UpdatedAt:      rec.UpdatedAt,
+		PausedAt:       rec.PausedAt,
+		SlowCause:      rec.SlowCause,
+		Integrity:      rec.Integrity,
+		lastChunkAt:    time.Now(), // Downtime must not count against the measured rate
+	}
+	switch {
+	case rec.Drop != "":
+		drop, err := metadata.GetDrop(ctx, rec.Drop)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load drop: %w", err)
+		}
+		session.Preset = drop.preset()
+	case rec.Preset != "":
+		preset, ok := presets[rec.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown upload preset %q", rec.Preset)
+		}
+		session.Preset = preset
+	}
+
+	etags := make(map[int32]string)
+	for _, chunk := range rec.Chunks {
+		if chunk.ETag != "" {
+			etags[chunk.PartNumber] = chunk.ETag
+		}
+	}
+	for index, chunk := range rec.Chunks {
+		if _, ok := etags[chunk.PartNumber]; ok && index < session.TotalChunks {
+			session.ReceivedChunks[index] = chunk
+			session.BytesReceived += uint64(chunk.Size)
+		}
+	}
+	session.rebuildParts(etags)
+
+	// The previous owner died mid-finalize; whether S3 completed the upload
+	// is unknown, so let the client finalize again
+	if session.State == STATE_FINALIZING {
+		session.State = STATE_UPLOADING
+	}
+	return session, nil
+}
+
+// rebuildParts sets CompletedParts to the parts with etags, in order.
+// Caller holds us.mu or has the session to itself.
+func (us *UploadSession) rebuildParts(etags map[int32]string) {
+	us.CompletedParts = make([]types.CompletedPart, 0, us.PartCount())
+	for part, etag := range etags {
+		us.CompletedParts = append(us.CompletedParts, types.CompletedPart{
+			PartNumber: aws.Int32(part),
+			ETag:       aws.String(etag),
+		})
+	}
+	slices.SortFunc(us.CompletedParts, func(a, b types.CompletedPart) int {
+		return int(*a.PartNumber - *b.PartNumber)
+	})
+}
+
+// ============================================
+// Session Writer
+// ============================================
+
+type sessionWrite struct {
+	record    *SessionRecord
+	chunks    []*ChunkInfo
+	sessionID string // Set for a delete
+}
+
+// SessionWriter applies session writes to the store from one goroutine.
+type SessionWriter struct {
+	store   SessionStore
+	enabled bool
+	queue   chan *sessionWrite
+	done    chan struct{}
+}
+
+// sessionWriter is replaced in main once the store is configured; until then
+// sessions are not persisted.
+var sessionWriter = NewSessionWriter(nopSessionStore{})
+
+func NewSessionWriter(store SessionStore) *SessionWriter {
+	_, nop := store.(nopSessionStore)
+	sw := &SessionWriter{
+		store:   store,
+		enabled: !nop,
+		queue:   make(chan *sessionWrite, SESSION_STORE_QUEUE_SIZE),
+		done:    make(chan struct{}),
+	}
+	go sw.run()
+	return sw
+}
+
+// Enabled reports whether sessions are persisted at all.
+func (sw *SessionWriter) Enabled() bool {
+	return sw.enabled
+}
+
+func (sw *SessionWriter) Save(record *SessionRecord, chunks []*ChunkInfo) {
+	sw.enqueue(&sessionWrite{record: record, chunks: chunks})
+}
+
+func (sw *SessionWriter) Delete(sessionID string) {
+	if sw.enabled {
+		sw.enqueue(&sessionWrite{sessionID: sessionID})
+	}
+}
+
+func (sw *SessionWriter) enqueue(write *sessionWrite) {
+	select {
+	case sw.queue <- write:
+	default:
+		sessionStoreWrites.WithLabelValues(write.op(), "dropped").Inc()
+		sessionLog.Warn("session store queue full, dropping write", "op", write.op(), "session_id", write.id())
+	}
+}
+
+func (sw *SessionWriter) run() {
+	defer close(sw.done)
+
+	for write := range sw.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), SESSION_STORE_TIMEOUT)
+		var err error
+		if write.record != nil {
+			err = sw.store.Save(ctx, write.record, write.chunks)
+		} else {
+			err = sw.store.Delete(ctx, write.sessionID)
+		}
+		cancel()
+
+		if err != nil {
+			sessionStoreWrites.WithLabelValues(write.op(), "error").Inc()
+			sessionLog.Warn("failed to write session to store", "op", write.op(), "session_id", write.id(), "err", err)
+			continue
+		}
+		sessionStoreWrites.WithLabelValues(write.op(), "ok").Inc()
+	}
+}
+
+// Close applies the writes still queued, waiting at most timeout, then
+// closes the store. No sessions may be saved afterwards.
+func (sw *SessionWriter) Close(timeout time.Duration) error {
+	close(sw.queue)
+	select {
+	case <-sw.done:
+	case <-time.After(timeout):
+		sessionLog.Warn("session store queue not drained before shutdown", "pending", len(sw.queue))
+	}
+	return sw.store.Close()
+}
+
+func (w *sessionWrite) op() string {
+	if w.record != nil {
+		return "save"
+	}
+	return "delete"
+}
+
+func (w *sessionWrite) id() string {
+	if w.record != nil {
+		return w.record.SessionID
+	}
+	return w.sessionID
+}
+
+// restoreSessions loads every stored session into the manager, returning how
+// many were restored.
+func (sm *SessionManager) restoreSessions(ctx context.Context, store SessionStore, presets map[string]*UploadPreset, metadata MetadataStore) (int, error) {
+	records, err := store.LoadAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.store = store
+	sm.presets = presets
+	sm.metadata = metadata
+	for _, rec := range records {
+		session, err := restoreSession(ctx, rec, presets, metadata)
+		if err != nil {
+			sessionLog.Warn("failed to restore session", "session_id", rec.SessionID, "err", err)
+			continue
+		}
+		sm.sessions[session.SessionID] = session
+		sessionTransitions.WithLabelValues("restored", session.State).Inc()
+	}
+	return len(sm.sessions), nil
+}
+
+// loadSession fetches a session this instance does not hold from the store,
+// e.g. one started on another instance.
+func (sm *SessionManager) loadSession(sessionID string) *UploadSession {
+	if sm.store == nil || !sessionWriter.Enabled() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SESSION_STORE_TIMEOUT)
+	defer cancel()
+
+	rec, err := sm.store.Load(ctx, sessionID)
+	if err != nil {
+		sessionLog.Warn("failed to load session from store", "session_id", sessionID, "err", err)
+		return nil
+	}
+	if rec == nil {
+		return nil
+	}
+	session, err := restoreSession(ctx, rec, sm.presets, sm.metadata)
+	if err != nil {
+		sessionLog.Warn("failed to restore session", "session_id", sessionID, "err", err)
+		return nil
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if existing, ok := sm.sessions[sessionID]; ok {
+		return existing // Loaded concurrently
+	}
+	sm.sessions[sessionID] = session
+	sessionTransitions.WithLabelValues("restored", session.State).Inc()
+	sessionLog.Info("loaded session from store", "session_id", sessionID, "state", session.State,
+		"chunks", len(session.ReceivedChunks), "total", session.TotalChunks)
+	return session
+}
+
+// ============================================
+// Stores
+// ============================================
+
+type nopSessionStore struct{}
+
+func (nopSessionStore) Save(ctx context.Context, record *SessionRecord, chunks []*ChunkInfo) error {
+	return nil
+}
+
+func (nopSessionStore) Delete(ctx context.Context, sessionID string) error { return nil }
+
+func (nopSessionStore) Load(ctx context.Context, sessionID string) (*SessionRecord, error) {
+	return nil, nil
+}
+
+func (nopSessionStore) LoadAll(ctx context.Context) ([]*SessionRecord, error) { return nil, nil }
+func (nopSessionStore) Ping(ctx context.Context) error                        { return nil }
+func (nopSessionStore) Close() error                                          { return nil }
+
+type RedisSessionStore struct {
+	client *RedisClient
+	prefix string
+	ttl    time.Duration // Refreshed on every save; the cleanup loop normally deletes first
+}
+
+func NewRedisSessionStore(url, prefix string) (*RedisSessionStore, error) {
+	client, err := NewRedisClient(url)
+	if err != nil {
+		return nil, err
+	}
+	rs := &RedisSessionStore{client: client, prefix: prefix, ttl: SESSION_TIMEOUT + time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SESSION_STORE_TIMEOUT)
+	defer cancel()
+	if err := rs.Ping(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", client.addr, err)
+	}
+
+	sessionLog.Info("persisting sessions to Redis", "addr", client.addr, "db", client.db, "prefix", prefix)
+	return rs, nil
+}
+
+func (rs *RedisSessionStore) key(sessionID string) string {
+	return rs.prefix + "session:" + sessionID
+}
+
+func (rs *RedisSessionStore) Save(ctx context.Context, record *SessionRecord, chunks []*ChunkInfo) error {
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := rs.key(record.SessionID)
+	fields := []string{"HSET", key, "meta", string(meta)}
+	for _, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "chunk:"+strconv.FormatUint(uint64(chunk.Index), 10), string(data))
+	}
+
+	p := rs.client.Pipeline()
+	p.Add(fields...)
+	p.Add("EXPIRE", key, strconv.Itoa(int(rs.ttl.Seconds())))
+	p.Add("SADD", rs.prefix+"sessions", record.SessionID)
+	return p.Exec(ctx)
+}
+
+func (rs *RedisSessionStore) Delete(ctx context.Context, sessionID string) error {
+	p := rs.client.Pipeline()
+	p.Add("DEL", rs.key(sessionID))
+	p.Add("SREM", rs.prefix+"sessions", sessionID)
+	return p.Exec(ctx)
+}
+
+func (rs *RedisSessionStore) Load(ctx context.Context, sessionID string) (*SessionRecord, error) {
+	fields, err := rs.client.Strings(ctx, "HGETALL", rs.key(sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	var rec *SessionRecord
+	chunks := make(map[uint32]*ChunkInfo)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, value := fields[i], fields[i+1]
+		switch {
+		case name == "meta":
+			rec = &SessionRecord{}
+			if err := json.Unmarshal([]byte(value), rec); err != nil {
+				return nil, fmt.Errorf("invalid session record: %w", err)
+			}
+		case strings.HasPrefix(name, "chunk:"):
+			chunk := &ChunkInfo{}
+			if err := json.Unmarshal([]byte(value), chunk); err != nil {
+				return nil, fmt.Errorf("invalid chunk record %s: %w", name, err)
+			}
+			chunks[chunk.Index] = chunk
+		}
+	}
+	if rec == nil {
+		return nil, nil // Expired, or only chunks written
+	}
+	rec.Chunks = chunks
+	return rec, nil
+}
+
+func (rs *RedisSessionStore) LoadAll(ctx context.Context) ([]*SessionRecord, error) {
+	ids, err := rs.client.Strings(ctx, "SMEMBERS", rs.prefix+"sessions")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*SessionRecord, 0, len(ids))
+	for _, id := range ids {
+		rec, err := rs.Load(ctx, id)
+		if err != nil {
+			sessionLog.Warn("failed to load session from store", "session_id", id, "err", err)
+			continue
+		}
+		if rec == nil {
+			// Its hash expired; drop it from the index
+			if _, err := rs.client.Do(ctx, "SREM", rs.prefix+"sessions", id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (rs *RedisSessionStore) Ping(ctx context.Context) error {
+	_, err := rs.client.Do(ctx, "PING")
+	return err
+}
+
+func (rs *RedisSessionStore) Close() error {
+	return rs.client.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// dropMetadataStore knows one drop.
+type dropMetadataStore struct {
+	nopMetadataStore
+	drop *Drop
+}
+
+func (ms dropMetadataStore) GetDrop(ctx context.Context, token string) (*Drop, error) {
+	if ms.drop == nil || token != ms.drop.Token {
+		return nil, errDropNotFound
+	}
+	return ms.drop, nil
+}
+
+// A drop upload keeps the drop's policy across a restart, even with an
+// admin preset of the same name.
+func TestRestoreDropSession(t *testing.T) {
+	drop := &Drop{Token: "droptoken", Owner: "user_123", Folder: "inbox", MaxFileSize: 1 << 30, Extensions: []string{".pdf"}}
+	session := &UploadSession{
+		SessionID:   "user_123_1",
+		UserID:      "user_123",
+		FileName:    "scan.pdf",
+		S3Key:       "user_123/inbox/1/scan.pdf",
+		Preset:      drop.preset(),
+		Drop:        drop.Token,
+		TotalChunks: 2,
+		ChunkSize:   MIN_CHUNK_SIZE,
+		State:       STATE_UPLOADING,
+	}
+	presets := map[string]*UploadPreset{"drop": {Name: "drop", Extensions: []string{".mp4"}, Prefix: "admin"}}
+
+	restored, err := restoreSession(context.Background(), session.record(), presets, dropMetadataStore{drop: drop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Drop != drop.Token {
+		t.Fatalf("Drop %q, want %q", restored.Drop, drop.Token)
+	}
+	if !reflect.DeepEqual(restored.Preset, drop.preset()) {
+		t.Fatalf("Preset %+v, want the drop's %+v", restored.Preset, drop.preset())
+	}
+
+	if _, err := restoreSession(context.Background(), session.record(), presets, dropMetadataStore{}); err == nil {
+		t.Fatal("restored a session of a deleted drop")
+	}
+}
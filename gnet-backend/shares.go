@@ -0,0 +1,398 @@
+// shares.go - Links that let anyone download one file
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ============================================
+// Shares
+// ============================================
+
+// Streaming tokens (stream.go) last minutes and are meant for the owner's
+// own players. A share is a link for someone else: it expires when its owner
+// says (SHARE_DEFAULT_TTL_HOURS by default, at most SHARE_MAX_TTL_HOURS),
+// can be limited to a number of downloads and protected by a password, and
+// can be revoked at any time.
+//
+//	POST   /files/share            {"key", ["expires_in_seconds"], ["max_downloads"], ["password"], ["notify"]}
+//	GET    /files/shares           the caller's shares, newest first
+//	DELETE /files/shares/{token}   revoke
+//	GET    /share/{token}          the file, with X-Share-Password or ?password= if set
+//
+// Every GET counts as a download, except one range starting past the first
+// byte from a client holding the resume cookie that a counted download sets
+// (SHARE_RESUME_TTL_SECONDS, signed with a key of this process). That way a
+// player seeking or a browser resuming does not use up max_downloads, and a
+// range without the cookie, like bytes=1- on an unused share, counts. Once the
+// last download has started, a limited share serves nothing more, ranges
+// included. Downloads count towards the owner's streamed bytes in /usage.
+//
+// "notify" lists email addresses to send the link to (notify.go). Shares are
+// kept in the metadata store (metadata.go) and need METADATA_DB.
+// Passwords are stored as bcrypt hashes.
+
+var (
+	SHARE_DEFAULT_TTL = time.Duration(envInt("SHARE_DEFAULT_TTL_HOURS", 7*24)) * time.Hour
+	SHARE_MAX_TTL     = time.Duration(envInt("SHARE_MAX_TTL_HOURS", 30*24)) * time.Hour
+	SHARE_RESUME_TTL  = time.Duration(envInt("SHARE_RESUME_TTL_SECONDS", 3600)) * time.Second
+)
+
+const SHARE_RESUME_COOKIE = "share_resume"
+
+// Signs resume cookies; after a restart, or on another instance, a client's
+// next range counts again.
+var shareResumeKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+var errShareNotFound = errors.New("Share not found")
+
+type Share struct {
+	Token        string    `json:"token"`
+	URL          string    `json:"url"` // Relative to the API root
+	Key          string    `json:"key"`
+	Owner        string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int       `json:"max_downloads,omitempty"` // 0 for no limit
+	Downloads    int       `json:"downloads"`
+	Protected    bool      `json:"password_protected"`
+	PasswordHash string    `json:"-"` // bcrypt, empty without a password
+}
+
+type CreateShareRequest struct {
+	Key              string   `json:"key"`
+	ExpiresInSeconds int64    `json:"expires_in_seconds"`
+	MaxDownloads     int      `json:"max_downloads"`
+	Password         string   `json:"password"`
+	Notify           []string `json:"notify"` // Addresses to email the link to
+}
+
+func (hs *HTTPServer) registerShareRoutes() {
+	hs.mux.HandleFunc("POST /files/share", hs.handleCreateShare)
+	hs.mux.HandleFunc("GET /files/shares", hs.handleListShares)
+	hs.mux.HandleFunc("DELETE /files/shares/{token}", hs.handleRevokeShare)
+	hs.mux.HandleFunc("GET /share/{token}", hs.handleSharedFile)
+}
+
+// POST /files/share
+func (hs *HTTPServer) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req CreateShareRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if !strings.HasPrefix(req.Key, tokenInfo.UserID+"/") {
+		writeJSONError(w, http.StatusForbidden, "File does not belong to user")
+		return
+	}
+	ttl := time.Duration(req.ExpiresInSeconds) * time.Second
+	if ttl == 0 {
+		ttl = SHARE_DEFAULT_TTL
+	}
+	if ttl < 0 || ttl > SHARE_MAX_TTL {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("expires_in_seconds must be between 1 and %d", int64(SHARE_MAX_TTL.Seconds())))
+		return
+	}
+	if req.MaxDownloads < 0 {
+		writeJSONError(w, http.StatusBadRequest, "max_downloads must not be negative")
+		return
+	}
+	recipients, err := validateEmails(req.Notify)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	_, err = s3Client.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(req.Key),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+			writeJSONError(w, http.StatusNotFound, "File not found")
+			return
+		}
+		s3Log.ErrorContext(r.Context(), "failed to head object", "key", req.Key, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to fetch file")
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	now := time.Now().UTC()
+	share := &Share{
+		Token:        hex.EncodeToString(b),
+		Key:          req.Key,
+		Owner:        tokenInfo.UserID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid password")
+			return
+		}
+		share.PasswordHash = string(hash)
+		share.Protected = true
+	}
+
+	if !hs.writeMetadataError(w, r, hs.uploads.metadata.CreateShare(r.Context(), share)) {
+		return
+	}
+	auditLog.Record(AUDIT_SHARE_CREATED, tokenInfo.UserID, "", r.RemoteAddr, req.Key)
+	hs.uploads.activity.Record(ACTIVITY_SHARE_CREATED, req.Key, tokenInfo.UserID, "")
+	httpLog.InfoContext(r.Context(), "created share", "key", req.Key, "expires_at", share.ExpiresAt, "max_downloads", share.MaxDownloads)
+
+	share.URL = shareURL(share.Token)
+	from := tokenInfo.Username
+	if from == "" {
+		from = tokenInfo.UserID
+	}
+	hs.uploads.notifier.ShareCreated(share, from, recipients)
+	writeJSON(w, http.StatusCreated, share)
+}
+
+// GET /files/shares
+func (hs *HTTPServer) handleListShares(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	shares, err := hs.uploads.metadata.ListShares(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	for i := range shares {
+		shares[i].URL = shareURL(shares[i].Token)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shares": shares})
+}
+
+// DELETE /files/shares/{token}
+func (hs *HTTPServer) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	token := r.PathValue("token")
+	err := hs.uploads.metadata.DeleteShare(r.Context(), tokenInfo.UserID, token)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	auditLog.Record(AUDIT_SHARE_REVOKED, tokenInfo.UserID, "", r.RemoteAddr, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /share/{token}
+func (hs *HTTPServer) handleSharedFile(w http.ResponseWriter, r *http.Request) {
+	share, err := hs.uploads.metadata.GetShare(r.Context(), r.PathValue("token"))
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	if time.Now().After(share.ExpiresAt) {
+		writeJSONError(w, http.StatusGone, "Share has expired")
+		return
+	}
+
+	if share.PasswordHash != "" {
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			password = r.URL.Query().Get("password")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+			writeJSONError(w, http.StatusUnauthorized, "Password required")
+			return
+		}
+	}
+
+	resuming := rangeSkipsStart(r.Header.Get("Range")) && canResumeShare(r, share.Token)
+	if r.Method == http.MethodGet && !resuming {
+		counted, err := hs.uploads.metadata.CountShareDownload(r.Context(), share.Token)
+		if !hs.writeMetadataError(w, r, err) {
+			return
+		}
+		if !counted {
+			writeJSONError(w, http.StatusGone, "Share download limit reached")
+			return
+		}
+		setShareResume(w, share.Token)
+	} else if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		writeJSONError(w, http.StatusGone, "Share download limit reached")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(share.Key)}))
+	hs.serveObject(w, r, share.Owner, share.Key, ACTIVITY_SHARE_DOWNLOADED)
+}
+
+// rangeSkipsStart reports whether rng is one byte range starting past the
+// first byte, like the rest of an interrupted download. Any other request,
+// suffix ranges included, may return the whole file.
+func rangeSkipsStart(rng string) bool {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return false
+	}
+	start, _, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return false
+	}
+	first, err := strconv.ParseInt(start, 10, 64)
+	return err == nil && first > 0
+}
+
+func shareResumeMAC(token string, expires int64) string {
+	mac := hmac.New(sha256.New, shareResumeKey)
+	fmt.Fprintf(mac, "%s|%d", token, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setShareResume lets the client of a counted download fetch ranges of the
+// share uncounted for SHARE_RESUME_TTL.
+func setShareResume(w http.ResponseWriter, token string) {
+	expires := time.Now().Add(SHARE_RESUME_TTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     SHARE_RESUME_COOKIE,
+		Value:    strconv.FormatInt(expires, 10) + "." + shareResumeMAC(token, expires),
+		Path:     shareURL(token),
+		MaxAge:   int(SHARE_RESUME_TTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// canResumeShare reports whether r carries an unexpired resume cookie for
+// the share.
+func canResumeShare(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(SHARE_RESUME_COOKIE)
+	if err != nil {
+		return false
+	}
+	exp, mac, ok := strings.Cut(cookie.Value, ".")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(shareResumeMAC(token, expires)))
+}
+
+func shareURL(token string) string {
+	return "/share/" + token
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) CreateShare(ctx context.Context, share *Share) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO shares (token, s3_key, owner, created_at, expires_at, max_downloads, downloads, password_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, $7)`,
+		share.Token, share.Key, share.Owner, share.CreatedAt, share.ExpiresAt, share.MaxDownloads, share.PasswordHash)
+	return err
+}
+
+func (ms *sqlMetadataStore) GetShare(ctx context.Context, token string) (*Share, error) {
+	share := &Share{Token: token}
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT s3_key, owner, created_at, expires_at, max_downloads, downloads, password_hash
+		FROM shares WHERE token = $1`, token).
+		Scan(&share.Key, &share.Owner, &share.CreatedAt, &share.ExpiresAt, &share.MaxDownloads, &share.Downloads, &share.PasswordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	share.Protected = share.PasswordHash != ""
+	return share, nil
+}
+
+func (ms *sqlMetadataStore) ListShares(ctx context.Context, owner string) ([]Share, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT token, s3_key, created_at, expires_at, max_downloads, downloads, password_hash
+		FROM shares WHERE owner = $1
+		ORDER BY created_at DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]Share, 0)
+	for rows.Next() {
+		share := Share{Owner: owner}
+		if err := rows.Scan(&share.Token, &share.Key, &share.CreatedAt, &share.ExpiresAt, &share.MaxDownloads, &share.Downloads, &share.PasswordHash); err != nil {
+			return nil, err
+		}
+		share.Protected = share.PasswordHash != ""
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func (ms *sqlMetadataStore) CountShareDownload(ctx context.Context, token string) (bool, error) {
+	// One statement, so concurrent downloads cannot both take the last one
+	result, err := ms.db.ExecContext(ctx, `
+		UPDATE shares SET downloads = downloads + 1
+		WHERE token = $1 AND (max_downloads = 0 OR downloads < max_downloads)`, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (ms *sqlMetadataStore) DeleteShare(ctx context.Context, owner, token string) error {
+	result, err := ms.db.ExecContext(ctx, `DELETE FROM shares WHERE token = $1 AND owner = $2`, token, owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errShareNotFound
+	}
+	return nil
+}
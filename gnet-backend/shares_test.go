@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A range past the first byte is only uncounted with the resume cookie of a
+// counted download; otherwise it would hand out the file without using up
+// max_downloads.
+func TestShareRangesCount(t *testing.T) {
+	if sqliteDriver == "" {
+		t.Skip("needs a build with cgo for SQLite")
+	}
+	hs, s3Client := newTestHTTPServer(t)
+	metadata, err := openSQLMetadataStore(sqliteDriver, filepath.Join(t.TempDir(), "metadata.db"), sqliteMetadataSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metadata.Close()
+	hs.uploads.metadata = metadata
+
+	ctx := context.Background()
+	_, err = s3Client.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("test"),
+		Key:    aws.String("user_123/1/file.mp4"),
+		Body:   bytes.NewReader([]byte("0123456789")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newShare := func(token string, maxDownloads int) {
+		t.Helper()
+		err := metadata.CreateShare(ctx, &Share{
+			Token:        token,
+			Key:          "user_123/1/file.mp4",
+			Owner:        "user_123",
+			CreatedAt:    time.Now(),
+			ExpiresAt:    time.Now().Add(time.Hour),
+			MaxDownloads: maxDownloads,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(token, rng string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, shareURL(token), nil)
+		r.Header.Set("Range", rng)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		hs.ServeHTTP(w, r)
+		return w
+	}
+
+	newShare("unused", 1)
+	if w := get("unused", "bytes=1-"); w.Code != http.StatusPartialContent {
+		t.Fatalf("bytes=1- on an unused share: status %d: %s", w.Code, w.Body)
+	}
+	if w := get("unused", "bytes=0-0"); w.Code != http.StatusGone {
+		t.Fatalf("bytes=1- was not counted: a second download got status %d", w.Code)
+	}
+
+	newShare("resumed", 2)
+	w := get("resumed", "bytes=0-4")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("first download: status %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	for range 3 {
+		if w := get("resumed", "bytes=5-", cookies...); w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+			t.Fatalf("resumed range: status %d: %s", w.Code, w.Body)
+		}
+	}
+	if share, err := metadata.GetShare(ctx, "resumed"); err != nil || share.Downloads != 1 {
+		t.Fatalf("resumed ranges were counted: %d downloads, %v", share.Downloads, err)
+	}
+
+	// A cookie is for its own share only
+	newShare("other", 1)
+	get("other", "bytes=1-", cookies...)
+	if share, err := metadata.GetShare(ctx, "other"); err != nil || share.Downloads != 1 {
+		t.Fatalf("a range with another share's cookie was not counted: %d downloads, %v", share.Downloads, err)
+	}
+}
@@ -0,0 +1,67 @@
+// slow.go - Slow-chunk detection and bottleneck attribution
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// ============================================
+// Slow Chunk Detection
+// ============================================
+
+// Every chunk's time splits into receive time (first to last byte from the
+// client) and S3 time (the UploadPart call). A chunk counts as slow when the
+// two together exceed SLOW_CHUNK_SECONDS, and is attributed to whichever side
+// took longer. A session is flagged once SLOW_SESSION_STREAK chunks in a row
+// are slow.
+
+const (
+	SLOW_CAUSE_CLIENT = "client"
+	SLOW_CAUSE_S3     = "s3"
+)
+
+var (
+	SLOW_CHUNK_SECONDS  = envInt("SLOW_CHUNK_SECONDS", 10)
+	SLOW_SESSION_STREAK = envInt("SLOW_SESSION_STREAK", 3)
+)
+
+func (us *UploadSession) recordChunkTiming(ctx context.Context, index, size uint32, receive, s3 time.Duration) {
+	if receive+s3 < time.Duration(SLOW_CHUNK_SECONDS)*time.Second {
+		us.mu.Lock()
+		us.SlowChunks = 0
+		us.mu.Unlock()
+		return
+	}
+
+	cause := SLOW_CAUSE_S3
+	if receive > s3 {
+		cause = SLOW_CAUSE_CLIENT
+	}
+	slowChunks.WithLabelValues(cause).Inc()
+
+	chunkLog.InfoContext(ctx, "slow chunk", "session_id", us.SessionID, "chunk_index", index, "cause", cause,
+		"receive_ms", receive.Milliseconds(), "s3_ms", s3.Milliseconds(),
+		"client_bytes_per_sec", bytesPerSecond(size, receive), "s3_bytes_per_sec", bytesPerSecond(size, s3))
+
+	us.mu.Lock()
+	us.SlowChunks++
+	flag := us.SlowChunks >= SLOW_SESSION_STREAK && us.SlowCause == ""
+	if flag {
+		us.SlowCause = cause
+	}
+	us.mu.Unlock()
+
+	if flag {
+		slowSessions.WithLabelValues(cause).Inc()
+		sessionLog.WarnContext(ctx, "upload session is consistently slow", "session_id", us.SessionID,
+			"user", us.Username, "cause", cause, "streak", SLOW_SESSION_STREAK)
+	}
+}
+
+func bytesPerSecond(size uint32, d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64(float64(size) / d.Seconds())
+}
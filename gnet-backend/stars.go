@@ -0,0 +1,176 @@
+// stars.go - Starred files, for users to pin the ones they come back to
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================
+// Starred Files
+// ============================================
+
+// With thousands of uploads the few that matter get lost in the listing. A
+// user stars them, their own or ones granted to them (acl.go), and lists
+// just those:
+//
+//	PUT    /files/starred/{key...}   star a file
+//	DELETE /files/starred/{key...}   unstar it
+//	GET    /files?starred=true       the caller's starred files, most recently starred first
+//
+// Stars are the caller's own: another user starring the same file changes
+// nothing for them. ?tag= narrows the starred listing to files carrying every
+// tag given (tags.go). Files in the trash are left out, and so are granted
+// files whose grant has since been revoked; GET /metadata tells whether the
+// caller starred a file. Stars are kept in the metadata store (metadata.go)
+// and need METADATA_DB.
+
+func (hs *HTTPServer) registerStarRoutes() {
+	hs.mux.HandleFunc("PUT /files/starred/{key...}", hs.handleStarFile)
+	hs.mux.HandleFunc("DELETE /files/starred/{key...}", hs.handleUnstarFile)
+}
+
+// PUT /files/starred/{key...}
+func (hs *HTTPServer) handleStarFile(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.PathValue("key")
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_READ) {
+		return
+	}
+
+	ctx := r.Context()
+	_, err := hs.uploads.metadata.GetFile(ctx, key)
+	if err == nil {
+		err = hs.uploads.metadata.StarFile(ctx, tokenInfo.UserID, key, time.Now().UTC())
+	}
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /files/starred/{key...}
+func (hs *HTTPServer) handleUnstarFile(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	// No access check: a file whose grant was revoked can still be unstarred
+	err := hs.uploads.metadata.UnstarFile(r.Context(), tokenInfo.UserID, r.PathValue("key"))
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listStarredFiles serves GET /files?starred=true from the metadata store.
+func (hs *HTTPServer) listStarredFiles(w http.ResponseWriter, r *http.Request, userID string, tags []string) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx := r.Context()
+	grants, err := hs.uploads.metadata.GrantsTo(ctx, userID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+
+	// One more than asked for tells whether there are more
+	records, err := hs.uploads.metadata.StarredFiles(ctx, userID, tags, FILES_LIST_MAX+1)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	files := make([]FileSummary, 0, len(records))
+	for _, record := range records {
+		if !strings.HasPrefix(record.Key, userID+"/") && !slices.ContainsFunc(grants, func(g Grant) bool { return g.covers(record.Key) }) {
+			continue
+		}
+		files = append(files, FileSummary{Key: record.Key, Size: record.Size, LastModified: record.CompletedAt})
+	}
+	truncated := len(records) > FILES_LIST_MAX
+	if len(files) > FILES_LIST_MAX {
+		files = files[:FILES_LIST_MAX]
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files":     files,
+		"truncated": truncated,
+		"sessions":  []SessionSummary{},
+	})
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) StarFile(ctx context.Context, userID, key string, starredAt time.Time) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO stars (user_id, s3_key, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, s3_key) DO NOTHING`, userID, key, starredAt)
+	return err
+}
+
+func (ms *sqlMetadataStore) UnstarFile(ctx context.Context, userID, key string) error {
+	_, err := ms.db.ExecContext(ctx, `DELETE FROM stars WHERE user_id = $1 AND s3_key = $2`, userID, key)
+	return err
+}
+
+func (ms *sqlMetadataStore) IsStarred(ctx context.Context, userID, key string) (bool, error) {
+	var n int
+	err := ms.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM stars WHERE user_id = $1 AND s3_key = $2`, userID, key).Scan(&n)
+	return n > 0, err
+}
+
+func (ms *sqlMetadataStore) StarredFiles(ctx context.Context, userID string, tags []string, limit int) ([]FileRecord, error) {
+	// $1 the user, then the tags, how many there are and the limit
+	where, args := ``, []any{userID}
+	if len(tags) > 0 {
+		placeholders := make([]string, 0, len(tags))
+		for _, tag := range slices.Compact(slices.Sorted(slices.Values(tags))) {
+			args = append(args, tag)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+		args = append(args, len(placeholders))
+		where = ` AND f.s3_key IN (
+			SELECT s3_key FROM file_tags WHERE tag IN (` + strings.Join(placeholders, ", ") + `)
+			GROUP BY s3_key HAVING COUNT(*) = $` + strconv.Itoa(len(args)) + `
+		)`
+	}
+	args = append(args, limit)
+
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT f.s3_key, f.owner, f.file_name, f.version, f.size, f.checksum, f.content_type, f.created_at, f.completed_at
+		FROM stars s JOIN files f ON f.s3_key = s.s3_key
+		WHERE s.user_id = $1 AND f.deleted_at IS NULL`+where+`
+		ORDER BY s.created_at DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]FileRecord, 0)
+	for rows.Next() {
+		var file FileRecord
+		if err := rows.Scan(&file.Key, &file.Owner, &file.FileName, &file.Version, &file.Size, &file.Checksum, &file.ContentType, &file.CreatedAt, &file.CompletedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,274 @@
+// stats.go - In-process upload statistics for the admin dashboard
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Upload Statistics
+// ============================================
+
+// Prometheus keeps the long-term series; these are the short windows an
+// operator wants at a glance without a metrics stack.
+
+const (
+	STATS_HORIZON      = 15 * time.Minute // Longest sliding window kept
+	STATS_MAX_FAILURES = 50               // Recent failures remembered
+	STATS_TOP_USERS    = 10
+)
+
+var STATS_WINDOWS = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+var uploadStats = NewUploadStats()
+
+// slidingCounter sums events in one-second buckets over the last STATS_HORIZON.
+type slidingCounter struct {
+	counts []int64
+	stamps []int64 // Unix second each bucket currently holds
+	mu     sync.Mutex
+}
+
+func newSlidingCounter() *slidingCounter {
+	n := int(STATS_HORIZON / time.Second)
+	return &slidingCounter{
+		counts: make([]int64, n),
+		stamps: make([]int64, n),
+	}
+}
+
+func (sc *slidingCounter) Add(n int64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sec := time.Now().Unix()
+	i := sec % int64(len(sc.counts))
+	if sc.stamps[i] != sec {
+		sc.stamps[i] = sec
+		sc.counts[i] = 0
+	}
+	sc.counts[i] += n
+}
+
+// Sum returns the total over the last window (capped at STATS_HORIZON).
+func (sc *slidingCounter) Sum(window time.Duration) int64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	since := time.Now().Add(-window).Unix()
+	var total int64
+	for i, stamp := range sc.stamps {
+		if stamp > since {
+			total += sc.counts[i]
+		}
+	}
+	return total
+}
+
+const (
+	FAILURE_CHUNK    = "chunk"
+	FAILURE_FINALIZE = "finalize"
+	FAILURE_AUTH     = "auth"
+)
+
+type FailureRecord struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"` // One of the FAILURE_* kinds
+	SessionID string    `json:"session_id,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	Error     string    `json:"error"`
+}
+
+type UploadStats struct {
+	bytes      *slidingCounter
+	chunks     *slidingCounter
+	s3Calls    *slidingCounter
+	s3Failures *slidingCounter
+	byKind     map[string]*slidingCounter // Failures per FailureRecord.Kind
+
+	userBytes map[string]int64 // Bytes uploaded per user since start
+	failures  []FailureRecord  // Ring of the most recent failures
+	next      int
+	mu        sync.Mutex
+}
+
+func NewUploadStats() *UploadStats {
+	return &UploadStats{
+		bytes:      newSlidingCounter(),
+		chunks:     newSlidingCounter(),
+		s3Calls:    newSlidingCounter(),
+		s3Failures: newSlidingCounter(),
+		byKind: map[string]*slidingCounter{
+			FAILURE_CHUNK:    newSlidingCounter(),
+			FAILURE_FINALIZE: newSlidingCounter(),
+			FAILURE_AUTH:     newSlidingCounter(),
+		},
+		userBytes: make(map[string]int64),
+		failures:  make([]FailureRecord, 0, STATS_MAX_FAILURES),
+	}
+}
+
+func (us *UploadStats) RecordChunk(userID string, size uint32) {
+	us.bytes.Add(int64(size))
+	us.chunks.Add(1)
+
+	us.mu.Lock()
+	us.userBytes[userID] += int64(size)
+	us.mu.Unlock()
+}
+
+func (us *UploadStats) RecordS3Call(failed bool) {
+	us.s3Calls.Add(1)
+	if failed {
+		us.s3Failures.Add(1)
+	}
+}
+
+func (us *UploadStats) RecordFailure(kind, sessionID, userID string, err error) {
+	record := FailureRecord{
+		Time:      time.Now(),
+		Kind:      kind,
+		SessionID: sessionID,
+		UserID:    userID,
+		Error:     err.Error(),
+	}
+	if counter, ok := us.byKind[kind]; ok {
+		counter.Add(1)
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if len(us.failures) < STATS_MAX_FAILURES {
+		us.failures = append(us.failures, record)
+	} else {
+		us.failures[us.next] = record
+	}
+	us.next = (us.next + 1) % STATS_MAX_FAILURES
+}
+
+// FailureCount returns how many failures of a kind happened within window.
+func (us *UploadStats) FailureCount(kind string, window time.Duration) int64 {
+	if counter, ok := us.byKind[kind]; ok {
+		return counter.Sum(window)
+	}
+	return 0
+}
+
+// RecentFailures returns the remembered failures, newest first.
+func (us *UploadStats) RecentFailures() []FailureRecord {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	out := make([]FailureRecord, len(us.failures))
+	copy(out, us.failures)
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	return out
+}
+
+type UserBytes struct {
+	UserID string `json:"user_id"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func (us *UploadStats) TopUsers(n int) []UserBytes {
+	us.mu.Lock()
+	users := make([]UserBytes, 0, len(us.userBytes))
+	for userID, bytes := range us.userBytes {
+		users = append(users, UserBytes{UserID: userID, Bytes: bytes})
+	}
+	us.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Bytes > users[j].Bytes })
+	if len(users) > n {
+		users = users[:n]
+	}
+	return users
+}
+
+// ============================================
+// Admin Stats Endpoint
+// ============================================
+
+type WindowStats struct {
+	Window         string  `json:"window"`
+	Bytes          int64   `json:"bytes"`
+	Chunks         int64   `json:"chunks"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	S3Calls        int64   `json:"s3_calls"`
+	S3Errors       int64   `json:"s3_errors"`
+	S3ErrorRate    float64 `json:"s3_error_rate"`
+}
+
+type SessionSummary struct {
+	SessionID      string    `json:"session_id"`
+	UserID         string    `json:"user_id"`
+	FileName       string    `json:"file_name"`
+	State          string    `json:"state"`
+	ReceivedChunks uint32    `json:"received_chunks"`
+	TotalChunks    uint32    `json:"total_chunks"`
+	BytesPerSecond uint64    `json:"bytes_per_second"`
+	SlowCause      string    `json:"slow_cause,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// GET /admin/stats
+func (hs *HTTPServer) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	windows := make([]WindowStats, 0, len(STATS_WINDOWS))
+	for _, window := range STATS_WINDOWS {
+		ws := WindowStats{
+			Window:   window.String(),
+			Bytes:    uploadStats.bytes.Sum(window),
+			Chunks:   uploadStats.chunks.Sum(window),
+			S3Calls:  uploadStats.s3Calls.Sum(window),
+			S3Errors: uploadStats.s3Failures.Sum(window),
+		}
+		ws.BytesPerSecond = float64(ws.Bytes) / window.Seconds()
+		if ws.S3Calls > 0 {
+			ws.S3ErrorRate = float64(ws.S3Errors) / float64(ws.S3Calls)
+		}
+		windows = append(windows, ws)
+	}
+
+	sessions := hs.sessionMgr.Sessions()
+	summaries := make([]SessionSummary, 0, len(sessions))
+	byState := map[string]int{}
+	for _, session := range sessions {
+		session.mu.Lock()
+		summary := SessionSummary{
+			SessionID:      session.SessionID,
+			UserID:         session.UserID,
+			FileName:       session.FileName,
+			State:          session.State,
+			ReceivedChunks: uint32(len(session.ReceivedChunks)),
+			TotalChunks:    session.TotalChunks,
+			BytesPerSecond: uint64(session.throughput),
+			SlowCause:      session.SlowCause,
+			CreatedAt:      session.CreatedAt,
+			UpdatedAt:      session.UpdatedAt,
+		}
+		session.mu.Unlock()
+
+		byState[summary.State]++
+		switch summary.State {
+		case STATE_INITIALIZED, STATE_UPLOADING, STATE_PAUSED, STATE_FINALIZING:
+			summaries = append(summaries, summary)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timestamp":         time.Now(),
+		"sessions_by_state": byState,
+		"active_sessions":   summaries,
+		"throughput":        windows,
+		"top_users":         uploadStats.TopUsers(STATS_TOP_USERS),
+		"recent_failures":   uploadStats.RecentFailures(),
+	})
+}
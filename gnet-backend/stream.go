@@ -0,0 +1,153 @@
+// stream.go - Short-lived streaming tokens for playing back uploads
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// ============================================
+// Streaming Tokens
+// ============================================
+
+// Players fetch a file with many ranged GETs and often cannot set headers
+// (<video> tags, media services), so they would otherwise carry the user's
+// long-lived token in every URL. A streaming token only reads one key and
+// expires after STREAM_TOKEN_TTL; players ask for a new one before then.
+//
+//	POST /stream/token/{key...}          {"token", "url", "expires_at", "size", "etag", "content_type"}
+//	GET  /stream/files/{key...}?token=   same as GET /files/{key...}
+
+var STREAM_TOKEN_TTL = time.Duration(envInt("STREAM_TOKEN_TTL_SECONDS", 300)) * time.Second
+
+type StreamTokenResponse struct {
+	Token       string    `json:"token"`
+	URL         string    `json:"url"` // Relative to the API root
+	ExpiresAt   time.Time `json:"expires_at"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	ContentType string    `json:"content_type"`
+}
+
+type streamGrant struct {
+	userID    string
+	key       string
+	expiresAt time.Time
+}
+
+type StreamTokens struct {
+	mu     sync.Mutex
+	grants map[string]streamGrant
+}
+
+func NewStreamTokens() *StreamTokens {
+	return &StreamTokens{grants: make(map[string]streamGrant)}
+}
+
+// Issue returns a new token that reads key on behalf of userID.
+func (st *StreamTokens) Issue(userID, key string) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	expiresAt := time.Now().Add(STREAM_TOKEN_TTL)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Expired grants are dropped here rather than by a separate loop
+	now := time.Now()
+	for t, grant := range st.grants {
+		if now.After(grant.expiresAt) {
+			delete(st.grants, t)
+		}
+	}
+	st.grants[token] = streamGrant{userID: userID, key: key, expiresAt: expiresAt}
+	return token, expiresAt
+}
+
+// Validate returns the user a token was issued to, if it is unexpired and
+// was issued for key.
+func (st *StreamTokens) Validate(token, key string) (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	grant, ok := st.grants[token]
+	if !ok || grant.key != key || time.Now().After(grant.expiresAt) {
+		return "", false
+	}
+	return grant.userID, true
+}
+
+// POST /stream/token/{key...}
+func (hs *HTTPServer) handleStreamToken(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.PathValue("key")
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_READ) {
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	head, err := s3Client.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+			writeJSONError(w, http.StatusNotFound, "File not found")
+			return
+		}
+		s3Log.ErrorContext(r.Context(), "failed to head object", "key", key, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to fetch file")
+		return
+	}
+
+	token, expiresAt := hs.streams.Issue(tokenInfo.UserID, key)
+	httpLog.InfoContext(r.Context(), "issued streaming token", "key", key, "expires_at", expiresAt)
+
+	writeJSON(w, http.StatusOK, StreamTokenResponse{
+		Token:       token,
+		URL:         "/stream/files/" + escapeKey(key) + "?token=" + token,
+		ExpiresAt:   expiresAt,
+		Size:        aws.ToInt64(head.ContentLength),
+		ETag:        aws.ToString(head.ETag),
+		ContentType: aws.ToString(head.ContentType),
+	})
+}
+
+// GET /stream/files/{key...}?token=
+func (hs *HTTPServer) handleStreamFile(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	userID, ok := hs.streams.Validate(r.URL.Query().Get("token"), key)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or expired streaming token")
+		return
+	}
+	hs.serveObject(w, r, userID, key, ACTIVITY_FILE_STREAMED)
+}
+
+// escapeKey escapes each path segment of an S3 key but keeps the slashes.
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
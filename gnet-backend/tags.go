@@ -0,0 +1,353 @@
+// tags.go - User tags on files and tag-filtered listing
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// File Tags
+// ============================================
+
+// Keys are user_id/timestamp/filename, which orders uploads by time and
+// nothing else. Users can tag their files and list them by tag:
+//
+//	POST /tags/{key...}        {"add": [...], "remove": [...]}, returns the file's tags
+//	GET  /tags                 the caller's tags with how many files carry each
+//	GET  /files?tag=a&tag=b    the caller's files carrying every tag given
+//
+// Tags live in the metadata store (metadata.go), so they need METADATA_DB,
+// and only files uploaded since it was set can be tagged. Each change is
+// then mirrored to the object's S3 tags as tag:<name>, for bucket lifecycle
+// rules and other tools that read the bucket directly. S3 allows ten tags
+// per object and the integrity probe uses one, hence FILE_MAX_TAGS. A failed
+// mirror is logged and left for the file's next tag change; the store is
+// the reference.
+
+const (
+	FILE_MAX_TAGS = 9
+
+	OBJECT_TAG_PREFIX = "tag:"
+)
+
+// Lowercase, and within what S3 accepts in a tag key
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+var errTooManyTags = fmt.Errorf("A file can have at most %d tags", FILE_MAX_TAGS)
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Files int    `json:"files"`
+}
+
+type UpdateTagsRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type FileTagsResponse struct {
+	Key  string   `json:"key"`
+	Tags []string `json:"tags"`
+}
+
+// normalizeTags lowercases tags and checks each against tagPattern.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid tag %q: 1 to 64 letters, digits, '.', '_' or '-'", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+func (hs *HTTPServer) registerTagRoutes() {
+	hs.mux.HandleFunc("POST /tags/{key...}", hs.handleUpdateTags)
+	hs.mux.HandleFunc("GET /tags", hs.handleListTags)
+}
+
+// POST /tags/{key...}
+func (hs *HTTPServer) handleUpdateTags(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.PathValue("key")
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_WRITE) {
+		return
+	}
+
+	var req UpdateTagsRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	add, err := normalizeTags(req.Add)
+	if err == nil {
+		req.Remove, err = normalizeTags(req.Remove)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tags, err := hs.uploads.metadata.UpdateTags(r.Context(), key, add, req.Remove)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+
+	if err := hs.sessionMgr.s3Client.mirrorTags(r.Context(), key, tags); err != nil {
+		s3Log.WarnContext(r.Context(), "failed to mirror tags to object", "s3_key", key, "err", err)
+	}
+	writeJSON(w, http.StatusOK, FileTagsResponse{Key: key, Tags: tags})
+}
+
+// GET /tags
+func (hs *HTTPServer) handleListTags(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	tags, err := hs.uploads.metadata.ListTags(r.Context(), tokenInfo.UserID)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// listTaggedFiles serves GET /files?tag=... from the metadata store.
+func (hs *HTTPServer) listTaggedFiles(w http.ResponseWriter, r *http.Request, userID string, tags []string) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// One more than asked for tells whether there are more
+	records, err := hs.uploads.metadata.FindFiles(r.Context(), userID, tags, FILES_LIST_MAX+1)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	truncated := len(records) > FILES_LIST_MAX
+	if truncated {
+		records = records[:FILES_LIST_MAX]
+	}
+
+	files := make([]FileSummary, 0, len(records))
+	for _, record := range records {
+		files = append(files, FileSummary{Key: record.Key, Size: record.Size, LastModified: record.CompletedAt})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files":     files,
+		"truncated": truncated,
+	})
+}
+
+// writeMetadataError answers a failed metadata store call and reports whether
+// err was nil, i.e. whether the caller should go on.
+func (hs *HTTPServer) writeMetadataError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errMetadataDisabled):
+		writeJSONError(w, http.StatusNotImplemented, err.Error())
+	case errors.Is(err, errFileNotRecorded), errors.Is(err, errShareNotFound), errors.Is(err, errGrantNotFound),
+		errors.Is(err, errExportNotFound), errors.Is(err, errLegalHoldNotFound), errors.Is(err, errCommentNotFound), errors.Is(err, errDropNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errTooManyTags), errors.Is(err, errTooManyComments):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		httpLog.ErrorContext(r.Context(), "metadata store request failed", "path", r.URL.Path, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read file metadata")
+	}
+	return false
+}
+
+// ============================================
+// Object Tags
+// ============================================
+
+// PutObjectTagging replaces an object's whole tag set, so writers read the
+// set, swap their own tags and write it back, one at a time.
+var objectTagsMu sync.Mutex
+
+// replaceObjectTags replaces the tags of key's object that owned matches
+// with tags, keeping the others.
+func (s3c *S3Client) replaceObjectTags(ctx context.Context, key string, owned func(name string) bool, tags []types.Tag) error {
+	objectTagsMu.Lock()
+	defer objectTagsMu.Unlock()
+
+	current, err := s3c.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	set := slices.DeleteFunc(current.TagSet, func(tag types.Tag) bool { return owned(aws.ToString(tag.Key)) })
+	set = append(set, tags...)
+
+	_, err = s3c.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(s3c.bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: set},
+	})
+	return err
+}
+
+// mirrorTags makes key's object carry tags as its user tags.
+func (s3c *S3Client) mirrorTags(ctx context.Context, key string, tags []string) error {
+	objectTags := make([]types.Tag, 0, len(tags))
+	for _, tag := range tags {
+		objectTags = append(objectTags, types.Tag{Key: aws.String(OBJECT_TAG_PREFIX + tag), Value: aws.String("")})
+	}
+	isUserTag := func(name string) bool { return strings.HasPrefix(name, OBJECT_TAG_PREFIX) }
+	return s3c.replaceObjectTags(ctx, key, isUserTag, objectTags)
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) UpdateTags(ctx context.Context, key string, add, remove []string) ([]string, error) {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, `SELECT 1 FROM files WHERE s3_key = $1 AND deleted_at IS NULL`, key).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errFileNotRecorded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range remove {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM file_tags WHERE s3_key = $1 AND tag = $2`, key, tag); err != nil {
+			return nil, err
+		}
+	}
+	for _, tag := range add {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO file_tags (s3_key, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING`, key, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	tags, err := queryTags(ctx, tx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > FILE_MAX_TAGS {
+		return nil, errTooManyTags
+	}
+	return tags, tx.Commit()
+}
+
+func (ms *sqlMetadataStore) FindFiles(ctx context.Context, owner string, tags []string, limit int) ([]FileRecord, error) {
+	// $1 owner, then the tags, how many there are and the limit
+	args := []any{owner}
+	placeholders := make([]string, 0, len(tags))
+	for _, tag := range slices.Compact(slices.Sorted(slices.Values(tags))) {
+		args = append(args, tag)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+	}
+	args = append(args, len(placeholders), limit)
+
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT s3_key, owner, file_name, version, size, checksum, content_type, created_at, completed_at
+		FROM files
+		WHERE owner = $1 AND deleted_at IS NULL AND s3_key IN (
+			SELECT s3_key FROM file_tags WHERE tag IN (`+strings.Join(placeholders, ", ")+`)
+			GROUP BY s3_key HAVING COUNT(*) = $`+strconv.Itoa(len(args)-1)+`
+		)
+		ORDER BY completed_at DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]FileRecord, 0)
+	for rows.Next() {
+		var file FileRecord
+		if err := rows.Scan(&file.Key, &file.Owner, &file.FileName, &file.Version, &file.Size, &file.Checksum, &file.ContentType, &file.CreatedAt, &file.CompletedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func (ms *sqlMetadataStore) ListTags(ctx context.Context, owner string) ([]TagCount, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT t.tag, COUNT(*)
+		FROM file_tags t JOIN files f ON f.s3_key = t.s3_key
+		WHERE f.owner = $1 AND f.deleted_at IS NULL
+		GROUP BY t.tag
+		ORDER BY t.tag`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]TagCount, 0)
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Files); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tc)
+	}
+	return tags, rows.Err()
+}
+
+// sqlQuerier is a *sql.DB or a *sql.Tx.
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// queryTags returns the tags of key's file, sorted.
+func queryTags(ctx context.Context, q sqlQuerier, key string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT tag FROM file_tags WHERE s3_key = $1 ORDER BY tag`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,293 @@
+// tenants.go - Isolated customers sharing one deployment
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Tenants
+// ============================================
+
+// Each tenant in TENANTS_FILE is a customer of the deployment, with its own
+// tokens and limits:
+//
+//	{
+//	  "acme": {
+//	    "max_file_size": 5368709120,
+//	    "max_chunk_size": 104857600,
+//	    "extensions": [".mp4", ".mov"],
+//	    "quota_bytes": 1099511627776,
+//	    "max_sessions": 50,
+//	    "retention": [{"days": 30, "action": "delete"}],
+//	    "tokens": {
+//	      "<token>": {"user_id": "alice", "username": "Alice", "expires_at": "2027-01-01T00:00:00Z"}
+//	    }
+//	  }
+//	}
+//
+// A tenant's user is known to the server as tenants/<tenant>/<user_id>, and
+// that is their UserID everywhere a user ID goes: their S3 keys start with
+// it, and the session and file APIs, which check ownership against it, keep
+// tenants apart without knowing about them. Tokens outside any tenant (the
+// default tenant) keep plain user IDs, so "tenants" is reserved there
+// (reservedKeyRoot, jwt.go).
+//
+// Limits left out or 0 are the server's: MAX_FILE_SIZE, MAX_CHUNK_SIZE and
+// every supported extension, with no quota or session cap; a tenant's limits
+// can only be lower. CreateSession checks file size, chunk size and
+// extension, for both protocols. Before it, createSession checks the session
+// cap and the quota, which counts the bytes the tenant's users have stored
+// (from the usage meter) plus the declared size of their open sessions. A
+// tenant with "disabled": true keeps its files but its tokens are refused.
+// Retention rules are retention.go's.
+//
+//	GET /admin/tenants   each tenant's limits, stored bytes and open sessions
+
+const TENANT_KEY_ROOT = "tenants/"
+
+var TENANTS_FILE = envString("TENANTS_FILE", "")
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+type Tenant struct {
+	ID           string                 `json:"-"`
+	MaxFileSize  uint64                 `json:"max_file_size"`
+	MaxChunkSize uint32                 `json:"max_chunk_size"`
+	Extensions   []string               `json:"extensions"`
+	QuotaBytes   uint64                 `json:"quota_bytes"`
+	MaxSessions  int                    `json:"max_sessions"`
+	Disabled     bool                   `json:"disabled"`
+	Retention    []RetentionRule        `json:"retention"`
+	Tokens       map[string]TenantToken `json:"tokens"`
+
+	mu sync.Mutex // Serializes the quota check and creation of sessions
+}
+
+type TenantToken struct {
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"` // Zero for a token that does not expire
+}
+
+type TenantStatus struct {
+	ID           string   `json:"id"`
+	Disabled     bool     `json:"disabled"`
+	Tokens       int      `json:"tokens"`
+	MaxFileSize  uint64   `json:"max_file_size"`
+	MaxChunkSize uint32   `json:"max_chunk_size"`
+	Extensions   []string `json:"extensions,omitempty"`
+	QuotaBytes   uint64   `json:"quota_bytes,omitempty"`
+	StoredBytes  uint64   `json:"stored_bytes"`
+	MaxSessions  int      `json:"max_sessions,omitempty"`
+	OpenSessions int      `json:"open_sessions"`
+}
+
+// The limits of a tenant, nil for the default tenant
+
+func (t *Tenant) maxFileSize() uint64 {
+	if t == nil || t.MaxFileSize == 0 {
+		return MAX_FILE_SIZE
+	}
+	return t.MaxFileSize
+}
+
+func (t *Tenant) maxChunkSize() uint32 {
+	if t == nil || t.MaxChunkSize == 0 {
+		return MAX_CHUNK_SIZE
+	}
+	return t.MaxChunkSize
+}
+
+func (t *Tenant) allowsExtension(ext string) bool {
+	return t == nil || len(t.Extensions) == 0 || slices.Contains(t.Extensions, ext)
+}
+
+// userPrefix is the start of every user ID, and so every key, of t's users.
+func (t *Tenant) userPrefix() string {
+	return TENANT_KEY_ROOT + t.ID + "/"
+}
+
+// tenantOf returns the tenant of userID, nil for the default tenant.
+func (fus *FileUploadServer) tenantOf(userID string) *Tenant {
+	rest, ok := strings.CutPrefix(userID, TENANT_KEY_ROOT)
+	if !ok {
+		return nil
+	}
+	id, _, _ := strings.Cut(rest, "/")
+	return fus.tenants[id]
+}
+
+// keyOwner returns the user ID an upload's key starts with.
+func keyOwner(key string) string {
+	segments := 1
+	if strings.HasPrefix(key, TENANT_KEY_ROOT) {
+		segments = 3 // tenants/<tenant>/<user_id>
+	}
+	parts := strings.SplitN(key, "/", segments+1)
+	if len(parts) <= segments {
+		return ""
+	}
+	return strings.Join(parts[:segments], "/")
+}
+
+// LoadTenants reads TENANTS_FILE, if set, and registers the tokens of every
+// enabled tenant with authMgr.
+func LoadTenants(path string, authMgr *AuthManager) (map[string]*Tenant, error) {
+	tenants := make(map[string]*Tenant)
+	if path == "" {
+		return tenants, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	for id, tenant := range tenants {
+		tenant.ID = id
+		if err := tenant.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", id, err)
+		}
+		if tenant.Disabled {
+			continue
+		}
+		for token, tt := range tenant.Tokens {
+			authMgr.addTenantToken(token, tenant, tt)
+		}
+	}
+	authLog.Info("loaded tenants", "file", path, "tenants", len(tenants))
+	return tenants, nil
+}
+
+func (am *AuthManager) addTenantToken(token string, tenant *Tenant, tt TenantToken) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.tokens[token] = &TokenInfo{
+		UserID:    tenant.userPrefix() + tt.UserID,
+		Username:  tt.Username,
+		ExpiresAt: tt.ExpiresAt,
+		Tenant:    tenant,
+	}
+}
+
+func (t *Tenant) validate() error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("invalid tenant ID: 1 to 64 lowercase letters, digits, '_' or '-'")
+	}
+	if t.MaxFileSize > MAX_FILE_SIZE {
+		return fmt.Errorf("max_file_size above the server's %d", MAX_FILE_SIZE)
+	}
+	if t.MaxChunkSize > MAX_CHUNK_SIZE {
+		return fmt.Errorf("max_chunk_size above the server's %d", MAX_CHUNK_SIZE)
+	}
+	if err := normalizeExtensions(t.Extensions); err != nil {
+		return err
+	}
+	if err := validateRetentionRules(t.Retention); err != nil {
+		return err
+	}
+	for _, tt := range t.Tokens {
+		if tt.UserID == "" || strings.Contains(tt.UserID, "/") {
+			return fmt.Errorf("invalid user_id %q", tt.UserID)
+		}
+	}
+	return nil
+}
+
+// normalizeExtensions lowercases extensions in place, with their dot, and
+// checks that each is supported.
+func normalizeExtensions(extensions []string) error {
+	for i, ext := range extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if _, ok := SUPPORTED_EXTENSIONS[ext]; !ok {
+			return fmt.Errorf("unsupported extension %s", ext)
+		}
+		extensions[i] = ext
+	}
+	return nil
+}
+
+// checkTenantLimits refuses a new session of totalSize bytes for a tenant at
+// its session cap or quota. The caller holds tenant.mu until the session is
+// created.
+func (fus *FileUploadServer) checkTenantLimits(tenant *Tenant, totalSize uint64) error {
+	if tenant.QuotaBytes == 0 && tenant.MaxSessions == 0 {
+		return nil
+	}
+
+	open, reserved := fus.openTenantSessions(tenant)
+	if tenant.MaxSessions > 0 && open >= tenant.MaxSessions {
+		return fmt.Errorf("too many open uploads: %d (max: %d)", open, tenant.MaxSessions)
+	}
+	if tenant.QuotaBytes > 0 {
+		used := fus.usage.StoredBytes(tenant.userPrefix()) + reserved
+		if used+totalSize > tenant.QuotaBytes {
+			return fmt.Errorf("storage quota exceeded: %d bytes used or reserved, %d requested (quota: %d)", used, totalSize, tenant.QuotaBytes)
+		}
+	}
+	return nil
+}
+
+// openTenantSessions counts the tenant's sessions that may still store a
+// file, and the bytes they declared.
+func (fus *FileUploadServer) openTenantSessions(tenant *Tenant) (open int, bytes uint64) {
+	return fus.openSessions(func(userID string) bool { return strings.HasPrefix(userID, tenant.userPrefix()) })
+}
+
+// openSessions counts the sessions of the users matched by owned that may
+// still store a file, and the bytes they declared.
+func (fus *FileUploadServer) openSessions(owned func(userID string) bool) (open int, bytes uint64) {
+	for _, session := range fus.sessionMgr.Sessions() {
+		if !owned(session.UserID) {
+			continue
+		}
+		session.mu.Lock()
+		switch session.State {
+		case STATE_COMPLETED, STATE_CANCELLED, STATE_FAILED:
+		default:
+			open++
+			bytes += session.TotalSize
+		}
+		session.mu.Unlock()
+	}
+	return open, bytes
+}
+
+// GET /admin/tenants
+func (hs *HTTPServer) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]TenantStatus, 0, len(hs.uploads.tenants))
+	for _, tenant := range hs.uploads.tenants {
+		open, _ := hs.uploads.openTenantSessions(tenant)
+		statuses = append(statuses, TenantStatus{
+			ID:           tenant.ID,
+			Disabled:     tenant.Disabled,
+			Tokens:       len(tenant.Tokens),
+			MaxFileSize:  tenant.maxFileSize(),
+			MaxChunkSize: tenant.maxChunkSize(),
+			Extensions:   tenant.Extensions,
+			QuotaBytes:   tenant.QuotaBytes,
+			StoredBytes:  hs.usage.StoredBytes(tenant.userPrefix()),
+			MaxSessions:  tenant.MaxSessions,
+			OpenSessions: open,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tenants": statuses})
+}
@@ -0,0 +1,173 @@
+// tls.go - TLS listener for the binary protocol
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Binary TLS
+// ============================================
+
+// The binary port is plaintext: tokens and file contents cross the wire as
+// they are. With GNET_TLS_ADDR set the server also listens there for TLS,
+// with the certificate chain and key in GNET_TLS_CERT and GNET_TLS_KEY. With
+// GNET_TLS_CLIENT_CA set as well, a client must present a certificate signed
+// by one of the CAs in that file; the auth token is still required.
+//
+// gnet has no TLS, and its event loops only take connections they can poll
+// themselves. Each TLS connection is therefore decrypted by crypto/tls in
+// goroutines of its own, which pass the plaintext through a socketpair whose
+// other end is registered with the event loops and handled like any
+// connection of the plaintext port. It logs, rate-limits and audits the
+// client's address, which OnOpen takes from the bridgedPeer the socket was
+// registered with. The extra copy costs CPU at high rates; a TLS-terminating
+// load balancer in front of the plaintext port avoids it.
+//
+// The plaintext port stays open. To accept only TLS, bind GNET_ADDR to an
+// address clients cannot reach, e.g. 127.0.0.1:8081.
+
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var (
+	GNET_TLS_ADDR      = envString("GNET_TLS_ADDR", "")
+	GNET_TLS_CERT      = envString("GNET_TLS_CERT", "")
+	GNET_TLS_KEY       = envString("GNET_TLS_KEY", "")
+	GNET_TLS_CLIENT_CA = envString("GNET_TLS_CLIENT_CA", "")
+)
+
+// bridgedPeer is the gnet context a socket from registerSocket is registered
+// with, until OnOpen replaces it.
+type bridgedPeer struct {
+	remoteAddr string
+}
+
+// loadTLSConfig builds the listener's config, or returns nil when
+// GNET_TLS_ADDR is not set.
+func loadTLSConfig() (*tls.Config, error) {
+	if GNET_TLS_ADDR == "" {
+		return nil, nil
+	}
+	if GNET_TLS_CERT == "" || GNET_TLS_KEY == "" {
+		return nil, errors.New("GNET_TLS_ADDR needs GNET_TLS_CERT and GNET_TLS_KEY")
+	}
+	cert, err := tls.LoadX509KeyPair(GNET_TLS_CERT, GNET_TLS_KEY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if GNET_TLS_CLIENT_CA != "" {
+		pem, err := os.ReadFile(GNET_TLS_CLIENT_CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", GNET_TLS_CLIENT_CA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serveTLS accepts TLS connections on GNET_TLS_ADDR until the listener fails.
+func (fus *FileUploadServer) serveTLS(cfg *tls.Config) {
+	ln, err := net.Listen("tcp", GNET_TLS_ADDR)
+	if err != nil {
+		logFatal(serverLog, "failed to listen for TLS", "addr", GNET_TLS_ADDR, "err", err)
+	}
+	serverLog.Info("binary TLS listening", "addr", GNET_TLS_ADDR, "client_certs", cfg.ClientAuth == tls.RequireAndVerifyClientCert)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logFatal(serverLog, "TLS listener stopped", "addr", GNET_TLS_ADDR, "err", err)
+		}
+		go fus.handleTLS(tls.Server(conn, cfg))
+	}
+}
+
+func (fus *FileUploadServer) handleTLS(conn *tls.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		protoLog.Debug("TLS handshake failed", "remote", remote, "err", err)
+		tlsHandshakeFailures.Inc()
+		return
+	}
+
+	local, err := fus.registerSocket(remote)
+	if err != nil {
+		protoLog.Error("failed to register TLS connection", "remote", remote, "err", err)
+		return
+	}
+	defer local.Close()
+
+	// Either side closing ends both: the client's close reaches the event
+	// loop as EOF, and the loop's close ends the copy to the client
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// registerSocket hands one end of a new socketpair to the event loops, as a
+// connection from remote, and returns the other. WebSocket connections
+// (websocket.go) come in the same way.
+func (fus *FileUploadServer) registerSocket(remote string) (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local, err := fileConn(fds[0])
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+	loop, err := fileConn(fds[1])
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	// gnet duplicates the socket, so this one is closed either way
+	defer loop.Close()
+
+	ctx := gnet.NewNetConnContext(gnet.NewContext(context.Background(), &bridgedPeer{remoteAddr: remote}), loop)
+	registered, err := fus.eng.Register(ctx)
+	if err == nil {
+		err = (<-registered).Err
+	}
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	return local, nil
+}
+
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "socketpair")
+	defer f.Close()
+	return net.FileConn(f)
+}
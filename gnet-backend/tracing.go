@@ -0,0 +1,61 @@
+// tracing.go - OpenTelemetry tracing setup
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// ============================================
+// Tracing
+// ============================================
+
+const TRACING_SERVICE_NAME = "gnet-file-server"
+
+var tracer = otel.Tracer(TRACING_SERVICE_NAME)
+
+// initTracing installs an OTLP/HTTP trace exporter when
+// OTEL_EXPORTER_OTLP_ENDPOINT (or the traces-specific variant) is set. The
+// exporter reads the standard OTEL_* variables for everything else. Without
+// an endpoint the global no-op provider stays in place.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	// Always accept W3C trace context so HTTP requests from the gateway join its trace
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(TRACING_SERVICE_NAME),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	serverLog.Info("OpenTelemetry tracing enabled", "exporter", "otlp/http")
+	return provider.Shutdown, nil
+}
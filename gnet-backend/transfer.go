@@ -0,0 +1,452 @@
+// transfer.go - Copying files to other users and handing them over
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ============================================
+// Copies and Transfers
+// ============================================
+
+// A grant (acl.go) lets a colleague reach a file; sometimes they need it as
+// their own. A user can copy a file they can read, their own or granted to
+// them, into another user's folder (or their own), and hand a file or a
+// folder of their own over to another user of the same tenant:
+//
+//	POST /files/copy        {"key" | "prefix", "user_id", ["after"]}
+//	POST /files/transfer    {"key" | "prefix", "user_id", ["after"]}
+//	POST /admin/transfers   {"from", "to", ["prefix"], ["copy"], ["after"]}
+//
+// The admin route is for someone who has left: it copies or transfers every
+// file of "from" (under "prefix" within their folder, if given) to "to".
+//
+// A file keeps its path: alice/20240101_120000/plan.pdf goes to
+// bob/20240101_120000/plan.pdf, and becomes the next version of that path
+// among bob's files (versions.go). The object is copied as trash.go copies,
+// so its checksum is unchanged, and recorded as the recipient's with its
+// attributes; the recipient's quota must have room for it. A copy starts out
+// untagged, with no comments and no grants. A transfer takes the file's
+// tags, comments, stars and share links along, and the owner's grants that
+// reached it become the recipient's grants of the new key, so whoever could
+// read it still can. The original is then removed: not to the trash, as
+// the file lives on. Files under legal hold or immutable cannot be
+// transferred, only copied.
+//
+// A key answers with the new file, or the error that stopped it. A prefix
+// answers with a report of the files done and those that failed, at most
+// TRANSFER_MAX_FILES at a time in key order; if it is truncated, the same
+// request with "after" set to the report's "next" goes on from there.
+// Copying to a key the recipient already has fails with 409.
+
+const TRANSFER_MAX_FILES = 1000
+
+var errNoRoom = errors.New("Recipient has no room for the file")
+
+type TransferRequest struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	UserID string `json:"user_id"`
+	After  string `json:"after"`
+}
+
+type AdminTransferRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Prefix string `json:"prefix"` // Within from's folder; empty for all of it
+	Copy   bool   `json:"copy"`
+	After  string `json:"after"`
+}
+
+type TransferredFile struct {
+	Key    string `json:"key"`
+	NewKey string `json:"new_key"`
+	Size   int64  `json:"size"`
+}
+
+type TransferFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type TransferReport struct {
+	To        string            `json:"to"`
+	Copy      bool              `json:"copy"`
+	Files     []TransferredFile `json:"files"`
+	Bytes     int64             `json:"bytes"`
+	Failed    []TransferFailure `json:"failed"`
+	Truncated bool              `json:"truncated"`
+	Next      string            `json:"next,omitempty"` // "after" for the rest
+}
+
+func (hs *HTTPServer) registerTransferRoutes() {
+	hs.mux.HandleFunc("POST /files/copy", func(w http.ResponseWriter, r *http.Request) { hs.handleTransfer(w, r, true) })
+	hs.mux.HandleFunc("POST /files/transfer", func(w http.ResponseWriter, r *http.Request) { hs.handleTransfer(w, r, false) })
+	hs.mux.Handle("POST /admin/transfers", requireAdmin(http.HandlerFunc(hs.handleAdminTransfer)))
+}
+
+// POST /files/copy
+// POST /files/transfer
+func (hs *HTTPServer) handleTransfer(w http.ResponseWriter, r *http.Request, copyOnly bool) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	path := req.Key
+	if (req.Key == "") == (req.Prefix == "") {
+		writeJSONError(w, http.StatusBadRequest, "Either key or prefix is required")
+		return
+	}
+	if req.Prefix != "" {
+		path = req.Prefix
+	}
+	// Copies may be of files granted to the caller, transfers only of their own
+	if copyOnly {
+		if !hs.authorize(w, r, tokenInfo.UserID, path, ACCESS_READ) {
+			return
+		}
+	} else if !strings.HasPrefix(path, tokenInfo.UserID+"/") {
+		writeJSONError(w, http.StatusForbidden, "File does not belong to user")
+		return
+	}
+	if msg := hs.uploads.checkRecipient(keyOwner(path), req.UserID); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	ctx := r.Context()
+	if req.Key != "" {
+		file, err := hs.uploads.transferFile(ctx, req.Key, req.UserID, tokenInfo.UserID, r.RemoteAddr, copyOnly)
+		if writeTransferError(w, r, req.Key, err) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, file)
+		return
+	}
+	report, err := hs.uploads.transferFiles(ctx, req.Prefix, req.After, req.UserID, tokenInfo.UserID, r.RemoteAddr, copyOnly)
+	if err != nil {
+		s3Log.ErrorContext(ctx, "failed to list files to transfer", "prefix", req.Prefix, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to list files")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// POST /admin/transfers
+func (hs *HTTPServer) handleAdminTransfer(w http.ResponseWriter, r *http.Request) {
+	var req AdminTransferRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.From == "" || keyOwner(req.From+"/") != req.From {
+		writeJSONError(w, http.StatusBadRequest, "Invalid from")
+		return
+	}
+	if msg := hs.uploads.checkRecipient(req.From, req.To); msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	prefix := req.From + "/" + strings.TrimPrefix(req.Prefix, "/")
+	// A transfer stopped halfway is safe, but the report would be cut short
+	ctx := context.WithoutCancel(r.Context())
+	report, err := hs.uploads.transferFiles(ctx, prefix, req.After, req.To, "admin", r.RemoteAddr, req.Copy)
+	if err != nil {
+		s3Log.ErrorContext(ctx, "failed to list files to transfer", "prefix", prefix, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to list files")
+		return
+	}
+	httpLog.InfoContext(ctx, "transferred user files", "from", req.From, "to", req.To, "prefix", prefix, "copy", req.Copy,
+		"files", len(report.Files), "failed", len(report.Failed), "truncated", report.Truncated)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// checkRecipient returns why the files of owner cannot go to to, or "".
+// Like grants, they only go within a tenant.
+func (fus *FileUploadServer) checkRecipient(owner, to string) string {
+	switch {
+	case to == "" || keyOwner(to+"/") != to:
+		return "Invalid user_id"
+	case to == owner:
+		return "Files already belong to this user"
+	case fus.tenantOf(to) != fus.tenantOf(owner) || (fus.tenantOf(to) == nil && strings.HasPrefix(to, TENANT_KEY_ROOT)):
+		return "Files can only go to a user of the same tenant"
+	}
+	return ""
+}
+
+// writeTransferError answers a failed copy or transfer of key and reports
+// whether there was an error.
+func writeTransferError(w http.ResponseWriter, r *http.Request, key string, err error) bool {
+	if errors.Is(err, errNoRoom) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return true
+	}
+	return writeTrashError(w, r, key, err)
+}
+
+// ============================================
+// Transferring
+// ============================================
+
+// transferFiles copies or transfers the files under prefix after the key
+// after to the user to, on behalf of actor.
+func (fus *FileUploadServer) transferFiles(ctx context.Context, prefix, after, to, actor, remoteAddr string, copyOnly bool) (*TransferReport, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(fus.s3Client.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if after != "" {
+		input.StartAfter = aws.String(after)
+	}
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(fus.s3Client.client, input)
+	for paginator.HasMorePages() && len(keys) <= TRANSFER_MAX_FILES {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+
+	report := &TransferReport{To: to, Copy: copyOnly, Files: make([]TransferredFile, 0), Failed: make([]TransferFailure, 0)}
+	if len(keys) > TRANSFER_MAX_FILES {
+		keys, report.Truncated = keys[:TRANSFER_MAX_FILES], true
+		report.Next = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		file, err := fus.transferFile(ctx, key, to, actor, remoteAddr, copyOnly)
+		if err != nil {
+			report.Failed = append(report.Failed, TransferFailure{Key: key, Error: err.Error()})
+			continue
+		}
+		report.Files = append(report.Files, *file)
+		report.Bytes += file.Size
+	}
+	return report, nil
+}
+
+// transferFile copies key to the same path in to's folder and, unless copy,
+// moves what belongs to the file along and removes key.
+func (fus *FileUploadServer) transferFile(ctx context.Context, key, to, actor, remoteAddr string, copyOnly bool) (*TransferredFile, error) {
+	owner := keyOwner(key)
+	newKey := to + strings.TrimPrefix(key, owner)
+	if !copyOnly {
+		if err := fus.checkLegalHold(ctx, key); err != nil {
+			return nil, err
+		}
+		if err := fus.checkImmutable(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+
+	s3Client := fus.s3Client
+	head, err := s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	size := aws.ToInt64(head.ContentLength)
+	if err := fus.checkRecipientRoom(to, uint64(size), copyOnly); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoRoom, err)
+	}
+	_, err = s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(newKey),
+	})
+	if err == nil {
+		return nil, errFileExists
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+	if _, err := s3Client.copyObject(ctx, key, newKey); err != nil {
+		return nil, err
+	}
+
+	// Either the file is the recipient's, with what goes along, or the copy
+	// is removed again
+	if err := fus.recordTransfer(ctx, key, newKey, to, copyOnly); err != nil {
+		if err := s3Client.deleteObject(context.WithoutCancel(ctx), newKey); err != nil {
+			s3Log.ErrorContext(ctx, "failed to remove copy of file not transferred", "key", newKey, "err", err)
+		}
+		return nil, err
+	}
+	if copyOnly {
+		// The source's tags are its owner's
+		if err := s3Client.mirrorTags(ctx, newKey, nil); err != nil {
+			s3Log.WarnContext(ctx, "failed to clear copied object tags", "s3_key", newKey, "err", err)
+		}
+	} else {
+		if err := fus.transferGrants(ctx, owner, key, newKey, to); err != nil {
+			serverLog.WarnContext(ctx, "failed to transfer grants", "key", key, "new_key", newKey, "err", err)
+		}
+		if err := s3Client.deleteObject(ctx, key); err != nil {
+			s3Log.ErrorContext(ctx, "failed to remove transferred file", "key", key, "new_key", newKey, "err", err)
+		}
+		if err := fus.metadata.DeleteFile(ctx, key); err != nil {
+			serverLog.WarnContext(ctx, "failed to delete transferred file metadata", "key", key, "err", err)
+		}
+		fus.usage.RecordDeleted(owner, uint64(size))
+	}
+	fus.usage.RecordStored(to, uint64(size))
+	fus.indexer.Enqueue(newKey, aws.ToString(head.ContentType))
+
+	event, verb := AUDIT_FILE_TRANSFERRED, "transferred"
+	if copyOnly {
+		event, verb = AUDIT_FILE_COPIED, "copied"
+	} else {
+		fus.activity.Record(ACTIVITY_FILE_TRANSFERRED, key, actor, "To "+to)
+	}
+	fus.activity.Record(ACTIVITY_FILE_RECEIVED, newKey, actor, "From "+owner)
+	auditLog.Record(event, owner, "", remoteAddr, key+" -> "+newKey+" by "+actor)
+	serverLog.InfoContext(ctx, verb+" file", "key", key, "new_key", newKey, "actor", actor, "size", size)
+	return &TransferredFile{Key: key, NewKey: newKey, Size: size}, nil
+}
+
+// checkRecipientRoom checks the quotas of to for size more bytes. A transfer
+// stays within the tenant, so only a copy takes more of its quota.
+func (fus *FileUploadServer) checkRecipientRoom(to string, size uint64, copyOnly bool) error {
+	if tenant := fus.tenantOf(to); tenant != nil && copyOnly {
+		tenant.mu.Lock()
+		err := fus.checkTenantLimits(tenant, size)
+		tenant.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if quota := fus.userQuota(to); quota > 0 {
+		fus.quotaMu.Lock()
+		defer fus.quotaMu.Unlock()
+		return fus.checkUserQuota(to, quota, size)
+	}
+	return nil
+}
+
+// recordTransfer records newKey as to's, with key's attributes, and on a
+// transfer also its tags, comments, stars and shares. Without a record of
+// key there is nothing to record.
+func (fus *FileUploadServer) recordTransfer(ctx context.Context, key, newKey, to string, copyOnly bool) error {
+	source, err := fus.metadata.GetFile(ctx, key)
+	if errors.Is(err, errFileNotRecorded) || errors.Is(err, errMetadataDisabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	file := &FileRecord{
+		Key:         newKey,
+		Owner:       to,
+		FileName:    source.FileName,
+		Size:        source.Size,
+		Checksum:    source.Checksum,
+		SHA256:      source.SHA256,
+		ContentType: source.ContentType,
+		CreatedAt:   source.CreatedAt,
+		CompletedAt: source.CompletedAt,
+		Attributes:  source.Attributes,
+	}
+	if copyOnly {
+		now := time.Now().UTC()
+		file.CreatedAt, file.CompletedAt = now, now
+	}
+	if err := fus.metadata.PutFile(ctx, file); err != nil {
+		return err
+	}
+	if copyOnly {
+		return nil
+	}
+	if len(source.Tags) > 0 {
+		_, err = fus.metadata.UpdateTags(ctx, newKey, source.Tags, nil)
+	}
+	if err == nil {
+		err = fus.metadata.MoveFileRefs(ctx, key, newKey, to)
+	}
+	if err != nil {
+		if err := fus.metadata.DeleteFile(context.WithoutCancel(ctx), newKey); err != nil {
+			serverLog.WarnContext(ctx, "failed to delete record of file not transferred", "key", newKey, "err", err)
+		}
+	}
+	return err
+}
+
+// transferGrants gives everyone owner granted key the same access to newKey,
+// now to's, and drops owner's grants of key itself.
+func (fus *FileUploadServer) transferGrants(ctx context.Context, owner, key, newKey, to string) error {
+	grants, err := fus.metadata.ListGrants(ctx, owner)
+	if errors.Is(err, errMetadataDisabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	access := make(map[string]string) // By grantee, the most they had
+	for _, grant := range grants {
+		if !grant.covers(key) {
+			continue
+		}
+		if grant.Path == key {
+			if err := fus.metadata.DeleteGrant(ctx, owner, key, grant.UserID); err != nil && !errors.Is(err, errGrantNotFound) {
+				return err
+			}
+		}
+		if grant.UserID != to && access[grant.UserID] != ACCESS_WRITE {
+			access[grant.UserID] = grant.Access
+		}
+	}
+	now := time.Now().UTC()
+	for grantee, level := range access {
+		grant := &Grant{Path: newKey, Owner: to, UserID: grantee, Access: level, CreatedAt: now}
+		if err := fus.metadata.PutGrant(ctx, grant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) MoveFileRefs(ctx context.Context, from, to, owner string) error {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"comments", "stars", "file_verifications"} {
+		if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET s3_key = $1 WHERE s3_key = $2`, to, from); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE shares SET s3_key = $1, owner = $2 WHERE s3_key = $3`, to, owner, from); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
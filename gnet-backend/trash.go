@@ -0,0 +1,442 @@
+// trash.go - Deleting files through a trash they can be restored from
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ============================================
+// Trash
+// ============================================
+
+// Deleting a file moves it to <TRASH_PREFIX>/<key>, where it stays for
+// TRASH_RETENTION_DAYS before the purge job removes it for good; until then
+// it can be restored to its key. With TRASH_RETENTION_DAYS=0 a delete is
+// final.
+//
+//	DELETE /files/{key...}   move to the trash
+//	GET    /files/trash      the caller's trashed files, most recently deleted first
+//	POST   /files/restore    {"key"}: move back, unless a file took its key meanwhile
+//
+// The trash copy keeps the file's content type, metadata and object tags,
+// and is copied in the file's own part size, so its multipart ETag (and the
+// checksum clients verify downloads against) survives a delete and restore.
+// Its LastModified is the time of deletion. In the metadata store the file's
+// record stays, marked deleted_at, and goes when the file is purged.
+//
+// Trashed files are outside the user's prefix, so they are neither listed
+// nor served, and shares of them (shares.go) answer 404 until restored.
+
+var (
+	TRASH_PREFIX         = envString("TRASH_PREFIX", "_trash")
+	TRASH_RETENTION_DAYS = envInt("TRASH_RETENTION_DAYS", 30)
+	TRASH_PURGE_INTERVAL = time.Duration(envInt("TRASH_PURGE_MINUTES", 60)) * time.Minute
+)
+
+// S3 copies at most 5 GiB per request, so larger objects are copied in parts.
+const COPY_PART_MAX = 5 * 1024 * 1024 * 1024
+
+var errFileExists = errors.New("A file already exists at this key")
+
+type TrashedFile struct {
+	Key       string    `json:"key"` // Where it is restored to
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+type RestoreRequest struct {
+	Key string `json:"key"`
+}
+
+func (hs *HTTPServer) registerTrashRoutes() {
+	hs.mux.HandleFunc("DELETE /files/{key...}", hs.handleDeleteFile)
+	hs.mux.HandleFunc("GET /files/trash", hs.handleListTrash)
+	hs.mux.HandleFunc("POST /files/restore", hs.handleRestoreFile)
+}
+
+func trashKey(key string) string {
+	return TRASH_PREFIX + "/" + key
+}
+
+func trashedFile(key string, size int64, deletedAt time.Time) TrashedFile {
+	return TrashedFile{
+		Key:       key,
+		Size:      size,
+		DeletedAt: deletedAt.UTC(),
+		PurgeAt:   deletedAt.UTC().AddDate(0, 0, TRASH_RETENTION_DAYS),
+	}
+}
+
+// DELETE /files/{key...}
+func (hs *HTTPServer) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	key := r.PathValue("key")
+	if !hs.authorize(w, r, tokenInfo.UserID, key, ACCESS_WRITE) {
+		return
+	}
+
+	ctx := r.Context()
+	trashed, err := hs.uploads.deleteFile(ctx, key)
+	if writeTrashError(w, r, key, err) {
+		return
+	}
+	auditLog.Record(AUDIT_FILE_DELETED, tokenInfo.UserID, "", r.RemoteAddr, key)
+	hs.uploads.activity.Record(ACTIVITY_FILE_DELETED, key, tokenInfo.UserID, "")
+	httpLog.InfoContext(ctx, "deleted file", "key", key, "trash", trashed != nil)
+
+	if trashed == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, trashed)
+}
+
+// deleteFile moves key to the trash, or with TRASH_RETENTION_DAYS=0 deletes
+// it for good, and updates its metadata record. trashed is nil for a final
+// delete. A file under legal hold (legalhold.go) is errLegalHold, and one
+// still locked (immutable.go) errImmutable.
+func (fus *FileUploadServer) deleteFile(ctx context.Context, key string) (trashed *TrashedFile, err error) {
+	if err := fus.checkLegalHold(ctx, key); err != nil {
+		return nil, err
+	}
+	if err := fus.checkImmutable(ctx, key); err != nil {
+		return nil, err
+	}
+
+	s3Client := fus.s3Client
+	var size int64
+	if TRASH_RETENTION_DAYS > 0 {
+		size, err = s3Client.copyObject(ctx, key, trashKey(key))
+		if err != nil {
+			return nil, err
+		}
+		file := trashedFile(key, size, time.Now())
+		trashed = &file
+	} else {
+		head, err := s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s3Client.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		size = aws.ToInt64(head.ContentLength)
+	}
+
+	if err := s3Client.deleteObject(ctx, key); err != nil {
+		return nil, err
+	}
+
+	if trashed != nil {
+		err := fus.metadata.SetDeleted(ctx, key, trashed.DeletedAt)
+		if err != nil {
+			serverLog.WarnContext(ctx, "failed to mark file deleted in metadata", "key", key, "err", err)
+		}
+	} else {
+		// Storage is freed now rather than at the purge
+		fus.usage.RecordDeleted(keyOwner(key), uint64(size))
+		if err := fus.metadata.DeleteFile(ctx, key); err != nil {
+			serverLog.WarnContext(ctx, "failed to delete file metadata", "key", key, "err", err)
+		}
+	}
+	return trashed, nil
+}
+
+// GET /files/trash
+func (hs *HTTPServer) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	files, truncated, err := listFiles(r.Context(), s3Client, trashKey(tokenInfo.UserID+"/"))
+	if err != nil {
+		s3Log.ErrorContext(r.Context(), "failed to list trash", "user_id", tokenInfo.UserID, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to list trash")
+		return
+	}
+
+	trashed := make([]TrashedFile, 0, len(files))
+	for _, f := range files {
+		trashed = append(trashed, trashedFile(strings.TrimPrefix(f.Key, trashKey("")), f.Size, f.LastModified))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"files": trashed, "truncated": truncated})
+}
+
+// POST /files/restore
+func (hs *HTTPServer) handleRestoreFile(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req RestoreRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if !strings.HasPrefix(req.Key, tokenInfo.UserID+"/") {
+		writeJSONError(w, http.StatusForbidden, "File does not belong to user")
+		return
+	}
+
+	s3Client := hs.sessionMgr.s3Client
+	ctx := r.Context()
+	_, err := s3Client.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Client.bucket),
+		Key:    aws.String(req.Key),
+	})
+	if err == nil {
+		err = errFileExists
+	} else if isNotFound(err) {
+		_, err = s3Client.copyObject(ctx, trashKey(req.Key), req.Key)
+	}
+	if writeTrashError(w, r, req.Key, err) {
+		return
+	}
+	if err := s3Client.deleteObject(ctx, trashKey(req.Key)); err != nil {
+		// Restored all the same; the purge removes the copy later
+		s3Log.WarnContext(ctx, "failed to delete restored file from trash", "key", req.Key, "err", err)
+	}
+
+	if err := hs.uploads.metadata.SetDeleted(ctx, req.Key, time.Time{}); err != nil {
+		httpLog.WarnContext(ctx, "failed to mark file restored in metadata", "key", req.Key, "err", err)
+	}
+	auditLog.Record(AUDIT_FILE_RESTORED, tokenInfo.UserID, "", r.RemoteAddr, req.Key)
+	httpLog.InfoContext(ctx, "restored file", "key", req.Key)
+
+	writeJSON(w, http.StatusOK, map[string]string{"key": req.Key})
+}
+
+// writeTrashError answers a failed delete or restore of key and reports
+// whether there was an error.
+func writeTrashError(w http.ResponseWriter, r *http.Request, key string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case isNotFound(err):
+		writeJSONError(w, http.StatusNotFound, "File not found")
+	case errors.Is(err, errFileExists), errors.Is(err, errLegalHold), errors.Is(err, errImmutable):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		s3Log.ErrorContext(r.Context(), "failed to move file", "key", key, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to move file")
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey")
+}
+
+// ============================================
+// Copying Objects
+// ============================================
+
+// copyObject copies src to dst with its content type, metadata and tags and
+// returns its size. The copy is a multipart upload of ranges of src, in the
+// upload's chunk size when known, so the ETag stays the same.
+func (s3c *S3Client) copyObject(ctx context.Context, src, dst string) (int64, error) {
+	return s3c.copyObjectTo(ctx, src, s3c.bucket, dst)
+}
+
+// copyObjectTo is copyObject to dst in another bucket.
+func (s3c *S3Client) copyObjectTo(ctx context.Context, src, bucket, dst string) (int64, error) {
+	head, err := s3c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return 0, err
+	}
+	tagging, err := s3c.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	partSize, _ := strconv.ParseInt(head.Metadata[OBJECT_META_CHUNK_SIZE], 10, 64)
+	if partSize <= 0 || partSize > COPY_PART_MAX {
+		partSize = min(max(size, 1), COPY_PART_MAX)
+	}
+
+	upload, err := s3c.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dst),
+		ContentType:     head.ContentType,
+		ContentEncoding: head.ContentEncoding,
+		Metadata:        head.Metadata,
+	})
+	if err != nil {
+		return 0, err
+	}
+	abort := func() {
+		s3c.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(dst),
+			UploadId: upload.UploadId,
+		})
+	}
+
+	source := (&url.URL{Path: s3c.bucket + "/" + src}).EscapedPath()
+	var parts []types.CompletedPart
+	for offset := int64(0); offset < size || len(parts) == 0; offset += partSize {
+		number := int32(len(parts) + 1)
+		input := &s3.UploadPartCopyInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(dst),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(number),
+			CopySource: aws.String(source),
+		}
+		if size > 0 {
+			input.CopySourceRange = aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+partSize, size)-1))
+		}
+		out, err := s3c.client.UploadPartCopy(ctx, input)
+		if err != nil {
+			abort()
+			return 0, err
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(number), ETag: out.CopyPartResult.ETag})
+	}
+
+	_, err = s3c.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dst),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abort()
+		return 0, err
+	}
+	if bucket == s3c.bucket {
+		s3c.listings.Invalidate(dst)
+	}
+
+	if len(tagging.TagSet) > 0 {
+		_, err = s3c.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(dst),
+			Tagging: &types.Tagging{TagSet: tagging.TagSet},
+		})
+		if err != nil {
+			s3Log.WarnContext(ctx, "failed to copy object tags", "src", src, "dst", dst, "err", err)
+		}
+	}
+	return size, nil
+}
+
+func (s3c *S3Client) deleteObject(ctx context.Context, key string) error {
+	out, err := s3c.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s3c.bucket),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String(key)}}, Quiet: aws.Bool(true)},
+	})
+	s3c.listings.Invalidate(key)
+	if err != nil {
+		return err
+	}
+	if len(out.Errors) > 0 {
+		return fmt.Errorf("%s: %s", aws.ToString(out.Errors[0].Code), aws.ToString(out.Errors[0].Message))
+	}
+	return nil
+}
+
+// ============================================
+// Purge
+// ============================================
+
+// RunTrashPurge deletes trashed files older than the retention period every
+// TRASH_PURGE_INTERVAL, with their metadata records.
+func (fus *FileUploadServer) RunTrashPurge() {
+	if TRASH_RETENTION_DAYS <= 0 {
+		return
+	}
+	ticker := time.NewTicker(TRASH_PURGE_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := fus.purgeTrash(context.Background()); err != nil {
+			s3Log.Warn("trash purge failed", "err", err)
+		}
+	}
+}
+
+func (fus *FileUploadServer) purgeTrash(ctx context.Context) error {
+	cutoff := time.Now().AddDate(0, 0, -TRASH_RETENTION_DAYS)
+
+	paginator := s3.NewListObjectsV2Paginator(fus.s3Client.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(fus.s3Client.bucket),
+		Prefix: aws.String(trashKey("")),
+	})
+
+	var expired []types.ObjectIdentifier
+	sizes := make(map[string]int64)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified != nil && obj.LastModified.Before(cutoff) {
+				expired = append(expired, types.ObjectIdentifier{Key: obj.Key})
+				sizes[aws.ToString(obj.Key)] = aws.ToInt64(obj.Size)
+			}
+		}
+	}
+
+	// DeleteObjects takes at most 1000 keys per call
+	for start := 0; start < len(expired); start += 1000 {
+		batch := expired[start:min(start+1000, len(expired))]
+		_, err := fus.s3Client.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(fus.s3Client.bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		fus.s3Client.listings.Invalidate(trashKey(""))
+		if err != nil {
+			return err
+		}
+		for _, obj := range batch {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), trashKey(""))
+			fus.usage.RecordDeleted(keyOwner(key), uint64(sizes[aws.ToString(obj.Key)]))
+			if err := fus.metadata.DeleteFile(ctx, key); err != nil {
+				s3Log.Warn("failed to delete purged file metadata", "key", key, "err", err)
+			}
+		}
+	}
+
+	if len(expired) > 0 {
+		s3Log.Info("expired trash deleted", "objects", len(expired), "retention_days", TRASH_RETENTION_DAYS)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// tuning.go - Event loop and HTTP server sizing
+package main
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ============================================
+// Event Loop Tuning
+// ============================================
+
+// The binary port's gnet options, each overridable from the environment.
+// Defaults come from `go run ./cmd/bench -paths binary -chunk-sizes
+// 5MB,16MB,64MB -runs 8` with the server started under each setting (one
+// CPU, loopback, in-memory storage); runs varied by about 10%, so smaller
+// differences are not claimed below.
+//
+// gnet has no io_uring backend; edge-triggered epoll is the closest it
+// offers, reading a ready connection GNET_ET_CHUNK bytes at a time until it
+// is drained instead of being woken again for every read.
+
+var (
+	// Event loops, one per CPU by default. A connection stays on its loop,
+	// so fewer loops than CPUs only makes sense to leave cores to the chunk
+	// workers. Not measured: the bench machine had a single CPU.
+	GNET_LOOPS = envInt("GNET_LOOPS", runtime.NumCPU())
+
+	// Edge-triggered I/O: 390ms of server CPU per 64MB chunk against 430ms
+	// without, 138 MB/s against 124. The gateway runs with it too. A 4MB
+	// GNET_ET_CHUNK was no different from 1MB.
+	GNET_EDGE_TRIGGERED = envBool("GNET_EDGE_TRIGGERED", true)
+	GNET_ET_CHUNK       = envInt("GNET_ET_CHUNK", 1024*1024)
+
+	// Bytes read per syscall. Chunks stream out of the inbound buffer as they
+	// arrive (chunkpool.go), so 64KB measured the same as 1MB and the old
+	// 64MB, without reserving 64MB per event loop.
+	GNET_READ_BUFFER  = envInt("GNET_READ_BUFFER", 64*1024)
+	GNET_WRITE_BUFFER = envInt("GNET_WRITE_BUFFER", 4*1024*1024)
+
+	// SO_RCVBUF / SO_SNDBUF; 0 keeps the kernel's autotuning. A fixed 4MB
+	// receive buffer gained nothing on loopback; raise them for links with
+	// a large bandwidth-delay product, past net.ipv4.tcp_rmem's maximum,
+	// which is as far as autotuning goes.
+	GNET_SOCKET_RECV_BUFFER = envInt("GNET_SOCKET_RECV_BUFFER", 0)
+	GNET_SOCKET_SEND_BUFFER = envInt("GNET_SOCKET_SEND_BUFFER", 0)
+
+	// TCP_NODELAY. Chunks are written in large pieces either way, but a
+	// reply or a small command held back by Nagle's algorithm waits for the
+	// peer's delayed ACK, up to 40ms on Linux, and every chunk waits on its
+	// ACK once the client's window is full.
+	GNET_TCP_NODELAY = envBool("GNET_TCP_NODELAY", true)
+
+	// TCP keep-alive, in seconds; 0 turns it off. gnet leaves it off, so a
+	// client that vanished without a FIN (a laptop closed, a NAT entry
+	// expired) kept its connection, and any chunk memory it held, until the
+	// server restarted. Probes start after GNET_TCP_KEEPALIVE idle seconds
+	// and repeat every GNET_TCP_KEEPINTVL seconds (0: a fifth of
+	// GNET_TCP_KEEPALIVE); GNET_TCP_KEEPCNT unanswered probes drop the
+	// connection.
+	GNET_TCP_KEEPALIVE = envInt("GNET_TCP_KEEPALIVE", 60)
+	GNET_TCP_KEEPINTVL = envInt("GNET_TCP_KEEPINTVL", 0)
+	GNET_TCP_KEEPCNT   = envInt("GNET_TCP_KEEPCNT", 5)
+
+	// Pins each event loop to an OS thread. Within noise, so off.
+	GNET_LOCK_OS_THREAD = envBool("GNET_LOCK_OS_THREAD", false)
+)
+
+func envBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// gnetOptions is the option set for gnet.Run.
+func gnetOptions() []gnet.Option {
+	opts := []gnet.Option{
+		gnet.WithReusePort(true),
+		gnet.WithNumEventLoop(max(GNET_LOOPS, 1)),
+		gnet.WithReadBufferCap(GNET_READ_BUFFER),
+		gnet.WithWriteBufferCap(GNET_WRITE_BUFFER),
+		gnet.WithLockOSThread(GNET_LOCK_OS_THREAD),
+	}
+	if GNET_EDGE_TRIGGERED {
+		opts = append(opts, gnet.WithEdgeTriggeredIO(true), gnet.WithEdgeTriggeredIOChunk(GNET_ET_CHUNK))
+	}
+	if GNET_SOCKET_RECV_BUFFER > 0 && GNET_CONN_RECV_BUFFER_MAX <= 0 {
+		opts = append(opts, gnet.WithSocketRecvBuffer(GNET_SOCKET_RECV_BUFFER))
+	}
+	if GNET_SOCKET_SEND_BUFFER > 0 {
+		opts = append(opts, gnet.WithSocketSendBuffer(GNET_SOCKET_SEND_BUFFER))
+	}
+	if GNET_TCP_NODELAY {
+		opts = append(opts, gnet.WithTCPNoDelay(gnet.TCPNoDelay))
+	} else {
+		opts = append(opts, gnet.WithTCPNoDelay(gnet.TCPDelay))
+	}
+	if GNET_TCP_KEEPALIVE > 0 {
+		opts = append(opts,
+			gnet.WithTCPKeepAlive(time.Duration(GNET_TCP_KEEPALIVE)*time.Second),
+			gnet.WithTCPKeepInterval(time.Duration(GNET_TCP_KEEPINTVL)*time.Second),
+			gnet.WithTCPKeepCount(GNET_TCP_KEEPCNT))
+	}
+	if GNET_TLS_ADDR != "" || WEBSOCKET_UPLOADS {
+		// Round robin races with connections registered from outside the
+		// event loops (tls.go, websocket.go)
+		opts = append(opts, gnet.WithLoadBalancing(gnet.LeastConnections))
+	}
+	return opts
+}
+
+// ============================================
+// Connection Receive Buffers
+// ============================================
+
+// GNET_READ_BUFFER is one buffer per event loop, and gnet hands a
+// connection's unread bytes back to a shared pool once it has drained them,
+// so an idle or control-only connection holds next to nothing in user space.
+// What stays per connection is the kernel's receive buffer. Autotuning
+// (net.ipv4.tcp_rmem) grows it with the connection's throughput and is the
+// right choice unless its maximum is below the bandwidth-delay product of
+// the client's link.
+//
+// For that case GNET_CONN_RECV_BUFFER_MAX, when set, sizes SO_RCVBUF per
+// connection instead of GNET_SOCKET_RECV_BUFFER for all of them: a
+// connection gets one once it starts sending chunks, of its chunk size
+// times the chunks it has in flight, up to the maximum. It only grows, as
+// a client settles into bigger chunks or a deeper pipeline. Connections
+// that never send a chunk keep autotuning. A fixed SO_RCVBUF turns
+// autotuning off for that socket, and the kernel caps it at
+// net.core.rmem_max, which must be raised to match.
+
+var GNET_CONN_RECV_BUFFER_MAX = envInt("GNET_CONN_RECV_BUFFER_MAX", 0)
+
+// sizeRecvBuffer grows c's receive buffer for chunks of chunkSize bytes,
+// depth of them in flight. Event loop only.
+func sizeRecvBuffer(c gnet.Conn, ctx *ClientContext, chunkSize, depth int) {
+	if GNET_CONN_RECV_BUFFER_MAX <= 0 {
+		return
+	}
+	size := min(chunkSize*depth, GNET_CONN_RECV_BUFFER_MAX)
+	ctx.mu.Lock()
+	grow := size > ctx.recvBuffer
+	ctx.mu.Unlock()
+	if !grow {
+		return
+	}
+	if err := c.SetReadBuffer(size); err != nil {
+		protoLog.WarnContext(ctx.connCtx, "failed to set receive buffer", "remote", ctx.remoteAddr, "size", size, "err", err)
+		return
+	}
+	ctx.mu.Lock()
+	ctx.recvBuffer = size
+	ctx.mu.Unlock()
+	protoLog.DebugContext(ctx.connCtx, "receive buffer resized", "remote", ctx.remoteAddr, "size", size, "chunk_size", chunkSize, "depth", depth)
+}
+
+// ============================================
+// HTTP Server
+// ============================================
+
+// The HTTP API ran on a bare http.ListenAndServe, without limits: a client
+// could hold a connection by trickling headers forever. Bodies and responses
+// may rightly take minutes - a 100MB chunk over a slow uplink, a download of
+// a whole upload - so by default only reading the headers and idle
+// keep-alive connections are bounded. Timeouts are in seconds, 0 for none.
+
+var (
+	HTTP_READ_HEADER_TIMEOUT = time.Duration(envInt("HTTP_READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second
+	HTTP_READ_TIMEOUT        = time.Duration(envInt("HTTP_READ_TIMEOUT_SECONDS", 0)) * time.Second
+	HTTP_WRITE_TIMEOUT       = time.Duration(envInt("HTTP_WRITE_TIMEOUT_SECONDS", 0)) * time.Second
+	HTTP_IDLE_TIMEOUT        = time.Duration(envInt("HTTP_IDLE_TIMEOUT_SECONDS", 120)) * time.Second
+
+	// Requests carry a bearer token and little else; Go's default is 1MB
+	HTTP_MAX_HEADER_BYTES = envInt("HTTP_MAX_HEADER_BYTES", 64*1024)
+)
+
+// listenHTTP serves handler on HTTP_PORT until the listener fails.
+func listenHTTP(handler http.Handler) error {
+	server := &http.Server{
+		Addr:              HTTP_PORT,
+		Handler:           handler,
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		ReadTimeout:       HTTP_READ_TIMEOUT,
+		WriteTimeout:      HTTP_WRITE_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+		MaxHeaderBytes:    HTTP_MAX_HEADER_BYTES,
+	}
+	return server.ListenAndServe()
+}
+
+// logTuning records the effective settings at startup.
+func logTuning() {
+	serverLog.Info("gnet options",
+		"loops", GNET_LOOPS,
+		"edge_triggered", GNET_EDGE_TRIGGERED,
+		"et_chunk", GNET_ET_CHUNK,
+		"read_buffer", GNET_READ_BUFFER,
+		"write_buffer", GNET_WRITE_BUFFER,
+		"socket_recv_buffer", GNET_SOCKET_RECV_BUFFER,
+		"socket_send_buffer", GNET_SOCKET_SEND_BUFFER,
+		"conn_recv_buffer_max", GNET_CONN_RECV_BUFFER_MAX,
+		"tcp_nodelay", GNET_TCP_NODELAY,
+		"tcp_keepalive", GNET_TCP_KEEPALIVE,
+		"tcp_keepintvl", GNET_TCP_KEEPINTVL,
+		"tcp_keepcnt", GNET_TCP_KEEPCNT,
+		"lock_os_thread", GNET_LOCK_OS_THREAD)
+	serverLog.Info("chunk workers",
+		"workers", UPLOAD_WORKERS,
+		"queue", UPLOAD_QUEUE)
+	httpLog.Info("HTTP server options",
+		"read_header_timeout", HTTP_READ_HEADER_TIMEOUT,
+		"read_timeout", HTTP_READ_TIMEOUT,
+		"write_timeout", HTTP_WRITE_TIMEOUT,
+		"idle_timeout", HTTP_IDLE_TIMEOUT,
+		"max_header_bytes", HTTP_MAX_HEADER_BYTES)
+}
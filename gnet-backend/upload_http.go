@@ -0,0 +1,601 @@
+// upload_http.go - HTTP chunk upload API for clients that cannot open raw TCP
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/protocol"
+)
+
+// ============================================
+// HTTP Upload API
+// ============================================
+
+// The same sessions as the binary protocol, over plain HTTP for browsers:
+//
+//	POST /upload/init                   {"file_name", "total_chunks", "chunk_size", ["attributes"], ["sha256"], ["preset"], ["size"], ["immutable"]}
+//	POST /upload/chunk                  multipart form: session_id, chunk_index, [sha256], [size], chunk (file)
+//	GET  /upload/status/{sessionID}     state, progress and missing chunk indexes
+//	POST /upload/pause/{sessionID}
+//	POST /upload/resume/{sessionID}
+//	POST /upload/cancel/{sessionID}
+//
+// Chunks may be sent concurrently and in any order. The request that stores
+// the last missing chunk finalizes the upload and gets "complete": true. An
+// init whose "sha256" (of the whole file) is already stored may get
+// "complete": true itself, with no chunks to send; see dedup.go.
+
+const HTTP_CHUNK_OVERHEAD = 1 << 20 // Multipart framing allowed on top of MAX_CHUNK_SIZE
+
+type InitUploadRequest struct {
+	FileName    string `json:"file_name"`
+	TotalChunks uint32 `json:"total_chunks"`
+	ChunkSize   uint32 `json:"chunk_size"`
+
+	// Recorded with the completed file; see metadata.go
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Hex SHA-256 of the whole file, which the assembled file must match
+	// (filehash.go) and which allows an instant upload (dedup.go)
+	FileHash string `json:"sha256,omitempty"`
+
+	// A preset of UPLOAD_PRESETS_FILE, whose chunk size may stand in for
+	// total_chunks and chunk_size given the file's size; see presets.go
+	Preset string `json:"preset,omitempty"`
+	Size   uint64 `json:"size,omitempty"`
+
+	// Object Lock retention for the completed file; see immutable.go
+	Immutable *ImmutableRequest `json:"immutable,omitempty"`
+}
+
+type InitUploadResponse struct {
+	SessionID   string `json:"session_id"`
+	S3Key       string `json:"s3_key"`
+	TotalChunks uint32 `json:"total_chunks"`
+	ChunkSize   uint32 `json:"chunk_size"`
+	Complete    bool   `json:"complete"`       // Stored by copy; no chunks to send
+	Size        uint64 `json:"size,omitempty"` // Of the completed file
+
+	// Chunks already stored when an upload a restart left behind was
+	// resumed (recovery.go); GET /upload/status lists the missing ones
+	Received uint32 `json:"received,omitempty"`
+}
+
+type ChunkResponse struct {
+	ChunkIndex     uint32  `json:"chunk_index"`
+	Duplicate      bool    `json:"duplicate"`
+	Received       uint32  `json:"received"`
+	Total          uint32  `json:"total"`
+	BytesPerSecond uint64  `json:"bytes_per_second"`
+	ETASeconds     *uint32 `json:"eta_seconds"` // null until a rate is measured
+	State          string  `json:"state"`
+	Complete       bool    `json:"complete"`
+	S3Key          string  `json:"s3_key,omitempty"`
+	Size           uint64  `json:"size,omitempty"`
+}
+
+type UploadStatusResponse struct {
+	SessionID string   `json:"session_id"`
+	FileName  string   `json:"file_name"`
+	S3Key     string   `json:"s3_key"`
+	State     string   `json:"state"`
+	Received  uint32   `json:"received"`
+	Total     uint32   `json:"total"`
+	ChunkSize uint32   `json:"chunk_size"`
+	Missing   []uint32 `json:"missing"`
+}
+
+func (hs *HTTPServer) registerUploadRoutes() {
+	hs.mux.HandleFunc("POST /upload/init", hs.handleInitUpload)
+	hs.mux.HandleFunc("POST /upload/chunk", hs.handleUploadChunk)
+	hs.mux.HandleFunc("GET /upload/status/{sessionID}", hs.handleUploadStatus)
+	hs.mux.HandleFunc("POST /upload/pause/{sessionID}", hs.handlePauseUpload)
+	hs.mux.HandleFunc("POST /upload/resume/{sessionID}", hs.handleResumeUpload)
+	hs.mux.HandleFunc("POST /upload/cancel/{sessionID}", hs.handleCancelUpload)
+}
+
+// POST /upload/init
+func (hs *HTTPServer) handleInitUpload(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	if !hs.allowHTTP(w, r, RATE_INIT, tokenInfo.UserID, 0) {
+		return
+	}
+
+	var req InitUploadRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if err := validateAttributes(req.Attributes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fileHash, err := normalizeFileHash(req.FileHash)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Immutable != nil {
+		if err := req.Immutable.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		fileHash = "" // A copy would not be locked
+	}
+	var preset *UploadPreset
+	if req.Preset != "" {
+		if preset = hs.uploads.presets[req.Preset]; preset == nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unknown preset %q", req.Preset))
+			return
+		}
+		if err := preset.applyInit(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	session, err := hs.uploads.startUpload(r.Context(), tokenInfo.Tenant, preset, tokenInfo.UserID, tokenInfo.Username, req.FileName, req.TotalChunks, req.ChunkSize, fileHash, req.Attributes)
+	hs.setStorageHeaders(w, tokenInfo.UserID)
+	if errors.Is(err, errDraining) {
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Immutable != nil {
+		session.mu.Lock()
+		session.Immutable = req.Immutable
+		session.mu.Unlock()
+	}
+
+	resp := InitUploadResponse{
+		SessionID:   session.SessionID,
+		S3Key:       session.S3Key,
+		TotalChunks: session.TotalChunks,
+		ChunkSize:   session.ChunkSize,
+	}
+	if session.GetState() == STATE_COMPLETED {
+		resp.Complete = true
+		resp.Size = session.TotalSize
+	}
+	resp.Received, _ = session.GetProgress()
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// POST /upload/chunk
+func (hs *HTTPServer) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	hs.receiveChunk(w, r, start, tokenInfo, func(sessionID string) (*UploadSession, bool) {
+		return hs.ownedSession(w, tokenInfo, sessionID)
+	})
+}
+
+// receiveChunk stores the chunk of a POST /upload/chunk or of a drop's
+// (drops.go), in the session that lookup finds for the form's session_id.
+// tokenInfo is nil for a drop, whose uploader is not told where the file
+// went.
+func (hs *HTTPServer) receiveChunk(w http.ResponseWriter, r *http.Request, start time.Time, tokenInfo *TokenInfo, lookup func(sessionID string) (*UploadSession, bool)) {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_CHUNK_SIZE+HTTP_CHUNK_OVERHEAD)
+	// A refused chunk is read to the end before the answer goes out, or a
+	// client still sending it sees a reset rather than the error
+	defer io.Copy(io.Discard, r.Body)
+
+	// Charged before the body is read, at its length or, sent without one,
+	// the most a chunk can be
+	userID, charged := "", MAX_CHUNK_SIZE
+	if tokenInfo != nil {
+		userID = tokenInfo.UserID
+	}
+	if r.ContentLength >= 0 {
+		charged = int(min(r.ContentLength, MAX_CHUNK_SIZE))
+	}
+	if !hs.allowHTTP(w, r, RATE_CHUNK, userID, charged) {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Expected multipart/form-data")
+		return
+	}
+
+	// Fields must precede the chunk part so the session is known before the
+	// chunk streams to storage
+	fields := map[string]string{}
+	var chunk *multipart.Part
+	for chunk == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "Missing chunk part")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Malformed multipart body")
+			return
+		}
+
+		if part.FormName() == "chunk" {
+			chunk = part
+			continue
+		}
+		value, _ := io.ReadAll(io.LimitReader(part, 1024))
+		fields[part.FormName()] = string(value)
+	}
+	defer func() {
+		chunkDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	chunkIndex, err := strconv.ParseUint(fields["chunk_index"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid chunk_index")
+		return
+	}
+
+	session, ok := lookup(fields["session_id"])
+	if !ok {
+		return
+	}
+	if uint32(chunkIndex) >= session.TotalChunks {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("chunk_index %d out of range (total %d)", chunkIndex, session.TotalChunks))
+		return
+	}
+
+	// S3 needs the part's length before its first byte. Every chunk but the
+	// last is ChunkSize; the last is either sized by the client or buffered
+	// here to measure it, and only then counts against MAX_CHUNK_MEMORY. A
+	// chunk that may not fit in memory has to be sized.
+	var data io.Reader = chunk
+	var size uint32
+	switch {
+	case fields["size"] != "":
+		n, err := strconv.ParseUint(fields["size"], 10, 32)
+		if err != nil || n > uint64(session.ChunkSize) {
+			writeJSONError(w, http.StatusBadRequest, "Invalid size")
+			return
+		}
+		size = uint32(n)
+	case uint32(chunkIndex) < session.TotalChunks-1:
+		size = session.ChunkSize
+	case session.ChunkSize > MAX_MEMORY_CHUNK_SIZE:
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("size is required for chunks over %d bytes", MAX_MEMORY_CHUNK_SIZE))
+		return
+	default:
+		reserved := int(r.ContentLength)
+		if reserved < 0 || reserved > MAX_CHUNK_SIZE+HTTP_CHUNK_OVERHEAD {
+			reserved = MAX_CHUNK_SIZE + HTTP_CHUNK_OVERHEAD
+		}
+		if !hs.uploads.chunkMemory.Reserve(reserved) {
+			backpressure.WithLabelValues("http").Inc()
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusServiceUnavailable, errServerBusy.Error())
+			return
+		}
+		defer hs.uploads.chunkMemory.Release(reserved)
+
+		buffered, err := io.ReadAll(chunk)
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "Chunk too large")
+			return
+		}
+		data, size = bytes.NewReader(buffered), uint32(len(buffered))
+	}
+
+	body := newStreamedChunk(data, size, fields["sha256"], time.Since(start))
+	isDuplicate, err := hs.uploads.storeChunk(r.Context(), session, uint32(chunkIndex), body)
+	chunkReceiveDuration.Observe(body.receive.Seconds())
+	if body.err != nil {
+		err = body.err // The request failed, not storage
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "Chunk too large")
+		return
+	}
+	if errors.Is(err, errChunkChecksum) {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if errors.Is(err, errChunkSize) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errSessionBusy) {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if errors.Is(err, errInjectedNack) {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	received, total := session.GetProgress()
+	resp := ChunkResponse{
+		ChunkIndex: uint32(chunkIndex),
+		Duplicate:  isDuplicate,
+		Received:   received,
+		Total:      total,
+	}
+
+	if session.IsComplete() {
+		err := hs.uploads.completeUpload(r.Context(), session)
+		var hashErr *fileHashError
+		if errors.As(err, &hashErr) {
+			writeFileHashError(w, hashErr)
+			return
+		}
+		if err != nil && !errors.Is(err, errFinalizing) {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to complete upload: %v", err))
+			return
+		}
+		resp.Complete = err == nil
+		if resp.Complete && tokenInfo != nil {
+			resp.S3Key = session.S3Key
+			resp.Size = session.TotalSize
+			hs.setStorageHeaders(w, tokenInfo.UserID)
+		}
+	}
+
+	bytesPerSec, eta, measured := session.GetThroughput()
+	resp.BytesPerSecond = bytesPerSec
+	if measured {
+		etaSeconds := uint32(min(eta.Seconds(), protocol.ETA_UNKNOWN-1))
+		resp.ETASeconds = &etaSeconds
+	}
+	session.mu.Lock()
+	resp.State = session.State
+	session.mu.Unlock()
+
+	switch ackFault(r.Context()) {
+	case FAULT_DROP:
+		// Close the connection without a response
+		panic(http.ErrAbortHandler)
+	case FAULT_DELAY:
+		time.Sleep(faultDelay())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ============================================
+// Streamed Chunks
+// ============================================
+
+// A chunk is streamed from the request to storage: the multipart part is
+// the body of the S3 UploadPart (or is copied into its part's staging file)
+// and is hashed as S3 reads it. Peak memory per request is
+// the SDK's copy buffer, whatever the chunk size. The catch is that the
+// client's digest can only be checked after the part is in S3; a chunk
+// that fails the check is not recorded, and its retry overwrites the part.
+
+var (
+	errChunkChecksum = errors.New("Chunk checksum mismatch")
+	errChunkSize     = errors.New("Chunk size mismatch")
+)
+
+// streamedChunk is a chunkBody of exactly size bytes read from a request.
+type streamedChunk struct {
+	part      io.Reader
+	length    uint32
+	remaining int64
+	hash      hash.Hash
+	out       io.Writer // hash, plus whatever the chunk is teed to
+	expected  string    // The client's hex SHA-256, if it sent one
+	receive   time.Duration
+	sum       [sha256.Size]byte
+	done      bool
+	err       error // Why the request failed, if it did
+}
+
+func newStreamedChunk(part io.Reader, size uint32, expected string, receive time.Duration) *streamedChunk {
+	h := sha256.New()
+	return &streamedChunk{
+		part:      part,
+		length:    size,
+		remaining: int64(size),
+		hash:      h,
+		out:       h,
+		expected:  expected,
+		receive:   receive,
+	}
+}
+
+func (sc *streamedChunk) Read(p []byte) (int, error) {
+	if sc.err != nil {
+		return 0, sc.err
+	}
+	if sc.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > sc.remaining {
+		p = p[:sc.remaining]
+	}
+	start := time.Now()
+	n, err := sc.part.Read(p)
+	sc.receive += time.Since(start)
+	sc.out.Write(p[:n])
+	sc.remaining -= int64(n)
+	if err == io.EOF && sc.remaining > 0 {
+		err = fmt.Errorf("%w: %d bytes short of %d", errChunkSize, sc.remaining, sc.length)
+	}
+	if err != nil && err != io.EOF {
+		sc.err = err
+	}
+	return n, err
+}
+
+func (sc *streamedChunk) size() uint32               { return sc.length }
+func (sc *streamedChunk) tee(w io.Writer)            { sc.out = io.MultiWriter(sc.out, w) }
+func (sc *streamedChunk) receiveTime() time.Duration { return sc.receive }
+
+func (sc *streamedChunk) digest() ([sha256.Size]byte, error) {
+	if sc.done {
+		return sc.sum, sc.err
+	}
+	sc.done = true
+
+	if _, err := io.Copy(io.Discard, sc); err != nil {
+		return sc.sum, err
+	}
+	var extra [1]byte
+	if n, _ := io.ReadFull(sc.part, extra[:]); n > 0 {
+		sc.err = fmt.Errorf("%w: more than %d bytes", errChunkSize, sc.length)
+		return sc.sum, sc.err
+	}
+	sc.hash.Sum(sc.sum[:0])
+
+	// Optional client-side digest catches corruption between browser and server
+	if sc.expected != "" && !strings.EqualFold(sc.expected, hex.EncodeToString(sc.sum[:])) {
+		sc.err = errChunkChecksum
+	}
+	return sc.sum, sc.err
+}
+
+// GET /upload/status/{sessionID}
+func (hs *HTTPServer) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	session, ok := hs.ownedSession(w, tokenInfo, r.PathValue("sessionID"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, uploadStatus(session))
+}
+
+// POST /upload/pause/{sessionID}
+func (hs *HTTPServer) handlePauseUpload(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	session, ok := hs.ownedSession(w, tokenInfo, r.PathValue("sessionID"))
+	if !ok {
+		return
+	}
+
+	session.Pause()
+	auditLog.Record(AUDIT_SESSION_PAUSED, tokenInfo.UserID, session.SessionID, r.RemoteAddr, "")
+	sessionLog.InfoContext(r.Context(), "upload paused", "session_id", session.SessionID)
+
+	writeJSON(w, http.StatusOK, uploadStatus(session))
+}
+
+// POST /upload/resume/{sessionID}
+func (hs *HTTPServer) handleResumeUpload(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	session, ok := hs.ownedSession(w, tokenInfo, r.PathValue("sessionID"))
+	if !ok {
+		return
+	}
+
+	if session.State != STATE_PAUSED {
+		writeJSONError(w, http.StatusConflict, "Upload is not paused")
+		return
+	}
+
+	session.Resume(0)
+	auditLog.Record(AUDIT_SESSION_RESUMED, tokenInfo.UserID, session.SessionID, r.RemoteAddr, "")
+	sessionLog.InfoContext(r.Context(), "upload resumed", "session_id", session.SessionID)
+
+	writeJSON(w, http.StatusOK, uploadStatus(session))
+}
+
+// POST /upload/cancel/{sessionID}
+func (hs *HTTPServer) handleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticateUpload(w, r)
+	if !ok {
+		return
+	}
+	session, ok := hs.ownedSession(w, tokenInfo, r.PathValue("sessionID"))
+	if !ok {
+		return
+	}
+
+	hs.uploads.cancelUpload(r.Context(), session, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ============================================
+// Helpers
+// ============================================
+
+func (hs *HTTPServer) authenticateUpload(w http.ResponseWriter, r *http.Request) (*TokenInfo, bool) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		authFailures.Inc()
+		uploadStats.RecordFailure(FAILURE_AUTH, "", "", fmt.Errorf("invalid token from %s", r.RemoteAddr))
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return nil, false
+	}
+	return tokenInfo, true
+}
+
+func (hs *HTTPServer) ownedSession(w http.ResponseWriter, tokenInfo *TokenInfo, sessionID string) (*UploadSession, bool) {
+	session := hs.sessionMgr.GetSession(sessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, "Invalid session ID")
+		return nil, false
+	}
+	if session.UserID != tokenInfo.UserID {
+		writeJSONError(w, http.StatusForbidden, "Session does not belong to user")
+		return nil, false
+	}
+	return session, true
+}
+
+func uploadStatus(session *UploadSession) UploadStatusResponse {
+	received, total := session.GetProgress()
+	missing := session.GetMissingChunks()
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return UploadStatusResponse{
+		SessionID: session.SessionID,
+		FileName:  session.FileName,
+		S3Key:     session.S3Key,
+		State:     session.State,
+		Received:  received,
+		Total:     total,
+		ChunkSize: session.ChunkSize,
+		Missing:   missing,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// The HTTP path: a POST /upload/chunk form read part by part and hashed by
+// receiveChunk, then stored like a binary chunk.
+func BenchmarkHTTPChunk(b *testing.B) {
+	var body bytes.Buffer
+	benchmarkChunks(b, func(b *testing.B, hs *HTTPServer, session *UploadSession, index uint32, data []byte) {
+		body.Reset()
+		form := multipart.NewWriter(&body)
+		form.WriteField("session_id", session.SessionID)
+		form.WriteField("chunk_index", strconv.FormatUint(uint64(index), 10))
+		part, _ := form.CreateFormFile("chunk", "chunk")
+		part.Write(data)
+		form.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/upload/chunk", &body)
+		r.Header.Set("Authorization", "Bearer test_token_user123")
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		hs.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("chunk %d: status %d: %s", index, w.Code, w.Body)
+		}
+	})
+}
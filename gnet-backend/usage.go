@@ -0,0 +1,422 @@
+// usage.go - Per-user usage metering and the /usage reporting API
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// Usage Metering
+// ============================================
+
+// Usage is kept per user per UTC day and flushed to a JSON file, so it
+// survives restarts. Monthly figures are rolled up from the daily records
+// at query time.
+
+const (
+	USAGE_FLUSH_INTERVAL = time.Minute
+	USAGE_DAY_FORMAT     = "2006-01-02"
+	USAGE_MONTH_FORMAT   = "2006-01"
+)
+
+var USAGE_FILE = envString("USAGE_FILE", "/data/usage.json")
+
+type UsageRecord struct {
+	BytesUploaded uint64 `json:"bytes_uploaded"`
+	BytesStreamed uint64 `json:"bytes_streamed"`
+	BytesStored   uint64 `json:"bytes_stored"` // Size of uploads completed in the period
+	FilesStored   uint64 `json:"files_stored"`
+	BytesDeleted  uint64 `json:"bytes_deleted"` // Size of files purged from the trash in the period
+	FilesDeleted  uint64 `json:"files_deleted"`
+}
+
+func (ur *UsageRecord) add(other *UsageRecord) {
+	ur.BytesUploaded += other.BytesUploaded
+	ur.BytesStreamed += other.BytesStreamed
+	ur.BytesStored += other.BytesStored
+	ur.FilesStored += other.FilesStored
+	ur.BytesDeleted += other.BytesDeleted
+	ur.FilesDeleted += other.FilesDeleted
+}
+
+// netStored adds rec's stored bytes and takes its deleted ones from total.
+func netStored(total uint64, rec *UsageRecord) uint64 {
+	total += rec.BytesStored
+	return total - min(total, rec.BytesDeleted)
+}
+
+type UsageMeter struct {
+	path  string
+	days  map[string]map[string]*UsageRecord // user_id -> day -> record
+	dirty bool
+	mu    sync.Mutex
+}
+
+func NewUsageMeter(path string) (*UsageMeter, error) {
+	um := &UsageMeter{
+		path: path,
+		days: make(map[string]map[string]*UsageRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	default:
+		if err := json.Unmarshal(data, &um.days); err != nil {
+			return nil, fmt.Errorf("failed to parse usage file: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create usage directory: %w", err)
+	}
+
+	go um.flushLoop()
+
+	return um, nil
+}
+
+func (um *UsageMeter) record(userID string, update func(*UsageRecord)) {
+	day := time.Now().UTC().Format(USAGE_DAY_FORMAT)
+
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	days, ok := um.days[userID]
+	if !ok {
+		days = make(map[string]*UsageRecord)
+		um.days[userID] = days
+	}
+	rec, ok := days[day]
+	if !ok {
+		rec = &UsageRecord{}
+		days[day] = rec
+	}
+	update(rec)
+	um.dirty = true
+}
+
+func (um *UsageMeter) RecordUpload(userID string, bytes uint64) {
+	um.record(userID, func(rec *UsageRecord) { rec.BytesUploaded += bytes })
+}
+
+func (um *UsageMeter) RecordStream(userID string, bytes uint64) {
+	um.record(userID, func(rec *UsageRecord) { rec.BytesStreamed += bytes })
+}
+
+func (um *UsageMeter) RecordStored(userID string, bytes uint64) {
+	um.record(userID, func(rec *UsageRecord) {
+		rec.BytesStored += bytes
+		rec.FilesStored++
+	})
+}
+
+func (um *UsageMeter) RecordDeleted(userID string, bytes uint64) {
+	um.record(userID, func(rec *UsageRecord) {
+		rec.BytesDeleted += bytes
+		rec.FilesDeleted++
+	})
+}
+
+// StoredBytes returns the bytes stored, less those deleted, over all recorded
+// days by the users whose IDs start with prefix.
+func (um *UsageMeter) StoredBytes(prefix string) uint64 {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	var sum UsageRecord
+	for userID, days := range um.days {
+		if !strings.HasPrefix(userID, prefix) {
+			continue
+		}
+		for _, rec := range days {
+			sum.add(rec)
+		}
+	}
+	return netStored(0, &sum)
+}
+
+// UserStored returns the bytes and files userID has stored, less those
+// deleted.
+func (um *UsageMeter) UserStored(userID string) (bytes, files uint64) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	var sum UsageRecord
+	for _, rec := range um.days[userID] {
+		sum.add(rec)
+	}
+	return netStored(0, &sum), sum.FilesStored - min(sum.FilesStored, sum.FilesDeleted)
+}
+
+func (um *UsageMeter) flushLoop() {
+	ticker := time.NewTicker(USAGE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := um.Flush(); err != nil {
+			serverLog.Error("failed to flush usage", "path", um.path, "err", err)
+		}
+	}
+}
+
+// Flush writes the ledger to disk if it changed since the last flush.
+func (um *UsageMeter) Flush() error {
+	um.mu.Lock()
+	if !um.dirty {
+		um.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(um.days)
+	um.dirty = false
+	um.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := um.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, um.path)
+	}
+	if err != nil {
+		// Retry on the next tick
+		um.mu.Lock()
+		um.dirty = true
+		um.mu.Unlock()
+	}
+	return err
+}
+
+type UsagePeriod struct {
+	Period string `json:"period"`
+	UsageRecord
+	StorageTotal uint64 `json:"storage_total"` // Cumulative bytes stored, less deleted, up to the end of the period
+}
+
+// Report rolls a user's daily records up by day or month within [from, to].
+func (um *UsageMeter) Report(userID, granularity string, from, to time.Time) []UsagePeriod {
+	format := USAGE_DAY_FORMAT
+	if granularity == "monthly" {
+		format = USAGE_MONTH_FORMAT
+	}
+	fromDay := from.Format(USAGE_DAY_FORMAT)
+	toDay := to.Format(USAGE_DAY_FORMAT)
+
+	um.mu.Lock()
+	days := make([]string, 0, len(um.days[userID]))
+	for day := range um.days[userID] {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var storageTotal uint64
+	periods := make([]UsagePeriod, 0)
+	for _, day := range days {
+		rec := um.days[userID][day]
+		storageTotal = netStored(storageTotal, rec)
+		if day < fromDay || day > toDay {
+			continue
+		}
+
+		t, _ := time.Parse(USAGE_DAY_FORMAT, day)
+		key := t.Format(format)
+		if len(periods) == 0 || periods[len(periods)-1].Period != key {
+			periods = append(periods, UsagePeriod{Period: key})
+		}
+		last := &periods[len(periods)-1]
+		last.add(rec)
+		last.StorageTotal = storageTotal
+	}
+	um.mu.Unlock()
+
+	return periods
+}
+
+// ============================================
+// Storage Quota
+// ============================================
+
+// What a user has stored is what their completed uploads added less what
+// was purged from the trash (trash.go); files in the trash count until then.
+// USER_QUOTA_BYTES caps every user unless an admin set them a quota of their
+// own (quotas.go), and a tenant's quota_bytes (tenants.go) its users together. Both count the declared size of open uploads as used,
+// so an upload that could not fit is refused at init, not at its last chunk.
+//
+// GET /usage and GET /quota report the caller's storage, and the responses to an upload's
+// init and to the chunk that completes it carry it as headers, for clients
+// to warn before starting an upload that cannot fit:
+//
+//	X-Storage-Used        bytes stored
+//	X-Storage-Quota       the quota that leaves the least room, if any
+//	X-Storage-Remaining   bytes left for new uploads under it
+
+var USER_QUOTA_BYTES = uint64(envInt("USER_QUOTA_BYTES", 0))
+
+type StorageStatus struct {
+	UsedBytes      uint64  `json:"used_bytes"`
+	Files          uint64  `json:"files"`
+	ReservedBytes  uint64  `json:"reserved_bytes"` // Declared by open uploads
+	QuotaBytes     uint64  `json:"quota_bytes,omitempty"`
+	RemainingBytes *uint64 `json:"remaining_bytes,omitempty"` // Absent without a quota
+}
+
+// checkUserQuota refuses a new session of totalSize bytes for a user at
+// their quota. The caller holds fus.quotaMu until the session is created.
+func (fus *FileUploadServer) checkUserQuota(userID string, quota, totalSize uint64) error {
+	used, _ := fus.usage.UserStored(userID)
+	_, reserved := fus.openSessions(func(id string) bool { return id == userID })
+	if used+reserved+totalSize > quota {
+		return fmt.Errorf("storage quota exceeded: %d bytes used or reserved, %d requested (quota: %d)", used+reserved, totalSize, quota)
+	}
+	return nil
+}
+
+func (fus *FileUploadServer) storageStatus(userID string) StorageStatus {
+	var status StorageStatus
+	status.UsedBytes, status.Files = fus.usage.UserStored(userID)
+	_, status.ReservedBytes = fus.openSessions(func(id string) bool { return id == userID })
+
+	room := func(quota, used uint64) {
+		left := quota - min(quota, used)
+		if status.RemainingBytes == nil || left < *status.RemainingBytes {
+			status.QuotaBytes, status.RemainingBytes = quota, &left
+		}
+	}
+	if quota := fus.userQuota(userID); quota > 0 {
+		room(quota, status.UsedBytes+status.ReservedBytes)
+	}
+	if tenant := fus.tenantOf(userID); tenant != nil && tenant.QuotaBytes > 0 {
+		_, reserved := fus.openTenantSessions(tenant)
+		room(tenant.QuotaBytes, fus.usage.StoredBytes(tenant.userPrefix())+reserved)
+	}
+	return status
+}
+
+func (hs *HTTPServer) setStorageHeaders(w http.ResponseWriter, userID string) {
+	status := hs.uploads.storageStatus(userID)
+	w.Header().Set("X-Storage-Used", strconv.FormatUint(status.UsedBytes, 10))
+	if status.RemainingBytes != nil {
+		w.Header().Set("X-Storage-Quota", strconv.FormatUint(status.QuotaBytes, 10))
+		w.Header().Set("X-Storage-Remaining", strconv.FormatUint(*status.RemainingBytes, 10))
+	}
+}
+
+// ============================================
+// Usage API
+// ============================================
+
+// countingWriter tallies response body bytes for streaming usage.
+type countingWriter struct {
+	http.ResponseWriter
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+// ReadFrom keeps the ResponseWriter's sendfile path reachable through the
+// wrapper. http.ServeContent copies through io.LimitReader, which hides a
+// SpoolReader's own WriteTo, so that case is unwrapped here.
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if lr, ok := src.(*io.LimitedReader); ok {
+		if sr, ok := lr.R.(*SpoolReader); ok {
+			n, err = sr.writeTo(cw.ResponseWriter, lr.N)
+			lr.N -= n
+			cw.n += uint64(n)
+			return n, err
+		}
+	}
+	n, err = io.Copy(cw.ResponseWriter, src)
+	cw.n += uint64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// GET /usage?granularity=daily|monthly&from=YYYY-MM-DD&to=YYYY-MM-DD[&user_id=]
+// Users see their own usage. With the admin token, user_id selects any user.
+// Besides the periods, the response has the user's storage and quota now.
+func (hs *HTTPServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var userID string
+	if isAdminRequest(r) {
+		userID = query.Get("user_id")
+		if userID == "" {
+			writeJSONError(w, http.StatusBadRequest, "user_id is required")
+			return
+		}
+	} else {
+		tokenInfo, ok := hs.authenticate(r)
+		if !ok {
+			writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+			return
+		}
+		userID = tokenInfo.UserID
+	}
+
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = "daily"
+	}
+	if granularity != "daily" && granularity != "monthly" {
+		writeJSONError(w, http.StatusBadRequest, "granularity must be daily or monthly")
+		return
+	}
+
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, -30)
+	to := now
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(USAGE_DAY_FORMAT, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s date, expected YYYY-MM-DD", name))
+			return
+		}
+		*dst = t
+	}
+
+	periods := hs.usage.Report(userID, granularity, from, to)
+
+	var total UsageRecord
+	for i := range periods {
+		total.add(&periods[i].UsageRecord)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"granularity": granularity,
+		"from":        from.Format(USAGE_DAY_FORMAT),
+		"to":          to.Format(USAGE_DAY_FORMAT),
+		"periods":     periods,
+		"total":       total,
+		"storage":     hs.uploads.storageStatus(userID),
+	})
+}
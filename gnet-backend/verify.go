@@ -0,0 +1,450 @@
+// verify.go - Re-reading stored files against their recorded hashes
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ============================================
+// Stored File Verification
+// ============================================
+
+// The probe at finalize (integrity.go) only says an upload arrived whole.
+// What sits in the bucket afterwards can still rot: a faulty disk under a
+// self-hosted S3, an object overwritten by a script, a file gone from the
+// fs backend. The verification job re-reads stored files and compares them
+// with what was recorded when they completed: their size, their checksum
+// (the multipart ETag, recomputed from the object's chunk-size metadata)
+// and their SHA-256, if known. A file with no SHA-256 yet gets the one read,
+// so the next run can check it too.
+//
+// Every VERIFY_MINUTES (0, the default, leaves the job off) it verifies up
+// to VERIFY_BATCH files, those never verified first, then those verified
+// longest ago; a file is verified at most every VERIFY_EVERY_DAYS. Each
+// outcome is kept with the file (GET /metadata shows it as "integrity"). A
+// corrupt file's object is tagged integrity=corrupt, as the probe tags it,
+// and a corrupt or missing file is audit-logged as file.corrupt and sent to
+// INTEGRITY_WEBHOOK_URL as file.corrupt. Nothing is repaired or deleted.
+//
+//	GET  /admin/verification       the settings, the last run's report and the files found corrupt or missing
+//	POST /admin/verification/run   run now and return the report (?key=: verify that file only)
+//
+// Files are found in the metadata store, so the job needs METADATA_DB.
+// Files in the trash are not verified.
+
+const (
+	VERIFY_OK       = "ok"       // Matched what was recorded
+	VERIFY_RECORDED = "recorded" // Nothing to compare with; its SHA-256 is now recorded
+	VERIFY_CORRUPT  = "corrupt"
+	VERIFY_MISSING  = "missing" // The object is gone
+
+	VERIFY_REPORT_FILES = 100 // Corrupt and missing files listed in a report
+)
+
+var (
+	VERIFY_INTERVAL   = time.Duration(envInt("VERIFY_MINUTES", 0)) * time.Minute
+	VERIFY_BATCH      = envInt("VERIFY_BATCH", 100)
+	VERIFY_EVERY_DAYS = envInt("VERIFY_EVERY_DAYS", 30)
+)
+
+var errVerificationNotFound = errors.New("File has not been verified")
+
+// FileVerification is the outcome of verifying a file.
+type FileVerification struct {
+	Key        string    `json:"key"`
+	Owner      string    `json:"owner,omitempty"`
+	Status     string    `json:"status"`
+	Reason     string    `json:"reason,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// Verifier holds the last verification run's report.
+type Verifier struct {
+	runMu sync.Mutex // Serializes runs
+	mu    sync.Mutex
+	last  *VerificationReport
+}
+
+type VerificationReport struct {
+	StartedAt  time.Time          `json:"started_at"`
+	FinishedAt time.Time          `json:"finished_at"`
+	Files      int                `json:"files"`
+	Bytes      int64              `json:"bytes"`
+	Results    map[string]int     `json:"results"` // Files by status, and "error" for those that could not be read
+	Failed     []FileVerification `json:"failed"`  // Corrupt and missing
+	Error      string             `json:"error,omitempty"`
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{}
+}
+
+func (hs *HTTPServer) registerVerificationRoutes() {
+	hs.mux.Handle("GET /admin/verification", requireAdmin(http.HandlerFunc(hs.handleVerificationStatus)))
+	hs.mux.Handle("POST /admin/verification/run", requireAdmin(http.HandlerFunc(hs.handleRunVerification)))
+}
+
+// GET /admin/verification
+func (hs *HTTPServer) handleVerificationStatus(w http.ResponseWriter, r *http.Request) {
+	failed, err := hs.uploads.metadata.FailedVerifications(r.Context(), VERIFY_REPORT_FILES)
+	if err != nil {
+		hs.writeMetadataError(w, r, err)
+		return
+	}
+
+	verifier := hs.uploads.verifier
+	verifier.mu.Lock()
+	last := verifier.last
+	verifier.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"interval":   VERIFY_INTERVAL.String(),
+		"batch":      VERIFY_BATCH,
+		"every_days": VERIFY_EVERY_DAYS,
+		"last_run":   last,
+		"failed":     failed,
+	})
+}
+
+// POST /admin/verification/run
+func (hs *HTTPServer) handleRunVerification(w http.ResponseWriter, r *http.Request) {
+	// A run stopped halfway is safe, but the report would be cut short
+	ctx := context.WithoutCancel(r.Context())
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSON(w, http.StatusOK, hs.uploads.applyVerification(ctx))
+		return
+	}
+
+	file, err := hs.uploads.metadata.GetFile(ctx, key)
+	if err != nil {
+		hs.writeMetadataError(w, r, err)
+		return
+	}
+	if file.DeletedAt != nil {
+		writeJSONError(w, http.StatusConflict, "File is in the trash")
+		return
+	}
+	v, _, err := hs.uploads.verifyFile(ctx, file)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to verify file: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// ============================================
+// Worker
+// ============================================
+
+// RunVerification verifies a batch of files every VERIFY_INTERVAL.
+func (fus *FileUploadServer) RunVerification() {
+	if VERIFY_INTERVAL <= 0 || METADATA_DB == "" {
+		return
+	}
+	ticker := time.NewTicker(VERIFY_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fus.applyVerification(context.Background())
+	}
+}
+
+// applyVerification verifies the files due and keeps the report as the last
+// run's.
+func (fus *FileUploadServer) applyVerification(ctx context.Context) *VerificationReport {
+	fus.verifier.runMu.Lock()
+	defer fus.verifier.runMu.Unlock()
+
+	report := &VerificationReport{StartedAt: time.Now().UTC(), Results: make(map[string]int), Failed: make([]FileVerification, 0)}
+	before := report.StartedAt.AddDate(0, 0, -VERIFY_EVERY_DAYS)
+	files, err := fus.metadata.FilesToVerify(ctx, before, VERIFY_BATCH)
+	if err != nil {
+		report.Error = err.Error()
+		serverLog.WarnContext(ctx, "failed to list files to verify", "err", err)
+	}
+
+	for i := range files {
+		v, n, err := fus.verifyFile(ctx, &files[i])
+		report.Bytes += n
+		if err != nil {
+			report.Results["error"]++
+			serverLog.WarnContext(ctx, "failed to verify file", "key", files[i].Key, "err", err)
+			continue
+		}
+		report.Files++
+		report.Results[v.Status]++
+		if v.Status != VERIFY_OK && v.Status != VERIFY_RECORDED && len(report.Failed) < VERIFY_REPORT_FILES {
+			report.Failed = append(report.Failed, *v)
+		}
+	}
+	report.FinishedAt = time.Now().UTC()
+	if report.Files > 0 || report.Results["error"] > 0 {
+		serverLog.InfoContext(ctx, "verified stored files", "files", report.Files, "bytes", report.Bytes,
+			"corrupt", report.Results[VERIFY_CORRUPT], "missing", report.Results[VERIFY_MISSING], "errors", report.Results["error"])
+	}
+
+	fus.verifier.mu.Lock()
+	fus.verifier.last = report
+	fus.verifier.mu.Unlock()
+	return report
+}
+
+// verifyFile re-reads file's object, records the outcome and flags the file
+// if it is corrupt or missing. It returns the bytes read. An error means the
+// file could not be verified, and nothing was recorded.
+func (fus *FileUploadServer) verifyFile(ctx context.Context, file *FileRecord) (*FileVerification, int64, error) {
+	v := &FileVerification{Key: file.Key, Owner: file.Owner, Status: VERIFY_OK}
+	sums, n, err := fus.s3Client.hashObject(ctx, file.Key)
+	verifiedBytes.Add(float64(n))
+	switch {
+	case isNotFound(err):
+		v.Status, v.Reason = VERIFY_MISSING, "object not found"
+	case err != nil:
+		verifiedFiles.WithLabelValues("error").Inc()
+		return nil, n, err
+	default:
+		v.Status, v.Reason = sums.compare(file)
+	}
+	v.VerifiedAt = time.Now().UTC()
+
+	if v.Status == VERIFY_RECORDED || (v.Status == VERIFY_OK && file.SHA256 == "") {
+		if err := fus.metadata.SetContentHash(ctx, file.Key, sums.sha256); err != nil {
+			verifiedFiles.WithLabelValues("error").Inc()
+			return nil, n, err
+		}
+	}
+	if err := fus.metadata.PutVerification(ctx, v); err != nil {
+		verifiedFiles.WithLabelValues("error").Inc()
+		return nil, n, err
+	}
+	verifiedFiles.WithLabelValues(v.Status).Inc()
+
+	// Keeps the user's tags (tags.go); an object found whole again loses its
+	// corrupt tag
+	wasCorrupt := file.Integrity != nil && file.Integrity.Status == VERIFY_CORRUPT
+	if v.Status == VERIFY_CORRUPT || (wasCorrupt && v.Status != VERIFY_MISSING) {
+		isIntegrityTag := func(name string) bool { return name == "integrity" }
+		status := INTEGRITY_OK
+		if v.Status == VERIFY_CORRUPT {
+			status = INTEGRITY_CORRUPT
+		}
+		err := fus.s3Client.replaceObjectTags(ctx, file.Key, isIntegrityTag,
+			[]types.Tag{{Key: aws.String("integrity"), Value: aws.String(status)}})
+		if err != nil {
+			s3Log.WarnContext(ctx, "failed to tag object", "s3_key", file.Key, "err", err)
+		}
+	}
+
+	if v.Status == VERIFY_CORRUPT || v.Status == VERIFY_MISSING {
+		s3Log.ErrorContext(ctx, "stored file failed verification", "key", file.Key, "status", v.Status, "reason", v.Reason)
+		auditLog.Record(AUDIT_FILE_CORRUPT, file.Owner, "", "", file.Key+" "+v.Status+": "+v.Reason)
+		sendWebhook(ctx, INTEGRITY_WEBHOOK_URL, "file.corrupt", v)
+	}
+	return v, n, nil
+}
+
+// objectSums are the hashes of an object as read back.
+type objectSums struct {
+	size   int64
+	sha256 string
+	md5    string // Of the whole object: the ETag of one uploaded in one piece
+	etag   string // Multipart, "md5(part md5s)-N"; empty without chunk-size metadata
+}
+
+// hashObject reads key's object through, hashing it as compare needs.
+func (s3c *S3Client) hashObject(ctx context.Context, key string) (*objectSums, int64, error) {
+	obj, err := s3c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer obj.Body.Close()
+
+	// Parts are as the upload made them: ChunksPerPart chunks (aggregate.go)
+	whole, content := md5.New(), sha256.New()
+	var parts *partHash
+	if chunkSize, _ := strconv.ParseUint(obj.Metadata[OBJECT_META_CHUNK_SIZE], 10, 32); chunkSize > 0 {
+		parts = &partHash{size: int64(chunkSize) * int64(chunksPerPart(uint32(chunkSize))), part: md5.New()}
+	}
+	w := io.MultiWriter(whole, content)
+	if parts != nil {
+		w = io.MultiWriter(whole, content, parts)
+	}
+	n, err := io.Copy(w, obj.Body)
+	if err != nil {
+		return nil, n, err
+	}
+
+	sums := &objectSums{size: n, sha256: hex.EncodeToString(content.Sum(nil)), md5: hex.EncodeToString(whole.Sum(nil))}
+	if parts != nil {
+		sums.etag = parts.etag()
+	}
+	return sums, n, nil
+}
+
+// compare checks the sums against file's record, returning a status and the
+// reason for it.
+func (sums *objectSums) compare(file *FileRecord) (string, string) {
+	if sums.size != file.Size {
+		return VERIFY_CORRUPT, fmt.Sprintf("size %d, recorded %d", sums.size, file.Size)
+	}
+	if file.SHA256 != "" && file.SHA256 != sums.sha256 {
+		return VERIFY_CORRUPT, "sha256 " + sums.sha256 + ", recorded " + file.SHA256
+	}
+
+	// A multipart checksum is only recomputed if it has as many parts as the
+	// chunk size gives; a copy made with other part sizes does not
+	checksum := strings.Trim(file.Checksum, `"`)
+	computed := sums.md5
+	if i := strings.LastIndexByte(checksum, '-'); i >= 0 {
+		computed = ""
+		if j := strings.LastIndexByte(sums.etag, '-'); j >= 0 && sums.etag[j:] == checksum[i:] {
+			computed = sums.etag
+		}
+	}
+	switch {
+	case checksum != "" && computed != "" && computed != checksum:
+		return VERIFY_CORRUPT, "checksum " + computed + ", recorded " + checksum
+	case checksum != "" && computed != "", file.SHA256 != "":
+		return VERIFY_OK, ""
+	default:
+		return VERIFY_RECORDED, ""
+	}
+}
+
+// partHash computes a multipart ETag over parts of size bytes.
+type partHash struct {
+	size  int64
+	part  hash.Hash
+	n     int64 // Bytes in part
+	sums  []byte
+	count int
+}
+
+func (ph *partHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		take := min(int64(len(p)), ph.size-ph.n)
+		ph.part.Write(p[:take])
+		ph.n += take
+		p = p[take:]
+		if ph.n == ph.size {
+			ph.endPart()
+		}
+	}
+	return written, nil
+}
+
+func (ph *partHash) endPart() {
+	ph.sums = ph.part.Sum(ph.sums)
+	ph.part.Reset()
+	ph.n = 0
+	ph.count++
+}
+
+func (ph *partHash) etag() string {
+	if ph.n > 0 || ph.count == 0 {
+		ph.endPart()
+	}
+	total := md5.Sum(ph.sums)
+	return hex.EncodeToString(total[:]) + "-" + strconv.Itoa(ph.count)
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) FilesToVerify(ctx context.Context, before time.Time, limit int) ([]FileRecord, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT f.s3_key, f.owner, f.file_name, f.version, f.size, f.checksum, f.sha256, f.content_type, f.created_at, f.completed_at,
+			v.status, v.reason, v.verified_at
+		FROM files f LEFT JOIN file_verifications v ON v.s3_key = f.s3_key
+		WHERE f.deleted_at IS NULL AND (v.verified_at IS NULL OR v.verified_at < $1)
+		ORDER BY v.verified_at IS NOT NULL, v.verified_at, f.completed_at
+		LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]FileRecord, 0)
+	for rows.Next() {
+		var file FileRecord
+		var status, reason sql.NullString
+		var verifiedAt sql.NullTime
+		if err := rows.Scan(&file.Key, &file.Owner, &file.FileName, &file.Version, &file.Size, &file.Checksum, &file.SHA256, &file.ContentType,
+			&file.CreatedAt, &file.CompletedAt, &status, &reason, &verifiedAt); err != nil {
+			return nil, err
+		}
+		if verifiedAt.Valid {
+			file.Integrity = &FileVerification{Key: file.Key, Owner: file.Owner, Status: status.String, Reason: reason.String, VerifiedAt: verifiedAt.Time}
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func (ms *sqlMetadataStore) PutVerification(ctx context.Context, v *FileVerification) error {
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO file_verifications (s3_key, status, reason, verified_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (s3_key) DO UPDATE SET status = excluded.status, reason = excluded.reason, verified_at = excluded.verified_at`,
+		v.Key, v.Status, v.Reason, v.VerifiedAt)
+	return err
+}
+
+func (ms *sqlMetadataStore) GetVerification(ctx context.Context, key string) (*FileVerification, error) {
+	v := &FileVerification{Key: key}
+	err := ms.db.QueryRowContext(ctx, `SELECT status, reason, verified_at FROM file_verifications WHERE s3_key = $1`, key).
+		Scan(&v.Status, &v.Reason, &v.VerifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errVerificationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (ms *sqlMetadataStore) FailedVerifications(ctx context.Context, limit int) ([]FileVerification, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT v.s3_key, f.owner, v.status, v.reason, v.verified_at
+		FROM file_verifications v JOIN files f ON f.s3_key = v.s3_key
+		WHERE v.status IN ($1, $2)
+		ORDER BY v.verified_at DESC
+		LIMIT $3`, VERIFY_CORRUPT, VERIFY_MISSING, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failed := make([]FileVerification, 0)
+	for rows.Next() {
+		var v FileVerification
+		if err := rows.Scan(&v.Key, &v.Owner, &v.Status, &v.Reason, &v.VerifiedAt); err != nil {
+			return nil, err
+		}
+		failed = append(failed, v)
+	}
+	return failed, rows.Err()
+}
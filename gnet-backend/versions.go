@@ -0,0 +1,215 @@
+// versions.go - Versions of a file uploaded to the same path again
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ============================================
+// File Versions
+// ============================================
+
+// Every upload gets a key of its own (user_id/timestamp/file_name), so
+// uploading a file again never overwrites it. The metadata store relates
+// the keys: an owner's files with the same file name (the path, with any
+// directories a sync prefix put in it) are versions 1, 2, ... of that path,
+// numbered as they are recorded. The newest version not in the trash is the
+// current one, and is also the path's newest key in GET /files.
+//
+//	GET  /files/versions?path=...   the path's versions, newest first
+//	POST /files/rollback            {"path", "version"}
+//
+// Rolling back copies the old version to a new key (as trash.go copies, so
+// the checksum is unchanged) with its attributes and tags, making it the
+// path's newest version; the versions in between are kept. A version in the
+// trash must be restored before it can be rolled back to.
+//
+// Versions need METADATA_DB.
+
+type RollbackRequest struct {
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+}
+
+type FileVersions struct {
+	Path     string       `json:"path"`
+	Current  int          `json:"current"` // 0 if every version is in the trash
+	Versions []FileRecord `json:"versions"`
+}
+
+func (hs *HTTPServer) registerVersionRoutes() {
+	hs.mux.HandleFunc("GET /files/versions", hs.handleListVersions)
+	hs.mux.HandleFunc("POST /files/rollback", hs.handleRollback)
+}
+
+// GET /files/versions?path=...
+func (hs *HTTPServer) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSONError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	versions, ok := hs.fileVersions(w, r, tokenInfo.UserID, path)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// POST /files/rollback
+func (hs *HTTPServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	tokenInfo, ok := hs.authenticate(r)
+	if !ok {
+		auditLog.Record(AUDIT_AUTH_FAILED, "", "", r.RemoteAddr, r.URL.Path)
+		writeJSONError(w, http.StatusUnauthorized, "Authentication failed")
+		return
+	}
+
+	var req RollbackRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	versions, ok := hs.fileVersions(w, r, tokenInfo.UserID, req.Path)
+	if !ok {
+		return
+	}
+	var target *FileRecord
+	for i := range versions.Versions {
+		if versions.Versions[i].Version == req.Version {
+			target = &versions.Versions[i]
+		}
+	}
+	switch {
+	case target == nil:
+		writeJSONError(w, http.StatusNotFound, "Version not found")
+		return
+	case target.DeletedAt != nil:
+		writeJSONError(w, http.StatusConflict, "Version is in the trash; restore it first")
+		return
+	case target.Version == versions.Current:
+		writeJSONError(w, http.StatusConflict, "Version is already current")
+		return
+	}
+
+	ctx := r.Context()
+	// Attributes and tags are not in the version list
+	source, err := hs.uploads.metadata.GetFile(ctx, target.Key)
+	if !hs.writeMetadataError(w, r, err) {
+		return
+	}
+	if tenant := tokenInfo.Tenant; tenant != nil {
+		tenant.mu.Lock()
+		err = hs.uploads.checkTenantLimits(tenant, uint64(source.Size))
+		tenant.mu.Unlock()
+	}
+	if quota := hs.uploads.userQuota(tokenInfo.UserID); err == nil && quota > 0 {
+		hs.uploads.quotaMu.Lock()
+		err = hs.uploads.checkUserQuota(tokenInfo.UserID, quota, uint64(source.Size))
+		hs.uploads.quotaMu.Unlock()
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Keys are to the second; one made this second would be overwritten
+	key := newS3Key(tokenInfo.UserID, req.Path)
+	if key == versions.Versions[0].Key {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusConflict, "A version of this path was stored this second; try again")
+		return
+	}
+	if _, err := hs.sessionMgr.s3Client.copyObject(ctx, source.Key, key); writeTrashError(w, r, source.Key, err) {
+		return
+	}
+	hs.usage.RecordStored(tokenInfo.UserID, uint64(source.Size))
+
+	now := time.Now().UTC()
+	file := &FileRecord{
+		Key:         key,
+		Owner:       tokenInfo.UserID,
+		FileName:    req.Path,
+		Size:        source.Size,
+		Checksum:    source.Checksum,
+		SHA256:      source.SHA256,
+		ContentType: source.ContentType,
+		CreatedAt:   now,
+		CompletedAt: now,
+		Attributes:  source.Attributes,
+	}
+	err = hs.uploads.metadata.PutFile(ctx, file)
+	if err == nil && len(source.Tags) > 0 {
+		file.Tags, err = hs.uploads.metadata.UpdateTags(ctx, key, source.Tags, nil)
+	}
+	if err != nil {
+		// The copy is there all the same, as an unversioned file
+		httpLog.ErrorContext(ctx, "failed to record rolled back file", "key", key, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to record file metadata")
+		return
+	}
+
+	hs.uploads.indexer.Enqueue(key, file.ContentType)
+
+	auditLog.Record(AUDIT_FILE_ROLLED_BACK, tokenInfo.UserID, "", r.RemoteAddr, source.Key+" -> "+key)
+	httpLog.InfoContext(ctx, "rolled back file", "path", req.Path, "from_version", source.Version, "version", file.Version, "key", key)
+	writeJSON(w, http.StatusCreated, file)
+}
+
+// fileVersions looks up the versions of owner's path, answering the request
+// itself if there are none.
+func (hs *HTTPServer) fileVersions(w http.ResponseWriter, r *http.Request, owner, path string) (*FileVersions, bool) {
+	records, err := hs.uploads.metadata.ListVersions(r.Context(), owner, path)
+	if !hs.writeMetadataError(w, r, err) {
+		return nil, false
+	}
+	if len(records) == 0 {
+		writeJSONError(w, http.StatusNotFound, "File not found")
+		return nil, false
+	}
+
+	versions := &FileVersions{Path: path, Versions: records}
+	for _, record := range records {
+		if record.DeletedAt == nil {
+			versions.Current = record.Version
+			break
+		}
+	}
+	return versions, true
+}
+
+// ============================================
+// SQL Store
+// ============================================
+
+func (ms *sqlMetadataStore) ListVersions(ctx context.Context, owner, fileName string) ([]FileRecord, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT s3_key, version, size, checksum, content_type, created_at, completed_at, deleted_at
+		FROM files WHERE owner = $1 AND file_name = $2
+		ORDER BY version DESC`, owner, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]FileRecord, 0)
+	for rows.Next() {
+		file := FileRecord{Owner: owner, FileName: fileName}
+		if err := rows.Scan(&file.Key, &file.Version, &file.Size, &file.Checksum, &file.ContentType, &file.CreatedAt, &file.CompletedAt, &file.DeletedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
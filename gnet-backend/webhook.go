@@ -0,0 +1,68 @@
+// webhook.go - Outbound JSON webhook notifications
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ============================================
+// Webhooks
+// ============================================
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type WebhookEvent struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	RequestID string      `json:"request_id,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+// sendWebhook posts an event to url in the background. Delivery is best
+// effort: failures are logged and never affect the upload path. The request or
+// connection ID carried by ctx is included in the payload.
+func sendWebhook(ctx context.Context, url, event string, data interface{}) {
+	if url == "" {
+		return
+	}
+
+	postWebhook(ctx, url, event, WebhookEvent{
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		RequestID: correlationID(ctx),
+		Data:      data,
+	})
+}
+
+// sendSlack posts a plain-text message to a Slack incoming webhook.
+func sendSlack(ctx context.Context, url, event, text string) {
+	if url == "" {
+		return
+	}
+	postWebhook(ctx, url, event, map[string]string{"text": text})
+}
+
+func postWebhook(ctx context.Context, url, event string, payload interface{}) {
+	go func() {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			webhookLog.ErrorContext(ctx, "failed to encode webhook", "event", event, "err", err)
+			return
+		}
+
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			webhookLog.WarnContext(ctx, "webhook delivery failed", "event", event, "err", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			webhookLog.WarnContext(ctx, "webhook delivery failed", "event", event, "status", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+// websocket.go - The binary protocol over WebSocket, for browsers
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"backend/protocol"
+)
+
+// ============================================
+// WebSocket Bridge
+// ============================================
+
+// Browsers cannot open the TCP connection the binary protocol needs, so with
+// WEBSOCKET_UPLOADS=1 it is also served over WebSocket at GET /upload/ws.
+// The client sends request frames exactly as on the binary port
+// (protocol.AppendFrame, encodeFrame in the web client) in binary messages,
+// which are read as one stream: a frame may span messages, or share one with
+// the next. Each response comes back as a binary message of its own. A text
+// message closes the connection.
+//
+// Like a TLS connection (tls.go), the stream reaches the event loops through
+// a socketpair, so a browser gets what native clients get on the binary port:
+// pipelined chunks, pause and resume, rate limits and quotas. The token is in
+// every frame rather than in the upgrade request, which carries no
+// credentials, so pages on any origin may connect. The client's address is
+// the request's, or with RATE_LIMIT_TRUST_FORWARDED=1 the last
+// X-Forwarded-For hop (ratelimit.go). The gateway proxies /upload/ to this
+// server, upgrades included.
+
+var WEBSOCKET_UPLOADS = envBool("WEBSOCKET_UPLOADS", false)
+
+const (
+	WEBSOCKET_BUFFER_SIZE   = 64 * 1024
+	WEBSOCKET_CLOSE_TIMEOUT = time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  WEBSOCKET_BUFFER_SIZE,
+	WriteBufferSize: WEBSOCKET_BUFFER_SIZE,
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
+func (hs *HTTPServer) registerWebSocketRoutes() {
+	if WEBSOCKET_UPLOADS {
+		hs.mux.HandleFunc("GET /upload/ws", hs.handleWebSocket)
+	}
+}
+
+// GET /upload/ws
+func (hs *HTTPServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-hs.uploads.booted:
+	default:
+		writeJSONError(w, http.StatusServiceUnavailable, "Binary server is not running yet")
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has answered the request
+	}
+	defer conn.Close()
+
+	remote := r.RemoteAddr
+	if RATE_LIMIT_TRUST_FORWARDED {
+		remote = requestIP(r)
+	}
+	local, err := hs.uploads.registerSocket(remote)
+	if err != nil {
+		httpLog.ErrorContext(r.Context(), "failed to register WebSocket connection", "remote", remote, "err", err)
+		closeWebSocket(conn, websocket.CloseInternalServerErr, "")
+		return
+	}
+	defer local.Close()
+	websocketConnections.Inc()
+
+	// Either side closing ends both, as for TLS
+	done := make(chan struct{}, 2)
+	go func() {
+		readMessages(conn, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		writeResponses(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// readMessages copies the client's binary messages to the event loops.
+func readMessages(conn *websocket.Conn, local io.Writer) {
+	for {
+		kind, message, err := conn.NextReader()
+		if err != nil {
+			return
+		}
+		if kind != websocket.BinaryMessage {
+			closeWebSocket(conn, websocket.CloseUnsupportedData, "Binary messages only")
+			return
+		}
+		if _, err := io.Copy(local, message); err != nil {
+			return
+		}
+	}
+}
+
+// writeResponses sends each response from the event loops to the client as
+// one message.
+func writeResponses(conn *websocket.Conn, local io.Reader) {
+	r := bufio.NewReaderSize(local, WEBSOCKET_BUFFER_SIZE)
+	var raw bytes.Buffer
+	for {
+		raw.Reset()
+		if _, err := protocol.ReadResponse(io.TeeReader(r, &raw)); err != nil {
+			switch {
+			case errors.Is(err, net.ErrClosed):
+				// The client went away first
+			case errors.Is(err, io.EOF):
+				closeWebSocket(conn, websocket.CloseNormalClosure, "")
+			default:
+				httpLog.Error("failed to read response for WebSocket", "err", err)
+				closeWebSocket(conn, websocket.CloseInternalServerErr, "")
+			}
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, raw.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WEBSOCKET_CLOSE_TIMEOUT))
+}
@@ -0,0 +1,43 @@
+"""Python client for the high performance upload server.
+
+    from hpu_client import HTTPClient
+
+    client = HTTPClient("http://gateway:5000", token)
+    done = client.upload_file("video.mp4", parallelism=4)
+    print(done.s3_key, done.size)
+
+    # After an interruption, in the same or a new process:
+    client.resume_file(session_id, "video.mp4")
+
+``HTTPClient`` talks to the HTTP chunk API (/upload/*) and is the usual
+choice. ``BinaryClient`` speaks the raw TCP protocol on the binary port for
+lower overhead. Both expose the same upload_file / resume_file calls.
+"""
+
+from .binary import BinaryClient
+from .errors import AuthError, BusyError, UploadError
+from .http import HTTPClient
+from .upload import (
+    DEFAULT_CHUNK_SIZE,
+    MAX_CHUNK_SIZE,
+    MIN_CHUNK_SIZE,
+    MIN_SMALL_CHUNK_SIZE,
+    ChunkResult,
+    Completed,
+    Status,
+)
+
+__all__ = [
+    "HTTPClient",
+    "BinaryClient",
+    "UploadError",
+    "AuthError",
+    "BusyError",
+    "ChunkResult",
+    "Completed",
+    "Status",
+    "MIN_CHUNK_SIZE",
+    "MIN_SMALL_CHUNK_SIZE",
+    "MAX_CHUNK_SIZE",
+    "DEFAULT_CHUNK_SIZE",
+]
@@ -0,0 +1,268 @@
+"""Client for the binary upload protocol (gnet port 9000, or the gateway's
+binary proxy). Codes come from protocol_gen.py, generated from the protocol
+schema in gnet-backend/protocol."""
+
+import socket
+import struct
+import threading
+import time
+
+from .errors import BUSY_MESSAGE, AuthError, BusyError, UploadError
+from .protocol_gen import (
+    CMD_CANCEL_UPLOAD,
+    CMD_GET_STATUS,
+    CMD_INIT_UPLOAD,
+    CMD_PAUSE_UPLOAD,
+    CMD_RESUME_UPLOAD,
+    CMD_UPLOAD_CHUNK,
+    COMMAND_NAMES,
+    ETA_UNKNOWN,
+    MAX_TOKEN_SIZE,
+    RESP_AUTH_FAILED,
+    RESP_CANCELLED,
+    RESP_CHUNK_ACK,
+    RESP_COMPLETE,
+    RESP_DUPLICATE,
+    RESP_ERROR,
+    RESP_OK,
+    RESP_PAUSED,
+    RESP_READY,
+    RESP_RESUMED,
+    RESP_STATUS,
+)
+from .upload import ChunkResult, Completed, Status, UploadMixin
+
+DEFAULT_TIMEOUT = 300
+DEFAULT_RETRIES = 5
+RETRY_BACKOFF = 0.5
+MAX_RETRY_BACKOFF = 30.0
+
+
+class BinaryClient(UploadMixin):
+    """One connection to the binary protocol port, opened lazily and
+    re-dialled after network errors. Calls are serialised on the connection;
+    parallel uploads open one connection per worker."""
+
+    def __init__(self, host, port, token, timeout=DEFAULT_TIMEOUT, retries=DEFAULT_RETRIES):
+        self.host = host
+        self.port = port
+        self.token = token
+        self.timeout = timeout
+        self.retries = retries
+        self._sock = None
+        self._reader = None
+        self._lock = threading.Lock()
+
+    def close(self):
+        with self._lock:
+            self._close()
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+    # ============================================
+    # Commands
+    # ============================================
+
+    def init_upload(self, file_name, total_chunks, chunk_size):
+        """Open a session and return its ID. If the connection drops after the
+        server accepted the command, the retry opens a second session; the
+        first is reaped by the server's session timeout."""
+        name = file_name.encode()
+        data = struct.pack(">H", len(name)) + name + struct.pack(">II", total_chunks, chunk_size)
+        code, resp = self._do(CMD_INIT_UPLOAD, data)
+        _expect(CMD_INIT_UPLOAD, code, RESP_READY)
+        return resp["session_id"]
+
+    def upload_chunk(self, session_id, index, data) -> ChunkResult:
+        data = _session(session_id) + struct.pack(">II", index, len(data)) + data
+        code, resp = self._do(CMD_UPLOAD_CHUNK, data)
+
+        if code == RESP_CHUNK_ACK:
+            eta = resp["eta"]
+            return ChunkResult(
+                index=index,
+                received=resp["received"],
+                total=resp["total"],
+                bytes_per_sec=resp["bytes_per_sec"],
+                eta=None if eta == ETA_UNKNOWN else float(eta),
+            )
+        if code == RESP_DUPLICATE:
+            return ChunkResult(index=index, received=resp["received"], total=0, duplicate=True)
+        if code == RESP_COMPLETE:
+            return ChunkResult(
+                index=index,
+                received=0,
+                total=0,
+                eta=0.0,
+                complete=Completed(s3_key=resp["s3_key"], size=resp["size"]),
+            )
+        raise _unexpected(CMD_UPLOAD_CHUNK, code)
+
+    def status(self, session_id) -> Status:
+        code, resp = self._do(CMD_GET_STATUS, _session(session_id))
+        _expect(CMD_GET_STATUS, code, RESP_STATUS)
+        return Status(state=resp["state"], received=resp["received"], total=resp["total"])
+
+    def pause(self, session_id) -> Status:
+        code, resp = self._do(CMD_PAUSE_UPLOAD, _session(session_id))
+        _expect(CMD_PAUSE_UPLOAD, code, RESP_PAUSED)
+        return Status(state="paused", received=resp["received"], total=resp["total"])
+
+    def resume(self, session_id) -> Status:
+        """Continue a paused session; missing lists the chunks still to send."""
+        code, resp = self._do(CMD_RESUME_UPLOAD, _session(session_id))
+        _expect(CMD_RESUME_UPLOAD, code, RESP_RESUMED)
+        return Status(
+            state="uploading",
+            received=resp["received"],
+            total=resp["total"],
+            missing=resp["missing"],
+        )
+
+    def cancel(self, session_id):
+        code, _ = self._do(CMD_CANCEL_UPLOAD, _session(session_id))
+        _expect(CMD_CANCEL_UPLOAD, code, RESP_CANCELLED)
+
+    def _missing_chunks(self, session_id):
+        # Only RESUME reports the missing chunks, and it requires a paused session
+        if self.status(session_id).state != "paused":
+            self.pause(session_id)
+        return self.resume(session_id).missing
+
+    def _clone(self):
+        return BinaryClient(self.host, self.port, self.token, self.timeout, self.retries)
+
+    # ============================================
+    # Transport
+    # ============================================
+
+    def _do(self, cmd, data):
+        token = self.token.encode()
+        if len(token) > MAX_TOKEN_SIZE:
+            raise UploadError(f"auth token too long: {len(token)} bytes (max {MAX_TOKEN_SIZE})")
+        frame = (
+            struct.pack(">I", len(token)) + token + struct.pack(">IB", 1 + len(data), cmd) + data
+        )
+
+        with self._lock:
+            backoff = RETRY_BACKOFF
+            for attempt in range(self.retries + 1):
+                try:
+                    code, resp = self._round_trip(frame)
+                    break
+                except OSError as err:
+                    self._close()
+                    if attempt == self.retries:
+                        raise UploadError(
+                            f"{_command_name(cmd)} failed after {attempt + 1} attempts: {err}"
+                        )
+                except UploadError:
+                    # The stream position is unknown after a malformed response
+                    self._close()
+                    raise
+                time.sleep(backoff)
+                backoff = min(backoff * 2, MAX_RETRY_BACKOFF)
+
+        if code == RESP_ERROR:
+            message = resp["message"]
+            if message.startswith(BUSY_MESSAGE):
+                raise BusyError(message)
+            raise UploadError(message)
+        if code == RESP_AUTH_FAILED:
+            raise AuthError("authentication failed")
+        return code, resp
+
+    def _round_trip(self, frame):
+        if self._sock is None:
+            self._sock = socket.create_connection((self.host, self.port), timeout=self.timeout)
+            self._reader = self._sock.makefile("rb")
+        self._sock.sendall(frame)
+        return _read_response(self._reader)
+
+    def _close(self):
+        if self._sock is None:
+            return
+        try:
+            self._reader.close()
+            self._sock.close()
+        finally:
+            self._sock = None
+            self._reader = None
+
+
+def _session(session_id):
+    sid = session_id.encode()
+    return struct.pack(">H", len(sid)) + sid
+
+
+def _read_exact(r, n):
+    buf = r.read(n)
+    if len(buf) < n:
+        raise ConnectionError("connection closed mid-response")
+    return buf
+
+
+def _read_string16(r):
+    (size,) = struct.unpack(">H", _read_exact(r, 2))
+    return _read_exact(r, size).decode()
+
+
+def _read_response(r):
+    code = _read_exact(r, 1)[0]
+
+    if code in (RESP_OK, RESP_CANCELLED, RESP_AUTH_FAILED):
+        return code, {}
+    if code == RESP_ERROR:
+        size = _read_exact(r, 1)[0]
+        return code, {"message": _read_exact(r, size).decode(errors="replace")}
+    if code == RESP_READY:
+        return code, {"session_id": _read_string16(r), "s3_key": _read_string16(r)}
+    if code == RESP_CHUNK_ACK:
+        index, received, total, rate, eta = struct.unpack(">IIIQI", _read_exact(r, 24))
+        return code, {
+            "index": index,
+            "received": received,
+            "total": total,
+            "bytes_per_sec": rate,
+            "eta": eta,
+        }
+    if code == RESP_DUPLICATE:
+        index, received = struct.unpack(">II", _read_exact(r, 8))
+        return code, {"index": index, "received": received}
+    if code == RESP_COMPLETE:
+        key = _read_string16(r)
+        (size,) = struct.unpack(">Q", _read_exact(r, 8))
+        return code, {"s3_key": key, "size": size}
+    if code == RESP_STATUS:
+        size = _read_exact(r, 1)[0]
+        state = _read_exact(r, size).decode()
+        received, total = struct.unpack(">II", _read_exact(r, 8))
+        return code, {"state": state, "received": received, "total": total}
+    if code == RESP_PAUSED:
+        received, total = struct.unpack(">II", _read_exact(r, 8))
+        return code, {"received": received, "total": total}
+    if code == RESP_RESUMED:
+        received, total, count = struct.unpack(">III", _read_exact(r, 12))
+        if count > total:
+            raise UploadError(f"malformed RESUMED response: {count} missing of {total} chunks")
+        missing = list(struct.unpack(f">{count}I", _read_exact(r, count * 4)))
+        return code, {"received": received, "total": total, "missing": missing}
+
+    raise UploadError(f"unknown response code 0x{code:02x}")
+
+
+def _command_name(cmd):
+    return COMMAND_NAMES.get(cmd, f"0x{cmd:02x}")
+
+
+def _unexpected(cmd, code):
+    return UploadError(f"unexpected response 0x{code:02x} to {_command_name(cmd)}")
+
+
+def _expect(cmd, code, want):
+    if code != want:
+        raise _unexpected(cmd, code)
@@ -0,0 +1,23 @@
+"""Errors raised by both transports."""
+
+
+class UploadError(Exception):
+    """A request the server rejected. ``status`` is the HTTP status code, or
+    0 for the binary protocol."""
+
+    def __init__(self, message, status=0):
+        super().__init__(message)
+        self.status = status
+
+
+class AuthError(UploadError):
+    pass
+
+
+class BusyError(UploadError):
+    """The session already has the server's maximum of chunks in flight; the
+    chunk was not stored and can be sent again shortly."""
+
+
+# Prefix of the server's busy error (errSessionBusy in gnet-backend/main.go)
+BUSY_MESSAGE = "Too many chunks in flight"
@@ -0,0 +1,168 @@
+"""Client for the HTTP chunk API (/upload/* on the gateway or upload server)."""
+
+import hashlib
+import json
+import time
+import uuid
+from urllib.error import HTTPError, URLError
+from urllib.parse import quote
+from urllib.request import Request, urlopen
+
+from .errors import AuthError, BusyError, UploadError
+from .upload import ChunkResult, Completed, Status, UploadMixin
+
+DEFAULT_TIMEOUT = 300  # Seconds; covers the server's S3 part upload
+DEFAULT_RETRIES = 5
+RETRY_BACKOFF = 0.5
+MAX_RETRY_BACKOFF = 30.0
+
+
+class HTTPClient(UploadMixin):
+    """Uploads through the HTTP chunk API.
+
+    Network errors and 5xx responses are retried with exponential backoff;
+    chunks are idempotent, so a retried chunk is at worst a duplicate.
+    Each chunk carries its SHA-256 so the server rejects corrupted bodies.
+    """
+
+    def __init__(self, base_url, token, timeout=DEFAULT_TIMEOUT, retries=DEFAULT_RETRIES):
+        self.base_url = base_url.rstrip("/")
+        self.token = token
+        self.timeout = timeout
+        self.retries = retries
+
+    def close(self):
+        pass
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+    # ============================================
+    # Commands
+    # ============================================
+
+    def init_upload(self, file_name, total_chunks, chunk_size):
+        """Open a session and return its ID."""
+        body = json.dumps(
+            {"file_name": file_name, "total_chunks": total_chunks, "chunk_size": chunk_size}
+        ).encode()
+        resp = self._request("POST", "/upload/init", body, "application/json")
+        return resp["session_id"]
+
+    def upload_chunk(self, session_id, index, data) -> ChunkResult:
+        fields = {
+            "session_id": session_id,
+            "chunk_index": str(index),
+            "sha256": hashlib.sha256(data).hexdigest(),
+            "size": str(len(data)),
+        }
+        body, content_type = encode_multipart(fields, "chunk", data)
+        resp = self._request("POST", "/upload/chunk", body, content_type)
+
+        result = ChunkResult(
+            index=resp["chunk_index"],
+            received=resp["received"],
+            total=resp["total"],
+            duplicate=resp["duplicate"],
+            bytes_per_sec=resp["bytes_per_second"],
+            eta=resp["eta_seconds"],
+        )
+        if resp.get("complete"):
+            result.complete = Completed(s3_key=resp["s3_key"], size=resp["size"])
+        return result
+
+    def status(self, session_id) -> Status:
+        resp = self._request("GET", "/upload/status/" + quote(session_id, safe=""))
+        return _status(resp)
+
+    def pause(self, session_id) -> Status:
+        return _status(self._request("POST", "/upload/pause/" + quote(session_id, safe="")))
+
+    def resume(self, session_id) -> Status:
+        return _status(self._request("POST", "/upload/resume/" + quote(session_id, safe="")))
+
+    def cancel(self, session_id):
+        self._request("POST", "/upload/cancel/" + quote(session_id, safe=""))
+
+    def _missing_chunks(self, session_id):
+        status = self.status(session_id)
+        if status.state == "paused":
+            status = self.resume(session_id)
+        return status.missing
+
+    def _clone(self):
+        # urllib opens a connection per request, so one client serves every thread
+        return self
+
+    # ============================================
+    # Transport
+    # ============================================
+
+    def _request(self, method, route, body=None, content_type=None):
+        headers = {"Authorization": "Bearer " + self.token}
+        if content_type:
+            headers["Content-Type"] = content_type
+
+        backoff = RETRY_BACKOFF
+        for attempt in range(self.retries + 1):
+            req = Request(self.base_url + route, data=body, method=method, headers=headers)
+            try:
+                with urlopen(req, timeout=self.timeout) as resp:
+                    if resp.status == 204:
+                        return None
+                    return json.load(resp)
+            except HTTPError as err:
+                error = _http_error(err)
+                if err.code < 500 or attempt == self.retries:
+                    raise error from None
+            except (URLError, OSError) as err:
+                if attempt == self.retries:
+                    raise UploadError(f"{method} {route} failed after {attempt + 1} attempts: {err}")
+
+            time.sleep(backoff)
+            backoff = min(backoff * 2, MAX_RETRY_BACKOFF)
+
+
+def _http_error(err):
+    try:
+        message = json.load(err).get("error") or err.reason
+    except ValueError:
+        message = err.reason
+    if err.code == 401:
+        return AuthError(message, err.code)
+    if err.code == 429:
+        return BusyError(message, err.code)
+    return UploadError(message, err.code)
+
+
+def _status(resp):
+    return Status(
+        state=resp["state"],
+        received=resp["received"],
+        total=resp["total"],
+        missing=resp.get("missing") or [],
+    )
+
+
+def encode_multipart(fields, file_field, data):
+    """multipart/form-data with the plain fields first; the server reads them
+    before streaming the chunk."""
+    boundary = uuid.uuid4().hex
+    parts = []
+    for name, value in fields.items():
+        parts.append(
+            f'--{boundary}\r\nContent-Disposition: form-data; name="{name}"\r\n\r\n{value}\r\n'.encode()
+        )
+    parts.append(
+        (
+            f"--{boundary}\r\n"
+            f'Content-Disposition: form-data; name="{file_field}"; filename="{file_field}"\r\n'
+            "Content-Type: application/octet-stream\r\n\r\n"
+        ).encode()
+    )
+    parts.append(data)
+    parts.append(f"\r\n--{boundary}--\r\n".encode())
+    return b"".join(parts), "multipart/form-data; boundary=" + boundary
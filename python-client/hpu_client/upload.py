@@ -0,0 +1,188 @@
+"""Whole-file upload and resume, shared by both transports."""
+
+import os
+import threading
+import time
+from concurrent.futures import FIRST_EXCEPTION, ThreadPoolExecutor, wait
+from dataclasses import dataclass, field
+from typing import Callable, List, Optional
+
+from .errors import BusyError, UploadError
+
+MIN_SMALL_CHUNK_SIZE = 256 * 1024  # Server minimum; the server combines such chunks into parts
+MIN_CHUNK_SIZE = 5 * 1024 * 1024  # S3 multipart minimum, the smallest chunk that is its own part
+MAX_CHUNK_SIZE = 1024 * 1024 * 1024
+DEFAULT_CHUNK_SIZE = 8 * 1024 * 1024
+
+BUSY_BACKOFF = 0.25
+MAX_BUSY_BACKOFF = 5.0
+
+
+@dataclass
+class Completed:
+    s3_key: str
+    size: int
+
+
+@dataclass
+class ChunkResult:
+    index: int
+    received: int
+    total: int
+    duplicate: bool = False
+    bytes_per_sec: int = 0  # Server-measured rate, 0 until known
+    eta: Optional[float] = None  # Seconds, None until known
+    complete: Optional[Completed] = None
+    contiguous: int = 0  # Every chunk below this index is acknowledged
+
+
+@dataclass
+class Status:
+    state: str
+    received: int
+    total: int
+    missing: List[int] = field(default_factory=list)  # HTTP only
+
+
+def chunk_layout(size, chunk_size):
+    chunk_size = chunk_size or DEFAULT_CHUNK_SIZE
+    if not MIN_SMALL_CHUNK_SIZE <= chunk_size <= MAX_CHUNK_SIZE:
+        raise ValueError(
+            f"chunk size {chunk_size} out of range [{MIN_SMALL_CHUNK_SIZE}, {MAX_CHUNK_SIZE}]"
+        )
+    if size <= 0:
+        raise ValueError("cannot upload an empty file")
+    return chunk_size, (size + chunk_size - 1) // chunk_size
+
+
+class UploadMixin:
+    """upload_file / resume_file on top of a transport's chunk commands.
+
+    Transports implement init_upload, upload_chunk, status, pause, cancel,
+    _missing_chunks(session_id) and _clone() (a client safe to use from
+    another thread).
+    """
+
+    def upload_file(
+        self,
+        path,
+        name=None,
+        chunk_size=None,
+        parallelism=1,
+        on_session: Optional[Callable[[str], None]] = None,
+        on_chunk: Optional[Callable[[ChunkResult], None]] = None,
+    ) -> Completed:
+        """Upload the file at path in a new session.
+
+        on_session receives the session ID before any chunk is sent, so it can
+        be saved for resume_file. on_chunk is called after every acknowledged
+        chunk, never concurrently.
+        """
+        size = os.path.getsize(path)
+        chunk_size, total = chunk_layout(size, chunk_size)
+        session_id = self.init_upload(name or os.path.basename(path), total, chunk_size)
+        if on_session:
+            on_session(session_id)
+        return self._send_chunks(
+            session_id, path, size, chunk_size, total, list(range(total)), parallelism, on_chunk
+        )
+
+    def resume_file(
+        self,
+        session_id,
+        path,
+        chunk_size=None,
+        parallelism=1,
+        on_chunk: Optional[Callable[[ChunkResult], None]] = None,
+    ) -> Completed:
+        """Send the chunks of an existing session the server has not received.
+        The file and chunk size must be the ones the session started with."""
+        size = os.path.getsize(path)
+        chunk_size, total = chunk_layout(size, chunk_size)
+
+        status = self.status(session_id)
+        if status.total != total:
+            raise UploadError(
+                f"session has {status.total} chunks but the file splits into {total}; "
+                "use the original chunk size"
+            )
+        if status.state not in ("initialized", "uploading", "paused"):
+            raise UploadError(f"session is {status.state} and cannot be resumed")
+
+        missing = self._missing_chunks(session_id)
+        if not missing:
+            raise UploadError("server has every chunk but the session is not complete")
+        return self._send_chunks(
+            session_id, path, size, chunk_size, total, missing, parallelism, on_chunk
+        )
+
+    def _send_chunks(self, session_id, path, size, chunk_size, total, chunks, parallelism, on_chunk):
+        lock = threading.Lock()
+        done = [True] * total
+        for index in chunks:
+            done[index] = False
+        state = {"contiguous": 0, "completed": None}
+
+        def advance():
+            while state["contiguous"] < total and done[state["contiguous"]]:
+                state["contiguous"] += 1
+
+        advance()
+
+        local = threading.local()
+        clients = []
+
+        def worker_client():
+            # The first worker uses this client; others get their own connection
+            client = getattr(local, "client", None)
+            if client is None:
+                with lock:
+                    client = self if not clients else self._clone()
+                    clients.append(client)
+                local.client = client
+            return client
+
+        def send(index):
+            client = worker_client()
+            offset = index * chunk_size
+            with open(path, "rb") as f:
+                f.seek(offset)
+                data = f.read(min(chunk_size, size - offset))
+
+            backoff = BUSY_BACKOFF
+            while True:
+                try:
+                    result = client.upload_chunk(session_id, index, data)
+                    break
+                except BusyError:
+                    time.sleep(backoff)
+                    backoff = min(backoff * 2, MAX_BUSY_BACKOFF)
+
+            with lock:
+                done[index] = True
+                advance()
+                result.contiguous = state["contiguous"]
+                if on_chunk:
+                    on_chunk(result)
+                if result.complete:
+                    state["completed"] = result.complete
+
+        workers = max(1, min(parallelism, len(chunks)))
+        try:
+            with ThreadPoolExecutor(max_workers=workers) as pool:
+                futures = [pool.submit(send, index) for index in chunks]
+                finished, _ = wait(futures, return_when=FIRST_EXCEPTION)
+                for future in finished:
+                    error = future.exception()
+                    if error:
+                        for other in futures:
+                            other.cancel()
+                        raise error
+        finally:
+            for client in clients:
+                if client is not self:
+                    client.close()
+
+        if state["completed"] is None:
+            raise UploadError("all chunks sent but the server did not complete the upload")
+        return state["completed"]
@@ -0,0 +1,27 @@
+// hash.worker.ts - SHA-256 of chunk blobs off the main thread
+//
+// Request:  { id: number, blob: Blob }
+// Response: { id: number, sha256: string } or { id: number, error: string }
+
+export type HashRequest = { id: number; blob: Blob };
+export type HashResponse = { id: number; sha256?: string; error?: string };
+
+// Typed by hand so the package compiles against the DOM lib alone
+const scope = self as unknown as {
+  onmessage: ((event: MessageEvent<HashRequest>) => void) | null;
+  postMessage(message: HashResponse): void;
+};
+
+scope.onmessage = async (event: MessageEvent<HashRequest>) => {
+  const { id, blob } = event.data;
+  try {
+    const digest = await crypto.subtle.digest("SHA-256", await blob.arrayBuffer());
+    scope.postMessage({ id, sha256: toHex(digest) } satisfies HashResponse);
+  } catch (err) {
+    scope.postMessage({ id, error: String(err) } satisfies HashResponse);
+  }
+};
+
+function toHex(buffer: ArrayBuffer): string {
+  return Array.from(new Uint8Array(buffer), (b) => b.toString(16).padStart(2, "0")).join("");
+}
@@ -0,0 +1,460 @@
+// index.ts - Browser client for the HTTP chunk upload API
+//
+//   const client = new UploadClient({ baseUrl: "https://gateway.example", token });
+//   const upload = client.upload(file, { onProgress: (p) => render(p) });
+//   upload.pause();  upload.resume();  upload.cancel();
+//   const { s3Key, size } = await upload.done;
+//
+// Files are cut with File.slice and sent as parallel multipart POSTs to
+// /upload/chunk. Each chunk's SHA-256 is computed in a worker and sent along
+// so the server can reject corrupted chunks. Resuming (also after a page
+// reload, given the session ID) asks /upload/status for the missing chunks.
+
+import type { HashRequest, HashResponse } from "./hash.worker.js";
+
+// Binary protocol codecs, generated from gnet-backend/protocol/protocol.json
+export * as protocol from "./protocol.gen.js";
+
+// The binary protocol over WebSocket, for pipelined uploads
+export { BinarySocket } from "./socket.js";
+
+// The Go SDK compiled to WebAssembly, an alternative to UploadClient
+export { loadWasmCore } from "./wasm.js";
+export type { WasmCore, WasmUpload, WasmUploadOptions } from "./wasm.js";
+
+// Limits mirror the server (gnet-backend/main.go). Chunks under
+// MIN_CHUNK_SIZE are accepted and combined into S3 parts by the server.
+export const MIN_SMALL_CHUNK_SIZE = 256 * 1024;
+export const MIN_CHUNK_SIZE = 5 * 1024 * 1024;
+export const MAX_CHUNK_SIZE = 1024 * 1024 * 1024;
+export const DEFAULT_CHUNK_SIZE = 8 * 1024 * 1024;
+export const DEFAULT_CONCURRENCY = 4;
+export const DEFAULT_RETRIES = 3;
+
+export type UploadState = "initialized" | "uploading" | "paused" | "finalizing" | "completed" | "cancelled" | "failed";
+
+export interface ClientOptions {
+  baseUrl: string;
+  token: string;
+  fetch?: typeof fetch;
+}
+
+export interface UploadOptions {
+  name?: string;
+  chunkSize?: number;
+  concurrency?: number; // Chunks in flight at once
+  retries?: number; // Per chunk, for network errors, 429 and 5xx
+  hash?: boolean; // Send a worker-computed SHA-256 with each chunk (default true)
+  sessionId?: string; // Continue an existing session instead of starting one
+  onSession?: (sessionId: string) => void;
+  onProgress?: (progress: Progress) => void;
+}
+
+export interface Progress {
+  sessionId: string;
+  received: number;
+  total: number;
+  bytesSent: number;
+  bytesTotal: number;
+  bytesPerSecond: number; // Measured by the server
+  etaSeconds: number | null;
+  state: UploadState;
+}
+
+export interface Completed {
+  sessionId: string;
+  s3Key: string;
+  size: number;
+}
+
+export interface SessionStatus {
+  session_id: string;
+  file_name: string;
+  s3_key: string;
+  state: string;
+  received: number;
+  total: number;
+  chunk_size: number;
+  missing: number[];
+}
+
+interface InitResponse {
+  session_id: string;
+  s3_key: string;
+  total_chunks: number;
+  chunk_size: number;
+}
+
+interface ChunkResponse {
+  chunk_index: number;
+  duplicate: boolean;
+  received: number;
+  total: number;
+  bytes_per_second: number;
+  eta_seconds: number | null;
+  state: string;
+  complete: boolean;
+  s3_key?: string;
+  size?: number;
+}
+
+export class UploadError extends Error {
+  constructor(message: string, readonly status: number) {
+    super(message);
+    this.name = "UploadError";
+  }
+}
+
+// ============================================
+// Client
+// ============================================
+
+export class UploadClient {
+  private readonly baseUrl: string;
+  private readonly fetchImpl: typeof fetch;
+  private hasher: Hasher | null = null;
+
+  constructor(private readonly options: ClientOptions) {
+    this.baseUrl = options.baseUrl.replace(/\/+$/, "");
+    this.fetchImpl = options.fetch ?? fetch.bind(globalThis);
+  }
+
+  upload(file: File | Blob, options: UploadOptions = {}): Upload {
+    const upload = new Upload(this, file, options);
+    upload.start();
+    return upload;
+  }
+
+  status(sessionId: string, signal?: AbortSignal): Promise<SessionStatus> {
+    return this.request<SessionStatus>("GET", `/upload/status/${encodeURIComponent(sessionId)}`, undefined, signal);
+  }
+
+  pause(sessionId: string): Promise<SessionStatus> {
+    return this.request<SessionStatus>("POST", `/upload/pause/${encodeURIComponent(sessionId)}`);
+  }
+
+  resume(sessionId: string): Promise<SessionStatus> {
+    return this.request<SessionStatus>("POST", `/upload/resume/${encodeURIComponent(sessionId)}`);
+  }
+
+  async cancel(sessionId: string): Promise<void> {
+    await this.request<void>("POST", `/upload/cancel/${encodeURIComponent(sessionId)}`);
+  }
+
+  /** Releases the hashing worker. */
+  close(): void {
+    this.hasher?.terminate();
+    this.hasher = null;
+  }
+
+  /** @internal */
+  init(name: string, totalChunks: number, chunkSize: number, signal?: AbortSignal): Promise<InitResponse> {
+    const body = JSON.stringify({ file_name: name, total_chunks: totalChunks, chunk_size: chunkSize });
+    return this.request<InitResponse>("POST", "/upload/init", body, signal);
+  }
+
+  /** @internal */
+  sendChunk(sessionId: string, index: number, blob: Blob, sha256: string | null, signal?: AbortSignal): Promise<ChunkResponse> {
+    // The server reads the fields before the chunk part, so order matters
+    const form = new FormData();
+    form.append("session_id", sessionId);
+    form.append("chunk_index", String(index));
+    if (sha256) {
+      form.append("sha256", sha256);
+    }
+    form.append("size", String(blob.size));
+    form.append("chunk", blob, `chunk-${index}`);
+    return this.request<ChunkResponse>("POST", "/upload/chunk", form, signal);
+  }
+
+  /** @internal */
+  hash(blob: Blob): Promise<string> {
+    if (!this.hasher) {
+      this.hasher = new Hasher();
+    }
+    return this.hasher.hash(blob);
+  }
+
+  private async request<T>(method: string, path: string, body?: BodyInit, signal?: AbortSignal): Promise<T> {
+    const headers: Record<string, string> = { Authorization: `Bearer ${this.options.token}` };
+    if (typeof body === "string") {
+      headers["Content-Type"] = "application/json";
+    }
+
+    const resp = await this.fetchImpl(this.baseUrl + path, { method, headers, body, signal });
+    if (!resp.ok) {
+      let message = resp.statusText;
+      try {
+        message = ((await resp.json()) as { error?: string }).error ?? message;
+      } catch {
+        // Not a JSON error body
+      }
+      throw new UploadError(message, resp.status);
+    }
+    if (resp.status === 204) {
+      return undefined as T;
+    }
+    return (await resp.json()) as T;
+  }
+}
+
+// ============================================
+// Upload
+// ============================================
+
+export class Upload {
+  readonly done: Promise<Completed>;
+  sessionId: string | null;
+
+  private state: UploadState = "uploading";
+  private readonly chunkSize: number;
+  private readonly totalChunks: number;
+  private readonly pending: number[] = [];
+  private controller = new AbortController();
+  private runId = 0;
+  private bytesSent = 0;
+  private resolve!: (value: Completed) => void;
+  private reject!: (reason: unknown) => void;
+
+  constructor(
+    private readonly client: UploadClient,
+    private readonly file: File | Blob,
+    private readonly options: UploadOptions,
+  ) {
+    this.chunkSize = options.chunkSize ?? DEFAULT_CHUNK_SIZE;
+    if (this.chunkSize < MIN_SMALL_CHUNK_SIZE || this.chunkSize > MAX_CHUNK_SIZE) {
+      throw new RangeError(`chunkSize must be between ${MIN_SMALL_CHUNK_SIZE} and ${MAX_CHUNK_SIZE} bytes`);
+    }
+    this.totalChunks = Math.max(1, Math.ceil(file.size / this.chunkSize));
+    this.sessionId = options.sessionId ?? null;
+    this.done = new Promise<Completed>((resolve, reject) => {
+      this.resolve = resolve;
+      this.reject = reject;
+    });
+    // Callers that only use the callbacks should not see unhandled rejections
+    this.done.catch(() => undefined);
+  }
+
+  get currentState(): UploadState {
+    return this.state;
+  }
+
+  /** @internal */
+  start(): void {
+    void this.run(this.runId);
+  }
+
+  /** Aborts the chunks in flight and pauses the server session. */
+  async pause(): Promise<void> {
+    if (this.state !== "uploading") {
+      return;
+    }
+    this.state = "paused";
+    this.runId++;
+    this.controller.abort();
+    if (this.sessionId) {
+      await this.client.pause(this.sessionId);
+    }
+  }
+
+  /** Continues with whatever chunks the server is still missing. */
+  async resume(): Promise<void> {
+    if (this.state !== "paused") {
+      return;
+    }
+    this.state = "uploading";
+    this.controller = new AbortController();
+    void this.run(++this.runId);
+  }
+
+  async cancel(): Promise<void> {
+    if (this.state === "completed" || this.state === "cancelled") {
+      return;
+    }
+    this.state = "cancelled";
+    this.runId++;
+    this.controller.abort();
+    if (this.sessionId) {
+      await this.client.cancel(this.sessionId);
+    }
+    this.reject(new UploadError("Upload was cancelled", 0));
+  }
+
+  private async run(runId: number): Promise<void> {
+    const signal = this.controller.signal;
+    try {
+      if (this.sessionId) {
+        await this.loadMissing(signal);
+      } else {
+        const init = await this.client.init(this.fileName(), this.totalChunks, this.chunkSize, signal);
+        this.sessionId = init.session_id;
+        this.options.onSession?.(init.session_id);
+        this.pending.splice(0, this.pending.length, ...Array.from({ length: this.totalChunks }, (_, i) => i));
+      }
+
+      const workers = Array.from({ length: Math.max(1, this.options.concurrency ?? DEFAULT_CONCURRENCY) }, () =>
+        this.drain(runId, signal),
+      );
+      const results = await Promise.all(workers);
+      const completed = results.find((r): r is Completed => r !== null);
+      if (completed) {
+        this.state = "completed";
+        this.resolve(completed);
+        return;
+      }
+
+      // Every chunk was sent but another request finalized; confirm with the server
+      if (runId === this.runId && this.state === "uploading") {
+        await this.awaitCompletion(runId, signal);
+      }
+    } catch (err) {
+      if (runId !== this.runId || signal.aborted) {
+        return; // Paused or cancelled
+      }
+      this.state = "failed";
+      this.reject(err);
+    }
+  }
+
+  /** Resumes a paused server session and queues the chunks it lacks. */
+  private async loadMissing(signal: AbortSignal): Promise<void> {
+    let status = await this.client.status(this.sessionId!, signal);
+    if (status.state === "paused") {
+      status = await this.client.resume(this.sessionId!);
+    }
+    if (status.chunk_size !== this.chunkSize && status.total > 1) {
+      throw new UploadError(`Session uses ${status.chunk_size} byte chunks, not ${this.chunkSize}`, 0);
+    }
+    this.pending.splice(0, this.pending.length, ...status.missing);
+    this.bytesSent = (status.total - status.missing.length) * this.chunkSize;
+  }
+
+  /** One concurrency slot: takes chunks off the queue until it is empty. */
+  private async drain(runId: number, signal: AbortSignal): Promise<Completed | null> {
+    let completed: Completed | null = null;
+    for (let index = this.pending.shift(); index !== undefined; index = this.pending.shift()) {
+      if (runId !== this.runId) {
+        this.pending.unshift(index);
+        return null;
+      }
+      const resp = await this.sendWithRetry(index, signal);
+      this.bytesSent = Math.min(this.bytesSent + this.chunkBlob(index).size, this.file.size);
+      this.report(resp);
+      if (resp.complete && resp.s3_key) {
+        completed = { sessionId: this.sessionId!, s3Key: resp.s3_key, size: resp.size ?? this.file.size };
+      }
+    }
+    return completed;
+  }
+
+  private async sendWithRetry(index: number, signal: AbortSignal): Promise<ChunkResponse> {
+    const blob = this.chunkBlob(index);
+    const sha256 = this.options.hash === false ? null : await this.client.hash(blob);
+    const retries = this.options.retries ?? DEFAULT_RETRIES;
+
+    for (let attempt = 0; ; attempt++) {
+      try {
+        return await this.client.sendChunk(this.sessionId!, index, blob, sha256, signal);
+      } catch (err) {
+        const retryable = !(err instanceof UploadError) || err.status >= 500 || err.status === 422 || err.status === 429;
+        if (!retryable || attempt >= retries || signal.aborted) {
+          throw err;
+        }
+        await sleep(Math.min(500 * 2 ** attempt, 10_000), signal);
+      }
+    }
+  }
+
+  /** Polls status while another request is still finalizing the upload. */
+  private async awaitCompletion(runId: number, signal: AbortSignal): Promise<void> {
+    for (let attempt = 0; runId === this.runId; attempt++) {
+      const status = await this.client.status(this.sessionId!, signal);
+      if (status.state === "completed") {
+        this.state = "completed";
+        this.resolve({ sessionId: this.sessionId!, s3Key: status.s3_key, size: this.file.size });
+        return;
+      }
+      if (status.state === "failed" || status.state === "cancelled") {
+        throw new UploadError(`Upload ${status.state}`, 0);
+      }
+      if (status.missing.length > 0) {
+        throw new UploadError(`Server is missing ${status.missing.length} chunks`, 0);
+      }
+      await sleep(Math.min(250 * 2 ** attempt, 5_000), signal);
+    }
+  }
+
+  private report(resp: ChunkResponse): void {
+    this.options.onProgress?.({
+      sessionId: this.sessionId!,
+      received: resp.received,
+      total: resp.total,
+      bytesSent: this.bytesSent,
+      bytesTotal: this.file.size,
+      bytesPerSecond: resp.bytes_per_second,
+      etaSeconds: resp.eta_seconds,
+      state: resp.complete ? "completed" : (resp.state as UploadState),
+    });
+  }
+
+  private chunkBlob(index: number): Blob {
+    const start = index * this.chunkSize;
+    return this.file.slice(start, Math.min(start + this.chunkSize, this.file.size));
+  }
+
+  private fileName(): string {
+    if (this.options.name) {
+      return this.options.name;
+    }
+    return this.file instanceof File ? this.file.name : "upload.bin";
+  }
+}
+
+// ============================================
+// Hashing
+// ============================================
+
+class Hasher {
+  private readonly worker = new Worker(new URL("./hash.worker.js", import.meta.url), { type: "module" });
+  private readonly waiting = new Map<number, { resolve: (hex: string) => void; reject: (err: Error) => void }>();
+  private nextId = 0;
+
+  constructor() {
+    this.worker.onmessage = (event: MessageEvent<HashResponse>) => {
+      const { id, sha256, error } = event.data;
+      const entry = this.waiting.get(id);
+      this.waiting.delete(id);
+      if (sha256 !== undefined) {
+        entry?.resolve(sha256);
+      } else {
+        entry?.reject(new Error(error ?? "hash failed"));
+      }
+    };
+  }
+
+  hash(blob: Blob): Promise<string> {
+    const id = this.nextId++;
+    return new Promise((resolve, reject) => {
+      this.waiting.set(id, { resolve, reject });
+      this.worker.postMessage({ id, blob } satisfies HashRequest);
+    });
+  }
+
+  terminate(): void {
+    this.worker.terminate();
+    for (const entry of this.waiting.values()) {
+      entry.reject(new Error("hasher terminated"));
+    }
+    this.waiting.clear();
+  }
+}
+
+function sleep(ms: number, signal: AbortSignal): Promise<void> {
+  return new Promise((resolve, reject) => {
+    const timer = setTimeout(resolve, ms);
+    signal.addEventListener("abort", () => {
+      clearTimeout(timer);
+      reject(signal.reason);
+    }, { once: true });
+  });
+}
@@ -0,0 +1,66 @@
+// socket.ts - The binary protocol over the server's WebSocket bridge
+//
+//   const socket = await BinarySocket.connect("wss://gateway.example/upload/ws", token);
+//   const ready = await socket.send({ code: protocol.CMD_INIT_UPLOAD, fileName, totalChunks, chunkSize });
+//   socket.close();
+//
+// GET /upload/ws (gnet-backend/websocket.go, WEBSOCKET_UPLOADS=1) carries the
+// frames of the binary port, so commands can be pipelined like a native
+// client's: send() does not wait for earlier replies. The server answers in
+// the order the commands were sent, one response per message, so replies are
+// matched by position. RESP_ERROR and the other failures resolve like any
+// response; only a closed socket rejects.
+
+import { decodeResponse, encodeFrame } from "./protocol.gen.js";
+import type { Command, Response } from "./protocol.gen.js";
+
+export class BinarySocket {
+  private readonly waiting: { resolve: (resp: Response) => void; reject: (err: Error) => void }[] = [];
+  private closed: Error | null = null;
+
+  private constructor(private readonly ws: WebSocket, private readonly token: string) {
+    ws.binaryType = "arraybuffer";
+    ws.onmessage = (event: MessageEvent<ArrayBuffer>) => {
+      const decoded = decodeResponse(new Uint8Array(event.data));
+      const entry = this.waiting.shift();
+      if (!decoded) {
+        entry?.reject(new Error("truncated response"));
+        return;
+      }
+      entry?.resolve(decoded.response);
+    };
+    ws.onclose = (event) => {
+      this.closed = new Error(`socket closed (${event.code}${event.reason ? `: ${event.reason}` : ""})`);
+      for (const entry of this.waiting.splice(0)) {
+        entry.reject(this.closed);
+      }
+    };
+  }
+
+  static connect(url: string, token: string): Promise<BinarySocket> {
+    return new Promise((resolve, reject) => {
+      const ws = new WebSocket(url);
+      ws.onopen = () => resolve(new BinarySocket(ws, token));
+      ws.onerror = () => reject(new Error(`failed to connect to ${url}`));
+    });
+  }
+
+  /** Bytes queued by send() and not yet handed to the network. */
+  get bufferedAmount(): number {
+    return this.ws.bufferedAmount;
+  }
+
+  send(cmd: Command): Promise<Response> {
+    if (this.closed) {
+      return Promise.reject(this.closed);
+    }
+    return new Promise((resolve, reject) => {
+      this.waiting.push({ resolve, reject });
+      this.ws.send(encodeFrame(this.token, cmd));
+    });
+  }
+
+  close(): void {
+    this.ws.close();
+  }
+}
@@ -0,0 +1,68 @@
+// wasm.ts - The Go SDK's upload state machine, compiled to WebAssembly
+//
+//   <script src="wasm_exec.js"></script>   (from `npm run build:wasm`)
+//   const core = await loadWasmCore(new URL("hpu.wasm", import.meta.url));
+//   const upload = core.upload(file, { baseUrl, token, onProgress: (p) => render(p) });
+//   const { s3Key, size } = await upload.done;
+//
+// An alternative to UploadClient that runs gnet-backend/client over the
+// same HTTP chunk API, so the browser chunks, hashes, retries and adapts
+// exactly like the native SDK. The handle matches Upload.
+
+import type { Completed, Progress, UploadState } from "./index.js";
+
+export interface WasmUploadOptions {
+  baseUrl: string;
+  token: string;
+  name?: string;
+  chunkSize?: number; // Required to resume a session started with a non-default size
+  concurrency?: number; // Parallel chunk requests (default 4)
+  retries?: number; // Per request, for network errors
+  adaptive?: boolean; // Size chunks and concurrency from measured throughput
+  sessionId?: string; // Continue an existing session instead of starting one
+  onSession?: (sessionId: string) => void;
+  onProgress?: (progress: Progress) => void;
+}
+
+export interface WasmUpload {
+  readonly done: Promise<Completed>;
+  readonly sessionId: string | null;
+  readonly state: UploadState;
+  pause(): Promise<void>;
+  resume(): Promise<void>;
+  cancel(): Promise<void>;
+}
+
+export interface WasmCore {
+  upload(file: File | Blob, options: WasmUploadOptions): WasmUpload;
+}
+
+interface GoRuntime {
+  importObject: WebAssembly.Imports;
+  run(instance: WebAssembly.Instance): Promise<void>;
+}
+
+type Globals = typeof globalThis & {
+  Go?: new () => GoRuntime;
+  hpu?: WasmCore;
+};
+
+let loading: Promise<WasmCore> | null = null;
+
+/** Instantiates hpu.wasm once; wasm_exec.js must already be loaded. */
+export function loadWasmCore(url: string | URL): Promise<WasmCore> {
+  loading ??= (async () => {
+    const globals = globalThis as Globals;
+    if (!globals.Go) {
+      throw new Error("wasm_exec.js from the Go distribution must be loaded before hpu.wasm");
+    }
+    const go = new globals.Go();
+    const { instance } = await WebAssembly.instantiateStreaming(fetch(url), go.importObject);
+    void go.run(instance);
+    if (!globals.hpu) {
+      throw new Error("hpu.wasm did not register globalThis.hpu");
+    }
+    return globals.hpu;
+  })();
+  return loading;
+}